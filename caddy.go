@@ -15,6 +15,7 @@ package caddy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -70,21 +71,35 @@ type Instance struct {
 	// servers is the list of servers with their listeners.
 	servers []serverListener
 
+	// validating is true if this instance is only used to
+	// validate its Caddyfile and will never be started
+	validating bool
+
 	// these callbacks execute when certain events occur
 	onFirstStartup  []func() error // starting, not as part of a restart
 	onStartup       []func() error // starting, even as part of a restart
 	onRestart       []func() error // before restart commences
 	onShutdown      []func() error // stopping, even as part of a restart
 	onFinalShutdown []func() error // stopping, not as part of a restart
+	onFinalStop     []func() error // stopped, not as part of a restart
+	onStartupFailed []func() error // failed to start, even as part of a restart
 }
 
 // Stop stops all servers contained in i. It does NOT
-// execute shutdown callbacks.
+// execute shutdown callbacks. It returns ErrConnsCut if
+// any server had to close connections forcibly.
 func (i *Instance) Stop() error {
+	var cut bool
+
+	EmitEvent(InstanceShutdownEvent, InstanceEventInfo{Instance: i, ServerType: i.serverType})
+
 	// stop the servers
 	for _, s := range i.servers {
 		if gs, ok := s.server.(GracefulServer); ok {
-			if err := gs.Stop(); err != nil {
+			err := gs.Stop()
+			if err == ErrConnsCut {
+				cut = true
+			} else if err != nil {
 				log.Printf("[ERROR] Stopping %s: %v", gs.Address(), err)
 			}
 		}
@@ -100,6 +115,9 @@ func (i *Instance) Stop() error {
 	}
 	instancesMu.Unlock()
 
+	if cut {
+		return ErrConnsCut
+	}
 	return nil
 }
 
@@ -173,6 +191,7 @@ func (i *Instance) Restart(newCaddyfile Input) (*Instance, error) {
 	// attempt to start new instance
 	err := startWithListenerFds(newCaddyfile, newInst, restartFds)
 	if err != nil {
+		EmitEvent(InstanceRestartEvent, InstanceRestartEventInfo{Old: i, Caddyfile: newCaddyfile, Err: err})
 		return i, err
 	}
 
@@ -186,6 +205,7 @@ func (i *Instance) Restart(newCaddyfile Input) (*Instance, error) {
 	i.Stop()
 
 	log.Println("[INFO] Reloading complete")
+	EmitEvent(InstanceRestartEvent, InstanceRestartEventInfo{Old: i, New: newInst, Caddyfile: newCaddyfile})
 
 	return newInst, nil
 }
@@ -313,6 +333,11 @@ type GracefulServer interface {
 	Address() string
 }
 
+// ErrConnsCut is returned by the Stop method of a GracefulServer
+// when connections were still open at the end of its grace period
+// and had to be closed forcibly.
+var ErrConnsCut = errors.New("connections were closed forcibly")
+
 // Listener is a net.Listener with an underlying file descriptor.
 // A server's listener should implement this interface if it is
 // to support zero-downtime reloads.
@@ -347,6 +372,16 @@ type AfterStartup interface {
 // is returned. Consequently, this function never returns a nil
 // value as long as there are no errors.
 func LoadCaddyfile(serverType string) (Input, error) {
+	// A new process started by an upgrade serves the same
+	// Caddyfile as its parent
+	if IsUpgrade() {
+		handoff, err := loadUpgradeHandoff()
+		if err != nil {
+			return nil, err
+		}
+		return handoff.Caddyfile, nil
+	}
+
 	// Ask plugged-in loaders for a Caddyfile
 	cdyfile, err := loadCaddyfileInput(serverType)
 	if err != nil {
@@ -410,16 +445,56 @@ func (i *Instance) Caddyfile() Input {
 //
 // This function blocks until all the servers are listening.
 func Start(cdyfile Input) (*Instance, error) {
+	var restartFds map[string]restartTriple
+	if IsUpgrade() {
+		var err error
+		restartFds, err = inheritUpgradeState()
+		if err != nil {
+			signalUpgradeParent(err)
+			return nil, err
+		}
+	}
+
 	writePidFile()
 	inst := &Instance{serverType: cdyfile.ServerType(), wg: new(sync.WaitGroup)}
-	return inst, startWithListenerFds(cdyfile, inst, nil)
+	err := startWithListenerFds(cdyfile, inst, restartFds)
+
+	if IsUpgrade() {
+		// the new servers have their own copies of the inherited
+		// listeners, so these can be closed either way
+		for _, old := range restartFds {
+			if old.listener != nil {
+				old.listener.Close()
+			}
+			if old.packet != nil {
+				old.packet.Close()
+			}
+		}
+		closeInheritedExtras()
+		signalUpgradeParent(err)
+	}
+
+	return inst, err
 }
 
-func startWithListenerFds(cdyfile Input, inst *Instance, restartFds map[string]restartTriple) error {
+func startWithListenerFds(cdyfile Input, inst *Instance, restartFds map[string]restartTriple) (err error) {
 	if cdyfile == nil {
 		cdyfile = CaddyfileInput{}
 	}
 
+	// an instance that fails to start is discarded, so what its
+	// setup did that would outlive it must be undone
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, fn := range inst.onStartupFailed {
+			if err := fn(); err != nil {
+				log.Printf("[ERROR] Startup failure callback: %v", err)
+			}
+		}
+	}()
+
 	stypeName := cdyfile.ServerType()
 
 	stype, err := getServerType(stypeName)
@@ -444,7 +519,7 @@ func startWithListenerFds(cdyfile Input, inst *Instance, restartFds map[string]r
 		return err
 	}
 
-	err = executeDirectives(inst, cdyfile.Path(), stype.Directives, sblocks)
+	err = executeDirectives(inst, cdyfile.Path(), stype.directives(), sblocks)
 	if err != nil {
 		return err
 	}
@@ -497,6 +572,8 @@ func startWithListenerFds(cdyfile Input, inst *Instance, restartFds map[string]r
 		}
 	}
 
+	EmitEvent(InstanceStartupEvent, InstanceEventInfo{Instance: inst, ServerType: stypeName})
+
 	return nil
 }
 
@@ -506,6 +583,17 @@ func executeDirectives(inst *Instance, filename string,
 	// map of server block ID to map of directive name to whatever.
 	storages := make(map[int]map[string]interface{})
 
+	// when validating, keep going after an error so that
+	// all of them can be reported at once
+	var errs errorList
+	fail := func(err error) error {
+		if !inst.validating {
+			return err
+		}
+		errs = append(errs, err)
+		return nil
+	}
+
 	// It is crucial that directives are executed in the proper order.
 	// We loop with the directives on the outer loop so we execute
 	// a directive for all server blocks before going to the next directive.
@@ -523,6 +611,7 @@ func executeDirectives(inst *Instance, filename string,
 					controller := &Controller{
 						instance:  inst,
 						Key:       key,
+						Directive: dir,
 						Dispenser: caddyfile.NewDispenserTokens(filename, tokens),
 						OncePerServerBlock: func(f func() error) error {
 							var err error
@@ -542,9 +631,19 @@ func executeDirectives(inst *Instance, filename string,
 						return err
 					}
 
+					dirCtx, ok := inst.context.(DirectiveContext)
+					if ok {
+						dirCtx.SetDirective(key, dir)
+					}
 					err = setup(controller)
+					if ok {
+						dirCtx.SetDirective(key, "")
+					}
 					if err != nil {
-						return err
+						if err := fail(err); err != nil {
+							return err
+						}
+						continue
 					}
 
 					storages[i][dir] = controller.ServerBlockStorage // persist for this server block
@@ -557,15 +656,133 @@ func executeDirectives(inst *Instance, filename string,
 			callbacks := allCallbacks[dir]
 			for _, callback := range callbacks {
 				if err := callback(inst.context); err != nil {
-					return err
+					if err := fail(err); err != nil {
+						return err
+					}
 				}
 			}
 		}
 	}
 
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+// Validate loads cdyfile and executes the setup functions of all
+// its directives, but does not start any servers. It is a dry
+// run: no listeners are opened, and directives are told (via
+// Controller.Validating) to skip other side effects, like
+// obtaining certificates. Instead of stopping at the first error,
+// it collects as many as it can find. It returns the server
+// blocks that were parsed along with the errors.
+func Validate(cdyfile Input) ([]caddyfile.ServerBlock, []error) {
+	inst, sblocks, errs := validate(cdyfile)
+	if inst != nil {
+		inst.ShutdownCallbacks() // undo whatever the setup functions registered
+	}
+	return sblocks, errs
+}
+
+// validate does the work of Validate. It also returns the
+// instance that the directives were executed for, if any;
+// the caller must execute its shutdown callbacks.
+func validate(cdyfile Input) (*Instance, []caddyfile.ServerBlock, []error) {
+	if cdyfile == nil {
+		cdyfile = CaddyfileInput{}
+	}
+
+	stypeName := cdyfile.ServerType()
+	stype, err := getServerType(stypeName)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+
+	// parse without checking directives so that every
+	// unknown directive can be reported, not only the first
+	sblocks, err := caddyfile.Parse(cdyfile.Path(), bytes.NewReader(cdyfile.Body()), nil)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	if len(sblocks) == 0 && stype.DefaultInput != nil {
+		newInput := stype.DefaultInput()
+		sblocks, err = caddyfile.Parse(newInput.Path(), bytes.NewReader(newInput.Body()), nil)
+		if err != nil {
+			return nil, nil, []error{err}
+		}
+	}
+
+	var errs []error
+	directives := stype.directives()
+	for _, sb := range sblocks {
+		if len(sb.Keys) == 0 {
+			continue // global options are checked by the server type
+		}
+		for dir, tokens := range sb.Tokens {
+			if !directiveIsValid(directives, dir) {
+				d := caddyfile.NewDispenserTokens(cdyfile.Path(), tokens)
+				d.Next()
+				errs = append(errs, d.Errf("Unknown directive '%s'", dir))
+				delete(sb.Tokens, dir)
+			}
+		}
+	}
+
+	inst := &Instance{serverType: stypeName, wg: new(sync.WaitGroup), validating: true}
+	inst.caddyfileInput = cdyfile
+	inst.context = stype.NewContext()
+	if inst.context == nil {
+		return nil, sblocks, append(errs, fmt.Errorf("server type %s produced a nil Context", stypeName))
+	}
+	if vctx, ok := inst.context.(ValidatingContext); ok {
+		vctx.SetValidating()
+	}
+
+	sblocks, err = inst.context.InspectServerBlocks(cdyfile.Path(), sblocks)
+	if err != nil {
+		return inst, sblocks, append(errs, err)
+	}
+
+	err = executeDirectives(inst, cdyfile.Path(), directives, sblocks)
+	if list, ok := err.(errorList); ok {
+		errs = append(errs, list...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return inst, sblocks, errs
+	}
+
+	_, err = inst.context.MakeServers()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return inst, sblocks, errs
+}
+
+// directiveIsValid returns true if dir is in directives.
+func directiveIsValid(directives []string, dir string) bool {
+	for _, d := range directives {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// errorList is a list of errors that is itself an error.
+type errorList []error
+
+// Error returns the messages of all the errors, one per line.
+func (l errorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
 func startServers(serverList []Server, inst *Instance, restartFds map[string]restartTriple) error {
 	errChan := make(chan error, len(serverList))
 
@@ -692,21 +909,31 @@ func loadServerBlocks(serverType, filename string, input io.Reader) ([]caddyfile
 // Stop stops ALL servers. It blocks until they are all stopped.
 // It does NOT execute shutdown callbacks, and it deletes all
 // instances after stopping is completed. Do not re-use any
-// references to old instances after calling Stop.
+// references to old instances after calling Stop. It returns
+// ErrConnsCut if any server had to close connections forcibly.
 func Stop() error {
+	var cut bool
+
 	// This awkward for loop is to avoid a deadlock since
 	// inst.Stop() also acquires the instancesMu lock.
 	for {
 		instancesMu.Lock()
 		if len(instances) == 0 {
+			instancesMu.Unlock()
 			break
 		}
 		inst := instances[0]
 		instancesMu.Unlock()
-		if err := inst.Stop(); err != nil {
+		err := inst.Stop()
+		if err == ErrConnsCut {
+			cut = true
+		} else if err != nil {
 			log.Printf("[ERROR] Stopping %s: %v", inst.serverType, err)
 		}
 	}
+	if cut {
+		return ErrConnsCut
+	}
 	return nil
 }
 
@@ -723,16 +950,6 @@ func IsLoopback(addr string) bool {
 		strings.HasPrefix(host, "127.")
 }
 
-// Upgrade re-launches the process, preserving the listeners
-// for a graceful restart. It does NOT load new configuration;
-// it only starts the process anew with a fresh binary.
-//
-// TODO: This is not yet implemented
-func Upgrade() error {
-	return fmt.Errorf("not implemented")
-	// TODO: have child process set isUpgrade = true
-}
-
 // IsUpgrade returns true if this process is part of an upgrade
 // where a parent caddy process spawned this one to ugprade
 // the binary.
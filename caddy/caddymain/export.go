@@ -0,0 +1,29 @@
+package caddymain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/mholt/caddy"
+)
+
+// exportCaddyfile writes the configuration loaded from input
+// to out as JSON, or the errors in input to errOut. It returns
+// the exit status of the process: 0 if input is valid, 1 if not.
+func exportCaddyfile(out, errOut io.Writer, input caddy.Input) int {
+	export, errs := caddy.Export(input)
+	for _, err := range errs {
+		fmt.Fprintln(errOut, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	fmt.Fprintf(out, "%s\n", data)
+	return 0
+}
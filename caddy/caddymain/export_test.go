@@ -0,0 +1,64 @@
+package caddymain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestExportCaddyfile(t *testing.T) {
+	caddy.Quiet = true
+	defer func() { caddy.Quiet = false }()
+
+	for _, test := range []struct {
+		caddyfile string
+		secrets   []string
+	}{
+		{"testdata/export/Caddyfile", []string{"s3cret", "hunter2"}},
+		// one secret for each directive that can have one
+		{"testdata/export/secrets.Caddyfile", []string{"basicauth-s3cret", "proxy-s3cret", "trace-s3cret",
+			"admin-s3cret", "$2a$04$"}},
+	} {
+		contents, err := ioutil.ReadFile(test.caddyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(test.caddyfile + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := caddy.CaddyfileInput{Contents: contents, Filepath: test.caddyfile, ServerTypeName: "http"}
+
+		var out, errOut bytes.Buffer
+		if status := exportCaddyfile(&out, &errOut, input); status != 0 {
+			t.Fatalf("%s: Expected status 0, got %d (errors: %s)", test.caddyfile, status, errOut.String())
+		}
+		if !bytes.Equal(out.Bytes(), expected) {
+			t.Errorf("Expected export to match %s.json, got:\n%s", test.caddyfile, out.String())
+		}
+		for _, secret := range test.secrets {
+			if bytes.Contains(out.Bytes(), []byte(secret)) {
+				t.Errorf("%s: Expected '%s' to be redacted", test.caddyfile, secret)
+			}
+		}
+	}
+}
+
+func TestExportCaddyfileErrors(t *testing.T) {
+	caddy.Quiet = true
+	defer func() { caddy.Quiet = false }()
+
+	input := caddy.CaddyfileInput{Contents: []byte("localhost:2015 {\n  proxy\n}"), Filepath: "Caddyfile", ServerTypeName: "http"}
+	var out, errOut bytes.Buffer
+	if status := exportCaddyfile(&out, &errOut, input); status != 1 {
+		t.Errorf("Expected status 1, got %d", status)
+	}
+	if out.Len() > 0 {
+		t.Errorf("Expected no export, got: %s", out.String())
+	}
+	if !bytes.Contains(errOut.Bytes(), []byte("Caddyfile:2 - Parse error: Wrong argument count")) {
+		t.Errorf("Expected argument error, got: %s", errOut.String())
+	}
+}
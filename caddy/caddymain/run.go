@@ -1,6 +1,7 @@
 package caddymain
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,16 +30,23 @@ func init() {
 	setVersion()
 
 	flag.BoolVar(&caddytls.Agreed, "agree", false, "Agree to the CA's Subscriber Agreement")
+	flag.StringVar(&auditLog, "audit-log", "", "Certificate audit log to record -revoke in")
+	flag.BoolVar(&auditChain, "audit-chain", false, "Hash-chain the entry that -revoke adds to -audit-log")
 	flag.StringVar(&caddytls.DefaultCAUrl, "ca", "https://acme-v01.api.letsencrypt.org/directory", "URL to certificate authority's ACME server directory")
-	flag.StringVar(&conf, "conf", "", "Caddyfile to load (default \""+caddy.DefaultConfigFile+"\")")
+	flag.StringVar(&conf, "conf", "", "Caddyfile, directory of Caddyfiles or comma-separated list of them to load (default \""+caddy.DefaultConfigFile+"\")")
 	flag.StringVar(&cpu, "cpu", "100%", "CPU cap")
 	flag.BoolVar(&plugins, "plugins", false, "List installed plugins")
 	flag.StringVar(&caddytls.DefaultEmail, "email", "", "Default ACME CA account email address")
+	flag.BoolVar(&exportJSON, "export-json", false, "Print the configuration as JSON and exit")
 	flag.StringVar(&logfile, "log", "", "Process log file")
 	flag.StringVar(&caddy.PidFile, "pidfile", "", "Path to write pid file")
 	flag.BoolVar(&caddy.Quiet, "quiet", false, "Quiet mode (no initialization output)")
 	flag.StringVar(&revoke, "revoke", "", "Hostname for which to revoke the certificate")
+	flag.BoolVar(&rolloverAccount, "rollover-account", false, "Replace the key of the CA account with a new one")
 	flag.StringVar(&serverType, "type", "http", "Type of server to run")
+	flag.BoolVar(&validate, "validate", false, "Check the Caddyfile for errors and exit")
+	flag.StringVar(&verifyAuditLog, "verify-audit-log", "", "Check the hash chain of a certificate audit log and exit")
+	flag.BoolVar(&verbose, "verbose", false, "Print the parsed Caddyfile when used with -validate")
 	flag.BoolVar(&version, "version", false, "Show version")
 
 	caddy.RegisterCaddyfileLoader("flag", caddy.LoaderFunc(confLoader))
@@ -48,7 +56,9 @@ func init() {
 // Run is Caddy's main() function.
 func Run() {
 	flag.Parse()
-	moveStorage() // TODO: This is temporary for the 0.9 release, or until most users upgrade to 0.9+
+	if !validate && !exportJSON {
+		moveStorage() // TODO: This is temporary for the 0.9 release, or until most users upgrade to 0.9+
+	}
 
 	caddy.AppName = appName
 	caddy.AppVersion = appVersion
@@ -73,13 +83,30 @@ func Run() {
 
 	// Check for one-time actions
 	if revoke != "" {
-		err := caddytls.Revoke(revoke)
+		err := caddytls.Revoke(revoke, auditLog, auditChain)
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Printf("Revoked certificate for %s\n", revoke)
 		os.Exit(0)
 	}
+	if verifyAuditLog != "" {
+		n, err := caddytls.VerifyAuditLog(verifyAuditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", verifyAuditLog, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d entries, hash chain intact\n", verifyAuditLog, n)
+		os.Exit(0)
+	}
+	if rolloverAccount {
+		err := caddytls.RolloverAccountKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Rolled over account key")
+		os.Exit(0)
+	}
 	if version {
 		fmt.Printf("%s %s\n", appName, appVersion)
 		if devBuild && gitShortStat != "" {
@@ -91,6 +118,24 @@ func Run() {
 		fmt.Println(caddy.DescribePlugins())
 		os.Exit(0)
 	}
+	if validate {
+		caddy.Quiet = true
+		caddyfile, err := caddy.LoadCaddyfile(serverType)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(validateCaddyfile(os.Stdout, os.Stderr, caddyfile, verbose))
+	}
+	if exportJSON {
+		caddy.Quiet = true
+		caddyfile, err := caddy.LoadCaddyfile(serverType)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(exportCaddyfile(os.Stdout, os.Stderr, caddyfile))
+	}
 
 	// Set CPU cap
 	err := setCPU(cpu)
@@ -137,6 +182,10 @@ func confLoader(serverType string) (caddy.Input, error) {
 		return caddy.CaddyfileFromPipe(os.Stdin)
 	}
 
+	if info, err := os.Stat(conf); strings.Contains(conf, ",") || err == nil && info.IsDir() {
+		return multiFileLoader(conf, serverType)
+	}
+
 	contents, err := ioutil.ReadFile(conf)
 	if err != nil {
 		return nil, err
@@ -148,6 +197,92 @@ func confLoader(serverType string) (caddy.Input, error) {
 	}, nil
 }
 
+// multiFileLoader loads the Caddyfiles that conf names as one.
+// conf is a comma-separated list of Caddyfiles and directories;
+// a directory stands for the Caddyfiles in it, in lexical order.
+// The returned Caddyfile imports each of the files, so that they
+// are parsed as one but tokens still know the file they came from.
+func multiFileLoader(conf, serverType string) (caddy.Input, error) {
+	var files []string
+	for _, name := range strings.Split(conf, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		dirFiles, err := caddyfilesInDir(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(dirFiles) == 0 {
+			return nil, fmt.Errorf("no Caddyfiles in directory %s", name)
+		}
+		files = append(files, dirFiles...)
+	}
+
+	var contents bytes.Buffer
+	for _, file := range files {
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&contents, "import '%s'\n", strings.Replace(escapeGlob(absFile), "'", "\\'", -1))
+	}
+	return caddy.CaddyfileInput{
+		Contents:       contents.Bytes(),
+		Filepath:       conf,
+		ServerTypeName: serverType,
+	}, nil
+}
+
+// escapeGlob escapes the characters of name that import would
+// match other files with, by putting each in a character class
+// of its own, since Windows has no escape character to do it.
+func escapeGlob(name string) string {
+	var escaped bytes.Buffer
+	for _, ch := range name {
+		if ch == '*' || ch == '?' || ch == '[' || ch == '\\' && runtime.GOOS != "windows" {
+			escaped.WriteByte('[')
+			if ch == '\\' {
+				escaped.WriteByte('\\')
+			}
+			escaped.WriteRune(ch)
+			escaped.WriteByte(']')
+			continue
+		}
+		escaped.WriteRune(ch)
+	}
+	return escaped.String()
+}
+
+// caddyfilesInDir returns the files in dir in lexical order,
+// skipping directories, hidden files and editor backups.
+func caddyfilesInDir(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() ||
+			strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, "~") ||
+			strings.HasSuffix(name, ".swp") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
 // defaultLoader loads the Caddyfile from the current working directory.
 func defaultLoader(serverType string) (caddy.Input, error) {
 	contents, err := ioutil.ReadFile(caddy.DefaultConfigFile)
@@ -265,13 +400,20 @@ const appName = "Caddy"
 
 // Flags that control program flow or startup
 var (
-	serverType string
-	conf       string
-	cpu        string
-	logfile    string
-	revoke     string
-	version    bool
-	plugins    bool
+	serverType      string
+	conf            string
+	cpu             string
+	logfile         string
+	revoke          string
+	auditLog        string
+	auditChain      bool
+	rolloverAccount bool
+	version         bool
+	plugins         bool
+	validate        bool
+	verifyAuditLog  string
+	exportJSON      bool
+	verbose         bool
 )
 
 // Build information obtained with the help of -ldflags
@@ -1,8 +1,15 @@
 package caddymain
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/mholt/caddy"
 )
 
 func TestSetCPU(t *testing.T) {
@@ -42,3 +49,62 @@ func TestSetCPU(t *testing.T) {
 		runtime.GOMAXPROCS(currentCPU)
 	}
 }
+
+func TestMultiFileLoader(t *testing.T) {
+	caddy.Quiet = true
+	defer func() { caddy.Quiet = false }()
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	emptyDir, err := ioutil.TempDir("", "caddy_conf_d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyDir)
+
+	// a directory whose name import would match other files with
+	globDir, err := ioutil.TempDir("", "caddy_conf_[a]*?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(globDir)
+	if err := ioutil.WriteFile(filepath.Join(globDir, "Caddyfile"), []byte("localhost:2015"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		conf      string
+		loadErr   string // substring expected in the error loading
+		status    int
+		errOutput string // substring expected in the output of validating
+	}{
+		{"testdata/conf.d", "", 0, ""},
+		{"testdata/conf.d/01-first.conf, testdata/conf.d/02-second.conf", "", 0, ""},
+		{"testdata/conf.d-broken", "", 1, "02-broken.conf:3 - Parse error: Wrong argument count"},
+		{"testdata/conf.d,testdata/duplicate.conf", "", 1, "duplicate site address: localhost:2015"},
+		{emptyDir, "no Caddyfiles in directory", 0, ""},
+		{globDir, "", 0, ""},
+		{"testdata/conf.d,testdata/nonexistent", "nonexistent", 0, ""},
+	} {
+		conf = test.conf
+		input, err := confLoader("http")
+		if test.loadErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.loadErr) {
+				t.Errorf("Test %d: Expected error containing '%s', got: %v", i, test.loadErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error loading, got: %v", i, err)
+			continue
+		}
+		var out, errOut bytes.Buffer
+		status := validateCaddyfile(&out, &errOut, input, false)
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d (errors: %s)", i, test.status, status, errOut.String())
+		}
+		if test.errOutput != "" && !strings.Contains(errOut.String(), test.errOutput) {
+			t.Errorf("Test %d: Expected errors to contain '%s', got: %s", i, test.errOutput, errOut.String())
+		}
+	}
+}
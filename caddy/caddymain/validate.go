@@ -0,0 +1,91 @@
+package caddymain
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// validateCaddyfile checks input for errors without starting
+// any servers and writes them to errOut. If verbose is true,
+// the parsed server blocks are written to out. It returns
+// the exit status of the process: 0 if input is valid, 1 if not.
+func validateCaddyfile(out, errOut io.Writer, input caddy.Input, verbose bool) int {
+	sblocks, errs := caddy.Validate(input)
+	if verbose {
+		printServerBlocks(out, caddy.ValidDirectives(input.ServerType()), sblocks)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(errOut, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintf(out, "Valid configuration: %s\n", input.Path())
+	return 0
+}
+
+// printServerBlocks writes sblocks to w in a normalized form:
+// one block per site with braces, one directive per line in
+// the order that the directives are executed, and nested
+// blocks indented with tabs.
+func printServerBlocks(w io.Writer, directives []string, sblocks []caddyfile.ServerBlock) {
+	for i, sb := range sblocks {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s {\n", strings.Join(sb.Keys, ", "))
+		for _, dir := range directives {
+			tokens, ok := sb.Tokens[dir]
+			if !ok {
+				continue
+			}
+			printTokens(w, tokens)
+		}
+		fmt.Fprintln(w, "}")
+	}
+}
+
+// printTokens writes the lines of tokens, which belong to one
+// directive, indented by one tab plus their nesting depth.
+func printTokens(w io.Writer, tokens []caddyfile.Token) {
+	nesting := 0
+	for i, token := range tokens {
+		newLine := i == 0 || token.Line != tokens[i-1].Line || token.File != tokens[i-1].File
+		if newLine {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			indent := nesting + 1
+			if token.IsBrace("}") {
+				indent--
+			}
+			fmt.Fprint(w, strings.Repeat("\t", indent))
+		} else {
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprint(w, quoteToken(token))
+		if token.IsBrace("{") {
+			nesting++
+		} else if token.IsBrace("}") {
+			nesting--
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// quoteToken quotes the text of token if it would not be
+// read back as the same single token otherwise.
+func quoteToken(token caddyfile.Token) string {
+	text := token.Text
+	if token.IsBrace("{") || token.IsBrace("}") {
+		return text
+	}
+	if text != "" && text != "{" && text != "}" && !strings.ContainsAny(text, " \t\r\n\"") {
+		return text
+	}
+	return `"` + strings.Replace(text, `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,77 @@
+package caddymain
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestValidateCaddyfile(t *testing.T) {
+	caddy.Quiet = true
+	defer func() { caddy.Quiet = false }()
+
+	for i, test := range []struct {
+		input  string
+		status int
+		errs   []string // substrings expected in the error output, in order
+	}{
+		{"localhost:2015 {\n  gzip\n  proxy / localhost:8080 {\n    health_check_interval 10s\n  }\n}", 0, nil},
+		{"localhost:2015 {\n  gzip\n", 1, []string{"Caddyfile:2 - Syntax error: Unexpected token 'gzip'"}},
+		{"localhost:2015, {\n  gzip\n}", 1, []string{"Expected another address"}},
+		{"localhost:2015 {\n  gzip\n  nonexistent\n  proxy / localhost:8080 {\n    health_check_interval soon\n  }\n}", 1, []string{
+			"Caddyfile:3 - Parse error: Unknown directive 'nonexistent'",
+			"invalid duration",
+		}},
+		{"localhost:2015 {\n  proxy / localhost:8080 {\n    health_check_interval soon\n  }\n}\nlocalhost:2016 {\n  proxy\n}", 1, []string{
+			"invalid duration",
+			"Caddyfile:7 - Parse error: Wrong argument count",
+		}},
+	} {
+		var out, errOut bytes.Buffer
+		input := caddy.CaddyfileInput{Contents: []byte(test.input), Filepath: "Caddyfile", ServerTypeName: "http"}
+		status := validateCaddyfile(&out, &errOut, input, false)
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d (errors: %s)", i, test.status, status, errOut.String())
+		}
+		lines := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+		if len(test.errs) == 0 && errOut.Len() > 0 {
+			t.Errorf("Test %d: Expected no errors, got: %s", i, errOut.String())
+		} else if len(test.errs) > 0 && len(lines) != len(test.errs) {
+			t.Errorf("Test %d: Expected %d errors, got %d: %s", i, len(test.errs), len(lines), errOut.String())
+			continue
+		}
+		for j, expected := range test.errs {
+			if !strings.Contains(lines[j], expected) {
+				t.Errorf("Test %d: Expected error %d to contain '%s', got '%s'", i, j, expected, lines[j])
+			}
+		}
+	}
+}
+
+func TestValidateCaddyfileVerbose(t *testing.T) {
+	caddy.Quiet = true
+	defer func() { caddy.Quiet = false }()
+
+	input := caddy.CaddyfileInput{
+		Contents:       []byte("localhost:2015,\n  localhost:2016\nproxy / localhost:8080 {\n    header_upstream X-Name \"a b\"\n}\ngzip"),
+		Filepath:       "Caddyfile",
+		ServerTypeName: "http",
+	}
+	var out, errOut bytes.Buffer
+	if status := validateCaddyfile(&out, &errOut, input, true); status != 0 {
+		t.Fatalf("Expected status 0, got %d: %s", status, errOut.String())
+	}
+	expected := "localhost:2015, localhost:2016 {\n" +
+		"\tgzip\n" +
+		"\terrors\n" +
+		"\tproxy / localhost:8080 {\n" +
+		"\t\theader_upstream X-Name \"a b\"\n" +
+		"\t}\n" +
+		"}\n" +
+		"Valid configuration: Caddyfile\n"
+	if out.String() != expected {
+		t.Errorf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
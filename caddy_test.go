@@ -1,6 +1,15 @@
 package caddy
 
-import "testing"
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+)
 
 /*
 // TODO
@@ -56,3 +65,94 @@ func TestIsLoopback(t *testing.T) {
 		}
 	}
 }
+
+func TestStartupFailedCallbacks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	for i, test := range []struct {
+		input     CaddyfileInput
+		shouldRun bool
+	}{
+		{CaddyfileInput{Contents: []byte(addr), ServerTypeName: "nonexistent"}, true},
+		{CaddyfileInput{Contents: []byte(addr), ServerTypeName: "upgradetest"}, true}, // address in use
+		{CaddyfileInput{Contents: []byte("127.0.0.1:0"), ServerTypeName: "upgradetest"}, false},
+	} {
+		var ran bool
+		inst := &Instance{serverType: test.input.ServerTypeName, wg: new(sync.WaitGroup)}
+		inst.onStartupFailed = append(inst.onStartupFailed, func() error {
+			ran = true
+			return errors.New("logged, not returned")
+		})
+		err := startWithListenerFds(test.input, inst, nil)
+		if test.shouldRun != (err != nil) {
+			t.Errorf("Test %d: Expected error %v, got: %v", i, test.shouldRun, err)
+		}
+		if ran != test.shouldRun {
+			t.Errorf("Test %d: Expected the startup failure callbacks to run %v, got %v", i, test.shouldRun, ran)
+		}
+		for _, s := range inst.servers {
+			s.listener.Close()
+		}
+		instancesMu.Lock()
+		for j, other := range instances {
+			if other == inst {
+				instances = append(instances[:j], instances[j+1:]...)
+				break
+			}
+		}
+		instancesMu.Unlock()
+	}
+}
+
+// directiveTestContext records the directive that is being set up
+// for each key whenever the setup function of dirtest runs.
+type directiveTestContext struct {
+	current map[string]string
+	seen    []string
+}
+
+func (ctx *directiveTestContext) InspectServerBlocks(_ string, sblocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, error) {
+	return sblocks, nil
+}
+
+func (ctx *directiveTestContext) MakeServers() ([]Server, error) { return nil, nil }
+
+func (ctx *directiveTestContext) SetDirective(key, directive string) {
+	ctx.current[key] = directive
+}
+
+func TestDirectiveContext(t *testing.T) {
+	RegisterServerType("directivetest", ServerType{
+		Directives: []string{"dirtest"},
+		NewContext: func() Context { return &directiveTestContext{current: make(map[string]string)} },
+	})
+	RegisterPlugin("dirtest", Plugin{
+		ServerType: "directivetest",
+		Action: func(c *Controller) error {
+			ctx := c.Context().(*directiveTestContext)
+			ctx.seen = append(ctx.seen, c.Key+" "+ctx.current[c.Key])
+			return nil
+		},
+	})
+
+	sblocks, err := caddyfile.Parse("Testfile", strings.NewReader("a b {\n\tdirtest\n}"), []string{"dirtest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &directiveTestContext{current: make(map[string]string)}
+	inst := &Instance{serverType: "directivetest", context: ctx}
+	if err := executeDirectives(inst, "Testfile", []string{"dirtest"}, sblocks); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := []string{"a dirtest", "b dirtest"}; !reflect.DeepEqual(ctx.seen, expected) {
+		t.Errorf("Expected the directive to be set around its setup for each key, got %v", ctx.seen)
+	}
+	if ctx.current["a"] != "" || ctx.current["b"] != "" {
+		t.Errorf("Expected no directive after the setup, got %v", ctx.current)
+	}
+}
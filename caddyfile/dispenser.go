@@ -97,7 +97,7 @@ func (d *Dispenser) NextLine() bool {
 func (d *Dispenser) NextBlock() bool {
 	if d.nesting > 0 {
 		d.Next()
-		if d.Val() == "}" {
+		if d.isBrace("}") {
 			d.nesting--
 			return false
 		}
@@ -106,12 +106,12 @@ func (d *Dispenser) NextBlock() bool {
 	if !d.NextArg() { // block must open on same line
 		return false
 	}
-	if d.Val() != "{" {
+	if !d.isBrace("{") {
 		d.cursor-- // roll back if not opening brace
 		return false
 	}
 	d.Next()
-	if d.Val() == "}" {
+	if d.isBrace("}") {
 		// Open and then closed right away
 		return false
 	}
@@ -134,6 +134,15 @@ func (d *Dispenser) Val() string {
 	return d.tokens[d.cursor].Text
 }
 
+// isBrace returns true if the current token is the curly
+// brace brace, and not a quoted word that reads like one.
+func (d *Dispenser) isBrace(brace string) bool {
+	if d.cursor < 0 || d.cursor >= len(d.tokens) {
+		return false
+	}
+	return d.tokens[d.cursor].IsBrace(brace)
+}
+
 // Line gets the line number of the current token. If there is no token
 // loaded, it returns 0.
 func (d *Dispenser) Line() int {
@@ -181,7 +190,7 @@ func (d *Dispenser) RemainingArgs() []string {
 	var args []string
 
 	for d.NextArg() {
-		if d.Val() == "{" {
+		if d.isBrace("{") {
 			d.cursor--
 			break
 		}
@@ -196,7 +205,7 @@ func (d *Dispenser) RemainingArgs() []string {
 // a line break or open curly brace was encountered instead of
 // an argument.
 func (d *Dispenser) ArgErr() error {
-	if d.Val() == "{" {
+	if d.isBrace("{") {
 		return d.Err("Unexpected token '{', expecting argument")
 	}
 	return d.Errf("Wrong argument count or unexpected line ending after '%s'", d.Val())
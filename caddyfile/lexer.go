@@ -3,6 +3,7 @@ package caddyfile
 import (
 	"bufio"
 	"io"
+	"strings"
 	"unicode"
 )
 
@@ -10,7 +11,9 @@ type (
 	// lexer is a utility which can get values, token by
 	// token, from a Reader. A token is a word, and tokens
 	// are separated by whitespace. A word can be enclosed
-	// in quotes if it contains whitespace.
+	// in double quotes if it contains whitespace, or in
+	// single quotes if it should be taken literally. A
+	// heredoc makes a word of the lines up to its marker.
 	lexer struct {
 		reader *bufio.Reader
 		token  Token
@@ -22,9 +25,29 @@ type (
 		File string
 		Line int
 		Text string
+
+		// literal is true if the token was single-quoted,
+		// in which case no substitutions are made in it
+		literal bool
+
+		// quoted is true if the token was quoted or a
+		// heredoc, so that it is a word even if it reads
+		// like a curly brace
+		quoted bool
+
+		// imports is the chain of snippets and files that were
+		// imported to produce this token; it is used to resolve
+		// nested imports and to detect recursive ones
+		imports []string
 	}
 )
 
+// IsBrace returns true if t is the curly brace brace,
+// rather than a quoted word that reads like one.
+func (t Token) IsBrace(brace string) bool {
+	return !t.quoted && t.Text == brace
+}
+
 // load prepares the lexer to scan an input for tokens.
 // It discards any leading byte order mark.
 func (l *lexer) load(input io.Reader) error {
@@ -48,14 +71,19 @@ func (l *lexer) load(input io.Reader) error {
 // the token starts with a quotes character (")
 // in which case the token goes until the closing
 // quotes (the enclosing quotes are not included).
-// Inside quoted strings, quotes may be escaped
+// Tokens may also be enclosed in single quotes (')
+// which makes them literal. Inside quoted strings,
+// the enclosing quote character may be escaped
 // with a preceding \ character. No other chars
 // may be escaped. The rest of the line is skipped
-// if a "#" character is read in. Returns true if
-// a token was loaded; false otherwise.
+// if a "#" character is read in. A token that
+// starts with "<<" followed by a marker at the end
+// of the line is a heredoc; see heredoc. Returns
+// true if a token was loaded; false otherwise.
 func (l *lexer) next() bool {
 	var val []rune
 	var comment, quoted, escaped bool
+	var quote rune
 
 	makeToken := func() bool {
 		l.token.Text = string(val)
@@ -79,7 +107,7 @@ func (l *lexer) next() bool {
 				if ch == '\\' {
 					escaped = true
 					continue
-				} else if ch == '"' {
+				} else if ch == quote {
 					quoted = false
 					return makeToken()
 				}
@@ -89,7 +117,7 @@ func (l *lexer) next() bool {
 			}
 			if escaped {
 				// only escape quotes
-				if ch != '"' {
+				if ch != quote {
 					val = append(val, '\\')
 				}
 			}
@@ -122,12 +150,85 @@ func (l *lexer) next() bool {
 
 		if len(val) == 0 {
 			l.token = Token{Line: l.line}
-			if ch == '"' {
-				quoted = true
+			if ch == '"' || ch == '\'' {
+				quoted, quote = true, ch
+				l.token.literal = ch == '\''
+				l.token.quoted = true
 				continue
 			}
+			if ch == '<' {
+				if marker, ok := l.heredocMarker(); ok {
+					return l.heredoc(marker)
+				}
+			}
 		}
 
 		val = append(val, ch)
 	}
 }
+
+// heredocMarker returns the marker of the heredoc that
+// starts at the "<" that was just read, if there is one:
+// the rest of the line must be "<" and the marker, which
+// consists of letters, digits and underscores.
+func (l *lexer) heredocMarker() (string, bool) {
+	for n := 2; ; n++ {
+		peeked, err := l.reader.Peek(n)
+		if err != nil || peeked[0] != '<' {
+			return "", false
+		}
+		ch := peeked[n-1]
+		if ch == '\n' || ch == '\r' {
+			if n < 3 {
+				return "", false
+			}
+			return string(peeked[1 : n-1]), true
+		}
+		if ch != '_' && !('a' <= ch && ch <= 'z') && !('A' <= ch && ch <= 'Z') && !('0' <= ch && ch <= '9') {
+			return "", false
+		}
+	}
+}
+
+// heredoc loads the heredoc with marker as the token.
+// Its text is the lines after the one that opens it, up
+// to the line that consists of the marker, which are
+// taken as they are: nothing in them is special. The
+// indentation of the closing marker is removed from
+// every line, so that the text can be indented along
+// with the rest of the Caddyfile.
+func (l *lexer) heredoc(marker string) bool {
+	l.token.quoted = true
+	l.token.literal = false
+	if _, err := l.reader.ReadString('\n'); err != nil {
+		panic(err)
+	}
+	l.line++
+
+	var lines []string
+	for {
+		line, err := l.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		l.line++
+		line = strings.TrimRight(line, "\r\n")
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed == marker {
+			indent := line[:len(line)-len(trimmed)]
+			for i := range lines {
+				lines[i] = strings.TrimPrefix(lines[i], indent)
+			}
+			break
+		}
+		if err == io.EOF {
+			// like an unterminated quote, take what there is
+			if line != "" {
+				lines = append(lines, line)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	l.token.Text = strings.Join(lines, "\n")
+	return true
+}
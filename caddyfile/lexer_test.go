@@ -80,6 +80,21 @@ func TestLexer(t *testing.T) {
 				{Line: 1, Text: "B"},
 			},
 		},
+		{
+			input: `A 'single {$quoted} value' B`,
+			expected: []Token{
+				{Line: 1, Text: "A"},
+				{Line: 1, Text: "single {$quoted} value", literal: true},
+				{Line: 1, Text: "B"},
+			},
+		},
+		{
+			input: `'it\'s' "it's"`,
+			expected: []Token{
+				{Line: 1, Text: "it's", literal: true},
+				{Line: 1, Text: "it's"},
+			},
+		},
 		{
 			input: `"don't\escape"`,
 			expected: []Token{
@@ -128,6 +143,31 @@ func TestLexer(t *testing.T) {
 				{Line: 2, Text: "characters"},
 			},
 		},
+		{
+			input: "body <<EOF\n  {\n    \"a\": 1 # not a comment\n  }\n  EOF\nnext",
+			expected: []Token{
+				{Line: 1, Text: "body"},
+				{Line: 1, Text: "{\n  \"a\": 1 # not a comment\n}"},
+				{Line: 6, Text: "next"},
+			},
+		},
+		{
+			input: "body <<END_2\r\nline\r\n\r\nEOF\r\nEND_2",
+			expected: []Token{
+				{Line: 1, Text: "body"},
+				{Line: 1, Text: "line\n\nEOF"},
+			},
+		},
+		{
+			input: "not <<a heredoc <<\n<",
+			expected: []Token{
+				{Line: 1, Text: "not"},
+				{Line: 1, Text: "<<a"},
+				{Line: 1, Text: "heredoc"},
+				{Line: 1, Text: "<<"},
+				{Line: 2, Text: "<"},
+			},
+		},
 		{
 			input: "\xEF\xBB\xBF:8080", // test with leading byte order mark
 			expected: []Token{
@@ -167,5 +207,22 @@ func lexerCompare(t *testing.T, n int, expected, actual []Token) {
 				n, i, expected[i].Text, actual[i].Text)
 			break
 		}
+		if actual[i].literal != expected[i].literal {
+			t.Errorf("Test case %d token %d ('%s'): expected literal=%v but was %v",
+				n, i, expected[i].Text, expected[i].literal, actual[i].literal)
+			break
+		}
+	}
+}
+
+func TestLexerQuotedBraces(t *testing.T) {
+	tokens := tokenize("{ \"{\" '}' <<EOF\n}\nEOF\n}")
+	if len(tokens) != 5 {
+		t.Fatalf("Expected 5 tokens, got %d: %v", len(tokens), tokens)
+	}
+	for i, expected := range []bool{true, false, false, false, true} {
+		if got := tokens[i].IsBrace(tokens[i].Text); got != expected {
+			t.Errorf("Token %d (%q): expected IsBrace=%v but was %v", i, tokens[i].Text, expected, got)
+		}
 	}
 }
@@ -1,9 +1,11 @@
 package caddyfile
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -36,6 +38,9 @@ type parser struct {
 	block           ServerBlock // current server block being parsed
 	validDirectives []string    // a directive must be valid or it's an error
 	eof             bool        // if we encounter a valid EOF in a hard place
+	definedSnippets map[string][]Token
+	started         bool // if a block was parsed, so global options may not follow
+	global          bool // if the current block is the block of global options
 }
 
 func (p *parser) parseAll() ([]ServerBlock, error) {
@@ -46,9 +51,10 @@ func (p *parser) parseAll() ([]ServerBlock, error) {
 		if err != nil {
 			return blocks, err
 		}
-		if len(p.block.Keys) > 0 {
+		if len(p.block.Keys) > 0 || p.global {
 			blocks = append(blocks, p.block)
 		}
+		p.started = true
 	}
 
 	return blocks, nil
@@ -56,6 +62,7 @@ func (p *parser) parseAll() ([]ServerBlock, error) {
 
 func (p *parser) parseOne() error {
 	p.block = ServerBlock{Tokens: make(map[string][]Token)}
+	p.global = false
 
 	err := p.begin()
 	if err != nil {
@@ -81,6 +88,14 @@ func (p *parser) begin() error {
 		return nil
 	}
 
+	if name, ok := p.isSnippet(); ok {
+		return p.defineSnippet(name)
+	}
+
+	if len(p.block.Keys) == 0 && !p.started && p.isBrace("{") {
+		return p.globalOptions()
+	}
+
 	err = p.blockContents()
 	if err != nil {
 		return err
@@ -93,7 +108,10 @@ func (p *parser) addresses() error {
 	var expectingAnother bool
 
 	for {
-		tkn := replaceEnvVars(p.Val())
+		tkn, err := p.replaceEnvVars()
+		if err != nil {
+			return err
+		}
 
 		// special case: import directive replaces tokens during parse-time
 		if tkn == "import" && p.isNewLine() {
@@ -101,11 +119,16 @@ func (p *parser) addresses() error {
 			if err != nil {
 				return err
 			}
+			if p.cursor >= len(p.tokens) {
+				// nothing was imported at the end of the input
+				p.eof = true
+				break
+			}
 			continue
 		}
 
 		// Open brace definitely indicates end of addresses
-		if tkn == "{" {
+		if p.isBrace("{") {
 			if expectingAnother {
 				return p.Errf("Expected another address but had '%s' - check for extra comma", tkn)
 			}
@@ -122,6 +145,9 @@ func (p *parser) addresses() error {
 				expectingAnother = false // but we may still see another one on this line
 			}
 
+			if len(p.block.Keys) == 0 {
+				p.block.File, p.block.Line = p.File(), p.Line()
+			}
 			p.block.Keys = append(p.block.Keys, tkn)
 		}
 
@@ -172,7 +198,7 @@ func (p *parser) blockContents() error {
 func (p *parser) directives() error {
 	for p.Next() {
 		// end of server block
-		if p.Val() == "}" {
+		if p.isBrace("}") {
 			break
 		}
 
@@ -194,88 +220,251 @@ func (p *parser) directives() error {
 	return nil
 }
 
-// doImport swaps out the import directive and its argument
-// (a total of 2 tokens) with the tokens in the specified file
-// or globbing pattern. When the function returns, the cursor
-// is on the token before where the import directive was. In
-// other words, call Next() to access the first token that was
-// imported.
-func (p *parser) doImport() error {
-	// syntax check
-	if !p.NextArg() {
-		return p.ArgErr()
+// isSnippet returns the snippet name and true if the
+// current block is a snippet definition, which is a block
+// with a single key in parentheses, like "(common)".
+func (p *parser) isSnippet() (string, bool) {
+	keys := p.block.Keys
+	if len(keys) == 1 && len(keys[0]) > 2 &&
+		strings.HasPrefix(keys[0], "(") && strings.HasSuffix(keys[0], ")") {
+		return keys[0][1 : len(keys[0])-1], true
+	}
+	return "", false
+}
+
+// defineSnippet stores the tokens of the block that the
+// cursor is on as the snippet called name. The tokens are
+// kept as-is until the snippet is imported; the block
+// itself is not a server block, so its keys are cleared.
+func (p *parser) defineSnippet(name string) error {
+	if name == "optional" {
+		return p.Errf("Snippet name '%s' is reserved", name)
+	}
+	if _, ok := p.definedSnippets[name]; ok {
+		return p.Errf("Snippet '%s' is already defined", name)
 	}
-	importPattern := p.Val()
-	if p.NextArg() {
-		return p.Err("Import takes only one argument (glob pattern or file)")
+	if !p.isBrace("{") {
+		return p.Errf("Snippet '%s' must be followed by a block", name)
 	}
 
-	// make path relative to Caddyfile rather than current working directory (issue #867)
-	// and then use glob to get list of matching filenames
-	absFile, err := filepath.Abs(p.Dispenser.filename)
-	if err != nil {
-		return p.Errf("Failed to get absolute path of file: %s", p.Dispenser.filename)
+	var tokens []Token
+	nesting := 1
+	for p.Next() {
+		if p.isBrace("{") {
+			nesting++
+		} else if p.isBrace("}") {
+			nesting--
+			if nesting == 0 {
+				break
+			}
+		}
+		tokens = append(tokens, p.tokens[p.cursor])
+	}
+	if nesting > 0 {
+		return p.EOFErr()
 	}
 
-	var matches []string
-	var globPattern string
-	if !filepath.IsAbs(importPattern) {
-		globPattern = filepath.Join(filepath.Dir(absFile), importPattern)
-	} else {
-		globPattern = importPattern
+	if p.definedSnippets == nil {
+		p.definedSnippets = make(map[string][]Token)
 	}
-	matches, err = filepath.Glob(globPattern)
+	p.definedSnippets[name] = tokens
+	p.block.Keys = nil
+	return nil
+}
 
+// globalOptions parses the block that the cursor is on as the
+// block of global options, which is a block without addresses at
+// the start of the input. Its lines are grouped by option like
+// directives are, but they are not checked against the valid
+// directives; the server type reads them.
+func (p *parser) globalOptions() error {
+	p.global = true
+	p.block.File, p.block.Line = p.File(), p.Line()
+	validDirectives := p.validDirectives
+	p.validDirectives = nil
+	defer func() { p.validDirectives = validDirectives }()
+	return p.blockContents()
+}
+
+// doImport swaps out the import directive and its arguments
+// with the tokens of the named snippet or of the files that
+// match the globbing pattern. The syntax is:
+//
+//	import [optional] <snippet|pattern> [args...]
+//
+// Occurrences of {args.N} in the imported tokens are replaced
+// with the Nth argument. Unless optional is given, it is an
+// error for a pattern to match no files. When the function
+// returns, the cursor is on the token before where the import
+// directive was. In other words, call Next() to access the
+// first token that was imported.
+func (p *parser) doImport() error {
+	importToken := p.tokens[p.cursor]
+	start := p.cursor
+
+	// syntax check
+	if !p.NextArg() {
+		return p.ArgErr()
+	}
+	importPattern, err := p.replaceEnvVars()
 	if err != nil {
-		return p.Errf("Failed to use import pattern %s: %v", importPattern, err)
+		return err
 	}
-	if len(matches) == 0 {
-		return p.Errf("No files matching import pattern %s", importPattern)
+	var optional bool
+	if importPattern == "optional" && p.NextArg() {
+		optional = true
+		importPattern, err = p.replaceEnvVars()
+		if err != nil {
+			return err
+		}
+	}
+	var args []string
+	for p.NextArg() {
+		arg, err := p.replaceEnvVars()
+		if err != nil {
+			return err
+		}
+		args = append(args, arg)
 	}
 
-	// splice out the import directive and its argument (2 tokens total)
-	tokensBefore := p.tokens[:p.cursor-1]
-	tokensAfter := p.tokens[p.cursor+1:]
-
-	// collect all the imported tokens
 	var importedTokens []Token
-	for _, importFile := range matches {
-		newTokens, err := p.doSingleImport(importFile)
+	if snippet, ok := p.definedSnippets[importPattern]; ok {
+		importedTokens, err = p.importTokens(importToken, "("+importPattern+")", snippet, args)
+		if err != nil {
+			return err
+		}
+	} else {
+		matches, err := p.importMatches(importToken, importPattern)
 		if err != nil {
 			return err
 		}
-		var importLine int
-		importDir := filepath.Dir(importFile)
-		for i, token := range newTokens {
-			if token.Text == "import" {
-				importLine = token.Line
-				continue
+		if len(matches) == 0 && !optional {
+			return p.Errf("No files matching import pattern %s", importPattern)
+		}
+		for _, importFile := range matches {
+			newTokens, err := p.doSingleImport(importFile)
+			if err != nil {
+				return err
 			}
-			if token.Line == importLine {
-				var abs string
-				if !filepath.IsAbs(importFile) {
-					abs = filepath.Join(filepath.Dir(absFile), token.Text)
-				} else {
-					abs = filepath.Join(importDir, token.Text)
-				}
-				newTokens[i] = Token{
-					Text: abs,
-					Line: token.Line,
-					File: token.File,
-				}
+			newTokens, err = p.importTokens(importToken, importFile, newTokens, args)
+			if err != nil {
+				return err
 			}
+			importedTokens = append(importedTokens, newTokens...)
 		}
-		importedTokens = append(importedTokens, newTokens...)
 	}
 
+	// splice out the import directive and its arguments
+	tokensBefore := p.tokens[:start]
+	tokensAfter := p.tokens[p.cursor+1:]
+
 	// splice the imported tokens in the place of the import statement
 	// and rewind cursor so Next() will land on first imported token
 	p.tokens = append(tokensBefore, append(importedTokens, tokensAfter...)...)
-	p.cursor--
+	p.cursor = start
 
 	return nil
 }
 
+// importMatches returns the regular files matching importPattern.
+// A relative pattern is relative to the file that contains the
+// import, rather than the current working directory (issue #867).
+func (p *parser) importMatches(importToken Token, importPattern string) ([]string, error) {
+	globPattern := importPattern
+	if !filepath.IsAbs(importPattern) {
+		dir := ""
+		for i := len(importToken.imports) - 1; i >= 0; i-- {
+			if filepath.IsAbs(importToken.imports[i]) {
+				dir = filepath.Dir(importToken.imports[i])
+				break
+			}
+		}
+		if dir == "" {
+			absFile, err := filepath.Abs(p.Dispenser.filename)
+			if err != nil {
+				return nil, p.Errf("Failed to get absolute path of file: %s", p.Dispenser.filename)
+			}
+			dir = filepath.Dir(absFile)
+		}
+		globPattern = filepath.Join(dir, importPattern)
+	}
+
+	matches, err := filepath.Glob(globPattern)
+	if err != nil {
+		return nil, p.Errf("Failed to use import pattern %s: %v", importPattern, err)
+	}
+
+	var files []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, p.Errf("Could not import %s: %v", match, err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, match)
+	}
+	return files, nil
+}
+
+// importTokens returns copies of tokens, imported by importToken
+// from the snippet or file called name, with {args.N} replaced
+// by the corresponding argument. It is an error if name is
+// already being imported, since that would recurse forever.
+func (p *parser) importTokens(importToken Token, name string, tokens []Token, args []string) ([]Token, error) {
+	for _, imported := range importToken.imports {
+		if imported == name {
+			return nil, p.Errf("Recursive import of %s", strings.Trim(name, "()"))
+		}
+	}
+	chain := append(append([]string{}, importToken.imports...), name)
+
+	result := make([]Token, len(tokens))
+	for i, token := range tokens {
+		if !token.literal {
+			text, err := replaceArgs(token.Text, args)
+			if err != nil {
+				return nil, p.Err(err.Error())
+			}
+			token.Text = text
+		}
+		token.imports = chain
+		result[i] = token
+	}
+	return result, nil
+}
+
+// replaceArgs replaces the {args.N} placeholders in s with
+// the Nth element of args.
+func replaceArgs(s string, args []string) (string, error) {
+	const prefix = "{args."
+	var result string
+	for {
+		begin := strings.Index(s, prefix)
+		if begin < 0 {
+			break
+		}
+		end := strings.Index(s[begin:], "}")
+		if end < 0 {
+			break
+		}
+		end += begin
+		index, err := strconv.Atoi(s[begin+len(prefix) : end])
+		if err != nil {
+			result += s[:end+1]
+			s = s[end+1:]
+			continue
+		}
+		if index < 0 || index >= len(args) {
+			return "", fmt.Errorf("Argument %s is out of range; %d arguments given", s[begin:end+1], len(args))
+		}
+		result += s[:begin] + args[index]
+		s = s[end+1:]
+	}
+	return result + s, nil
+}
+
 // doSingleImport lexes the individual file at importFile and returns
 // its tokens or an error, if any.
 func (p *parser) doSingleImport(importFile string) ([]Token, error) {
@@ -314,17 +503,21 @@ func (p *parser) directive() error {
 	p.block.Tokens[dir] = append(p.block.Tokens[dir], p.tokens[p.cursor])
 
 	for p.Next() {
-		if p.Val() == "{" {
+		if p.isBrace("{") {
 			nesting++
 		} else if p.isNewLine() && nesting == 0 {
 			p.cursor-- // read too far
 			break
-		} else if p.Val() == "}" && nesting > 0 {
+		} else if p.isBrace("}") && nesting > 0 {
 			nesting--
-		} else if p.Val() == "}" && nesting == 0 {
+		} else if p.isBrace("}") && nesting == 0 {
 			return p.Err("Unexpected '}' because no matching opening brace")
 		}
-		p.tokens[p.cursor].Text = replaceEnvVars(p.tokens[p.cursor].Text)
+		text, err := p.replaceEnvVars()
+		if err != nil {
+			return err
+		}
+		p.tokens[p.cursor].Text = text
 		p.block.Tokens[dir] = append(p.block.Tokens[dir], p.tokens[p.cursor])
 	}
 
@@ -339,7 +532,7 @@ func (p *parser) directive() error {
 // because it returns an error if the token is not
 // a opening curly brace. It does NOT advance the token.
 func (p *parser) openCurlyBrace() error {
-	if p.Val() != "{" {
+	if !p.isBrace("{") {
 		return p.SyntaxErr("{")
 	}
 	return nil
@@ -350,7 +543,7 @@ func (p *parser) openCurlyBrace() error {
 // because it returns an error if the token is not
 // a closing curly brace. It does NOT advance the token.
 func (p *parser) closeCurlyBrace() error {
-	if p.Val() != "}" {
+	if !p.isBrace("}") {
 		return p.SyntaxErr("}")
 	}
 	return nil
@@ -369,34 +562,76 @@ func (p *parser) validDirective(dir string) bool {
 	return false
 }
 
+// replaceEnvVars returns the text of the current token with the
+// environment variables that appear in it replaced by their values.
+// Single-quoted tokens are returned as they are.
+func (p *parser) replaceEnvVars() (string, error) {
+	tkn := p.tokens[p.cursor]
+	if tkn.literal {
+		return tkn.Text, nil
+	}
+	text, err := replaceEnvVars(tkn.Text)
+	if err != nil {
+		return "", p.Err(err.Error())
+	}
+	return text, nil
+}
+
 // replaceEnvVars replaces environment variables that appear in the token
-// and understands both the $UNIX and %WINDOWS% syntaxes.
-func replaceEnvVars(s string) string {
-	s = replaceEnvReferences(s, "{%", "%}")
-	s = replaceEnvReferences(s, "{$", "}")
-	return s
+// and understands both the $UNIX and %WINDOWS% syntaxes. A variable may
+// be followed by a default value, as in {$VAR:default}, which is used if
+// the variable is not set; it is an error if it is not set and there is
+// no default.
+func replaceEnvVars(s string) (string, error) {
+	s, err := replaceEnvReferences(s, "{%", "%}")
+	if err != nil {
+		return "", err
+	}
+	return replaceEnvReferences(s, "{$", "}")
 }
 
 // replaceEnvReferences performs the actual replacement of env variables
 // in s, given the placeholder start and placeholder end strings.
-func replaceEnvReferences(s, refStart, refEnd string) string {
-	index := strings.Index(s, refStart)
-	for index != -1 {
-		endIndex := strings.Index(s, refEnd)
-		if endIndex != -1 {
-			ref := s[index : endIndex+len(refEnd)]
-			s = strings.Replace(s, ref, os.Getenv(ref[len(refStart):len(ref)-len(refEnd)]), -1)
-		} else {
-			return s
-		}
-		index = strings.Index(s, refStart)
-	}
-	return s
+// Values that are substituted in are not searched for references.
+func replaceEnvReferences(s, refStart, refEnd string) (string, error) {
+	var out []string
+	for {
+		start := strings.Index(s, refStart)
+		if start == -1 {
+			break
+		}
+		length := strings.Index(s[start+len(refStart):], refEnd)
+		if length == -1 {
+			break
+		}
+		ref := s[start+len(refStart) : start+len(refStart)+length]
+		name, def, hasDefault := ref, "", false
+		if i := strings.Index(ref, ":"); i != -1 {
+			name, def, hasDefault = ref[:i], ref[i+1:], true
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if !hasDefault {
+				return "", fmt.Errorf("Environment variable '%s' is not set and has no default", name)
+			}
+			value = def
+		}
+		out = append(out, s[:start], value)
+		s = s[start+len(refStart)+length+len(refEnd):]
+	}
+	return strings.Join(append(out, s), ""), nil
 }
 
 // ServerBlock associates any number of keys (usually addresses
-// of some sort) with tokens (grouped by directive name).
+// of some sort) with tokens (grouped by directive name). The
+// first server block has no keys if it is the block of global
+// options, whose tokens are grouped by option name instead.
 type ServerBlock struct {
 	Keys   []string
 	Tokens map[string][]Token
+
+	// File and Line are where the first key of the block is,
+	// or its opening brace if it has no keys
+	File string
+	Line int
 }
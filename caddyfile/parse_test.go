@@ -1,7 +1,10 @@
 package caddyfile
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -202,7 +205,15 @@ func TestParseOneAndImport(t *testing.T) {
 			"dir2": 2,
 		}},
 
-		{`import testdata/import_test1.txt testdata/import_test2.txt`, true, []string{}, map[string]int{}},
+		{`import testdata/import_args.txt host1 arg1`, false, []string{
+			"host1",
+		}, map[string]int{
+			"dir1": 2,
+		}},
+
+		{`import testdata/import_args.txt host1`, true, []string{}, map[string]int{}},
+
+		{`import optional testdata/not_found.txt`, false, []string{}, map[string]int{}},
 
 		{`import testdata/not_found.txt`, true, []string{}, map[string]int{}},
 
@@ -288,6 +299,23 @@ func TestParseAll(t *testing.T) {
 			{"glob1.host0"},
 			{"glob2.host0"},
 		}},
+
+		{`{
+			option1
+		  }
+		  localhost {
+		  }`, false, [][]string{
+			{},
+			{"localhost"},
+		}},
+
+		{`localhost {
+		  }
+		  {
+			dir1
+		  }`, false, [][]string{
+			{"localhost"},
+		}},
 	} {
 		p := testParser(test.input)
 		blocks, err := p.parseAll()
@@ -320,6 +348,55 @@ func TestParseAll(t *testing.T) {
 	}
 }
 
+func TestParseGlobalOptions(t *testing.T) {
+	input := "{\n\tmerge_duplicate_blocks\n\toption2 arg {\n\t\tsub\n\t}\n}\n\nhost1 {\n\tdir1\n}\nhost2, host3\n"
+	blocks, err := Parse("Caddyfile", strings.NewReader(input), []string{"dir1"})
+	if err != nil {
+		t.Fatalf("Expected global options not to be checked against the valid directives, got: %v", err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks, got %d", len(blocks))
+	}
+	options := blocks[0]
+	if len(options.Keys) != 0 {
+		t.Errorf("Expected the block of global options to have no keys, got %v", options.Keys)
+	}
+	if len(options.Tokens["merge_duplicate_blocks"]) != 1 || len(options.Tokens["option2"]) != 5 {
+		t.Errorf("Expected the tokens to be grouped by option, got %v", options.Tokens)
+	}
+	for i, expected := range []int{1, 8, 11} {
+		if blocks[i].Line != expected || blocks[i].File != "Caddyfile" {
+			t.Errorf("Block %d: Expected to be at Caddyfile:%d, got %s:%d", i, expected, blocks[i].File, blocks[i].Line)
+		}
+	}
+
+	if _, err := Parse("Caddyfile", strings.NewReader("{\n\tdir2\n}\nhost1 {\n\tdir2\n}"), []string{"dir1"}); err == nil {
+		t.Error("Expected the directives of server blocks to be checked")
+	}
+}
+
+func TestParseQuotedBraces(t *testing.T) {
+	p := testParser("localhost {\n\tdir1 \"}\" {\n\t\tbody '{'\n\t\tbody <<EOF\n{\n}\nEOF\n\t}\n\tdir2\n}")
+	p.validDirectives = []string{"dir1", "dir2"}
+	blocks, err := p.parseAll()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("Expected 1 server block, got %d", len(blocks))
+	}
+	var texts []string
+	for _, tkn := range blocks[0].Tokens["dir1"] {
+		texts = append(texts, tkn.Text)
+	}
+	if got, want := strings.Join(texts, " "), "dir1 } { body { body {\n} }"; got != want {
+		t.Errorf("Expected dir1 tokens to be %q, got %q", want, got)
+	}
+	if len(blocks[0].Tokens["dir2"]) != 1 {
+		t.Errorf("Expected dir2 to be parsed after dir1, got tokens %v", blocks[0].Tokens)
+	}
+}
+
 func TestEnvironmentReplacement(t *testing.T) {
 	os.Setenv("PORT", "8080")
 	os.Setenv("ADDRESS", "servername.com")
@@ -379,9 +456,8 @@ func TestEnvironmentReplacement(t *testing.T) {
 
 	// malformed (non-existent) env var (unix)
 	p = testParser(`:{$PORT$}`)
-	blocks, _ = p.parseAll()
-	if actual, expected := blocks[0].Keys[0], ":"; expected != actual {
-		t.Errorf("Expected key to be '%s' but was '%s'", expected, actual)
+	if _, err := p.parseAll(); err == nil {
+		t.Error("Expected an error for unset env var, but got none")
 	}
 
 	// in quoted field
@@ -392,6 +468,259 @@ func TestEnvironmentReplacement(t *testing.T) {
 	}
 }
 
+func TestEnvironmentReplacementDefaults(t *testing.T) {
+	os.Setenv("CADDY_TEST_SET", "set")
+	os.Setenv("CADDY_TEST_EMPTY", "")
+	os.Setenv("CADDY_TEST_SPACES", "a value with spaces")
+	os.Unsetenv("CADDY_TEST_UNSET")
+	defer os.Unsetenv("CADDY_TEST_SET")
+	defer os.Unsetenv("CADDY_TEST_EMPTY")
+	defer os.Unsetenv("CADDY_TEST_SPACES")
+
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		key       string
+		args      []string
+	}{
+		{":1234\ndir1 {$CADDY_TEST_SET:default}", false, ":1234", []string{"set"}},
+		{":1234\ndir1 {$CADDY_TEST_UNSET:default}", false, ":1234", []string{"default"}},
+		{":1234\ndir1 {%CADDY_TEST_UNSET:default%}", false, ":1234", []string{"default"}},
+		{":1234\ndir1 {$CADDY_TEST_UNSET:}", false, ":1234", []string{""}},
+		{":1234\ndir1 {$CADDY_TEST_UNSET:a:b}", false, ":1234", []string{"a:b"}},
+		{":1234\ndir1 {$CADDY_TEST_EMPTY}", false, ":1234", []string{""}},
+		{"{$CADDY_TEST_UNSET:localhost}:80", false, "localhost:80", nil},
+		{":1234\ndir1 {$CADDY_TEST_SPACES} last", false, ":1234", []string{"a value with spaces", "last"}},
+		{":1234\ndir1 '{$CADDY_TEST_SET}' {$CADDY_TEST_SET}", false, ":1234", []string{"{$CADDY_TEST_SET}", "set"}},
+		{":1234\ndir1 '{%CADDY_TEST_UNSET%}'", false, ":1234", []string{"{%CADDY_TEST_UNSET%}"}},
+		{":1234\ndir1 {$CADDY_TEST_UNSET}", true, "", nil},
+		{":1234\ndir1 {%CADDY_TEST_UNSET%}", true, "", nil},
+		{"{$CADDY_TEST_UNSET}:80", true, "", nil},
+		{":1234\ndir1 {\nsub {$CADDY_TEST_UNSET}\n}", true, "", nil},
+	} {
+		p := testParser(test.input)
+		blocks, err := p.parseAll()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if actual := blocks[0].Keys[0]; actual != test.key {
+			t.Errorf("Test %d: Expected key to be '%s' but was '%s'", i, test.key, actual)
+		}
+		if test.args == nil {
+			continue
+		}
+		tokens := blocks[0].Tokens["dir1"]
+		if len(tokens) != len(test.args)+1 {
+			t.Errorf("Test %d: Expected %d arguments, got %d: %v", i, len(test.args), len(tokens)-1, tokens)
+			continue
+		}
+		for j, arg := range test.args {
+			if actual := tokens[j+1].Text; actual != arg {
+				t.Errorf("Test %d: Expected argument %d to be '%s' but was '%s'", i, j, arg, actual)
+			}
+		}
+	}
+}
+
+func TestEnvironmentReplacementInImport(t *testing.T) {
+	os.Setenv("CADDY_TEST_IMPORTED", "imported")
+	defer os.Unsetenv("CADDY_TEST_IMPORTED")
+
+	dir, err := ioutil.TempDir("", "caddyfile_env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "imported.conf"), []byte("dir1 {$CADDY_TEST_IMPORTED}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CADDY_TEST_IMPORT_FILE", filepath.Join(dir, "imported.conf"))
+	defer os.Unsetenv("CADDY_TEST_IMPORT_FILE")
+	p := testParser(":1234\nimport {$CADDY_TEST_IMPORT_FILE}")
+	blocks, err := p.parseAll()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if got := blocks[0].Tokens["dir1"]; len(got) != 2 || got[1].Text != "imported" {
+		t.Errorf("Expected imported argument to be substituted, got: %v", got)
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		keys      [][]string
+		dir1      []string // arguments of the first dir1 in the first block
+	}{
+		{`(common) {
+			dir1 arg1
+		  }
+		  host1 {
+			import common
+		  }`, false, [][]string{{"host1"}}, []string{"arg1"}},
+
+		{`(common) {
+			dir1 {args.0} {args.1}
+		  }
+		  host1 {
+			import common foo bar
+		  }
+		  host2 {
+			import common baz qux
+		  }`, false, [][]string{{"host1"}, {"host2"}}, []string{"foo", "bar"}},
+
+		{`(inner) {
+			dir1 {args.0}
+		  }
+		  (outer) {
+			import inner {args.0}-inner
+			dir2 {
+				a b
+			}
+		  }
+		  host1 {
+			import outer nested
+		  }`, false, [][]string{{"host1"}}, []string{"nested-inner"}},
+
+		{`(site) {
+			{args.0} {
+				dir1 '{args.0}'
+			}
+		  }
+		  import site host1`, false, [][]string{{"host1"}}, []string{"{args.0}"}},
+
+		{`(common) {
+			dir1 {args.1}
+		  }
+		  host1 {
+			import common foo
+		  }`, true, [][]string{}, nil},
+
+		{`(loop) {
+			import loop
+		  }
+		  host1 {
+			import loop
+		  }`, true, [][]string{}, nil},
+
+		{`(a) {
+			import b
+		  }
+		  (b) {
+			dir1
+			import a
+		  }
+		  host1 {
+			import a
+		  }`, true, [][]string{}, nil},
+
+		{`(common) {
+			dir1
+		  }
+		  (common) {
+			dir2
+		  }`, true, [][]string{}, nil},
+
+		{`(optional) {
+			dir1
+		  }`, true, [][]string{}, nil},
+
+		{`(unclosed) {
+			dir1`, true, [][]string{}, nil},
+	} {
+		p := testParser(test.input)
+		blocks, err := p.parseAll()
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+
+		if len(blocks) != len(test.keys) {
+			t.Errorf("Test %d: Expected %d server blocks, got %d", i, len(test.keys), len(blocks))
+			continue
+		}
+		for j, block := range blocks {
+			if !reflect.DeepEqual(block.Keys, test.keys[j]) {
+				t.Errorf("Test %d, block %d: Expected keys %v, got %v", i, j, test.keys[j], block.Keys)
+			}
+		}
+		tokens := blocks[0].Tokens["dir1"]
+		if len(tokens) != len(test.dir1)+1 {
+			t.Errorf("Test %d: Expected %d arguments, got %d: %v", i, len(test.dir1), len(tokens)-1, tokens)
+			continue
+		}
+		for j, arg := range test.dir1 {
+			if actual := tokens[j+1].Text; actual != arg {
+				t.Errorf("Test %d: Expected argument %d to be '%s' but was '%s'", i, j, arg, actual)
+			}
+		}
+	}
+}
+
+func TestImportGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddyfile_import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "dir.caddy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "site.caddy"), []byte("host1 {\n\timport nested/*.caddy\n}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "nested", "dir1.caddy"), []byte("dir1 nested"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "loop.txt"), []byte("import loop.txt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// directories are skipped; nested imports are relative to the importing file
+	p := testParser("import " + filepath.Join(dir, "*.caddy"))
+	blocks, err := p.parseAll()
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(blocks) != 1 || len(blocks[0].Tokens["dir1"]) != 2 || blocks[0].Tokens["dir1"][1].Text != "nested" {
+		t.Errorf("Expected one block with nested dir1, got: %v", blocks)
+	}
+
+	// a pattern that only matches directories matches nothing
+	p = testParser("host1\nimport " + filepath.Join(dir, "dir.*"))
+	if _, err := p.parseAll(); err == nil {
+		t.Error("Expected an error when the pattern matches no files, but didn't get one")
+	}
+	p = testParser("host1\nimport optional " + filepath.Join(dir, "dir.*"))
+	if _, err := p.parseAll(); err != nil {
+		t.Errorf("Expected no error with optional import, but got: %v", err)
+	}
+
+	// a file that imports itself
+	p = testParser("host1\nimport " + filepath.Join(dir, "loop.txt"))
+	if _, err := p.parseAll(); err == nil || !strings.Contains(err.Error(), "Recursive import") {
+		t.Errorf("Expected a recursive import error, but got: %v", err)
+	}
+}
+
 func testParser(input string) parser {
 	buf := strings.NewReader(input)
 	p := parser{Dispenser: NewDispenser("Caddyfile", buf)}
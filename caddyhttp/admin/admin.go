@@ -0,0 +1,117 @@
+// Package admin implements a control endpoint, served on a separate
+// loopback listener, to operate on the certificates of the process
+// while it runs.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Admin is middleware that serves the control endpoint. Requests
+// that do not come from a loopback address, or that do not have
+// the token, are rejected before anything else is done.
+type Admin struct {
+	Next  httpserver.Handler
+	Token string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (a Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !fromLoopback(r) {
+		return http.StatusForbidden, nil
+	}
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		return http.StatusUnauthorized, nil
+	}
+
+	host := r.URL.Query().Get("host")
+	switch r.URL.Path {
+	case "/certificates":
+		switch r.Method {
+		case "GET":
+			return writeJSON(w, http.StatusOK, caddytls.CachedCertificates())
+		case "DELETE":
+			if host == "" {
+				return writeError(w, http.StatusBadRequest, "missing host")
+			}
+			fromStorage := r.URL.Query().Get("storage") == "true"
+			if err := caddytls.EvictCertificate(host, fromStorage); err != nil {
+				return writeCertError(w, err)
+			}
+			return writeJSON(w, http.StatusOK, map[string]interface{}{"evicted": host, "storage": fromStorage})
+		}
+		return methodNotAllowed(w, "GET, DELETE")
+	case "/certificates/renew":
+		if r.Method != "POST" {
+			return methodNotAllowed(w, "POST")
+		}
+		if host == "" {
+			return writeError(w, http.StatusBadRequest, "missing host")
+		}
+		if err := caddytls.RenewCertificate(host); err != nil {
+			return writeCertError(w, err)
+		}
+		return writeJSON(w, http.StatusOK, map[string]string{"renewed": host})
+	case "/ondemand/reset":
+		if r.Method != "POST" {
+			return methodNotAllowed(w, "POST")
+		}
+		return writeJSON(w, http.StatusOK, map[string]int{"reset": caddytls.ResetOnDemandFailures()})
+	}
+	return a.Next.ServeHTTP(w, r)
+}
+
+// authorized returns true if r has the token of a as a
+// bearer token in its Authorization header.
+func (a Admin) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(a.Token)) == 1
+}
+
+// fromLoopback returns true if r comes from a loopback address.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	return 0, json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) (int, error) {
+	return writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeCertError writes err, which is the error of an operation
+// on a certificate; a certificate that is not in the cache is
+// not found, and any other error is the fault of the server.
+func writeCertError(w http.ResponseWriter, err error) (int, error) {
+	if err == caddytls.ErrNoCertificate {
+		return writeError(w, http.StatusNotFound, err.Error())
+	}
+	return writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) (int, error) {
+	w.Header().Set("Allow", allow)
+	return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
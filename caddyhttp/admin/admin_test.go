@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddytls"
+	"github.com/mholt/caddy/caddytls/storagetest"
+)
+
+func makeSiteData(t *testing.T, name string) *caddytls.SiteData {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &caddytls.SiteData{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func serve(h httpserver.Handler, method, target, remoteAddr, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	status, _ := h.ServeHTTP(w, r)
+	if status != 0 {
+		w.Code = status
+	}
+	return w
+}
+
+func TestAdminRejects(t *testing.T) {
+	h := Admin{Next: httpserver.EmptyNext, Token: "secret"}
+	for i, test := range []struct {
+		remoteAddr, token string
+		expectedStatus    int
+	}{
+		{"192.0.2.1:1234", "secret", http.StatusForbidden},
+		{"127.0.0.1:1234", "", http.StatusUnauthorized},
+		{"127.0.0.1:1234", "wrong", http.StatusUnauthorized},
+		{"127.0.0.1:1234", "secret", http.StatusOK},
+		{"[::1]:1234", "secret", http.StatusOK},
+	} {
+		w := serve(h, "GET", "/certificates", test.remoteAddr, test.token)
+		if w.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, w.Code)
+		}
+	}
+}
+
+func TestAdminCertificates(t *testing.T) {
+	storage := storagetest.NewInMemoryStorage()
+	cfg := &caddytls.Config{
+		Managed: true,
+		CAUrl:   "https://ca.test/directory",
+		StorageCreator: func(caURL *url.URL) (caddytls.Storage, error) {
+			return storage, nil
+		},
+	}
+	names := []string{"a.example.com", "b.example.com"}
+	for _, name := range names {
+		if err := storage.StoreSite(name, makeSiteData(t, name)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := caddytls.CacheManagedCertificate(name, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, name := range names {
+			caddytls.EvictCertificate(name, false)
+		}
+	}()
+	h := Admin{Next: httpserver.EmptyNext, Token: "secret"}
+	do := func(method, target string) *httptest.ResponseRecorder {
+		return serve(h, method, target, "127.0.0.1:1234", "secret")
+	}
+
+	w := do("GET", "/certificates")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 listing certificates, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Expected JSON content type, got %s", ct)
+	}
+	var infos []caddytls.CertificateInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Names[0] != "a.example.com" || !infos[0].Managed {
+		t.Errorf("Expected both managed certificates listed, got %+v", infos)
+	}
+
+	for i, test := range []struct {
+		method, target string
+		expectedStatus int
+	}{
+		{"POST", "/certificates", http.StatusMethodNotAllowed},
+		{"GET", "/certificates/renew?host=a.example.com", http.StatusMethodNotAllowed},
+		{"POST", "/certificates/renew", http.StatusBadRequest},
+		{"POST", "/certificates/renew?host=nosuch.example.com", http.StatusNotFound},
+		{"DELETE", "/certificates", http.StatusBadRequest},
+		{"DELETE", "/certificates?host=nosuch.example.com", http.StatusNotFound},
+		{"GET", "/ondemand/reset", http.StatusMethodNotAllowed},
+		{"POST", "/ondemand/reset", http.StatusOK},
+		{"GET", "/other", http.StatusOK},
+	} {
+		w := do(test.method, test.target)
+		if w.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d for %s %s, got %d", i, test.expectedStatus, test.method, test.target, w.Code)
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+			t.Errorf("Test %d: Expected Allow header", i)
+		}
+	}
+
+	w = do("DELETE", "/certificates?host=b.example.com&storage=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 evicting, got %d: %s", w.Code, w.Body)
+	}
+	if storage.SiteExists("b.example.com") {
+		t.Error("Expected certificate to be deleted from storage")
+	}
+	if w := do("DELETE", "/certificates?host=b.example.com"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 evicting twice, got %d", w.Code)
+	}
+}
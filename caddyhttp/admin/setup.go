@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"net"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// DefaultAddress is the address of the control endpoint
+// if the admin directive does not specify one.
+const DefaultAddress = "127.0.0.1:2019"
+
+func init() {
+	caddy.RegisterPlugin("admin", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+		Redact:     redact,
+	})
+}
+
+// redact hides the token in an admin block.
+func redact(d *caddy.DirectiveExport) {
+	for i := range d.Block {
+		if line := &d.Block[i]; line.Name == "token" && len(line.Args) > 0 {
+			line.Args[0] = caddy.Redacted
+		}
+	}
+}
+
+// setup serves the control endpoint on a separate listener while
+// the instance runs:
+//
+//	admin [address] {
+//	    token secret
+//	}
+//
+// The address must be a loopback address, and the token is required.
+func setup(c *caddy.Controller) error {
+	addr, token, err := parseAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	debugendpoint.Install(c, "admin", debugendpoint.Options{Bind: addr}, func(next httpserver.Handler) httpserver.Handler {
+		return Admin{Next: next, Token: token}
+	})
+
+	return nil
+}
+
+func parseAdmin(c *caddy.Controller) (addr, token string, err error) {
+	var found bool
+	for c.Next() {
+		if found {
+			return "", "", c.Err("admin can only be specified once")
+		}
+		found = true
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+			addr = DefaultAddress
+		case 1:
+			addr = args[0]
+		default:
+			return "", "", c.ArgErr()
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", c.Errf("admin address '%s' must have a host and a port", addr)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return "", "", c.Errf("admin address '%s' must be a loopback address", addr)
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "token":
+				if !c.NextArg() {
+					return "", "", c.ArgErr()
+				}
+				token = c.Val()
+				if c.NextArg() {
+					return "", "", c.ArgErr()
+				}
+			default:
+				return "", "", c.Errf("Unknown admin option '%s'", c.Val())
+			}
+		}
+		if token == "" {
+			return "", "", c.Err("admin requires a token")
+		}
+	}
+	return addr, token, nil
+}
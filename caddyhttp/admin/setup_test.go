@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestParseAdmin(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		expectedAddr string
+	}{
+		{"admin {\ntoken secret\n}", false, DefaultAddress},
+		{"admin 127.0.0.1:2020 {\ntoken secret\n}", false, "127.0.0.1:2020"},
+		{"admin [::1]:2020 {\ntoken secret\n}", false, "[::1]:2020"},
+		{"admin localhost:2020 {\ntoken secret\n}", false, "localhost:2020"},
+		{`admin`, true, ""},
+		{"admin {\ntoken\n}", true, ""},
+		{"admin {\ntoken a b\n}", true, ""},
+		{"admin {\nfoo bar\n}", true, ""},
+		{"admin 0.0.0.0:2019 {\ntoken secret\n}", true, ""},
+		{"admin :2019 {\ntoken secret\n}", true, ""},
+		{"admin example.com:2019 {\ntoken secret\n}", true, ""},
+		{"admin 127.0.0.1 {\ntoken secret\n}", true, ""},
+		{"admin a b {\ntoken secret\n}", true, ""},
+		{"admin {\ntoken secret\n}\nadmin {\ntoken secret\n}", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", test.input)
+		addr, _, err := parseAdmin(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but found nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if addr != test.expectedAddr {
+			t.Errorf("Test %d: Expected address %s, got %s", i, test.expectedAddr, addr)
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", "admin {\ntoken secret\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if mids := httpserver.GetConfig(c).Middleware(); len(mids) != 0 {
+		t.Errorf("Expected admin not to be served on the site, got %d middleware", len(mids))
+	}
+}
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// TestMain runs the process started by caddy.Upgrade in
+// TestUpgradeWithAdmin, which is this test binary.
+func TestMain(m *testing.M) {
+	caddy.Quiet = true
+	caddytls.DefaultCAUrl = "https://ca.example.com/directory"
+	if caddy.IsUpgrade() {
+		runUpgradeChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runUpgradeChild serves the handed-off Caddyfile until the
+// file named by CADDY_TEST_ADMIN_RUNNING is gone (or a while
+// has passed).
+func runUpgradeChild() {
+	cdyfile, err := caddy.LoadCaddyfile("http")
+	if err != nil {
+		os.Exit(1)
+	}
+	inst, err := caddy.Start(cdyfile)
+	if err != nil {
+		os.Exit(1)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if _, err := os.Stat(os.Getenv("CADDY_TEST_ADMIN_RUNNING")); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	inst.Stop()
+	os.Exit(0)
+}
+
+// freeAddr returns a loopback address with a port that is free.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestUpgradeWithAdmin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrading is not supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "caddy_admin_upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	running := filepath.Join(dir, "running")
+	if err := ioutil.WriteFile(running, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CADDY_TEST_ADMIN_RUNNING", running)
+	defer os.Unsetenv("CADDY_TEST_ADMIN_RUNNING")
+
+	siteAddr, adminAddr := freeAddr(t), freeAddr(t)
+	_, err = caddy.Start(caddy.CaddyfileInput{
+		Contents:       []byte("http://" + siteAddr + " {\nadmin " + adminAddr + " {\ntoken secret\n}\n}"),
+		ServerTypeName: "http",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error starting, got: %v", err)
+	}
+	defer caddy.Stop()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	certificates := func() int {
+		req, _ := http.NewRequest("GET", "http://"+adminAddr+"/certificates", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Expected the admin endpoint to answer, got: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := certificates(); status != http.StatusOK {
+		t.Fatalf("Expected status 200 before upgrading, got %d", status)
+	}
+
+	// the new process takes over the listener of the admin
+	// endpoint, which this one holds until it has started
+	if err := caddy.Upgrade(); err != nil {
+		t.Fatalf("Expected no error upgrading, got: %v", err)
+	}
+	if status := certificates(); status != http.StatusOK {
+		t.Errorf("Expected status 200 from the new process, got %d", status)
+	}
+}
@@ -0,0 +1,31 @@
+// Package ambiguous lets a site's listener serve requests that
+// could be taken for different requests by a backend, which are
+// otherwise rejected.
+package ambiguous
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("insecure_allow_ambiguous_requests", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup makes the site's listener serve ambiguous requests, like
+// ones whose Host header does not match their target, instead of
+// rejecting them. It applies to all the sites on the listener,
+// since requests are checked before their site is known.
+func setup(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		config.AllowAmbiguousRequests = true
+	}
+	return nil
+}
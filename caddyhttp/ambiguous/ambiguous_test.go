@@ -0,0 +1,33 @@
+package ambiguous
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`insecure_allow_ambiguous_requests`, false},
+		{`insecure_allow_ambiguous_requests yes`, true},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if !httpserver.GetConfig(c).AllowAmbiguousRequests {
+			t.Errorf("Test %d: Expected ambiguous requests to be allowed", i)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package ban implements middleware that bans clients whose
+// requests fail too often, like ones that guess passwords.
+package ban
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Ban is middleware that counts the responses with one of
+// Triggers to requests in Paths by client, and bans clients
+// who get Threshold of them within Window from the site for
+// BanFor. Bans are kept in memory, so reloading the Caddyfile
+// lifts them all.
+type Ban struct {
+	Next     httpserver.Handler
+	Paths    []string
+	Triggers []int
+
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-For header tells the client's address
+	TrustedProxies []*net.IPNet
+
+	// IPv4Prefix and IPv6Prefix are the lengths of the network
+	// prefixes that clients are counted and banned by, so that
+	// a client cannot get around a ban by changing its address
+	// within its own network
+	IPv4Prefix, IPv6Prefix int
+
+	// Tarpit is how long the requests of banned clients are
+	// held before their connection is closed without response;
+	// if 0, they are answered with 403 Forbidden right away
+	Tarpit time.Duration
+
+	store *store
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (b Ban) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	key := b.clientKey(r)
+	if key == "" {
+		return b.Next.ServeHTTP(w, r)
+	}
+	if b.store.banned(key) {
+		return b.reject(w, r)
+	}
+
+	watched := false
+	for _, path := range b.Paths {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			watched = true
+			break
+		}
+	}
+	if !watched {
+		return b.Next.ServeHTTP(w, r)
+	}
+
+	rec := httpserver.NewResponseRecorder(w)
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok {
+		rec.Replacer = rr.Replacer
+	}
+	status, err := b.Next.ServeHTTP(rec, r)
+
+	// the status is either returned, to be written by
+	// the errors middleware, or written already
+	failed := status
+	if failed < 400 {
+		failed = rec.Status()
+	}
+	for _, trigger := range b.Triggers {
+		if failed == trigger {
+			b.store.fail(key)
+			break
+		}
+	}
+	return status, err
+}
+
+// reject answers a request of a banned client.
+func (b Ban) reject(w http.ResponseWriter, r *http.Request) (int, error) {
+	if b.Tarpit <= 0 {
+		return http.StatusForbidden, nil
+	}
+	timer := time.NewTimer(b.Tarpit)
+	defer timer.Stop()
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	select {
+	case <-timer.C:
+	case <-gone:
+		return 0, nil
+	}
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+			return 0, nil
+		}
+	}
+	return http.StatusForbidden, nil
+}
+
+// clientKey returns the network of the client of r, which it
+// is counted and banned by, or "" if its address is unknown.
+func (b Ban) clientKey(r *http.Request) string {
+	ip := httpserver.ClientIP(r, b.TrustedProxies)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if b.IPv4Prefix >= 8*net.IPv4len {
+			return ip4.String()
+		}
+		network := net.IPNet{IP: ip4.Mask(net.CIDRMask(b.IPv4Prefix, 8*net.IPv4len)), Mask: net.CIDRMask(b.IPv4Prefix, 8*net.IPv4len)}
+		return network.String()
+	}
+	if b.IPv6Prefix >= 8*net.IPv6len {
+		return ip.String()
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(b.IPv6Prefix, 8*net.IPv6len)), Mask: net.CIDRMask(b.IPv6Prefix, 8*net.IPv6len)}
+	return network.String()
+}
+
+// stores are the stores of the bans of all sites, by site address.
+var (
+	stores   = make(map[*store]string)
+	storesMu sync.Mutex
+)
+
+func init() {
+	expvar.Publish("bans", expvar.Func(currentBans))
+}
+
+// currentBans returns the bans of each site, mapping the
+// banned networks to the time their bans end.
+func currentBans() interface{} {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	bans := make(map[string]map[string]time.Time)
+	for s, site := range stores {
+		for key, until := range s.currentBans() {
+			if bans[site] == nil {
+				bans[site] = make(map[string]time.Time)
+			}
+			bans[site][key] = until
+		}
+	}
+	return bans
+}
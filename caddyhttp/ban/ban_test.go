@@ -0,0 +1,204 @@
+package ban
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// login fails unless the password is right; the status
+// is returned for the errors middleware to write.
+var login = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path == "/login" && r.URL.Query().Get("password") != "right" {
+		return http.StatusUnauthorized, nil
+	}
+	if r.URL.Path == "/forbidden" {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, nil
+	}
+	w.Write([]byte("welcome"))
+	return 0, nil
+})
+
+func newTestBan(threshold int) (Ban, *fakeClock) {
+	s, clock := newTestStore(threshold, 10*time.Minute, time.Hour, 100)
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	return Ban{
+		Next:           login,
+		Paths:          []string{"/login", "/forbidden"},
+		Triggers:       []int{401, 403},
+		TrustedProxies: []*net.IPNet{proxies},
+		IPv4Prefix:     32,
+		IPv6Prefix:     64,
+		store:          s,
+	}, clock
+}
+
+func request(h httpserver.Handler, path, remoteAddr, forwardedFor string) int {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rec := httptest.NewRecorder()
+	status, _ := h.ServeHTTP(rec, req)
+	if status == 0 {
+		status = rec.Code
+	}
+	return status
+}
+
+func TestBan(t *testing.T) {
+	b, clock := newTestBan(3)
+
+	for i := 0; i < 3; i++ {
+		if status := request(b, "/login", "203.0.113.7:1000", ""); status != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: Expected 401, got %d", i, status)
+		}
+	}
+	// banned everywhere, even with the right password
+	for _, path := range []string{"/login?password=right", "/"} {
+		if status := request(b, path, "203.0.113.7:1001", ""); status != http.StatusForbidden {
+			t.Errorf("Expected banned client to get 403 for %s, got %d", path, status)
+		}
+	}
+	// others are not
+	if status := request(b, "/login?password=right", "203.0.113.8:1000", ""); status != http.StatusOK {
+		t.Errorf("Expected other client to get 200, got %d", status)
+	}
+
+	clock.advance(time.Hour)
+	if status := request(b, "/", "203.0.113.7:1000", ""); status != http.StatusOK {
+		t.Errorf("Expected 200 after the ban, got %d", status)
+	}
+}
+
+func TestBanWrittenStatus(t *testing.T) {
+	b, _ := newTestBan(2)
+	request(b, "/forbidden", "203.0.113.7:1000", "")
+	request(b, "/forbidden", "203.0.113.7:1000", "")
+	if status := request(b, "/", "203.0.113.7:1000", ""); status != http.StatusForbidden {
+		t.Errorf("Expected ban for written 403s, got %d", status)
+	}
+}
+
+func TestBanOnlyWatchedPaths(t *testing.T) {
+	b, _ := newTestBan(1)
+	b.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusUnauthorized, nil
+	})
+	request(b, "/private", "203.0.113.7:1000", "")
+	if b.store.banned("203.0.113.7") {
+		t.Error("Expected failures outside of the watched paths not to count")
+	}
+}
+
+func TestBanIPv6Prefix(t *testing.T) {
+	b, _ := newTestBan(3)
+
+	// rotating addresses within a /64 does not help
+	for _, addr := range []string{"[2001:db8:1:2::1]:1000", "[2001:db8:1:2::2]:1000", "[2001:db8:1:2:ffff::3]:1000"} {
+		request(b, "/login", addr, "")
+	}
+	if status := request(b, "/", "[2001:db8:1:2:abcd::9]:1000", ""); status != http.StatusForbidden {
+		t.Errorf("Expected the /64 to be banned, got %d", status)
+	}
+	if status := request(b, "/", "[2001:db8:1:3::1]:1000", ""); status != http.StatusOK {
+		t.Errorf("Expected another /64 not to be banned, got %d", status)
+	}
+	if bans := b.store.currentBans(); len(bans) != 1 {
+		t.Errorf("Expected one ban, got %v", bans)
+	} else if _, ok := bans["2001:db8:1:2::/64"]; !ok {
+		t.Errorf("Expected 2001:db8:1:2::/64 to be banned, got %v", bans)
+	}
+}
+
+func TestBanTrustedProxies(t *testing.T) {
+	b, _ := newTestBan(2)
+
+	// behind a trusted proxy, the client is the one it forwards for
+	request(b, "/login", "10.0.0.1:1000", "203.0.113.7")
+	request(b, "/login", "10.0.0.2:1000", "198.51.100.1, 203.0.113.7, 10.0.0.3")
+	if status := request(b, "/", "10.0.0.1:1000", "203.0.113.7"); status != http.StatusForbidden {
+		t.Errorf("Expected forwarded client to be banned, got %d", status)
+	}
+	if status := request(b, "/", "10.0.0.1:1000", "203.0.113.8"); status != http.StatusOK {
+		t.Errorf("Expected the proxy itself not to be banned, got %d", status)
+	}
+
+	// others can't make themselves look like someone else
+	request(b, "/login", "198.51.100.9:1000", "192.0.2.1")
+	request(b, "/login", "198.51.100.9:1000", "192.0.2.2")
+	if status := request(b, "/", "198.51.100.9:1000", ""); status != http.StatusForbidden {
+		t.Errorf("Expected untrusted client to be banned by its own address, got %d", status)
+	}
+}
+
+func TestBanTarpit(t *testing.T) {
+	b, _ := newTestBan(1)
+	b.Tarpit = 50 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, _ := b.ServeHTTP(w, r); status >= 400 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	start := time.Now()
+	_, err = http.Get(srv.URL + "/")
+	if err == nil {
+		t.Error("Expected connection of banned client to be closed")
+	}
+	if time.Since(start) < b.Tarpit {
+		t.Errorf("Expected banned client to be held for %v, was only held for %v", b.Tarpit, time.Since(start))
+	}
+}
+
+func TestCurrentBans(t *testing.T) {
+	b, clock := newTestBan(1)
+	storesMu.Lock()
+	stores[b.store] = "example.com:80"
+	storesMu.Unlock()
+	defer func() {
+		storesMu.Lock()
+		delete(stores, b.store)
+		storesMu.Unlock()
+	}()
+
+	request(b, "/login", "203.0.113.7:1000", "")
+	out, err := json.Marshal(currentBans())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"example.com:80":{"203.0.113.7":"` + clock.now().Add(time.Hour).Format(time.RFC3339) + `"}}`
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestBanBadForwardedFor(t *testing.T) {
+	b, _ := newTestBan(2)
+
+	// a bad or missing address is not a way around the ban
+	request(b, "/login", "10.0.0.1:1000", "garbage")
+	request(b, "/login", "10.0.0.1:1000", "")
+	if status := request(b, "/", "10.0.0.1:1000", "not an address"); status != http.StatusForbidden {
+		t.Errorf("Expected the last good hop to be banned, got %d", status)
+	}
+	if bans := b.store.currentBans(); len(bans) != 1 {
+		t.Errorf("Expected one ban, got %v", bans)
+	} else if _, ok := bans["10.0.0.1"]; !ok {
+		t.Errorf("Expected the proxy to be banned, got %v", bans)
+	}
+}
@@ -0,0 +1,155 @@
+package ban
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("ban", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// Defaults of the ban directive.
+const (
+	DefaultThreshold  = 10
+	DefaultWindow     = 10 * time.Minute
+	DefaultBanFor     = time.Hour
+	DefaultIPv6Prefix = 64
+	DefaultMaxClients = 10000
+)
+
+// DefaultTriggers are the statuses counted as failures
+// unless others are configured.
+var DefaultTriggers = []int{401, 403}
+
+// setup configures a new Ban middleware instance.
+func setup(c *caddy.Controller) error {
+	b, err := banParse(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+	storesMu.Lock()
+	stores[b.store] = cfg.Addr.String()
+	storesMu.Unlock()
+	c.OnShutdown(func() error {
+		storesMu.Lock()
+		delete(stores, b.store)
+		storesMu.Unlock()
+		return nil
+	})
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		b.Next = next
+		return b
+	})
+	return nil
+}
+
+func banParse(c *caddy.Controller) (Ban, error) {
+	b := Ban{IPv4Prefix: 32, IPv6Prefix: DefaultIPv6Prefix}
+	threshold, window, banFor, maxClients := DefaultThreshold, DefaultWindow, DefaultBanFor, DefaultMaxClients
+
+	if !c.Next() {
+		return b, c.ArgErr()
+	}
+	b.Paths = c.RemainingArgs()
+
+	for c.NextBlock() {
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return b, c.ArgErr()
+		}
+		single := func() (string, error) {
+			if len(args) != 1 {
+				return "", c.ArgErr()
+			}
+			return args[0], nil
+		}
+
+		switch option {
+		case "path":
+			b.Paths = append(b.Paths, args...)
+		case "trigger":
+			for _, arg := range args {
+				status, err := strconv.Atoi(arg)
+				if err != nil || status < 100 || status > 599 {
+					return b, c.Errf("Invalid trigger status '%s'", arg)
+				}
+				b.Triggers = append(b.Triggers, status)
+			}
+		case "trusted_proxies":
+			for _, arg := range args {
+				network, err := httpserver.ParseNetwork(arg)
+				if err != nil {
+					return b, c.Err(err.Error())
+				}
+				b.TrustedProxies = append(b.TrustedProxies, network)
+			}
+		case "threshold", "max_clients", "ipv4_prefix", "ipv6_prefix":
+			arg, err := single()
+			if err != nil {
+				return b, err
+			}
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return b, c.Errf("%s must be a positive integer, got '%s'", option, arg)
+			}
+			switch option {
+			case "threshold":
+				threshold = n
+			case "max_clients":
+				maxClients = n
+			case "ipv4_prefix":
+				if n > 32 {
+					return b, c.Errf("ipv4_prefix must be at most 32, got %d", n)
+				}
+				b.IPv4Prefix = n
+			case "ipv6_prefix":
+				if n > 128 {
+					return b, c.Errf("ipv6_prefix must be at most 128, got %d", n)
+				}
+				b.IPv6Prefix = n
+			}
+		case "window", "ban_for", "tarpit":
+			arg, err := single()
+			if err != nil {
+				return b, err
+			}
+			dur, err := time.ParseDuration(arg)
+			if err != nil || dur <= 0 {
+				return b, c.Errf("%s must be a positive duration, got '%s'", option, arg)
+			}
+			switch option {
+			case "window":
+				window = dur
+			case "ban_for":
+				banFor = dur
+			case "tarpit":
+				b.Tarpit = dur
+			}
+		default:
+			return b, c.Errf("Unknown ban option '%s'", option)
+		}
+	}
+
+	if c.Next() {
+		return b, c.Err("ban may only be used once per site")
+	}
+	if len(b.Paths) == 0 {
+		return b, c.Err("ban needs at least one path to watch")
+	}
+	if len(b.Triggers) == 0 {
+		b.Triggers = DefaultTriggers
+	}
+	b.store = newStore(threshold, window, banFor, maxClients)
+	return b, nil
+}
@@ -0,0 +1,110 @@
+package ban
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `ban /login`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Ban)
+	if !ok {
+		t.Fatalf("Expected handler to be type Ban, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+	storesMu.Lock()
+	_, registered := stores[myHandler.store]
+	storesMu.Unlock()
+	if !registered {
+		t.Error("Expected the store to be registered for expvar")
+	}
+}
+
+func TestBanParse(t *testing.T) {
+	b, err := banParse(caddy.NewTestController("http", `ban {
+		path /login /wp-login.php
+		trigger 401 403 429
+		threshold 5
+		window 1m
+		ban_for 2h
+		trusted_proxies 10.0.0.0/8 192.168.0.1
+		ipv4_prefix 24
+		ipv6_prefix 48
+		max_clients 50
+		tarpit 10s
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(b.Paths, []string{"/login", "/wp-login.php"}) {
+		t.Errorf("Unexpected paths %v", b.Paths)
+	}
+	if !reflect.DeepEqual(b.Triggers, []int{401, 403, 429}) {
+		t.Errorf("Unexpected triggers %v", b.Triggers)
+	}
+	if len(b.TrustedProxies) != 2 || b.TrustedProxies[1].String() != "192.168.0.1/32" {
+		t.Errorf("Unexpected trusted proxies %v", b.TrustedProxies)
+	}
+	if b.IPv4Prefix != 24 || b.IPv6Prefix != 48 || b.Tarpit != 10*time.Second {
+		t.Errorf("Unexpected prefixes %d, %d or tarpit %v", b.IPv4Prefix, b.IPv6Prefix, b.Tarpit)
+	}
+	if s := b.store; s.threshold != 5 || s.window != time.Minute || s.banFor != 2*time.Hour || s.maxEntries != 50 {
+		t.Errorf("Unexpected store settings %d, %v, %v, %d", s.threshold, s.window, s.banFor, s.maxEntries)
+	}
+
+	b, err = banParse(caddy.NewTestController("http", `ban /login`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(b.Triggers, DefaultTriggers) || b.IPv6Prefix != DefaultIPv6Prefix || b.store.threshold != DefaultThreshold {
+		t.Errorf("Expected defaults, got %#v", b)
+	}
+
+	for i, input := range []string{
+		`ban`,
+		`ban /login {
+			trigger abc
+		}`,
+		`ban /login {
+			threshold 0
+		}`,
+		`ban /login {
+			threshold 1 2
+		}`,
+		`ban /login {
+			window forever
+		}`,
+		`ban /login {
+			ipv6_prefix 129
+		}`,
+		`ban /login {
+			trusted_proxies nonsense
+		}`,
+		`ban /login {
+			unknown 1
+		}`,
+		`ban /login {
+			path
+		}`,
+		`ban /login
+		ban /admin`,
+	} {
+		if _, err := banParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: Expected an error, got none", i)
+		}
+	}
+}
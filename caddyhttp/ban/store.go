@@ -0,0 +1,133 @@
+package ban
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// store counts the failures of clients and keeps their bans.
+// It holds at most maxEntries clients with failures and as many
+// bans; when it is full, the client whose last failure is the
+// oldest is forgotten, or the ban that ends first is lifted.
+type store struct {
+	threshold  int
+	window     time.Duration
+	banFor     time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]*list.Element // values are *failures
+	lru      *list.List               // most recent failure first
+	bans     map[string]time.Time     // the time each ban ends
+}
+
+// failures are the times of the recent failures of a client.
+type failures struct {
+	key   string
+	times []time.Time
+}
+
+func newStore(threshold int, window, banFor time.Duration, maxEntries int) *store {
+	return &store{
+		threshold:  threshold,
+		window:     window,
+		banFor:     banFor,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		failures:   make(map[string]*list.Element),
+		lru:        list.New(),
+		bans:       make(map[string]time.Time),
+	}
+}
+
+// banned returns true if the client key is banned.
+func (s *store) banned(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[key]
+	if !ok {
+		return false
+	}
+	if !s.now().Before(until) {
+		delete(s.bans, key)
+		return false
+	}
+	return true
+}
+
+// fail records a failure of the client key and returns true
+// if that got it banned.
+func (s *store) fail(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	var f *failures
+	if elem, ok := s.failures[key]; ok {
+		f = elem.Value.(*failures)
+		s.lru.MoveToFront(elem)
+	} else {
+		if s.lru.Len() >= s.maxEntries {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.failures, oldest.Value.(*failures).key)
+		}
+		f = &failures{key: key}
+		s.failures[key] = s.lru.PushFront(f)
+	}
+
+	// forget the failures that are out of the window
+	start := now.Add(-s.window)
+	i := 0
+	for i < len(f.times) && !f.times[i].After(start) {
+		i++
+	}
+	f.times = append(f.times[i:], now)
+	if len(f.times) < s.threshold {
+		return false
+	}
+
+	s.lru.Remove(s.failures[key])
+	delete(s.failures, key)
+	if _, ok := s.bans[key]; !ok && len(s.bans) >= s.maxEntries {
+		s.liftFirstBan(now)
+	}
+	s.bans[key] = now.Add(s.banFor)
+	return true
+}
+
+// liftFirstBan lifts the bans that have ended or, if none
+// have, the one that ends first. s.mu must be locked.
+func (s *store) liftFirstBan(now time.Time) {
+	var first string
+	var firstUntil time.Time
+	for key, until := range s.bans {
+		if !now.Before(until) {
+			delete(s.bans, key)
+			continue
+		}
+		if first == "" || until.Before(firstUntil) {
+			first, firstUntil = key, until
+		}
+	}
+	if len(s.bans) >= s.maxEntries {
+		delete(s.bans, first)
+	}
+}
+
+// currentBans returns the clients that are banned
+// now mapped to the time their bans end.
+func (s *store) currentBans() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	bans := make(map[string]time.Time, len(s.bans))
+	for key, until := range s.bans {
+		if now.Before(until) {
+			bans[key] = until
+		}
+	}
+	return bans
+}
@@ -0,0 +1,113 @@
+package ban
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestStore(threshold int, window, banFor time.Duration, maxEntries int) (*store, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)}
+	s := newStore(threshold, window, banFor, maxEntries)
+	s.now = clock.now
+	return s, clock
+}
+
+func TestStoreWindow(t *testing.T) {
+	s, clock := newTestStore(3, 10*time.Minute, time.Hour, 100)
+
+	// failures that are spread out more than the window don't add up
+	for i := 0; i < 5; i++ {
+		if s.fail("a") {
+			t.Fatalf("Failure %d: Expected no ban for failures outside the window", i)
+		}
+		clock.advance(6 * time.Minute)
+	}
+	if s.banned("a") {
+		t.Fatal("Expected client not to be banned")
+	}
+
+	// the third failure in the window bans
+	s.fail("a")
+	clock.advance(4 * time.Minute)
+	if s.fail("a") {
+		t.Fatal("Expected no ban after two failures in the window")
+	}
+	clock.advance(4 * time.Minute)
+	if !s.fail("a") {
+		t.Fatal("Expected ban after three failures in the window")
+	}
+	if !s.banned("a") {
+		t.Fatal("Expected client to be banned")
+	}
+	if s.banned("b") {
+		t.Fatal("Expected other client not to be banned")
+	}
+
+	// the ban ends
+	clock.advance(time.Hour - time.Second)
+	if !s.banned("a") {
+		t.Fatal("Expected client to be banned until the ban ends")
+	}
+	clock.advance(time.Second)
+	if s.banned("a") {
+		t.Fatal("Expected ban to end")
+	}
+
+	// failures from before the ban are forgotten
+	if s.fail("a") {
+		t.Fatal("Expected a fresh count after the ban")
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	s, clock := newTestStore(3, time.Hour, time.Hour, 3)
+
+	// the client whose last failure is the oldest is forgotten
+	s.fail("a")
+	s.fail("b")
+	s.fail("c")
+	s.fail("a")
+	s.fail("d") // forgets b
+	s.fail("b")
+	if s.fail("b") {
+		t.Error("Expected the failures of b to be forgotten")
+	}
+	if !s.fail("a") {
+		t.Error("Expected the failures of a to be remembered")
+	}
+
+	// the ban that ends first is lifted
+	s, clock = newTestStore(1, time.Hour, time.Hour, 2)
+	for _, key := range []string{"x", "y", "z"} {
+		s.fail(key)
+		clock.advance(time.Minute)
+	}
+	for key, banned := range map[string]bool{"x": false, "y": true, "z": true} {
+		if s.banned(key) != banned {
+			t.Errorf("Expected %s banned to be %v", key, banned)
+		}
+	}
+	if bans := s.currentBans(); len(bans) != 2 {
+		t.Errorf("Expected 2 current bans, got %v", bans)
+	}
+}
+
+func TestStoreBounded(t *testing.T) {
+	s, _ := newTestStore(2, time.Hour, time.Hour, 10)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client%d", i)
+		s.fail(key)
+		s.fail(key)
+	}
+	if len(s.failures) > 10 || s.lru.Len() > 10 || len(s.bans) > 10 {
+		t.Errorf("Expected at most 10 entries, got %d failures (%d in list) and %d bans",
+			len(s.failures), s.lru.Len(), len(s.bans))
+	}
+}
@@ -11,6 +11,7 @@ func init() {
 	caddy.RegisterPlugin("basicauth", caddy.Plugin{
 		ServerType: "http",
 		Action:     setup,
+		Redact:     redact,
 	})
 }
 
@@ -35,6 +36,14 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// redact hides the password of a basicauth line, which is
+// its last argument, unless it names an htpasswd file.
+func redact(d *caddy.DirectiveExport) {
+	if n := len(d.Args); n >= 2 && !strings.HasPrefix(d.Args[n-1], "htpasswd=") {
+		d.Args[n-1] = caddy.Redacted
+	}
+}
+
 func basicAuthParse(c *caddy.Controller) ([]Rule, error) {
 	var rules []Rule
 	cfg := httpserver.GetConfig(c)
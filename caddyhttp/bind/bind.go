@@ -1,6 +1,11 @@
 package bind
 
 import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -15,10 +20,104 @@ func init() {
 func setupBind(c *caddy.Controller) error {
 	config := httpserver.GetConfig(c)
 	for c.Next() {
-		if !c.Args(&config.ListenHost) {
+		args := c.RemainingArgs()
+		for _, host := range args {
+			addListenHost(config, host)
+		}
+
+		var hadBlock bool
+		for c.NextBlock() {
+			hadBlock = true
+			if config.Socket == nil {
+				config.Socket = &httpserver.SocketOptions{UID: -1, GID: -1}
+			}
+			switch c.Val() {
+			case "socket_mode":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				mode, err := strconv.ParseUint(c.Val(), 8, 32)
+				if err != nil || mode > 0777 {
+					return c.Errf("Invalid socket mode '%s'; must be octal permission bits like 0660", c.Val())
+				}
+				config.Socket.Mode = os.FileMode(mode)
+			case "socket_owner":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				uid, gid, err := parseOwner(c.Val())
+				if err != nil {
+					return c.Errf("Invalid socket owner '%s': %v", c.Val(), err)
+				}
+				config.Socket.UID, config.Socket.GID = uid, gid
+			default:
+				return c.Errf("Unknown bind option '%s'", c.Val())
+			}
+		}
+
+		// bind requires a host if a block is not opened
+		if len(args) == 0 && !hadBlock {
 			return c.ArgErr()
 		}
-		config.TLS.ListenHost = config.ListenHost // necessary for ACME challenges, see issue #309
 	}
 	return nil
 }
+
+// addListenHost adds host to the hosts that config binds to,
+// unless it is there already. The first host is also the one
+// that ACME challenges are solved on.
+func addListenHost(config *httpserver.SiteConfig, host string) {
+	for _, h := range config.ListenHosts {
+		if h == host {
+			return
+		}
+	}
+	config.ListenHosts = append(config.ListenHosts, host)
+	if len(config.ListenHosts) == 1 {
+		config.ListenHost = host
+		config.TLS.ListenHost = host // necessary for ACME challenges, see issue #309
+	}
+}
+
+// parseOwner parses owner, which is in the form "user",
+// "user:group", or ":group", where user and group may be
+// names or numeric IDs, and returns the corresponding IDs.
+// Any part that is omitted is returned as -1.
+func parseOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	userPart, groupPart := owner, ""
+	if idx := strings.Index(owner, ":"); idx > -1 {
+		userPart, groupPart = owner[:idx], owner[idx+1:]
+	}
+	if userPart == "" && groupPart == "" {
+		return -1, -1, strconv.ErrSyntax
+	}
+
+	if userPart != "" {
+		uid, err = strconv.Atoi(userPart)
+		if err != nil {
+			u, err := user.Lookup(userPart)
+			if err != nil {
+				return -1, -1, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+
+	if groupPart != "" {
+		gid, err = strconv.Atoi(groupPart)
+		if err != nil {
+			g, err := user.LookupGroup(groupPart)
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -1,6 +1,9 @@
 package bind
 
 import (
+	"fmt"
+	"os"
+	"reflect"
 	"testing"
 
 	"github.com/mholt/caddy"
@@ -22,3 +25,67 @@ func TestSetupBind(t *testing.T) {
 		t.Errorf("Expected the TLS config's ListenHost to be %s, was %s", want, got)
 	}
 }
+
+func TestSetupBindMultiple(t *testing.T) {
+	c := caddy.NewTestController("http", "bind 192.0.2.10 2001:db8::10\nbind 192.0.2.11 192.0.2.10")
+	err := setupBind(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	cfg := httpserver.GetConfig(c)
+	if got, want := cfg.ListenHosts, []string{"192.0.2.10", "2001:db8::10", "192.0.2.11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the config's ListenHosts to be %v, was %v", want, got)
+	}
+	if got, want := cfg.ListenHost, "192.0.2.10"; got != want {
+		t.Errorf("Expected the config's ListenHost to be %s, was %s", want, got)
+	}
+	if got, want := cfg.TLS.ListenHost, "192.0.2.10"; got != want {
+		t.Errorf("Expected the TLS config's ListenHost to be %s, was %s", want, got)
+	}
+}
+
+func TestSetupBindSocketOptions(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		mode      os.FileMode
+		uid, gid  int
+	}{
+		{"bind {\nsocket_mode 0660\n}", false, 0660, -1, -1},
+		{fmt.Sprintf("bind {\nsocket_owner %d:%d\n}", uid, gid), false, 0, uid, gid},
+		{fmt.Sprintf("bind {\nsocket_owner :%d\n}", gid), false, 0, -1, gid},
+		{fmt.Sprintf("bind {\nsocket_mode 600\nsocket_owner %d\n}", uid), false, 0600, uid, -1},
+		{"bind {\nsocket_mode 0999\n}", true, 0, 0, 0},
+		{"bind {\nsocket_mode\n}", true, 0, 0, 0},
+		{"bind {\nsocket_owner :\n}", true, 0, 0, 0},
+		{"bind {\nsocket_owner no-such-user-hopefully\n}", true, 0, 0, 0},
+		{"bind {\nfoo bar\n}", true, 0, 0, 0},
+		{`bind`, true, 0, 0, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupBind(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		opts := httpserver.GetConfig(c).Socket
+		if opts == nil {
+			t.Errorf("Test %d: Expected socket options to be set", i)
+			continue
+		}
+		if opts.Mode != test.mode {
+			t.Errorf("Test %d: Expected mode %o, got %o", i, test.mode, opts.Mode)
+		}
+		if opts.UID != test.uid || opts.GID != test.gid {
+			t.Errorf("Test %d: Expected owner %d:%d, got %d:%d", i, test.uid, test.gid, opts.UID, opts.GID)
+		}
+	}
+}
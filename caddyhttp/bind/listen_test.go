@@ -0,0 +1,82 @@
+package bind
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddytls"
+)
+
+func TestBindMultipleAddresses(t *testing.T) {
+	// the whole of 127.0.0.0/8 is loopback on Linux, but not everywhere
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Cannot listen on a second loopback address: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	dir, err := ioutil.TempDir("", "caddy_bind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caddy.Quiet = true
+	caddytls.DefaultCAUrl = "https://ca.example.com/directory"
+	defer func() { caddy.Quiet, caddytls.DefaultCAUrl = false, "" }()
+	cdyfile := caddy.CaddyfileInput{
+		Contents:       []byte("http://localhost:" + port + "\nbind 127.0.0.1 127.0.0.2 127.0.0.1"),
+		ServerTypeName: "http",
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	inst, err := caddy.Start(cdyfile)
+	if err != nil {
+		t.Fatalf("Expected no error starting, got: %v", err)
+	}
+	defer func() { inst.Stop() }()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	checkServed := func(when string) {
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+			req, err := http.NewRequest("GET", "http://"+net.JoinHostPort(ip, port)+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "localhost:" + port
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("%s: Expected site to be served on %s, got: %v", when, ip, err)
+				continue
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+				t.Errorf("%s: Expected 200 \"hello\" from %s, got %d %q", when, ip, resp.StatusCode, body)
+			}
+		}
+	}
+
+	checkServed("After start")
+
+	inst, err = inst.Restart(cdyfile)
+	if err != nil {
+		t.Fatalf("Expected no error restarting, got: %v", err)
+	}
+	checkServed("After restart")
+}
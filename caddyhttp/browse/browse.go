@@ -26,6 +26,10 @@ type Browse struct {
 	Next          httpserver.Handler
 	Configs       []Config
 	IgnoreIndexes bool
+
+	// Returns the index pages of the directory at a path;
+	// if nil, staticfiles.IndexPages are used everywhere
+	IndexPages func(urlPath string) []string
 }
 
 // Config is a configuration for browsing in a particular path.
@@ -186,7 +190,7 @@ func (l Listing) applySort() {
 	}
 }
 
-func directoryListing(files []os.FileInfo, canGoUp bool, urlPath string) (Listing, bool) {
+func directoryListing(files []os.FileInfo, canGoUp bool, urlPath string, indexPages []string) (Listing, bool) {
 	var (
 		fileinfos           []FileInfo
 		dirCount, fileCount int
@@ -196,7 +200,7 @@ func directoryListing(files []os.FileInfo, canGoUp bool, urlPath string) (Listin
 	for _, f := range files {
 		name := f.Name()
 
-		for _, indexName := range staticfiles.IndexPages {
+		for _, indexName := range indexPages {
 			if name == indexName {
 				hasIndexFile = true
 				break
@@ -246,6 +250,12 @@ func (b Browse) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	return b.Next.ServeHTTP(w, r)
 inScope:
 
+	if _, ok := httpserver.RequestRoot(r); ok {
+		scoped := *bc
+		scoped.Root = httpserver.RequestFileSystem(r, bc.Root)
+		bc = &scoped
+	}
+
 	// Browse works on existing directories; delegate everything else
 	requestedFilepath, err := bc.Root.Open(r.URL.Path)
 	if err != nil {
@@ -312,7 +322,11 @@ func (b Browse) loadDirectoryContents(requestedFilepath http.File, urlPath strin
 	}
 
 	// Assemble listing of directory contents
-	listing, hasIndex := directoryListing(files, canGoUp, urlPath)
+	indexPages := staticfiles.IndexPages
+	if b.IndexPages != nil {
+		indexPages = b.IndexPages(urlPath)
+	}
+	listing, hasIndex := directoryListing(files, canGoUp, urlPath, indexPages)
 
 	return &listing, hasIndex, nil
 }
@@ -131,6 +131,46 @@ func TestBrowseHTTPMethods(t *testing.T) {
 	}
 }
 
+func TestBrowseIndexPages(t *testing.T) {
+	tmpl, err := template.ParseFiles("testdata/photos.tpl")
+	if err != nil {
+		t.Fatalf("An error occured while parsing the template: %v", err)
+	}
+
+	for i, test := range []struct {
+		indexPages []string
+		expected   int
+	}{
+		{[]string{"index.html"}, http.StatusOK},    // no index page; listed
+		{[]string{"test.html"}, http.StatusTeapot}, // has index page; served by next
+		{nil, http.StatusOK},                       // none; listed
+		{[]string{"a.html", "test2.html"}, http.StatusTeapot},
+	} {
+		indexPages := test.indexPages
+		b := Browse{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusTeapot, nil
+			}),
+			Configs: []Config{
+				{
+					PathScope: "/photos",
+					Root:      http.Dir("./testdata"),
+					Template:  tmpl,
+				},
+			},
+			IndexPages: func(urlPath string) []string { return indexPages },
+		}
+		req, err := http.NewRequest("GET", "/photos/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+		}
+		code, _ := b.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, code)
+		}
+	}
+}
+
 func TestBrowseTemplate(t *testing.T) {
 	tmpl, err := template.ParseFiles("testdata/photos.tpl")
 	if err != nil {
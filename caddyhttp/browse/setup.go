@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"text/template"
 
 	"github.com/mholt/caddy"
@@ -27,6 +28,7 @@ func setup(c *caddy.Controller) error {
 	b := Browse{
 		Configs:       configs,
 		IgnoreIndexes: false,
+		IndexPages:    httpserver.GetConfig(c).IndexPagesFor,
 	}
 
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
@@ -62,14 +64,16 @@ func browseParse(c *caddy.Controller) ([]Config, error) {
 			bc.PathScope = "/"
 		}
 		bc.Root = http.Dir(cfg.Root)
-		theRoot, err := bc.Root.Open("/") // catch a missing path early
-		if err != nil {
-			return configs, err
-		}
-		defer theRoot.Close()
-		_, err = theRoot.Readdir(-1)
-		if err != nil {
-			return configs, err
+		if !strings.Contains(cfg.Root, "{") { // a root with placeholders is only known per request
+			theRoot, err := bc.Root.Open("/") // catch a missing path early
+			if err != nil {
+				return configs, err
+			}
+			defer theRoot.Close()
+			_, err = theRoot.Readdir(-1)
+			if err != nil {
+				return configs, err
+			}
 		}
 
 		// Second argument would be the template file to use
@@ -5,25 +5,55 @@ import (
 	_ "github.com/mholt/caddy/caddyhttp/httpserver"
 
 	// plug in the standard directives
+	_ "github.com/mholt/caddy/caddyhttp/admin"
+	_ "github.com/mholt/caddy/caddyhttp/ambiguous"
+	_ "github.com/mholt/caddy/caddyhttp/ban"
 	_ "github.com/mholt/caddy/caddyhttp/basicauth"
 	_ "github.com/mholt/caddy/caddyhttp/bind"
 	_ "github.com/mholt/caddy/caddyhttp/browse"
+	_ "github.com/mholt/caddy/caddyhttp/canonicalhost"
+	_ "github.com/mholt/caddy/caddyhttp/clientcert"
+	_ "github.com/mholt/caddy/caddyhttp/connections"
+	_ "github.com/mholt/caddy/caddyhttp/deadline"
+	_ "github.com/mholt/caddy/caddyhttp/defaultserver"
 	_ "github.com/mholt/caddy/caddyhttp/errors"
 	_ "github.com/mholt/caddy/caddyhttp/expvar"
 	_ "github.com/mholt/caddy/caddyhttp/extensions"
 	_ "github.com/mholt/caddy/caddyhttp/fastcgi"
+	_ "github.com/mholt/caddy/caddyhttp/geoip"
+	_ "github.com/mholt/caddy/caddyhttp/graceperiod"
 	_ "github.com/mholt/caddy/caddyhttp/gzip"
 	_ "github.com/mholt/caddy/caddyhttp/header"
+	_ "github.com/mholt/caddy/caddyhttp/health"
+	_ "github.com/mholt/caddy/caddyhttp/http2"
+	_ "github.com/mholt/caddy/caddyhttp/httpsredirect"
+	_ "github.com/mholt/caddy/caddyhttp/index"
 	_ "github.com/mholt/caddy/caddyhttp/internalsrv"
 	_ "github.com/mholt/caddy/caddyhttp/log"
+	_ "github.com/mholt/caddy/caddyhttp/maintenance"
 	_ "github.com/mholt/caddy/caddyhttp/markdown"
+	_ "github.com/mholt/caddy/caddyhttp/maxconns"
+	_ "github.com/mholt/caddy/caddyhttp/method"
+	_ "github.com/mholt/caddy/caddyhttp/metrics"
 	_ "github.com/mholt/caddy/caddyhttp/mime"
+	_ "github.com/mholt/caddy/caddyhttp/passthrough"
+	_ "github.com/mholt/caddy/caddyhttp/pathscope"
 	_ "github.com/mholt/caddy/caddyhttp/pprof"
 	_ "github.com/mholt/caddy/caddyhttp/proxy"
+	_ "github.com/mholt/caddy/caddyhttp/query"
 	_ "github.com/mholt/caddy/caddyhttp/redirect"
+	_ "github.com/mholt/caddy/caddyhttp/replace"
+	_ "github.com/mholt/caddy/caddyhttp/respond"
 	_ "github.com/mholt/caddy/caddyhttp/rewrite"
 	_ "github.com/mholt/caddy/caddyhttp/root"
+	_ "github.com/mholt/caddy/caddyhttp/securityheaders"
+	_ "github.com/mholt/caddy/caddyhttp/signedurl"
+	_ "github.com/mholt/caddy/caddyhttp/status"
 	_ "github.com/mholt/caddy/caddyhttp/templates"
+	_ "github.com/mholt/caddy/caddyhttp/trace"
+	_ "github.com/mholt/caddy/caddyhttp/traffic"
+	_ "github.com/mholt/caddy/caddyhttp/upload"
+	_ "github.com/mholt/caddy/caddyhttp/vars"
 	_ "github.com/mholt/caddy/caddyhttp/websocket"
 	_ "github.com/mholt/caddy/startupshutdown"
 )
@@ -0,0 +1,47 @@
+// Package canonicalhost serves a site at one of the www and
+// non-www forms of its host, and redirects the other form to it.
+package canonicalhost
+
+import (
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("canonical_host", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupCanonicalHost,
+	})
+}
+
+// setupCanonicalHost sets the canonical host of the site, which
+// must be the host of the site or its www or non-www form. The
+// other form is served too, with a certificate of its own if the
+// site gets one, and its requests are redirected to the canonical
+// host with a 308.
+func setupCanonicalHost(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		host := strings.ToLower(c.Val())
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		siteHost := config.Addr.Host
+		if siteHost == "" || strings.Contains(siteHost, "*") {
+			return c.Errf("canonical_host needs a site with one host, not '%s'", config.Addr)
+		}
+		if strings.Contains(host, "*") {
+			return c.Errf("canonical_host cannot be a wildcard, got '%s'", host)
+		}
+		if host != siteHost && host != httpserver.AlternateHost(siteHost) {
+			return c.Errf("canonical_host must be %s or %s, got '%s'", siteHost, httpserver.AlternateHost(siteHost), host)
+		}
+		config.CanonicalHost = host
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package canonicalhost
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupCanonicalHost(t *testing.T) {
+	for i, test := range []struct {
+		siteHost  string
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{"example.com", `canonical_host example.com`, false, "example.com"},
+		{"example.com", `canonical_host WWW.example.com`, false, "www.example.com"},
+		{"www.example.com", `canonical_host example.com`, false, "example.com"},
+		{"www.example.com", `canonical_host www.example.com`, false, "www.example.com"},
+		{"example.com", `canonical_host`, true, ""},
+		{"example.com", `canonical_host example.com www.example.com`, true, ""},
+		{"example.com", `canonical_host example.org`, true, ""},
+		{"*.example.com", `canonical_host example.com`, true, ""},
+		{"example.com", `canonical_host *.example.com`, true, ""},
+		{"", `canonical_host example.com`, true, ""},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		cfg := httpserver.GetConfig(c)
+		cfg.Addr = httpserver.Address{Original: test.siteHost, Host: test.siteHost}
+		err := setupCanonicalHost(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if cfg.CanonicalHost != test.expected {
+			t.Errorf("Test %d: Expected canonical host '%s', got '%s'", i, test.expected, cfg.CanonicalHost)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package clientcert is middleware that lets through the requests
+// to a path only if they come with a TLS client certificate that
+// verifies and whose subject or names match patterns, so that part
+// of a site can be limited to some clients while the rest is open.
+//
+// Since a client certificate cannot be asked for again once the
+// connection is up, the site requests one in every handshake but
+// does not require it; it is checked here.
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Placeholders set for the requests that match a rule, with the
+// identity of the client certificate, or empty if there is none.
+// Values that a certificate has more than one of are separated
+// by commas.
+const (
+	CommonNamePlaceholder  = "clientcert_cn"
+	OrgUnitPlaceholder     = "clientcert_ou"
+	OrgPlaceholder         = "clientcert_o"
+	EmailPlaceholder       = "clientcert_email"
+	URIPlaceholder         = "clientcert_uri"
+	SerialPlaceholder      = "clientcert_serial"
+	FingerprintPlaceholder = "clientcert_fingerprint"
+)
+
+// ChallengeHeader is the value of the WWW-Authenticate header of the
+// responses with status 401 to requests without a valid certificate,
+// which tells the client it has to present one.
+const ChallengeHeader = "ClientCertificate"
+
+// ClientCertFilter is middleware that checks the client
+// certificate of the requests that match one of its rules.
+type ClientCertFilter struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is the check of the client certificates of the requests
+// to a path. A certificate is valid if it verifies against Roots
+// for client authentication; it matches if, for each kind of
+// pattern the rule has, one of the patterns matches one of the
+// values of that kind the certificate has. Patterns are globs,
+// as path.Match has them.
+type Rule struct {
+	Path string
+
+	// Require refuses the requests without a certificate;
+	// otherwise they are let through, with the identity
+	// placeholders empty. A certificate that is presented must
+	// always be valid and match.
+	Require bool
+
+	// Status is the status of the responses to requests without
+	// a valid certificate, 401 or 403; requests with a valid
+	// certificate that does not match always get 403.
+	Status int
+
+	Roots *x509.CertPool
+
+	CommonNames []string
+	OrgUnits    []string
+	Orgs        []string
+	Emails      []string // email address SANs
+	URIs        []string // URI SANs
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (f ClientCertFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule, ok := f.match(r)
+	if !ok {
+		return f.Next.ServeHTTP(w, r)
+	}
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+		if !rule.verify(r.TLS.PeerCertificates) {
+			return rule.refuse(w), nil
+		}
+		if !rule.matches(cert) {
+			return http.StatusForbidden, nil
+		}
+	} else if rule.Require {
+		return rule.refuse(w), nil
+	}
+
+	for key, value := range identity(cert) {
+		if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
+			rr.Replacer.Set(key, value)
+		}
+		value := value
+		r = httpserver.WithPlaceholder(r, key, func() string { return value })
+	}
+	return f.Next.ServeHTTP(w, r)
+}
+
+// match returns the rule with the longest path that matches r.
+func (f ClientCertFilter) match(r *http.Request) (Rule, bool) {
+	var rule Rule
+	var found bool
+	for _, candidate := range f.Rules {
+		if !httpserver.Path(r.URL.Path).Matches(candidate.Path) {
+			continue
+		}
+		if !found || len(candidate.Path) > len(rule.Path) {
+			rule, found = candidate, true
+		}
+	}
+	return rule, found
+}
+
+// refuse returns the status of the responses to requests
+// without a valid certificate, with the header it needs.
+func (rule Rule) refuse(w http.ResponseWriter) int {
+	if rule.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", ChallengeHeader)
+	}
+	return rule.Status
+}
+
+// verify returns true if the first of certs, which the client
+// presented, verifies against the roots of rule with the rest
+// of certs as intermediates.
+func (rule Rule) verify(certs []*x509.Certificate) bool {
+	opts := x509.VerifyOptions{
+		Roots:         rule.Roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// matches returns true if cert matches the patterns of rule.
+func (rule Rule) matches(cert *x509.Certificate) bool {
+	return matchAny(rule.CommonNames, []string{cert.Subject.CommonName}) &&
+		matchAny(rule.OrgUnits, cert.Subject.OrganizationalUnit) &&
+		matchAny(rule.Orgs, cert.Subject.Organization) &&
+		matchAny(rule.Emails, cert.EmailAddresses) &&
+		matchAny(rule.URIs, uriSANs(cert))
+}
+
+// matchAny returns true if there are no patterns, or if one
+// of values matches one of patterns.
+func matchAny(patterns, values []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identity returns the values of the placeholders for cert,
+// which are empty if cert is nil.
+func identity(cert *x509.Certificate) map[string]string {
+	if cert == nil {
+		return map[string]string{
+			CommonNamePlaceholder: "", OrgUnitPlaceholder: "", OrgPlaceholder: "", EmailPlaceholder: "",
+			URIPlaceholder: "", SerialPlaceholder: "", FingerprintPlaceholder: "",
+		}
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return map[string]string{
+		CommonNamePlaceholder:  cert.Subject.CommonName,
+		OrgUnitPlaceholder:     strings.Join(cert.Subject.OrganizationalUnit, ","),
+		OrgPlaceholder:         strings.Join(cert.Subject.Organization, ","),
+		EmailPlaceholder:       strings.Join(cert.EmailAddresses, ","),
+		URIPlaceholder:         strings.Join(uriSANs(cert), ","),
+		SerialPlaceholder:      cert.SerialNumber.Text(16),
+		FingerprintPlaceholder: hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+func uriSANs(cert *x509.Certificate) []string {
+	var uris []string
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	return uris
+}
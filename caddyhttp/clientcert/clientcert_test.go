@@ -0,0 +1,208 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// testCA is an authority that issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func (ca testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a client certificate with subject and SANs.
+func (ca testCA) issue(t *testing.T, subject pkix.Name, email, uri string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email != "" {
+		template.EmailAddresses = []string{email}
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startFilter starts a TLS server that requests client certificates
+// and passes the requests to filter, in front of a handler that
+// answers with the common name of the client it was told.
+func startFilter(filter ClientCertFilter) *httptest.Server {
+	filter.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Write([]byte(httpserver.NewReplacer(r, nil, "-").Replace("{" + CommonNamePlaceholder + "}")))
+		return http.StatusOK, nil
+	})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, _ := filter.ServeHTTP(w, r); status >= 400 {
+			w.WriteHeader(status)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	return server
+}
+
+// get requests path from server with the client certificate cert,
+// if it has one, and returns the status and the body.
+func get(t *testing.T, server *httptest.Server, path string, cert *tls.Certificate) (*http.Response, string) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestClientCertFilter(t *testing.T) {
+	ca := newTestCA(t, "Test Client CA")
+	other := newTestCA(t, "Other CA")
+	ops := ca.issue(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops"}, Organization: []string{"Example"}},
+		"alice@example.com", "spiffe://cluster/ops/alice")
+	dev := ca.issue(t, pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"dev"}, Organization: []string{"Example"}},
+		"bob@example.com", "spiffe://cluster/dev/bob")
+	impostor := other.issue(t, pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{"ops"}},
+		"", "spiffe://cluster/ops/mallory")
+
+	server := startFilter(ClientCertFilter{Rules: []Rule{
+		{Path: "/admin", Require: true, Status: http.StatusForbidden, Roots: ca.pool(),
+			OrgUnits: []string{"ops"}, URIs: []string{"spiffe://cluster/ops/*"}},
+		{Path: "/internal", Require: true, Status: http.StatusUnauthorized, Roots: ca.pool(),
+			Orgs: []string{"Example"}, Emails: []string{"*@example.com"}},
+		{Path: "/optional", Status: http.StatusForbidden, Roots: ca.pool(), CommonNames: []string{"a*"}},
+	}})
+	defer server.Close()
+
+	for i, test := range []struct {
+		path           string
+		cert           *tls.Certificate
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/", nil, http.StatusOK, "{clientcert_cn}"},
+		{"/", &dev, http.StatusOK, "{clientcert_cn}"},
+		{"/admin", nil, http.StatusForbidden, ""},
+		{"/admin", &ops, http.StatusOK, "alice"},
+		{"/admin/users", &ops, http.StatusOK, "alice"},
+		{"/admin", &dev, http.StatusForbidden, ""},
+		{"/admin", &impostor, http.StatusForbidden, ""},
+		{"/internal", nil, http.StatusUnauthorized, ""},
+		{"/internal", &impostor, http.StatusUnauthorized, ""},
+		{"/internal", &dev, http.StatusOK, "bob"},
+		{"/optional", nil, http.StatusOK, "-"},
+		{"/optional", &ops, http.StatusOK, "alice"},
+		{"/optional", &dev, http.StatusForbidden, ""},
+	} {
+		resp, body := get(t, server, test.path, test.cert)
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, resp.StatusCode)
+		}
+		if test.expectedStatus == http.StatusOK && body != test.expectedBody {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.expectedBody, body)
+		}
+		expectChallenge := ""
+		if test.expectedStatus == http.StatusUnauthorized {
+			expectChallenge = ChallengeHeader
+		}
+		if got := resp.Header.Get("WWW-Authenticate"); got != expectChallenge {
+			t.Errorf("Test %d: Expected WWW-Authenticate %q, got %q", i, expectChallenge, got)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	ca := newTestCA(t, "Test Client CA")
+	issued := ca.issue(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"ops", "oncall"}, Organization: []string{"Example"}},
+		"alice@example.com", "spiffe://cluster/ops/alice")
+	cert, err := x509.ParseCertificate(issued.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := identity(cert)
+	for key, expected := range map[string]string{
+		CommonNamePlaceholder: "alice",
+		OrgUnitPlaceholder:    "ops,oncall",
+		OrgPlaceholder:        "Example",
+		EmailPlaceholder:      "alice@example.com",
+		URIPlaceholder:        "spiffe://cluster/ops/alice",
+		SerialPlaceholder:     cert.SerialNumber.Text(16),
+	} {
+		if id[key] != expected {
+			t.Errorf("Expected %s to be %q, got %q", key, expected, id[key])
+		}
+	}
+	if len(id[FingerprintPlaceholder]) != 64 {
+		t.Errorf("Expected a SHA-256 fingerprint in hex, got %q", id[FingerprintPlaceholder])
+	}
+}
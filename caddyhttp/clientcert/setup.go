@@ -0,0 +1,146 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("clientcert_filter", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new ClientCertFilter middleware instance.
+func setup(c *caddy.Controller) error {
+	cfg := httpserver.GetConfig(c)
+	rules, err := parse(c, cfg.TLS.ClientCerts)
+	if err != nil {
+		return err
+	}
+
+	// the certificate is requested in the handshake, unless the
+	// site already asks for one more strictly, but it is up to
+	// the rules whether it is needed; the authorities of the
+	// rules are only trusted by the rules, not by the whole site
+	if cfg.TLS.ClientAuth == tls.NoClientCert {
+		cfg.TLS.ClientAuth = tls.RequestClientCert
+	}
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return ClientCertFilter{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+// parse parses the clientcert_filter directives, each of which is
+//
+//	clientcert_filter [path] {
+//	    require
+//	    status      401|403
+//	    ca          file...
+//	    match_cn    pattern...
+//	    match_ou    pattern...
+//	    match_o     pattern...
+//	    match_email pattern...
+//	    match_san   pattern...
+//	}
+//
+// where match_san matches URI SANs. The certificates of the
+// authorities in the ca files, or else in the client CA files of
+// the tls directive, siteCAs, are the roots that certificates are
+// verified against.
+func parse(c *caddy.Controller, siteCAs []string) ([]Rule, error) {
+	var rules []Rule
+	for c.Next() {
+		rule := Rule{Path: "/", Status: http.StatusForbidden}
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Path = args[0]
+		default:
+			return nil, c.ArgErr()
+		}
+		for _, existing := range rules {
+			if existing.Path == rule.Path {
+				return nil, c.Errf("duplicate clientcert_filter path '%s'", rule.Path)
+			}
+		}
+
+		var caFiles []string
+		for c.NextBlock() {
+			property := c.Val()
+			args := c.RemainingArgs()
+			if property == "require" {
+				if len(args) != 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Require = true
+				continue
+			}
+			if len(args) == 0 || (property == "status" && len(args) != 1) {
+				return nil, c.ArgErr()
+			}
+			if strings.HasPrefix(property, "match_") {
+				for _, pattern := range args {
+					if _, err := path.Match(pattern, ""); err != nil {
+						return nil, c.Errf("bad clientcert_filter pattern '%s': %v", pattern, err)
+					}
+				}
+			}
+			switch property {
+			case "status":
+				switch args[0] {
+				case "401":
+					rule.Status = http.StatusUnauthorized
+				case "403":
+					rule.Status = http.StatusForbidden
+				default:
+					return nil, c.Errf("clientcert_filter status must be 401 or 403, not '%s'", args[0])
+				}
+			case "ca":
+				caFiles = append(caFiles, args...)
+			case "match_cn":
+				rule.CommonNames = append(rule.CommonNames, args...)
+			case "match_ou":
+				rule.OrgUnits = append(rule.OrgUnits, args...)
+			case "match_o":
+				rule.Orgs = append(rule.Orgs, args...)
+			case "match_email":
+				rule.Emails = append(rule.Emails, args...)
+			case "match_san":
+				rule.URIs = append(rule.URIs, args...)
+			default:
+				return nil, c.Errf("unknown clientcert_filter property '%s'", property)
+			}
+		}
+
+		if len(caFiles) == 0 {
+			caFiles = siteCAs
+		}
+		if len(caFiles) == 0 {
+			return nil, c.Err("clientcert_filter needs the certificates of the client authorities; use ca, or list them in tls clients")
+		}
+		rule.Roots = x509.NewCertPool()
+		for _, file := range caFiles {
+			pemData, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, c.Errf("loading client authority: %v", err)
+			}
+			if !rule.Roots.AppendCertsFromPEM(pemData) {
+				return nil, c.Errf("loading client authority '%s': no certificates", file)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
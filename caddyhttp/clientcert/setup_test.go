@@ -0,0 +1,91 @@
+package clientcert
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, newTestCA(t, "Test Client CA").pem(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		input         string
+		siteCAs       []string
+		shouldErr     bool
+		expectedRules int
+	}{
+		{"clientcert_filter /admin {\nrequire\nca " + caFile + "\nmatch_ou ops\nmatch_san spiffe://cluster/ops/*\n}", nil, false, 1},
+		{"clientcert_filter {\nstatus 401\nmatch_cn *.example.com\nmatch_o Example\nmatch_email *@example.com\n}", []string{caFile}, false, 1},
+		{"clientcert_filter /a {\nrequire\n}\nclientcert_filter /b {\nca " + caFile + "\n}", []string{caFile}, false, 2},
+		{"clientcert_filter /admin {\nrequire\n}", nil, true, 0},
+		{"clientcert_filter /admin {\nca " + filepath.Join(dir, "missing.pem") + "\n}", nil, true, 0},
+		{"clientcert_filter /admin {\nca " + notPEM + "\n}", nil, true, 0},
+		{"clientcert_filter /a /b {\nca " + caFile + "\n}", nil, true, 0},
+		{"clientcert_filter {\nca " + caFile + "\nrequire yes\n}", nil, true, 0},
+		{"clientcert_filter {\nca " + caFile + "\nstatus 404\n}", nil, true, 0},
+		{"clientcert_filter {\nca " + caFile + "\nmatch_ou\n}", nil, true, 0},
+		{"clientcert_filter {\nca " + caFile + "\nmatch_cn [\n}", nil, true, 0},
+		{"clientcert_filter {\nca " + caFile + "\nmatch_dns example.com\n}", nil, true, 0},
+		{"clientcert_filter /a {\nca " + caFile + "\n}\nclientcert_filter /a {\nca " + caFile + "\n}", nil, true, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		cfg := httpserver.GetConfig(c)
+		cfg.TLS.ClientCerts = test.siteCAs
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		mids := cfg.Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		handler := mids[0](httpserver.EmptyNext).(ClientCertFilter)
+		if len(handler.Rules) != test.expectedRules {
+			t.Errorf("Test %d: Expected %d rules, got %d", i, test.expectedRules, len(handler.Rules))
+		}
+		if cfg.TLS.ClientAuth != tls.RequestClientCert {
+			t.Errorf("Test %d: Expected client certificates to be requested, got client auth %v", i, cfg.TLS.ClientAuth)
+		}
+		if len(cfg.TLS.ClientCerts) != len(test.siteCAs) {
+			t.Errorf("Test %d: Expected the client authorities of the site to stay %v, got %v", i, test.siteCAs, cfg.TLS.ClientCerts)
+		}
+	}
+}
+
+func TestSetupKeepsStricterClientAuth(t *testing.T) {
+	c := caddy.NewTestController("http", "clientcert_filter /admin")
+	cfg := httpserver.GetConfig(c)
+	cfg.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.TLS.ClientCerts = []string{"ca.pem"}
+	// the authority file does not exist, but
+	// the client auth must not be changed anyway
+	setup(c)
+	if cfg.TLS.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("Expected client auth to stay %v, got %v", tls.VerifyClientCertIfGiven, cfg.TLS.ClientAuth)
+	}
+}
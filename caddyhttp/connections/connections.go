@@ -0,0 +1,56 @@
+// Package connections serves a debugging endpoint that lists the
+// open connections of the process and the requests they are serving.
+package connections
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// BasePath is the default path of the endpoint.
+const BasePath = "/debug/connections"
+
+// Handler lists the open connections of all servers, with the
+// requests that are in a handler, as text.
+type Handler struct {
+	Next    httpserver.Handler
+	Options debugendpoint.Options
+
+	// ShowQuery lists the query strings of the requests,
+	// which are redacted otherwise
+	ShowQuery bool
+}
+
+// ServeHTTP serves the list at the configured path (BasePath by
+// default), or passes all other requests up the chain. Unless
+// credentials are required, only clients on the loopback interface
+// may see it; the rest are answered as if there was nothing there.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	path := h.Options.Path
+	if path == "" {
+		path = BasePath
+	}
+	if !httpserver.Path(r.URL.Path).Matches(path) {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if !h.Options.Authorized(r) || (len(h.Options.Users) == 0 && !loopback(r)) {
+		return http.StatusNotFound, nil
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	httpserver.WriteConnections(w, httpserver.Connections(h.ShowQuery))
+	return 0, nil
+}
+
+// loopback returns true if r is from the loopback interface.
+func loopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
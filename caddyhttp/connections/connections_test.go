@@ -0,0 +1,116 @@
+package connections
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func nextHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Write([]byte("content"))
+	return http.StatusNotFound, nil
+}
+
+func TestServeHTTPAccess(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := Handler{Next: httpserver.HandlerFunc(nextHandler)}
+	protected := Handler{
+		Next:    httpserver.HandlerFunc(nextHandler),
+		Options: debugendpoint.Options{Users: map[string][]byte{"admin": hash}},
+	}
+
+	for i, test := range []struct {
+		handler  Handler
+		path     string
+		remote   string
+		password string
+		served   bool
+	}{
+		{open, "/debug/connections", "127.0.0.1:1234", "", true},
+		{open, "/debug/connections", "[::1]:1234", "", true},
+		{open, "/debug/connections", "203.0.113.1:1234", "", false},
+		{open, "/foo", "127.0.0.1:1234", "", false},
+		{protected, "/debug/connections", "203.0.113.1:1234", "secret", true},
+		{protected, "/debug/connections", "127.0.0.1:1234", "", false},
+		{protected, "/debug/connections", "127.0.0.1:1234", "wrong", false},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.RemoteAddr = test.remote
+		if test.password != "" {
+			r.SetBasicAuth("admin", test.password)
+		}
+		w := httptest.NewRecorder()
+		status, err := test.handler.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if test.served && (status != 0 || w.Body.String() == "content") {
+			t.Errorf("Test %d: Expected the connections to be listed, got status %d and body '%s'", i, status, w.Body.String())
+		}
+		if !test.served && status != http.StatusNotFound {
+			t.Errorf("Test %d: Expected status 404, got %d", i, status)
+		}
+	}
+}
+
+func TestServeHTTPListsRequests(t *testing.T) {
+	release := make(chan struct{})
+	site := httpserver.SiteConfig{Addr: httpserver.Address{Original: "example.com", Host: "example.com"}}
+	site.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			<-release
+			return 0, nil
+		})
+	})
+	s, err := httpserver.NewServer("127.0.0.1:0", []*httpserver.SiteConfig{&site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+	defer s.Stop()
+	defer close(release)
+
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/slow?key=s3cret", nil)
+		req.Host = "example.com"
+		if resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	for i, test := range []struct {
+		showQuery bool
+		expected  string
+	}{
+		{false, "    GET example.com/slow?REDACTED HTTP/1.1 "},
+		{true, "    GET example.com/slow?key=s3cret HTTP/1.1 "},
+	} {
+		h := Handler{Next: httpserver.HandlerFunc(nextHandler), ShowQuery: test.showQuery}
+		deadline := time.Now().Add(5 * time.Second)
+		var body string
+		for !strings.Contains(body, test.expected) && time.Now().Before(deadline) {
+			r := httptest.NewRequest("GET", "/debug/connections", nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			body = w.Body.String()
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !strings.Contains(body, test.expected) {
+			t.Errorf("Test %d: Expected the request in flight to be listed as '%s', got:\n%s", i, test.expected, body)
+		}
+	}
+}
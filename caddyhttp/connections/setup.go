@@ -0,0 +1,67 @@
+package connections
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("connections", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+		Redact:     debugendpoint.Redact,
+	})
+}
+
+// setup serves the connections endpoint. It accepts no arguments,
+// but an optional block with show_query, which lists the query
+// strings of the requests, and the options that protect debugging
+// endpoints (see package debugendpoint).
+func setup(c *caddy.Controller) error {
+	h, err := connectionsParse(c)
+	if err != nil {
+		return err
+	}
+
+	debugendpoint.Install(c, "connections", h.Options, func(next httpserver.Handler) httpserver.Handler {
+		handler := h
+		handler.Next = next
+		return handler
+	})
+
+	return nil
+}
+
+func connectionsParse(c *caddy.Controller) (Handler, error) {
+	h := Handler{Options: debugendpoint.Options{Path: BasePath}}
+	found := false
+
+	for c.Next() {
+		if found {
+			return h, c.Err("connections can only be specified once")
+		}
+		if len(c.RemainingArgs()) != 0 {
+			return h, c.ArgErr()
+		}
+		for c.NextBlock() {
+			if c.Val() == "show_query" {
+				if c.NextArg() {
+					return h, c.ArgErr()
+				}
+				h.ShowQuery = true
+				continue
+			}
+			ok, err := debugendpoint.ParseOption(c, &h.Options)
+			if err != nil {
+				return h, err
+			}
+			if !ok {
+				return h, c.Errf("Unknown connections option '%s'", c.Val())
+			}
+		}
+		found = true
+	}
+
+	return h, nil
+}
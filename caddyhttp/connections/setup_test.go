@@ -0,0 +1,50 @@
+package connections
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		showQuery bool
+		path      string
+	}{
+		{`connections`, false, false, BasePath},
+		{`connections {}`, true, false, ""},
+		{`connections /foo`, true, false, ""},
+		{"connections {\npath /secret\nshow_query\n}", false, true, "/secret"},
+		{"connections {\nshow_query yes\n}", true, false, ""},
+		{"connections {\na b\n}", true, false, ""},
+		{"connections\nconnections", true, false, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error but found nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error but found error: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		h := mids[0](httpserver.EmptyNext).(Handler)
+		if h.ShowQuery != test.showQuery || h.Options.Path != test.path {
+			t.Errorf("Test %d: Expected show_query %v and path %s, got %v and %s", i, test.showQuery, test.path, h.ShowQuery, h.Options.Path)
+		}
+		if !httpserver.SameNext(h.Next, httpserver.EmptyNext) {
+			t.Errorf("Test %d: 'Next' field of handler was not set properly", i)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Package deadline is middleware that limits how long
+// requests may take to be served.
+package deadline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Deadline is a middleware that cancels requests that are
+// not served within the timeout of the rule for their path.
+// The context of a request is canceled when its deadline
+// passes, which makes the proxy and fastcgi middleware
+// abandon the request to the upstream. If nothing was
+// written yet, the status is 504 Gateway Timeout, so that
+// the errors middleware can serve an error page; otherwise
+// the connection is closed, if it can be hijacked.
+type Deadline struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is a deadline for the requests with a path.
+type Rule struct {
+	// Path is the path the rule applies to; the
+	// longest path that matches a request wins
+	Path string
+
+	// Timeout is how long requests may take
+	Timeout time.Duration
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (d Deadline) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule, ok := d.match(r)
+	if !ok {
+		return d.Next.ServeHTTP(w, r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), rule.Timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	dw := &deadlineWriter{ResponseWriterWrapper: httpserver.ResponseWriterWrapper{ResponseWriter: w}, header: make(http.Header)}
+	copyHeader(dw.header, w.Header())
+
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- result{panicked: true, recovered: rec}
+			}
+		}()
+		status, err := d.Next.ServeHTTP(dw, r)
+		done <- result{status: status, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return dw.finish(res)
+	case <-ctx.Done():
+	}
+
+	dw.mu.Lock()
+	hijacked, wroteHeader := dw.hijacked, dw.wroteHeader
+	dw.timedOut = !hijacked
+	dw.mu.Unlock()
+
+	if hijacked {
+		// the connection is not ours to limit anymore
+		return dw.finish(<-done)
+	}
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("deadline of %v exceeded", rule.Timeout)
+	}
+	if !wroteHeader {
+		return http.StatusGatewayTimeout, err
+	}
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, hjErr := hj.Hijack(); hjErr == nil {
+			conn.Close()
+		}
+	}
+	return 0, err
+}
+
+// match returns the rule with the longest path that matches r.
+func (d Deadline) match(r *http.Request) (Rule, bool) {
+	var match Rule
+	var found bool
+	for _, rule := range d.Rules {
+		if httpserver.Path(r.URL.Path).Matches(rule.Path) && (!found || len(rule.Path) > len(match.Path)) {
+			match, found = rule, true
+		}
+	}
+	return match, found
+}
+
+// result is what the next handler returned.
+type result struct {
+	status    int
+	err       error
+	panicked  bool
+	recovered interface{}
+}
+
+// deadlineWriter is the response writer of the next handler, which
+// runs in its own goroutine. It keeps the handler from writing once
+// the deadline passed. Until the response header is written, the
+// handler changes a copy of it, so that an error page can be served
+// with the original header if the deadline passes.
+type deadlineWriter struct {
+	httpserver.ResponseWriterWrapper
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+	hijacked    bool
+}
+
+// Header returns the header of the response.
+func (w *deadlineWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wroteHeader && !w.timedOut {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+// WriteHeader writes the response header, unless the deadline passed.
+func (w *deadlineWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.wroteHeader {
+		return
+	}
+	w.writeHeader(status)
+}
+
+// writeHeader sets the header of the response to the copy of
+// the handler and writes it. w.mu must be locked.
+func (w *deadlineWriter) writeHeader(status int) {
+	w.setHeader()
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// setHeader replaces the header of the response with the
+// copy of the handler. w.mu must be locked.
+func (w *deadlineWriter) setHeader() {
+	header := w.ResponseWriter.Header()
+	for field := range header {
+		if _, ok := w.header[field]; !ok {
+			delete(header, field)
+		}
+	}
+	for field, values := range w.header {
+		header[field] = values
+	}
+}
+
+// finish is called when the handler returned in time, with what
+// it returned. If it did not write the response header, it sets
+// the header, so that an error page is served with the fields the
+// handler set. A panic of the handler is repeated here, so that
+// it can be recovered like any other.
+func (w *deadlineWriter) finish(res result) (int, error) {
+	if res.panicked {
+		panic(res.recovered)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.wroteHeader && !w.hijacked {
+		w.setHeader()
+	}
+	return res.status, res.err
+}
+
+// Write writes b, unless the deadline passed.
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack implements http.Hijacker. Hijacked connections,
+// like websockets, are not limited by the deadline.
+func (w *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	conn, brw, err := w.ResponseWriterWrapper.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Flush implements http.Flusher.
+func (w *deadlineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+	w.ResponseWriterWrapper.Flush()
+}
+
+// copyHeader copies the fields of src to dst.
+func copyHeader(dst, src http.Header) {
+	for field, values := range src {
+		dst[field] = append([]string(nil), values...)
+	}
+}
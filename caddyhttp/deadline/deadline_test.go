@@ -0,0 +1,153 @@
+package deadline
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+)
+
+func TestDeadlineCancelsUpstream(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	canceled := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+			w.Write([]byte("too late"))
+		}
+	}))
+	defer backend.Close()
+
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / "+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Deadline{
+		Next:  proxy.Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams},
+		Rules: []Rule{{Path: "/", Timeout: 50 * time.Millisecond}},
+	}
+
+	r, _ := http.NewRequest("GET", "/report", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	status, err := d.ServeHTTP(w, r)
+	if status != http.StatusGatewayTimeout || err == nil {
+		t.Errorf("Expected status 504 and an error, got %d and %v", status, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to return at the deadline, took %v", elapsed)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected nothing to be written, so that an error page can be, got %q", w.Body.String())
+	}
+	select {
+	case wasCanceled := <-canceled:
+		if !wasCanceled {
+			t.Error("Expected the context of the upstream request to be canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the upstream to notice the cancellation")
+	}
+}
+
+func TestDeadlineAfterWrite(t *testing.T) {
+	d := Deadline{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			w.Write([]byte(" and the rest"))
+			return 0, nil
+		}),
+		Rules: []Rule{{Path: "/", Timeout: 50 * time.Millisecond}},
+	}
+	returned := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := d.ServeHTTP(w, r)
+		returned <- status
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		t.Error("Expected reading the body to fail because the connection was closed")
+	}
+	if string(body) != "partial" {
+		t.Errorf("Expected the body written before the deadline, got %q", body)
+	}
+	if status := <-returned; status != 0 {
+		t.Errorf("Expected status 0 since a response was written, got %d", status)
+	}
+}
+
+func TestDeadlineLongestPath(t *testing.T) {
+	d := Deadline{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				w.Write([]byte("report"))
+				return 0, nil
+			case <-r.Context().Done():
+				return http.StatusServiceUnavailable, r.Context().Err()
+			}
+		}),
+		Rules: []Rule{
+			{Path: "/", Timeout: 10 * time.Millisecond},
+			{Path: "/reports", Timeout: 5 * time.Second},
+		},
+	}
+
+	for i, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/reports/yearly", 0, "report"},
+		{"/other", http.StatusGatewayTimeout, ""},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		status, _ := d.ServeHTTP(w, r)
+		if status != test.status || w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected status %d and body %q, got %d and %q", i, test.status, test.body, status, w.Body.String())
+		}
+	}
+}
+
+func TestDeadlineInTime(t *testing.T) {
+	d := Deadline{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("WWW-Authenticate", "Basic")
+			return http.StatusUnauthorized, nil
+		}),
+		Rules: []Rule{{Path: "/", Timeout: time.Second}},
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	w.Header().Set("Server", "Caddy")
+	status, err := d.ServeHTTP(w, r)
+	if status != http.StatusUnauthorized || err != nil {
+		t.Errorf("Expected status 401 and no error, got %d and %v", status, err)
+	}
+	if w.Header().Get("WWW-Authenticate") != "Basic" || w.Header().Get("Server") != "Caddy" {
+		t.Errorf("Expected header set by the handler and before it, got %v", w.Header())
+	}
+}
@@ -0,0 +1,71 @@
+package deadline
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("deadline", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Deadline middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := deadlineParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Deadline{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// deadlineParse parses deadline directives, which look like:
+//
+//	deadline [path] timeout
+//
+// The path defaults to /.
+func deadlineParse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+
+	for c.Next() {
+		rule := Rule{Path: "/"}
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 1:
+		case 2:
+			if !strings.HasPrefix(args[0], "/") {
+				return nil, c.Errf("Invalid path '%s'; must begin with /", args[0])
+			}
+			rule.Path = args[0]
+			args = args[1:]
+		default:
+			return nil, c.ArgErr()
+		}
+
+		timeout, err := time.ParseDuration(args[0])
+		if err != nil || timeout <= 0 {
+			return nil, c.Errf("Invalid timeout '%s'; must be a positive duration", args[0])
+		}
+		rule.Timeout = timeout
+
+		for _, other := range rules {
+			if other.Path == rule.Path {
+				return nil, c.Errf("Duplicate deadline for path %s", rule.Path)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,69 @@
+package deadline
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `deadline /reports 120s`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Deadline)
+	if !ok {
+		t.Fatalf("Expected handler to be type Deadline, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestDeadlineParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`deadline 10s`, false, []Rule{{Path: "/", Timeout: 10 * time.Second}}},
+		{"deadline /reports 120s\ndeadline / 10s", false, []Rule{
+			{Path: "/reports", Timeout: 120 * time.Second},
+			{Path: "/", Timeout: 10 * time.Second},
+		}},
+		{`deadline`, true, nil},
+		{`deadline /reports`, true, nil},
+		{`deadline reports 10s`, true, nil},
+		{`deadline / 0s`, true, nil},
+		{`deadline / soon`, true, nil},
+		{`deadline / 10s 20s`, true, nil},
+		{"deadline 10s\ndeadline / 20s", true, nil},
+	}
+	for i, test := range tests {
+		actual, err := deadlineParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected rules %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
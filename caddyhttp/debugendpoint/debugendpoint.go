@@ -0,0 +1,243 @@
+// Package debugendpoint protects endpoints that expose debugging
+// information about the process, such as pprof and expvar. It lets
+// those endpoints require credentials and be served on a separate
+// listener instead of on the site they are configured for.
+package debugendpoint
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultPort is the port of the separate listener if
+// the bind option does not specify one.
+const DefaultPort = "6060"
+
+// Options configures how a debugging endpoint is protected.
+type Options struct {
+	// The path prefix to serve the endpoint on
+	Path string
+
+	// Bcrypt hashes of passwords, keyed by username; if
+	// empty, the endpoint does not require credentials
+	Users map[string][]byte
+
+	// The address of a separate listener to serve the
+	// endpoint on; if empty, the site serves it
+	Bind string
+}
+
+// ParseOption parses the option the dispenser of c is on into
+// opts. It returns false if that is not an option known to this
+// package, in which case the caller should handle it.
+func ParseOption(c *caddy.Controller, opts *Options) (bool, error) {
+	switch c.Val() {
+	case "path":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		opts.Path = c.Val()
+	case "basicauth":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return true, c.ArgErr()
+		}
+		if _, err := bcrypt.Cost([]byte(args[1])); err != nil {
+			return true, c.Errf("Password for '%s' must be a bcrypt hash: %v", args[0], err)
+		}
+		if opts.Users == nil {
+			opts.Users = make(map[string][]byte)
+		}
+		opts.Users[args[0]] = []byte(args[1])
+	case "bind":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		addr := c.Val()
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, DefaultPort)
+		}
+		opts.Bind = addr
+	default:
+		return false, nil
+	}
+	if c.NextArg() {
+		return true, c.ArgErr()
+	}
+	return true, nil
+}
+
+// Redact hides the password hashes of the basicauth options in
+// the block of an exported debugging endpoint directive.
+func Redact(d *caddy.DirectiveExport) {
+	for i := range d.Block {
+		if line := &d.Block[i]; line.Name == "basicauth" && len(line.Args) == 2 {
+			line.Args[1] = caddy.Redacted
+		}
+	}
+}
+
+// Authorized returns true if the endpoint does not require
+// credentials or if r has the credentials of one of the users.
+func (o Options) Authorized(r *http.Request) bool {
+	if len(o.Users) == 0 {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := o.Users[username]
+	if !ok {
+		// take as long as for a wrong password, so that the
+		// time it takes does not tell which users exist
+		bcrypt.CompareHashAndPassword(o.dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// dummyHashes are bcrypt hashes of no password that anyone
+// knows, keyed by their cost, to compare the passwords of
+// unknown users against.
+var (
+	dummyHashes   = make(map[int][]byte)
+	dummyHashesMu sync.Mutex
+)
+
+// dummyHash returns a bcrypt hash with the highest cost of
+// the hashes of the users of o.
+func (o Options) dummyHash() []byte {
+	cost := bcrypt.MinCost
+	for _, hash := range o.Users {
+		if c, err := bcrypt.Cost(hash); err == nil && c > cost {
+			cost = c
+		}
+	}
+	dummyHashesMu.Lock()
+	defer dummyHashesMu.Unlock()
+	if hash, ok := dummyHashes[cost]; ok {
+		return hash
+	}
+	password := make([]byte, 16)
+	rand.Read(password)
+	hash, _ := bcrypt.GenerateFromPassword(password, cost)
+	dummyHashes[cost] = hash
+	return hash
+}
+
+// listener is a separate listener shared by the debugging
+// endpoints that are bound to its address.
+type listener struct {
+	ln          net.Listener
+	middlewares map[string]httpserver.Middleware // keyed by endpoint name
+	refs        map[string]int                   // keyed by endpoint name
+}
+
+var (
+	listeners   = make(map[string]*listener)
+	listenersMu sync.RWMutex
+)
+
+// Serve makes the separate listener at addr serve the endpoint
+// called name, which is made by m, starting the listener if
+// needed, or taking it over from the parent process after an
+// upgrade. If the listener already serves an endpoint by that
+// name, m replaces it, which allows instances to restart without
+// losing the listener. Every call to Serve must be balanced with
+// a call to Unserve.
+func Serve(addr, name string, m httpserver.Middleware) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	l, ok := listeners[addr]
+	if !ok {
+		ln, err := caddy.ListenExtra(addr)
+		if err != nil {
+			return err
+		}
+		l = &listener{
+			ln:          ln,
+			middlewares: make(map[string]httpserver.Middleware),
+			refs:        make(map[string]int),
+		}
+		listeners[addr] = l
+
+		// without keep-alive, closing the listener
+		// is enough to stop serving the endpoints
+		srv := &http.Server{Handler: l}
+		srv.SetKeepAlivesEnabled(false)
+		go srv.Serve(ln)
+	}
+	l.middlewares[name] = m
+	l.refs[name]++
+	return nil
+}
+
+// Unserve stops the separate listener at addr from serving the
+// endpoint called name, and closes the listener when it no
+// longer serves any endpoints.
+func Unserve(addr, name string) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	l, ok := listeners[addr]
+	if !ok {
+		return nil
+	}
+	if l.refs[name]--; l.refs[name] <= 0 {
+		delete(l.refs, name)
+		delete(l.middlewares, name)
+	}
+	if len(l.refs) > 0 {
+		return nil
+	}
+	delete(listeners, addr)
+	return l.ln.Close()
+}
+
+// ServeHTTP serves r with the endpoints of l.
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	listenersMu.RLock()
+	names := make([]string, 0, len(l.middlewares))
+	for name := range l.middlewares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var stack httpserver.Handler = httpserver.HandlerFunc(notFound)
+	for i := len(names) - 1; i >= 0; i-- {
+		stack = l.middlewares[names[i]](stack)
+	}
+	listenersMu.RUnlock()
+
+	if status, _ := stack.ServeHTTP(w, r); status >= 400 {
+		httpserver.DefaultErrorFunc(w, r, status)
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) (int, error) {
+	return http.StatusNotFound, nil
+}
+
+// Install makes the endpoint called name, which is made by m,
+// available as opts say: on the separate listener at opts.Bind
+// while the instance of c is running, or else on the site of c.
+func Install(c *caddy.Controller, name string, opts Options, m httpserver.Middleware) {
+	if opts.Bind == "" {
+		httpserver.GetConfig(c).AddMiddleware(m)
+		return
+	}
+	c.OnStartup(func() error {
+		return Serve(opts.Bind, name, m)
+	})
+	c.OnShutdown(func() error {
+		return Unserve(opts.Bind, name)
+	})
+}
@@ -0,0 +1,157 @@
+package debugendpoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseOption(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		input     string
+		known     bool
+		shouldErr bool
+		expected  func(Options) bool
+	}{
+		{"path /d", true, false, func(o Options) bool { return o.Path == "/d" }},
+		{"bind 127.0.0.1", true, false, func(o Options) bool { return o.Bind == "127.0.0.1:6060" }},
+		{"bind 127.0.0.1:7000", true, false, func(o Options) bool { return o.Bind == "127.0.0.1:7000" }},
+		{"bind [::1]:7000", true, false, func(o Options) bool { return o.Bind == "[::1]:7000" }},
+		{"basicauth admin " + string(hash), true, false, func(o Options) bool { return string(o.Users["admin"]) == string(hash) }},
+		{"basicauth admin plaintext", true, true, nil},
+		{"basicauth admin", true, true, nil},
+		{"path", true, true, nil},
+		{"path /a /b", true, true, nil},
+		{"bind", true, true, nil},
+		{"foo bar", false, false, nil},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		c.Next()
+		var opts Options
+		known, err := ParseOption(c, &opts)
+		if known != test.known {
+			t.Errorf("Test %d: Expected known=%v, got %v", i, test.known, known)
+		}
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: Expected error=%v, got: %v", i, test.shouldErr, err)
+		}
+		if test.expected != nil && !test.expected(opts) {
+			t.Errorf("Test %d: Unexpected options: %+v", i, opts)
+		}
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(Options{}).Authorized(new(http.Request)) {
+		t.Error("Expected request to be authorized when no users are configured")
+	}
+
+	opts := Options{Users: map[string][]byte{"admin": hash}}
+	for i, test := range []struct {
+		user, pass string
+		setAuth    bool
+		expected   bool
+	}{
+		{"admin", "secret", true, true},
+		{"admin", "wrong", true, false},
+		{"other", "secret", true, false},
+		{"", "", false, false},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if test.setAuth {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		if got := opts.Authorized(r); got != test.expected {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	// unknown users are checked against a hash as costly as theirs
+	costly, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Users["root"] = costly
+	if cost, err := bcrypt.Cost(opts.dummyHash()); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("Expected a dummy hash of cost %d, got %d (error: %v)", bcrypt.MinCost+1, cost, err)
+	}
+}
+
+// respond returns a middleware that answers requests to path with body.
+func respond(path, body string) httpserver.Middleware {
+	return func(next httpserver.Handler) httpserver.Handler {
+		return httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path != path {
+				return next.ServeHTTP(w, r)
+			}
+			fmt.Fprint(w, body)
+			return 0, nil
+		})
+	}
+}
+
+func TestSeparateListener(t *testing.T) {
+	const addr = "127.0.0.1:0"
+	if err := Serve(addr, "a", respond("/a", "A")); err != nil {
+		t.Fatalf("Expected no error starting listener, got: %v", err)
+	}
+	if err := Serve(addr, "b", respond("/b", "B")); err != nil {
+		t.Fatalf("Expected no error adding endpoint, got: %v", err)
+	}
+	url := "http://" + listeners[addr].ln.Addr().String()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("/a"); status != http.StatusOK || body != "A" {
+		t.Errorf("Expected endpoint a to be served, got %d: %s", status, body)
+	}
+	if status, body := get("/b"); status != http.StatusOK || body != "B" {
+		t.Errorf("Expected endpoint b to be served, got %d: %s", status, body)
+	}
+	if status, _ := get("/c"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown path, got %d", status)
+	}
+
+	// replacing an endpoint, like a restart does, keeps the listener
+	if err := Serve(addr, "a", respond("/a", "A2")); err != nil {
+		t.Fatal(err)
+	}
+	Unserve(addr, "a")
+	if status, body := get("/a"); status != http.StatusOK || body != "A2" {
+		t.Errorf("Expected replaced endpoint a to be served, got %d: %s", status, body)
+	}
+
+	Unserve(addr, "a")
+	if status, _ := get("/a"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 after endpoint a is removed, got %d", status)
+	}
+
+	Unserve(addr, "b")
+	if _, ok := listeners[addr]; ok {
+		t.Error("Expected listener to be closed after last endpoint is removed")
+	}
+	if status, _ := get("/b"); status != 0 {
+		t.Errorf("Expected connection to fail after listener closed, got status %d", status)
+	}
+}
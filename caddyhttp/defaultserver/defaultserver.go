@@ -0,0 +1,57 @@
+// Package defaultserver decides which site serves the requests
+// whose Host matches no site on their listener.
+package defaultserver
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("default_server", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupDefaultServer,
+	})
+	caddy.RegisterPlugin("unmatched_host", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupUnmatchedHost,
+	})
+}
+
+// setupDefaultServer makes the site serve the requests on its
+// listener whose Host matches no other site.
+func setupDefaultServer(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		config.DefaultServer = true
+	}
+	return nil
+}
+
+// setupUnmatchedHost configures what happens to the requests on
+// the site's listener whose Host matches no site, if no site is
+// the default server: either a 404 response or closing the
+// connection without one.
+func setupUnmatchedHost(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "404":
+			config.CloseUnmatched = false
+		case "close":
+			config.CloseUnmatched = true
+		default:
+			return c.Errf("Unknown unmatched host action '%s'; must be 404 or close", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	}
+	return nil
+}
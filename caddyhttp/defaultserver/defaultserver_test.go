@@ -0,0 +1,62 @@
+package defaultserver
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupDefaultServer(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`default_server`, false},
+		{`default_server yes`, true},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupDefaultServer(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if !httpserver.GetConfig(c).DefaultServer {
+			t.Errorf("Test %d: Expected site to be the default server", i)
+		}
+	}
+}
+
+func TestSetupUnmatchedHost(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		close     bool
+	}{
+		{`unmatched_host close`, false, true},
+		{`unmatched_host 404`, false, false},
+		{`unmatched_host`, true, false},
+		{`unmatched_host drop`, true, false},
+		{`unmatched_host close now`, true, false},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupUnmatchedHost(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if got := httpserver.GetConfig(c).CloseUnmatched; got != test.close {
+			t.Errorf("Test %d: Expected CloseUnmatched to be %v, was %v", i, test.close, got)
+		}
+	}
+}
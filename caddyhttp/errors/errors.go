@@ -60,10 +60,21 @@ func (h ErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 
 // errorPage serves a static error page to w according to the status
 // code. If there is an error serving the error page, a plaintext error
-// message is written instead, and the extra error is logged.
+// message is written instead, and the extra error is logged. Pages
+// whose name ends in .tmpl are templates; see templatePage. Error
+// responses are not to be cached unless something says otherwise.
 func (h ErrorHandler) errorPage(w http.ResponseWriter, r *http.Request, code int) {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
 	// See if an error page for this status code was specified
 	if pagePath, ok := h.ErrorPages[code]; ok {
+		if strings.HasSuffix(pagePath, ".tmpl") {
+			h.templatePage(w, r, code, pagePath)
+			return
+		}
+
 		// Try to open it
 		errorPage, err := os.Open(pagePath)
 		if err != nil {
@@ -0,0 +1,97 @@
+package errors
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// RequestIDHeader is the header that identifies a request. If
+// a request does not have one, the request ID on its error page
+// is made up and sent to the client in this header.
+const RequestIDHeader = "X-Request-ID"
+
+// PageContext is what error pages that are templates are
+// executed with.
+type PageContext struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Path       string
+	Host       string
+	Time       time.Time
+
+	// Header holds the request headers, with the values
+	// of the ones that carry credentials redacted
+	Header map[string]string
+}
+
+// redactedHeaders are the request headers that are not
+// shown to templates.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// newPageContext returns the context of the error page with
+// status code for r. It sets the request ID header on w if r
+// does not have one.
+func newPageContext(w http.ResponseWriter, r *http.Request, code int) PageContext {
+	ctx := PageContext{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		RequestID:  r.Header.Get(RequestIDHeader),
+		Path:       r.URL.Path,
+		Host:       r.Host,
+		Time:       time.Now(),
+		Header:     make(map[string]string, len(r.Header)),
+	}
+	if ctx.RequestID == "" {
+		ctx.RequestID = newRequestID()
+		w.Header().Set(RequestIDHeader, ctx.RequestID)
+	}
+	for name, values := range r.Header {
+		if len(values) > 0 {
+			ctx.Header[name] = values[0]
+		}
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := ctx.Header[name]; ok {
+			ctx.Header[name] = caddy.Redacted
+		}
+	}
+	return ctx
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// templatePage serves the error page at pagePath for status
+// code, which is executed as a template with a PageContext.
+// The page is rendered before anything is written, so that if
+// this fails, a plaintext error message is written instead, and
+// the extra error is logged.
+func (h ErrorHandler) templatePage(w http.ResponseWriter, r *http.Request, code int, pagePath string) {
+	var buf bytes.Buffer
+	tpl, err := template.ParseFiles(pagePath)
+	if err == nil {
+		err = tpl.Execute(&buf, newPageContext(w, r, code))
+	}
+	if err != nil {
+		h.Log.Printf("%s [NOTICE %d %s] could not render error page %s: %v",
+			time.Now().Format(timeFormat), code, r.URL.String(), pagePath, err)
+		httpserver.DefaultErrorFunc(w, r, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,105 @@
+package errors
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestTemplateErrorPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	page := filepath.Join(dir, "404.tmpl")
+	err = ioutil.WriteFile(page, []byte(`{{.Status}}|{{.StatusText}}|{{.RequestID}}|{{.Path}}|{{.Host}}|`+
+		`{{.Time.Year}}|{{index .Header "User-Agent"}}|{{index .Header "Authorization"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "500.tmpl")
+	err = ioutil.WriteFile(broken, []byte(`{{.NoSuchField}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	eh := ErrorHandler{
+		ErrorPages: map[int]string{http.StatusNotFound: page, http.StatusInternalServerError: broken},
+		Log:        log.New(&buf, "", 0),
+	}
+
+	for i, test := range []struct {
+		status    int
+		requestID string
+		body      string // ID and YEAR stand for the request ID and the year
+	}{
+		{http.StatusNotFound, "abc123", "404|Not Found|abc123|/missing/<b>|example.com|YEAR|tester|" + caddy.Redacted},
+		{http.StatusNotFound, "", "404|Not Found|ID|/missing/<b>|example.com|YEAR|tester|" + caddy.Redacted},
+		{http.StatusInternalServerError, "abc123", "500 Internal Server Error\n"},
+	} {
+		buf.Reset()
+		eh.Next = genErrorHandler(test.status, nil, "")
+		req := httptest.NewRequest("GET", "http://example.com/missing/<b>", nil)
+		req.Header.Set("User-Agent", "tester")
+		req.Header.Set("Authorization", "Basic c2VjcmV0")
+		if test.requestID != "" {
+			req.Header.Set(RequestIDHeader, test.requestID)
+		}
+		rec := httptest.NewRecorder()
+		eh.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, rec.Code)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Test %d: Expected Cache-Control no-store, got %q", i, got)
+		}
+		requestID := test.requestID
+		if requestID == "" {
+			requestID = rec.Header().Get(RequestIDHeader)
+			if requestID == "" {
+				t.Errorf("Test %d: Expected a request ID to be made up and sent", i)
+			}
+		}
+		expected := strings.NewReplacer(
+			"|ID|", "|"+requestID+"|",
+			"YEAR", strconv.Itoa(time.Now().Year()),
+			"<b>", "&lt;b&gt;", // the page is HTML
+		).Replace(test.body)
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Test %d: Expected body %q, got %q", i, expected, got)
+		}
+	}
+	if !strings.Contains(buf.String(), "could not render error page") {
+		t.Errorf("Expected broken template to be logged, got log %q", buf.String())
+	}
+}
+
+func TestErrorPageCacheControl(t *testing.T) {
+	eh := ErrorHandler{
+		ErrorPages: make(map[int]string),
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			return http.StatusNotFound, nil
+		}),
+	}
+	rec := httptest.NewRecorder()
+	eh.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Expected Cache-Control set by the site to be kept, got %q", got)
+	}
+}
@@ -1,11 +1,13 @@
 package errors
 
 import (
+	"html/template"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-syslog"
 	"github.com/mholt/caddy"
@@ -121,6 +123,11 @@ func errorsParse(c *caddy.Controller) (*ErrorHandler, error) {
 					log.Printf("[WARNING] Unable to open error page '%s': %v", where, err)
 				}
 				f.Close()
+				if err == nil && strings.HasSuffix(where, ".tmpl") {
+					if _, err := template.ParseFiles(where); err != nil {
+						log.Printf("[WARNING] Unable to parse error page '%s': %v", where, err)
+					}
+				}
 
 				whatInt, err := strconv.Atoi(what)
 				if err != nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
@@ -12,12 +13,18 @@ import (
 type ExpVar struct {
 	Next     httpserver.Handler
 	Resource Resource
+	Options  debugendpoint.Options
 }
 
 // ServeHTTP handles requests to expvar's configured entry point with
-// expvar, or passes all other requests up the chain.
+// expvar, or passes all other requests up the chain. Requests without
+// valid credentials, if credentials are required, are answered as if
+// there was nothing there.
 func (e ExpVar) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	if httpserver.Path(r.URL.Path).Matches(string(e.Resource)) {
+		if !e.Options.Authorized(r) {
+			return http.StatusNotFound, nil
+		}
 		expvarHandler(w, r)
 		return 0, nil
 	}
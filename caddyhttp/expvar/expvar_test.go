@@ -6,7 +6,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestExpVar(t *testing.T) {
@@ -40,6 +42,46 @@ func TestExpVar(t *testing.T) {
 	}
 }
 
+func TestExpVarProtected(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := ExpVar{
+		Next:     httpserver.HandlerFunc(contentHandler),
+		Resource: "/d/v",
+		Options:  debugendpoint.Options{Users: map[string][]byte{"admin": hash}},
+	}
+
+	for i, test := range []struct {
+		user, pass string
+		result     int
+	}{
+		{"admin", "secret", 0},
+		{"admin", "wrong", http.StatusNotFound},
+		{"", "", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest("GET", "/d/v", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request %v", i, err)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.pass)
+		}
+		rec := httptest.NewRecorder()
+		result, err := rw.ServeHTTP(rec, req)
+		if err != nil {
+			t.Fatalf("Test %d: Could not ServeHTTP %v", i, err)
+		}
+		if result != test.result {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.result, result)
+		}
+		if test.result != 0 && rec.Body.Len() > 0 {
+			t.Errorf("Test %d: Expected no variables to be written, got: %s", i, rec.Body.String())
+		}
+	}
+}
+
 func contentHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 	fmt.Fprintf(w, r.URL.String())
 	return http.StatusOK, nil
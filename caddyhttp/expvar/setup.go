@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
@@ -13,12 +14,13 @@ func init() {
 	caddy.RegisterPlugin("expvar", caddy.Plugin{
 		ServerType: "http",
 		Action:     setup,
+		Redact:     debugendpoint.Redact,
 	})
 }
 
 // setup configures a new ExpVar middleware instance.
 func setup(c *caddy.Controller) error {
-	resource, err := expVarParse(c)
+	resource, opts, err := expVarParse(c)
 	if err != nil {
 		return err
 	}
@@ -26,9 +28,9 @@ func setup(c *caddy.Controller) error {
 	// publish any extra information/metrics we may want to capture
 	publishExtraVars()
 
-	ev := ExpVar{Resource: resource}
+	ev := ExpVar{Resource: resource, Options: opts}
 
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+	debugendpoint.Install(c, "expvar", opts, func(next httpserver.Handler) httpserver.Handler {
 		ev.Next = next
 		return ev
 	})
@@ -36,23 +38,33 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-func expVarParse(c *caddy.Controller) (Resource, error) {
+func expVarParse(c *caddy.Controller) (Resource, debugendpoint.Options, error) {
 	var resource Resource
-	var err error
+	var opts debugendpoint.Options
 
 	for c.Next() {
 		args := c.RemainingArgs()
 		switch len(args) {
 		case 0:
-			resource = Resource(defaultExpvarPath)
+			opts.Path = defaultExpvarPath
 		case 1:
-			resource = Resource(args[0])
+			opts.Path = args[0]
 		default:
-			return resource, c.ArgErr()
+			return resource, opts, c.ArgErr()
 		}
+		for c.NextBlock() {
+			ok, err := debugendpoint.ParseOption(c, &opts)
+			if err != nil {
+				return resource, opts, err
+			}
+			if !ok {
+				return resource, opts, c.Errf("Unknown expvar option '%s'", c.Val())
+			}
+		}
+		resource = Resource(opts.Path)
 	}
 
-	return resource, err
+	return resource, opts, nil
 }
 
 func publishExtraVars() {
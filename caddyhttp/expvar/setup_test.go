@@ -40,3 +40,41 @@ func TestSetup(t *testing.T) {
 		t.Error("'Next' field of handler was not set properly")
 	}
 }
+
+func TestSetupOptions(t *testing.T) {
+	for i, test := range []struct {
+		input      string
+		shouldErr  bool
+		resource   Resource
+		middleware int
+	}{
+		{"expvar {\nbasicauth admin $2a$04$IgUS4yIVzCIMZvDRZwHZxOfIlmAeHvT0kEcYaIrz0VpGNuNqMNW3m\n}", false, "/debug/vars", 1},
+		{"expvar /d/v {\nbind 127.0.0.1\n}", false, "/d/v", 0},
+		{"expvar {\npath /d/v\n}", false, "/d/v", 1},
+		{"expvar {\nbasicauth admin hunter2\n}", true, "", 0},
+		{"expvar {\nfoo\n}", true, "", 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != test.middleware {
+			t.Errorf("Test %d: Expected %d middleware, got %d", i, test.middleware, len(mids))
+			continue
+		}
+		if len(mids) > 0 {
+			if got := mids[0](httpserver.EmptyNext).(ExpVar).Resource; got != test.resource {
+				t.Errorf("Test %d: Expected resource %s, got %s", i, test.resource, got)
+			}
+		}
+	}
+}
@@ -30,6 +30,12 @@ type Ext struct {
 
 // ServeHTTP implements the httpserver.Handler interface.
 func (e Ext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if root, ok := httpserver.RequestRoot(r); ok {
+		if root == "" {
+			return e.Next.ServeHTTP(w, r)
+		}
+		e.Root = root
+	}
 	urlpath := strings.TrimSuffix(r.URL.Path, "/")
 	if path.Ext(urlpath) == "" && len(r.URL.Path) > 0 && r.URL.Path[len(r.URL.Path)-1] != '/' {
 		for _, ext := range e.Extensions {
@@ -33,6 +33,18 @@ type Handler struct {
 
 // ServeHTTP satisfies the httpserver.Handler interface.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if root, ok := httpserver.RequestRoot(r); ok {
+		if root == "" {
+			// no scripts for a request without root
+			return h.Next.ServeHTTP(w, r)
+		}
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		h.Root, h.AbsRoot, h.FileSys = root, absRoot, http.Dir(root)
+	}
+
 	for _, rule := range h.Rules {
 
 		// First requirement: Base path must match and the path must be allowed.
@@ -78,6 +90,18 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				return http.StatusBadGateway, err
 			}
 
+			// abandon the request if the client goes away
+			// or a deadline passes before we are done
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-r.Context().Done():
+					fcgiBackend.Close()
+				case <-stop:
+				}
+			}()
+
 			var resp *http.Response
 			contentLength, _ := strconv.Atoi(r.Header.Get("Content-Length"))
 			switch r.Method {
@@ -91,7 +115,7 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				resp, err = fcgiBackend.Post(env, r.Method, r.Header.Get("Content-Type"), r.Body, contentLength)
 			}
 
-			if resp.Body != nil {
+			if resp != nil && resp.Body != nil {
 				defer resp.Body.Close()
 			}
 
@@ -8,6 +8,8 @@ import (
 	"net/url"
 	"strconv"
 	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
 func TestServeHTTP(t *testing.T) {
@@ -50,6 +52,32 @@ func TestServeHTTP(t *testing.T) {
 	}
 }
 
+func TestServeHTTPRequestRoot(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to create listener for test: %v", err)
+	}
+	defer listener.Close()
+	go fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fcgi.ProcessEnv(r)["SCRIPT_FILENAME"]))
+	}))
+
+	handler := Handler{
+		Rules:   []Rule{{Path: "/", Address: listener.Addr().String(), Ext: ".php", SplitPath: ".php"}},
+		Root:    "/srv/sites/{host}",
+		AbsRoot: "/srv/sites/{host}",
+	}
+	r := httpserver.WithRoot(httptest.NewRequest("GET", "/index.php", nil), "/srv/sites/example.com")
+	w := httptest.NewRecorder()
+
+	if _, err := handler.ServeHTTP(w, r); err != nil {
+		t.Fatalf("Expected nil error, got: %v", err)
+	}
+	if got, want := w.Body.String(), "/srv/sites/example.com/index.php"; got != want {
+		t.Errorf("Expected SCRIPT_FILENAME to be '%s', got: '%s'", want, got)
+	}
+}
+
 func TestRuleParseAddress(t *testing.T) {
 	getClientTestTable := []struct {
 		rule            *Rule
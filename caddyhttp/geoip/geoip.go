@@ -0,0 +1,190 @@
+// Package geoip is middleware that looks up the country and
+// network of clients in a MaxMind DB file, to block clients by
+// country and to make both known as placeholders.
+package geoip
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Placeholders set for every request that passes through GeoIP.
+const (
+	CountryCodePlaceholder = "geoip_country_code"
+	ASNPlaceholder         = "geoip_asn"
+)
+
+// GeoIP is middleware that looks up the client of each request
+// in a MaxMind DB, like a GeoLite2 Country or ASN database, and
+// sets the placeholders {geoip_country_code} and {geoip_asn}. If
+// countries are allowed or blocked, the requests of clients from
+// other or those countries get Status, as do the requests of
+// clients that are not in the database if the fallback is to block.
+type GeoIP struct {
+	Next httpserver.Handler
+
+	// AllowCountries, if not empty, are the only countries,
+	// by ISO 3166-1 code, whose clients are allowed
+	AllowCountries []string
+
+	// BlockCountries are the countries whose clients are blocked
+	BlockCountries []string
+
+	// BlockUnknown blocks the clients whose country is unknown
+	BlockUnknown bool
+
+	// Status is the status of responses to blocked clients
+	Status int
+
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-For header tells the client's address
+	TrustedProxies []*net.IPNet
+
+	db *watchedDatabase
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (g GeoIP) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var country, asn string
+	if ip := httpserver.ClientIP(r, g.TrustedProxies); ip != nil {
+		if record, err := g.db.get().lookup(ip); err != nil {
+			log.Printf("[ERROR] geoip: looking up %s: %v", ip, err)
+		} else {
+			country, asn = recordFields(record)
+		}
+	}
+
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
+		rr.Replacer.Set(CountryCodePlaceholder, country)
+		rr.Replacer.Set(ASNPlaceholder, asn)
+	}
+	r = httpserver.WithPlaceholder(r, CountryCodePlaceholder, func() string { return country })
+	r = httpserver.WithPlaceholder(r, ASNPlaceholder, func() string { return asn })
+
+	if g.blocked(country) {
+		return g.Status, nil
+	}
+	return g.Next.ServeHTTP(w, r)
+}
+
+// blocked returns true if clients from country, which
+// is empty if it is unknown, are to be blocked.
+func (g GeoIP) blocked(country string) bool {
+	if len(g.AllowCountries) == 0 && len(g.BlockCountries) == 0 {
+		return false
+	}
+	if country == "" {
+		return g.BlockUnknown
+	}
+	if len(g.AllowCountries) > 0 {
+		return !contains(g.AllowCountries, country)
+	}
+	return contains(g.BlockCountries, country)
+}
+
+// recordFields returns the country code and the number of the
+// autonomous system in record, which is what the database has
+// for an address; either is empty if the database does not have it.
+func recordFields(record interface{}) (country, asn string) {
+	fields, _ := record.(map[string]interface{})
+	if c, ok := fields["country"].(map[string]interface{}); ok {
+		country, _ = c["iso_code"].(string)
+	}
+	if n, ok := fields["autonomous_system_number"].(uint64); ok {
+		asn = strconv.FormatUint(n, 10)
+	}
+	return country, asn
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadInterval is how often the database file is checked
+// for changes.
+var reloadInterval = time.Minute
+
+// watchedDatabase is a database file that is opened again
+// when it changes. Lookups use the database that was open
+// when they began, so a new one is swapped in atomically.
+type watchedDatabase struct {
+	path    string
+	current atomic.Value // *database
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// openWatchedDatabase opens the database file at path.
+func openWatchedDatabase(path string) (*watchedDatabase, error) {
+	wd := &watchedDatabase{path: path, stop: make(chan struct{})}
+	if _, err := wd.reload(); err != nil {
+		return nil, err
+	}
+	return wd, nil
+}
+
+// get returns the current database.
+func (wd *watchedDatabase) get() *database {
+	return wd.current.Load().(*database)
+}
+
+// reload opens the database file again if it changed since
+// it was last opened, and returns whether it did. If the new
+// file cannot be read, the old database is kept. It must not
+// be called concurrently.
+func (wd *watchedDatabase) reload() (bool, error) {
+	info, err := os.Stat(wd.path)
+	if err != nil {
+		return false, err
+	}
+	if wd.current.Load() != nil && info.ModTime().Equal(wd.modTime) && info.Size() == wd.size {
+		return false, nil
+	}
+	db, err := openDatabase(wd.path)
+	if err != nil {
+		return false, err
+	}
+	wd.current.Store(db)
+	wd.modTime, wd.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// watch checks the file for changes until Stop is called.
+func (wd *watchedDatabase) watch() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := wd.reload()
+			if err != nil {
+				log.Printf("[ERROR] geoip: reloading database: %v", err)
+			} else if reloaded {
+				log.Printf("[INFO] geoip: reloaded database %s", wd.path)
+			}
+		case <-wd.stop:
+			return
+		}
+	}
+}
+
+// Stop stops watching the file.
+func (wd *watchedDatabase) Stop() {
+	wd.once.Do(func() { close(wd.stop) })
+}
@@ -0,0 +1,199 @@
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// newTestGeoIP returns a GeoIP with a database of
+// testNetworks, which must be stopped when done.
+func newTestGeoIP(t *testing.T) (GeoIP, func()) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.mmdb")
+	writeTestDatabase(t, path, 24, testNetworks)
+	db, err := openWatchedDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return GeoIP{Status: http.StatusForbidden, db: db}, func() {
+		db.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// placeholderNext records the placeholders of GeoIP as
+// the handlers after it see them.
+type placeholderNext struct {
+	country, asn string
+}
+
+func (n *placeholderNext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	repl := httpserver.NewReplacer(r, nil, "-")
+	n.country = repl.Replace("{geoip_country_code}")
+	n.asn = repl.Replace("{geoip_asn}")
+	return http.StatusOK, nil
+}
+
+func TestGeoIP(t *testing.T) {
+	g, cleanup := newTestGeoIP(t)
+	defer cleanup()
+
+	for i, test := range []struct {
+		allow, block []string
+		blockUnknown bool
+		remoteAddr   string
+		status       int
+		country, asn string
+	}{
+		// only placeholders
+		{nil, nil, false, "1.2.3.4:1234", http.StatusOK, "US", "64500"},
+		{nil, nil, true, "9.9.9.9:1234", http.StatusOK, "-", "-"},
+
+		// allowed countries
+		{[]string{"US", "CA"}, nil, false, "1.2.3.4:1234", http.StatusOK, "US", "64500"},
+		{[]string{"US", "CA"}, nil, false, "5.6.7.8:1234", http.StatusOK, "CA", "-"},
+		{[]string{"US", "CA"}, nil, false, "[2001:db8::1]:1234", http.StatusForbidden, "", ""},
+
+		// blocked countries
+		{nil, []string{"de"}, false, "[2001:db8::1]:1234", http.StatusForbidden, "", ""},
+		{nil, []string{"DE"}, false, "1.2.3.4:1234", http.StatusOK, "US", "64500"},
+
+		// unknown addresses follow the fallback
+		{nil, []string{"DE"}, false, "9.9.9.9:1234", http.StatusOK, "-", "-"},
+		{nil, []string{"DE"}, true, "9.9.9.9:1234", http.StatusForbidden, "", ""},
+		{[]string{"US"}, nil, true, "not an address", http.StatusForbidden, "", ""},
+	} {
+		next := new(placeholderNext)
+		g.Next = next
+		g.AllowCountries, g.BlockCountries, g.BlockUnknown = test.allow, test.block, test.blockUnknown
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		status, err := g.ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+		}
+		if next.country != test.country || next.asn != test.asn {
+			t.Errorf("Test %d: Expected placeholders %q and %q, got %q and %q", i, test.country, test.asn, next.country, next.asn)
+		}
+	}
+}
+
+func TestGeoIPTrustedProxies(t *testing.T) {
+	g, cleanup := newTestGeoIP(t)
+	defer cleanup()
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	g.TrustedProxies = []*net.IPNet{proxies}
+	g.BlockCountries = []string{"DE"}
+	g.Next = httpserver.EmptyNext
+
+	for i, test := range []struct {
+		remoteAddr, forwardedFor string
+		status                   int
+	}{
+		{"10.0.0.1:1234", "2001:db8::1", http.StatusForbidden},
+		{"10.0.0.1:1234", "2001:db8::1, 1.2.3.4, 10.0.0.2", 0},
+		{"1.2.3.4:1234", "2001:db8::1", 0}, // not from a trusted proxy
+		{"[2001:db8::1]:1234", "1.2.3.4", http.StatusForbidden},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		status, _ := g.ServeHTTP(httptest.NewRecorder(), r)
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+		}
+	}
+}
+
+func TestGeoIPLogPlaceholders(t *testing.T) {
+	g, cleanup := newTestGeoIP(t)
+	defer cleanup()
+	g.Next = httpserver.EmptyNext
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	rr := httpserver.NewResponseRecorder(httptest.NewRecorder())
+	rr.Replacer = httpserver.NewReplacer(r, rr, "-")
+	g.ServeHTTP(rr, r)
+	if got := rr.Replacer.Replace("{geoip_country_code} {geoip_asn}"); got != "US 64500" {
+		t.Errorf("Expected placeholders for the log to be 'US 64500', got '%s'", got)
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	g, cleanup := newTestGeoIP(t)
+	defer cleanup()
+	g.Next = httpserver.EmptyNext
+	g.BlockCountries = []string{"FR"}
+
+	serve := func() int {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "1.2.3.4:1234"
+		status, _ := g.ServeHTTP(httptest.NewRecorder(), r)
+		return status
+	}
+	if status := serve(); status != 0 {
+		t.Fatalf("Expected US client to be allowed, got status %d", status)
+	}
+
+	// lookups go on while the database is swapped
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					serve()
+				}
+			}
+		}()
+	}
+
+	writeTestDatabase(t, g.db.path, 28, []testNetwork{{"1.2.3.0/24", country("FR")}})
+	// make sure the change is seen on file systems with coarse times
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(g.db.path, later, later)
+	reloaded, err := g.db.reload()
+	close(stop)
+	wg.Wait()
+	if !reloaded || err != nil {
+		t.Fatalf("Expected database to be reloaded, got %t and error %v", reloaded, err)
+	}
+	if status := serve(); status != http.StatusForbidden {
+		t.Errorf("Expected client to be blocked after reload, got status %d", status)
+	}
+
+	if reloaded, _ := g.db.reload(); reloaded {
+		t.Error("Expected unchanged database not to be reloaded")
+	}
+
+	// a broken file does not replace the database
+	ioutil.WriteFile(g.db.path, []byte("broken"), 0644)
+	if _, err := g.db.reload(); err == nil {
+		t.Error("Expected error reloading a broken database, got none")
+	}
+	if status := serve(); status != http.StatusForbidden {
+		t.Errorf("Expected old database to be kept, got status %d", status)
+	}
+}
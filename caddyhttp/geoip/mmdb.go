@@ -0,0 +1,319 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metadataMarker starts the metadata section at the end of a
+// MaxMind DB file; see http://maxmind.github.io/MaxMind-DB/.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// database is a MaxMind DB file, read into memory. It is
+// safe for concurrent use, since it is never changed.
+type database struct {
+	tree       []byte
+	data       decoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // the node of ::/96, where IPv4 addresses start
+}
+
+// openDatabase reads the MaxMind DB file at path.
+func openDatabase(path string) (*database, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseDatabase(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// parseDatabase parses buf, which holds a MaxMind DB file.
+func parseDatabase(buf []byte) (*database, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file: no metadata")
+	}
+	meta, _, err := decoder{buf[start+len(metadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	fields, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata: not a map")
+	}
+	number := func(name string) uint {
+		n, _ := fields[name].(uint64)
+		return uint(n)
+	}
+
+	db := &database{
+		nodeCount:  number("node_count"),
+		recordSize: number("record_size"),
+		ipVersion:  number("ip_version"),
+	}
+	if major := number("binary_format_major_version"); major != 2 {
+		return nil, fmt.Errorf("unsupported format version %d", major)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	db.tree = buf[:treeSize]
+	db.data = decoder{buf[treeSize+16 : start]}
+
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *database) record(node, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the data of the network that ip is in,
+// or nil if the database has no data for it.
+func (db *database) lookup(ip net.IP) (interface{}, error) {
+	var node uint
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := uint(0); i < uint(len(ip))*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		// a node, if the address is too short for the
+		// tree, or the marker of an empty record
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	value, _, err := db.data.decode(offset, 0)
+	return value, err
+}
+
+// decoder decodes the values in a data section.
+type decoder struct {
+	buf []byte
+}
+
+// maxDepth limits how deeply values may be nested,
+// so that malicious files cannot exhaust the stack.
+const maxDepth = 32
+
+// The types of values.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decode decodes the value at offset and returns it with the
+// offset of the next value. Strings become strings, unsigned and
+// signed integers become uint64 and int64 (uint128 becomes []byte),
+// maps become map[string]interface{} and arrays []interface{}.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("values nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typeNum := uint(ctrl >> 5)
+
+	if typeNum == typePointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	if typeNum == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		typeNum = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typeNum {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch typeNum {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid size %d of double", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid size %d of float", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid size %d of integer", size)
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid size %d of integer", size)
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d", typeNum)
+}
+
+// size decodes the size of the value with the control
+// byte ctrl, whose size bytes, if any, are at offset.
+func (d decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	var extra uint
+	for _, c := range d.buf[offset : offset+n] {
+		extra = extra<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		size = 29 + extra
+	case 30:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return size, offset + n, nil
+}
+
+// pointer decodes the pointer with the control byte
+// ctrl, whose bytes are at offset.
+func (d decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	var pointer uint
+	if n < 4 {
+		pointer = uint(ctrl & 0x7)
+	}
+	for _, c := range d.buf[offset : offset+n] {
+		pointer = pointer<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + n, nil
+}
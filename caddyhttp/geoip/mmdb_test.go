@@ -0,0 +1,274 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testNetwork is a network in a test database and its data.
+type testNetwork struct {
+	cidr string
+	data map[string]interface{}
+}
+
+// country returns the data of a network in country,
+// as a GeoLite2 Country database has it.
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": code},
+	}
+}
+
+// writeTestDatabase writes a MaxMind DB file with networks to path.
+// The database is for IPv6, with IPv4 addresses in ::/96, like the
+// GeoLite2 databases.
+func writeTestDatabase(t *testing.T, path string, recordSize int, networks []testNetwork) {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data bytes.Buffer
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		addr := ipnet.IP.To16()
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			addr = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+
+		// data records are -2 - offset
+		offset := data.Len()
+		encodeTestValue(&data, network.data)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(addr[i/8]>>uint(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var file bytes.Buffer
+	nodeCount := len(nodes)
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit, record := range node {
+			switch {
+			case record == empty:
+				records[bit] = uint32(nodeCount)
+			case record < empty:
+				records[bit] = uint32(nodeCount + 16 + (-2 - record))
+			default:
+				records[bit] = uint32(record)
+			}
+		}
+		switch recordSize {
+		case 24:
+			file.Write([]byte{byte(records[0] >> 16), byte(records[0] >> 8), byte(records[0]),
+				byte(records[1] >> 16), byte(records[1] >> 8), byte(records[1])})
+		case 28:
+			file.Write([]byte{byte(records[0] >> 16), byte(records[0] >> 8), byte(records[0]),
+				byte(records[0]>>24)<<4 | byte(records[1]>>24),
+				byte(records[1] >> 16), byte(records[1] >> 8), byte(records[1])})
+		case 32:
+			binary.Write(&file, binary.BigEndian, records)
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.Write(metadataMarker)
+	encodeTestValue(&file, map[string]interface{}{
+		"node_count":                  uint64(nodeCount),
+		"record_size":                 uint64(recordSize),
+		"ip_version":                  uint64(6),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"build_epoch":                 uint64(1500000000),
+		"description":                 map[string]interface{}{"en": "Test database"},
+	})
+
+	if err := ioutil.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodeTestValue encodes v in the format of the data section.
+func encodeTestValue(buf *bytes.Buffer, v interface{}) {
+	control := func(typeNum, size int) {
+		var sizeBits byte
+		var extra []byte
+		switch {
+		case size < 29:
+			sizeBits = byte(size)
+		case size < 285:
+			sizeBits, extra = 29, []byte{byte(size - 29)}
+		case size < 65821:
+			sizeBits, extra = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+		default:
+			size -= 65821
+			sizeBits, extra = 31, []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		}
+		if typeNum <= typeMap {
+			buf.WriteByte(byte(typeNum<<5) | sizeBits)
+		} else {
+			buf.Write([]byte{sizeBits, byte(typeNum - 7)})
+		}
+		buf.Write(extra)
+	}
+
+	switch v := v.(type) {
+	case string:
+		control(typeString, len(v))
+		buf.WriteString(v)
+	case uint64:
+		var b []byte
+		for n := v; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		control(typeUint64, len(b))
+		buf.Write(b)
+	case bool:
+		control(typeBool, btoi(v))
+	case []interface{}:
+		control(typeArray, len(v))
+		for _, item := range v {
+			encodeTestValue(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		control(typeMap, len(v))
+		for _, key := range keys {
+			encodeTestValue(buf, key)
+			encodeTestValue(buf, v[key])
+		}
+	default:
+		panic("cannot encode test value")
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var testNetworks = []testNetwork{
+	{"1.2.3.0/24", map[string]interface{}{
+		"country":                  map[string]interface{}{"iso_code": "US"},
+		"autonomous_system_number": uint64(64500),
+	}},
+	{"5.6.0.0/16", country("CA")},
+	{"2001:db8::/32", country("DE")},
+}
+
+func TestDatabaseLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, recordSize := range []int{24, 28, 32} {
+		path := filepath.Join(dir, "test.mmdb")
+		writeTestDatabase(t, path, recordSize, testNetworks)
+		db, err := openDatabase(path)
+		if err != nil {
+			t.Fatalf("Record size %d: Expected no error, got: %v", recordSize, err)
+		}
+
+		for i, test := range []struct {
+			ip       string
+			expected interface{}
+		}{
+			{"1.2.3.4", testNetworks[0].data},
+			{"::ffff:1.2.3.4", testNetworks[0].data},
+			{"1.2.4.1", nil},
+			{"5.6.200.1", testNetworks[1].data},
+			{"2001:db8::1", testNetworks[2].data},
+			{"2001:db9::1", nil},
+			{"::1", nil},
+		} {
+			record, err := db.lookup(net.ParseIP(test.ip))
+			if err != nil {
+				t.Errorf("Record size %d, test %d: Expected no error, got: %v", recordSize, i, err)
+			}
+			if !reflect.DeepEqual(record, test.expected) {
+				t.Errorf("Record size %d, test %d: Expected %v for %s, got %v", recordSize, i, test.expected, test.ip, record)
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "invalid.mmdb")
+	ioutil.WriteFile(path, []byte("not a database"), 0644)
+	if _, err := openDatabase(path); err == nil {
+		t.Error("Expected error opening a file that is not a database, got none")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+	for i, test := range []struct {
+		data     []byte
+		offset   uint
+		expected interface{}
+		next     uint
+	}{
+		// a string, then a pointer to it
+		{[]byte{0x42, 'h', 'i', 0x20, 0x00}, 3, "hi", 5},
+		// a uint16 and a uint32
+		{[]byte{0xa2, 0x01, 0xbb}, 0, uint64(443), 3},
+		{[]byte{0xc0}, 0, uint64(0), 1},
+		// an int32, extended type 1
+		{[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, 0, int64(-2), 6},
+		// a boolean, extended type 7
+		{[]byte{0x01, 0x07}, 0, true, 2},
+		// a double
+		{[]byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 0, 1.5, 9},
+		// a string with a size of two bytes
+		{append([]byte{0x5e, 0x00, 0x0f}, long...), 0, string(long), 303},
+		// an array of a string
+		{[]byte{0x01, 0x04, 0x41, 'a'}, 0, []interface{}{"a"}, 4},
+	} {
+		value, next, err := decoder{test.data}.decode(test.offset, 0)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.expected) || next != test.next {
+			t.Errorf("Test %d: Expected %#v and next offset %d, got %#v and %d", i, test.expected, test.next, value, next)
+		}
+	}
+
+	for i, data := range [][]byte{
+		{0x45, 'a'},                   // string longer than the data
+		{0x20, 0x00},                  // pointer to itself
+		{0xe1, 0xa1, 0x01, 0x41, 'a'}, // map with a key that is not a string
+		{0x00, 0x09},                  // unknown type 16
+	} {
+		if _, _, err := (decoder{data}).decode(0, 0); err == nil {
+			t.Errorf("Invalid test %d: Expected error, got none", i)
+		}
+	}
+}
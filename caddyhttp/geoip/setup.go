@@ -0,0 +1,132 @@
+package geoip
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("geoip", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new GeoIP middleware instance.
+func setup(c *caddy.Controller) error {
+	cfg := httpserver.GetConfig(c)
+	g, path, err := geoipParse(c)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.Root, path)
+	}
+	g.db, err = openWatchedDatabase(path)
+	if err != nil {
+		return c.Errf("Opening geoip database: %v", err)
+	}
+	if !c.Validating() {
+		go g.db.watch()
+	}
+	c.OnShutdown(func() error {
+		g.db.Stop()
+		return nil
+	})
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		g.Next = next
+		return g
+	})
+	return nil
+}
+
+// geoipParse parses the geoip directive, which looks like:
+//
+//	geoip database {
+//	    allow_countries code...
+//	    block_countries code...
+//	    fallback        allow|block
+//	    status          code
+//	    trusted_proxies network...
+//	}
+//
+// It returns the middleware and the path of the database.
+func geoipParse(c *caddy.Controller) (GeoIP, string, error) {
+	g := GeoIP{Status: http.StatusForbidden}
+
+	if !c.Next() {
+		return g, "", c.ArgErr()
+	}
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return g, "", c.ArgErr()
+	}
+	path := args[0]
+
+	for c.NextBlock() {
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return g, "", c.ArgErr()
+		}
+
+		switch option {
+		case "allow_countries", "block_countries":
+			for _, arg := range args {
+				if len(arg) != 2 {
+					return g, "", c.Errf("Invalid country code '%s'; must be two letters", arg)
+				}
+			}
+			if option == "allow_countries" {
+				g.AllowCountries = append(g.AllowCountries, args...)
+			} else {
+				g.BlockCountries = append(g.BlockCountries, args...)
+			}
+		case "fallback":
+			if len(args) != 1 {
+				return g, "", c.ArgErr()
+			}
+			switch args[0] {
+			case "allow":
+				g.BlockUnknown = false
+			case "block":
+				g.BlockUnknown = true
+			default:
+				return g, "", c.Errf("fallback must be allow or block, got '%s'", args[0])
+			}
+		case "status":
+			if len(args) != 1 {
+				return g, "", c.ArgErr()
+			}
+			status, err := strconv.Atoi(args[0])
+			if err != nil || status < 400 || status > 599 {
+				return g, "", c.Errf("Invalid status '%s'; must be a code from 400 to 599", args[0])
+			}
+			g.Status = status
+		case "trusted_proxies":
+			for _, arg := range args {
+				network, err := httpserver.ParseNetwork(arg)
+				if err != nil {
+					return g, "", c.Err(err.Error())
+				}
+				g.TrustedProxies = append(g.TrustedProxies, network)
+			}
+		default:
+			return g, "", c.Errf("Unknown geoip option '%s'", option)
+		}
+	}
+
+	if c.Next() {
+		return g, "", c.Err("geoip may only be used once per site")
+	}
+	if len(g.AllowCountries) > 0 && len(g.BlockCountries) > 0 {
+		return g, "", c.Err("geoip cannot both allow and block countries")
+	}
+	return g, path, nil
+}
@@ -0,0 +1,95 @@
+package geoip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestDatabase(t, filepath.Join(dir, "test.mmdb"), 24, testNetworks)
+
+	c := caddy.NewTestController("http", "geoip test.mmdb {\nblock_countries DE\n}")
+	httpserver.GetConfig(c).Root = dir
+	err = setup(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(GeoIP)
+	if !ok {
+		t.Fatalf("Expected handler to be type GeoIP, got: %#v", handler)
+	}
+	defer myHandler.db.Stop()
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+
+	c = caddy.NewTestController("http", "geoip missing.mmdb")
+	httpserver.GetConfig(c).Root = dir
+	if err := setup(c); err == nil {
+		t.Error("Expected error for a missing database, got none")
+	}
+}
+
+func TestGeoIPParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		path      string
+		expected  GeoIP
+	}{
+		{`geoip /data/GeoLite2-Country.mmdb`, false, "/data/GeoLite2-Country.mmdb", GeoIP{Status: http.StatusForbidden}},
+		{"geoip db.mmdb {\nallow_countries US CA\nfallback block\nstatus 451\n}", false, "db.mmdb", GeoIP{
+			AllowCountries: []string{"US", "CA"}, BlockUnknown: true, Status: 451,
+		}},
+		{"geoip db.mmdb {\nblock_countries KP\nblock_countries IR\nfallback allow\n}", false, "db.mmdb", GeoIP{
+			BlockCountries: []string{"KP", "IR"}, Status: http.StatusForbidden,
+		}},
+		{`geoip`, true, "", GeoIP{}},
+		{`geoip a.mmdb b.mmdb`, true, "", GeoIP{}},
+		{"geoip db.mmdb {\nallow_countries USA\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\nallow_countries US\nblock_countries DE\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\nfallback maybe\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\nstatus 200\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\ntrusted_proxies nonsense\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\nblock_countries\n}", true, "", GeoIP{}},
+		{"geoip db.mmdb {\ncolor blue\n}", true, "", GeoIP{}},
+		{"geoip a.mmdb\ngeoip b.mmdb", true, "", GeoIP{}},
+	}
+	for i, test := range tests {
+		actual, path, err := geoipParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if path != test.path {
+			t.Errorf("Test %d: Expected path %s, got %s", i, test.path, path)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package graceperiod
+
+import (
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("grace_period", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupGracePeriod,
+	})
+}
+
+// setupGracePeriod configures how long the server of a site waits
+// for connections to finish when it stops before closing them
+// forcibly. If the sites of a server disagree, the longest grace
+// period wins; sites without one use the -grace flag.
+func setupGracePeriod(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		period, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("Invalid grace period '%s': %v", c.Val(), err)
+		}
+		if period <= 0 {
+			return c.Errf("Grace period must be positive, got '%s'", c.Val())
+		}
+		config.GracePeriod = period
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	}
+	return nil
+}
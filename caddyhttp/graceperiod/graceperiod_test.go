@@ -0,0 +1,37 @@
+package graceperiod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupGracePeriod(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		period    time.Duration
+	}{
+		{`grace_period 30s`, false, 30 * time.Second},
+		{`grace_period 1m30s`, false, 90 * time.Second},
+		{`grace_period`, true, 0},
+		{`grace_period 30`, true, 0},
+		{`grace_period 0s`, true, 0},
+		{`grace_period -1s`, true, 0},
+		{`grace_period 30s 1m`, true, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupGracePeriod(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if got := httpserver.GetConfig(c).GracePeriod; !test.shouldErr && got != test.period {
+			t.Errorf("Test %d: Expected grace period %v, got %v", i, test.period, got)
+		}
+	}
+}
@@ -36,7 +36,8 @@ type Gzip struct {
 type Config struct {
 	RequestFilters  []RequestFilter
 	ResponseFilters []ResponseFilter
-	Level           int // Compression level
+	Level           int  // Compression level
+	Sniff           bool // Detect a missing Content-Type before compressing
 }
 
 // ServeHTTP serves a gzipped response if the client supports it.
@@ -66,7 +67,8 @@ outer:
 			return http.StatusInternalServerError, err
 		}
 		defer gzipWriter.Close()
-		gz := &gzipResponseWriter{Writer: gzipWriter, ResponseWriter: w}
+		gz := &gzipResponseWriter{Writer: gzipWriter, ResponseWriter: w, sniff: c.Sniff}
+		defer gz.endSniff() // before the gzip writer is closed
 
 		var rw http.ResponseWriter
 		// if no response filter is used
@@ -106,19 +108,50 @@ func newWriter(c Config, w io.Writer) (*gzip.Writer, error) {
 	return gzip.NewWriter(w), nil
 }
 
+// sniffLen is how many bytes of the body are held to detect
+// its Content-Type; it is all that http.DetectContentType reads.
+const sniffLen = 512
+
 // gzipResponeWriter wraps the underlying Write method
 // with a gzip.Writer to compress the output.
 type gzipResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
 	statusCodeWritten bool
+
+	// if sniff is true, a response without a Content-Type
+	// is held until its type is detected from the start of
+	// the body, which is sniffed; sniffing is true until then
+	sniff     bool
+	sniffing  bool
+	sniffCode int
+	sniffed   []byte
 }
 
 // WriteHeader wraps the underlying WriteHeader method to prevent
 // problems with conflicting headers from proxied backends. For
 // example, a backend system that calculates Content-Length would
-// be wrong because it doesn't know it's being gzipped.
+// be wrong because it doesn't know it's being gzipped. Whether
+// the response is compressed is decided only once.
 func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.statusCodeWritten || w.sniffing {
+		return
+	}
+	if w.sniff && w.Header().Get("Content-Type") == "" && compressible(code, w.Header()) {
+		w.sniffing, w.sniffCode = true, code
+		return
+	}
+	if !compressible(code, w.Header()) {
+		// the body is written as it is; not even the header
+		// and footer of the gzip writer, when it is closed
+		if gzWriter, ok := w.Writer.(*gzip.Writer); ok {
+			gzWriter.Reset(ioutil.Discard)
+		}
+		w.Writer = w.ResponseWriter
+		w.ResponseWriter.WriteHeader(code)
+		w.statusCodeWritten = true
+		return
+	}
 	w.Header().Del("Content-Length")
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Add("Vary", "Accept-Encoding")
@@ -128,16 +161,80 @@ func (w *gzipResponseWriter) WriteHeader(code int) {
 
 // Write wraps the underlying Write method to do compression.
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	if w.Header().Get("Content-Type") == "" {
+	if !w.sniff && w.Header().Get("Content-Type") == "" {
 		w.Header().Set("Content-Type", http.DetectContentType(b))
 	}
 	if !w.statusCodeWritten {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.sniffing {
+		w.sniffed = append(w.sniffed, b...)
+		if len(w.sniffed) >= sniffLen {
+			if err := w.endSniff(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
 	n, err := w.Writer.Write(b)
 	return n, err
 }
 
+// endSniff sets the Content-Type detected from the start of the
+// body, if the response is being sniffed, and then writes the header
+// and that part of the body, which is not modified if the response
+// is not compressed after all.
+func (w *gzipResponseWriter) endSniff() error {
+	if !w.sniffing {
+		return nil
+	}
+	w.sniffing, w.sniff = false, false
+	if len(w.sniffed) > 0 {
+		w.Header().Set("Content-Type", http.DetectContentType(w.sniffed))
+	}
+	w.WriteHeader(w.sniffCode)
+	_, err := w.Writer.Write(w.sniffed)
+	w.sniffed = nil
+	return err
+}
+
+// compressedTypes are the media types, or the prefixes of them,
+// whose content is compressed already; compressing it again
+// only takes time.
+var compressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"audio/", "video/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/font-woff",
+}
+
+// compressible returns whether the response with status code
+// and header can be compressed. Partial content is a range of
+// the bytes of the representation the client asked for, and
+// the client has them already if it was not modified; and a
+// response that is encoded already, or whose type is compressed,
+// is not encoded again.
+func compressible(code int, header http.Header) bool {
+	switch code {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if code < 200 || header.Get("Content-Range") != "" {
+		return false
+	}
+	if enc := header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	for _, compressed := range compressedTypes {
+		if strings.HasPrefix(contentType, compressed) {
+			return false
+		}
+	}
+	return true
+}
+
 // Hijack implements http.Hijacker. It simply wraps the underlying
 // ResponseWriter's Hijack method if there is one, or returns an error.
 func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
@@ -147,9 +244,14 @@ func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return nil, nil, fmt.Errorf("not a Hijacker")
 }
 
-// Flush implements http.Flusher. It simply wraps the underlying
-// ResponseWriter's Flush method if there is one, or panics.
+// Flush implements http.Flusher. It ends sniffing with what was
+// written so far and flushes the gzip writer, and then wraps the
+// underlying ResponseWriter's Flush method if there is one, or panics.
 func (w *gzipResponseWriter) Flush() {
+	w.endSniff()
+	if gzWriter, ok := w.Writer.(*gzip.Writer); ok && w.statusCodeWritten {
+		gzWriter.Flush()
+	}
 	if f, ok := w.ResponseWriter.(http.Flusher); ok {
 		f.Flush()
 	} else {
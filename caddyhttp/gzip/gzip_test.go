@@ -1,14 +1,20 @@
 package gzip
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
 )
 
 func TestGzipHandler(t *testing.T) {
@@ -120,3 +126,217 @@ func nextFunc(shouldGzip bool) httpserver.Handler {
 		return 0, nil
 	})
 }
+
+func TestGzipIdentityResponses(t *testing.T) {
+	for i, test := range []struct {
+		status int
+		header http.Header
+		body   string
+	}{
+		{http.StatusPartialContent, http.Header{"Content-Range": {"bytes 0-4/10"}}, "01234"},
+		{http.StatusNotModified, nil, ""},
+		{http.StatusNoContent, nil, ""},
+		{http.StatusOK, http.Header{"Content-Encoding": {"br"}}, "brotli"},
+		{http.StatusRequestedRangeNotSatisfiable, http.Header{"Content-Range": {"bytes */10"}}, "invalid range"},
+	} {
+		gz := Gzip{Configs: []Config{{}}}
+		gz.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			for field, values := range test.header {
+				w.Header()[field] = values
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(test.status)
+			io.WriteString(w, test.body)
+			return 0, nil
+		})
+		r, err := http.NewRequest("GET", "/file.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		if _, err := gz.ServeHTTP(w, r); err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc == "gzip" {
+			t.Errorf("Test %d: Expected response not to be gzipped", i)
+		}
+		if got := w.Body.String(); got != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, got)
+		}
+	}
+}
+
+// gzipConfigs parses the configs of input, a gzip directive.
+func gzipConfigs(t *testing.T, input string) []Config {
+	configs, err := gzipParse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configs
+}
+
+func gzipRequest(t *testing.T, gz Gzip, path string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	if _, err := gz.ServeHTTP(w, r); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	return w
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Expected a gzipped body: %v", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Expected a gzipped body: %v", err)
+	}
+	return string(body)
+}
+
+func TestGzipSniffProxiedJPEG(t *testing.T) {
+	jpeg := append([]byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), bytes.Repeat([]byte{0}, 2000)...)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil // not even detected by net/http
+		w.Write(jpeg[:100])
+		w.Write(jpeg[100:])
+	}))
+	defer backend.Close()
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / "+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := proxy.Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	w := gzipRequest(t, Gzip{Next: next, Configs: gzipConfigs(t, "gzip {\nsniff\n}")}, "/photo")
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected the sniffed JPEG not to be compressed, got Content-Encoding %s", enc)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Expected the sniffed Content-Type image/jpeg, got %s", ct)
+	}
+	if !bytes.Equal(w.Body.Bytes(), jpeg) {
+		t.Errorf("Expected the JPEG unmodified, got %d bytes", w.Body.Len())
+	}
+
+	// without sniffing there is no type to tell before compressing
+	w = gzipRequest(t, Gzip{Next: next, Configs: gzipConfigs(t, "gzip")}, "/photo")
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Expected the JPEG without a type to be compressed without sniffing, got Content-Encoding '%s'", enc)
+	}
+}
+
+func TestGzipSniffText(t *testing.T) {
+	for i, body := range []string{"short text", strings.Repeat("longer text ", 100), ""} {
+		gz := Gzip{Configs: gzipConfigs(t, "gzip {\nsniff\n}")}
+		gz.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			io.WriteString(w, body)
+			return http.StatusOK, nil
+		})
+		w := gzipRequest(t, gz, "/text")
+		if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+			t.Errorf("Test %d: Expected the sniffed text to be compressed, got Content-Encoding '%s'", i, enc)
+			continue
+		}
+		if got := gunzip(t, w.Body.Bytes()); got != body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, body, got)
+		}
+	}
+}
+
+func TestGzipTypedResponses(t *testing.T) {
+	for i, test := range []struct {
+		contentType string
+		compressed  bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"image/png", false},
+		{"Video/MP4", false},
+		{"application/zip", false},
+		{"image/svg+xml", true},
+	} {
+		gz := Gzip{Configs: []Config{{}}}
+		gz.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Content-Type", test.contentType)
+			io.WriteString(w, "content")
+			return http.StatusOK, nil
+		})
+		w := gzipRequest(t, gz, "/file")
+		if compressed := w.Header().Get("Content-Encoding") == "gzip"; compressed != test.compressed {
+			t.Errorf("Test %d: Expected %s compressed %v, got %v", i, test.contentType, test.compressed, compressed)
+		}
+	}
+}
+
+func TestGzipNotPaths(t *testing.T) {
+	gz := Gzip{Configs: gzipConfigs(t, "gzip {\nnot /api/stream /downloads\n}")}
+	gz.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "content")
+		return http.StatusOK, nil
+	})
+	for i, test := range []struct {
+		path       string
+		compressed bool
+	}{
+		{"/api/stream", false},
+		{"/api/stream/events", false},
+		{"/downloads/file.txt", false},
+		{"/api/other", true},
+		{"/index.html", true},
+	} {
+		w := gzipRequest(t, gz, test.path)
+		if compressed := w.Header().Get("Content-Encoding") == "gzip"; compressed != test.compressed {
+			t.Errorf("Test %d: Expected %s compressed %v, got %v", i, test.path, test.compressed, compressed)
+		}
+	}
+}
+
+func TestGzipSniffStreaming(t *testing.T) {
+	var flushed []int // compressed bytes written at each flush
+	gz := Gzip{Configs: gzipConfigs(t, "gzip {\nsniff\n}")}
+	var w *httptest.ResponseRecorder
+	gz.Next = httpserver.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) (int, error) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(rw, "data: %d\n\n", i)
+			rw.(http.Flusher).Flush()
+			flushed = append(flushed, w.Body.Len())
+		}
+		return http.StatusOK, nil
+	})
+	r, err := http.NewRequest("GET", "/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	if _, err := gz.ServeHTTP(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Expected the stream to be compressed, got Content-Encoding '%s'", enc)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected the type sniffed at the first flush, got %s", ct)
+	}
+	for i := 0; i < len(flushed); i++ {
+		if flushed[i] == 0 || (i > 0 && flushed[i] <= flushed[i-1]) {
+			t.Errorf("Expected each event to be written when it is flushed, got %v bytes", flushed)
+			break
+		}
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != "data: 0\n\ndata: 1\n\ndata: 2\n\n" {
+		t.Errorf("Expected all of the events, got %q", got)
+	}
+}
@@ -85,6 +85,11 @@ func gzipParse(c *caddy.Controller) ([]Config, error) {
 					return configs, fmt.Errorf(`gzip: min_length must be greater than 0`)
 				}
 				lengthFilter = LengthFilter(length)
+			case "sniff":
+				if c.NextArg() {
+					return configs, c.ArgErr()
+				}
+				config.Sniff = true
 			default:
 				return configs, c.ArgErr()
 			}
@@ -43,6 +43,12 @@ func TestSetup(t *testing.T) {
 		 level 1
 		} `, false},
 		{`gzip { level 9 } `, false},
+		{`gzip {
+		 sniff
+		}`, false},
+		{`gzip {
+		 sniff on
+		}`, true},
 		{`gzip { ext } `, true},
 		{`gzip { ext /f
 		} `, true},
@@ -19,26 +19,96 @@ type Headers struct {
 
 // ServeHTTP implements the httpserver.Handler interface and serves requests,
 // setting headers on the response according to the configured rules.
+// Headers whose values have response placeholders, like {status}, are
+// set when the response is written instead, since that is when their
+// values are known.
 func (h Headers) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	replacer := httpserver.NewReplacer(r, nil, "")
+	var deferred []Header
 	for _, rule := range h.Rules {
 		if httpserver.Path(r.URL.Path).Matches(rule.Path) {
 			for _, header := range rule.Headers {
-				// One can either delete a header, add multiple values to a header, or simply
-				// set a header.
-				if strings.HasPrefix(header.Name, "-") {
-					w.Header().Del(strings.TrimLeft(header.Name, "-"))
-				} else if strings.HasPrefix(header.Name, "+") {
-					w.Header().Add(strings.TrimLeft(header.Name, "+"), replacer.Replace(header.Value))
-				} else {
-					w.Header().Set(header.Name, replacer.Replace(header.Value))
+				if httpserver.HasResponsePlaceholder(header.Value) {
+					deferred = append(deferred, header)
+					continue
 				}
+				setHeader(w.Header(), header, replacer)
 			}
 		}
 	}
+	if len(deferred) > 0 {
+		w = newDeferredHeaderWriter(w, r, deferred)
+	}
 	return h.Next.ServeHTTP(w, r)
 }
 
+// setHeader applies header to h. One can either delete a header,
+// add multiple values to a header, or simply set a header.
+func setHeader(h http.Header, header Header, replacer httpserver.Replacer) {
+	if strings.HasPrefix(header.Name, "-") {
+		h.Del(strings.TrimLeft(header.Name, "-"))
+	} else if strings.HasPrefix(header.Name, "+") {
+		h.Add(strings.TrimLeft(header.Name, "+"), replacer.Replace(header.Value))
+	} else {
+		h.Set(header.Name, replacer.Replace(header.Value))
+	}
+}
+
+// newDeferredHeaderWriter returns a ResponseRecorder that
+// sets headers on w right before the response header is
+// written, with the response placeholders in their values
+// filled in from the recorder. If w is a ResponseRecorder
+// itself, its Replacer is kept so that later middlewares
+// can still set placeholders for the log.
+func newDeferredHeaderWriter(w http.ResponseWriter, r *http.Request, headers []Header) *httpserver.ResponseRecorder {
+	dw := &deferredHeaderWriter{ResponseWriterWrapper: httpserver.ResponseWriterWrapper{ResponseWriter: w}, headers: headers}
+	rec := httpserver.NewResponseRecorder(dw)
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok {
+		rec.Replacer = rr.Replacer
+	}
+	dw.replacer = httpserver.NewReplacer(r, rec, "")
+	return rec
+}
+
+// deferredHeaderWriter sets its headers the first time
+// the response header is about to be written.
+type deferredHeaderWriter struct {
+	httpserver.ResponseWriterWrapper
+	headers  []Header
+	replacer httpserver.Replacer
+	done     bool
+}
+
+func (w *deferredHeaderWriter) setHeaders() {
+	if w.done {
+		return
+	}
+	w.done = true
+	for _, header := range w.headers {
+		setHeader(w.ResponseWriter.Header(), header, w.replacer)
+	}
+}
+
+// WriteHeader sets the headers and writes the response header.
+func (w *deferredHeaderWriter) WriteHeader(status int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write sets the headers if the response header
+// has not been written yet, and writes buf.
+func (w *deferredHeaderWriter) Write(buf []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush implements http.Flusher. Flushing writes the
+// response header, so the headers are set first.
+func (w *deferredHeaderWriter) Flush() {
+	w.setHeaders()
+	w.ResponseWriterWrapper.Flush()
+}
+
 type (
 	// Rule groups a slice of HTTP headers by a URL pattern.
 	// TODO: use http.Header type instead?
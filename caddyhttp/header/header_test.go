@@ -87,3 +87,59 @@ func TestMultipleHeaders(t *testing.T) {
 		t.Errorf("Expected header to contain: %v but got: %v", desiredHeaders, actualHeaders)
 	}
 }
+
+func TestResponsePlaceholders(t *testing.T) {
+	for i, test := range []struct {
+		status    int  // status written by the next handler
+		writeBody bool // whether it writes a body without WriteHeader
+		expect    string
+	}{
+		{http.StatusNotFound, false, "404"},
+		{http.StatusCreated, false, "201"},
+		{0, true, "200"},
+	} {
+		var replacer httpserver.Replacer
+		he := Headers{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				if rr, ok := w.(*httpserver.ResponseRecorder); ok {
+					replacer = rr.Replacer
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				if test.writeBody {
+					w.Write([]byte("hello"))
+				} else {
+					w.WriteHeader(test.status)
+				}
+				return 0, nil
+			}),
+			Rules: []Rule{
+				{Path: "/", Headers: []Header{
+					{Name: "X-Status", Value: "{status}"},
+					{Name: "Content-Type", Value: "text/html"},
+				}},
+			},
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+		}
+		rec := httptest.NewRecorder()
+		logRecorder := httpserver.NewResponseRecorder(rec)
+		logRecorder.Replacer = httpserver.NewReplacer(req, logRecorder, "-")
+
+		he.ServeHTTP(logRecorder, req)
+
+		if got := rec.Header().Get("X-Status"); got != test.expect {
+			t.Errorf("Test %d: Expected X-Status header to be %q but was %q", i, test.expect, got)
+		}
+		// headers without response placeholders are still set
+		// before the next handler, which may overwrite them
+		if got, want := rec.Header().Get("Content-Type"), "text/plain"; got != want {
+			t.Errorf("Test %d: Expected Content-Type header to be %q but was %q", i, want, got)
+		}
+		if replacer != logRecorder.Replacer {
+			t.Errorf("Test %d: Expected next handler to get the Replacer of the log", i)
+		}
+	}
+}
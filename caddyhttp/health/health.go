@@ -0,0 +1,111 @@
+// Package health implements liveness and readiness endpoints.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/maintenance"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// Health is middleware that answers requests to health endpoints.
+type Health struct {
+	Next      httpserver.Handler
+	Site      *httpserver.SiteConfig
+	Endpoints []Endpoint
+}
+
+// Endpoint is a path that reports on the health of the site.
+// If it has no checks, it reports whether the process is
+// serving requests (liveness); otherwise it reports whether
+// all its checks pass (readiness).
+type Endpoint struct {
+	Path   string
+	Checks []string
+}
+
+// Report is the JSON body that is written in response to
+// requests to a health endpoint.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// checks maps the name of each readiness check to the function
+// that performs it. A check returns an error if it fails.
+var checks = map[string]func(*httpserver.SiteConfig) error{
+	"tls":         checkTLS,
+	"upstream":    checkUpstream,
+	"maintenance": checkMaintenance,
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (h Health) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, e := range h.Endpoints {
+		if r.URL.Path != e.Path {
+			continue
+		}
+		status, report := http.StatusOK, Report{Status: "ok"}
+		for _, name := range e.Checks {
+			if report.Checks == nil {
+				report.Checks = make(map[string]string)
+			}
+			if err := checks[name](h.Site); err != nil {
+				status, report.Status = http.StatusServiceUnavailable, "unavailable"
+				report.Checks[name] = err.Error()
+				continue
+			}
+			report.Checks[name] = "ok"
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+		return 0, nil
+	}
+	return h.Next.ServeHTTP(w, r)
+}
+
+// checkTLS fails if the site is served over TLS but its
+// certificate is not loaded or has expired. Certificates
+// obtained on demand are not checked since they are only
+// loaded once a client asks for them.
+func checkTLS(site *httpserver.SiteConfig) error {
+	if site.TLS == nil || !site.TLS.Enabled || site.TLS.OnDemand {
+		return nil
+	}
+	return caddytls.CheckCertificate(site.Addr.Host)
+}
+
+// checkUpstream fails if none of the hosts the site
+// proxies to are up.
+func checkUpstream(site *httpserver.SiteConfig) error {
+	up, total := proxy.HostCounts(site)
+	if total == 0 {
+		return errNoUpstreams
+	}
+	if up == 0 {
+		return errUpstreamsDown
+	}
+	return nil
+}
+
+// checkMaintenance fails if the site is in maintenance, for
+// load balancers that should stop sending requests to it then.
+// Health endpoints are answered in maintenance as usual.
+func checkMaintenance(site *httpserver.SiteConfig) error {
+	if maintenance.InMaintenance(site) {
+		return errInMaintenance
+	}
+	return nil
+}
+
+var (
+	errNoUpstreams   = errors.New("no proxy upstreams configured")
+	errUpstreamsDown = errors.New("no proxy upstream hosts are up")
+	errInMaintenance = errors.New("site is in maintenance")
+)
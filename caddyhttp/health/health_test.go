@@ -0,0 +1,219 @@
+package health
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	_ "github.com/mholt/caddy/caddyhttp/maintenance"
+	_ "github.com/mholt/caddy/caddyhttp/proxy"
+	_ "github.com/mholt/caddy/caddytls"
+)
+
+// runDirective executes the named directive with input
+// against the site config of c.
+func runDirective(t *testing.T, c *caddy.Controller, dir, input string) {
+	action, err := caddy.DirectiveAction("http", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(input))
+	if err := action(c); err != nil {
+		t.Fatalf("Expected no error setting up %s, got: %v", dir, err)
+	}
+}
+
+// probe requests path from h and returns the status and decoded report.
+func probe(t *testing.T, h httpserver.Handler, path string) (int, Report) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if _, err := h.ServeHTTP(rec, req); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("Expected JSON body, got error: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestLiveness(t *testing.T) {
+	h := Health{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusTeapot, nil
+		}),
+		Site:      &httpserver.SiteConfig{},
+		Endpoints: []Endpoint{{Path: "/healthz"}},
+	}
+
+	status, report := probe(t, h, "/healthz")
+	if status != http.StatusOK || report.Status != "ok" {
+		t.Errorf("Expected status 200 and 'ok', got %d and '%s'", status, report.Status)
+	}
+
+	req, _ := http.NewRequest("GET", "/healthz/other", nil)
+	if status, _ := h.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusTeapot {
+		t.Errorf("Expected other paths to be passed on, got status %d", status)
+	}
+}
+
+func TestReadinessTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := caddy.NewTestController("http", "")
+	cfg := httpserver.GetConfig(c)
+	cfg.Addr = httpserver.Address{Host: "ready.caddy.test"}
+	cfg.TLS.Enabled = true
+	h := Health{Next: httpserver.EmptyNext, Site: cfg, Endpoints: []Endpoint{{Path: "/ready", Checks: []string{"tls"}}}}
+
+	// certificate is not loaded yet
+	status, report := probe(t, h, "/ready")
+	if status != http.StatusServiceUnavailable || report.Checks["tls"] == "ok" {
+		t.Errorf("Expected 503 with failed tls check when certificate is missing, got %d: %v", status, report)
+	}
+
+	// an expired certificate is no good either
+	certFile, keyFile := writeCert(t, dir, "expired.caddy.test", time.Now().Add(-time.Hour))
+	runDirective(t, c, "tls", "tls "+certFile+" "+keyFile)
+	cfg.Addr.Host = "expired.caddy.test"
+	if status, report := probe(t, h, "/ready"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when certificate is expired, got %d: %v", status, report)
+	}
+
+	certFile, keyFile = writeCert(t, dir, "ready.caddy.test", time.Now().Add(time.Hour))
+	runDirective(t, c, "tls", "tls "+certFile+" "+keyFile)
+	cfg.Addr.Host = "ready.caddy.test"
+	status, report = probe(t, h, "/ready")
+	if status != http.StatusOK || report.Checks["tls"] != "ok" {
+		t.Errorf("Expected 200 once certificate is loaded, got %d: %v", status, report)
+	}
+}
+
+func TestReadinessUpstream(t *testing.T) {
+	var down int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	c := caddy.NewTestController("http", "")
+	cfg := httpserver.GetConfig(c)
+	h := Health{Next: httpserver.EmptyNext, Site: cfg, Endpoints: []Endpoint{{Path: "/ready", Checks: []string{"upstream"}}}}
+
+	// no upstreams configured at all
+	if status, report := probe(t, h, "/ready"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without upstreams, got %d: %v", status, report)
+	}
+
+	runDirective(t, c, "proxy", "proxy / "+backend.URL+" {\nhealth_check /hc\nhealth_check_interval 10ms\n}")
+	waitForStatus(t, h, http.StatusOK)
+
+	atomic.StoreInt32(&down, 1)
+	report := waitForStatus(t, h, http.StatusServiceUnavailable)
+	if report.Status != "unavailable" || report.Checks["upstream"] == "ok" {
+		t.Errorf("Expected upstream check to fail, got: %v", report)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	waitForStatus(t, h, http.StatusOK)
+}
+
+func TestReadinessMaintenance(t *testing.T) {
+	flag := filepath.Join(os.TempDir(), "caddy_health_maintenance.flag")
+	os.Remove(flag)
+	defer os.Remove(flag)
+
+	c := caddy.NewTestController("http", "")
+	cfg := httpserver.GetConfig(c)
+	h := Health{Next: httpserver.EmptyNext, Site: cfg, Endpoints: []Endpoint{{Path: "/ready", Checks: []string{"maintenance"}}}}
+
+	// no maintenance configured at all
+	if status, report := probe(t, h, "/ready"); status != http.StatusOK {
+		t.Errorf("Expected 200 without maintenance, got %d: %v", status, report)
+	}
+
+	runDirective(t, c, "maintenance", "maintenance {\nenable_if_file_exists "+flag+" 10ms\n}")
+	waitForStatus(t, h, http.StatusOK)
+
+	if err := ioutil.WriteFile(flag, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := waitForStatus(t, h, http.StatusServiceUnavailable)
+	if report.Checks["maintenance"] != errInMaintenance.Error() {
+		t.Errorf("Expected maintenance check to fail, got: %v", report)
+	}
+
+	os.Remove(flag)
+	waitForStatus(t, h, http.StatusOK)
+}
+
+// waitForStatus probes h until it answers with status or the test times out.
+func waitForStatus(t *testing.T, h httpserver.Handler, status int) Report {
+	var got int
+	var report Report
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, report = probe(t, h, "/ready"); got == status {
+			return report
+		}
+	}
+	t.Fatalf("Expected readiness status %d, still got %d: %v", status, got, report)
+	return report
+}
+
+// writeCert writes a self-signed certificate for name that
+// expires at notAfter, and its key, into dir.
+func writeCert(t *testing.T, dir, name string, notAfter time.Time) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
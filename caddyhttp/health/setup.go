@@ -0,0 +1,71 @@
+package health
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("health", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Health middleware instance.
+func setup(c *caddy.Controller) error {
+	endpoints, err := healthParse(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+
+	// health endpoints must stay reachable for probes
+	// that can't present a TLS client certificate
+	for _, e := range endpoints {
+		cfg.ClientAuthExempt = append(cfg.ClientAuthExempt, e.Path)
+	}
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Health{Next: next, Site: cfg, Endpoints: endpoints}
+	})
+	return nil
+}
+
+func healthParse(c *caddy.Controller) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	seen := make(map[string]bool)
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		e := Endpoint{Path: args[0]}
+		if seen[e.Path] {
+			return nil, c.Errf("Duplicate health endpoint '%s'", e.Path)
+		}
+		seen[e.Path] = true
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "check":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if _, ok := checks[c.Val()]; !ok {
+					return nil, c.Errf("Unknown health check '%s'", c.Val())
+				}
+				e.Checks = append(e.Checks, c.Val())
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			default:
+				return nil, c.Errf("Unknown health option '%s'", c.Val())
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
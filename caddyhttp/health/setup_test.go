@@ -0,0 +1,62 @@
+package health
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", "health /healthz\nhealth /ready {\ncheck tls\ncheck upstream\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, got: %v", err)
+	}
+	cfg := httpserver.GetConfig(c)
+	mids := cfg.Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	h, ok := handler.(Health)
+	if !ok {
+		t.Fatalf("Expected handler to be type Health, got: %#v", handler)
+	}
+	expected := []Endpoint{{Path: "/healthz"}, {Path: "/ready", Checks: []string{"tls", "upstream"}}}
+	if !reflect.DeepEqual(h.Endpoints, expected) {
+		t.Errorf("Expected endpoints %v, got %v", expected, h.Endpoints)
+	}
+	if h.Site != cfg {
+		t.Error("Expected handler to check the site it was set up for")
+	}
+	if expected := []string{"/healthz", "/ready"}; !reflect.DeepEqual(cfg.ClientAuthExempt, expected) {
+		t.Errorf("Expected %v to be exempt from client auth, got %v", expected, cfg.ClientAuthExempt)
+	}
+}
+
+func TestHealthParse(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`health /healthz`, false},
+		{"health /ready {\ncheck tls\n}", false},
+		{`health`, true},
+		{`health /a /b`, true},
+		{"health /a\nhealth /a", true},
+		{"health /ready {\ncheck\n}", true},
+		{"health /ready {\ncheck disk\n}", true},
+		{"health /ready {\ncheck tls upstream\n}", true},
+		{"health /ready {\nfoo\n}", true},
+	} {
+		_, err := healthParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package http2
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("http2", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupHTTP2,
+	})
+}
+
+// setupHTTP2 configures how a site speaks HTTP/2. Currently the
+// only supported mode is h2c, which serves HTTP/2 over cleartext
+// TCP (with prior knowledge or via Upgrade: h2c) on a site that
+// is not served with TLS.
+func setupHTTP2(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "h2c":
+			config.H2C = true
+		default:
+			return c.Errf("Unknown HTTP/2 mode '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	}
+	return nil
+}
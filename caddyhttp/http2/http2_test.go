@@ -0,0 +1,33 @@
+package http2
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupHTTP2(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		h2c       bool
+	}{
+		{`http2 h2c`, false, true},
+		{`http2`, true, false},
+		{`http2 h2`, true, false},
+		{`http2 h2c extra`, true, false},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupHTTP2(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if got := httpserver.GetConfig(c).H2C; !test.shouldErr && got != test.h2c {
+			t.Errorf("Test %d: Expected H2C to be %v, was %v", i, test.h2c, got)
+		}
+	}
+}
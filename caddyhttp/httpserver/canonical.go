@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AlternateHost returns the other form of host: host without
+// "www." if it starts with that, or with "www." in front.
+func AlternateHost(host string) string {
+	if strings.HasPrefix(host, "www.") {
+		return host[len("www."):]
+	}
+	return "www." + host
+}
+
+// makeCanonicalHostRedirects adds a site for the other form of the
+// canonical host of each site that has one, which redirects to the
+// site. A site that was declared with the other form is moved to its
+// canonical host. It returns all configs, or an error if another site
+// already serves one of the forms.
+func makeCanonicalHostRedirects(allConfigs []*SiteConfig) ([]*SiteConfig, error) {
+	for _, cfg := range allConfigs {
+		if cfg.CanonicalHost == "" {
+			continue
+		}
+		alternate := AlternateHost(cfg.CanonicalHost)
+		for _, other := range allConfigs {
+			if other != cfg && other.Addr.Port == cfg.Addr.Port &&
+				(other.Addr.Host == cfg.CanonicalHost || other.Addr.Host == alternate) {
+				return allConfigs, fmt.Errorf("%s: canonical_host %s: site %s already serves %s",
+					cfg.Addr, cfg.CanonicalHost, other.Addr, other.Addr.Host)
+			}
+		}
+		if cfg.Addr.Host != cfg.CanonicalHost {
+			cfg.Addr = withHost(cfg.Addr, cfg.CanonicalHost)
+			cfg.TLS.Hostname = cfg.CanonicalHost
+		}
+		allConfigs = append(allConfigs, redirCanonicalHost(cfg, alternate))
+	}
+	return allConfigs, nil
+}
+
+// redirCanonicalHost returns a new configuration for host, which
+// redirects every request to the canonical host of cfg with a 308,
+// keeping the scheme, port, path and query of the request. It has
+// the TLS settings of cfg for host, so it gets its own certificate
+// if cfg gets one.
+func redirCanonicalHost(cfg *SiteConfig, host string) *SiteConfig {
+	canonical := cfg.CanonicalHost
+	redirMiddleware := func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			toURL := "http://"
+			if r.TLS != nil {
+				toURL = "https://"
+			}
+			if _, port, err := net.SplitHostPort(r.Host); err == nil {
+				toURL += net.JoinHostPort(canonical, port)
+			} else {
+				toURL += canonical
+			}
+			http.Redirect(w, r, toURL+r.URL.RequestURI(), http.StatusPermanentRedirect)
+			return 0, nil
+		})
+	}
+
+	addr := withHost(cfg.Addr, host)
+	tlsConfig := *cfg.TLS
+	tlsConfig.Hostname = host
+	return &SiteConfig{
+		Addr:          addr,
+		ListenHost:    cfg.ListenHost,
+		ListenHosts:   cfg.ListenHosts,
+		HTTPSRedirect: cfg.HTTPSRedirect,
+		middleware:    []Middleware{redirMiddleware},
+		TLS:           &tlsConfig,
+	}
+}
+
+// withHost returns addr with host in place of its host.
+func withHost(addr Address, host string) Address {
+	addr.Original = strings.Replace(addr.Original, addr.Host, host, 1)
+	addr.Host = host
+	return addr
+}
@@ -0,0 +1,104 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+func TestMakeCanonicalHostRedirects(t *testing.T) {
+	for i, test := range []struct {
+		siteHost      string
+		canonicalHost string
+		expectedSite  string
+		expectedRedir string
+	}{
+		{"example.com", "example.com", "example.com", "www.example.com"},
+		{"www.example.com", "www.example.com", "www.example.com", "example.com"},
+		{"www.example.com", "example.com", "example.com", "www.example.com"},
+		{"example.com", "www.example.com", "www.example.com", "example.com"},
+	} {
+		site := &SiteConfig{
+			Addr:          Address{Original: test.siteHost + ":8443", Host: test.siteHost, Port: "8443"},
+			TLS:           &caddytls.Config{Hostname: test.siteHost, ACMEEmail: "me@example.com"},
+			CanonicalHost: test.canonicalHost,
+		}
+		configs, err := makeCanonicalHostRedirects([]*SiteConfig{site, {Addr: Address{Host: "other.com"}, TLS: new(caddytls.Config)}})
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if len(configs) != 3 {
+			t.Fatalf("Test %d: Expected 1 redirect site to be added, got %d", i, len(configs)-2)
+		}
+		redir := configs[2]
+		if site.Addr.Host != test.expectedSite || site.TLS.Hostname != test.expectedSite || site.Addr.VHost() != test.expectedSite+":8443" {
+			t.Errorf("Test %d: Expected site at %s, got %s (TLS %s, vhost %s)",
+				i, test.expectedSite, site.Addr.Host, site.TLS.Hostname, site.Addr.VHost())
+		}
+		if redir.Addr.Host != test.expectedRedir || redir.Addr.Port != "8443" || redir.Addr.VHost() != test.expectedRedir+":8443" {
+			t.Errorf("Test %d: Expected redirect site at %s:8443, got %s (vhost %s)", i, test.expectedRedir, redir.Addr, redir.Addr.VHost())
+		}
+
+		// the other form gets a certificate of its own
+		markQualifiedForAutoHTTPS(configs)
+		if !redir.TLS.Managed || redir.TLS.Hostname != test.expectedRedir || redir.TLS.ACMEEmail != "me@example.com" {
+			t.Errorf("Test %d: Expected managed TLS for %s with the settings of the site, got %+v", i, test.expectedRedir, redir.TLS)
+		}
+		if redir.TLS == site.TLS {
+			t.Errorf("Test %d: Expected redirect site to have a TLS config of its own", i)
+		}
+	}
+}
+
+func TestMakeCanonicalHostRedirectsConflict(t *testing.T) {
+	configs := []*SiteConfig{
+		{Addr: Address{Host: "example.com"}, TLS: new(caddytls.Config), CanonicalHost: "example.com"},
+		{Addr: Address{Host: "www.example.com"}, TLS: new(caddytls.Config)},
+	}
+	if _, err := makeCanonicalHostRedirects(configs); err == nil {
+		t.Error("Expected an error when another site serves the other form, got none")
+	}
+
+	// on another port, the other form is free
+	configs[1].Addr.Port = "8080"
+	if _, err := makeCanonicalHostRedirects(configs); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+}
+
+func TestRedirCanonicalHost(t *testing.T) {
+	site := &SiteConfig{Addr: Address{Host: "example.com"}, TLS: new(caddytls.Config), CanonicalHost: "example.com"}
+	handler := redirCanonicalHost(site, "www.example.com").middleware[0](nil)
+
+	for i, test := range []struct {
+		url      string
+		tls      bool
+		expected string
+	}{
+		{"http://www.example.com/a/b?q=1&r=2", false, "http://example.com/a/b?q=1&r=2"},
+		{"https://www.example.com/a%20b?q=1", true, "https://example.com/a%20b?q=1"},
+		{"https://www.example.com:8443/", true, "https://example.com:8443/"},
+		{"http://www.example.com", false, "http://example.com/"},
+	} {
+		r := httptest.NewRequest("POST", test.url, nil)
+		if test.tls {
+			r.TLS = new(tls.ConnectionState)
+		} else {
+			r.TLS = nil
+		}
+		w := httptest.NewRecorder()
+		status, err := handler.ServeHTTP(w, r)
+		if status != 0 || err != nil {
+			t.Errorf("Test %d: Expected status 0 and no error, got %d and %v", i, status, err)
+		}
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("Test %d: Expected status %d, got %d", i, http.StatusPermanentRedirect, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != test.expected {
+			t.Errorf("Test %d: Expected Location '%s', got '%s'", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetwork parses a CIDR network or a single IP address,
+// which is the network of just that address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// NetworksContain returns true if ip is in any of networks.
+func NetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client of r, or nil if the
+// remote address of r is not an IP address. If the request comes
+// from one of the trusted proxies, it is the last address in
+// X-Forwarded-For that is not a trusted proxy. If the proxies did
+// not forward a valid address, it is the last one that did, or the
+// proxy itself, so that a client cannot pass for nobody by sending
+// a bad X-Forwarded-For through them.
+func ClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !NetworksContain(trusted, ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break // can't tell who is behind the last good hop
+		}
+		ip = hop
+		if !NetworksContain(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
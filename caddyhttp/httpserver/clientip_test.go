@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expected  string
+		shouldErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"203.0.113.7", "203.0.113.7/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"not-an-ip", "", true},
+		{"10.0.0.0/33", "", true},
+	} {
+		network, err := ParseNetwork(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got %v", i, network)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if network.String() != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, network)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxies}
+	for i, test := range []struct {
+		remoteAddr   string
+		forwardedFor []string
+		trusted      []*net.IPNet
+		expected     string
+	}{
+		{"203.0.113.7:1000", nil, trusted, "203.0.113.7"},
+		{"203.0.113.7", nil, trusted, "203.0.113.7"},
+		{"203.0.113.7:1000", []string{"192.0.2.1"}, trusted, "203.0.113.7"},
+		{"10.0.0.1:1000", []string{"203.0.113.7"}, trusted, "203.0.113.7"},
+		{"10.0.0.1:1000", []string{"198.51.100.1, 203.0.113.7", "10.0.0.3"}, trusted, "203.0.113.7"},
+		{"10.0.0.1:1000", []string{"203.0.113.7"}, nil, "10.0.0.1"},
+		{"10.0.0.1:1000", nil, trusted, "10.0.0.1"},
+		{"10.0.0.1:1000", []string{"garbage"}, trusted, "10.0.0.1"},
+		{"10.0.0.1:1000", []string{"garbage, 10.0.0.2"}, trusted, "10.0.0.2"},
+		{"@unix", nil, trusted, "<nil>"},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != nil {
+			r.Header["X-Forwarded-For"] = test.forwardedFor
+		}
+		if ip := ClientIP(r, test.trusted); ip.String() != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, ip)
+		}
+	}
+}
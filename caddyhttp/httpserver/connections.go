@@ -0,0 +1,305 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// ConnectionInfo describes an open connection of a server,
+// for debugging what the server is doing.
+type ConnectionInfo struct {
+	// The address the server listens on
+	Server string
+
+	// The addresses of either end of the connection
+	Local, Remote string
+
+	// What the connection is doing: new, active or idle as
+	// it is for http.ConnState, and detached if it is no
+	// longer served by the HTTP server, like a websocket
+	// that was hijacked or a connection that is passed
+	// through to another server
+	State string
+
+	// The TLS version, server name and negotiated protocol
+	// of the connection, if it has finished its handshake
+	TLSVersion, ServerName, Protocol string
+
+	// How long the connection has been open
+	Age time.Duration
+
+	// The bytes read from and written to the connection,
+	// TLS records and headers included
+	Traffic TrafficCounts
+
+	// The requests on the connection that are in a handler,
+	// which are more than one for HTTP/2, from the oldest
+	Requests []RequestInfo
+}
+
+// RequestInfo describes a request that is being served.
+type RequestInfo struct {
+	Method, Host, Proto string
+
+	// The path of the request, with its query string,
+	// which may hold secrets, only if it was asked for
+	Path string
+
+	// How long the request has been served
+	Elapsed time.Duration
+
+	// The middleware the request is in, which is only
+	// known for the sites that trace their requests
+	Middleware string
+}
+
+// RedactedQuery replaces the query string of the path of a
+// RequestInfo when the query strings are not to be shown.
+const RedactedQuery = "?REDACTED"
+
+// Connections returns the open connections of all the servers
+// that are running, from the oldest. The query strings of the
+// requests are redacted unless showQuery is true.
+func Connections(showQuery bool) []ConnectionInfo {
+	runningServersMu.Lock()
+	servers := make([]*Server, 0, len(runningServers))
+	for s := range runningServers {
+		servers = append(servers, s)
+	}
+	runningServersMu.Unlock()
+
+	now := time.Now()
+	var infos []ConnectionInfo
+	for _, s := range servers {
+		infos = append(infos, s.connections(now, showQuery)...)
+	}
+	sort.Stable(byAge(infos))
+	return infos
+}
+
+// WriteConnections writes infos to w as text, a line for
+// each connection followed by a line for each of its requests.
+func WriteConnections(w io.Writer, infos []ConnectionInfo) error {
+	for _, c := range infos {
+		line := fmt.Sprintf("%s <- %s %s", c.Server, c.Remote, c.State)
+		if c.TLSVersion != "" {
+			line += " " + c.TLSVersion
+			if c.ServerName != "" {
+				line += " sni=" + c.ServerName
+			}
+		}
+		if c.Protocol != "" {
+			line += " alpn=" + c.Protocol
+		}
+		line += fmt.Sprintf(" age=%v in=%d out=%d\n", c.Age, c.Traffic.Received, c.Traffic.Sent)
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		for _, r := range c.Requests {
+			line := fmt.Sprintf("    %s %s%s %s %v", r.Method, r.Host, r.Path, r.Proto, r.Elapsed)
+			if r.Middleware != "" {
+				line += " in " + r.Middleware
+			}
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runningServers are the servers whose connections are
+// listed by Connections, from when they start serving
+// until they have stopped.
+var (
+	runningServers   = make(map[*Server]struct{})
+	runningServersMu sync.Mutex
+)
+
+// connStatus is what the ConnState callback of a server
+// knows about one of its connections.
+type connStatus struct {
+	state http.ConnState
+	tls   *tls.ConnectionState // once the handshake is done
+}
+
+// trackConnState records the state of c, which the ConnState
+// callback of s reports. It must be called with s.listenerMu held.
+func (s *Server) trackConnState(c net.Conn, cs http.ConnState) {
+	switch cs {
+	case http.StateNew:
+		s.connStates[c] = &connStatus{state: cs}
+	case http.StateActive, http.StateIdle:
+		status, ok := s.connStates[c]
+		if !ok {
+			status = &connStatus{}
+			s.connStates[c] = status
+		}
+		status.state = cs
+		if tc, ok := c.(*tls.Conn); ok && status.tls == nil && cs == http.StateActive {
+			// the handshake is done before the first request is read
+			state := tc.ConnectionState()
+			status.tls = &state
+		}
+	default:
+		delete(s.connStates, c)
+	}
+}
+
+// inflightCtxKey is the request context key for the
+// inflightRequest of a request.
+const inflightCtxKey ctxKey = "inflight"
+
+// inflightRequest is a request that is being served, which
+// is kept in its server from when it starts until it ends.
+type inflightRequest struct {
+	local, remote       string
+	method, host, proto string
+	path, query         string
+	started             time.Time
+	middleware          atomic.Value // string
+}
+
+// inflightSet is the set of requests a server is serving.
+type inflightSet struct {
+	sync.Mutex
+	requests map[*inflightRequest]struct{}
+}
+
+// start adds r to the set as it starts being served, and
+// returns the inflightRequest that is to be passed to end.
+func (s *inflightSet) start(r *http.Request) *inflightRequest {
+	req := &inflightRequest{
+		remote:  r.RemoteAddr,
+		method:  r.Method,
+		host:    r.Host,
+		proto:   r.Proto,
+		path:    r.URL.Path,
+		query:   r.URL.RawQuery,
+		started: time.Now(),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		req.local = addr.String()
+	}
+	s.Lock()
+	if s.requests == nil {
+		s.requests = make(map[*inflightRequest]struct{})
+	}
+	s.requests[req] = struct{}{}
+	s.Unlock()
+	return req
+}
+
+// end removes req from the set once it is served.
+func (s *inflightSet) end(req *inflightRequest) {
+	s.Lock()
+	delete(s.requests, req)
+	s.Unlock()
+}
+
+// enterMiddleware records that r, if it is in flight, is in the
+// middleware called name, and returns the middleware it was in.
+func enterMiddleware(r *http.Request, name string) (*inflightRequest, string) {
+	req, ok := r.Context().Value(inflightCtxKey).(*inflightRequest)
+	if !ok {
+		return nil, ""
+	}
+	prev, _ := req.middleware.Load().(string)
+	req.middleware.Store(name)
+	return req, prev
+}
+
+// connKey identifies a connection by its addresses, which are the
+// same whether it is seen wrapped by TLS, by the ConnState callback
+// or by a request, or not.
+func connKey(local, remote string) string {
+	return local + " " + remote
+}
+
+// connections lists the open connections of s, with what
+// ConnState and the requests in flight know about them.
+func (s *Server) connections(now time.Time, showQuery bool) []ConnectionInfo {
+	s.listenerMu.Lock()
+	statuses := make(map[string]connStatus, len(s.connStates))
+	for c, status := range s.connStates {
+		statuses[connKey(c.LocalAddr().String(), c.RemoteAddr().String())] = *status
+	}
+	s.listenerMu.Unlock()
+
+	requests := make(map[string][]RequestInfo)
+	s.inflight.Lock()
+	for req := range s.inflight.requests {
+		info := RequestInfo{
+			Method:  req.method,
+			Host:    req.host,
+			Proto:   req.proto,
+			Path:    req.path,
+			Elapsed: now.Sub(req.started),
+		}
+		if req.query != "" {
+			if showQuery {
+				info.Path += "?" + req.query
+			} else {
+				info.Path += RedactedQuery
+			}
+		}
+		info.Middleware, _ = req.middleware.Load().(string)
+		key := connKey(req.local, req.remote)
+		requests[key] = append(requests[key], info)
+	}
+	s.inflight.Unlock()
+
+	s.conns.Lock()
+	infos := make([]ConnectionInfo, 0, len(s.conns.conns))
+	for c := range s.conns.conns {
+		local, remote := c.LocalAddr().String(), c.RemoteAddr().String()
+		key := connKey(local, remote)
+		info := ConnectionInfo{
+			Server:   s.Server.Addr,
+			Local:    local,
+			Remote:   remote,
+			State:    "detached",
+			Age:      now.Sub(c.opened),
+			Traffic:  c.traffic.Counts(),
+			Requests: requests[key],
+		}
+		if status, ok := statuses[key]; ok {
+			info.State = status.state.String()
+			if status.tls != nil {
+				info.TLSVersion = caddytls.ProtocolName(status.tls.Version)
+				if info.TLSVersion == "" {
+					info.TLSVersion = fmt.Sprintf("0x%04x", status.tls.Version)
+				}
+				info.ServerName = status.tls.ServerName
+				info.Protocol = status.tls.NegotiatedProtocol
+			}
+		}
+		sort.Sort(byElapsed(info.Requests))
+		infos = append(infos, info)
+	}
+	s.conns.Unlock()
+	return infos
+}
+
+// byAge sorts connections from the oldest.
+type byAge []ConnectionInfo
+
+func (l byAge) Len() int           { return len(l) }
+func (l byAge) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byAge) Less(i, j int) bool { return l[i].Age > l[j].Age }
+
+// byElapsed sorts requests from the oldest.
+type byElapsed []RequestInfo
+
+func (l byElapsed) Len() int           { return len(l) }
+func (l byElapsed) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byElapsed) Less(i, j int) bool { return l[i].Elapsed > l[j].Elapsed }
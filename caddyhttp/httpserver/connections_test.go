@@ -0,0 +1,137 @@
+package httpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// serverConnections returns the connections of the server at addr.
+func serverConnections(addr string, showQuery bool) []ConnectionInfo {
+	var infos []ConnectionInfo
+	for _, c := range Connections(showQuery) {
+		if c.Local == addr {
+			infos = append(infos, c)
+		}
+	}
+	return infos
+}
+
+func TestConnections(t *testing.T) {
+	release := make(chan struct{})
+	site := &SiteConfig{Addr: Address{Original: "example.com", Host: "example.com"}, TLS: new(caddytls.Config), Trace: TraceConfig{Always: true}}
+	site.directive = "auth"
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return next.ServeHTTP(w, r)
+		})
+	})
+	site.directive = "proxy"
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			<-release
+			w.Write([]byte("done"))
+			return 0, nil
+		})
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+	defer s.Stop()
+	addr := ln.Addr().String()
+
+	// each request is on its own connection, a while after the one before
+	paths := []string{"/first?token=s3cret", "/second", "/third"}
+	done := make(chan error, len(paths))
+	for i, path := range paths {
+		go func(path string) {
+			req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+			req.Host = "example.com"
+			resp, err := (&http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}).Do(req)
+			if err == nil {
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			done <- err
+		}(path)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var inflight int
+			for _, c := range serverConnections(addr, false) {
+				inflight += len(c.Requests)
+			}
+			if inflight == i+1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d requests in flight, got %d", i+1, inflight)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	infos := serverConnections(addr, false)
+	if len(infos) != len(paths) {
+		t.Fatalf("Expected %d connections, got %d", len(paths), len(infos))
+	}
+	for i, c := range infos {
+		if len(c.Requests) != 1 {
+			t.Fatalf("Connection %d: Expected 1 request, got %d", i, len(c.Requests))
+		}
+		r := c.Requests[0]
+		expectedPath := strings.Split(paths[i], "?")[0]
+		if i == 0 {
+			expectedPath += RedactedQuery
+		}
+		if r.Method != "GET" || r.Host != "example.com" || r.Path != expectedPath || r.Proto != "HTTP/1.1" {
+			t.Errorf("Connection %d: Expected GET example.com%s HTTP/1.1, got %s %s%s %s", i, expectedPath, r.Method, r.Host, r.Path, r.Proto)
+		}
+		if r.Middleware != "proxy" {
+			t.Errorf("Connection %d: Expected the request to be in proxy, got '%s'", i, r.Middleware)
+		}
+		if c.State != "active" || c.Traffic.Received == 0 || c.Age < r.Elapsed {
+			t.Errorf("Connection %d: Expected an active connection that was read from, got %+v", i, c)
+		}
+		if i > 0 && r.Elapsed >= infos[i-1].Requests[0].Elapsed {
+			t.Errorf("Connection %d: Expected the requests from the oldest, got %v after %v", i, r.Elapsed, infos[i-1].Requests[0].Elapsed)
+		}
+	}
+	if path := serverConnections(addr, true)[0].Requests[0].Path; path != paths[0] {
+		t.Errorf("Expected the query string when it is asked for, got '%s'", path)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteConnections(&buf, infos); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 6 ||
+		!strings.HasPrefix(lines[0], "127.0.0.1:0 <- ") || !strings.HasPrefix(lines[1], "    GET example.com/first?REDACTED HTTP/1.1 ") ||
+		!strings.HasSuffix(lines[1], " in proxy") {
+		t.Errorf("Expected a line for each connection and request, got:\n%s", buf.String())
+	}
+
+	// once they are served, the requests are gone
+	close(release)
+	for range paths {
+		if err := <-done; err != nil {
+			t.Fatalf("Expected no error from the request, got: %v", err)
+		}
+	}
+	for _, c := range serverConnections(addr, false) {
+		if len(c.Requests) > 0 {
+			t.Errorf("Expected no requests in flight after they are served, got %+v", c.Requests)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package httpserver
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// connCounts has the connection counts of every listener
+// that limits its connections, by address.
+var connCounts = expvar.NewMap("connections")
+
+// connLimits returns the connection limits of a server at addr for
+// group. The limits are kept by the listener that the sites share,
+// so each is set only if every site in group sets it, and to the
+// same value: if a site does not set it, there is no limit, and if
+// the sites set different ones, an error is returned.
+func connLimits(addr string, group []*SiteConfig) (max, maxPerIP int, err error) {
+	max, err = sharedConnLimit(addr, "max_connections", group, func(site *SiteConfig) int { return site.MaxConns })
+	if err != nil {
+		return 0, 0, err
+	}
+	maxPerIP, err = sharedConnLimit(addr, "max_connections_per_ip", group, func(site *SiteConfig) int { return site.MaxConnsPerIP })
+	if err != nil {
+		return 0, 0, err
+	}
+	return max, maxPerIP, nil
+}
+
+// sharedConnLimit returns the limit called name, which limit
+// gets from each site, of the listener at addr for group.
+func sharedConnLimit(addr, name string, group []*SiteConfig, limit func(*SiteConfig) int) (int, error) {
+	var limited, unlimited *SiteConfig
+	for _, site := range group {
+		if limit(site) == 0 {
+			unlimited = site
+		} else if limited == nil {
+			limited = site
+		}
+	}
+	if limited == nil {
+		return 0, nil
+	}
+	if unlimited != nil {
+		log.Printf("[WARNING] %s: %s of %s does not apply, because %s shares the listener without a limit",
+			addr, name, limited.Addr, unlimited.Addr)
+		return 0, nil
+	}
+	for _, site := range group {
+		if limit(site) != limit(limited) {
+			return 0, fmt.Errorf("%s: %s and %s share the listener, but set different %s (%d and %d)",
+				addr, limited.Addr, site.Addr, name, limit(limited), limit(site))
+		}
+	}
+	return limit(limited), nil
+}
+
+// newLimitListener returns a limitListener that wraps l and
+// allows up to max connections at a time, and up to maxPerIP
+// from one IP address; a limit of 0 means no limit.
+func newLimitListener(l net.Listener, max, maxPerIP int) *limitListener {
+	ll := &limitListener{Listener: l, max: max, maxPerIP: maxPerIP, perIP: make(map[string]int)}
+	connCounts.Set(l.Addr().String(), ll)
+	return ll
+}
+
+// limitListener is a net.Listener that closes the connections
+// it accepts beyond its limits right away, before anything is
+// read from them, so that a client that opens many connections
+// cannot make the server do the work of serving them, not even
+// their TLS handshakes.
+type limitListener struct {
+	net.Listener
+	max      int
+	maxPerIP int
+
+	mu       sync.Mutex // protects the counts
+	active   int
+	perIP    map[string]int
+	rejected int
+}
+
+// Accept accepts the next connection that is within the limits.
+func (ll *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := connIP(c)
+		if ll.admit(ip) {
+			return &limitConn{Conn: c, ll: ll, ip: ip}, nil
+		}
+		c.Close()
+	}
+}
+
+// admit counts a connection from ip, if it is within the limits.
+func (ll *limitListener) admit(ip string) bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if (ll.max > 0 && ll.active >= ll.max) ||
+		(ll.maxPerIP > 0 && ip != "" && ll.perIP[ip] >= ll.maxPerIP) {
+		ll.rejected++
+		return false
+	}
+	ll.active++
+	if ip != "" {
+		ll.perIP[ip]++
+	}
+	return true
+}
+
+// release uncounts a connection from ip.
+func (ll *limitListener) release(ip string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.active--
+	if ip != "" {
+		if ll.perIP[ip]--; ll.perIP[ip] <= 0 {
+			delete(ll.perIP, ip)
+		}
+	}
+}
+
+// counts returns how many connections are open, from how
+// many IP addresses, and how many were rejected.
+func (ll *limitListener) counts() (active, ips, rejected int) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.active, len(ll.perIP), ll.rejected
+}
+
+// String implements expvar.Var.
+func (ll *limitListener) String() string {
+	active, ips, rejected := ll.counts()
+	return fmt.Sprintf(`{"active": %d, "ips": %d, "rejected": %d}`, active, ips, rejected)
+}
+
+// connIP returns the IP address that c comes from,
+// or "" if it does not come from one.
+func connIP(c net.Conn) string {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// limitConn is a connection that a limitListener counts
+// until it is closed.
+type limitConn struct {
+	net.Conn
+	ll   *limitListener
+	ip   string
+	once sync.Once
+}
+
+// Close closes the connection and uncounts it.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.ll.release(c.ip) })
+	return err
+}
@@ -0,0 +1,143 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveIdle accepts the connections of ln and keeps them
+// open until their client closes them.
+func serveIdle(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}()
+	}
+}
+
+// waitForCounts waits until ll has the counts, and
+// fails the test if it does not get them in time.
+func waitForCounts(t *testing.T, ll *limitListener, active, ips, rejected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a, i, r := ll.counts()
+		if a == active && i == ips && r == rejected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active connections from %d IPs and %d rejected, got %d from %d and %d",
+				active, ips, rejected, a, i, r)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialFrom opens a connection to addr from the loopback address ip.
+func dialFrom(t *testing.T, ip, addr string) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dialing %s from %s: %v", addr, ip, err)
+	}
+	return c
+}
+
+// isClosed reports whether the server closed c.
+func isClosed(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening: %v", err)
+	}
+	ll := newLimitListener(inner, 5, 3)
+	defer ll.Close()
+	go serveIdle(ll)
+	addr := inner.Addr().String()
+
+	// 3 from one IP are allowed, the rest from it are not
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		conns = append(conns, dialFrom(t, "127.0.0.1", addr))
+	}
+	waitForCounts(t, ll, 3, 1, 2)
+	var closed int
+	for _, c := range conns {
+		if isClosed(c) {
+			closed++
+		}
+	}
+	if closed != 2 {
+		t.Errorf("Expected 2 connections to be closed, got %d", closed)
+	}
+
+	// another IP may open connections up to the total limit
+	for i := 0; i < 3; i++ {
+		conns = append(conns, dialFrom(t, "127.0.0.2", addr))
+	}
+	waitForCounts(t, ll, 5, 2, 3)
+
+	// closing connections makes room for new ones
+	for _, c := range conns {
+		c.Close()
+	}
+	waitForCounts(t, ll, 0, 0, 3)
+	c := dialFrom(t, "127.0.0.2", addr)
+	defer c.Close()
+	waitForCounts(t, ll, 1, 1, 3)
+
+	var counts struct{ Active, IPs, Rejected int }
+	if err := json.Unmarshal([]byte(expvar.Get("connections").(*expvar.Map).Get(addr).String()), &counts); err != nil {
+		t.Fatalf("Expected counts in expvar, got error: %v", err)
+	}
+	if counts.Active != 1 || counts.IPs != 1 || counts.Rejected != 3 {
+		t.Errorf("Expected 1 active connection from 1 IP and 3 rejected in expvar, got %+v", counts)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	for i, test := range []struct {
+		sites            []*SiteConfig
+		expectedMax      int
+		expectedMaxPerIP int
+		shouldErr        bool
+	}{
+		{[]*SiteConfig{{}}, 0, 0, false},
+		{[]*SiteConfig{{MaxConns: 1000, MaxConnsPerIP: 50}}, 1000, 50, false},
+		{[]*SiteConfig{{MaxConns: 1000}, {MaxConns: 1000}}, 1000, 0, false},
+		{[]*SiteConfig{{MaxConns: 1000, MaxConnsPerIP: 50}, {MaxConns: 1000}}, 1000, 0, false},
+		{[]*SiteConfig{{MaxConns: 100}, {MaxConns: 1000, MaxConnsPerIP: 50}, {}}, 0, 0, false},
+		{[]*SiteConfig{{MaxConns: 100}, {MaxConns: 1000}}, 0, 0, true},
+		{[]*SiteConfig{{MaxConnsPerIP: 5}, {MaxConnsPerIP: 50}}, 0, 0, true},
+	} {
+		max, maxPerIP, err := connLimits("127.0.0.1:0", test.sites)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got limits %d and %d", i, max, maxPerIP)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if max != test.expectedMax || maxPerIP != test.expectedMaxPerIP {
+			t.Errorf("Test %d: Expected limits %d and %d, got %d and %d",
+				i, test.expectedMax, test.expectedMaxPerIP, max, maxPerIP)
+		}
+	}
+}
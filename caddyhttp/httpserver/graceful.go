@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // TODO: Should this be a generic graceful listener available in its own package or something?
@@ -11,9 +12,10 @@ import (
 // the waitgroup internal to itself?
 
 // newGracefulListener returns a gracefulListener that wraps l and
-// uses wg (stored in the host server) to count connections.
-func newGracefulListener(l net.Listener, wg *sync.WaitGroup) *gracefulListener {
-	gl := &gracefulListener{Listener: l, stop: make(chan error), connWg: wg}
+// uses wg (stored in the host server) to count connections and
+// conns (also stored in the host server) to keep them.
+func newGracefulListener(l net.Listener, wg *sync.WaitGroup, conns *connSet) *gracefulListener {
+	gl := &gracefulListener{Listener: l, stop: make(chan error), connWg: wg, conns: conns}
 	go func() {
 		<-gl.stop
 		gl.Lock()
@@ -33,6 +35,7 @@ type gracefulListener struct {
 	stopped    bool
 	sync.Mutex                 // protects the stopped flag
 	connWg     *sync.WaitGroup // pointer to the host's wg used for counting connections
+	conns      *connSet        // pointer to the host's set of open connections
 }
 
 // Accept accepts a connection.
@@ -41,9 +44,10 @@ func (gl *gracefulListener) Accept() (c net.Conn, err error) {
 	if err != nil {
 		return
 	}
-	c = gracefulConn{Conn: c, connWg: gl.connWg}
+	gc := &gracefulConn{Conn: c, connWg: gl.connWg, conns: gl.conns, opened: time.Now()}
 	gl.connWg.Add(1)
-	return
+	gl.conns.add(gc)
+	return gc, nil
 }
 
 // Close immediately closes the listener.
@@ -63,18 +67,78 @@ func (gl *gracefulListener) Close() error {
 // of the number of connections, thus facilitating
 // a graceful shutdown.
 type gracefulConn struct {
+	traffic Traffic // must be first field to be 64-bit aligned on 32-bit systems
 	net.Conn
 	connWg *sync.WaitGroup // pointer to the host server's connection waitgroup
+	conns  *connSet        // pointer to the host server's set of open connections
+	opened time.Time       // when the connection was accepted
+}
+
+// Read reads from c's underlying connection, counting the bytes.
+func (c *gracefulConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.traffic.AddReceived(n)
+	return n, err
+}
+
+// Write writes to c's underlying connection, counting the bytes.
+func (c *gracefulConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.traffic.AddSent(n)
+	return n, err
 }
 
 // Close closes c's underlying connection while updating the wg count.
-func (c gracefulConn) Close() error {
+func (c *gracefulConn) Close() error {
 	err := c.Conn.Close()
 	if err != nil {
 		return err
 	}
 	// close can fail on http2 connections (as of Oct. 2015, before http2 in std lib)
 	// so don't decrement count unless close succeeds
+	c.conns.remove(c)
 	c.connWg.Done()
 	return nil
 }
+
+// connSet is the set of open connections of a server, which
+// is kept so that the connections that are still open at the
+// end of a graceful shutdown can be closed forcibly.
+type connSet struct {
+	sync.Mutex
+	conns map[*gracefulConn]struct{}
+}
+
+func (s *connSet) add(c *gracefulConn) {
+	s.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*gracefulConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.Unlock()
+}
+
+func (s *connSet) remove(c *gracefulConn) {
+	s.Lock()
+	delete(s.conns, c)
+	s.Unlock()
+}
+
+// closeAll closes all connections in the set, whatever
+// they are doing, and returns how many it closed.
+func (s *connSet) closeAll() int {
+	s.Lock()
+	conns := make([]*gracefulConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.Unlock()
+
+	var closed int
+	for _, c := range conns {
+		if c.Close() == nil {
+			closed++
+		}
+	}
+	return closed
+}
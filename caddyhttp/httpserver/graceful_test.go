@@ -0,0 +1,184 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddytls"
+)
+
+func TestGracePeriod(t *testing.T) {
+	oldTimeout := GracefulTimeout
+	defer func() { GracefulTimeout = oldTimeout }()
+	GracefulTimeout = 5 * time.Second
+
+	for i, test := range []struct {
+		periods  []time.Duration
+		expected time.Duration
+	}{
+		{[]time.Duration{0}, 5 * time.Second},
+		{[]time.Duration{0, 0}, 5 * time.Second},
+		{[]time.Duration{time.Second}, time.Second},
+		{[]time.Duration{0, 30 * time.Second, time.Second}, 30 * time.Second},
+	} {
+		var group []*SiteConfig
+		for _, period := range test.periods {
+			group = append(group, &SiteConfig{GracePeriod: period})
+		}
+		if got := gracePeriod(group); got != test.expected {
+			t.Errorf("Test %d: Expected grace period %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestStopGracePeriod(t *testing.T) {
+	testDone := make(chan struct{})
+	defer close(testDone)
+	started := make(chan struct{}, 3)
+
+	site := &SiteConfig{
+		Addr:        Address{Original: "127.0.0.1:0", Host: "127.0.0.1", Port: "0"},
+		TLS:         new(caddytls.Config),
+		GracePeriod: 500 * time.Millisecond,
+	}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			switch r.URL.Path {
+			case "/short":
+				started <- struct{}{}
+				time.Sleep(200 * time.Millisecond)
+			case "/long":
+				started <- struct{}{}
+				select {
+				case <-time.After(10 * time.Second):
+				case <-testDone:
+				}
+			case "/notify":
+				started <- struct{}{}
+				select {
+				case <-ShutdownNotify(r):
+				case <-testDone:
+				}
+			}
+			w.Write([]byte("done"))
+			return 0, nil
+		})
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+	addr := ln.Addr().String()
+
+	// an idle keep-alive connection must not hold up the shutdown
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Expected no error on first request, got: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	type result struct {
+		resp *http.Response
+		body string
+		err  error
+	}
+	results := make(map[string]chan result)
+	for _, path := range []string{"/short", "/long", "/notify"} {
+		ch := make(chan result, 1)
+		results[path] = ch
+		go func(path string) {
+			// each request on its own connection
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			resp, err := client.Get("http://" + addr + path)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			ch <- result{resp: resp, body: string(body), err: err}
+		}(path)
+	}
+	for i := 0; i < len(results); i++ {
+		<-started
+	}
+
+	start := time.Now()
+	err = s.Stop()
+	elapsed := time.Since(start)
+	if err != caddy.ErrConnsCut {
+		t.Errorf("Expected ErrConnsCut from stopping, got: %v", err)
+	}
+	if elapsed < site.GracePeriod || elapsed > site.GracePeriod+time.Second {
+		t.Errorf("Expected stopping to take the grace period of %v, took %v", site.GracePeriod, elapsed)
+	}
+
+	for _, path := range []string{"/short", "/notify"} {
+		res := <-results[path]
+		if res.err != nil {
+			t.Errorf("Expected %s to finish within the grace period, got: %v", path, res.err)
+			continue
+		}
+		if res.body != "done" {
+			t.Errorf("Expected %s to respond 'done', got '%s'", path, res.body)
+		}
+		if !res.resp.Close {
+			t.Errorf("Expected %s to be answered with Connection: close", path)
+		}
+	}
+	select {
+	case res := <-results["/long"]:
+		if res.err == nil {
+			t.Errorf("Expected /long to be cut at the end of the grace period, but it finished with '%s'", res.body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected /long to be cut at the end of the grace period, but it is still going")
+	}
+}
+
+func TestStopWithinGracePeriod(t *testing.T) {
+	site := &SiteConfig{
+		Addr:        Address{Original: "127.0.0.1:0", Host: "127.0.0.1", Port: "0"},
+		TLS:         new(caddytls.Config),
+		GracePeriod: 5 * time.Second,
+	}
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+
+	// a connection that went idle is closed right away
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Expected no error on request, got: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	start := time.Now()
+	if err := s.Stop(); err != nil {
+		t.Errorf("Expected no error from stopping, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected stopping without connections in flight to be quick, took %v", elapsed)
+	}
+}
@@ -0,0 +1,195 @@
+package httpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// startH2CServer starts a plaintext server with h2c enabled that
+// responds with the protocol version of each request it serves.
+func startH2CServer(t *testing.T) (*Server, string) {
+	site := &SiteConfig{
+		Addr: Address{Original: "127.0.0.1:0", Host: "127.0.0.1", Port: "0"},
+		TLS:  new(caddytls.Config),
+		H2C:  true,
+	}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Trailer", "X-Proto")
+			w.Write([]byte(r.Proto))
+			w.Header().Set("X-Proto", r.Proto)
+			return 0, nil
+		})
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+	return s, ln.Addr().String()
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	s, addr := startH2CServer(t)
+	defer s.Stop()
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Expected no error making h2c request, got: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected response over HTTP/2, got %s", resp.Proto)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected request to be served as HTTP/2.0, got %s", body)
+	}
+	if got := resp.Trailer.Get("X-Proto"); got != "HTTP/2.0" {
+		t.Errorf("Expected trailer X-Proto to be HTTP/2.0, got '%s'", got)
+	}
+
+	// HTTP/1.1 on the same listener must keep working
+	resp, err = http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Expected no error making HTTP/1.1 request, got: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("Expected request to be served as HTTP/1.1, got %s", body)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	s, addr := startH2CServer(t)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// empty SETTINGS payload, base64url encoded, is the empty string
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading upgrade response, got: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upgrade"); got != "h2c" {
+		t.Errorf("Expected Upgrade: h2c, got '%s'", got)
+	}
+
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgraded request is answered on stream 1
+	var status, body string
+	dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+	for done := false; !done; {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Expected no error reading frame, got: %v", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			if _, err := dec.Write(f.HeaderBlockFragment()); err != nil {
+				t.Fatal(err)
+			}
+			done = f.StreamEnded()
+		case *http2.DataFrame:
+			body += string(f.Data())
+			done = f.StreamEnded()
+		}
+	}
+	if status != "200" {
+		t.Errorf("Expected status 200 on stream 1, got '%s'", status)
+	}
+	if !strings.HasPrefix(body, "HTTP/2.0") {
+		t.Errorf("Expected upgraded request to be served as HTTP/2.0, got %s", body)
+	}
+}
+
+func TestH2CUpgradeHeaderOnly(t *testing.T) {
+	s, addr := startH2CServer(t)
+	defer s.Stop()
+
+	// without Connection: HTTP2-Settings, the connection is not upgraded
+	for i, headers := range []string{
+		"Upgrade: h2c\r\n",
+		"Connection: Upgrade\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + addr + "\r\n" + headers + "\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error reading response, got: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		conn.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "HTTP/1.1") {
+			t.Errorf("Test %d: Expected the request to be served as HTTP/1.1, got %d '%s'", i, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestH2CRefusesTLS(t *testing.T) {
+	site := &SiteConfig{
+		Addr: Address{Original: "https://example.com", Scheme: "https", Host: "example.com", Port: "443"},
+		TLS:  &caddytls.Config{Enabled: true, Manual: true, Hostname: "example.com"},
+		H2C:  true,
+	}
+	_, err := NewServer("example.com:443", []*SiteConfig{site})
+	if err == nil {
+		t.Error("Expected an error enabling h2c on a TLS listener, got none")
+	}
+}
@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ambiguity returns why r could be taken for a different request
+// by a server behind this one, or the empty string if it could
+// not. Such requests are rejected before any site sees them,
+// unless a site on the listener allows them.
+//
+// The net/http server already rejects many of these, like
+// requests with several Host headers or with header names that
+// are not tokens, before they get here; the checks here cover
+// the other ways requests come in, like QUIC.
+func ambiguity(r *http.Request) string {
+	hosts := r.Header["Host"]
+	if len(hosts) > 1 {
+		return "multiple Host headers"
+	}
+	if len(hosts) == 1 && normalizeHost(hosts[0], r.TLS != nil) != normalizeHost(r.Host, r.TLS != nil) {
+		return fmt.Sprintf("Host header %q does not match request target host %q", hosts[0], r.Host)
+	}
+
+	// the host of an absolute-form target is the host of the
+	// request, which the net/http server takes in place of the
+	// Host header it drops (RFC 7230 section 5.4); the target is
+	// only ambiguous if it disagrees with the host of the request
+	if r.URL.IsAbs() && normalizeHost(r.URL.Host, r.TLS != nil) != normalizeHost(r.Host, r.TLS != nil) {
+		return fmt.Sprintf("absolute-form request target %q does not match host %q", r.URL.String(), r.Host)
+	}
+
+	for name := range r.Header {
+		if !ValidHeaderName(name) {
+			if strings.Contains(name, "_") {
+				return fmt.Sprintf("underscore in header name %q", name)
+			}
+			return fmt.Sprintf("invalid character in header name %q", name)
+		}
+	}
+
+	if len(r.Header["Content-Length"]) > 1 {
+		return "multiple Content-Length headers"
+	}
+	if len(r.TransferEncoding) > 0 && r.Header.Get("Content-Length") != "" {
+		return "both Transfer-Encoding and Content-Length"
+	}
+	return ""
+}
+
+// ValidHeaderName returns true if name is a token, as HTTP requires
+// header names to be, without underscores, which some servers, like
+// CGI ones, take for dashes; a header with an underscore could pass
+// for one that a proxy in front of them set.
+func ValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' || !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar returns true if c may be in a token (RFC 7230 section 3.2.6).
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// normalizeHost returns host as the effective host of requests is
+// known to the sites, their placeholders and their certificates:
+// in lower case, without a trailing dot in the name, and without
+// the port if it is the default one for the scheme.
+func normalizeHost(host string, isTLS bool) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if port == "" || (port == "80" && !isTLS) || (port == "443" && isTLS) {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
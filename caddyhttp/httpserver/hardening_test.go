@@ -0,0 +1,162 @@
+package httpserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// startHostServer starts a server with a site that responds
+// with the {host} placeholder of each request it serves.
+func startHostServer(t *testing.T, allowAmbiguous bool) (*Server, string) {
+	site := &SiteConfig{
+		Addr:                   Address{Original: "example.com", Host: "example.com", Port: "80"},
+		TLS:                    new(caddytls.Config),
+		AllowAmbiguousRequests: allowAmbiguous,
+	}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte(NewReplacer(r, nil, "").Replace("{host}")))
+			return 0, nil
+		})
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+	return s, ln.Addr().String()
+}
+
+// rawRequest writes req on a new connection to addr and
+// returns the status and body of the response.
+func rawRequest(t *testing.T, addr, req string) (int, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Expected a response to %q, got error: %v", req, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, string(body)
+}
+
+func TestAmbiguousRequests(t *testing.T) {
+	s, addr := startHostServer(t, false)
+	defer s.Stop()
+
+	for i, test := range []struct {
+		req    string
+		status int
+		host   string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "example.com"},
+		{"GET / HTTP/1.1\r\nHost: EXAMPLE.com.:80\r\n\r\n", http.StatusOK, "example.com"},
+		{"GET / HTTP/1.1\r\nHost: example.com:80\r\nX-Custom-Header: 1\r\n\r\n", http.StatusOK, "example.com"},
+		{"POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusOK, "example.com"},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\nHost: other.example.com\r\n\r\n", http.StatusBadRequest, ""},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "example.com"},
+		{"GET http://EXAMPLE.com:80/ HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK, "example.com"},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\nX_Forwarded_For: 10.0.0.1\r\n\r\n", http.StatusBadRequest, ""},
+		{"GET / HTTP/1.1\r\nHost: example.com\r\nX Forwarded For: 10.0.0.1\r\n\r\n", http.StatusBadRequest, ""},
+		{"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", http.StatusBadRequest, ""},
+		// net/http refuses to guess which encoding applies
+		{"POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n", http.StatusNotImplemented, ""},
+	} {
+		status, body := rawRequest(t, addr, test.req)
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+			continue
+		}
+		if status == http.StatusOK && body != test.host {
+			t.Errorf("Test %d: Expected {host} to be %q, got %q", i, test.host, body)
+		}
+	}
+}
+
+func TestAllowAmbiguousRequests(t *testing.T) {
+	s, addr := startHostServer(t, true)
+	defer s.Stop()
+
+	status, body := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: example.com\r\nX_Forwarded_For: 10.0.0.1\r\n\r\n")
+	if status != http.StatusOK || body != "example.com" {
+		t.Errorf("Expected 200 with host example.com, got %d %q", status, body)
+	}
+	status, body = rawRequest(t, addr, "GET http://Example.com./ HTTP/1.1\r\nHost: other.example.com\r\n\r\n")
+	if status != http.StatusOK || body != "example.com" {
+		t.Errorf("Expected 200 with host example.com, got %d %q", status, body)
+	}
+}
+
+func TestAmbiguity(t *testing.T) {
+	for i, test := range []struct {
+		target string
+		header http.Header
+		host   string
+		te     []string
+		reason string
+	}{
+		{"/", http.Header{"Accept": {"*/*"}}, "example.com", nil, ""},
+		{"/", http.Header{"Host": {"Example.com."}}, "example.com", nil, ""},
+		{"/", http.Header{"Host": {"example.com", "example.com"}}, "example.com", nil, "multiple Host headers"},
+		{"/", http.Header{"Host": {"other.example.com"}}, "example.com", nil, "does not match"},
+		{"/", http.Header{"X_Real_Ip": {"10.0.0.1"}}, "example.com", nil, "underscore"},
+		{"/", http.Header{"X Real Ip": {"10.0.0.1"}}, "example.com", nil, "invalid character"},
+		{"/", http.Header{"Content-Length": {"5", "6"}}, "example.com", nil, "multiple Content-Length"},
+		{"/", http.Header{"Content-Length": {"5"}}, "example.com", []string{"chunked"}, "both Transfer-Encoding and Content-Length"},
+		{"http://example.com/", http.Header{}, "example.com", nil, ""},
+		{"http://Example.com:80/", http.Header{}, "example.com", nil, ""},
+		{"http://other.example.com/", http.Header{}, "example.com", nil, "absolute-form request target"},
+	} {
+		r, err := http.NewRequest("GET", test.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RequestURI = test.target
+		r.Header, r.Host, r.TransferEncoding = test.header, test.host, test.te
+		reason := ambiguity(r)
+		if (test.reason == "") != (reason == "") || !strings.Contains(reason, test.reason) {
+			t.Errorf("Test %d: Expected reason containing %q, got %q", i, test.reason, reason)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for i, test := range []struct {
+		host   string
+		isTLS  bool
+		expect string
+	}{
+		{"Example.COM", false, "example.com"},
+		{"example.com.", false, "example.com"},
+		{"example.com:80", false, "example.com"},
+		{"example.com:443", true, "example.com"},
+		{"example.com:443", false, "example.com:443"},
+		{"example.com.:8080", false, "example.com:8080"},
+		{"[::1]:80", false, "[::1]"},
+		{"[::1]:8080", false, "[::1]:8080"},
+		{"", false, ""},
+	} {
+		if got := normalizeHost(test.host, test.isTLS); got != test.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expect, got)
+		}
+	}
+}
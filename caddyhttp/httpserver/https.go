@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddytls"
@@ -16,19 +17,55 @@ func activateHTTPS(cctx caddy.Context) error {
 
 	ctx := cctx.(*httpContext)
 
+	// serve the other form of canonical hosts, so that it
+	// gets its certificate like any other site
+	var err error
+	ctx.siteConfigs, err = makeCanonicalHostRedirects(ctx.siteConfigs)
+	if err != nil {
+		return err
+	}
+
 	// pre-screen each config and earmark the ones that qualify for managed TLS
 	markQualifiedForAutoHTTPS(ctx.siteConfigs)
 
-	// place certificates and keys on disk
+	if ctx.validating {
+		// configure TLS and redirects as usual, but do not
+		// touch the CA or the certificates on disk
+		enableAutoHTTPS(ctx.siteConfigs, false)
+		ctx.siteConfigs = makePlaintextRedirects(ctx.siteConfigs)
+		if !caddy.Quiet {
+			fmt.Println(" done.")
+		}
+		return nil
+	}
+
+	// set aside the certificates and keys on disk that are
+	// damaged, so that they are obtained again
+	tlsConfigs := make([]*caddytls.Config, len(ctx.siteConfigs))
+	for i, c := range ctx.siteConfigs {
+		tlsConfigs[i] = c.TLS
+	}
+	caddytls.CheckStorage(tlsConfigs)
+
+	// place certificates and keys on disk; the ones that are not
+	// there yet are obtained in the background once the servers
+	// are listening, unless their config blocks until they are
 	for _, c := range ctx.siteConfigs {
-		err := c.TLS.ObtainCert(true)
+		queued, err := c.TLS.ObtainCertInBackground(true)
+		if err != nil {
+			return err
+		}
+		if queued {
+			continue
+		}
+		err = c.TLS.ObtainCert(true)
 		if err != nil {
 			return err
 		}
 	}
 
 	// update TLS configurations
-	err := enableAutoHTTPS(ctx.siteConfigs, true)
+	err = enableAutoHTTPS(ctx.siteConfigs, true)
 	if err != nil {
 		return err
 	}
@@ -67,7 +104,8 @@ func markQualifiedForAutoHTTPS(configs []*SiteConfig) {
 // the certificates will be loaded from disk into the cache for this process
 // to use. If false, TLS will still be enabled and configured with default
 // settings, but no certificates will be parsed loaded into the cache, and
-// the returned error value will always be nil.
+// the returned error value will always be nil. The certificates that
+// are being obtained in the background are not loaded either.
 func enableAutoHTTPS(configs []*SiteConfig, loadCertificates bool) error {
 	for _, cfg := range configs {
 		if cfg == nil || cfg.TLS == nil || !cfg.TLS.Managed {
@@ -75,7 +113,7 @@ func enableAutoHTTPS(configs []*SiteConfig, loadCertificates bool) error {
 		}
 		cfg.TLS.Enabled = true
 		cfg.Addr.Scheme = "https"
-		if loadCertificates && caddytls.HostQualifies(cfg.Addr.Host) {
+		if loadCertificates && caddytls.HostQualifies(cfg.Addr.Host) && !caddytls.ObtainingInBackground(cfg.Addr.Host) {
 			_, err := caddytls.CacheManagedCertificate(cfg.Addr.Host, cfg.TLS)
 			if err != nil {
 				return err
@@ -104,6 +142,9 @@ func enableAutoHTTPS(configs []*SiteConfig, loadCertificates bool) error {
 // all configs.
 func makePlaintextRedirects(allConfigs []*SiteConfig) []*SiteConfig {
 	for i, cfg := range allConfigs {
+		if cfg.HTTPSRedirect != nil && cfg.HTTPSRedirect.Disabled {
+			continue
+		}
 		if cfg.TLS.Managed &&
 			!hostHasOtherPort(allConfigs, i, "80") &&
 			(cfg.Addr.Port == "443" || !hostHasOtherPort(allConfigs, i, "443")) {
@@ -129,24 +170,83 @@ func hostHasOtherPort(allConfigs []*SiteConfig, thisConfigIdx int, otherPort str
 	return false
 }
 
+// RedirectConfig customizes the redirect from HTTP to HTTPS
+// that is set up for sites which use automatic HTTPS.
+type RedirectConfig struct {
+	// Don't redirect at all (HTTPS stays enabled)
+	Disabled bool
+
+	// The status code to redirect with; 0 means
+	// http.StatusMovedPermanently
+	Code int
+
+	// The port to redirect to; empty means the
+	// port the HTTPS site is served on
+	Port string
+
+	// Whether to drop the query string
+	StripQuery bool
+
+	// Path prefixes that are not redirected, but
+	// served by the site over plaintext HTTP instead
+	Except []string
+}
+
 // redirPlaintextHost returns a new plaintext HTTP configuration for
 // a virtualHost that simply redirects to cfg, which is assumed to
 // be the HTTPS configuration. The returned configuration is set
 // to listen on port 80. The TLS field of cfg must not be nil.
+// Requests to paths exempted by cfg.HTTPSRedirect are served
+// by the middleware of cfg instead of being redirected.
 func redirPlaintextHost(cfg *SiteConfig) *SiteConfig {
+	rc := cfg.HTTPSRedirect
+	if rc == nil {
+		rc = new(RedirectConfig)
+	}
+	code := rc.Code
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
 	redirPort := cfg.Addr.Port
+	if rc.Port != "" {
+		redirPort = rc.Port
+	}
 	if redirPort == "443" {
 		// default port is redundant
 		redirPort = ""
 	}
 	redirMiddleware := func(next Handler) Handler {
 		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
-			toURL := "https://" + r.Host
+			for _, prefix := range rc.Except {
+				if Path(r.URL.Path).Matches(prefix) {
+					return cfg.middlewareChain.ServeHTTP(w, r)
+				}
+			}
+
+			// the port of the plaintext request is irrelevant
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			host = strings.Trim(host, "[]")
+
+			toURL := "https://"
 			if redirPort != "" {
-				toURL += ":" + redirPort
+				toURL += net.JoinHostPort(host, redirPort)
+			} else if strings.Contains(host, ":") {
+				toURL += "[" + host + "]"
+			} else {
+				toURL += host
+			}
+			if rc.StripQuery {
+				if r.URL.Path == "" {
+					toURL += "/"
+				}
+				toURL += r.URL.EscapedPath()
+			} else {
+				toURL += r.URL.RequestURI()
 			}
-			toURL += r.URL.RequestURI()
-			http.Redirect(w, r, toURL, http.StatusMovedPermanently)
+			http.Redirect(w, r, toURL, code)
 			return 0, nil
 		})
 	}
@@ -154,9 +254,14 @@ func redirPlaintextHost(cfg *SiteConfig) *SiteConfig {
 	port := "80"
 	addr := net.JoinHostPort(host, port)
 	return &SiteConfig{
-		Addr:       Address{Original: addr, Host: host, Port: port},
-		ListenHost: cfg.ListenHost,
-		middleware: []Middleware{redirMiddleware},
-		TLS:        &caddytls.Config{AltHTTPPort: cfg.TLS.AltHTTPPort},
+		Addr:        Address{Original: addr, Host: host, Port: port},
+		ListenHost:  cfg.ListenHost,
+		ListenHosts: cfg.ListenHosts,
+		middleware:  []Middleware{redirMiddleware},
+		TLS: &caddytls.Config{
+			AltHTTPPort:    cfg.TLS.AltHTTPPort,
+			CAUrl:          cfg.TLS.CAUrl,
+			StorageCreator: cfg.TLS.StorageCreator,
+		},
 	}
 }
@@ -81,6 +81,57 @@ func TestRedirPlaintextHost(t *testing.T) {
 	}
 }
 
+func TestRedirPlaintextHostOptions(t *testing.T) {
+	for i, test := range []struct {
+		port     string
+		redirect *RedirectConfig
+		url      string
+		code     int
+		location string
+	}{
+		{"443", &RedirectConfig{Code: http.StatusMovedPermanently}, "http://foo/bar?q=1", http.StatusMovedPermanently, "https://foo/bar?q=1"},
+		{"443", &RedirectConfig{Code: http.StatusFound}, "http://foo/bar?q=1", http.StatusFound, "https://foo/bar?q=1"},
+		{"443", &RedirectConfig{Code: http.StatusTemporaryRedirect}, "http://foo/bar?q=1", http.StatusTemporaryRedirect, "https://foo/bar?q=1"},
+		{"443", &RedirectConfig{Code: http.StatusPermanentRedirect}, "http://foo/bar?q=1", http.StatusPermanentRedirect, "https://foo/bar?q=1"},
+		{"8443", nil, "http://foo/bar?q=1", http.StatusMovedPermanently, "https://foo:8443/bar?q=1"},
+		{"8443", nil, "http://foo:80/bar", http.StatusMovedPermanently, "https://foo:8443/bar"},
+		{"8443", &RedirectConfig{Port: "443"}, "http://foo/bar", http.StatusMovedPermanently, "https://foo/bar"},
+		{"443", &RedirectConfig{Port: "9443"}, "http://foo/bar", http.StatusMovedPermanently, "https://foo:9443/bar"},
+		{"443", nil, "http://[::1]:80/bar", http.StatusMovedPermanently, "https://[::1]/bar"},
+		{"8443", nil, "http://[::1]/bar", http.StatusMovedPermanently, "https://[::1]:8443/bar"},
+		{"443", &RedirectConfig{StripQuery: true}, "http://foo/bar?q=1", http.StatusMovedPermanently, "https://foo/bar"},
+		{"443", &RedirectConfig{StripQuery: true}, "http://foo?q=1", http.StatusMovedPermanently, "https://foo/"},
+		{"443", &RedirectConfig{Except: []string{"/health"}}, "http://foo/health/live?q=1", http.StatusTeapot, ""},
+		{"443", &RedirectConfig{Except: []string{"/health"}}, "http://foo/bar", http.StatusMovedPermanently, "https://foo/bar"},
+	} {
+		site := &SiteConfig{
+			Addr:          Address{Host: "example.com", Port: test.port},
+			TLS:           new(caddytls.Config),
+			HTTPSRedirect: test.redirect,
+			middlewareChain: HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				w.WriteHeader(http.StatusTeapot)
+				return 0, nil
+			}),
+		}
+		handler := redirPlaintextHost(site).middleware[0](nil)
+
+		rec := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if _, err := handler.ServeHTTP(rec, req); err != nil {
+			t.Errorf("Test %d: Expected returned error to be nil, but was %v", i, err)
+		}
+		if rec.Code != test.code {
+			t.Errorf("Test %d: Expected status %d but got %d", i, test.code, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != test.location {
+			t.Errorf("Test %d: Expected Location: '%s' but got '%s'", i, test.location, got)
+		}
+	}
+}
+
 func TestHostHasOtherPort(t *testing.T) {
 	configs := []*SiteConfig{
 		{Addr: Address{Host: "example.com", Port: "80"}},
@@ -114,6 +165,9 @@ func TestMakePlaintextRedirects(t *testing.T) {
 		// Can redirect from 80 to either 443 or 5001, but choose 443
 		{Addr: Address{Host: "sub3.example.com", Port: "443"}, TLS: &caddytls.Config{Managed: true}},
 		{Addr: Address{Host: "sub3.example.com", Port: "5001", Scheme: "https"}, TLS: &caddytls.Config{Managed: true}},
+
+		// Redirect turned off for this site
+		{Addr: Address{Host: "sub4.example.com"}, TLS: &caddytls.Config{Managed: true}, HTTPSRedirect: &RedirectConfig{Disabled: true}},
 	}
 
 	result := makePlaintextRedirects(configs)
@@ -0,0 +1,278 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// options are the global options of the HTTP server type, which
+// are given in a block without addresses at the top of the Caddyfile.
+type options struct {
+	// mergeDuplicateBlocks is true if server blocks with the
+	// same addresses are to be merged, instead of being an error
+	mergeDuplicateBlocks bool
+
+	// egress is how the outbound requests of Caddy are made
+	egress caddy.Egress
+
+	// memory is the configuration of the resource governor,
+	// and certCacheTarget how many on-demand certificates it
+	// keeps in the cache while memory is short
+	memory          caddy.MemoryLimit
+	certCacheTarget int
+}
+
+// globalOptions returns serverBlocks without the block of global
+// options, if there is one, and the options that it sets.
+func globalOptions(serverBlocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, options, error) {
+	var opts options
+	if len(serverBlocks) == 0 || len(serverBlocks[0].Keys) > 0 {
+		return serverBlocks, opts, nil
+	}
+	for name, tokens := range serverBlocks[0].Tokens {
+		d := caddyfile.NewDispenserTokens(serverBlocks[0].File, tokens)
+		switch name {
+		case "merge_duplicate_blocks":
+			for d.Next() {
+				if d.NextArg() {
+					return serverBlocks, opts, d.ArgErr()
+				}
+			}
+			opts.mergeDuplicateBlocks = true
+		case "egress":
+			egress, err := parseEgress(&d)
+			if err != nil {
+				return serverBlocks, opts, err
+			}
+			opts.egress = egress
+		case "memory_soft_limit":
+			if err := parseMemoryLimit(&d, &opts); err != nil {
+				return serverBlocks, opts, err
+			}
+		default:
+			d.Next()
+			return serverBlocks, opts, d.Errf("Unknown global option '%s'", name)
+		}
+	}
+	return serverBlocks[1:], opts, nil
+}
+
+// parseEgress parses the egress global option:
+//
+//	egress {
+//	    proxy          url
+//	    bind_interface name
+//	    resolvers      address...
+//	    timeout        duration
+//	}
+func parseEgress(d *caddyfile.Dispenser) (caddy.Egress, error) {
+	var egress caddy.Egress
+	for d.Next() {
+		if len(d.RemainingArgs()) > 0 {
+			return egress, d.ArgErr()
+		}
+		for d.NextBlock() {
+			switch d.Val() {
+			case "proxy":
+				if !d.NextArg() {
+					return egress, d.ArgErr()
+				}
+				u, err := url.Parse(d.Val())
+				if err != nil {
+					return egress, d.Errf("egress proxy: %v", err)
+				}
+				egress.Proxy = u
+			case "bind_interface":
+				if !d.NextArg() {
+					return egress, d.ArgErr()
+				}
+				egress.BindInterface = d.Val()
+			case "resolvers":
+				resolvers := d.RemainingArgs()
+				if len(resolvers) == 0 {
+					return egress, d.ArgErr()
+				}
+				for _, resolver := range resolvers {
+					if _, _, err := net.SplitHostPort(resolver); err != nil {
+						resolver = net.JoinHostPort(resolver, "53")
+					}
+					egress.Resolvers = append(egress.Resolvers, resolver)
+				}
+			case "timeout":
+				if !d.NextArg() {
+					return egress, d.ArgErr()
+				}
+				timeout, err := time.ParseDuration(d.Val())
+				if err != nil {
+					return egress, d.Errf("egress timeout: %v", err)
+				}
+				egress.Timeout = timeout
+			default:
+				return egress, d.Errf("Unknown egress option '%s'", d.Val())
+			}
+			if d.NextArg() {
+				return egress, d.ArgErr()
+			}
+		}
+	}
+	if err := egress.Check(); err != nil {
+		return egress, d.Err(err.Error())
+	}
+	return egress, nil
+}
+
+// parseMemoryLimit parses the memory_soft_limit global option
+// into opts. Each memory action can be turned off or on, and the
+// certificate_cache action can be given its target instead:
+//
+//	memory_soft_limit size {
+//	    check_interval    duration
+//	    certificate_cache on|off|target
+//	    action            on|off
+//	}
+func parseMemoryLimit(d *caddyfile.Dispenser, opts *options) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		limit, err := parseSize(d.Val())
+		if err != nil || limit == 0 {
+			return d.Errf("memory_soft_limit: invalid size '%s'", d.Val())
+		}
+		opts.memory.SoftLimit = uint64(limit)
+		if len(d.RemainingArgs()) > 0 {
+			return d.ArgErr()
+		}
+		for d.NextBlock() {
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch arg := d.Val(); {
+			case name == "check_interval":
+				interval, err := time.ParseDuration(arg)
+				if err != nil || interval <= 0 {
+					return d.Errf("memory_soft_limit: invalid check_interval '%s'", arg)
+				}
+				opts.memory.Interval = interval
+			case arg == "off":
+				opts.memory.Disabled = append(opts.memory.Disabled, name)
+			case arg == "on":
+			case name == "certificate_cache":
+				target, err := strconv.Atoi(arg)
+				if err != nil || target < 0 {
+					return d.Errf("memory_soft_limit: invalid certificate_cache target '%s'", arg)
+				}
+				opts.certCacheTarget = target
+			default:
+				return d.Errf("memory_soft_limit: %s must be on or off", name)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if name != "check_interval" {
+				if err := caddy.CheckMemoryLimit(caddy.MemoryLimit{Disabled: []string{name}}); err != nil {
+					return d.Err(err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes, which may end in
+// kb, mb or gb for multiples of 1024, 1024² or 1024³ bytes.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	lower := strings.ToLower(s)
+	for suffix, m := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(lower, suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * multiplier, nil
+}
+
+// siteKey returns what identifies the site at addr when looking
+// for duplicates: its socket, or its host, port and path, since a
+// scheme only follows from the port.
+func siteKey(addr Address) string {
+	if addr.IsUnixSocket() {
+		return addr.String()
+	}
+	return addr.Host + ":" + addr.Port + addr.Path
+}
+
+// singletons are the directives that set what a site can have only
+// one of, each with a function that returns what its tokens set it
+// to, if they do. Server blocks can be merged only if they set these
+// to the same value or leave them unset.
+var singletons = map[string]func(tokens []caddyfile.Token) (setting, value string, ok bool){
+	"root": func(tokens []caddyfile.Token) (string, string, bool) {
+		return "root", tokenText(tokens[1:]), true
+	},
+	"tls": func(tokens []caddyfile.Token) (string, string, bool) {
+		for i := 0; i < len(tokens)-1; i++ {
+			if tokens[i].Text == "key_type" {
+				return "tls key_type", tokens[i+1].Text, true
+			}
+		}
+		return "tls key_type", "", false
+	},
+}
+
+// mergeServerBlock appends the tokens of sb, which has the same
+// addresses, to into. The lines of each directive of sb come after
+// those of into, and the directives are executed in their usual
+// order. It is an error if the blocks set a singleton differently.
+func mergeServerBlock(into *caddyfile.ServerBlock, sb caddyfile.ServerBlock, sourceFile string) error {
+	for dir, tokens := range sb.Tokens {
+		earlier, ok := into.Tokens[dir]
+		if !ok {
+			into.Tokens[dir] = tokens
+			continue
+		}
+		if singleton, ok := singletons[dir]; ok {
+			setting, earlierValue, earlierOK := singleton(earlier)
+			_, value, valueOK := singleton(tokens)
+			if earlierOK && valueOK && earlierValue != value {
+				return fmt.Errorf("conflicting %s of %s: '%s' at %s and '%s' at %s, which cannot be merged",
+					setting, strings.Join(into.Keys, ", "), earlierValue, tokenPosition(earlier[0], sourceFile),
+					value, tokenPosition(tokens[0], sourceFile))
+			}
+		}
+		into.Tokens[dir] = append(earlier, tokens...)
+	}
+	return nil
+}
+
+// tokenText returns the text of tokens, separated by spaces.
+func tokenText(tokens []caddyfile.Token) string {
+	texts := make([]string, len(tokens))
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+	return strings.Join(texts, " ")
+}
+
+// tokenPosition returns the file and line of token, which is
+// in sourceFile if it was not imported from another file.
+func tokenPosition(token caddyfile.Token, sourceFile string) string {
+	file := token.File
+	if file == "" {
+		file = sourceFile
+	}
+	return fmt.Sprintf("%s:%d", file, token.Line)
+}
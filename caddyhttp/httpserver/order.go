@@ -0,0 +1,238 @@
+package httpserver
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Position is where RegisterDirectiveOrder puts a directive.
+type Position int
+
+const (
+	// Before puts the directive right before another one.
+	Before Position = iota
+	// After puts the directive right after another one.
+	After
+	// First puts the directive before all others.
+	First
+	// Last puts the directive after all others.
+	Last
+)
+
+func (p Position) String() string {
+	switch p {
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case First:
+		return "first"
+	case Last:
+		return "last"
+	}
+	return fmt.Sprintf("Position(%d)", int(p))
+}
+
+// directiveOrder is where a registered directive goes.
+type directiveOrder struct {
+	name       string
+	position   Position
+	relativeTo string
+	registrant string // the package that registered the directive
+}
+
+var (
+	// orderedDirectives are the directives registered with
+	// RegisterDirectiveOrder, by name, and resolvedDirectives
+	// is the order of all directives that they resolve to,
+	// once it is asked for.
+	orderedDirectives   = make(map[string]directiveOrder)
+	resolvedDirectives  []string
+	orderedDirectivesMu sync.Mutex
+)
+
+// RegisterDirectiveOrder adds the directive name to the directives
+// of the http server type, at position relative to the directive
+// relativeTo, which must be one of the standard directives or one
+// that is registered, too, by this or another plugin; it does not
+// matter which is registered first. relativeTo must be empty for
+// First and Last. Plugins whose directives are not in the standard
+// list call this from their init() function, next to
+// caddy.RegisterPlugin.
+//
+// Directives that are put at the same position relative to the same
+// directive are ordered by name, so the resulting order does not
+// depend on the order in which plugins are initialized. It panics if
+// name is already known or cannot be put where it is asked to be,
+// and, when the directives are first asked for, if relativeTo is
+// not known by then.
+func RegisterDirectiveOrder(name string, position Position, relativeTo string) {
+	err := registerDirectiveOrder(name, position, relativeTo, callerPackage())
+	if err != nil {
+		panic(err)
+	}
+}
+
+func registerDirectiveOrder(name string, position Position, relativeTo, registrant string) error {
+	orderedDirectivesMu.Lock()
+	defer orderedDirectivesMu.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("%s: directive must have a name", registrant)
+	}
+	if isStandardDirective(name) {
+		return fmt.Errorf("%s: directive %s is a standard directive and already ordered", registrant, name)
+	}
+	if other, dup := orderedDirectives[name]; dup {
+		return fmt.Errorf("%s: directive %s is already registered by %s", registrant, name, other.registrant)
+	}
+
+	switch position {
+	case First, Last:
+		if relativeTo != "" {
+			return fmt.Errorf("%s: directive %s goes %s, so it cannot be relative to %s", registrant, name, position, relativeTo)
+		}
+	case Before, After:
+		if relativeTo == name {
+			return fmt.Errorf("%s: directive %s cannot be ordered relative to itself", registrant, name)
+		}
+		if relativeTo == "" {
+			return fmt.Errorf("%s: directive %s goes %s, so it must be relative to a directive", registrant, name, position)
+		}
+	default:
+		return fmt.Errorf("%s: directive %s has invalid position %s", registrant, name, position)
+	}
+
+	orderedDirectives[name] = directiveOrder{
+		name:       name,
+		position:   position,
+		relativeTo: relativeTo,
+		registrant: registrant,
+	}
+	resolvedDirectives = nil
+	return nil
+}
+
+// isStandardDirective returns true if name is in the
+// hard-coded list of directives.
+func isStandardDirective(name string) bool {
+	for _, dir := range directives {
+		if dir == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allDirectives returns the standard directives with the
+// ones registered by RegisterDirectiveOrder in their places.
+// It panics if they cannot all be put in their places.
+func allDirectives() []string {
+	orderedDirectivesMu.Lock()
+	defer orderedDirectivesMu.Unlock()
+
+	if len(orderedDirectives) == 0 {
+		return directives
+	}
+	if resolvedDirectives == nil {
+		all, err := resolveDirectiveOrder()
+		if err != nil {
+			panic(err)
+		}
+		resolvedDirectives = all
+	}
+	return resolvedDirectives
+}
+
+// resolveDirectiveOrder puts the registered directives in their
+// places among the standard ones. The directives that are put
+// relative to the same directive are ordered by name. It returns
+// an error for the directives that are relative to a directive
+// that is not known, or relative to each other in a cycle, since
+// those do not end up in the order. It must be called with
+// orderedDirectivesMu held.
+func resolveDirectiveOrder() ([]string, error) {
+	// group the registered directives by what they are
+	// relative to, each group sorted by name
+	type anchor struct {
+		position   Position
+		relativeTo string
+	}
+	anchored := make(map[anchor][]string)
+	for _, order := range orderedDirectives {
+		a := anchor{order.position, order.relativeTo}
+		anchored[a] = append(anchored[a], order.name)
+	}
+	for _, names := range anchored {
+		sort.Strings(names)
+	}
+
+	var all []string
+	added := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		for _, before := range anchored[anchor{Before, name}] {
+			add(before)
+		}
+		all = append(all, name)
+		added[name] = true
+		for _, after := range anchored[anchor{After, name}] {
+			add(after)
+		}
+	}
+	for _, name := range anchored[anchor{First, ""}] {
+		add(name)
+	}
+	for _, name := range directives {
+		add(name)
+	}
+	for _, name := range anchored[anchor{Last, ""}] {
+		add(name)
+	}
+
+	// the ones that are left are not reachable from
+	// the standard directives
+	var left []string
+	for name := range orderedDirectives {
+		if !added[name] {
+			left = append(left, name)
+		}
+	}
+	if len(left) == 0 {
+		return all, nil
+	}
+	sort.Strings(left)
+	for _, name := range left {
+		order := orderedDirectives[name]
+		if _, ok := orderedDirectives[order.relativeTo]; !ok {
+			return nil, fmt.Errorf("%s: directive %s is to go %s unknown directive '%s'",
+				order.registrant, order.name, order.position, order.relativeTo)
+		}
+	}
+	order := orderedDirectives[left[0]]
+	return nil, fmt.Errorf("%s: directives are ordered relative to each other in a cycle: %s",
+		order.registrant, strings.Join(left, ", "))
+}
+
+// callerPackage returns the import path of the package
+// that called the function which called callerPackage.
+func callerPackage() string {
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown package"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "unknown package"
+	}
+	// function names look like "github.com/user/plugin.init.1"
+	name := fn.Name()
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		name = name[:slash+1+dot]
+	}
+	return name
+}
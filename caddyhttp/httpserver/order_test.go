@@ -0,0 +1,145 @@
+package httpserver
+
+import (
+	"strings"
+	"testing"
+)
+
+// withOrderedDirectives runs f with no directives
+// registered other than the ones f registers.
+func withOrderedDirectives(f func()) {
+	orderedDirectivesMu.Lock()
+	old, oldResolved := orderedDirectives, resolvedDirectives
+	orderedDirectives, resolvedDirectives = make(map[string]directiveOrder), nil
+	orderedDirectivesMu.Unlock()
+	defer func() {
+		orderedDirectivesMu.Lock()
+		orderedDirectives, resolvedDirectives = old, oldResolved
+		orderedDirectivesMu.Unlock()
+	}()
+	f()
+}
+
+// indexOf returns the index of name in list, or -1.
+func indexOf(list []string, name string) int {
+	for i, s := range list {
+		if s == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRegisterDirectiveOrder(t *testing.T) {
+	withOrderedDirectives(func() {
+		for i, reg := range []struct {
+			name       string
+			position   Position
+			relativeTo string
+		}{
+			// registered out of order on purpose; the result
+			// must not depend on the order of registration,
+			// even of a directive and the one it is next to
+			{"zfirst", First, ""},
+			{"afirst", First, ""},
+			{"zbeforegzip", Before, "gzip"},
+			{"abeforegzip", Before, "gzip"},
+			{"afterafter", After, "aftergzip"},
+			{"beforeafter", Before, "aftergzip"},
+			{"aftergzip", After, "gzip"},
+			{"zlast", Last, ""},
+			{"alast", Last, ""},
+		} {
+			if err := registerDirectiveOrder(reg.name, reg.position, reg.relativeTo, "test"); err != nil {
+				t.Fatalf("Registration %d: Expected no error, got: %v", i, err)
+			}
+		}
+
+		all := allDirectives()
+		if len(all) != len(directives)+9 {
+			t.Fatalf("Expected %d directives, got %d: %v", len(directives)+9, len(all), all)
+		}
+		if all[0] != "afirst" || all[1] != "zfirst" || all[2] != directives[0] {
+			t.Errorf("Expected afirst, zfirst, %s at the start, got %v", directives[0], all[:3])
+		}
+		if n := len(all); all[n-2] != "alast" || all[n-1] != "zlast" {
+			t.Errorf("Expected alast, zlast at the end, got %v", all[n-2:])
+		}
+		gzip := indexOf(all, "gzip")
+		expected := []string{"abeforegzip", "zbeforegzip", "gzip", "beforeafter", "aftergzip", "afterafter"}
+		if got := all[gzip-2 : gzip+4]; strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected %v around gzip, got %v", expected, got)
+		}
+		for _, dir := range directives {
+			if indexOf(all, dir) < 0 {
+				t.Errorf("Expected standard directive %s to stay in the list", dir)
+			}
+		}
+	})
+}
+
+func TestRegisterDirectiveOrderErrors(t *testing.T) {
+	withOrderedDirectives(func() {
+		if err := registerDirectiveOrder("myplugin", After, "gzip", "example.com/first"); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		for i, test := range []struct {
+			name       string
+			position   Position
+			relativeTo string
+			expected   string
+		}{
+			{"myplugin", Before, "proxy", "example.com/second: directive myplugin is already registered by example.com/first"},
+			{"gzip", Before, "proxy", "standard directive"},
+			{"", Before, "proxy", "must have a name"},
+			{"other", Before, "", "must be relative to a directive"},
+			{"other", After, "other", "relative to itself"},
+			{"other", First, "gzip", "cannot be relative to gzip"},
+			{"other", Position(42), "gzip", "invalid position"},
+		} {
+			err := registerDirectiveOrder(test.name, test.position, test.relativeTo, "example.com/second")
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("Test %d: Expected error containing '%s', got: %v", i, test.expected, err)
+			}
+		}
+		if all := allDirectives(); len(all) != len(directives)+1 {
+			t.Errorf("Expected failed registrations to leave the order alone, got %d directives", len(all))
+		}
+	})
+
+	for i, test := range []struct {
+		regs     [][2]string // names and what they go after
+		expected string
+	}{
+		{[][2]string{{"other", "nonexistent"}}, "example.com/second: directive other is to go after unknown directive 'nonexistent'"},
+		{[][2]string{{"a", "b"}, {"b", "nonexistent"}}, "directive b is to go after unknown directive 'nonexistent'"},
+		{[][2]string{{"a", "b"}, {"b", "a"}}, "in a cycle: a, b"},
+	} {
+		withOrderedDirectives(func() {
+			for _, reg := range test.regs {
+				if err := registerDirectiveOrder(reg[0], After, reg[1], "example.com/second"); err != nil {
+					t.Fatalf("Test %d: Expected no error registering, got: %v", i, err)
+				}
+			}
+			if _, err := resolveDirectiveOrder(); err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("Test %d: Expected error containing '%s', got: %v", i, test.expected, err)
+			}
+		})
+	}
+}
+
+func TestRegisterDirectiveOrderPanics(t *testing.T) {
+	withOrderedDirectives(func() {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				t.Fatal("Expected a panic")
+			}
+			if err, ok := rec.(error); !ok || !strings.Contains(err.Error(), "github.com/mholt/caddy/caddyhttp/httpserver:") {
+				t.Errorf("Expected error naming this package, got: %v", rec)
+			}
+		}()
+		RegisterDirectiveOrder("bogus", Before, "nonexistent")
+		allDirectives()
+	})
+}
@@ -0,0 +1,315 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Passthrough is where TLS connections for a server
+// name are spliced to without being terminated.
+type Passthrough struct {
+	// Address is the host:port to splice to
+	Address string
+
+	// IdleTimeout is how long the spliced connection
+	// may go without data in either direction before
+	// it is closed; 0 means DefaultPassthroughIdleTimeout
+	IdleTimeout time.Duration
+}
+
+const (
+	// DefaultPassthroughIdleTimeout is how long a spliced
+	// connection may be idle if its Passthrough does not say.
+	DefaultPassthroughIdleTimeout = 5 * time.Minute
+
+	// clientHelloTimeout is how long a client has to send
+	// its ClientHello before its connection is closed.
+	clientHelloTimeout = 10 * time.Second
+
+	// passthroughDialTimeout is how long to wait for the
+	// connection to the passthrough address.
+	passthroughDialTimeout = 10 * time.Second
+
+	// maxClientHelloSize bounds how much is read to find
+	// the end of a ClientHello.
+	maxClientHelloSize = 64 * 1024
+)
+
+// passthroughListener reads the ClientHello of each connection
+// it accepts in the background. Connections whose server name
+// is in routes are spliced to the route's address; all others,
+// including connections without a server name or that are not
+// TLS at all, are returned by Accept with the bytes that were
+// read put back in front.
+type passthroughListener struct {
+	net.Listener
+	routes map[string]Passthrough
+	conns  chan net.Conn
+	errs   chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newPassthroughListener wraps ln, passing the connections for
+// the server names in routes through.
+func newPassthroughListener(ln net.Listener, routes map[string]Passthrough) *passthroughListener {
+	l := &passthroughListener{
+		Listener: ln,
+		routes:   routes,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections until the listener fails,
+// so that reading one ClientHello does not hold up the rest.
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// Accept returns the next connection that is not passed through.
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+// Close closes the listener.
+func (l *passthroughListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// route passes conn through if its server name is in l.routes,
+// and hands it to Accept otherwise.
+func (l *passthroughListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && len(hello) == 0 {
+		conn.Close()
+		return
+	}
+
+	if route, ok := l.routes[strings.ToLower(serverName(hello))]; ok {
+		splice(conn, hello, route)
+		return
+	}
+
+	conn = &prefixedConn{Conn: conn, prefix: bytes.NewReader(hello)}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// splice copies between conn, whose first bytes were hello, and
+// a new connection to the address of route until either side is
+// done or the connection has been idle for too long.
+func splice(conn net.Conn, hello []byte, route Passthrough) {
+	defer conn.Close()
+	backend, err := net.DialTimeout("tcp", route.Address, passthroughDialTimeout)
+	if err != nil {
+		log.Printf("[ERROR] Passing TLS connection from %s through to %s: %v", conn.RemoteAddr(), route.Address, err)
+		return
+	}
+	defer backend.Close()
+
+	idle := route.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultPassthroughIdleTimeout
+	}
+	client := &idleConn{Conn: conn, timeout: idle}
+	server := &idleConn{Conn: backend, timeout: idle}
+	if _, err := server.Write(hello); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, server)
+		done <- struct{}{}
+	}()
+	<-done // the deferred closes end the other copy
+}
+
+// idleConn is a net.Conn whose reads and writes fail once
+// it has been idle for longer than timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// prefixedConn is a net.Conn whose first bytes
+// are read from prefix instead of the network.
+type prefixedConn struct {
+	net.Conn
+	prefix *bytes.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if c.prefix.Len() > 0 {
+		return c.prefix.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// readClientHello reads the TLS records from r that hold the
+// first handshake message, which is the ClientHello if r is a
+// TLS client. It returns what it read, even if that is not a
+// ClientHello or an error happened, so it can be replayed.
+func readClientHello(r io.Reader) ([]byte, error) {
+	var buf []byte
+	var handshake []byte
+	for len(buf) < maxClientHelloSize {
+		header := make([]byte, 5)
+		n, err := io.ReadFull(r, header)
+		buf = append(buf, header[:n]...)
+		if err != nil {
+			return buf, err
+		}
+		if header[0] != 0x16 { // not a handshake record
+			return buf, nil
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		record := make([]byte, length)
+		n, err = io.ReadFull(r, record)
+		buf = append(buf, record[:n]...)
+		if err != nil {
+			return buf, err
+		}
+		handshake = append(handshake, record...)
+		if len(handshake) >= 4 {
+			msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+msgLen {
+				return buf, nil
+			}
+		}
+	}
+	return buf, nil
+}
+
+// serverName returns the server name in the ClientHello that is
+// held by the TLS records in data, or "" if there is none.
+func serverName(data []byte) string {
+	// reassemble the handshake message from the records
+	var msg []byte
+	for len(data) >= 5 && data[0] == 0x16 {
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			return ""
+		}
+		msg = append(msg, data[5:5+length]...)
+		data = data[5+length:]
+	}
+	if len(msg) < 4 || msg[0] != 0x01 { // not a ClientHello
+		return ""
+	}
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+msgLen {
+		return ""
+	}
+	p := &helloParser{b: msg[4 : 4+msgLen]}
+
+	p.skip(2 + 32)     // version and random
+	p.skip(p.uint8())  // session ID
+	p.skip(p.uint16()) // cipher suites
+	p.skip(p.uint8())  // compression methods
+	extensions := &helloParser{b: p.bytes(p.uint16())}
+	for !p.failed && !extensions.failed && len(extensions.b) > 0 {
+		typ := extensions.uint16()
+		ext := &helloParser{b: extensions.bytes(extensions.uint16())}
+		if typ != 0 { // server_name
+			continue
+		}
+		names := &helloParser{b: ext.bytes(ext.uint16())}
+		for !ext.failed && !names.failed && len(names.b) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(names.uint16())
+			if !names.failed && nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// helloParser reads the fields of a ClientHello; once a read
+// goes past the end, failed is set and all reads return zero.
+type helloParser struct {
+	b      []byte
+	failed bool
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.failed || len(p.b) < n {
+		p.failed = true
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *helloParser) skip(n int) { p.bytes(n) }
+
+func (p *helloParser) uint8() int {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (p *helloParser) uint16() int {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
@@ -0,0 +1,196 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfig makes a config with a self-signed certificate for name.
+func testTLSConfig(t *testing.T, name string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serveTestTLS writes body to each connection on ln.
+func serveTestTLS(ln net.Listener, body string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.Write([]byte(body))
+			conn.Close()
+		}()
+	}
+}
+
+// testClientHello returns the ClientHello a client sends for serverName.
+func testClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	hello, err := readClientHello(server)
+	client.Close()
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func TestPassthroughListener(t *testing.T) {
+	target, err := tls.Listen("tcp", "127.0.0.1:0", testTLSConfig(t, "mail.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go serveTestTLS(target, "appliance")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newPassthroughListener(ln, map[string]Passthrough{
+		"mail.example.com": {Address: target.Addr().String()},
+	})
+	defer pl.Close()
+	go serveTestTLS(tls.NewListener(pl, testTLSConfig(t, "example.com")), "caddy")
+
+	for i, test := range []struct {
+		serverName   string
+		expectedCert string
+		expectedBody string
+	}{
+		{"mail.example.com", "mail.example.com", "appliance"},
+		{"MAIL.Example.com", "mail.example.com", "appliance"},
+		{"www.example.com", "example.com", "caddy"},
+		{"", "example.com", "caddy"}, // no SNI
+	} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: test.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(conn)
+		cert := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		if cert.Subject.CommonName != test.expectedCert {
+			t.Errorf("Test %d: Expected certificate of %s, got %s", i, test.expectedCert, cert.Subject.CommonName)
+		}
+		if string(body) != test.expectedBody {
+			t.Errorf("Test %d: Expected to be served by %s, got '%s'", i, test.expectedBody, body)
+		}
+	}
+}
+
+func TestPassthroughListenerNotTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newPassthroughListener(ln, map[string]Passthrough{"mail.example.com": {Address: "127.0.0.1:1"}})
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, 16)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("Expected plaintext bytes to be replayed, got '%s' (%v)", got, err)
+	}
+}
+
+func TestPassthroughIdleTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // accept, but never answer
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newPassthroughListener(ln, map[string]Passthrough{
+		"mail.example.com": {Address: target.Addr().String(), IdleTimeout: 50 * time.Millisecond},
+	})
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(testClientHello(t, "mail.example.com"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = client.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("Expected idle connection to be closed, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected connection to be closed after the idle timeout, took %v", elapsed)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	hello := testClientHello(t, "mail.example.com")
+	if got := serverName(hello); got != "mail.example.com" {
+		t.Errorf("Expected server name mail.example.com, got '%s'", got)
+	}
+	if got := serverName(testClientHello(t, "")); got != "" {
+		t.Errorf("Expected no server name, got '%s'", got)
+	}
+
+	// a ClientHello that is cut short has no server name
+	for i := 0; i < len(hello); i++ {
+		if got := serverName(hello[:i]); got != "" {
+			t.Errorf("Expected no server name in first %d bytes, got '%s'", i, got)
+		}
+	}
+	if got := serverName([]byte("GET / HTTP/1.1\r\n")); got != "" {
+		t.Errorf("Expected no server name in plaintext, got '%s'", got)
+	}
+}
@@ -0,0 +1,25 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the process ID, user ID, and
+// group ID of the process on the other end of c.
+func peerCredentials(c *net.UnixConn) string {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return "unix"
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return "unix"
+	}
+	return fmt.Sprintf("pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid)
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package httpserver
+
+import "net"
+
+// peerCredentials returns a generic description of the peer,
+// since credentials are not retrieved on this platform.
+func peerCredentials(c *net.UnixConn) string {
+	return "unix"
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,7 +26,8 @@ func init() {
 	flag.BoolVar(&QUIC, "quic", false, "Use experimental QUIC")
 
 	caddy.RegisterServerType(serverType, caddy.ServerType{
-		Directives: directives,
+		Directives:        directives,
+		OrderedDirectives: allDirectives,
 		DefaultInput: func() caddy.Input {
 			if Port == DefaultPort && Host != "" {
 				// by leaving the port blank in this case we give auto HTTPS
@@ -60,6 +62,23 @@ type httpContext struct {
 
 	// siteConfigs is the master list of all site configs.
 	siteConfigs []*SiteConfig
+
+	// validating is true if the servers will not be started
+	validating bool
+}
+
+// SetValidating marks h as being used only to validate
+// the configuration; see caddy.ValidatingContext.
+func (h *httpContext) SetValidating() {
+	h.validating = true
+}
+
+// SetDirective implements caddy.DirectiveContext, so that the
+// middleware a directive adds to a site is named after it.
+func (h *httpContext) SetDirective(key, directive string) {
+	if cfg, ok := h.keysToSiteConfigs[key]; ok {
+		cfg.directive = directive
+	}
 }
 
 func (h *httpContext) saveConfig(key string, cfg *SiteConfig) {
@@ -71,13 +90,34 @@ func (h *httpContext) saveConfig(key string, cfg *SiteConfig) {
 // executing directives and otherwise prepares the directives to
 // be parsed and executed.
 func (h *httpContext) InspectServerBlocks(sourceFile string, serverBlocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, error) {
-	// For each address in each server block, make a new config
+	serverBlocks, options, err := globalOptions(serverBlocks)
+	if err != nil {
+		return serverBlocks, err
+	}
+	if !h.validating {
+		// before the directives, which may make requests
+		if err := caddy.SetEgress(options.egress); err != nil {
+			return serverBlocks, err
+		}
+		caddytls.SetOnDemandCacheTarget(options.certCacheTarget)
+		if err := caddy.SetMemoryLimit(options.memory); err != nil {
+			return serverBlocks, err
+		}
+	}
+
+	// A site address may be defined by only one server block,
+	// unless blocks with the same addresses are to be merged
+	sites := make(map[string]int) // site address to index in blocks
+	var blocks []caddyfile.ServerBlock
 	for _, sb := range serverBlocks {
+		var keys, dupKeys []string
+		var addrs []Address
+		var dupOf []int // the earlier block of each of dupKeys
 		for _, key := range sb.Keys {
-			key = strings.ToLower(key)
-			if _, dup := h.keysToSiteConfigs[key]; dup {
-				return serverBlocks, fmt.Errorf("duplicate site address: %s", key)
+			if !strings.HasPrefix(key, unixAddrPrefix) {
+				key = strings.ToLower(key) // socket paths are case-sensitive
 			}
+			keys = append(keys, key)
 			addr, err := standardizeAddress(key)
 			if err != nil {
 				return serverBlocks, err
@@ -85,22 +125,94 @@ func (h *httpContext) InspectServerBlocks(sourceFile string, serverBlocks []cadd
 
 			// Fill in address components from command line so that middleware
 			// have access to the correct information during setup
-			if addr.Host == "" && Host != DefaultHost {
-				addr.Host = Host
+			if !addr.IsUnixSocket() {
+				if addr.Host == "" && Host != DefaultHost {
+					addr.Host = Host
+				}
+				if addr.Port == "" && Port != DefaultPort {
+					addr.Port = Port
+				}
 			}
-			if addr.Port == "" && Port != DefaultPort {
-				addr.Port = Port
+
+			addrs = append(addrs, addr)
+			if j, dup := sites[siteKey(addr)]; dup {
+				dupKeys, dupOf = append(dupKeys, key), append(dupOf, j)
 			}
+		}
+
+		if len(dupKeys) > 0 {
+			earlier := blocks[dupOf[0]]
+			if !options.mergeDuplicateBlocks {
+				return serverBlocks, fmt.Errorf("duplicate site address: %s (defined at %s:%d and at %s:%d)",
+					dupKeys[0], earlier.File, earlier.Line, sb.File, sb.Line)
+			}
+			sameAddrs := len(dupKeys) == len(keys) && len(earlier.Keys) == len(addrs)
+			for _, j := range dupOf {
+				sameAddrs = sameAddrs && j == dupOf[0]
+			}
+			if !sameAddrs {
+				return serverBlocks, fmt.Errorf("duplicate site address: %s (defined at %s:%d and at %s:%d, "+
+					"which cannot be merged because they do not have the same addresses)",
+					dupKeys[0], earlier.File, earlier.Line, sb.File, sb.Line)
+			}
+			if err := mergeServerBlock(&blocks[dupOf[0]], sb, sourceFile); err != nil {
+				return serverBlocks, err
+			}
+			continue
+		}
+
+		for i, key := range keys {
+			if _, dup := sites[siteKey(addrs[i])]; dup {
+				return serverBlocks, fmt.Errorf("duplicate site address: %s (defined twice at %s:%d)",
+					key, sb.File, sb.Line)
+			}
+			sites[siteKey(addrs[i])] = len(blocks)
 
 			// Save the config to our master list, and key it for lookups
 			cfg := &SiteConfig{
-				Addr:        addr,
+				Addr:        addrs[i],
 				Root:        Root,
-				TLS:         &caddytls.Config{Hostname: addr.Host},
+				TLS:         &caddytls.Config{Hostname: addrs[i].Host},
 				HiddenFiles: []string{sourceFile},
 			}
 			h.saveConfig(key, cfg)
 		}
+		blocks = append(blocks, sb)
+	}
+	serverBlocks = blocks
+
+	// A path-scoped site gets its certificate and TLS settings
+	// from the site of its host, if there is one, so then it
+	// cannot have its own
+	hostSites := make(map[*SiteConfig]*SiteConfig)
+	for _, cfg := range h.siteConfigs {
+		if !isPathScoped(cfg.Addr) {
+			continue
+		}
+		for _, host := range h.siteConfigs {
+			if !isPathScoped(host.Addr) && !host.Addr.IsUnixSocket() &&
+				host.Addr.Host == cfg.Addr.Host && host.Addr.Port == cfg.Addr.Port {
+				hostSites[cfg] = host
+				break
+			}
+		}
+	}
+	for _, sb := range serverBlocks {
+		if _, ok := sb.Tokens["tls"]; !ok {
+			continue
+		}
+		for _, key := range sb.Keys {
+			if !strings.HasPrefix(key, unixAddrPrefix) {
+				key = strings.ToLower(key)
+			}
+			if host, ok := hostSites[h.keysToSiteConfigs[key]]; ok {
+				return serverBlocks, fmt.Errorf("%s:%d: path-scoped site %s cannot have tls; "+
+					"its TLS settings are those of the site %s", sb.File, sb.Line, key, host.Addr)
+			}
+		}
+	}
+	for cfg, host := range hostSites {
+		cfg.TLS = host.TLS
 	}
 
 	// For sites that have gzip (which gets chained in
@@ -127,6 +239,10 @@ func (h *httpContext) MakeServers() ([]caddy.Server, error) {
 		if !cfg.TLS.Enabled {
 			continue
 		}
+		if cfg.Addr.IsUnixSocket() {
+			// TLS is allowed on a socket, but there is no port to pick
+			continue
+		}
 		if cfg.Addr.Port == "80" || cfg.Addr.Scheme == "http" {
 			cfg.TLS.Enabled = false
 			log.Printf("[WARNING] TLS disabled for %s", cfg.Addr)
@@ -165,6 +281,47 @@ func (h *httpContext) MakeServers() ([]caddy.Server, error) {
 	return servers, nil
 }
 
+// serverExport describes a server for caddy.Export.
+type serverExport struct {
+	Listen string       `json:"listen"`
+	Sites  []siteExport `json:"sites"`
+}
+
+// siteExport describes a site for caddy.Export.
+type siteExport struct {
+	Address string           `json:"address"`
+	Root    string           `json:"root"`
+	TLS     caddytls.Summary `json:"tls"`
+}
+
+// ExportServers describes the servers made by MakeServers by
+// the address they listen on, in order, and the sites they serve.
+func (h *httpContext) ExportServers() interface{} {
+	groups, err := groupSiteConfigsByListenAddr(h.siteConfigs)
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for addr := range groups {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	servers := []serverExport{}
+	for _, addr := range addrs {
+		server := serverExport{Listen: addr}
+		for _, site := range groups[addr] {
+			server.Sites = append(server.Sites, siteExport{
+				Address: site.Addr.String(),
+				Root:    site.Root,
+				TLS:     site.TLS.Summary(),
+			})
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
 // GetConfig gets the SiteConfig that corresponds to c.
 // If none exist (should only happen in tests), then a
 // new, empty one will be created.
@@ -201,7 +358,10 @@ func shortCaddyfileLoader(serverType string) (caddy.Input, error) {
 // (bind) address, so sites that use the same listener can be served
 // on the same server instance. The return value maps the listen
 // address (what you pass into net.Listen) to the list of site configs.
-// This function does NOT vet the configs to ensure they are compatible.
+// A site that binds several hosts is in the group of each of them.
+// This function does NOT vet the configs to ensure they are compatible,
+// except that on each port, sites must either all listen on all
+// interfaces or all listen on specific addresses.
 func groupSiteConfigsByListenAddr(configs []*SiteConfig) (map[string][]*SiteConfig, error) {
 	groups := make(map[string][]*SiteConfig)
 
@@ -211,20 +371,77 @@ func groupSiteConfigsByListenAddr(configs []*SiteConfig) (map[string][]*SiteConf
 		// would prevent outsiders from even connecting; but that was problematic:
 		// https://forum.caddyserver.com/t/wildcard-virtual-domains-with-wildcard-roots/221/5?u=matt
 
+		// Unix sockets are keyed by their path; each one is its own listener
+		if conf.Addr.IsUnixSocket() {
+			addrstr := unixAddrPrefix + conf.Addr.Socket
+			groups[addrstr] = append(groups[addrstr], conf)
+			continue
+		}
+
 		if conf.Addr.Port == "" {
 			conf.Addr.Port = Port
 		}
-		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(conf.ListenHost, conf.Addr.Port))
-		if err != nil {
-			return nil, err
+		hosts := conf.ListenHosts
+		if len(hosts) == 0 {
+			hosts = []string{conf.ListenHost}
+		}
+		for _, host := range hosts {
+			addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, conf.Addr.Port))
+			if err != nil {
+				return nil, err
+			}
+			addrstr := addr.String()
+			if group := groups[addrstr]; len(group) > 0 && group[len(group)-1] == conf {
+				continue // two hosts of this site have the same address
+			}
+			groups[addrstr] = append(groups[addrstr], conf)
 		}
-		addrstr := addr.String()
-		groups[addrstr] = append(groups[addrstr], conf)
 	}
 
+	err := checkListenAddrConflicts(groups)
+	if err != nil {
+		return nil, err
+	}
 	return groups, nil
 }
 
+// checkListenAddrConflicts returns an error if a port that a
+// group listens on all interfaces of is listened on by another
+// group too, because the two listeners cannot both be bound.
+func checkListenAddrConflicts(groups map[string][]*SiteConfig) error {
+	var addrs []string
+	for addr := range groups {
+		if !strings.HasPrefix(addr, unixAddrPrefix) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+
+	byPort := make(map[string][]string)
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		byPort[port] = append(byPort[port], addr)
+	}
+	for _, addr := range addrs {
+		host, port, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); host != "" && !ip.IsUnspecified() {
+			continue
+		}
+		for _, other := range byPort[port] {
+			if other == addr {
+				continue
+			}
+			return fmt.Errorf("site %s listens on all interfaces (%s), so site %s cannot listen on %s; "+
+				"sites on port %s must either all bind specific addresses or none",
+				groups[addr][0].Addr, addr, groups[other][0].Addr, other, port)
+		}
+	}
+	return nil
+}
+
 // Address represents a site address. It contains
 // the original input value, and the component
 // parts of an address. The component parts may be
@@ -232,10 +449,23 @@ func groupSiteConfigsByListenAddr(configs []*SiteConfig) (map[string][]*SiteConf
 // but the original value should never be changed.
 type Address struct {
 	Original, Scheme, Host, Port, Path string
+
+	// Socket is the path of the Unix domain socket
+	// to listen on; only set if Scheme is "unix".
+	Socket string
+}
+
+// IsUnixSocket returns true if a is the address of
+// a Unix domain socket rather than a network host.
+func (a Address) IsUnixSocket() bool {
+	return a.Scheme == "unix"
 }
 
 // String returns a human-friendly print of the address.
 func (a Address) String() string {
+	if a.IsUnixSocket() {
+		return unixAddrPrefix + a.Socket
+	}
 	if a.Host == "" && a.Port == "" {
 		return ""
 	}
@@ -265,7 +495,12 @@ func (a Address) String() string {
 
 // VHost returns a sensible concatenation of Host:Port/Path from a.
 // It's basically the a.Original but without the scheme.
+// Sites on a Unix socket match any host, since the socket
+// itself identifies the site.
 func (a Address) VHost() string {
+	if a.IsUnixSocket() {
+		return ""
+	}
 	if idx := strings.Index(a.Original, "://"); idx > -1 {
 		return a.Original[idx+3:]
 	}
@@ -277,6 +512,15 @@ func (a Address) VHost() string {
 func standardizeAddress(str string) (Address, error) {
 	input := str
 
+	// Unix sockets have no host or port, only a file path
+	if strings.HasPrefix(str, unixAddrPrefix) {
+		socket := strings.TrimPrefix(strings.TrimPrefix(str, unixAddrPrefix), "//")
+		if socket == "" {
+			return Address{}, fmt.Errorf("[%s] missing socket path", input)
+		}
+		return Address{Original: input, Scheme: "unix", Socket: socket}, nil
+	}
+
 	// Split input into components (prepend with // to assert host by default)
 	if !strings.Contains(str, "//") && !strings.HasPrefix(str, "/") {
 		str = "//" + str
@@ -331,9 +575,24 @@ func standardizeAddress(str string) (Address, error) {
 // The ordering of this list is important.
 var directives = []string{
 	// primitive actions that set up the fundamental vitals of each config
+	"map", // its middleware must come before that of root, which can use its placeholders
 	"root",
+	"index",
+	"https_redirect", // must come before tls; HTTPS is activated after tls
+	"canonical_host", // must come before tls too
 	"tls",
 	"bind",
+	"default_server",
+	"unmatched_host",
+	"http2",
+	"grace_period",
+	"max_connections",
+	"max_connections_per_ip",
+	"passthrough",
+	"insecure_allow_ambiguous_requests",
+	"fallthrough",
+	"rebase_path",
+	"trace",
 
 	// services/utilities, or other directives that don't necessarily inject handlers
 	"startup",
@@ -342,17 +601,31 @@ var directives = []string{
 	"git",    // github.com/abiosoft/caddy-git
 
 	// directives that add middleware to the stack
+	"traffic",
+	"traffic_log",
+	"health",
 	"locale", // github.com/simia-tech/caddy-locale
+	"method", // before log, which records the overridden method
 	"log",
+	"geoip",
+	"maintenance",
+	"ban",
+	"clientcert_filter",
+	"signed_url",
 	"rewrite",
+	"try_files",
+	"query",
 	"ext",
 	"gzip",
 	"errors",
+	"deadline",
+	"replace",
 	"minify",    // github.com/hacdias/caddy-minify
 	"ipfilter",  // github.com/pyed/ipfilter
 	"ratelimit", // github.com/xuqingfeng/caddy-rate-limit
 	"search",    // github.com/pedronasser/caddy-search
 	"header",
+	"security_headers",
 	"redir",
 	"cors", // github.com/captncraig/cors/caddy
 	"mime",
@@ -361,8 +634,13 @@ var directives = []string{
 	"jsonp",  // github.com/pschlump/caddy-jsonp
 	"upload", // blitznote.com/src/caddy.upload
 	"internal",
+	"status",
+	"respond",
+	"metrics",
 	"pprof",
 	"expvar",
+	"connections",
+	"admin",
 	"proxy",
 	"fastcgi",
 	"websocket",
@@ -1,6 +1,8 @@
 package httpserver
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -51,6 +53,8 @@ func TestStandardizeAddress(t *testing.T) {
 		{`host:80/path`, "", "host", "80", "/path", false},
 		{`host:https/path`, "https", "host", "443", "/path", false},
 		{`/path`, "", "", "", "/path", false},
+		{`unix:/run/caddy.sock`, "unix", "", "", "", false},
+		{`unix:`, "", "", "", "", true},
 	} {
 		actual, err := standardizeAddress(test.input)
 
@@ -89,6 +93,7 @@ func TestAddressVHost(t *testing.T) {
 		{Address{Original: "host/foo"}, "host/foo"},
 		{Address{Original: "http://host/foo"}, "host/foo"},
 		{Address{Original: "https://host/foo"}, "host/foo"},
+		{Address{Original: "unix:/run/caddy.sock", Scheme: "unix", Socket: "/run/caddy.sock"}, ""},
 	} {
 		actual := test.addr.VHost()
 		if actual != test.expected {
@@ -111,6 +116,7 @@ func TestAddressString(t *testing.T) {
 		{Address{Scheme: "", Host: "host", Port: "80", Path: "/path"}, "http://host/path"},
 		{Address{Scheme: "http", Host: "", Port: "1234", Path: ""}, "http://:1234"},
 		{Address{Scheme: "", Host: "", Port: "", Path: ""}, ""},
+		{Address{Scheme: "unix", Socket: "/run/caddy.sock"}, "unix:/run/caddy.sock"},
 	} {
 		actual := test.addr.String()
 		if actual != test.expected {
@@ -137,3 +143,252 @@ func TestInspectServerBlocksWithCustomDefaultPort(t *testing.T) {
 		t.Errorf("Expected the port on the address to be set, but got: %#v", addr)
 	}
 }
+
+func TestInspectServerBlocksDuplicates(t *testing.T) {
+	const merge = "{\n\tmerge_duplicate_blocks\n}\n"
+	for i, test := range []struct {
+		input       string
+		shouldErr   bool
+		errContains []string
+		blocks      int
+	}{
+		{"a.com {\n}\nb.com {\n}", false, nil, 2},
+		{"a.com {\n}\n\nA.com {\n}", true, []string{"a.com", "Testfile:1", "Testfile:4"}, 0},
+		{"a.com:80 {\n}\nhttp://a.com {\n}", true, []string{"Testfile:1", "Testfile:3"}, 0},
+		{"a.com:80 {\n}\na.com:8080 {\n}", false, nil, 2},
+		{"a.com, a.com {\n}", true, []string{"defined twice at Testfile:1"}, 0},
+		{"{\n\tunknown_option\n}\na.com", true, []string{"unknown_option"}, 0},
+		{"{\n\tmerge_duplicate_blocks arg\n}\na.com", true, nil, 0},
+		{merge + "a.com {\n\tgzip\n}\na.com {\n\theader / X-A 1\n}\nb.com {\n}", false, nil, 2},
+		{merge + "a.com, b.com {\n}\nb.com, a.com {\n}", false, nil, 1},
+		{merge + "a.com, b.com {\n}\na.com {\n}", true, []string{"do not have the same addresses"}, 0},
+		{merge + "a.com {\n}\na.com, b.com {\n}", true, []string{"do not have the same addresses"}, 0},
+		{merge + "a.com {\n\troot /a\n}\na.com {\n\troot /a\n}", false, nil, 1},
+		{merge + "a.com {\n\troot /a\n}\na.com {\n\troot /b\n}", true, []string{"conflicting root", "Testfile:5", "Testfile:8"}, 0},
+		{merge + "a.com {\n\ttls {\n\t\tkey_type p256\n\t}\n}\na.com {\n\ttls {\n\t\tkey_type rsa2048\n\t}\n}",
+			true, []string{"conflicting tls key_type", "p256", "rsa2048"}, 0},
+		{merge + "a.com {\n\ttls {\n\t\tkey_type p256\n\t}\n}\na.com {\n\ttls {\n\t\tmust_staple\n\t}\n}", false, nil, 1},
+	} {
+		sblocks, err := caddyfile.Parse("Testfile", strings.NewReader(test.input), nil)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error setting up test, got: %v", i, err)
+		}
+		ctx := newContext().(*httpContext)
+		sblocks, err = ctx.InspectServerBlocks("Testfile", sblocks)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+				continue
+			}
+			for _, expected := range test.errContains {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Test %d: Expected error to contain '%s', got: %v", i, expected, err)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if len(sblocks) != test.blocks {
+			t.Errorf("Test %d: Expected %d server blocks, got %d", i, test.blocks, len(sblocks))
+		}
+	}
+}
+
+func TestGlobalOptionsEgress(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{"{\n\tegress {\n\t\tproxy http://proxy:3128\n\t\tresolvers 10.0.0.53 [::1]:5353 ::2\n\t\ttimeout 10s\n\t}\n}\na.com",
+			false, "http://proxy:3128 [10.0.0.53:53 [::1]:5353 [::2]:53] 10s"},
+		{"{\n\tegress {\n\t}\n}\na.com", false, "<nil> [] 0s"},
+		{"a.com", false, "<nil> [] 0s"},
+		{"{\n\tegress {\n\t\tproxy ftp://proxy\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress {\n\t\tproxy\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress {\n\t\ttimeout soon\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress {\n\t\ttimeout 1s 2s\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress {\n\t\tbind_interface nonexistent0\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress {\n\t\tunknown\n\t}\n}\na.com", true, ""},
+		{"{\n\tegress arg\n}\na.com", true, ""},
+	} {
+		sblocks, err := caddyfile.Parse("Testfile", strings.NewReader(test.input), nil)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error setting up test, got: %v", i, err)
+		}
+		_, opts, err := globalOptions(sblocks)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		proxy := "<nil>"
+		if opts.egress.Proxy != nil {
+			proxy = opts.egress.Proxy.String()
+		}
+		if got := fmt.Sprintf("%s %v %v", proxy, opts.egress.Resolvers, opts.egress.Timeout); got != test.expected {
+			t.Errorf("Test %d: Expected egress %s, got %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestGlobalOptionsMemoryLimit(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{"{\n\tmemory_soft_limit 1GB\n}\na.com", false, "1073741824 0s [] 0"},
+		{"{\n\tmemory_soft_limit 512mb {\n\t\tcheck_interval 5s\n\t\tcertificate_cache 100\n\t\ton_demand off\n\t}\n}\na.com",
+			false, "536870912 5s [on_demand] 100"},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\tcertificate_cache off\n\t\ton_demand on\n\t}\n}\na.com", false, "1073741824 0s [certificate_cache] 0"},
+		{"{\n\tmemory_soft_limit\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit lots\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 0\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB 2GB\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\tcheck_interval never\n\t}\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\tcertificate_cache -1\n\t}\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\ton_demand 5\n\t}\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\tunknown off\n\t}\n}\na.com", true, ""},
+		{"{\n\tmemory_soft_limit 1GB {\n\t\ton_demand\n\t}\n}\na.com", true, ""},
+	} {
+		sblocks, err := caddyfile.Parse("Testfile", strings.NewReader(test.input), nil)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error setting up test, got: %v", i, err)
+		}
+		_, opts, err := globalOptions(sblocks)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		got := fmt.Sprintf("%d %v %v %d", opts.memory.SoftLimit, opts.memory.Interval, opts.memory.Disabled, opts.certCacheTarget)
+		if got != test.expected {
+			t.Errorf("Test %d: Expected memory limit %s, got %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestInspectServerBlocksMerge(t *testing.T) {
+	input := `{
+		merge_duplicate_blocks
+	}
+	a.com {
+		header / X-First 1
+		gzip
+	}
+	a.com {
+		header / X-Second 2
+		root /srv
+	}`
+	sblocks, err := caddyfile.Parse("Testfile", strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatalf("Expected no error setting up test, got: %v", err)
+	}
+	ctx := newContext().(*httpContext)
+	sblocks, err = ctx.InspectServerBlocks("Testfile", sblocks)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(sblocks) != 1 || len(ctx.siteConfigs) != 1 {
+		t.Fatalf("Expected 1 server block and site, got %d and %d", len(sblocks), len(ctx.siteConfigs))
+	}
+	if headers := tokenText(sblocks[0].Tokens["header"]); headers != "header / X-First 1 header / X-Second 2" {
+		t.Errorf("Expected the header lines of the later block to follow those of the earlier one, got %s", headers)
+	}
+	for _, dir := range []string{"gzip", "errors", "root"} {
+		if _, ok := sblocks[0].Tokens[dir]; !ok {
+			t.Errorf("Expected the merged block to have %s", dir)
+		}
+	}
+}
+
+func TestInspectServerBlocksPathScopes(t *testing.T) {
+	input := "example.com/blog {\n}\nexample.com {\n\ttls off\n}\nexample.com:8080/docs {\n}\nother.com/blog {\n\ttls off\n}"
+	sblocks, err := caddyfile.Parse("Testfile", strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatalf("Expected no error setting up test, got: %v", err)
+	}
+	ctx := newContext().(*httpContext)
+	if _, err := ctx.InspectServerBlocks("Testfile", sblocks); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if ctx.keysToSiteConfigs["example.com/blog"].TLS != ctx.keysToSiteConfigs["example.com"].TLS {
+		t.Error("Expected the path-scoped site to have the TLS configuration of its host")
+	}
+	if ctx.keysToSiteConfigs["example.com:8080/docs"].TLS == ctx.keysToSiteConfigs["example.com"].TLS {
+		t.Error("Expected the path-scoped site on another port not to have the TLS configuration of the host")
+	}
+	if ctx.keysToSiteConfigs["other.com/blog"].TLS == nil {
+		t.Error("Expected the path-scoped site without a site of its host to have a TLS configuration")
+	} else if ctx.keysToSiteConfigs["other.com/blog"].TLS == ctx.keysToSiteConfigs["example.com"].TLS {
+		t.Error("Expected the path-scoped site without a site of its host to have its own TLS configuration")
+	}
+
+	sblocks, err = caddyfile.Parse("Testfile", strings.NewReader("example.com {\n}\n\nexample.com/blog {\n\ttls off\n}"), nil)
+	if err != nil {
+		t.Fatalf("Expected no error setting up test, got: %v", err)
+	}
+	_, err = newContext().(*httpContext).InspectServerBlocks("Testfile", sblocks)
+	if err == nil || !strings.Contains(err.Error(), "Testfile:4") {
+		t.Errorf("Expected an error for tls in the path-scoped site at Testfile:4, got: %v", err)
+	}
+}
+
+func TestGroupSiteConfigsByListenAddr(t *testing.T) {
+	site := func(addr string, hosts ...string) *SiteConfig {
+		cfg := &SiteConfig{Addr: Address{Host: addr, Port: "2015"}, ListenHosts: hosts}
+		if len(hosts) > 0 {
+			cfg.ListenHost = hosts[0]
+		}
+		return cfg
+	}
+
+	for i, test := range []struct {
+		sites     []*SiteConfig
+		shouldErr bool
+		expected  map[string]int // listen address to number of sites
+	}{
+		{[]*SiteConfig{site("a"), site("b")}, false, map[string]int{":2015": 2}},
+		{[]*SiteConfig{site("a", "127.0.0.1", "127.0.0.2")}, false,
+			map[string]int{"127.0.0.1:2015": 1, "127.0.0.2:2015": 1}},
+		{[]*SiteConfig{site("a", "127.0.0.1", "127.0.0.2"), site("b", "127.0.0.2", "127.0.0.3")}, false,
+			map[string]int{"127.0.0.1:2015": 1, "127.0.0.2:2015": 2, "127.0.0.3:2015": 1}},
+		{[]*SiteConfig{site("a", "127.0.0.1", "127.0.0.1")}, false, map[string]int{"127.0.0.1:2015": 1}},
+		{[]*SiteConfig{site("a", "127.0.0.1"), site("b")}, true, nil},
+		{[]*SiteConfig{site("a", "127.0.0.1"), site("b", "0.0.0.0")}, true, nil},
+		{[]*SiteConfig{site("a", "::"), site("b")}, true, nil},
+	} {
+		groups, err := groupSiteConfigsByListenAddr(test.sites)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		got := make(map[string]int)
+		for addr, group := range groups {
+			got[addr] = len(group)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d: Expected groups %v, got %v", i, test.expected, got)
+		}
+	}
+}
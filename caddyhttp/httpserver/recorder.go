@@ -50,12 +50,11 @@ func (r *ResponseRecorder) WriteHeader(status int) {
 }
 
 // Write is a wrapper that records the size of the body
-// that gets written.
+// that gets written, including what was written before
+// an error.
 func (r *ResponseRecorder) Write(buf []byte) (int, error) {
 	n, err := r.ResponseWriter.Write(buf)
-	if err == nil {
-		r.size += n
-	}
+	r.size += n
 	return n, err
 }
 
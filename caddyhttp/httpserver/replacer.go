@@ -1,6 +1,7 @@
 package httpserver
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/mholt/caddy/caddytls"
 )
 
 // requestReplacer is a strings.Replacer which is used to
@@ -62,6 +65,18 @@ func NewReplacer(r *http.Request, rr *ResponseRecorder, emptyValue string) Repla
 				}
 				return "http"
 			},
+			"{tls_protocol}": func() string {
+				if r.TLS == nil {
+					return ""
+				}
+				return caddytls.ProtocolName(r.TLS.Version)
+			},
+			"{tls_cipher}": func() string {
+				if r.TLS == nil {
+					return ""
+				}
+				return caddytls.CipherName(r.TLS.CipherSuite)
+			},
 			"{hostname}": func() string {
 				name, err := os.Hostname()
 				if err != nil {
@@ -119,6 +134,8 @@ func NewReplacer(r *http.Request, rr *ResponseRecorder, emptyValue string) Repla
 
 				return requestReplacer.Replace(string(dump))
 			},
+			// set by the site for the requests it traces
+			"{trace}": func() string { return "" },
 		},
 		emptyValue: emptyValue,
 	}
@@ -129,9 +146,36 @@ func NewReplacer(r *http.Request, rr *ResponseRecorder, emptyValue string) Repla
 		rep.replacements[headerReplacer+strings.ToLower(header)+"}"] = func() string { return strings.Join(values, ",") }
 	}
 
+	// Placeholders set by middleware for this request
+	if placeholders, ok := r.Context().Value(placeholdersKey{}).(map[string]func() string); ok {
+		for key, value := range placeholders {
+			rep.replacements[key] = value
+		}
+	}
+
 	return rep
 }
 
+// placeholdersKey is the context key of the placeholders
+// that were set for a request with WithPlaceholder.
+type placeholdersKey struct{}
+
+// WithPlaceholder returns a shallow copy of r with the placeholder
+// {key}, which is replaced with what value returns by every replacer
+// made for the copy or requests derived from it. Middleware use this
+// to make values known to the handlers after them; the request they
+// were given, and the log, do not see the placeholder.
+func WithPlaceholder(r *http.Request, key string, value func() string) *http.Request {
+	placeholders := make(map[string]func() string)
+	if existing, ok := r.Context().Value(placeholdersKey{}).(map[string]func() string); ok {
+		for k, v := range existing {
+			placeholders[k] = v
+		}
+	}
+	placeholders["{"+key+"}"] = value
+	return r.WithContext(context.WithValue(r.Context(), placeholdersKey{}, placeholders))
+}
+
 // Replace performs a replacement of values on s and returns
 // the string with the replaced values.
 func (r *replacer) Replace(s string) string {
@@ -140,14 +184,23 @@ func (r *replacer) Replace(s string) string {
 		return s
 	}
 
-	// Make response placeholders now
-	if r.responseRecorder != nil {
-		r.replacements["{status}"] = func() string { return strconv.Itoa(r.responseRecorder.status) }
-		r.replacements["{size}"] = func() string { return strconv.Itoa(r.responseRecorder.size) }
+	// Make response placeholders now; without a response
+	// recorder they are empty rather than left as they are
+	if rr := r.responseRecorder; rr != nil {
+		r.replacements["{status}"] = func() string { return strconv.Itoa(rr.status) }
+		r.replacements["{size}"] = func() string { return strconv.Itoa(rr.size) }
 		r.replacements["{latency}"] = func() string {
-			dur := time.Since(r.responseRecorder.start)
+			dur := time.Since(rr.start)
 			return roundDuration(dur).String()
 		}
+		r.replacements["{latency_ms}"] = func() string {
+			dur := time.Since(rr.start)
+			return strconv.FormatInt(int64(dur/time.Millisecond), 10)
+		}
+	} else {
+		for _, placeholder := range responsePlaceholders {
+			r.replacements[placeholder] = func() string { return "" }
+		}
 	}
 
 	// Include custom placeholders, overwriting existing ones if necessary
@@ -225,6 +278,21 @@ func (r *replacer) Set(key, value string) {
 	r.customReplacements["{"+key+"}"] = func() string { return value }
 }
 
+// responsePlaceholders are the placeholders whose values
+// come from the ResponseRecorder.
+var responsePlaceholders = []string{"{status}", "{size}", "{latency}", "{latency_ms}"}
+
+// HasResponsePlaceholder returns true if s contains a placeholder
+// whose value is only known once the response is being written.
+func HasResponsePlaceholder(s string) bool {
+	for _, placeholder := range responsePlaceholders {
+		if strings.Contains(s, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	timeFormat     = "02/Jan/2006:15:04:05 -0700"
 	headerReplacer = "{>"
@@ -1,9 +1,11 @@
 package httpserver
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -112,6 +114,86 @@ func TestReplace(t *testing.T) {
 	}
 }
 
+func TestConnectionAndResponsePlaceholders(t *testing.T) {
+	for i, test := range []struct {
+		url      string
+		tls      *tls.ConnectionState
+		recorder bool // whether there is a ResponseRecorder
+		expect   map[string]string
+	}{
+		{
+			url:      "http://localhost:2015/",
+			recorder: true,
+			expect: map[string]string{
+				"{scheme}":       "http",
+				"{hostonly}":     "localhost",
+				"{tls_protocol}": "-",
+				"{tls_cipher}":   "-",
+				"{status}":       "201",
+				"{size}":         "5",
+			},
+		},
+		{
+			url: "https://example.com/",
+			tls: &tls.ConnectionState{
+				Version:     tls.VersionTLS12,
+				CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			},
+			recorder: true,
+			expect: map[string]string{
+				"{scheme}":       "https",
+				"{hostonly}":     "example.com",
+				"{tls_protocol}": "tls1.2",
+				"{tls_cipher}":   "ECDHE-RSA-AES128-GCM-SHA256",
+				"{status}":       "201",
+				"{size}":         "5",
+			},
+		},
+		{
+			url: "https://example.com:8443/",
+			tls: &tls.ConnectionState{
+				Version:     tls.VersionTLS11,
+				CipherSuite: tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			},
+			expect: map[string]string{
+				"{scheme}":       "https",
+				"{hostonly}":     "example.com",
+				"{tls_protocol}": "tls1.1",
+				"{tls_cipher}":   "RSA-AES256-CBC-SHA",
+				"{status}":       "-",
+				"{size}":         "-",
+				"{latency}":      "-",
+				"{latency_ms}":   "-",
+			},
+		},
+	} {
+		request, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Request Formation Failed: %v", i, err)
+		}
+		request.TLS = test.tls
+
+		var rr *ResponseRecorder
+		if test.recorder {
+			rr = NewResponseRecorder(httptest.NewRecorder())
+			rr.WriteHeader(http.StatusCreated)
+			rr.Write([]byte("hello"))
+		}
+		repl := NewReplacer(request, rr, "-")
+
+		for placeholder, expect := range test.expect {
+			if actual := repl.Replace(placeholder); actual != expect {
+				t.Errorf("Test %d: Expected %s to be '%s', got '%s'", i, placeholder, expect, actual)
+			}
+		}
+		if test.recorder {
+			if actual := repl.Replace("{latency_ms}"); !regexp.MustCompile(`^[0-9]+$`).MatchString(actual) {
+				t.Errorf("Test %d: Expected {latency_ms} to be a number of milliseconds, got '%s'", i, actual)
+			}
+		}
+	}
+}
+
 func TestSet(t *testing.T) {
 	w := httptest.NewRecorder()
 	recordRequest := NewResponseRecorder(w)
@@ -142,6 +224,25 @@ func TestSet(t *testing.T) {
 	}
 }
 
+func TestWithPlaceholder(t *testing.T) {
+	request, err := http.NewRequest("GET", "http://localhost", nil)
+	if err != nil {
+		t.Fatalf("Request Formation Failed \n")
+	}
+	withCountry := WithPlaceholder(request, "country", func() string { return "US" })
+	withBoth := WithPlaceholder(withCountry, "asn", func() string { return "64500" })
+
+	if got := NewReplacer(withBoth, nil, "-").Replace("{country} {asn}"); got != "US 64500" {
+		t.Errorf("Expected placeholders to be replaced with 'US 64500', got '%s'", got)
+	}
+	if got := NewReplacer(withCountry, nil, "-").Replace("{country} {asn}"); got != "US {asn}" {
+		t.Errorf("Expected placeholder of derived request not to be set, got '%s'", got)
+	}
+	if got := NewReplacer(request, nil, "-").Replace("{country}"); got != "{country}" {
+		t.Errorf("Expected original request to have no placeholder, got '%s'", got)
+	}
+}
+
 func TestRound(t *testing.T) {
 	var tests = map[time.Duration]time.Duration{
 		// 599.935µs -> 560µs
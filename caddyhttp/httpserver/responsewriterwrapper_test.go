@@ -0,0 +1,19 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseWriterWrapper(t *testing.T) {
+	w := httptest.NewRecorder()
+	rww := ResponseWriterWrapper{ResponseWriter: w}
+
+	rww.Flush()
+	if !w.Flushed {
+		t.Error("Expected the underlying ResponseWriter to be flushed")
+	}
+	if _, _, err := rww.Hijack(); err == nil {
+		t.Error("Expected error hijacking a ResponseWriter that is not a Hijacker, got none")
+	}
+}
@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+)
+
+// rootKey is the context key of the document root of a request.
+type rootKey struct{}
+
+// WithRoot returns a shallow copy of r whose files are served
+// from root instead of the root of the site. Middleware that
+// choose the document root for each request use this; the
+// handlers that serve files read it back with RequestRoot.
+// If root is empty, r has no root, and no files are found
+// for it, so that it ends up not found.
+func WithRoot(r *http.Request, root string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), rootKey{}, root))
+}
+
+// RequestRoot returns the document root of r, if it was
+// set with WithRoot. Handlers that find the files of r in
+// the returned root must find none if it is empty.
+func RequestRoot(r *http.Request) (string, bool) {
+	root, ok := r.Context().Value(rootKey{}).(string)
+	return root, ok
+}
+
+// RequestFileSystem returns the files of the document root
+// of r, if it was set with WithRoot, or else files, which
+// are those of the root of the site.
+func RequestFileSystem(r *http.Request, files http.FileSystem) http.FileSystem {
+	root, ok := RequestRoot(r)
+	if !ok {
+		return files
+	}
+	if root == "" {
+		return noFiles{}
+	}
+	return http.Dir(root)
+}
+
+// noFiles is the file system of a request that has no root.
+type noFiles struct{}
+
+func (noFiles) Open(name string) (http.File, error) {
+	return nil, os.ErrNotExist
+}
+
+// rootFileServer is the file server of a site, which serves
+// the files of each request from the root of that request.
+type rootFileServer struct {
+	staticfiles.FileServer
+}
+
+func (fs rootFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	fs.Root = RequestFileSystem(r, fs.Root)
+	return fs.FileServer.ServeHTTP(w, r)
+}
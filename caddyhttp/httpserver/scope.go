@@ -0,0 +1,155 @@
+package httpserver
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isPathScoped returns whether the site at addr serves
+// only a path of its host, like example.com/blog.
+func isPathScoped(addr Address) bool {
+	return addr.Path != "" && addr.Path != "/"
+}
+
+// serveScopes serves r with the first of sites, which are the sites
+// of the host whose paths match the request, from the longest path
+// to the shortest, with prefixes being their paths. Each site serves
+// the request in isolation; only a site that falls through passes
+// the request on to the next one, if it finds nothing for it.
+func (s *Server) serveScopes(w http.ResponseWriter, r *http.Request, sites []*SiteConfig, prefixes []string) (int, error) {
+	for i, vhost := range sites {
+		if !vhost.Fallthrough || i == len(sites)-1 {
+			return s.serveSite(w, r, vhost, prefixes[i])
+		}
+		fw := &fallthroughWriter{ResponseWriterWrapper: ResponseWriterWrapper{ResponseWriter: w}, header: make(http.Header)}
+		status, err := s.serveSite(fw, scopedRequest(r), vhost, prefixes[i])
+		if status == http.StatusNotFound && !fw.wrote {
+			continue
+		}
+		if !fw.wrote {
+			// the error response is written with the header of the site
+			copyHeader(w.Header(), fw.header)
+		}
+		return status, err
+	}
+	return http.StatusNotFound, nil
+}
+
+// serveSite serves r with the middleware of vhost, whose path is
+// pathPrefix, traces it if the site does, and notifies its observers.
+func (s *Server) serveSite(w http.ResponseWriter, r *http.Request, vhost *SiteConfig, pathPrefix string) (int, error) {
+	// trim the path portion of the site address from the beginning of
+	// the URL path, so a request to example.com/foo/blog on the site
+	// defined as example.com/foo appears as /blog instead of /foo/blog.
+	if pathPrefix != "/" && !vhost.KeepScopePath {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, pathPrefix)
+		if !strings.HasPrefix(r.URL.Path, "/") {
+			r.URL.Path = "/" + r.URL.Path
+		}
+	}
+
+	serve := vhost.middlewareChain.ServeHTTP
+	if vhost.Trace.enabled() && vhost.Trace.traces(r) {
+		serve = func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return serveTraced(w, r, vhost)
+		}
+	}
+	if len(vhost.observers) == 0 {
+		return serve(w, r)
+	}
+
+	rec := NewResponseRecorder(w)
+	status, err := serve(rec, r)
+	observed := rec.Status()
+	if status >= 400 {
+		// the error response has not been written yet
+		observed = status
+	}
+	latency := time.Since(rec.start)
+	for _, observe := range vhost.observers {
+		observe(r, observed, rec.Size(), latency)
+	}
+	return status, err
+}
+
+// scopedRequest returns a copy of r for a site that may fall
+// through, so that the changes its middleware makes to the URL
+// and the header do not reach the site that it falls through to.
+func scopedRequest(r *http.Request) *http.Request {
+	scoped := r.WithContext(r.Context())
+	u := *r.URL
+	scoped.URL = &u
+	scoped.Header = make(http.Header, len(r.Header))
+	copyHeader(scoped.Header, r.Header)
+	return scoped
+}
+
+// copyHeader adds the values of src to dst.
+func copyHeader(dst, src http.Header) {
+	for field, values := range src {
+		dst[field] = append(dst[field], values...)
+	}
+}
+
+// fallthroughWriter is the ResponseWriter of a site that falls
+// through. Its header is kept apart from that of the underlying
+// ResponseWriter until the site writes a response, so that none
+// of it leaks into the response of the site that it falls
+// through to instead.
+type fallthroughWriter struct {
+	ResponseWriterWrapper
+	header http.Header
+	wrote  bool
+}
+
+// Header returns the header of the site's response.
+func (w *fallthroughWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader writes the header of the site's response,
+// which means that it does not fall through.
+func (w *fallthroughWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.commit()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the site's response, which means
+// that it does not fall through.
+func (w *fallthroughWriter) Write(buf []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// commit copies the header of the site's response
+// to the underlying ResponseWriter.
+func (w *fallthroughWriter) commit() {
+	w.wrote = true
+	copyHeader(w.ResponseWriter.Header(), w.header)
+}
+
+// Hijack implements http.Hijacker. A site whose
+// connection is hijacked does not fall through.
+func (w *fallthroughWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriterWrapper.Hijack()
+	if err == nil {
+		w.wrote = true
+	}
+	return conn, brw, err
+}
+
+// Flush implements http.Flusher. It writes the header
+// if it was not written yet, and then flushes.
+func (w *fallthroughWriter) Flush() {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriterWrapper.Flush()
+}
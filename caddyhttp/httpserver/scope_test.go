@@ -0,0 +1,111 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// scopeTestSite returns a site at addr that serves the files
+// in files from a new root, and that sets X-Site to name.
+func scopeTestSite(t *testing.T, addr Address, name string, files map[string]string) *SiteConfig {
+	root, err := ioutil.TempDir("", "caddy_scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range files {
+		file = filepath.Join(root, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	site := &SiteConfig{Addr: addr, Root: root, TLS: new(caddytls.Config)}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("X-Site", name)
+			w.Header().Set("X-"+name+"-Path", r.URL.Path)
+			r.Header.Set("X-Seen-By-"+name, "yes")
+			return next.ServeHTTP(w, r)
+		})
+	})
+	return site
+}
+
+func TestPathScopedSites(t *testing.T) {
+	parent := scopeTestSite(t, Address{Original: "example.com", Host: "example.com"}, "Parent", map[string]string{
+		"index.html":       "parent index",
+		"about.html":       "parent about",
+		"blog/legacy.html": "parent legacy",
+	})
+	defer os.RemoveAll(parent.Root)
+	blog := scopeTestSite(t, Address{Original: "example.com/blog", Host: "example.com", Path: "/blog"}, "Blog", map[string]string{
+		"index.html": "blog index",
+		"post.html":  "blog post",
+	})
+	defer os.RemoveAll(blog.Root)
+	parent.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.Header.Get("X-Seen-By-Blog") != "" {
+				t.Errorf("Expected the parent site not to see the request changes of the blog, got %v", r.Header)
+			}
+			return next.ServeHTTP(w, r)
+		})
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{blog, parent})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+
+	for i, test := range []struct {
+		path         string
+		fallthrough_ bool
+		keepPath     bool
+		status       int
+		body         string
+		site         string
+		sitePath     string
+	}{
+		{"/blog/post.html", false, false, http.StatusOK, "blog post", "Blog", "/post.html"},
+		{"/blog/", false, false, http.StatusOK, "blog index", "Blog", "/"},
+		{"/blog/legacy.html", false, false, http.StatusNotFound, "", "Blog", "/legacy.html"},
+		{"/blog/about.html", false, false, http.StatusNotFound, "", "Blog", "/about.html"},
+		{"/about.html", false, false, http.StatusOK, "parent about", "Parent", "/about.html"},
+		{"/", false, false, http.StatusOK, "parent index", "Parent", "/"},
+		{"/blog/post.html", true, false, http.StatusOK, "blog post", "Blog", "/post.html"},
+		{"/blog/legacy.html", true, false, http.StatusOK, "parent legacy", "Parent", "/blog/legacy.html"},
+		{"/blog/missing.html", true, false, http.StatusNotFound, "", "Parent", "/blog/missing.html"},
+		{"/blog/post.html", false, true, http.StatusNotFound, "", "Blog", "/blog/post.html"},
+	} {
+		blog.Fallthrough, blog.KeepScopePath = test.fallthrough_, test.keepPath
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d for %s, got %d", i, test.status, test.path, w.Code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, w.Body.String())
+		}
+		if got := w.Header().Get("X-Site"); got != test.site {
+			t.Errorf("Test %d: Expected %s to be served by %s, got %s", i, test.path, test.site, got)
+		}
+		if got := w.Header().Get("X-" + test.site + "-Path"); got != test.sitePath {
+			t.Errorf("Test %d: Expected the site to see path %s, got %s", i, test.sitePath, got)
+		}
+		for _, other := range []string{"Blog", "Parent"} {
+			if other != test.site && w.Header().Get("X-"+other+"-Path") != "" {
+				t.Errorf("Test %d: Expected no header of %s in the response of %s", i, other, test.site)
+			}
+		}
+	}
+}
@@ -2,7 +2,9 @@
 package httpserver
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
@@ -18,6 +20,9 @@ import (
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/staticfiles"
 	"github.com/mholt/caddy/caddytls"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server is the HTTP server implementation.
@@ -27,10 +32,39 @@ type Server struct {
 	listener    net.Listener
 	listenerMu  sync.Mutex
 	sites       []*SiteConfig
-	connTimeout time.Duration  // max time to wait for a connection before force stop
-	connWg      sync.WaitGroup // one increment per connection
-	tlsGovChan  chan struct{}  // close to stop the TLS maintenance goroutine
+	connTimeout time.Duration         // max time to wait for a connection before force stop
+	maxConns    int                   // max open connections; 0 means no limit
+	maxPerIP    int                   // max open connections from one IP address; 0 means no limit
+	connWg      sync.WaitGroup        // one increment per connection
+	conns       connSet               // open connections, to close after connTimeout
+	idleConns   map[net.Conn]struct{} // keep-alive connections between requests; protected by listenerMu
+	shutdown    chan struct{}         // closed when the server begins to stop
+	tlsGovChan  chan struct{}         // close to stop the TLS maintenance goroutine
 	vhosts      *vhostTrie
+
+	// what the ConnState callback reports of each connection,
+	// protected by listenerMu, and the requests being served,
+	// which are listed by Connections
+	connStates map[net.Conn]*connStatus
+	inflight   inflightSet
+
+	// whether client certificates are required per request
+	// rather than during the TLS handshake
+	requireClientCert bool
+
+	// the site that serves requests whose Host matches
+	// no site, and whether the connection is closed when
+	// there is no such site
+	defaultSite    *SiteConfig
+	closeUnmatched bool
+
+	// whether requests that could be taken for different
+	// requests by a backend are served instead of rejected
+	allowAmbiguous bool
+
+	// where TLS connections are spliced to,
+	// by server name, instead of being served
+	passthrough map[string]Passthrough
 }
 
 // ensure it satisfies the interface
@@ -49,18 +83,31 @@ func NewServer(addr string, group []*SiteConfig) (*Server, error) {
 		},
 		vhosts:      newVHostTrie(),
 		sites:       group,
-		connTimeout: GracefulTimeout,
+		connTimeout: gracePeriod(group),
+		idleConns:   make(map[net.Conn]struct{}),
+		connStates:  make(map[net.Conn]*connStatus),
+		shutdown:    make(chan struct{}),
+	}
+	var err error
+	s.maxConns, s.maxPerIP, err = connLimits(addr, group)
+	if err != nil {
+		return nil, err
 	}
 	s.Server.Handler = s // this is weird, but whatever
 	s.Server.ConnState = func(c net.Conn, cs http.ConnState) {
-		if cs == http.StateIdle {
-			s.listenerMu.Lock()
-			// server stopped, close idle connection
-			if s.listener == nil {
-				c.Close()
-			}
-			s.listenerMu.Unlock()
+		s.listenerMu.Lock()
+		defer s.listenerMu.Unlock()
+		s.trackConnState(c, cs)
+		if cs != http.StateIdle {
+			delete(s.idleConns, c)
+			return
 		}
+		// server stopped, close idle connection
+		if s.listener == nil {
+			c.Close()
+			return
+		}
+		s.idleConns[c] = struct{}{}
 	}
 
 	// Disable HTTP/2 if desired
@@ -84,7 +131,6 @@ func NewServer(addr string, group []*SiteConfig) (*Server, error) {
 
 	// Set up TLS configuration
 	var tlsConfigs []*caddytls.Config
-	var err error
 	for _, site := range group {
 		tlsConfigs = append(tlsConfigs, site.TLS)
 	}
@@ -97,19 +143,196 @@ func NewServer(addr string, group []*SiteConfig) (*Server, error) {
 		s.Server.TLSConfig.NextProtos = []string{"h2"}
 	}
 
-	// Compile custom middleware for every site (enables virtual hosting)
+	// Paths that are exempt from TLS client authentication can only
+	// be reached if the handshake succeeds without a certificate, so
+	// the requirement is enforced for each request instead
+	if s.Server.TLSConfig != nil && hasClientAuthExemptions(group) {
+		switch s.Server.TLSConfig.ClientAuth {
+		case tls.RequireAnyClientCert:
+			s.Server.TLSConfig.ClientAuth = tls.RequestClientCert
+			s.requireClientCert = true
+		case tls.RequireAndVerifyClientCert:
+			s.Server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			s.requireClientCert = true
+		}
+	}
+
+	// Serve HTTP/2 over cleartext (h2c) if a site opted in; HTTP/1.1
+	// requests on the same listener are still served as usual
+	if wantsH2C(group) {
+		if s.Server.TLSConfig != nil {
+			return nil, fmt.Errorf("%s: cannot serve h2c on a listener that uses TLS", addr)
+		}
+		if HTTP2 {
+			s.Server.Handler = h2c.NewHandler(h2cUpgradedRequests(s.Server.Handler), &http2.Server{})
+		} else {
+			log.Printf("[WARNING] h2c not enabled on %s because HTTP/2 is disabled", addr)
+		}
+	}
+
+	// Compile custom middleware for every site (enables virtual hosting);
+	// a site that binds several addresses is in several groups, and its
+	// servers share the middleware compiled for the first of them
 	for _, site := range group {
-		stack := Handler(staticfiles.FileServer{Root: http.Dir(site.Root), Hide: site.HiddenFiles})
-		for i := len(site.middleware) - 1; i >= 0; i-- {
-			stack = site.middleware[i](stack)
+		if site.middlewareChain == nil {
+			stack := Handler(rootFileServer{staticfiles.FileServer{Root: http.Dir(site.Root), Hide: site.HiddenFiles, IndexPages: site.IndexPagesFor}})
+			if site.Trace.enabled() {
+				stack = traceChain(site, stack)
+			} else {
+				for i := len(site.middleware) - 1; i >= 0; i-- {
+					stack = site.middleware[i](stack)
+				}
+			}
+			site.middlewareChain = stack
 		}
-		site.middlewareChain = stack
 		s.vhosts.Insert(site.Addr.VHost(), site)
 	}
 
+	// Decide where requests go whose Host matches no site
+	for _, site := range group {
+		if site.DefaultServer {
+			if s.defaultSite != nil {
+				return nil, fmt.Errorf("%s: sites %s and %s cannot both be the default server", addr, s.defaultSite.Addr, site.Addr)
+			}
+			s.defaultSite = site
+		}
+		if site.CloseUnmatched {
+			s.closeUnmatched = true
+		}
+		if site.AllowAmbiguousRequests {
+			s.allowAmbiguous = true
+		}
+	}
+	if s.defaultSite != nil {
+		for _, site := range group {
+			if site != s.defaultSite && isCatchAll(site.Addr) {
+				return nil, fmt.Errorf("%s: site %s is the default server, but site %s already serves all hosts", addr, s.defaultSite.Addr, site.Addr)
+			}
+		}
+	}
+
+	// Collect the server names whose TLS connections are passed through
+	for _, site := range group {
+		for name, route := range site.Passthrough {
+			if other, ok := s.passthrough[name]; ok && other != route {
+				return nil, fmt.Errorf("%s: %s is passed through to both %s and %s", addr, name, other.Address, route.Address)
+			}
+			if s.passthrough == nil {
+				s.passthrough = make(map[string]Passthrough)
+			}
+			s.passthrough[name] = route
+		}
+	}
+
 	return s, nil
 }
 
+// isCatchAll returns true if the site at addr
+// serves any host that no other site serves.
+func isCatchAll(addr Address) bool {
+	switch addr.Host {
+	case "", "0.0.0.0", "*":
+		return addr.Path == "" || addr.Path == "/"
+	}
+	return false
+}
+
+// hasClientAuthExemptions returns true if any site
+// in group has paths exempt from client authentication.
+func hasClientAuthExemptions(group []*SiteConfig) bool {
+	for _, site := range group {
+		if len(site.ClientAuthExempt) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// missingClientCert returns true if vhost requires a
+// TLS client certificate for r but r did not present one.
+func missingClientCert(vhost *SiteConfig, r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) > 0 || vhost.TLS == nil {
+		return false
+	}
+	if vhost.TLS.ClientAuth != tls.RequireAnyClientCert &&
+		vhost.TLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		return false
+	}
+	// the exempt paths match however the path is spelled
+	cleaned := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	for _, exempt := range vhost.ClientAuthExempt {
+		if Path(cleaned).Matches(exempt) {
+			return false
+		}
+	}
+	return true
+}
+
+// wantsH2C returns true if any site in group
+// wants to be served with h2c.
+func wantsH2C(group []*SiteConfig) bool {
+	for _, site := range group {
+		if site.H2C {
+			return true
+		}
+	}
+	return false
+}
+
+// gracePeriod returns how long a server for group waits for
+// connections to finish when it stops: the longest grace period
+// set by a site in group, or GracefulTimeout if none sets one.
+func gracePeriod(group []*SiteConfig) time.Duration {
+	var longest time.Duration
+	for _, site := range group {
+		if site.GracePeriod > longest {
+			longest = site.GracePeriod
+		}
+	}
+	if longest == 0 {
+		return GracefulTimeout
+	}
+	return longest
+}
+
+// h2cUpgradedRequests wraps next so that a request which
+// arrived as HTTP/1.1 with Upgrade: h2c, and which is being
+// answered over the upgraded HTTP/2 connection, looks like
+// any other HTTP/2 request to the middleware stack.
+func h2cUpgradedRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 && isH2CUpgrade(r.Header) {
+			r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+			r.Header.Del("Connection")
+			r.Header.Del("Upgrade")
+			r.Header.Del("HTTP2-Settings")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isH2CUpgrade returns true if h asks to upgrade the connection
+// to h2c as RFC 7540 section 3.2 says, with a valid HTTP2-Settings
+// header. The h2c handler upgrades the connection of a request
+// with these headers before it is served, so a request that has
+// them and is still HTTP/1.1 is the one served after the upgrade.
+func isH2CUpgrade(h http.Header) bool {
+	if !httpguts.HeaderValuesContainsToken(h["Upgrade"], "h2c") ||
+		!httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") ||
+		!httpguts.HeaderValuesContainsToken(h["Connection"], "HTTP2-Settings") {
+		return false
+	}
+	settings := h["Http2-Settings"]
+	if len(settings) != 1 {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(settings[0])
+	return err == nil
+}
+
 func (s *Server) wrapWithSvcHeaders(previousHandler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.quicServer.SetQuicHeaders(w.Header())
@@ -124,6 +347,14 @@ func (s *Server) Listen() (net.Listener, error) {
 		return nil, fmt.Errorf("Server field is nil")
 	}
 
+	if socket, ok := unixSocketPath(s.Server.Addr); ok {
+		var opts *SocketOptions
+		if len(s.sites) > 0 {
+			opts = s.sites[0].Socket
+		}
+		return listenUnix(socket, opts)
+	}
+
 	ln, err := net.Listen("tcp", s.Server.Addr)
 	if err != nil {
 		var succeeded bool
@@ -157,14 +388,28 @@ func (s *Server) ListenPacket() (net.PacketConn, error) { return nil, nil }
 func (s *Server) Serve(ln net.Listener) error {
 	if tcpLn, ok := ln.(*net.TCPListener); ok {
 		ln = tcpKeepAliveListener{TCPListener: tcpLn}
+	} else if unixLn, ok := ln.(*net.UnixListener); ok {
+		ln = unixListener{UnixListener: unixLn}
+	}
+
+	if s.maxConns > 0 || s.maxPerIP > 0 {
+		ln = newLimitListener(ln, s.maxConns, s.maxPerIP)
 	}
 
-	ln = newGracefulListener(ln, &s.connWg)
+	ln = newGracefulListener(ln, &s.connWg, &s.conns)
 
 	s.listenerMu.Lock()
 	s.listener = ln
 	s.listenerMu.Unlock()
 
+	runningServersMu.Lock()
+	runningServers[s] = struct{}{}
+	runningServersMu.Unlock()
+
+	if len(s.passthrough) > 0 {
+		ln = newPassthroughListener(ln, s.passthrough)
+	}
+
 	if s.Server.TLSConfig != nil {
 		// Create TLS listener - note that we do not replace s.listener
 		// with this TLS listener; tls.listener is unexported and does
@@ -211,6 +456,20 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	sanitizePath(r)
 
+	if !s.allowAmbiguous {
+		if reason := ambiguity(r); reason != "" {
+			log.Printf("[WARNING] Rejected ambiguous request from %s: %s", r.RemoteAddr, reason)
+			DefaultErrorFunc(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+	r.Host = normalizeHost(r.Host, r.TLS != nil)
+
+	req := s.inflight.start(r)
+	defer s.inflight.end(req)
+	ctx := context.WithValue(r.Context(), shutdownCtxKey, s.shutdown)
+	r = r.WithContext(context.WithValue(ctx, inflightCtxKey, req))
+
 	status, _ := s.serveHTTP(w, r)
 
 	// Fallback error response in case error handling wasn't chained in
@@ -225,46 +484,55 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 	// is on a different port.
 	hostname, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
-		hostname = r.Host
+		hostname = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
 	}
 
-	// look up the virtualhost; if no match, serve error
-	vhost, pathPrefix := s.vhosts.Match(hostname + r.URL.Path)
+	// look up the virtualhost; if no match, try the default
+	// server as if it had been asked for, else serve error
+	sites, prefixes := s.vhosts.MatchScopes(hostname + r.URL.Path)
+	if len(sites) == 0 && s.defaultSite != nil {
+		sites, prefixes = s.vhosts.MatchScopes(s.defaultSite.Addr.Host + r.URL.Path)
+	}
 
-	if vhost == nil {
+	if len(sites) == 0 {
 		// check for ACME challenge even if vhost is nil;
 		// could be a new host coming online soon
 		if caddytls.HTTPChallengeHandler(w, r, caddytls.DefaultHTTPAlternatePort) {
 			return 0, nil
 		}
-		// otherwise, log the error and write a message to the client
+		// otherwise, log the error and write a message to the
+		// client, or hang up on it if that is what is configured
 		remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
 			remoteHost = r.RemoteAddr
 		}
-		WriteTextResponse(w, http.StatusNotFound, "No such site at "+s.Server.Addr)
 		log.Printf("[INFO] %s - No such site at %s (Remote: %s, Referer: %s)",
 			hostname, s.Server.Addr, remoteHost, r.Header.Get("Referer"))
+		if s.closeUnmatched {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return 0, nil
+				}
+			}
+		}
+		WriteTextResponse(w, http.StatusNotFound, "No such site at "+s.Server.Addr)
 		return 0, nil
 	}
 
+	vhost := sites[0]
+
 	// we still check for ACME challenge if the vhost exists,
 	// because we must apply its HTTP challenge config settings
 	if s.proxyHTTPChallenge(vhost, w, r) {
 		return 0, nil
 	}
 
-	// trim the path portion of the site address from the beginning of
-	// the URL path, so a request to example.com/foo/blog on the site
-	// defined as example.com/foo appears as /blog instead of /foo/blog.
-	if pathPrefix != "/" {
-		r.URL.Path = strings.TrimPrefix(r.URL.Path, pathPrefix)
-		if !strings.HasPrefix(r.URL.Path, "/") {
-			r.URL.Path = "/" + r.URL.Path
-		}
+	if s.requireClientCert && missingClientCert(vhost, r) {
+		return http.StatusForbidden, nil
 	}
 
-	return vhost.middlewareChain.ServeHTTP(w, r)
+	return s.serveScopes(w, r, sites, prefixes)
 }
 
 // proxyHTTPChallenge solves the ACME HTTP challenge if r is the HTTP
@@ -278,11 +546,10 @@ func (s *Server) proxyHTTPChallenge(vhost *SiteConfig, w http.ResponseWriter, r
 	if vhost.TLS != nil && vhost.TLS.Manual {
 		return false
 	}
-	altPort := caddytls.DefaultHTTPAlternatePort
-	if vhost.TLS != nil && vhost.TLS.AltHTTPPort != "" {
-		altPort = vhost.TLS.AltHTTPPort
+	if vhost.TLS != nil {
+		return vhost.TLS.HTTPChallengeHandler(w, r)
 	}
-	return caddytls.HTTPChallengeHandler(w, r, altPort)
+	return caddytls.HTTPChallengeHandler(w, r, caddytls.DefaultHTTPAlternatePort)
 }
 
 // Address returns the address s was assigned to listen on.
@@ -291,10 +558,39 @@ func (s *Server) Address() string {
 }
 
 // Stop stops s gracefully (or forcefully after timeout) and
-// closes its listener.
+// closes its listener. Keep-alive connections are closed once
+// they are idle; connections that are still open when the grace
+// period is over are closed forcibly, in which case the error
+// is caddy.ErrConnsCut.
 func (s *Server) Stop() (err error) {
 	s.Server.SetKeepAlivesEnabled(false)
 
+	// Certificates that the sites of a new instance still use
+	// stay cached; the rest are evicted
+	for _, site := range s.sites {
+		if site.TLS != nil {
+			site.TLS.ReleaseCertificates()
+		}
+	}
+
+	// Close the listener first so that no new connections are
+	// accepted; after a restart or upgrade, they go to the new
+	// server, which has its own copy of the listener
+	s.listenerMu.Lock()
+	if s.listener != nil {
+		err = s.listener.Close()
+		s.listener = nil
+	}
+	for c := range s.idleConns {
+		c.Close()
+	}
+	select {
+	case <-s.shutdown:
+	default:
+		close(s.shutdown)
+	}
+	s.listenerMu.Unlock()
+
 	if runtime.GOOS != "windows" {
 		// force connections to close after timeout
 		done := make(chan struct{})
@@ -308,26 +604,51 @@ func (s *Server) Stop() (err error) {
 		// force them all to close after timeout
 		select {
 		case <-time.After(s.connTimeout):
+			if cut := s.conns.closeAll(); cut > 0 {
+				log.Printf("[WARNING] %s: Grace period of %v is over; closed %d connection(s) forcibly",
+					s.Server.Addr, s.connTimeout, cut)
+				if err == nil {
+					err = caddy.ErrConnsCut
+				}
+			}
 		case <-done:
 		}
 	}
 
-	// Close the listener now; this stops the server without delay
-	s.listenerMu.Lock()
-	if s.listener != nil {
-		err = s.listener.Close()
-		s.listener = nil
+	// Clean up the socket file, unless it was handed off in a restart
+	if socket, ok := unixSocketPath(s.Server.Addr); ok {
+		removeSocketIfUnused(socket)
 	}
-	s.listenerMu.Unlock()
 
 	// Closing this signals any TLS governor goroutines to exit
 	if s.tlsGovChan != nil {
 		close(s.tlsGovChan)
 	}
 
+	runningServersMu.Lock()
+	delete(runningServers, s)
+	runningServersMu.Unlock()
+
 	return
 }
 
+// ctxKey is the type of the request context keys of this package.
+type ctxKey string
+
+// shutdownCtxKey is the request context key for the
+// shutdown channel of the server serving the request.
+const shutdownCtxKey ctxKey = "shutdown"
+
+// ShutdownNotify returns a channel that is closed when the server
+// serving r begins to stop. Middleware that keeps a connection open
+// for a long time, like a websocket, can use it to end the
+// connection cleanly before the grace period is over. It returns
+// nil, which blocks forever, if r was not served by a Server.
+func ShutdownNotify(r *http.Request) <-chan struct{} {
+	ch, _ := r.Context().Value(shutdownCtxKey).(chan struct{})
+	return ch
+}
+
 // sanitizePath collapses any ./ ../ /// madness
 // which helps prevent path traversal attacks.
 // Note to middleware: use URL.RawPath If you need
@@ -1,8 +1,14 @@
 package httpserver
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
 )
 
 func TestAddress(t *testing.T) {
@@ -13,3 +19,181 @@ func TestAddress(t *testing.T) {
 		t.Errorf("Expected '%s' but got '%s'", want, got)
 	}
 }
+
+func TestMissingClientCert(t *testing.T) {
+	site := &SiteConfig{
+		TLS:              &caddytls.Config{ClientAuth: tls.RequireAndVerifyClientCert},
+		ClientAuthExempt: []string{"/healthz", "/status/"},
+	}
+	withCert := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{new(x509.Certificate)}}
+
+	for i, test := range []struct {
+		path     string
+		state    *tls.ConnectionState
+		expected bool
+	}{
+		{"/", &tls.ConnectionState{}, true},
+		{"/", withCert, false},
+		{"/healthz", &tls.ConnectionState{}, false},
+		{"/healthz/", &tls.ConnectionState{}, false},
+		{"//healthz", &tls.ConnectionState{}, false},
+		{"/a/../healthz", &tls.ConnectionState{}, false},
+		{"/status/", &tls.ConnectionState{}, false},
+		{"/status/live", &tls.ConnectionState{}, false},
+		{"/status", &tls.ConnectionState{}, true},
+		{"/private", &tls.ConnectionState{}, true},
+		{"/", nil, false},
+	} {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URL.Path = test.path
+		r.TLS = test.state
+		if got := missingClientCert(site, r); got != test.expected {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+
+	site.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	if missingClientCert(site, r) {
+		t.Error("Expected client certificate to be optional")
+	}
+}
+
+func TestRequestObservers(t *testing.T) {
+	site := &SiteConfig{Addr: Address{Host: "example.com"}, TLS: new(caddytls.Config)}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path == "/missing" {
+				return http.StatusNotFound, nil
+			}
+			w.Write([]byte("hello"))
+			return 0, nil
+		})
+	})
+	var statuses, sizes []int
+	site.AddRequestObserver(func(r *http.Request, status, size int, latency time.Duration) {
+		statuses = append(statuses, status)
+		sizes = append(sizes, size)
+	})
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/missing"} {
+		r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if len(statuses) != 2 || statuses[0] != http.StatusOK || statuses[1] != http.StatusNotFound {
+		t.Errorf("Expected observed statuses [200 404], got %v", statuses)
+	}
+	if len(sizes) != 2 || sizes[0] != 5 {
+		t.Errorf("Expected first observed size to be 5, got %v", sizes)
+	}
+}
+
+func TestUnmatchedHosts(t *testing.T) {
+	newSite := func(host string) *SiteConfig {
+		site := &SiteConfig{Addr: Address{Original: host, Host: host, Port: "443"}, TLS: new(caddytls.Config)}
+		site.AddMiddleware(func(next Handler) Handler {
+			return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				w.Write([]byte(host))
+				return 0, nil
+			})
+		})
+		return site
+	}
+	newDefaultSite := func(host string) *SiteConfig {
+		site := newSite(host)
+		site.DefaultServer = true
+		return site
+	}
+
+	for i, test := range []struct {
+		sites    []*SiteConfig
+		host     string
+		expected string // body of the response, or "404"
+	}{
+		// exact matches win over wildcards and catch-alls
+		{[]*SiteConfig{newSite("example.com"), newSite("*.example.com"), newSite("")}, "example.com", "example.com"},
+		{[]*SiteConfig{newSite("www.example.com"), newSite("*.example.com")}, "WWW.example.com", "www.example.com"},
+		// wildcard labels
+		{[]*SiteConfig{newSite("example.com"), newSite("*.example.com"), newSite("")}, "foo.example.com", "*.example.com"},
+		{[]*SiteConfig{newSite("*.example.com")}, "foo.bar.example.com", "404"},
+		// catch-alls, by address or marker
+		{[]*SiteConfig{newSite("example.com"), newSite("*.example.com"), newSite("")}, "other.org", ""},
+		{[]*SiteConfig{newSite("example.com"), newDefaultSite("staging.example.com")}, "other.org", "staging.example.com"},
+		{[]*SiteConfig{newSite("example.com"), newDefaultSite("*.example.com")}, "other.org", "*.example.com"},
+		{[]*SiteConfig{newDefaultSite("example.com"), newSite("staging.example.com")}, "staging.example.com", "staging.example.com"},
+		// no match is served by no site at all
+		{[]*SiteConfig{newSite("example.com"), newSite("staging.example.com")}, "other.org", "404"},
+		{[]*SiteConfig{newSite("example.com"), newSite("staging.example.com")}, "", "404"},
+	} {
+		s, err := NewServer("127.0.0.1:0", test.sites)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if test.expected == "404" {
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("Test %d: Expected 404 for host %q, got %d %q", i, test.host, rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		if got := rec.Body.String(); got != test.expected {
+			t.Errorf("Test %d: Expected host %q to be served by site %q, got %q", i, test.host, test.expected, got)
+		}
+	}
+}
+
+func TestDefaultServerConflicts(t *testing.T) {
+	for i, group := range [][]*SiteConfig{
+		{{Addr: Address{Host: "a.com"}, DefaultServer: true}, {Addr: Address{Host: "b.com"}, DefaultServer: true}},
+		{{Addr: Address{Host: "a.com"}, DefaultServer: true}, {Addr: Address{Host: ""}}},
+		{{Addr: Address{Host: "a.com"}, DefaultServer: true}, {Addr: Address{Host: "0.0.0.0"}}},
+	} {
+		for _, site := range group {
+			site.TLS = new(caddytls.Config)
+		}
+		if _, err := NewServer("127.0.0.1:0", group); err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+	}
+}
+
+func TestCloseUnmatched(t *testing.T) {
+	site := &SiteConfig{Addr: Address{Original: "example.com", Host: "example.com"}, TLS: new(caddytls.Config), CloseUnmatched: true}
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Stop()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	req.Host = "example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected matched host to be served, got: %v", err)
+	}
+	resp.Body.Close()
+
+	req.Host = "other.org"
+	resp, err = client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected connection to be closed for unmatched host, got status %d", resp.StatusCode)
+	}
+}
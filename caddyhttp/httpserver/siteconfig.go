@@ -1,6 +1,12 @@
 package httpserver
 
-import "github.com/mholt/caddy/caddytls"
+import (
+	"net/http"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+	"github.com/mholt/caddy/caddytls"
+)
 
 // SiteConfig contains information about a site
 // (also known as a virtual host).
@@ -12,16 +18,103 @@ type SiteConfig struct {
 	// defaults to Addr.Host
 	ListenHost string
 
+	// The hostnames to bind listeners to, one
+	// listener for each; if empty, ListenHost
+	// is used. ListenHost is the first of them.
+	ListenHosts []string
+
+	// Permissions and ownership of the socket
+	// file if Addr is a Unix socket; nil means
+	// to use the process defaults
+	Socket *SocketOptions
+
 	// TLS configuration
 	TLS *caddytls.Config
 
+	// How to redirect plaintext HTTP requests to
+	// this site when HTTPS is enabled automatically;
+	// nil means to use the default redirect
+	HTTPSRedirect *RedirectConfig
+
+	// The host this site is served at, which is either
+	// its own host or the www or non-www form of it;
+	// requests for the other form are redirected to it
+	CanonicalHost string
+
+	// Paths that can be requested without a TLS
+	// client certificate, even if the TLS config
+	// requires one; they match the paths they are
+	// a prefix of, as the paths of directives do
+	ClientAuthExempt []string
+
+	// Whether to serve HTTP/2 over cleartext
+	// (h2c) on this site's plaintext listener
+	H2C bool
+
+	// How long to wait for connections to finish
+	// when the server stops; 0 means to use the
+	// GracefulTimeout
+	GracePeriod time.Duration
+
+	// How many connections this site's listener
+	// allows at a time, in all and from one IP
+	// address; 0 means no limit
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// Whether this site receives the requests on
+	// its listener whose Host matches no site
+	DefaultServer bool
+
+	// Whether requests on this site's listener whose
+	// Host matches no site have their connection closed
+	// instead of getting a 404, if there is no catch-all
+	// site on the listener
+	CloseUnmatched bool
+
+	// Whether requests on this site's listener that
+	// could be taken for different requests by a
+	// backend, like ones whose Host header does not
+	// match their target, are served instead of
+	// rejected
+	AllowAmbiguousRequests bool
+
+	// Whether the requests that this path-scoped site
+	// finds nothing for are served by the site with the
+	// next shorter path of its host instead
+	Fallthrough bool
+
+	// Whether the path of this path-scoped site is
+	// left in the request path instead of being
+	// trimmed from it before the request is served
+	KeepScopePath bool
+
+	// TLS connections to this site's listener whose
+	// server name (SNI) is a key of Passthrough are
+	// spliced to the value without being terminated
+	Passthrough map[string]Passthrough
+
+	// How the time spent in each middleware of this
+	// site is traced
+	Trace TraceConfig
+
 	// Uncompiled middleware stack
 	middleware []Middleware
 
+	// The names of the directives that added each
+	// middleware, and of the directive being set up
+	middlewareNames []string
+	directive       string
+
 	// Compiled middleware stack
 	middlewareChain Handler
 
-	// Directory from which to serve files
+	// Functions to notify of each served request
+	observers []RequestObserver
+
+	// Directory from which to serve files; if it has
+	// placeholders, the root of each request is only known
+	// then, and is given to the handlers with WithRoot
 	Root string
 
 	// A list of files to hide (for example, the
@@ -30,11 +123,56 @@ type SiteConfig struct {
 	// standardized way of loading files from disk
 	// for a request.
 	HiddenFiles []string
+
+	// The index pages of directories, by the path
+	// they apply under; if none applies, the
+	// staticfiles.IndexPages are used
+	IndexPages []IndexRule
+}
+
+// IndexRule is the list of index pages, in order of
+// preference, of the directories under Path. If Pages
+// is empty, those directories have no index pages.
+type IndexRule struct {
+	Path  string
+	Pages []string
+}
+
+// IndexPagesFor returns the index pages of the directory at
+// urlPath, from the rule with the longest path that matches.
+func (s *SiteConfig) IndexPagesFor(urlPath string) []string {
+	var rule *IndexRule
+	for i := range s.IndexPages {
+		if !Path(urlPath).Matches(s.IndexPages[i].Path) {
+			continue
+		}
+		if rule == nil || len(s.IndexPages[i].Path) > len(rule.Path) {
+			rule = &s.IndexPages[i]
+		}
+	}
+	if rule == nil {
+		return staticfiles.IndexPages
+	}
+	return rule.Pages
 }
 
 // AddMiddleware adds a middleware to a site's middleware stack.
 func (s *SiteConfig) AddMiddleware(m Middleware) {
 	s.middleware = append(s.middleware, m)
+	s.middlewareNames = append(s.middlewareNames, s.directive)
+}
+
+// RequestObserver is a function that is called after a site has
+// served a request. It is passed the status code of the response,
+// the number of bytes written in the response body, and how long
+// it took to serve the request. It must not modify r.
+type RequestObserver func(r *http.Request, status, size int, latency time.Duration)
+
+// AddRequestObserver adds o to the functions that are notified
+// of every request the site serves. Unlike middleware, observers
+// see all requests, regardless of which middleware handles them.
+func (s *SiteConfig) AddRequestObserver(o RequestObserver) {
+	s.observers = append(s.observers, o)
 }
 
 // TLSConfig returns s.TLS.
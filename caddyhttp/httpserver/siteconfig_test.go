@@ -0,0 +1,38 @@
+package httpserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+)
+
+func TestIndexPagesFor(t *testing.T) {
+	s := &SiteConfig{IndexPages: []IndexRule{
+		{Path: "/docs", Pages: []string{"README.html", "index.html"}},
+		{Path: "/", Pages: []string{"index.html"}},
+		{Path: "/docs/api", Pages: nil},
+		{Path: "/docs/api/v2", Pages: []string{"v2.html"}},
+	}}
+	for i, test := range []struct {
+		path     string
+		expected []string
+	}{
+		{"/", []string{"index.html"}},
+		{"/blog/", []string{"index.html"}},
+		{"/docs/", []string{"README.html", "index.html"}},
+		{"/docs/guide/", []string{"README.html", "index.html"}},
+		{"/docs/api/", nil},
+		{"/docs/api/v1/", nil},
+		{"/docs/api/v2/", []string{"v2.html"}},
+	} {
+		if actual := s.IndexPagesFor(test.path); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected index pages %v for %s, got %v", i, test.expected, test.path, actual)
+		}
+	}
+
+	s = &SiteConfig{IndexPages: []IndexRule{{Path: "/docs", Pages: []string{"README.html"}}}}
+	if actual := s.IndexPagesFor("/blog/"); !reflect.DeepEqual(actual, staticfiles.IndexPages) {
+		t.Errorf("Expected default index pages where no rule applies, got %v", actual)
+	}
+}
@@ -0,0 +1,259 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TraceHeader is the request header that turns on tracing for
+// one request, for sites that trace requests with a token.
+const TraceHeader = "X-Caddy-Trace"
+
+// TraceConfig describes how the time spent in each middleware
+// of a site is traced. A traced request has the time of each
+// middleware in its Server-Timing response header, and in the
+// {trace} placeholder.
+type TraceConfig struct {
+	// Always traces every request
+	Always bool
+
+	// Token traces the requests that have it in the TraceHeader
+	Token string
+
+	// Threshold, if not zero, is how long a traced
+	// request can take before it is logged
+	Threshold time.Duration
+}
+
+// enabled returns whether any request of the site may be traced.
+func (tc TraceConfig) enabled() bool {
+	return tc.Always || tc.Token != ""
+}
+
+// traces returns whether r is to be traced. The trace header
+// is removed from r, so that it does not reach an upstream.
+func (tc TraceConfig) traces(r *http.Request) bool {
+	if tc.Token == "" {
+		return tc.Always
+	}
+	token := r.Header.Get(TraceHeader)
+	if token == "" {
+		return tc.Always
+	}
+	r.Header.Del(TraceHeader)
+	return tc.Always || subtle.ConstantTimeCompare([]byte(token), []byte(tc.Token)) == 1
+}
+
+// traceKey is the context key of the trace of a request.
+type traceKey struct{}
+
+// requestTrace is the time spent in each middleware of
+// the chain that serves a request, from the outermost.
+type requestTrace struct {
+	start   time.Time
+	entries []traceEntry
+}
+
+// traceEntry is the time spent in one middleware, including
+// the middleware after it, and the status it returned.
+type traceEntry struct {
+	name    string
+	entered bool
+	active  bool
+	start   time.Time
+	total   time.Duration
+	status  int
+}
+
+// elapsed is the time spent in the middleware,
+// including the time it is still running.
+func (e traceEntry) elapsed(now time.Time) time.Duration {
+	if e.active {
+		return e.total + now.Sub(e.start)
+	}
+	return e.total
+}
+
+// timing is the time a middleware took by itself,
+// and whether it changed the status of the response.
+type timing struct {
+	name     string
+	duration time.Duration
+	status   int
+	changed  bool
+}
+
+// timings returns the time each middleware entered so
+// far took by itself, without the middleware after it.
+func (t *requestTrace) timings(now time.Time) []timing {
+	var timings []timing
+	for i, e := range t.entries {
+		if !e.entered {
+			continue
+		}
+		tm := timing{name: e.name, duration: e.elapsed(now), status: e.status, changed: true}
+		if i+1 < len(t.entries) && t.entries[i+1].entered {
+			next := t.entries[i+1]
+			tm.duration -= next.elapsed(now)
+			tm.changed = !next.active && !e.active && next.status != e.status
+		}
+		timings = append(timings, tm)
+	}
+	return timings
+}
+
+// ServerTiming returns the value of the Server-Timing header.
+func (t *requestTrace) ServerTiming() string {
+	now := time.Now()
+	var parts []string
+	for _, tm := range t.timings(now) {
+		part := fmt.Sprintf("%s;dur=%s", tm.name, millis(tm.duration))
+		if tm.changed {
+			part += `;desc="` + statusDesc(tm.status) + `"`
+		}
+		parts = append(parts, part)
+	}
+	parts = append(parts, "total;dur="+millis(now.Sub(t.start)))
+	return strings.Join(parts, ", ")
+}
+
+// String returns the trace for the {trace} placeholder.
+func (t *requestTrace) String() string {
+	now := time.Now()
+	var parts []string
+	for _, tm := range t.timings(now) {
+		part := tm.name + ":" + millis(tm.duration) + "ms"
+		if tm.changed {
+			part += "[" + statusDesc(tm.status) + "]"
+		}
+		parts = append(parts, part)
+	}
+	parts = append(parts, "total:"+millis(now.Sub(t.start))+"ms")
+	return strings.Join(parts, " ")
+}
+
+// millis formats d in milliseconds.
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// statusDesc describes the status a middleware returned.
+func statusDesc(status int) string {
+	if status == 0 {
+		return "responded"
+	}
+	return strconv.Itoa(status)
+}
+
+// tracedHandler times the middleware at index in the chain
+// of the site, named after the directive that added it.
+type tracedHandler struct {
+	index int
+	name  string
+	next  Handler
+}
+
+// traceChain returns the middleware chain of site, with each
+// of its middleware timed for the requests that are traced.
+func traceChain(site *SiteConfig, fileServer Handler) Handler {
+	stack := Handler(tracedHandler{index: len(site.middleware), name: "fileserver", next: fileServer})
+	for i := len(site.middleware) - 1; i >= 0; i-- {
+		name := "middleware"
+		if i < len(site.middlewareNames) && site.middlewareNames[i] != "" {
+			name = site.middlewareNames[i]
+		}
+		stack = tracedHandler{index: i, name: name, next: site.middleware[i](stack)}
+	}
+	return stack
+}
+
+func (h tracedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	t, ok := r.Context().Value(traceKey{}).(*requestTrace)
+	if !ok || h.index >= len(t.entries) {
+		return h.next.ServeHTTP(w, r)
+	}
+	e := &t.entries[h.index]
+	e.name, e.entered, e.active, e.start = h.name, true, true, time.Now()
+	if req, outer := enterMiddleware(r, h.name); req != nil {
+		defer req.middleware.Store(outer)
+	}
+	status, err := h.next.ServeHTTP(w, r)
+	e.total += time.Since(e.start)
+	e.active, e.status = false, status
+	return status, err
+}
+
+// serveTraced serves r with the middleware chain of vhost,
+// and puts the time each middleware took in the response.
+func serveTraced(w http.ResponseWriter, r *http.Request, vhost *SiteConfig) (int, error) {
+	t := &requestTrace{start: time.Now(), entries: make([]traceEntry, len(vhost.middleware)+1)}
+	r = r.WithContext(context.WithValue(r.Context(), traceKey{}, t))
+	r = WithPlaceholder(r, "trace", t.String)
+	tw := &traceWriter{ResponseWriterWrapper: ResponseWriterWrapper{ResponseWriter: w}, trace: t}
+	status, err := vhost.middlewareChain.ServeHTTP(tw, r)
+	if !tw.wrote {
+		// the error response is written after the chain
+		tw.setHeader()
+	}
+	if total := time.Since(t.start); vhost.Trace.Threshold > 0 && total > vhost.Trace.Threshold {
+		log.Printf("[WARNING] %s %s took %v: %s", r.Method, r.URL.RequestURI(), total, t)
+	}
+	return status, err
+}
+
+// traceWriter puts the trace of a request in the
+// Server-Timing header when the header is written.
+type traceWriter struct {
+	ResponseWriterWrapper
+	trace *requestTrace
+	wrote bool
+}
+
+func (w *traceWriter) setHeader() {
+	w.wrote = true
+	w.Header().Set("Server-Timing", w.trace.ServerTiming())
+}
+
+// WriteHeader sets the Server-Timing header and
+// writes the header of the response.
+func (w *traceWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.setHeader()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the response, after its header.
+func (w *traceWriter) Write(buf []byte) (int, error) {
+	if !w.wrote {
+		w.setHeader()
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// Hijack implements http.Hijacker. The response of
+// a hijacked connection has no Server-Timing header.
+func (w *traceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriterWrapper.Hijack()
+	if err == nil {
+		w.wrote = true
+	}
+	return conn, brw, err
+}
+
+// Flush implements http.Flusher. It sets the Server-Timing
+// header if it was not set yet, and then flushes.
+func (w *traceWriter) Flush() {
+	if !w.wrote {
+		w.setHeader()
+	}
+	w.ResponseWriterWrapper.Flush()
+}
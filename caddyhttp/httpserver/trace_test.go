@@ -0,0 +1,173 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+// traceTestSite returns a site whose middleware, named auth, cache
+// and respond, take at least 10, 20 and 5 milliseconds by themselves;
+// respond answers with status, writing it if written is true.
+func traceTestSite(trace TraceConfig, status int, written bool, placeholder *string) *SiteConfig {
+	site := &SiteConfig{Addr: Address{Original: "example.com", Host: "example.com"}, TLS: new(caddytls.Config), Trace: trace}
+	for _, m := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"auth", 10 * time.Millisecond},
+		{"cache", 20 * time.Millisecond},
+	} {
+		m := m
+		site.directive = m.name
+		site.AddMiddleware(func(next Handler) Handler {
+			return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				time.Sleep(m.delay)
+				if r.Header.Get(TraceHeader) != "" {
+					w.Header().Set("X-Saw-Trace-Header", "yes")
+				}
+				status, err := next.ServeHTTP(w, r)
+				if m.name == "auth" {
+					*placeholder = NewReplacer(r, nil, "-").Replace("{trace}")
+				}
+				return status, err
+			})
+		})
+	}
+	site.directive = "respond"
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			time.Sleep(5 * time.Millisecond)
+			if !written {
+				return status, nil
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("traced"))
+			return 0, nil
+		})
+	})
+	return site
+}
+
+var serverTimingEntry = regexp.MustCompile(`^(\w+);dur=(\d+\.\d{3})(;desc="(\w+)")?$`)
+
+func TestTraceServerTiming(t *testing.T) {
+	for i, test := range []struct {
+		status  int
+		written bool
+		desc    string
+	}{
+		{http.StatusOK, true, "responded"},
+		{http.StatusNotFound, false, "404"},
+	} {
+		var placeholder string
+		site := traceTestSite(TraceConfig{Always: true}, test.status, test.written, &placeholder)
+		s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error creating server, got: %v", i, err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		header := w.Header().Get("Server-Timing")
+		entries := strings.Split(header, ", ")
+		if len(entries) != 4 {
+			t.Fatalf("Test %d: Expected the three middleware and the total in Server-Timing, got '%s'", i, header)
+		}
+		for j, expected := range []struct {
+			name    string
+			atLeast time.Duration
+			atMost  time.Duration
+			desc    string
+		}{
+			{"auth", 10 * time.Millisecond, 60 * time.Millisecond, ""},
+			{"cache", 20 * time.Millisecond, 70 * time.Millisecond, ""},
+			{"respond", 5 * time.Millisecond, 55 * time.Millisecond, test.desc},
+			{"total", 35 * time.Millisecond, time.Second, ""},
+		} {
+			match := serverTimingEntry.FindStringSubmatch(entries[j])
+			if match == nil || match[1] != expected.name || match[4] != expected.desc {
+				t.Errorf("Test %d: Expected entry %d to be %s with description '%s', got '%s'",
+					i, j, expected.name, expected.desc, entries[j])
+				continue
+			}
+			ms, _ := strconv.ParseFloat(match[2], 64)
+			if d := time.Duration(ms * float64(time.Millisecond)); d < expected.atLeast || d > expected.atMost {
+				t.Errorf("Test %d: Expected %s to take between %v and %v by itself, got %v",
+					i, expected.name, expected.atLeast, expected.atMost, d)
+			}
+		}
+		if !regexp.MustCompile(`^auth:[\d.]+ms cache:[\d.]+ms respond:[\d.]+ms\[` + test.desc + `\] total:[\d.]+ms$`).MatchString(placeholder) {
+			t.Errorf("Test %d: Expected the trace in the {trace} placeholder, got '%s'", i, placeholder)
+		}
+	}
+}
+
+func TestTraceToken(t *testing.T) {
+	var placeholder string
+	site := traceTestSite(TraceConfig{Token: "s3cret"}, http.StatusOK, true, &placeholder)
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	for i, test := range []struct {
+		token  string
+		traced bool
+	}{
+		{"", false},
+		{"wrong", false},
+		{"s3cret", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "example.com"
+		if test.token != "" {
+			r.Header.Set(TraceHeader, test.token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Server-Timing") != ""; got != test.traced {
+			t.Errorf("Test %d: Expected traced to be %v, got Server-Timing '%s'", i, test.traced, w.Header().Get("Server-Timing"))
+		}
+		if w.Header().Get("X-Saw-Trace-Header") != "" {
+			t.Errorf("Test %d: Expected the middleware not to see the trace header", i)
+		}
+		if !test.traced && placeholder != "-" {
+			t.Errorf("Test %d: Expected no {trace} placeholder, got '%s'", i, placeholder)
+		}
+	}
+}
+
+func TestTraceOff(t *testing.T) {
+	var placeholder string
+	site := traceTestSite(TraceConfig{}, http.StatusOK, true, &placeholder)
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("Expected no error creating server, got: %v", err)
+	}
+	if _, ok := site.middlewareChain.(tracedHandler); ok {
+		t.Error("Expected the middleware not to be wrapped when tracing is off")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "example.com"
+	r.Header.Set(TraceHeader, "anything")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := w.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("Expected no Server-Timing header when tracing is off, got '%s'", got)
+	}
+	if w.Header().Get("X-Saw-Trace-Header") == "" {
+		t.Error("Expected the trace header to be left alone when tracing is off")
+	}
+}
@@ -0,0 +1,63 @@
+package httpserver
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Traffic counts the bytes of the HTTP message bodies that pass
+// through a site or a proxy upstream in each direction, from the
+// point of view of the server. The bytes of headers and of the TLS
+// records are not counted. Its methods are safe for concurrent use.
+type Traffic struct {
+	received uint64 // must be first fields to be 64-bit aligned on 32-bit systems
+	sent     uint64
+}
+
+// TrafficCounts is a snapshot of the counts of a Traffic.
+type TrafficCounts struct {
+	Received uint64 `json:"received"`
+	Sent     uint64 `json:"sent"`
+}
+
+// Counts returns the bytes counted so far.
+func (t *Traffic) Counts() TrafficCounts {
+	return TrafficCounts{
+		Received: atomic.LoadUint64(&t.received),
+		Sent:     atomic.LoadUint64(&t.sent),
+	}
+}
+
+// AddReceived counts n bytes as received.
+func (t *Traffic) AddReceived(n int) {
+	atomic.AddUint64(&t.received, uint64(n))
+}
+
+// AddSent counts n bytes as sent.
+func (t *Traffic) AddSent(n int) {
+	atomic.AddUint64(&t.sent, uint64(n))
+}
+
+// CountReceived returns body such that the bytes read from it are
+// counted as received, as they are when it is the body of a request
+// from a client or of a response from an upstream.
+func (t *Traffic) CountReceived(body io.ReadCloser) io.ReadCloser {
+	return countingBody{ReadCloser: body, count: &t.received}
+}
+
+// CountSent returns body such that the bytes read from it are counted
+// as sent, as they are when it is the body of a request to an upstream.
+func (t *Traffic) CountSent(body io.ReadCloser) io.ReadCloser {
+	return countingBody{ReadCloser: body, count: &t.sent}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	count *uint64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddUint64(b.count, uint64(n))
+	return n, err
+}
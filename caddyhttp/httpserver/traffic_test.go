@@ -0,0 +1,22 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTraffic(t *testing.T) {
+	var traffic Traffic
+	if _, err := ioutil.ReadAll(traffic.CountReceived(ioutil.NopCloser(strings.NewReader("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(traffic.CountSent(ioutil.NopCloser(strings.NewReader("hi")))); err != nil {
+		t.Fatal(err)
+	}
+	traffic.AddSent(10)
+	traffic.AddReceived(1)
+	if got, want := traffic.Counts(), (TrafficCounts{Received: 6, Sent: 12}); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
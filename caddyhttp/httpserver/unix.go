@@ -0,0 +1,155 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixAddrPrefix is the prefix of site addresses and
+// listener addresses that refer to Unix domain sockets.
+const unixAddrPrefix = "unix:"
+
+// SocketOptions configures the file that backs a
+// Unix domain socket listener.
+type SocketOptions struct {
+	// Mode is the permission bits to set on the
+	// socket file; 0 keeps the umask default.
+	Mode os.FileMode
+
+	// UID and GID are the owner and group to give
+	// the socket file; -1 leaves either unchanged.
+	UID, GID int
+}
+
+// unixSocketPath returns the socket path of addr and
+// true if addr is the address of a Unix socket.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddrPrefix), true
+}
+
+// listenUnix creates a listener on the Unix socket at path,
+// removing a stale socket file first and then applying opts
+// (which may be nil) to the new socket file. The socket file
+// is not removed when the listener is closed, because the
+// listener may be handed to a new server during a graceful
+// restart; call removeSocketIfUnused to clean up.
+func listenUnix(path string, opts *SocketOptions) (*net.UnixListener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+
+	if opts != nil {
+		if opts.Mode != 0 {
+			if err := os.Chmod(path, opts.Mode); err != nil {
+				ln.Close()
+				os.Remove(path)
+				return nil, err
+			}
+		}
+		if opts.UID != -1 || opts.GID != -1 {
+			if err := os.Chown(path, opts.UID, opts.GID); err != nil {
+				ln.Close()
+				os.Remove(path)
+				return nil, err
+			}
+		}
+	}
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path if
+// nothing is accepting connections on it. It is an error
+// if the file is not a socket or if the socket is in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: file exists and is not a socket", path)
+	}
+	if socketInUse(path) {
+		return fmt.Errorf("%s: socket is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// removeSocketIfUnused removes the socket file at path
+// unless another listener (for example, one inherited by
+// a new server during a restart) is still serving on it.
+func removeSocketIfUnused(path string) {
+	if !socketInUse(path) {
+		os.Remove(path)
+	}
+}
+
+// socketInUse returns true if a connection to the Unix
+// socket at path can be established.
+func socketInUse(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// unixListener wraps a Unix socket listener so that the
+// connections it accepts report their peer's credentials
+// as their remote address.
+type unixListener struct {
+	*net.UnixListener
+}
+
+// Accept accepts the next connection on ln.
+func (ln unixListener) Accept() (net.Conn, error) {
+	c, err := ln.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{UnixConn: c, peer: unixPeerAddr(peerCredentials(c))}, nil
+}
+
+// File implements caddy.Listener; it returns the underlying file of the listener.
+func (ln unixListener) File() (*os.File, error) {
+	return ln.UnixListener.File()
+}
+
+// unixConn is a connection accepted on a Unix socket.
+type unixConn struct {
+	*net.UnixConn
+	peer net.Addr
+}
+
+// RemoteAddr returns the peer's credentials, if known.
+func (c unixConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// unixPeerAddr describes the client end of a Unix socket
+// connection. Such clients have no network address, so
+// this is the peer's process credentials where the platform
+// provides them, or simply "unix" otherwise.
+type unixPeerAddr string
+
+// Network returns "unix".
+func (a unixPeerAddr) Network() string { return "unix" }
+
+// String returns the peer description.
+func (a unixPeerAddr) String() string { return string(a) }
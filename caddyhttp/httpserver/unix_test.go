@@ -0,0 +1,171 @@
+// +build !windows
+
+package httpserver
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddytls"
+)
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "site.sock")
+
+	addr, err := standardizeAddress("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &SiteConfig{
+		Addr:   addr,
+		Root:   dir,
+		TLS:    new(caddytls.Config),
+		Socket: &SocketOptions{Mode: 0600, UID: os.Getuid(), GID: os.Getgid()},
+	}
+	site.AddMiddleware(func(next Handler) Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte(NewReplacer(r, nil, "-").Replace("{remote} {host}")))
+			return 0, nil
+		})
+	})
+
+	groups, err := groupSiteConfigsByListenAddr([]*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := groups["unix:"+socket]; !ok || len(groups) != 1 {
+		t.Fatalf("Expected site to be grouped by its socket, got %v", groups)
+	}
+
+	s, err := NewServer("unix:"+socket, []*SiteConfig{site})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error listening, got: %v", err)
+	}
+	go s.Serve(ln)
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0600 {
+		t.Errorf("Expected socket permissions 0600, got %o", got)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatalf("Expected no error making request, got: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasSuffix(string(body), " example.com") {
+		t.Errorf("Expected request to be served by site on socket, got: %s", body)
+	}
+	if strings.HasPrefix(string(body), "- ") {
+		t.Errorf("Expected remote placeholder to describe the peer, got: %s", body)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Expected no error stopping, got: %v", err)
+	}
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed after stop, got: %v", err)
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "stale.sock")
+
+	// leave a socket file behind with nothing listening on it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(socket); err != nil {
+		t.Fatalf("Expected stale socket file to exist: %v", err)
+	}
+
+	ln, err := listenUnix(socket, nil)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got: %v", err)
+	}
+
+	// a socket that is in use must not be replaced
+	if _, err := listenUnix(socket, nil); err == nil {
+		t.Error("Expected error listening on a socket that is in use")
+	}
+	ln.Close()
+
+	// ...and neither should a file that is not a socket
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(regular, nil); err == nil {
+		t.Error("Expected error listening on a path that is a regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("Expected regular file to be left alone, got: %v", err)
+	}
+}
+
+func TestListenUnixPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, mode := range []os.FileMode{0600, 0660, 0666} {
+		socket := filepath.Join(dir, "perm.sock")
+		ln, err := listenUnix(socket, &SocketOptions{Mode: mode, UID: -1, GID: -1})
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		info, err := os.Stat(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			t.Errorf("Test %d: Expected permissions %o, got %o", i, mode, got)
+		}
+		ln.Close()
+		removeSocketIfUnused(socket)
+	}
+
+	// changing ownership to a user we are not allowed to become fails
+	if os.Getuid() != 0 {
+		socket := filepath.Join(dir, "owner.sock")
+		if _, err := listenUnix(socket, &SocketOptions{UID: 0, GID: -1}); err == nil {
+			t.Error("Expected error changing socket owner without privileges")
+		}
+		if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+			t.Error("Expected socket to be removed after failing to set its owner")
+		}
+	}
+}
@@ -54,35 +54,49 @@ func (t *vhostTrie) insertPath(remainingPath, originalPath string, site *SiteCon
 // If there is no match, nil and empty string will
 // be returned.
 //
+// Hosts are tried from the most to the least specific:
+// the exact host, then wildcard hosts, then the
+// catch-all hosts. The first of them with a site
+// whose path matches wins.
+//
 // A typical key will be in the form "host" or "host/path".
 func (t *vhostTrie) Match(key string) (*SiteConfig, string) {
-	host, path := t.splitHostPath(key)
-	// try the given host, then, if no match, try wildcard hosts
-	branch := t.matchHost(host)
-	if branch == nil {
-		branch = t.matchHost("0.0.0.0")
-	}
-	if branch == nil {
-		branch = t.matchHost("")
-	}
-	if branch == nil {
+	sites, paths := t.MatchScopes(key)
+	if len(sites) == 0 {
 		return nil, ""
 	}
-	node := branch.matchPath(path)
-	if node == nil {
-		return nil, ""
+	return sites[0], paths[0]
+}
+
+// MatchScopes is like Match, but it returns all of the sites
+// of the host that matches whose paths match key, from the
+// longest path to the shortest, with their paths.
+func (t *vhostTrie) MatchScopes(key string) ([]*SiteConfig, []string) {
+	host, path := t.splitHostPath(key)
+	for _, branch := range t.matchHosts(host) {
+		if nodes := branch.matchPaths(path); len(nodes) > 0 {
+			sites, paths := make([]*SiteConfig, len(nodes)), make([]string, len(nodes))
+			for i, node := range nodes {
+				sites[i], paths[i] = node.site, node.path
+			}
+			return sites, paths
+		}
 	}
-	return node.site, node.path
+	return nil, nil
 }
 
-// matchHost returns the vhostTrie matching host. The matching
-// algorithm is the same as used to match certificates to host
-// with SNI during TLS handshakes. In other words, it supports,
+// matchHosts returns the vhostTries matching host, from
+// the most to the least specific. The matching algorithm
+// is the same as used to match certificates to host with
+// SNI during TLS handshakes. In other words, it supports,
 // to some degree, the use of wildcard (*) characters.
-func (t *vhostTrie) matchHost(host string) *vhostTrie {
+// The catch-all hosts "0.0.0.0", "" and "*" match any host.
+func (t *vhostTrie) matchHosts(host string) []*vhostTrie {
+	var branches []*vhostTrie
+
 	// try exact match
 	if subtree, ok := t.edges[host]; ok {
-		return subtree
+		branches = append(branches, subtree)
 	}
 
 	// then try replacing labels in the host
@@ -91,18 +105,25 @@ func (t *vhostTrie) matchHost(host string) *vhostTrie {
 	for i := range labels {
 		labels[i] = "*"
 		candidate := strings.Join(labels, ".")
-		if subtree, ok := t.edges[candidate]; ok {
-			return subtree
+		if subtree, ok := t.edges[candidate]; ok && candidate != host {
+			branches = append(branches, subtree)
+		}
+	}
+
+	for _, catchAll := range []string{"0.0.0.0", "", "*"} {
+		if subtree, ok := t.edges[catchAll]; ok && catchAll != host {
+			branches = append(branches, subtree)
 		}
 	}
 
-	return nil
+	return branches
 }
 
-// matchPath traverses t until it finds the longest key matching
-// remainingPath, and returns its node.
-func (t *vhostTrie) matchPath(remainingPath string) *vhostTrie {
-	var longestMatch *vhostTrie
+// matchPaths traverses t until it finds the longest key matching
+// remainingPath, and returns the nodes of all of the keys matching
+// it along the way, from the longest key to the shortest.
+func (t *vhostTrie) matchPaths(remainingPath string) []*vhostTrie {
+	var matches []*vhostTrie
 	for len(remainingPath) > 0 {
 		ch := string(remainingPath[0])
 		next, ok := t.edges[ch]
@@ -110,12 +131,12 @@ func (t *vhostTrie) matchPath(remainingPath string) *vhostTrie {
 			break
 		}
 		if next.site != nil {
-			longestMatch = next
+			matches = append([]*vhostTrie{next}, matches...)
 		}
 		t = next
 		remainingPath = remainingPath[1:]
 	}
-	return longestMatch
+	return matches
 }
 
 // splitHostPath separates host from path in key.
@@ -33,6 +33,36 @@ func TestVHostTrie(t *testing.T) {
 	}, false)
 }
 
+func TestVHostTrieMatchScopes(t *testing.T) {
+	trie := newVHostTrie()
+	populateTestTrie(trie, []string{
+		"example.com",
+		"example.com/blog",
+		"example.com/blog/2017",
+		"",
+	})
+	for i, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"example.com/blog/2017/post", []string{"/blog/2017", "/blog", "/"}},
+		{"example.com/blog/post", []string{"/blog", "/"}},
+		{"example.com/about", []string{"/"}},
+		{"other.com/blog", []string{"/"}},
+	} {
+		sites, paths := trie.MatchScopes(test.query)
+		if len(sites) != len(test.expected) || len(paths) != len(test.expected) {
+			t.Errorf("Test %d: Expected %d sites for %s, got %d", i, len(test.expected), test.query, len(sites))
+			continue
+		}
+		for j, path := range test.expected {
+			if paths[j] != path {
+				t.Errorf("Test %d: Expected site %d to have path %s, got %s", i, j, path, paths[j])
+			}
+		}
+	}
+}
+
 func TestVHostTrieWildcard1(t *testing.T) {
 	trie := newVHostTrie()
 	populateTestTrie(trie, []string{
@@ -0,0 +1,88 @@
+package httpsredirect
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("https_redirect", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupHTTPSRedirect,
+	})
+}
+
+// setupHTTPSRedirect configures the redirect from HTTP to HTTPS
+// which is made for sites that are served with automatic HTTPS.
+//
+//	https_redirect off
+//	https_redirect [status] {
+//	    port        <port>
+//	    strip_query
+//	    except      <paths...>
+//	}
+func setupHTTPSRedirect(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	rc := new(httpserver.RedirectConfig)
+	for c.Next() {
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			if args[0] == "off" {
+				rc.Disabled = true
+				break
+			}
+			code, err := strconv.Atoi(args[0])
+			if err != nil || !validRedirectCode(code) {
+				return c.Errf("Invalid redirect status code '%s'; must be 301, 302, 307 or 308", args[0])
+			}
+			rc.Code = code
+		default:
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			if rc.Disabled {
+				return c.Err("Cannot configure a redirect that is turned off")
+			}
+			switch c.Val() {
+			case "port":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				if port, err := strconv.Atoi(c.Val()); err != nil || port < 1 || port > 65535 {
+					return c.Errf("Invalid port '%s'", c.Val())
+				}
+				rc.Port = c.Val()
+			case "strip_query":
+				if c.NextArg() {
+					return c.ArgErr()
+				}
+				rc.StripQuery = true
+			case "except":
+				paths := c.RemainingArgs()
+				if len(paths) == 0 {
+					return c.ArgErr()
+				}
+				rc.Except = append(rc.Except, paths...)
+			default:
+				return c.Errf("Unknown https_redirect option '%s'", c.Val())
+			}
+		}
+	}
+	config.HTTPSRedirect = rc
+	return nil
+}
+
+func validRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
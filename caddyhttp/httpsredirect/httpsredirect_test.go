@@ -0,0 +1,52 @@
+package httpsredirect
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupHTTPSRedirect(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  httpserver.RedirectConfig
+	}{
+		{`https_redirect`, false, httpserver.RedirectConfig{}},
+		{`https_redirect off`, false, httpserver.RedirectConfig{Disabled: true}},
+		{`https_redirect 301`, false, httpserver.RedirectConfig{Code: 301}},
+		{`https_redirect 302`, false, httpserver.RedirectConfig{Code: 302}},
+		{`https_redirect 307`, false, httpserver.RedirectConfig{Code: 307}},
+		{`https_redirect 308`, false, httpserver.RedirectConfig{Code: 308}},
+		{"https_redirect 308 {\nport 8443\nstrip_query\nexcept /health /status\n}", false,
+			httpserver.RedirectConfig{Code: 308, Port: "8443", StripQuery: true, Except: []string{"/health", "/status"}}},
+		{"https_redirect {\nexcept /a\nexcept /b\n}", false,
+			httpserver.RedirectConfig{Except: []string{"/a", "/b"}}},
+		{`https_redirect 200`, true, httpserver.RedirectConfig{}},
+		{`https_redirect foo`, true, httpserver.RedirectConfig{}},
+		{`https_redirect 301 302`, true, httpserver.RedirectConfig{}},
+		{"https_redirect off {\nport 8443\n}", true, httpserver.RedirectConfig{}},
+		{"https_redirect {\nport 0\n}", true, httpserver.RedirectConfig{}},
+		{"https_redirect {\nexcept\n}", true, httpserver.RedirectConfig{}},
+		{"https_redirect {\nfoo\n}", true, httpserver.RedirectConfig{}},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupHTTPSRedirect(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		got := httpserver.GetConfig(c).HTTPSRedirect
+		if got == nil || !reflect.DeepEqual(*got, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package index configures the index pages of the
+// directories of a site, per path.
+package index
+
+import (
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("index", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupIndex,
+	})
+}
+
+// setupIndex parses index directives, which look like:
+//
+//	index [path] page...
+//	index [path] none
+//
+// where the pages are tried in order and none means the
+// directories under path have no index pages, so that they
+// are listed by browse or, without it, forbidden.
+func setupIndex(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		rule := httpserver.IndexRule{Path: "/"}
+		if len(args) > 1 && strings.HasPrefix(args[0], "/") {
+			rule.Path, args = args[0], args[1:]
+		}
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, page := range args {
+			if page == "none" {
+				if len(args) > 1 {
+					return c.Err("none cannot be combined with index pages")
+				}
+				continue
+			}
+			if strings.Contains(page, "/") {
+				return c.Errf("index page '%s' must be a file name", page)
+			}
+			rule.Pages = append(rule.Pages, page)
+		}
+		for _, other := range config.IndexPages {
+			if other.Path == rule.Path {
+				return c.Errf("duplicate index pages for %s", rule.Path)
+			}
+		}
+		config.IndexPages = append(config.IndexPages, rule)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestIndex(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  []httpserver.IndexRule
+	}{
+		{`index index.html`, false, []httpserver.IndexRule{
+			{Path: "/", Pages: []string{"index.html"}},
+		}},
+		{`index /docs README.html index.html
+		  index /docs/api none
+		  index default.htm`, false, []httpserver.IndexRule{
+			{Path: "/docs", Pages: []string{"README.html", "index.html"}},
+			{Path: "/docs/api", Pages: nil},
+			{Path: "/", Pages: []string{"default.htm"}},
+		}},
+		{`index none`, false, []httpserver.IndexRule{
+			{Path: "/", Pages: nil},
+		}},
+		{`index`, true, nil},
+		{`index /docs`, true, nil},
+		{`index /docs none README.html`, true, nil},
+		{`index /docs sub/index.html`, true, nil},
+		{`index /docs a.html
+		  index /docs b.html`, true, nil},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupIndex(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if actual := httpserver.GetConfig(c).IndexPages; !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected index rules %v, got %v", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package internalsrv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+)
+
+// TestProxyRedirect serves a protected file which a proxied
+// backend authorizes the download of, like it is usually done.
+func TestProxyRedirect(t *testing.T) {
+	root, err := ioutil.TempDir("", "caddy_internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "protected"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var large bytes.Buffer
+	for i := 0; large.Len() < 1<<20; i++ {
+		fmt.Fprintf(&large, "line %d\n", i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "protected", "large.txt"), large.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backend authorizes downloads with the right token and
+	// sends a body of its own, which must not be served
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-Accel-Redirect", "/protected/large.txt")
+		w.Header().Set("Content-Disposition", `attachment; filename="large.txt"`)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"authorized": true}`)
+	}))
+	defer backend.Close()
+
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile",
+		strings.NewReader(`proxy /download `+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := Internal{
+		Next: proxy.Proxy{
+			Next:      staticfiles.FileServer{Root: http.Dir(root)},
+			Upstreams: upstreams,
+		},
+		Paths: []string{"/protected"},
+	}
+
+	for i, test := range []struct {
+		url          string
+		rangeHeader  string
+		expectedCode int
+		expectedBody []byte
+	}{
+		{"/protected/large.txt", "", http.StatusNotFound, nil},
+		{"/download?token=wrong", "", http.StatusForbidden, nil},
+		{"/download?token=secret", "", http.StatusOK, large.Bytes()},
+		{"/download?token=secret", "bytes=1000-1999", http.StatusPartialContent, large.Bytes()[1000:2000]},
+		{"/download?token=secret", fmt.Sprintf("bytes=-%d", 100), http.StatusPartialContent, large.Bytes()[large.Len()-100:]},
+	} {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+		}
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		code, _ := im.ServeHTTP(rec, req)
+		if code < 400 {
+			// the response was written
+			code = rec.Code
+		}
+
+		if code != test.expectedCode {
+			t.Errorf("Test %d: Expected status code %d, but got %d", i, test.expectedCode, code)
+		}
+		if test.expectedBody == nil {
+			continue
+		}
+		if !bytes.Equal(rec.Body.Bytes(), test.expectedBody) {
+			t.Errorf("Test %d: Expected body of %d bytes, but got %d bytes", i, len(test.expectedBody), rec.Body.Len())
+		}
+		if got, want := rec.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("Test %d: Expected Content-Type %s, but got %s", i, want, got)
+		}
+		if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="large.txt"` {
+			t.Errorf("Test %d: Expected Content-Disposition of the backend, but got %s", i, got)
+		}
+		if got := rec.Header().Get("X-Accel-Redirect"); got != "" {
+			t.Errorf("Test %d: Expected no X-Accel-Redirect header, but got %s", i, got)
+		}
+	}
+}
+
+func TestProxyRedirectLoop(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accel-Redirect", "/protected/loop")
+	}))
+	defer backend.Close()
+
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile",
+		strings.NewReader(`proxy / `+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := Internal{
+		Next:  proxy.Proxy{Upstreams: upstreams},
+		Paths: []string{"/protected"},
+	}
+
+	req, err := http.NewRequest("GET", "/download", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	if code, _ := im.ServeHTTP(rec, req); code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d for a redirect loop, but got %d", http.StatusInternalServerError, code)
+	}
+}
@@ -7,7 +7,9 @@
 package internalsrv
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -17,44 +19,79 @@ import (
 type Internal struct {
 	Next  httpserver.Handler
 	Paths []string
+
+	// RedirectHeader is the response header that redirects
+	// the request to an internal location; if empty, it is
+	// DefaultRedirectHeader
+	RedirectHeader string
 }
 
+// DefaultRedirectHeader is the response header that redirects
+// to an internal location unless another one is configured.
+const DefaultRedirectHeader = "X-Accel-Redirect"
+
 const (
-	redirectHeader        string = "X-Accel-Redirect"
 	contentLengthHeader   string = "Content-Length"
 	contentEncodingHeader string = "Content-Encoding"
 	maxRedirectCount      int    = 10
 )
 
-func isInternalRedirect(w http.ResponseWriter) bool {
-	return w.Header().Get(redirectHeader) != ""
+// upstreamHeaders describe the body of the response that redirected
+// to an internal location; they are removed before that location is
+// served, so they do not end up in the response describing another
+// body. Other headers, like Content-Disposition, are kept.
+var upstreamHeaders = []string{
+	contentLengthHeader,
+	contentEncodingHeader,
+	"Content-Type",
+	"Content-Range",
+	"Accept-Ranges",
+	"Etag",
+	"Last-Modified",
 }
 
 // ServeHTTP implements the httpserver.Handler interface.
 func (i Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	// Internal location requested? -> Not found.
-	for _, prefix := range i.Paths {
-		if httpserver.Path(r.URL.Path).Matches(prefix) {
-			return http.StatusNotFound, nil
-		}
+	if i.isInternal(r.URL.Path) {
+		return http.StatusNotFound, nil
+	}
+
+	redirectHeader := i.RedirectHeader
+	if redirectHeader == "" {
+		redirectHeader = DefaultRedirectHeader
 	}
 
 	// Use internal response writer to ignore responses that will be
 	// redirected to internal locations
-	iw := internalResponseWriter{ResponseWriter: w}
+	iw := internalResponseWriter{ResponseWriter: w, redirectHeader: redirectHeader}
 	status, err := i.Next.ServeHTTP(iw, r)
 
-	for c := 0; c < maxRedirectCount && isInternalRedirect(iw); c++ {
-		// Redirect - adapt request URL path and send it again
+	for c := 0; c < maxRedirectCount && iw.isInternalRedirect(); c++ {
+		// Redirect - adapt request URL and send it again
 		// "down the chain"
-		r.URL.Path = iw.Header().Get(redirectHeader)
+		target, parseErr := url.Parse(iw.Header().Get(redirectHeader))
 		iw.ClearHeader()
+		if parseErr != nil {
+			return http.StatusInternalServerError, parseErr
+		}
+		if !i.isInternal(target.Path) {
+			return http.StatusInternalServerError, fmt.Errorf("%s to %s, which is not an internal location", redirectHeader, target.Path)
+		}
+		r.URL.Path = target.Path
+		r.URL.RawQuery = target.RawQuery
+
+		// the internal location is served like a download,
+		// whatever the method of the request that authorized it
+		if r.Method != http.MethodHead {
+			r.Method = http.MethodGet
+		}
 
 		status, err = i.Next.ServeHTTP(iw, r)
 	}
 
-	if isInternalRedirect(iw) {
+	if iw.isInternalRedirect() {
 		// Too many redirect cycles
 		iw.ClearHeader()
 		return http.StatusInternalServerError, nil
@@ -63,34 +100,50 @@ func (i Internal) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 	return status, err
 }
 
+// isInternal returns true if path is in an internal location.
+func (i Internal) isInternal(path string) bool {
+	for _, prefix := range i.Paths {
+		if httpserver.Path(path).Matches(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // internalResponseWriter wraps the underlying http.ResponseWriter and ignores
 // calls to Write and WriteHeader if the response should be redirected to an
 // internal location.
 type internalResponseWriter struct {
 	http.ResponseWriter
+	redirectHeader string
+}
+
+func (w internalResponseWriter) isInternalRedirect() bool {
+	return w.Header().Get(w.redirectHeader) != ""
 }
 
 // ClearHeader removes script headers that would interfere with follow up
 // redirect requests.
 func (w internalResponseWriter) ClearHeader() {
-	w.Header().Del(redirectHeader)
-	w.Header().Del(contentLengthHeader)
-	w.Header().Del(contentEncodingHeader)
+	w.Header().Del(w.redirectHeader)
+	for _, header := range upstreamHeaders {
+		w.Header().Del(header)
+	}
 }
 
 // WriteHeader ignores the call if the response should be redirected to an
 // internal location.
 func (w internalResponseWriter) WriteHeader(code int) {
-	if !isInternalRedirect(w) {
+	if !w.isInternalRedirect() {
 		w.ResponseWriter.WriteHeader(code)
 	}
 }
 
-// Write ignores the call if the response should be redirected to an internal
+// Write discards b if the response should be redirected to an internal
 // location.
 func (w internalResponseWriter) Write(b []byte) (int, error) {
-	if isInternalRedirect(w) {
-		return 0, nil
+	if w.isInternalRedirect() {
+		return len(b), nil
 	}
 	return w.ResponseWriter.Write(b)
 }
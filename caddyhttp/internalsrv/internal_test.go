@@ -34,11 +34,18 @@ func TestInternal(t *testing.T) {
 		{"/redirect", 0, "/internal"},
 
 		{"/cycle", http.StatusInternalServerError, ""},
+		{"/escape", http.StatusInternalServerError, ""},
+
+		{"/post", 0, "GET"},
 	}
 
 	var i int
 	for i, test := range tests {
-		req, err := http.NewRequest("GET", test.url, nil)
+		method := "GET"
+		if test.url == "/post" {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, test.url, nil)
 		if err != nil {
 			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
 		}
@@ -98,8 +105,21 @@ func internalTestHandlerFunc(w http.ResponseWriter, r *http.Request) (int, error
 	case "/redirect":
 		w.Header().Set("X-Accel-Redirect", "/internal")
 
-	case "/cycle":
-		w.Header().Set("X-Accel-Redirect", "/cycle")
+	case "/cycle", "/internal/cycle":
+		w.Header().Set("X-Accel-Redirect", "/internal/cycle")
+
+	case "/escape":
+		w.Header().Set("X-Accel-Redirect", "/public")
+
+	case "/post":
+		w.Header().Set("X-Accel-Redirect", "/internal/method")
+		fmt.Fprintf(w, "discarded")
+		return 0, nil
+
+	case "/internal/method":
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, r.Method)
+		return 0, nil
 
 	case "/download":
 		w.Header().Set("X-Accel-Redirect", "/internal/data")
@@ -14,27 +14,43 @@ func init() {
 
 // Internal configures a new Internal middleware instance.
 func setup(c *caddy.Controller) error {
-	paths, err := internalParse(c)
+	internal, err := internalParse(c)
 	if err != nil {
 		return err
 	}
 
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return Internal{Next: next, Paths: paths}
+		internal.Next = next
+		return internal
 	})
 
 	return nil
 }
 
-func internalParse(c *caddy.Controller) ([]string, error) {
-	var paths []string
+func internalParse(c *caddy.Controller) (Internal, error) {
+	var internal Internal
 
 	for c.Next() {
 		if !c.NextArg() {
-			return paths, c.ArgErr()
+			return internal, c.ArgErr()
+		}
+		internal.Paths = append(internal.Paths, c.Val())
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "redirect_header":
+				if !c.NextArg() {
+					return internal, c.ArgErr()
+				}
+				if internal.RedirectHeader != "" && internal.RedirectHeader != c.Val() {
+					return internal, c.Errf("Redirect header already set to %s", internal.RedirectHeader)
+				}
+				internal.RedirectHeader = c.Val()
+			default:
+				return internal, c.Errf("Unknown internal property '%s'", c.Val())
+			}
 		}
-		paths = append(paths, c.Val())
 	}
 
-	return paths, nil
+	return internal, nil
 }
@@ -37,17 +37,39 @@ func TestSetup(t *testing.T) {
 
 func TestInternalParse(t *testing.T) {
 	tests := []struct {
-		inputInternalPaths    string
-		shouldErr             bool
-		expectedInternalPaths []string
+		inputInternalPaths     string
+		shouldErr              bool
+		expectedInternalPaths  []string
+		expectedRedirectHeader string
 	}{
-		{`internal /internal`, false, []string{"/internal"}},
+		{`internal /internal`, false, []string{"/internal"}, ""},
 
 		{`internal /internal1
-		  internal /internal2`, false, []string{"/internal1", "/internal2"}},
+		  internal /internal2`, false, []string{"/internal1", "/internal2"}, ""},
+
+		{`internal /internal1 {
+			redirect_header X-Sendfile
+		  }
+		  internal /internal2`, false, []string{"/internal1", "/internal2"}, "X-Sendfile"},
+
+		{`internal /internal1 {
+			redirect_header X-Sendfile
+		  }
+		  internal /internal2 {
+			redirect_header X-Accel-Redirect
+		  }`, true, []string{"/internal1", "/internal2"}, "X-Sendfile"},
+
+		{`internal /internal {
+			redirect_header
+		  }`, true, []string{"/internal"}, ""},
+
+		{`internal /internal {
+			unknown
+		  }`, true, []string{"/internal"}, ""},
 	}
 	for i, test := range tests {
-		actualInternalPaths, err := internalParse(caddy.NewTestController("http", test.inputInternalPaths))
+		internal, err := internalParse(caddy.NewTestController("http", test.inputInternalPaths))
+		actualInternalPaths := internal.Paths
 
 		if err == nil && test.shouldErr {
 			t.Errorf("Test %d didn't error, but it should have", i)
@@ -65,6 +87,10 @@ func TestInternalParse(t *testing.T) {
 					i, j, test.expectedInternalPaths[j], actualInternalPath)
 			}
 		}
+		if internal.RedirectHeader != test.expectedRedirectHeader {
+			t.Errorf("Test %d expected redirect header %s, but got %s",
+				i, test.expectedRedirectHeader, internal.RedirectHeader)
+		}
 	}
 
 }
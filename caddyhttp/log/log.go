@@ -2,10 +2,12 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
@@ -26,39 +28,94 @@ type Logger struct {
 }
 
 func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	for _, rule := range l.Rules {
-		if httpserver.Path(r.URL.Path).Matches(rule.PathScope) {
-			// Record the response
-			responseRecorder := httpserver.NewResponseRecorder(w)
+	rule := l.match(r)
+	if rule == nil || rule.OutputFile == DiscardLog {
+		return l.Next.ServeHTTP(w, r)
+	}
+
+	// Record the response
+	responseRecorder := httpserver.NewResponseRecorder(w)
+
+	// Attach the Replacer we'll use so that other middlewares can
+	// set their own placeholders if they want to.
+	emptyValue := CommonLogEmptyValue
+	if rule.Format == JSONLogFormat {
+		emptyValue = ""
+	}
+	rep := httpserver.NewReplacer(r, responseRecorder, emptyValue)
+	responseRecorder.Replacer = rep
 
-			// Attach the Replacer we'll use so that other middlewares can
-			// set their own placeholders if they want to.
-			rep := httpserver.NewReplacer(r, responseRecorder, CommonLogEmptyValue)
-			responseRecorder.Replacer = rep
+	// Bon voyage, request!
+	start := time.Now()
+	status, err := l.Next.ServeHTTP(responseRecorder, r)
 
-			// Bon voyage, request!
-			status, err := l.Next.ServeHTTP(responseRecorder, r)
+	if status >= 400 {
+		// There was an error up the chain, but no response has been written yet.
+		// The error must be handled here so the log entry will record the response size.
+		if l.ErrorFunc != nil {
+			l.ErrorFunc(responseRecorder, r, status)
+		} else {
+			// Default failover error handler
+			responseRecorder.WriteHeader(status)
+			fmt.Fprintf(responseRecorder, "%d %s", status, http.StatusText(status))
+		}
+		status = 0
+	}
 
-			if status >= 400 {
-				// There was an error up the chain, but no response has been written yet.
-				// The error must be handled here so the log entry will record the response size.
-				if l.ErrorFunc != nil {
-					l.ErrorFunc(responseRecorder, r, status)
-				} else {
-					// Default failover error handler
-					responseRecorder.WriteHeader(status)
-					fmt.Fprintf(responseRecorder, "%d %s", status, http.StatusText(status))
-				}
-				status = 0
-			}
+	// Write log entry
+	if rule.Format == JSONLogFormat {
+		rule.Log.Println(jsonEntry(rep, responseRecorder, start))
+	} else {
+		rule.Log.Println(rep.Replace(rule.Format))
+	}
 
-			// Write log entry
-			rule.Log.Println(rep.Replace(rule.Format))
+	return status, err
+}
 
-			return status, err
+// match returns the rule with the longest path scope
+// that matches r, or nil if there is none. Only one
+// rule logs a request.
+func (l Logger) match(r *http.Request) *Rule {
+	var rule *Rule
+	for i := range l.Rules {
+		if !httpserver.Path(r.URL.Path).Matches(l.Rules[i].PathScope) {
+			continue
+		}
+		if rule == nil || len(l.Rules[i].PathScope) > len(rule.PathScope) {
+			rule = &l.Rules[i]
 		}
 	}
-	return l.Next.ServeHTTP(w, r)
+	return rule
+}
+
+// jsonEntry returns the log entry of a request in JSON.
+func jsonEntry(rep httpserver.Replacer, rr *httpserver.ResponseRecorder, start time.Time) string {
+	entry, _ := json.Marshal(struct {
+		Time      string `json:"time"`
+		Remote    string `json:"remote"`
+		Host      string `json:"host"`
+		Method    string `json:"method"`
+		URI       string `json:"uri"`
+		Proto     string `json:"proto"`
+		Status    int    `json:"status"`
+		Size      int    `json:"size"`
+		LatencyMs int64  `json:"latency_ms"`
+		Referer   string `json:"referer,omitempty"`
+		UserAgent string `json:"user_agent,omitempty"`
+	}{
+		Time:      start.Format(time.RFC3339),
+		Remote:    rep.Replace("{remote}"),
+		Host:      rep.Replace("{host}"),
+		Method:    rep.Replace("{method}"),
+		URI:       rep.Replace("{uri}"),
+		Proto:     rep.Replace("{proto}"),
+		Status:    rr.Status(),
+		Size:      rr.Size(),
+		LatencyMs: int64(time.Since(start) / time.Millisecond),
+		Referer:   rep.Replace("{>Referer}"),
+		UserAgent: rep.Replace("{>User-Agent}"),
+	})
+	return string(entry)
 }
 
 // Rule configures the logging middleware.
@@ -82,4 +139,9 @@ const (
 	CombinedLogFormat = CommonLogFormat + ` "{>Referer}" "{>User-Agent}"`
 	// DefaultLogFormat is the default log format.
 	DefaultLogFormat = CommonLogFormat
+	// JSONLogFormat logs each request as a JSON object.
+	JSONLogFormat = "{json}"
+	// DiscardLog is the output file of rules whose
+	// requests are not logged.
+	DiscardLog = "off"
 )
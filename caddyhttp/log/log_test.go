@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -60,3 +61,66 @@ func TestLoggedStatus(t *testing.T) {
 		t.Errorf("Expected the log entry to contain 'foobar' (custom placeholder), but it didn't: %s", logged)
 	}
 }
+
+func TestLogScopes(t *testing.T) {
+	var api, access bytes.Buffer
+	logger := Logger{
+		Rules: []Rule{
+			{PathScope: "/", Format: DefaultLogFormat, Log: log.New(&access, "", 0)},
+			{PathScope: "/api", Format: JSONLogFormat, Log: log.New(&api, "", 0)},
+			{PathScope: "/healthz", OutputFile: DiscardLog},
+		},
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("ok"))
+			return 0, nil
+		}),
+	}
+
+	for i, test := range []struct {
+		path      string
+		expectAPI bool
+		expectLog bool
+	}{
+		{"/", false, true},
+		{"/api/users", true, false},
+		{"/apiary", true, false},
+		{"/healthz", false, false},
+		{"/index.html", false, true},
+	} {
+		api.Reset()
+		access.Reset()
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("User-Agent", "test \"agent\"")
+		rec := httptest.NewRecorder()
+		if _, err := logger.ServeHTTP(rec, r); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if rec.Body.String() != "ok" {
+			t.Errorf("Test %d: Expected request to be served, got '%s'", i, rec.Body.String())
+		}
+		if got := strings.Count(api.String(), "\n"); got != map[bool]int{true: 1}[test.expectAPI] {
+			t.Errorf("Test %d: Expected %t for the api log, got %d lines: %s", i, test.expectAPI, got, api.String())
+		}
+		if got := strings.Count(access.String(), "\n"); got != map[bool]int{true: 1}[test.expectLog] {
+			t.Errorf("Test %d: Expected %t for the access log, got %d lines: %s", i, test.expectLog, got, access.String())
+		}
+		if test.expectLog && !strings.Contains(access.String(), `"GET `+test.path+` HTTP/1.1" 200 2`) {
+			t.Errorf("Test %d: Expected common log entry, got: %s", i, access.String())
+		}
+		if test.expectAPI {
+			var entry struct {
+				URI       string `json:"uri"`
+				Status    int    `json:"status"`
+				Size      int    `json:"size"`
+				UserAgent string `json:"user_agent"`
+				Referer   *string
+			}
+			if err := json.Unmarshal(api.Bytes(), &entry); err != nil {
+				t.Fatalf("Test %d: Expected JSON log entry, got error %v: %s", i, err, api.String())
+			}
+			if entry.URI != test.path || entry.Status != 200 || entry.Size != 2 || entry.UserAgent != `test "agent"` || entry.Referer != nil {
+				t.Errorf("Test %d: Unexpected JSON log entry: %s", i, api.String())
+			}
+		}
+	}
+}
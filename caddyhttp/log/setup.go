@@ -23,7 +23,9 @@ func setup(c *caddy.Controller) error {
 			var err error
 			var writer io.Writer
 
-			if rules[i].OutputFile == "stdout" {
+			if rules[i].OutputFile == DiscardLog {
+				continue
+			} else if rules[i].OutputFile == "stdout" {
 				writer = os.Stdout
 			} else if rules[i].OutputFile == "stderr" {
 				writer = os.Stderr
@@ -78,41 +80,49 @@ func logParse(c *caddy.Controller) ([]Rule, error) {
 		args := c.RemainingArgs()
 
 		var logRoller *httpserver.LogRoller
-		if c.NextBlock() {
-			if c.Val() == "rotate" {
+		var blockFormat string
+		for c.NextBlock() {
+			what := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch what {
+			case "rotate":
+				if c.Val() != "{" {
+					return nil, c.ArgErr()
+				}
+				c.IncrNest()
+				var err error
+				logRoller, err = httpserver.ParseRoller(c)
+				if err != nil {
+					return nil, err
+				}
+			case "format":
+				blockFormat = logFormat(c.Val())
 				if c.NextArg() {
-					if c.Val() == "{" {
-						var err error
-						logRoller, err = httpserver.ParseRoller(c)
-						if err != nil {
-							return nil, err
-						}
-						// This part doesn't allow having something after the rotate block
-						if c.Next() {
-							if c.Val() != "}" {
-								return nil, c.ArgErr()
-							}
-						}
-					}
+					return nil, c.ArgErr()
 				}
+			default:
+				return nil, c.Errf("unknown log property '%s'", what)
 			}
 		}
+		var rule Rule
 		if len(args) == 0 {
 			// Nothing specified; use defaults
-			rules = append(rules, Rule{
+			rule = Rule{
 				PathScope:  "/",
 				OutputFile: DefaultLogFilename,
 				Format:     DefaultLogFormat,
 				Roller:     logRoller,
-			})
+			}
 		} else if len(args) == 1 {
 			// Only an output file specified
-			rules = append(rules, Rule{
+			rule = Rule{
 				PathScope:  "/",
 				OutputFile: args[0],
 				Format:     DefaultLogFormat,
 				Roller:     logRoller,
-			})
+			}
 		} else {
 			// Path scope, output file, and maybe a format specified
 
@@ -129,14 +139,41 @@ func logParse(c *caddy.Controller) ([]Rule, error) {
 				}
 			}
 
-			rules = append(rules, Rule{
+			rule = Rule{
 				PathScope:  args[0],
 				OutputFile: args[1],
 				Format:     format,
 				Roller:     logRoller,
-			})
+			}
+		}
+		if blockFormat != "" {
+			if len(args) > 2 {
+				return nil, c.Err("log format given twice")
+			}
+			rule.Format = blockFormat
+		}
+
+		for _, other := range rules {
+			if other.PathScope == rule.PathScope {
+				return nil, c.Errf("duplicate log scope '%s'", rule.PathScope)
+			}
 		}
+		rules = append(rules, rule)
 	}
 
 	return rules, nil
 }
+
+// logFormat returns the format that name stands for
+// in the format property of a log block.
+func logFormat(name string) string {
+	switch name {
+	case "common":
+		return CommonLogFormat
+	case "combined":
+		return CombinedLogFormat
+	case "json":
+		return JSONLogFormat
+	}
+	return name
+}
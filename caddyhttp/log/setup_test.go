@@ -111,6 +111,56 @@ func TestLogParse(t *testing.T) {
 				LocalTime:  true,
 			},
 		}}},
+		{`log /api api.log {
+			format json
+			rotate {
+				size 5
+			}
+		}
+		log / access.log
+		log /healthz off`, false, []Rule{{
+			PathScope:  "/api",
+			OutputFile: "api.log",
+			Format:     JSONLogFormat,
+			Roller: &httpserver.LogRoller{
+				MaxSize:   5,
+				LocalTime: true,
+			},
+		}, {
+			PathScope:  "/",
+			OutputFile: "access.log",
+			Format:     DefaultLogFormat,
+		}, {
+			PathScope:  "/healthz",
+			OutputFile: DiscardLog,
+			Format:     DefaultLogFormat,
+		}}},
+		{`log /api api.log {json}`, false, []Rule{{
+			PathScope:  "/api",
+			OutputFile: "api.log",
+			Format:     JSONLogFormat,
+		}}},
+		{`log access.log {
+			format combined
+		}`, false, []Rule{{
+			PathScope:  "/",
+			OutputFile: "access.log",
+			Format:     CombinedLogFormat,
+		}}},
+		{`log / a.log
+		  log / b.log`, true, nil},
+		{`log /api api.log {common} {
+			format json
+		}`, true, nil},
+		{`log access.log {
+			format
+		}`, true, nil},
+		{`log access.log {
+			color on
+		}`, true, nil},
+		{`log access.log {
+			rotate size
+		}`, true, nil},
 	}
 	for i, test := range tests {
 		c := caddy.NewTestController("http", test.inputLogRules)
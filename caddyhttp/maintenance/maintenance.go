@@ -0,0 +1,160 @@
+// Package maintenance implements a maintenance mode, in which
+// a site answers requests with a maintenance page, except for
+// the ones from allowed clients.
+package maintenance
+
+import (
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// DefaultCheckInterval is how long whether the flag file
+// exists is remembered before it is checked again.
+const DefaultCheckInterval = 2 * time.Second
+
+// Maintenance is middleware that serves a maintenance page
+// while the site is in maintenance.
+type Maintenance struct {
+	Next httpserver.Handler
+
+	// File is the maintenance page; if empty, a short
+	// text is served instead
+	File string
+
+	// Status is the status code of the maintenance page
+	Status int
+
+	// RetryAfter is the value of the Retry-After header;
+	// if 0, the header is not sent
+	RetryAfter time.Duration
+
+	// Allow are the networks of the clients that
+	// bypass the maintenance page
+	Allow []*net.IPNet
+
+	// BypassHeader and BypassCookie are the name and value
+	// of a header or cookie with which requests bypass the
+	// maintenance page; they are not used if their name is empty
+	BypassHeader, BypassHeaderValue string
+	BypassCookie, BypassCookieValue string
+
+	// FlagFile is the file whose existence puts the site in
+	// maintenance; if empty, the site is always in maintenance
+	FlagFile string
+
+	// CheckInterval is how often the existence of
+	// FlagFile is checked; see DefaultCheckInterval
+	CheckInterval time.Duration
+
+	flag *flagCheck // shared by the copies of this value
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (m Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !m.Enabled() || m.bypass(r) {
+		return m.Next.ServeHTTP(w, r)
+	}
+
+	body, contentType := []byte(http.StatusText(m.Status)+"\n"), "text/plain; charset=utf-8"
+	if m.File != "" {
+		page, err := ioutil.ReadFile(m.File)
+		if err != nil {
+			log.Printf("[ERROR] maintenance: reading %s: %v", m.File, err)
+		} else {
+			body, contentType = page, mime.TypeByExtension(filepath.Ext(m.File))
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.RetryAfter/time.Second)))
+	}
+	w.WriteHeader(m.Status)
+	w.Write(body)
+	return 0, nil
+}
+
+// Enabled returns true if the site is in maintenance.
+func (m Maintenance) Enabled() bool {
+	if m.FlagFile == "" {
+		return true
+	}
+	if m.flag == nil {
+		return fileExists(m.FlagFile)
+	}
+	return m.flag.exists(m.FlagFile, m.CheckInterval)
+}
+
+// bypass returns true if r may bypass the maintenance page.
+func (m Maintenance) bypass(r *http.Request) bool {
+	if m.BypassHeader != "" && m.BypassHeaderValue != "" && r.Header.Get(m.BypassHeader) == m.BypassHeaderValue {
+		return true
+	}
+	if m.BypassCookie != "" && m.BypassCookieValue != "" {
+		if cookie, err := r.Cookie(m.BypassCookie); err == nil && cookie.Value == m.BypassCookieValue {
+			return true
+		}
+	}
+	if len(m.Allow) > 0 {
+		if ip := httpserver.ClientIP(r, nil); ip != nil && httpserver.NetworksContain(m.Allow, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagCheck remembers whether the flag file exists
+// for a while, so it is not checked on every request.
+type flagCheck struct {
+	sync.Mutex
+	checked time.Time
+	found   bool
+}
+
+func (f *flagCheck) exists(path string, interval time.Duration) bool {
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	f.Lock()
+	defer f.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= interval {
+		f.found = fileExists(path)
+		f.checked = now
+	}
+	return f.found
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// siteMaintenance keeps the maintenance configuration of each
+// site, so that health checks can report on it.
+var (
+	siteMaintenance   = make(map[*httpserver.SiteConfig]Maintenance)
+	siteMaintenanceMu sync.RWMutex
+)
+
+// InMaintenance returns true if site is in maintenance.
+func InMaintenance(site *httpserver.SiteConfig) bool {
+	siteMaintenanceMu.RLock()
+	m, ok := siteMaintenance[site]
+	siteMaintenanceMu.RUnlock()
+	return ok && m.Enabled()
+}
@@ -0,0 +1,145 @@
+package maintenance
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+var okNext = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Write([]byte("site"))
+	return 0, nil
+})
+
+func serve(h httpserver.Handler, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/page", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMaintenance(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	m := Maintenance{
+		Next:              okNext,
+		File:              "testdata/maintenance.html",
+		Status:            http.StatusServiceUnavailable,
+		RetryAfter:        2 * time.Minute,
+		Allow:             []*net.IPNet{private},
+		BypassHeader:      "X-Maintenance-Bypass",
+		BypassHeaderValue: "letmein",
+		BypassCookie:      "maintenance",
+		BypassCookieValue: "letmein",
+	}
+	page, err := ioutil.ReadFile(m.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		remoteAddr  string
+		header      http.Header
+		maintenance bool
+	}{
+		{"203.0.113.7:1234", nil, true},
+		{"10.1.2.3:1234", nil, false},
+		{"[2001:db8::1]:1234", nil, true},
+		{"203.0.113.7:1234", http.Header{"X-Maintenance-Bypass": {"letmein"}}, false},
+		{"203.0.113.7:1234", http.Header{"X-Maintenance-Bypass": {"wrong"}}, true},
+		{"203.0.113.7:1234", http.Header{"Cookie": {"maintenance=letmein"}}, false},
+		{"203.0.113.7:1234", http.Header{"Cookie": {"maintenance=wrong"}}, true},
+	} {
+		rec := serve(m, test.remoteAddr, test.header)
+		if !test.maintenance {
+			if rec.Code != http.StatusOK || rec.Body.String() != "site" {
+				t.Errorf("Test %d: Expected the site, got %d: %s", i, rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Test %d: Expected status 503, got %d", i, rec.Code)
+		}
+		if rec.Body.String() != string(page) {
+			t.Errorf("Test %d: Expected maintenance page, got: %s", i, rec.Body.String())
+		}
+		for name, value := range map[string]string{
+			"Retry-After":   "120",
+			"Cache-Control": "no-store",
+			"Content-Type":  "text/html; charset=utf-8",
+		} {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("Test %d: Expected %s header '%s', got '%s'", i, name, value, got)
+			}
+		}
+	}
+}
+
+func TestMaintenanceWithoutFile(t *testing.T) {
+	m := Maintenance{Next: okNext, Status: http.StatusTooManyRequests}
+	rec := serve(m, "203.0.113.7:1234", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Expected no Retry-After header, got '%s'", got)
+	}
+	if got, want := rec.Body.String(), "Too Many Requests\n"; got != want {
+		t.Errorf("Expected body '%s', got '%s'", want, got)
+	}
+}
+
+func TestMaintenanceFlagFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag := filepath.Join(dir, "maintenance.flag")
+
+	m := Maintenance{
+		Next:          okNext,
+		Status:        http.StatusServiceUnavailable,
+		RetryAfter:    time.Minute,
+		FlagFile:      flag,
+		CheckInterval: 50 * time.Millisecond,
+		flag:          new(flagCheck),
+	}
+
+	if rec := serve(m, "203.0.113.7:1234", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the site without flag file, got %d", rec.Code)
+	}
+
+	if err := ioutil.WriteFile(flag, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the flag is not checked again right away...
+	if rec := serve(m, "203.0.113.7:1234", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the site until the check interval is over, got %d", rec.Code)
+	}
+	// ...but soon
+	time.Sleep(60 * time.Millisecond)
+	rec := serve(m, "203.0.113.7:1234", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected maintenance after the flag file was created, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After 60, got '%s'", got)
+	}
+
+	os.Remove(flag)
+	time.Sleep(60 * time.Millisecond)
+	if rec := serve(m, "203.0.113.7:1234", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the site after the flag file was removed, got %d", rec.Code)
+	}
+}
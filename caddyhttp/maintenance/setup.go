@@ -0,0 +1,140 @@
+package maintenance
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("maintenance", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Maintenance middleware instance.
+func setup(c *caddy.Controller) error {
+	m, err := maintenanceParse(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+	siteMaintenanceMu.Lock()
+	siteMaintenance[cfg] = m
+	siteMaintenanceMu.Unlock()
+	c.OnShutdown(func() error {
+		siteMaintenanceMu.Lock()
+		delete(siteMaintenance, cfg)
+		siteMaintenanceMu.Unlock()
+		return nil
+	})
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		m.Next = next
+		return m
+	})
+	return nil
+}
+
+func maintenanceParse(c *caddy.Controller) (Maintenance, error) {
+	m := Maintenance{
+		Status:     http.StatusServiceUnavailable,
+		RetryAfter: 5 * time.Minute,
+		flag:       new(flagCheck),
+	}
+
+	if !c.Next() {
+		return m, c.ArgErr()
+	}
+	args := c.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 1:
+		m.File = args[0]
+	default:
+		return m, c.ArgErr()
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "file":
+			if !c.NextArg() {
+				return m, c.ArgErr()
+			}
+			m.File = c.Val()
+		case "status":
+			if !c.NextArg() {
+				return m, c.ArgErr()
+			}
+			status, err := strconv.Atoi(c.Val())
+			if err != nil || status < 400 || status > 599 {
+				return m, c.Errf("Status must be an error status code, got '%s'", c.Val())
+			}
+			m.Status = status
+		case "retry_after":
+			if !c.NextArg() {
+				return m, c.ArgErr()
+			}
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil || dur < 0 {
+				return m, c.Errf("Invalid retry_after duration '%s'", c.Val())
+			}
+			m.RetryAfter = dur
+		case "allow":
+			networks := c.RemainingArgs()
+			if len(networks) == 0 {
+				return m, c.ArgErr()
+			}
+			for _, network := range networks {
+				ipnet, err := httpserver.ParseNetwork(network)
+				if err != nil {
+					return m, c.Err(err.Error())
+				}
+				m.Allow = append(m.Allow, ipnet)
+			}
+		case "bypass_header", "bypass_cookie":
+			option := c.Val()
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return m, c.ArgErr()
+			}
+			if args[0] == "" || args[1] == "" {
+				// an empty value would be matched by
+				// every request that does not have it
+				return m, c.Errf("%s needs a name and a value that are not empty", option)
+			}
+			if option == "bypass_header" {
+				m.BypassHeader, m.BypassHeaderValue = args[0], args[1]
+			} else {
+				m.BypassCookie, m.BypassCookieValue = args[0], args[1]
+			}
+		case "enable_if_file_exists":
+			if !c.NextArg() {
+				return m, c.ArgErr()
+			}
+			m.FlagFile = c.Val()
+			if c.NextArg() {
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil || dur <= 0 {
+					return m, c.Errf("Invalid check interval '%s'", c.Val())
+				}
+				m.CheckInterval = dur
+			}
+		default:
+			return m, c.Errf("Unknown maintenance option '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return m, c.ArgErr()
+		}
+	}
+
+	if c.Next() {
+		return m, c.Err("maintenance may only be used once per site")
+	}
+	return m, nil
+}
@@ -0,0 +1,108 @@
+package maintenance
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `maintenance`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Maintenance)
+	if !ok {
+		t.Fatalf("Expected handler to be type Maintenance, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+	if !InMaintenance(httpserver.GetConfig(c)) {
+		t.Error("Expected site to be in maintenance")
+	}
+}
+
+func TestMaintenanceParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		check     func(Maintenance) bool
+	}{
+		{`maintenance`, false, func(m Maintenance) bool {
+			return m.Status == http.StatusServiceUnavailable && m.RetryAfter == 5*time.Minute && m.File == ""
+		}},
+		{`maintenance /srv/maintenance.html`, false, func(m Maintenance) bool {
+			return m.File == "/srv/maintenance.html"
+		}},
+		{`maintenance {
+			file /srv/maintenance.html
+			status 502
+			retry_after 30s
+			allow 10.0.0.0/8 192.168.1.7 ::1
+			bypass_header X-Bypass secret
+			bypass_cookie bypass secret2
+			enable_if_file_exists /tmp/maintenance.flag 1s
+		}`, false, func(m Maintenance) bool {
+			return m.File == "/srv/maintenance.html" && m.Status == 502 && m.RetryAfter == 30*time.Second &&
+				len(m.Allow) == 3 && m.Allow[1].String() == "192.168.1.7/32" && m.Allow[2].String() == "::1/128" &&
+				m.BypassHeader == "X-Bypass" && m.BypassHeaderValue == "secret" &&
+				m.BypassCookie == "bypass" && m.BypassCookieValue == "secret2" &&
+				m.FlagFile == "/tmp/maintenance.flag" && m.CheckInterval == time.Second
+		}},
+		{`maintenance a b`, true, nil},
+		{`maintenance {
+			status 200
+		}`, true, nil},
+		{`maintenance {
+			allow 10.0.0.0/33
+		}`, true, nil},
+		{`maintenance {
+			allow nonsense
+		}`, true, nil},
+		{`maintenance {
+			bypass_header X-Bypass
+		}`, true, nil},
+		{`maintenance {
+			bypass_header X-Bypass ""
+		}`, true, nil},
+		{`maintenance {
+			bypass_cookie "" secret
+		}`, true, nil},
+		{`maintenance {
+			enable_if_file_exists /tmp/flag soon
+		}`, true, nil},
+		{`maintenance {
+			file a b
+		}`, true, nil},
+		{`maintenance {
+			unknown
+		}`, true, nil},
+		{`maintenance
+		  maintenance`, true, nil},
+	}
+	for i, test := range tests {
+		m, err := maintenanceParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !test.check(m) {
+			t.Errorf("Test %d: Unexpected configuration: %#v", i, m)
+		}
+	}
+}
@@ -68,6 +68,11 @@ func (md Markdown) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error
 		return md.Next.ServeHTTP(w, r) // exit early
 	}
 
+	if root, ok := httpserver.RequestRoot(r); ok {
+		md.Root = root
+		md.FileSys = httpserver.RequestFileSystem(r, md.FileSys)
+	}
+
 	// We only deal with HEAD/GET
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
@@ -0,0 +1,52 @@
+package maxconns
+
+import (
+	"strconv"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("max_connections", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupMaxConns,
+	})
+	caddy.RegisterPlugin("max_connections_per_ip", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupMaxConnsPerIP,
+	})
+}
+
+// setupMaxConns configures how many connections the listener of
+// a site allows at a time. Connections beyond that are closed as
+// soon as they are accepted. The sites of a listener must agree;
+// if one of them sets no limit, the listener has none.
+func setupMaxConns(c *caddy.Controller) error {
+	return parseLimit(c, &httpserver.GetConfig(c).MaxConns)
+}
+
+// setupMaxConnsPerIP configures how many connections the listener
+// of a site allows from one IP address at a time.
+func setupMaxConnsPerIP(c *caddy.Controller) error {
+	return parseLimit(c, &httpserver.GetConfig(c).MaxConnsPerIP)
+}
+
+// parseLimit parses the one limit of the directive into limit.
+func parseLimit(c *caddy.Controller, limit *int) error {
+	for c.Next() {
+		directive := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n <= 0 {
+			return c.Errf("%s must be a positive number, got '%s'", directive, c.Val())
+		}
+		*limit = n
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package maxconns
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupMaxConns(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		perIP     bool
+		limit     int
+	}{
+		{`max_connections 1000`, false, false, 1000},
+		{`max_connections_per_ip 50`, false, true, 50},
+		{`max_connections`, true, false, 0},
+		{`max_connections many`, true, false, 0},
+		{`max_connections 0`, true, false, 0},
+		{`max_connections_per_ip -1`, true, true, 0},
+		{`max_connections 10 20`, true, false, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		setup, got := setupMaxConns, &httpserver.GetConfig(c).MaxConns
+		if test.perIP {
+			setup, got = setupMaxConnsPerIP, &httpserver.GetConfig(c).MaxConnsPerIP
+		}
+		err := setup(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if !test.shouldErr && *got != test.limit {
+			t.Errorf("Test %d: Expected limit %d, got %d", i, test.limit, *got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package method is middleware that overrides the method of
+// requests from a header, for clients that can only send GET and
+// POST, and that rejects requests with methods a path does not
+// allow.
+package method
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// DefaultOverrideMethods are the methods a request can be
+// overridden to if no others are configured.
+var DefaultOverrideMethods = []string{"PUT", "PATCH", "DELETE"}
+
+// Method is middleware that applies the override rule with the
+// longest path that matches a request, and then the allow rule
+// with the longest path that matches it.
+type Method struct {
+	Next      httpserver.Handler
+	Overrides []Override
+	Allows    []Allow
+}
+
+// Override is a rule that sets the method of the POST requests
+// with a path to the value of a header, if it is one of the
+// methods it can be overridden to. The header is removed from
+// all requests with the path, so that the handlers after this
+// one, such as the proxy, do not override the method again.
+type Override struct {
+	Path    string
+	Header  string
+	Methods []string
+}
+
+// Allow is a rule that answers requests with a path with 405
+// Method Not Allowed, unless their method is one of Methods.
+type Allow struct {
+	Path    string
+	Methods []string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (m Method) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if i := longestMatch(r.URL.Path, len(m.Overrides), func(i int) string { return m.Overrides[i].Path }); i >= 0 {
+		rule := m.Overrides[i]
+		override := strings.ToUpper(strings.TrimSpace(r.Header.Get(rule.Header)))
+		r.Header.Del(rule.Header)
+		if override != "" && r.Method == http.MethodPost {
+			if !contains(rule.Methods, override) {
+				return http.StatusBadRequest, nil
+			}
+			// this runs before log, so the log records
+			// the method the request is served with
+			r.Method = override
+		}
+	}
+
+	if i := longestMatch(r.URL.Path, len(m.Allows), func(i int) string { return m.Allows[i].Path }); i >= 0 {
+		rule := m.Allows[i]
+		if !contains(rule.Methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(rule.Methods, ", "))
+			return http.StatusMethodNotAllowed, nil
+		}
+	}
+
+	return m.Next.ServeHTTP(w, r)
+}
+
+// longestMatch returns the index of the one of n paths, which
+// are given by path, that is the longest one that matches
+// urlPath, or -1 if none does.
+func longestMatch(urlPath string, n int, path func(int) string) int {
+	match := -1
+	for i := 0; i < n; i++ {
+		if !httpserver.Path(urlPath).Matches(path(i)) {
+			continue
+		}
+		if match < 0 || len(path(i)) > len(path(match)) {
+			match = i
+		}
+	}
+	return match
+}
+
+func contains(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
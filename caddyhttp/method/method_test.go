@@ -0,0 +1,98 @@
+package method
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+)
+
+func TestMethod(t *testing.T) {
+	var gotMethod, gotHeader string
+	m := Method{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			gotMethod, gotHeader = r.Method, r.Header.Get("X-HTTP-Method-Override")
+			return http.StatusOK, nil
+		}),
+		Overrides: []Override{{Path: "/api", Header: "X-Http-Method-Override", Methods: DefaultOverrideMethods}},
+		Allows: []Allow{
+			{Path: "/api", Methods: []string{"GET", "PUT", "DELETE"}},
+			{Path: "/public", Methods: []string{"GET", "HEAD"}},
+		},
+	}
+
+	for i, test := range []struct {
+		method, path, override string
+		expectedStatus         int
+		expectedMethod         string
+		expectedAllow          string
+	}{
+		{"POST", "/api/items/1", "DELETE", http.StatusOK, "DELETE", ""},
+		{"POST", "/api/items/1", "put", http.StatusOK, "PUT", ""},
+		{"GET", "/api/items/1", "DELETE", http.StatusOK, "GET", ""},
+		{"POST", "/api/items/1", "TRACE", http.StatusBadRequest, "", ""},
+		{"POST", "/other", "DELETE", http.StatusOK, "POST", ""},
+		// the override comes before the allow rule
+		{"POST", "/api/items", "", http.StatusMethodNotAllowed, "", "GET, PUT, DELETE"},
+		{"POST", "/api/items/1", "PATCH", http.StatusMethodNotAllowed, "", "GET, PUT, DELETE"},
+		{"HEAD", "/public/a.html", "", http.StatusOK, "HEAD", ""},
+		{"DELETE", "/public/a.html", "", http.StatusMethodNotAllowed, "", "GET, HEAD"},
+	} {
+		gotMethod, gotHeader = "", ""
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.override != "" {
+			r.Header.Set("X-HTTP-Method-Override", test.override)
+		}
+		w := httptest.NewRecorder()
+		status, err := m.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != test.expectedAllow {
+			t.Errorf("Test %d: Expected Allow '%s', got '%s'", i, test.expectedAllow, got)
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		if gotMethod != test.expectedMethod {
+			t.Errorf("Test %d: Expected method %s, got %s", i, test.expectedMethod, gotMethod)
+		}
+		if strings.HasPrefix(test.path, "/api") && gotHeader != "" {
+			t.Errorf("Test %d: Expected the override header to be removed, got '%s'", i, gotHeader)
+		}
+	}
+}
+
+func TestOverrideIsProxied(t *testing.T) {
+	var gotMethod string
+	var gotHeader []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotHeader = r.Method, r.Header["X-Http-Method-Override"]
+	}))
+	defer backend.Close()
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / "+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Method{
+		Next:      proxy.Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams},
+		Overrides: []Override{{Path: "/", Header: "X-Http-Method-Override", Methods: DefaultOverrideMethods}},
+	}
+
+	r := httptest.NewRequest("POST", "/items/1", nil)
+	r.Header.Set("X-HTTP-Method-Override", "PATCH")
+	if _, err := m.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if gotMethod != "PATCH" || gotHeader != nil {
+		t.Errorf("Expected upstream to get PATCH without the override header, got %s and %v", gotMethod, gotHeader)
+	}
+}
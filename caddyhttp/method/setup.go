@@ -0,0 +1,111 @@
+package method
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("method", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Method middleware instance.
+func setup(c *caddy.Controller) error {
+	m, err := methodParse(c)
+	if err != nil {
+		return err
+	}
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		m.Next = next
+		return m
+	})
+	return nil
+}
+
+// methodParse parses the method directives, each of which is
+//
+//	method [path] override header [method...]
+//
+// or
+//
+//	method [path] allow method...
+//
+// where the methods of override are the ones requests can be
+// overridden to, DefaultOverrideMethods by default. A path can
+// have one rule of each kind.
+func methodParse(c *caddy.Controller) (Method, error) {
+	var m Method
+	for c.Next() {
+		args := c.RemainingArgs()
+		path := "/"
+		if len(args) > 0 && strings.HasPrefix(args[0], "/") {
+			path, args = args[0], args[1:]
+		}
+		if len(args) == 0 {
+			return m, c.ArgErr()
+		}
+		kind, args := args[0], args[1:]
+		switch kind {
+		case "override":
+			if len(args) == 0 {
+				return m, c.ArgErr()
+			}
+			header := http.CanonicalHeaderKey(args[0])
+			methods, err := parseMethods(c, args[1:])
+			if err != nil {
+				return m, err
+			}
+			if len(methods) == 0 {
+				methods = DefaultOverrideMethods
+			}
+			for _, method := range methods {
+				if method == http.MethodPost || method == http.MethodConnect {
+					return m, c.Errf("requests cannot be overridden to %s", method)
+				}
+			}
+			for _, rule := range m.Overrides {
+				if rule.Path == path {
+					return m, c.Errf("duplicate method override for path '%s'", path)
+				}
+			}
+			m.Overrides = append(m.Overrides, Override{Path: path, Header: header, Methods: methods})
+		case "allow":
+			methods, err := parseMethods(c, args)
+			if err != nil {
+				return m, err
+			}
+			if len(methods) == 0 {
+				return m, c.ArgErr()
+			}
+			for _, rule := range m.Allows {
+				if rule.Path == path {
+					return m, c.Errf("duplicate method allow for path '%s'", path)
+				}
+			}
+			m.Allows = append(m.Allows, Allow{Path: path, Methods: methods})
+		default:
+			return m, c.Errf("method must be 'override' or 'allow', got '%s'", kind)
+		}
+	}
+	return m, nil
+}
+
+// parseMethods returns args, which must be method names, in upper case.
+func parseMethods(c *caddy.Controller, args []string) ([]string, error) {
+	methods := make([]string, len(args))
+	for i, arg := range args {
+		for _, r := range arg {
+			if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+				return nil, c.Errf("invalid method '%s'", arg)
+			}
+		}
+		methods[i] = strings.ToUpper(arg)
+	}
+	return methods, nil
+}
@@ -0,0 +1,58 @@
+package method
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input             string
+		shouldErr         bool
+		expectedOverrides []Override
+		expectedAllows    []Allow
+	}{
+		{`method /api override X-HTTP-Method-Override`, false,
+			[]Override{{"/api", "X-Http-Method-Override", DefaultOverrideMethods}}, nil},
+		{`method override x-method put delete`, false,
+			[]Override{{"/", "X-Method", []string{"PUT", "DELETE"}}}, nil},
+		{"method /public allow GET head\nmethod /api override X-Method", false,
+			[]Override{{"/api", "X-Method", DefaultOverrideMethods}}, []Allow{{"/public", []string{"GET", "HEAD"}}}},
+		{`method /public allow`, true, nil, nil},
+		{`method /api override`, true, nil, nil},
+		{`method /api`, true, nil, nil},
+		{`method`, true, nil, nil},
+		{`method /api rewrite GET`, true, nil, nil},
+		{`method /api override X-Method POST`, true, nil, nil},
+		{`method /api allow GET {`, true, nil, nil},
+		{"method /a allow GET\nmethod /a allow POST", true, nil, nil},
+		{"method /a override X-A\nmethod /a override X-B", true, nil, nil},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		m := mids[0](httpserver.EmptyNext).(Method)
+		if !reflect.DeepEqual(m.Overrides, test.expectedOverrides) {
+			t.Errorf("Test %d: Expected overrides %v, got %v", i, test.expectedOverrides, m.Overrides)
+		}
+		if !reflect.DeepEqual(m.Allows, test.expectedAllows) {
+			t.Errorf("Test %d: Expected allows %v, got %v", i, test.expectedAllows, m.Allows)
+		}
+	}
+}
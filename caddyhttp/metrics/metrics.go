@@ -0,0 +1,262 @@
+// Package metrics collects request metrics and exposes them,
+// along with TLS, proxy health and traffic, in the Prometheus text
+// format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+	"github.com/mholt/caddy/caddyhttp/traffic"
+	"github.com/mholt/caddy/caddytls"
+)
+
+// DefaultPath is the path metrics are served on if none is given.
+const DefaultPath = "/metrics"
+
+// methods are the request methods that get their own label value;
+// all other methods are counted as "OTHER" to bound cardinality.
+var methods = [...]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE", "OTHER"}
+
+// statusClasses are the label values for the status of a response.
+var statusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// buckets are the upper bounds, in seconds, of the latency histogram.
+var buckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// series holds the request count and latency histogram for one
+// combination of labels. All fields are updated atomically.
+type series struct {
+	count   uint64
+	sumNano uint64
+	buckets [len(buckets)]uint64 // not cumulative
+}
+
+// siteMetrics holds all series of a site. The series are allocated
+// up front, so recording a request never allocates nor locks.
+type siteMetrics struct {
+	label  string
+	site   *httpserver.SiteConfig // for upstream health; guarded by registryMu
+	refs   int                    // guarded by registryMu
+	series [len(methods)][len(statusClasses)]series
+}
+
+// observe records a request; it implements httpserver.RequestObserver.
+func (m *siteMetrics) observe(r *http.Request, status, size int, latency time.Duration) {
+	s := &m.series[methodIndex(r.Method)][statusClassIndex(status)]
+	atomic.AddUint64(&s.count, 1)
+	atomic.AddUint64(&s.sumNano, uint64(latency))
+	seconds := latency.Seconds()
+	for i, le := range buckets {
+		if seconds <= le {
+			atomic.AddUint64(&s.buckets[i], 1)
+			break
+		}
+	}
+}
+
+func methodIndex(method string) int {
+	for i, m := range methods[:len(methods)-1] {
+		if m == method {
+			return i
+		}
+	}
+	return len(methods) - 1
+}
+
+func statusClassIndex(status int) int {
+	switch {
+	case status < 200:
+		return 0
+	case status >= 500:
+		return len(statusClasses) - 1
+	default:
+		return status/100 - 1
+	}
+}
+
+// registry holds the metrics of every site that has the metrics
+// directive, keyed by site address. Sites keep their metrics
+// across restarts, as long as they are still configured.
+var (
+	registry   = make(map[string]*siteMetrics)
+	registryMu sync.Mutex
+)
+
+// register returns the metrics for site, creating them if needed.
+// Each call must be balanced by a call to unregister.
+func register(site *httpserver.SiteConfig) *siteMetrics {
+	label := site.Addr.String()
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	m, ok := registry[label]
+	if !ok {
+		m = &siteMetrics{label: label}
+		registry[label] = m
+	}
+	m.site = site
+	m.refs++
+	return m
+}
+
+func unregister(m *siteMetrics) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if m.refs--; m.refs <= 0 {
+		delete(registry, m.label)
+	}
+}
+
+// Handler serves metrics on Path and passes all
+// other requests to Next.
+type Handler struct {
+	Next httpserver.Handler
+	Path string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != h.Path {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return http.StatusMethodNotAllowed, nil
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, time.Now())
+	return 0, bw.Flush()
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func writeMetrics(w *bufio.Writer, now time.Time) {
+	registryMu.Lock()
+	sites := make([]*siteMetrics, 0, len(registry))
+	for _, m := range registry {
+		sites = append(sites, m)
+	}
+	upstreams := make(map[*siteMetrics][2]int, len(sites))
+	for _, m := range sites {
+		up, total := proxy.HostCounts(m.site)
+		upstreams[m] = [2]int{up, total}
+	}
+	registryMu.Unlock()
+	sort.Sort(byLabel(sites))
+
+	fmt.Fprintln(w, "# HELP caddy_http_requests_total Number of requests served, by site, method and status class.")
+	fmt.Fprintln(w, "# TYPE caddy_http_requests_total counter")
+	forEachSeries(sites, func(labels string, s *series) {
+		fmt.Fprintf(w, "caddy_http_requests_total{%s} %d\n", labels, atomic.LoadUint64(&s.count))
+	})
+
+	fmt.Fprintln(w, "# HELP caddy_http_request_duration_seconds Time taken to serve requests, by site, method and status class.")
+	fmt.Fprintln(w, "# TYPE caddy_http_request_duration_seconds histogram")
+	forEachSeries(sites, func(labels string, s *series) {
+		var cumulative uint64
+		for i, le := range buckets {
+			cumulative += atomic.LoadUint64(&s.buckets[i])
+			fmt.Fprintf(w, "caddy_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		count := atomic.LoadUint64(&s.count)
+		fmt.Fprintf(w, "caddy_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, count)
+		fmt.Fprintf(w, "caddy_http_request_duration_seconds_sum{%s} %s\n", labels,
+			strconv.FormatFloat(time.Duration(atomic.LoadUint64(&s.sumNano)).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "caddy_http_request_duration_seconds_count{%s} %d\n", labels, count)
+	})
+
+	fmt.Fprintln(w, "# HELP caddy_proxy_upstream_hosts_up Number of proxy upstream hosts that are not down, by site.")
+	fmt.Fprintln(w, "# TYPE caddy_proxy_upstream_hosts_up gauge")
+	for _, m := range sites {
+		if u := upstreams[m]; u[1] > 0 {
+			fmt.Fprintf(w, "caddy_proxy_upstream_hosts_up{site=%q} %d\n", m.label, u[0])
+		}
+	}
+	fmt.Fprintln(w, "# HELP caddy_proxy_upstream_hosts Number of proxy upstream hosts, by site.")
+	fmt.Fprintln(w, "# TYPE caddy_proxy_upstream_hosts gauge")
+	for _, m := range sites {
+		if u := upstreams[m]; u[1] > 0 {
+			fmt.Fprintf(w, "caddy_proxy_upstream_hosts{site=%q} %d\n", m.label, u[1])
+		}
+	}
+
+	writeTraffic(w, "caddy_http_received_bytes_total",
+		"Bytes of request bodies received, by site.", "site", traffic.Sites(), true)
+	writeTraffic(w, "caddy_http_sent_bytes_total",
+		"Bytes of response bodies sent, by site.", "site", traffic.Sites(), false)
+	upstreamTraffic := proxy.UpstreamTraffic()
+	writeTraffic(w, "caddy_proxy_upstream_sent_bytes_total",
+		"Bytes of request bodies sent to proxy upstream hosts, by host.", "upstream", upstreamTraffic, false)
+	writeTraffic(w, "caddy_proxy_upstream_received_bytes_total",
+		"Bytes of response bodies received from proxy upstream hosts, by host.", "upstream", upstreamTraffic, true)
+
+	stats := caddytls.CertificateCacheStats()
+	fmt.Fprintln(w, "# HELP caddy_tls_managed_certificates Number of managed certificates loaded.")
+	fmt.Fprintln(w, "# TYPE caddy_tls_managed_certificates gauge")
+	fmt.Fprintf(w, "caddy_tls_managed_certificates %d\n", stats.Managed)
+	if !stats.NearestExpiry.IsZero() {
+		fmt.Fprintln(w, "# HELP caddy_tls_certificate_expiry_days Days until the first loaded certificate expires.")
+		fmt.Fprintln(w, "# TYPE caddy_tls_certificate_expiry_days gauge")
+		fmt.Fprintf(w, "caddy_tls_certificate_expiry_days %s\n",
+			strconv.FormatFloat(stats.NearestExpiry.Sub(now).Hours()/24, 'f', 3, 64))
+	}
+	if !stats.OldestOCSP.IsZero() {
+		fmt.Fprintln(w, "# HELP caddy_tls_ocsp_staple_age_seconds Age of the oldest OCSP staple.")
+		fmt.Fprintln(w, "# TYPE caddy_tls_ocsp_staple_age_seconds gauge")
+		fmt.Fprintf(w, "caddy_tls_ocsp_staple_age_seconds %s\n",
+			strconv.FormatFloat(now.Sub(stats.OldestOCSP).Seconds(), 'f', 0, 64))
+	}
+}
+
+// writeTraffic writes the received or sent bytes of counts as
+// the counter name, labeled by their keys; nothing is written
+// if there are no counts.
+func writeTraffic(w *bufio.Writer, name, help, label string, counts map[string]httpserver.TrafficCounts, received bool) {
+	if len(counts) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, key := range keys {
+		n := counts[key].Sent
+		if received {
+			n = counts[key].Received
+		}
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, n)
+	}
+}
+
+// forEachSeries calls fn for every series of sites that has
+// counted at least one request, along with its labels.
+func forEachSeries(sites []*siteMetrics, fn func(labels string, s *series)) {
+	for _, m := range sites {
+		for i := range m.series {
+			for j := range m.series[i] {
+				s := &m.series[i][j]
+				if atomic.LoadUint64(&s.count) == 0 {
+					continue
+				}
+				fn(fmt.Sprintf("site=%q,method=%q,status=%q", m.label, methods[i], statusClasses[j]), s)
+			}
+		}
+	}
+}
+
+type byLabel []*siteMetrics
+
+func (s byLabel) Len() int           { return len(s) }
+func (s byLabel) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLabel) Less(i, j int) bool { return s[i].label < s[j].label }
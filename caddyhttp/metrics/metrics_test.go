@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	c := caddy.NewTestController("http", `metrics`)
+	cfg := httpserver.GetConfig(c)
+	cfg.Addr = httpserver.Address{Original: "scrape.test", Host: "scrape.test"}
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, got: %v", err)
+	}
+	defer unregister(registry["http://scrape.test"])
+
+	// status codes come from the site's own handler
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path == "/missing" {
+				return http.StatusNotFound, nil
+			}
+			w.Write([]byte("ok"))
+			return 0, nil
+		})
+	})
+	srv, err := httpserver.NewServer("127.0.0.1:0", []*httpserver.SiteConfig{cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/"}, {"GET", "/"}, {"GET", "/missing"}, {"POST", "/"}, {"PROPFIND", "/"},
+	} {
+		r, _ := http.NewRequest(req.method, "http://scrape.test"+req.path, nil)
+		srv.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	r, _ := http.NewRequest("GET", "http://scrape.test/metrics", nil)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 scraping metrics, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+
+	for _, expected := range []string{
+		`caddy_http_requests_total{site="http://scrape.test",method="GET",status="2xx"} 2`,
+		`caddy_http_requests_total{site="http://scrape.test",method="GET",status="4xx"} 1`,
+		`caddy_http_requests_total{site="http://scrape.test",method="POST",status="2xx"} 1`,
+		`caddy_http_requests_total{site="http://scrape.test",method="OTHER",status="2xx"} 1`,
+		`caddy_http_request_duration_seconds_bucket{site="http://scrape.test",method="GET",status="2xx",le="+Inf"} 2`,
+		`caddy_http_request_duration_seconds_count{site="http://scrape.test",method="GET",status="2xx"} 2`,
+		`caddy_tls_managed_certificates 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected scrape to contain '%s', got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "PROPFIND") || strings.Contains(body, "/missing") {
+		t.Errorf("Expected no raw methods or paths as labels, got:\n%s", body)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	m := &siteMetrics{label: "histogram.test", site: new(httpserver.SiteConfig)}
+	registryMu.Lock()
+	registry[m.label] = m
+	registryMu.Unlock()
+	defer unregister(m)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	for _, latency := range []time.Duration{
+		time.Millisecond,       // le .005
+		20 * time.Millisecond,  // le .025
+		20 * time.Millisecond,  // le .025
+		300 * time.Millisecond, // le .5
+		20 * time.Second,       // +Inf only
+	} {
+		m.observe(r, http.StatusOK, 0, latency)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeMetrics(w, time.Now())
+	w.Flush()
+	body := buf.String()
+
+	prefix := `caddy_http_request_duration_seconds_bucket{site="histogram.test",method="GET",status="2xx",le=`
+	for _, expected := range []string{
+		prefix + `"0.005"} 1`,
+		prefix + `"0.01"} 1`,
+		prefix + `"0.025"} 3`,
+		prefix + `"0.25"} 3`,
+		prefix + `"0.5"} 4`,
+		prefix + `"10"} 4`,
+		prefix + `"+Inf"} 5`,
+		`caddy_http_request_duration_seconds_sum{site="histogram.test",method="GET",status="2xx"} 20.341`,
+		`caddy_http_request_duration_seconds_count{site="histogram.test",method="GET",status="2xx"} 5`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected scrape to contain '%s', got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestStatusClassIndex(t *testing.T) {
+	for i, test := range []struct {
+		status   int
+		expected string
+	}{
+		{101, "1xx"}, {200, "2xx"}, {304, "3xx"}, {404, "4xx"}, {503, "5xx"}, {0, "1xx"}, {999, "5xx"},
+	} {
+		if got := statusClasses[statusClassIndex(test.status)]; got != test.expected {
+			t.Errorf("Test %d: Expected %s for status %d, got %s", i, test.expected, test.status, got)
+		}
+	}
+}
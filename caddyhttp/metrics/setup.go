@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("metrics", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new metrics middleware instance. It collects
+// metrics for each request to the site and serves the metrics of
+// all sites on the given path.
+func setup(c *caddy.Controller) error {
+	path := DefaultPath
+	found := false
+
+	for c.Next() {
+		if found {
+			return c.Err("metrics can only be specified once")
+		}
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			path = args[0]
+		default:
+			return c.ArgErr()
+		}
+		if c.NextBlock() {
+			return c.ArgErr()
+		}
+		found = true
+	}
+
+	cfg := httpserver.GetConfig(c)
+	m := register(cfg)
+	c.OnShutdown(func() error {
+		unregister(m)
+		return nil
+	})
+	cfg.AddRequestObserver(m.observe)
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Handler{Next: next, Path: path}
+	})
+	return nil
+}
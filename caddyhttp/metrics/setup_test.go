@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		path      string
+	}{
+		{`metrics`, false, DefaultPath},
+		{`metrics /stats`, false, "/stats"},
+		{`metrics /a /b`, true, ""},
+		{"metrics\nmetrics", true, ""},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		handler, ok := mids[0](httpserver.EmptyNext).(Handler)
+		if !ok {
+			t.Fatalf("Test %d: Expected handler to be type Handler", i)
+		}
+		if handler.Path != test.path {
+			t.Errorf("Test %d: Expected path %s, got %s", i, test.path, handler.Path)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package mime
 
 import (
+	"mime"
 	"net/http"
 	"path"
+	"strings"
 
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -16,15 +18,23 @@ type Config map[string]string
 type Mime struct {
 	Next    httpserver.Handler
 	Configs Config
+
+	// Default is the type of files with an extension that is
+	// neither in Configs nor known to the mime package; if
+	// empty, the type of such files is detected from their
+	// content
+	Default string
 }
 
 // ServeHTTP implements the httpserver.Handler interface.
 func (e Mime) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	// Get a clean /-path, grab the extension
-	ext := path.Ext(path.Clean(r.URL.Path))
+	ext := strings.ToLower(path.Ext(path.Clean(r.URL.Path)))
 
 	if contentType, ok := e.Configs[ext]; ok {
 		w.Header().Set("Content-Type", contentType)
+	} else if e.Default != "" && ext != "" && mime.TypeByExtension(ext) == "" {
+		w.Header().Set("Content-Type", e.Default)
 	}
 
 	return e.Next.ServeHTTP(w, r)
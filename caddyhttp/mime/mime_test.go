@@ -67,3 +67,30 @@ func nextFunc(shouldMime bool, contentType string) httpserver.Handler {
 		return 0, nil
 	})
 }
+
+func TestMimeHandlerDefault(t *testing.T) {
+	m := Mime{
+		Configs: Config{".h5": "application/x-hdf5"},
+		Default: "application/x-unknown",
+	}
+	for i, test := range []struct {
+		path        string
+		contentType string
+	}{
+		{"/data.h5", "application/x-hdf5"},
+		{"/DATA.H5", "application/x-hdf5"},
+		{"/page.html", ""}, // known to Go, so detected by the file server
+		{"/data.xyz123", "application/x-unknown"},
+		{"/", ""},
+		{"/README", ""},
+	} {
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Next = nextFunc(test.contentType != "", test.contentType)
+		if _, err := m.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
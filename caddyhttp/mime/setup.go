@@ -17,20 +17,22 @@ func init() {
 
 // setup configures a new mime middleware instance.
 func setup(c *caddy.Controller) error {
-	configs, err := mimeParse(c)
+	m, err := mimeParse(c)
 	if err != nil {
 		return err
 	}
 
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return Mime{Next: next, Configs: configs}
+		m.Next = next
+		return m
 	})
 
 	return nil
 }
 
-func mimeParse(c *caddy.Controller) (Config, error) {
-	configs := Config{}
+func mimeParse(c *caddy.Controller) (Mime, error) {
+	m := Mime{Configs: Config{}}
+	fromFiles := Config{}
 
 	for c.Next() {
 		// At least one extension is required
@@ -38,28 +40,54 @@ func mimeParse(c *caddy.Controller) (Config, error) {
 		args := c.RemainingArgs()
 		switch len(args) {
 		case 2:
-			if err := validateExt(configs, args[0]); err != nil {
-				return configs, err
+			if err := validateExt(m.Configs, args[0]); err != nil {
+				return m, err
 			}
-			configs[args[0]] = args[1]
+			m.Configs[strings.ToLower(args[0])] = args[1]
 		case 1:
-			return configs, c.ArgErr()
+			return m, c.ArgErr()
 		case 0:
 			for c.NextBlock() {
-				ext := c.Val()
-				if err := validateExt(configs, ext); err != nil {
-					return configs, err
+				switch c.Val() {
+				case "file":
+					if !c.NextArg() {
+						return m, c.ArgErr()
+					}
+					types, err := loadMimeTypes(c.Val())
+					if err != nil {
+						return m, c.Err(err.Error())
+					}
+					for ext, typ := range types {
+						fromFiles[ext] = typ
+					}
+				case "default":
+					if !c.NextArg() {
+						return m, c.ArgErr()
+					}
+					m.Default = c.Val()
+				default:
+					ext := c.Val()
+					if err := validateExt(m.Configs, ext); err != nil {
+						return m, err
+					}
+					if !c.NextArg() {
+						return m, c.ArgErr()
+					}
+					m.Configs[strings.ToLower(ext)] = c.Val()
 				}
-				if !c.NextArg() {
-					return configs, c.ArgErr()
-				}
-				configs[ext] = c.Val()
 			}
 		}
 
 	}
 
-	return configs, nil
+	// inline types win over the ones from files
+	for ext, typ := range fromFiles {
+		if _, ok := m.Configs[ext]; !ok {
+			m.Configs[ext] = typ
+		}
+	}
+
+	return m, nil
 }
 
 // validateExt checks for valid file name extension.
@@ -67,7 +95,7 @@ func validateExt(configs Config, ext string) error {
 	if !strings.HasPrefix(ext, ".") {
 		return fmt.Errorf(`mime: invalid extension "%v" (must start with dot)`, ext)
 	}
-	if _, ok := configs[ext]; ok {
+	if _, ok := configs[strings.ToLower(ext)]; ok {
 		return fmt.Errorf(`mime: duplicate extension "%v" found`, ext)
 	}
 	return nil
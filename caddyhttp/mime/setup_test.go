@@ -1,6 +1,7 @@
 package mime
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/mholt/caddy"
@@ -51,6 +52,23 @@ func TestSetup(t *testing.T) {
 		{`mime { .html
 		} `, true},
 		{`mime .txt text/plain`, false},
+		{`mime {
+		 file testdata/mime.types
+		 default application/octet-stream
+		} `, false},
+		{`mime {
+		 file
+		} `, true},
+		{`mime {
+		 file testdata/missing.types
+		} `, true},
+		{`mime {
+		 default
+		} `, true},
+		{`mime {
+		 .TXT text/plain
+		 .txt text/html
+		} `, true},
 	}
 	for i, test := range tests {
 		m, err := mimeParse(caddy.NewTestController("http", test.input))
@@ -61,3 +79,38 @@ func TestSetup(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupFile(t *testing.T) {
+	m, err := mimeParse(caddy.NewTestController("http", `mime {
+		.fits image/fits
+		file testdata/mime.types
+		.PDB text/plain
+		default application/octet-stream
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for ext, typ := range map[string]string{
+		".h5":   "application/x-hdf5", // from the file
+		".fits": "image/fits",         // inline wins
+		".pdb":  "text/plain",         // inline wins, whatever the case
+		".fa":   "text/x-fasta",
+	} {
+		if got := m.Configs[ext]; got != typ {
+			t.Errorf("Expected type of %s to be %s, got '%s'", ext, typ, got)
+		}
+	}
+	if m.Default != "application/octet-stream" {
+		t.Errorf("Expected default application/octet-stream, got '%s'", m.Default)
+	}
+
+	_, err = mimeParse(caddy.NewTestController("http", `mime {
+		file testdata/broken.types
+	}`))
+	if err == nil {
+		t.Fatal("Expected an error for a broken file")
+	}
+	if !strings.Contains(err.Error(), "testdata/broken.types:3:") {
+		t.Errorf("Expected error with line number of the file, got: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package mime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadMimeTypes reads the mime.types file at path; see parseMimeTypes.
+func loadMimeTypes(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseMimeTypes(file, path)
+}
+
+// parseMimeTypes parses a file in the syntax of mime.types files,
+// named name, and returns the extensions in it mapped to their types.
+// Both the Apache syntax, which has a type followed by its extensions
+// on each line, and the nginx syntax, which wraps such lines in
+// "types { }" and ends each of them with a semicolon, are understood.
+// Lines that are blank or start with # are ignored.
+func parseMimeTypes(r io.Reader, name string) (Config, error) {
+	types := Config{}
+	var (
+		nginx, inTypes bool
+		stmt           []string // the nginx statement so far
+		stmtLine       int
+	)
+
+	add := func(line int, fields []string) error {
+		typ := fields[0]
+		if slash := strings.Index(typ, "/"); slash <= 0 || slash == len(typ)-1 || strings.Count(typ, "/") != 1 {
+			return fmt.Errorf("%s:%d: invalid media type '%s'", name, line, typ)
+		}
+		for _, ext := range fields[1:] {
+			ext = strings.TrimPrefix(ext, ".")
+			if ext == "" || strings.ContainsAny(ext, "/{};") {
+				return fmt.Errorf("%s:%d: invalid extension '%s' for %s", name, line, ext, typ)
+			}
+			types["."+strings.ToLower(ext)] = typ
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if hash := strings.Index(text, "#"); hash >= 0 {
+			text = text[:hash]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case !inTypes && strings.Join(fields, "") == "types{":
+			if nginx {
+				return nil, fmt.Errorf("%s:%d: types may only be opened once", name, line)
+			}
+			nginx, inTypes = true, true
+			continue
+		case inTypes && len(fields) == 1 && fields[0] == "}":
+			if len(stmt) > 0 {
+				return nil, fmt.Errorf("%s:%d: missing ';' after %s", name, stmtLine, stmt[0])
+			}
+			inTypes = false
+			continue
+		case nginx && !inTypes:
+			return nil, fmt.Errorf("%s:%d: unexpected '%s' after types", name, line, fields[0])
+		case !nginx:
+			if err := add(line, fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// nginx statements may span lines up to a semicolon
+		for _, field := range fields {
+			if len(stmt) == 0 {
+				stmtLine = line
+			}
+			end := strings.HasSuffix(field, ";")
+			if field = strings.TrimSuffix(field, ";"); field != "" {
+				stmt = append(stmt, field)
+			}
+			if end {
+				if len(stmt) == 0 {
+					return nil, fmt.Errorf("%s:%d: empty statement", name, line)
+				}
+				if err := add(stmtLine, stmt); err != nil {
+					return nil, err
+				}
+				stmt = nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inTypes {
+		return nil, fmt.Errorf("%s: missing '}' at end of types", name)
+	}
+	return types, nil
+}
@@ -0,0 +1,63 @@
+package mime
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadMimeTypes(t *testing.T) {
+	for _, file := range []string{"testdata/mime.types", "testdata/nginx.types"} {
+		types, err := loadMimeTypes(file)
+		if err != nil {
+			t.Fatalf("%s: Expected no error, got: %v", file, err)
+		}
+		for ext, typ := range map[string]string{
+			".h5":    "application/x-hdf5",
+			".he5":   "application/x-hdf5",
+			".fits":  "application/fits",
+			".fasta": "text/x-fasta",
+		} {
+			if got := types[ext]; got != typ {
+				t.Errorf("%s: Expected type of %s to be %s, got '%s'", file, ext, typ, got)
+			}
+		}
+	}
+
+	if _, err := loadMimeTypes("testdata/missing.types"); err == nil {
+		t.Error("Expected an error loading a missing file")
+	}
+}
+
+func TestParseMimeTypes(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    Config
+		expectErr string
+	}{
+		{"text/x-a a\n\n# comment\ntext/x-b b .B2 # trailing\n", Config{".a": "text/x-a", ".b": "text/x-b", ".b2": "text/x-b"}, ""},
+		{"types {\n text/x-a a\n  aa;\n text/x-b b; text/x-c c;\n}\n", Config{".a": "text/x-a", ".aa": "text/x-a", ".b": "text/x-b", ".c": "text/x-c"}, ""},
+		{"text/x-a a\nnotatype b\n", nil, "test.types:2: invalid media type 'notatype'"},
+		{"text/x-a a\n\ntext/ b\n", nil, "test.types:3: invalid media type 'text/'"},
+		{"text/x-a a/b\n", nil, "test.types:1: invalid extension 'a/b' for text/x-a"},
+		{"types {\n text/x-a a;\n text/x-b\n b\n}\n", nil, "test.types:3: missing ';' after text/x-b"},
+		{"types {\n text/x-a a;\n", nil, "test.types: missing '}' at end of types"},
+		{"types {\n text/x-a a;\n}\ntext/x-b b\n", nil, "test.types:4: unexpected 'text/x-b' after types"},
+		{"types {\n ;\n}\n", nil, "test.types:2: empty statement"},
+	} {
+		types, err := parseMimeTypes(strings.NewReader(test.input), "test.types")
+		if test.expectErr != "" {
+			if err == nil || err.Error() != test.expectErr {
+				t.Errorf("Test %d: Expected error '%s', got: %v", i, test.expectErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(types, test.expect) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expect, types)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package passthrough
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("passthrough", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupPassthrough,
+	})
+}
+
+// setupPassthrough configures the listener of a site to splice TLS
+// connections for a server name to another address, without
+// terminating them, so that another server can serve that name on
+// the same port:
+//
+//	passthrough name address {
+//	    idle_timeout duration
+//	}
+//
+// Connections for other server names, and those without one, are
+// served as usual.
+func setupPassthrough(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		name := strings.ToLower(args[0])
+		if name == "" || strings.Contains(name, "*") {
+			return c.Errf("Passthrough needs an exact server name, got '%s'", args[0])
+		}
+		if _, _, err := net.SplitHostPort(args[1]); err != nil {
+			return c.Errf("Passthrough address '%s' must be host:port: %v", args[1], err)
+		}
+		if _, dup := config.Passthrough[name]; dup {
+			return c.Errf("Server name %s is already passed through", name)
+		}
+		route := httpserver.Passthrough{Address: args[1]}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "idle_timeout":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil || timeout <= 0 {
+					return c.Errf("Invalid idle timeout '%s'", c.Val())
+				}
+				route.IdleTimeout = timeout
+				if c.NextArg() {
+					return c.ArgErr()
+				}
+			default:
+				return c.Errf("Unknown passthrough option '%s'", c.Val())
+			}
+		}
+
+		if config.Passthrough == nil {
+			config.Passthrough = make(map[string]httpserver.Passthrough)
+		}
+		config.Passthrough[name] = route
+	}
+	return nil
+}
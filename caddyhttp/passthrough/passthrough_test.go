@@ -0,0 +1,58 @@
+package passthrough
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetupPassthrough(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  map[string]httpserver.Passthrough
+	}{
+		{`passthrough mail.example.com 10.0.0.9:443`, false, map[string]httpserver.Passthrough{
+			"mail.example.com": {Address: "10.0.0.9:443"},
+		}},
+		{`passthrough Mail.Example.com 10.0.0.9:443 {
+			idle_timeout 1m
+		}
+		passthrough vpn.example.com [::1]:8443`, false, map[string]httpserver.Passthrough{
+			"mail.example.com": {Address: "10.0.0.9:443", IdleTimeout: time.Minute},
+			"vpn.example.com":  {Address: "[::1]:8443"},
+		}},
+		{`passthrough`, true, nil},
+		{`passthrough mail.example.com`, true, nil},
+		{`passthrough mail.example.com 10.0.0.9`, true, nil},
+		{`passthrough *.example.com 10.0.0.9:443`, true, nil},
+		{`passthrough mail.example.com 10.0.0.9:443 extra`, true, nil},
+		{`passthrough mail.example.com 10.0.0.9:443
+		passthrough mail.example.com 10.0.0.10:443`, true, nil},
+		{`passthrough mail.example.com 10.0.0.9:443 {
+			idle_timeout forever
+		}`, true, nil},
+		{`passthrough mail.example.com 10.0.0.9:443 {
+			timeout 1m
+		}`, true, nil},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupPassthrough(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if got := httpserver.GetConfig(c).Passthrough; !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package pathscope configures how a path-scoped site, like
+// example.com/blog, serves the requests under its path.
+package pathscope
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("fallthrough", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupFallthrough,
+	})
+	caddy.RegisterPlugin("rebase_path", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupRebasePath,
+	})
+}
+
+// setupFallthrough makes the path-scoped site pass the requests
+// it finds nothing for on to the site with the next shorter path
+// of its host, instead of answering them with a 404 itself.
+func setupFallthrough(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if !pathScoped(config) {
+			return c.Errf("fallthrough is only for path-scoped sites, like example.com/blog, not %s", c.Key)
+		}
+		config.Fallthrough = true
+	}
+	return nil
+}
+
+// setupRebasePath configures whether the path of the path-scoped
+// site is trimmed from the request path, which is the default, so
+// that its middleware sees the path relative to the site.
+func setupRebasePath(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "on":
+			config.KeepScopePath = false
+		case "off":
+			config.KeepScopePath = true
+		default:
+			return c.Errf("Unknown rebase_path value '%s'; must be on or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		if !pathScoped(config) {
+			return c.Errf("rebase_path is only for path-scoped sites, like example.com/blog, not %s", c.Key)
+		}
+	}
+	return nil
+}
+
+func pathScoped(config *httpserver.SiteConfig) bool {
+	return config.Addr.Path != "" && config.Addr.Path != "/"
+}
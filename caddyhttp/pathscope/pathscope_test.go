@@ -0,0 +1,75 @@
+package pathscope
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func scopedController(input string, addr httpserver.Address) *caddy.Controller {
+	c := caddy.NewTestController("http", input)
+	httpserver.GetConfig(c).Addr = addr
+	return c
+}
+
+var blogAddr = httpserver.Address{Original: "example.com/blog", Host: "example.com", Path: "/blog"}
+
+func TestSetupFallthrough(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		addr      httpserver.Address
+		shouldErr bool
+	}{
+		{`fallthrough`, blogAddr, false},
+		{`fallthrough yes`, blogAddr, true},
+		{`fallthrough`, httpserver.Address{Original: "example.com", Host: "example.com"}, true},
+		{`fallthrough`, httpserver.Address{Original: "example.com/", Host: "example.com", Path: "/"}, true},
+	} {
+		c := scopedController(test.input, test.addr)
+		err := setupFallthrough(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if !httpserver.GetConfig(c).Fallthrough {
+			t.Errorf("Test %d: Expected site to fall through", i)
+		}
+	}
+}
+
+func TestSetupRebasePath(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		addr      httpserver.Address
+		shouldErr bool
+		keepPath  bool
+	}{
+		{`rebase_path off`, blogAddr, false, true},
+		{`rebase_path on`, blogAddr, false, false},
+		{`rebase_path`, blogAddr, true, false},
+		{`rebase_path maybe`, blogAddr, true, false},
+		{`rebase_path off now`, blogAddr, true, false},
+		{`rebase_path off`, httpserver.Address{Original: "example.com", Host: "example.com"}, true, false},
+	} {
+		c := scopedController(test.input, test.addr)
+		err := setupRebasePath(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if got := httpserver.GetConfig(c).KeepScopePath; got != test.keepPath {
+			t.Errorf("Test %d: Expected KeepScopePath %v, got %v", i, test.keepPath, got)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package pprof
 import (
 	"net/http"
 	pp "net/http/pprof"
+	"strings"
 
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
@@ -13,18 +15,35 @@ const BasePath = "/debug/pprof"
 // Handler is a simple struct whose ServeHTTP will delegate pprof
 // endpoints to their equivalent net/http/pprof handlers.
 type Handler struct {
-	Next httpserver.Handler
-	Mux  *http.ServeMux
+	Next    httpserver.Handler
+	Mux     *http.ServeMux
+	Options debugendpoint.Options
 }
 
-// ServeHTTP handles requests to BasePath with pprof, or passes
-// all other requests up the chain.
+// ServeHTTP handles requests to the configured path (BasePath by
+// default) with pprof, or passes all other requests up the chain.
+// Requests without valid credentials, if credentials are required,
+// are answered as if there was nothing there.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if httpserver.Path(r.URL.Path).Matches(BasePath) {
-		h.Mux.ServeHTTP(w, r)
-		return 0, nil
+	path := h.Options.Path
+	if path == "" {
+		path = BasePath
 	}
-	return h.Next.ServeHTTP(w, r)
+	if !httpserver.Path(r.URL.Path).Matches(path) {
+		return h.Next.ServeHTTP(w, r)
+	}
+	if !h.Options.Authorized(r) {
+		return http.StatusNotFound, nil
+	}
+	if path != BasePath {
+		// the pprof handlers only know about BasePath
+		r2, u := *r, *r.URL
+		u.Path = BasePath + strings.TrimPrefix(r.URL.Path, path)
+		r2.URL = &u
+		r = &r2
+	}
+	h.Mux.ServeHTTP(w, r)
+	return 0, nil
 }
 
 // NewMux returns a new http.ServeMux that routes pprof requests.
@@ -6,7 +6,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestServeHTTP(t *testing.T) {
@@ -49,6 +51,60 @@ func TestServeHTTP(t *testing.T) {
 	}
 }
 
+func TestServeHTTPProtected(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler{
+		Next: httpserver.HandlerFunc(nextHandler),
+		Mux:  NewMux(),
+		Options: debugendpoint.Options{
+			Path:  "/secret/pprof",
+			Users: map[string][]byte{"admin": hash},
+		},
+	}
+
+	for i, test := range []struct {
+		path     string
+		user     string
+		pass     string
+		status   int
+		passThru bool
+	}{
+		{"/secret/pprof/", "admin", "secret", 0, false},
+		{"/secret/pprof/cmdline", "admin", "secret", 0, false},
+		{"/secret/pprof/", "admin", "wrong", http.StatusNotFound, false},
+		{"/secret/pprof/", "", "", http.StatusNotFound, false},
+		{"/debug/pprof/", "admin", "secret", http.StatusNotFound, true},
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		status, err := h.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected nil error, but got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d but got %d", i, test.status, status)
+		}
+		if passedThru := w.Body.String() == "content"; passedThru != test.passThru {
+			t.Errorf("Test %d: Expected pass thru to be %v, got body: %s", i, test.passThru, w.Body.String())
+		}
+		if status == 0 && w.Code != http.StatusOK {
+			t.Errorf("Test %d: Expected pprof to serve the request, got code %d", i, w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") != "" {
+			t.Errorf("Test %d: Expected endpoint not to ask for credentials", i)
+		}
+	}
+}
+
 func nextHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 	fmt.Fprintf(w, "content")
 	return http.StatusNotFound, nil
@@ -2,6 +2,7 @@ package pprof
 
 import (
 	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/debugendpoint"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
@@ -9,29 +10,48 @@ func init() {
 	caddy.RegisterPlugin("pprof", caddy.Plugin{
 		ServerType: "http",
 		Action:     setup,
+		Redact:     debugendpoint.Redact,
 	})
 }
 
-// setup returns a new instance of a pprof handler. It accepts no arguments or options.
+// setup returns a new instance of a pprof handler. It accepts no
+// arguments, but an optional block with the options that protect
+// debugging endpoints (see package debugendpoint).
 func setup(c *caddy.Controller) error {
+	opts, err := pprofParse(c)
+	if err != nil {
+		return err
+	}
+
+	debugendpoint.Install(c, "pprof", opts, func(next httpserver.Handler) httpserver.Handler {
+		return &Handler{Next: next, Mux: NewMux(), Options: opts}
+	})
+
+	return nil
+}
+
+func pprofParse(c *caddy.Controller) (debugendpoint.Options, error) {
+	opts := debugendpoint.Options{Path: BasePath}
 	found := false
 
 	for c.Next() {
 		if found {
-			return c.Err("pprof can only be specified once")
+			return opts, c.Err("pprof can only be specified once")
 		}
 		if len(c.RemainingArgs()) != 0 {
-			return c.ArgErr()
+			return opts, c.ArgErr()
 		}
-		if c.NextBlock() {
-			return c.ArgErr()
+		for c.NextBlock() {
+			ok, err := debugendpoint.ParseOption(c, &opts)
+			if err != nil {
+				return opts, err
+			}
+			if !ok {
+				return opts, c.Errf("Unknown pprof option '%s'", c.Val())
+			}
 		}
 		found = true
 	}
 
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return &Handler{Next: next, Mux: NewMux()}
-	})
-
-	return nil
+	return opts, nil
 }
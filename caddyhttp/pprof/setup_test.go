@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
 
 func TestSetup(t *testing.T) {
@@ -19,6 +20,13 @@ func TestSetup(t *testing.T) {
         }`, true},
 		{`pprof
           pprof`, true},
+		{`pprof {
+            path /secret
+            bind 127.0.0.1
+        }`, false},
+		{`pprof {
+            basicauth admin notahash
+        }`, true},
 	}
 	for i, test := range tests {
 		c := caddy.NewTestController("http", test.input)
@@ -30,3 +38,25 @@ func TestSetup(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupSeparateListener(t *testing.T) {
+	c := caddy.NewTestController("http", "pprof {\nbind 127.0.0.1:6060\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if mids := httpserver.GetConfig(c).Middleware(); len(mids) != 0 {
+		t.Errorf("Expected pprof not to be served on the site, got %d middleware", len(mids))
+	}
+
+	c = caddy.NewTestController("http", "pprof {\npath /secret\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) != 1 {
+		t.Fatalf("Expected pprof to be served on the site, got %d middleware", len(mids))
+	}
+	if h := mids[0](httpserver.EmptyNext).(*Handler); h.Options.Path != "/secret" {
+		t.Errorf("Expected path /secret, got %s", h.Options.Path)
+	}
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Defaults for caches.
+const (
+	DefaultCacheTTL     = 10 * time.Second
+	DefaultCacheMaxSize = 64 << 20
+	DefaultCacheKey     = "{scheme}{host}{uri}"
+)
+
+// cacheStatusHeader tells whether a response came from the cache:
+// HIT if it did, STALE if it did but it is being revalidated, and
+// MISS if it came from the upstream.
+const cacheStatusHeader = "X-Cache"
+
+// cache keeps successful responses of the upstream in memory
+// for a short while and serves them instead of the upstream.
+// After they expired, responses are still served for the stale
+// period while they are refreshed in the background. Requests
+// for the same key are coalesced, so that the upstream gets
+// one request per key at a time.
+type cache struct {
+	ttl     time.Duration // how long a response is fresh
+	stale   time.Duration // how long it is served after that
+	maxSize int64         // of all responses together, in bytes
+	key     string        // with placeholders
+
+	// by default, responses with cookies and requests with
+	// credentials are not cached
+	allowCookies       bool
+	allowAuthorization bool
+
+	mu           sync.Mutex
+	entries      map[string]*list.Element
+	lru          *list.List // of *cacheEntry, most recently used first
+	size         int64
+	fetching     map[string]*cacheFetch
+	revalidating map[string]bool
+}
+
+// cacheEntry is a response in the cache.
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// size is about how much memory e takes.
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for field, values := range e.header {
+		for _, v := range values {
+			n += len(field) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+// cacheFetch is a request to the upstream for a key that
+// is not in the cache, which others may wait for.
+type cacheFetch struct {
+	done  chan struct{}
+	entry *cacheEntry // nil if the response could not be cached
+}
+
+// newCache returns a cache with the default settings.
+func newCache() *cache {
+	return &cache{
+		ttl:          DefaultCacheTTL,
+		maxSize:      DefaultCacheMaxSize,
+		key:          DefaultCacheKey,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+		fetching:     make(map[string]*cacheFetch),
+		revalidating: make(map[string]bool),
+	}
+}
+
+// bypass returns true if r must not be served from the cache.
+func (c *cache) bypass(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return true
+	}
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	if r.Header.Get("Range") != "" {
+		// the upstream serves the range; the cache
+		// only has whole responses
+		return true
+	}
+	return r.Header.Get("Authorization") != "" && !c.allowAuthorization
+}
+
+// serve serves r from the cache, if it can, or else from fetch,
+// which proxies a request to the upstream. Unless r is a HEAD
+// request, the response from fetch is cached if it is cacheable.
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, fetch func(http.ResponseWriter, *http.Request) (int, error)) (int, error) {
+	key := httpserver.NewReplacer(r, nil, "").Replace(c.key)
+
+	entry, fresh := c.get(key)
+	if entry != nil {
+		if fresh {
+			c.write(w, r, entry, "HIT")
+		} else {
+			c.revalidate(key, r, fetch)
+			c.write(w, r, entry, "STALE")
+		}
+		return 0, nil
+	}
+
+	if r.Method == "HEAD" {
+		w.Header().Set(cacheStatusHeader, "MISS")
+		return fetch(w, r)
+	}
+
+	c.mu.Lock()
+	if f, ok := c.fetching[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		if f.entry != nil {
+			c.write(w, r, f.entry, "HIT")
+			return 0, nil
+		}
+		w.Header().Set(cacheStatusHeader, "MISS")
+		return fetch(w, r)
+	}
+	f := &cacheFetch{done: make(chan struct{})}
+	c.fetching[key] = f
+	c.mu.Unlock()
+
+	cw := &cacheWriter{ResponseWriter: w, limit: c.maxSize}
+	status, err := fetch(cw, r)
+	f.entry = c.store(key, cw, status, err)
+
+	c.mu.Lock()
+	delete(c.fetching, key)
+	c.mu.Unlock()
+	close(f.done)
+	return status, err
+}
+
+// revalidate refreshes the entry for key in the background,
+// unless that is being done already. The stale entry stays
+// in the cache if the response cannot be cached.
+func (c *cache) revalidate(key string, r *http.Request, fetch func(http.ResponseWriter, *http.Request) (int, error)) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	// the request must outlive the one being served
+	req := r.WithContext(context.Background())
+	req.Method = "GET"
+	req.Header = make(http.Header)
+	copyHeader(req.Header, r.Header)
+	req.Body = nil
+	req.ContentLength = 0
+
+	go func() {
+		cw := &cacheWriter{limit: c.maxSize}
+		status, err := fetch(cw, req)
+		c.store(key, cw, status, err)
+
+		c.mu.Lock()
+		delete(c.revalidating, key)
+		c.mu.Unlock()
+	}()
+}
+
+// get returns the entry for key, and whether it is fresh,
+// or nil if there is none that may be served.
+func (c *cache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	age := time.Since(entry.stored)
+	if age >= c.ttl+c.stale {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, age < c.ttl
+}
+
+// store adds the response recorded by cw to the cache as the
+// entry for key, if it can be cached, and returns the entry.
+// Least recently used entries are evicted to make room for it.
+func (c *cache) store(key string, cw *cacheWriter, status int, err error) *cacheEntry {
+	if err != nil || status != 0 || !c.cacheable(cw) {
+		return nil
+	}
+	entry := &cacheEntry{
+		key:    key,
+		status: cw.status,
+		header: make(http.Header),
+		body:   cw.body.Bytes(),
+		stored: time.Now(),
+	}
+	copyHeader(entry.header, cw.header)
+	size := entry.size()
+	if size > c.maxSize {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	return entry
+}
+
+// remove removes elem from the cache; c.mu must be locked.
+func (c *cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// cacheable returns true if the response recorded by cw may be cached.
+func (c *cache) cacheable(cw *cacheWriter) bool {
+	if cw.status != http.StatusOK || cw.tooLarge {
+		return false
+	}
+	header := cw.header
+	if header.Get("Set-Cookie") != "" && !c.allowCookies {
+		return false
+	}
+	if header.Get("Trailer") != "" {
+		return false
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store", "no-cache", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// write writes entry as the response to r.
+func (c *cache) write(w http.ResponseWriter, r *http.Request, entry *cacheEntry, cacheStatus string) {
+	setHeader(w.Header(), entry.header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored)/time.Second)))
+	w.Header().Set(cacheStatusHeader, cacheStatus)
+	w.WriteHeader(entry.status)
+	if r.Method != "HEAD" {
+		w.Write(entry.body)
+	}
+}
+
+// cacheWriter records a response of the upstream while it writes
+// it to ResponseWriter, if that is not nil. It stops recording
+// the body once it is larger than limit. The header that is
+// recorded is only what the upstream responded with, not
+// what other middleware put in the header of ResponseWriter.
+type cacheWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	tooLarge bool
+}
+
+// Header returns the header of the response. Once it is written,
+// changes to it (like trailers) go to the header of ResponseWriter.
+func (cw *cacheWriter) Header() http.Header {
+	if cw.status != 0 && cw.ResponseWriter != nil {
+		return cw.ResponseWriter.Header()
+	}
+	if cw.header == nil {
+		cw.header = make(http.Header)
+	}
+	return cw.header
+}
+
+// WriteHeader records the status of the response and writes it.
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	header := cw.Header()
+	cw.status = status
+	if cw.ResponseWriter != nil {
+		setHeader(cw.ResponseWriter.Header(), header)
+		cw.ResponseWriter.Header().Set(cacheStatusHeader, "MISS")
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write records b, if the body is not too large yet, and writes it.
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+	if !cw.tooLarge {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	if cw.ResponseWriter != nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return len(b), nil
+}
+
+// Flush flushes the response, so that it keeps being streamed.
+func (cw *cacheWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// setHeader sets the fields of src in dst, replacing their values.
+func setHeader(dst, src http.Header) {
+	for field, values := range src {
+		dst[field] = append([]string(nil), values...)
+	}
+}
+
+// parseSize parses a number of bytes, which may end in
+// kb, mb or gb for multiples of 1024, 1024² or 1024³ bytes.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	lower := strings.ToLower(s)
+	for suffix, m := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(lower, suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// newCacheTest returns a proxy with the cache block cacheBlock
+// to an upstream that uses handler, and the cache of the proxy.
+func newCacheTest(t *testing.T, cacheBlock string, handler http.HandlerFunc) (*Proxy, *cache, func()) {
+	backend := httptest.NewServer(handler)
+	config := "proxy / " + backend.URL + " {\ncache " + cacheBlock + "\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+	return p, upstreams[0].(*staticUpstream).Cache, backend.Close
+}
+
+// cacheGet serves a GET request for path with the given
+// header fields (name, value, name, value...) through p.
+func cacheGet(p *Proxy, path string, header ...string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+// countingHandler responds with the number of requests it got.
+func countingHandler(count *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(count, 1)
+		w.Write([]byte(strconv.Itoa(int(n))))
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	var count int32
+	p, _, cleanup := newCacheTest(t, "", countingHandler(&count))
+	defer cleanup()
+
+	for i, expected := range []string{"MISS", "HIT", "HIT"} {
+		w := cacheGet(p, "/")
+		if got := w.Header().Get("X-Cache"); got != expected {
+			t.Errorf("Request %d: Expected X-Cache %s, got %s", i+1, expected, got)
+		}
+		if w.Body.String() != "1" {
+			t.Errorf("Request %d: Expected body 1, got %s", i+1, w.Body.String())
+		}
+	}
+	if w := cacheGet(p, "/other"); w.Body.String() != "2" {
+		t.Errorf("Expected other path to be fetched, got body %s", w.Body.String())
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	p, c, cleanup := newCacheTest(t, "", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		w.Write([]byte("slow"))
+	})
+	defer cleanup()
+
+	const n = 10
+	responses := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = cacheGet(p, "/")
+		}(i)
+	}
+	// wait until one request is at the upstream and the others wait for it
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&count) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a request to reach the upstream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if count != 1 {
+		t.Errorf("Expected 1 request to reach the upstream, got %d", count)
+	}
+	var misses int
+	for i, w := range responses {
+		if w.Body.String() != "slow" {
+			t.Errorf("Response %d: Expected body slow, got %s", i, w.Body.String())
+		}
+		if w.Header().Get("X-Cache") == "MISS" {
+			misses++
+		}
+	}
+	if misses != 1 {
+		t.Errorf("Expected 1 miss, got %d", misses)
+	}
+	if len(c.fetching) != 0 {
+		t.Errorf("Expected no fetches to be left, got %d", len(c.fetching))
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	var count int32
+	release := make(chan struct{}, 10)
+	p, c, cleanup := newCacheTest(t, "{\nttl 1h\nstale 1h\n}", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		if n > 1 {
+			<-release
+		}
+		w.Write([]byte(strconv.Itoa(int(n))))
+	})
+	defer cleanup()
+
+	age := func(d time.Duration) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, elem := range c.entries {
+			elem.Value.(*cacheEntry).stored = time.Now().Add(-d)
+		}
+	}
+
+	cacheGet(p, "/")
+	age(90 * time.Minute)
+
+	// stale entries are served right away, while one
+	// revalidation runs no matter how many are served
+	for i := 0; i < 5; i++ {
+		w := cacheGet(p, "/")
+		if w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "1" {
+			t.Errorf("Request %d: Expected stale body 1, got %s %s", i+1, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	release <- struct{}{}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.mu.Lock()
+		done := len(c.revalidating) == 0
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected revalidation to finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 requests to reach the upstream, got %d", count)
+	}
+	if w := cacheGet(p, "/"); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "2" {
+		t.Errorf("Expected revalidated body 2, got %s %s", w.Header().Get("X-Cache"), w.Body.String())
+	}
+
+	// after the stale period, entries are not served
+	age(3 * time.Hour)
+	release <- struct{}{}
+	if w := cacheGet(p, "/"); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "3" {
+		t.Errorf("Expected expired entry to be fetched again, got %s %s", w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	var count int32
+	p, c, cleanup := newCacheTest(t, "{\nmax_size 1kb\n}", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	})
+	defer cleanup()
+
+	for i := 0; i < 20; i++ {
+		cacheGet(p, "/"+strconv.Itoa(i))
+		if i == 1 {
+			// keep /0 in use, so that /1 is the least recently used
+			cacheGet(p, "/0")
+		}
+	}
+	if c.size > c.maxSize {
+		t.Errorf("Expected size of cache to be at most %d, got %d", c.maxSize, c.size)
+	}
+	if c.lru.Len() != len(c.entries) || c.lru.Len() == 0 || c.lru.Len() >= 20 {
+		t.Errorf("Expected some of 20 entries to be evicted, got %d (lru %d)", len(c.entries), c.lru.Len())
+	}
+	if w := cacheGet(p, "/19"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected most recent entry to be kept, got %s", w.Header().Get("X-Cache"))
+	}
+	if w := cacheGet(p, "/1"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected least recently used entry to be evicted, got %s", w.Header().Get("X-Cache"))
+	}
+
+	// responses larger than the cache are not cached
+	body = strings.Repeat("x", 2000)
+	cacheGet(p, "/large")
+	if w := cacheGet(p, "/large"); w.Header().Get("X-Cache") != "MISS" || w.Body.Len() != 2000 {
+		t.Errorf("Expected large response to be served but not cached, got %s with %d bytes",
+			w.Header().Get("X-Cache"), w.Body.Len())
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	handler := func(count *int32) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(count, 1)
+			switch r.URL.Path {
+			case "/cookie":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+			case "/private":
+				w.Header().Set("Cache-Control", "private, max-age=60")
+			case "/notfound":
+				w.WriteHeader(http.StatusNotFound)
+			}
+			w.Write([]byte(strconv.Itoa(int(n))))
+		}
+	}
+
+	tests := []struct {
+		block  string
+		path   string
+		header []string
+		cached bool
+	}{
+		{"", "/", nil, true},
+		{"", "/", []string{"Authorization", "Basic Zm9vOmJhcg=="}, false},
+		{"{\nallow authorization\n}", "/", []string{"Authorization", "Basic Zm9vOmJhcg=="}, true},
+		{"", "/cookie", nil, false},
+		{"{\nallow set_cookie\n}", "/cookie", nil, true},
+		{"{\nallow set_cookie authorization\n}", "/private", nil, false},
+		{"", "/notfound", nil, false},
+		{"", "/", []string{"Upgrade", "websocket"}, false},
+		{"", "/", []string{"Range", "bytes=0-0"}, false},
+	}
+
+	for i, test := range tests {
+		var count int32
+		p, _, cleanup := newCacheTest(t, test.block, handler(&count))
+		cacheGet(p, test.path, test.header...)
+		w := cacheGet(p, test.path, test.header...)
+		cleanup()
+
+		expected := "2"
+		if test.cached {
+			expected = "1"
+		}
+		if w.Body.String() != expected {
+			t.Errorf("Test %d: Expected cached to be %t, got body %s (X-Cache %s)",
+				i+1, test.cached, w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+
+	// other methods are not cached
+	var count int32
+	p, _, cleanup := newCacheTest(t, "", handler(&count))
+	defer cleanup()
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader("data"))
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Header().Get("X-Cache") != "" {
+			t.Errorf("Expected no X-Cache for POST, got %s", w.Header().Get("X-Cache"))
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected every POST to reach the upstream, got %d", count)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  int64
+		shouldErr bool
+	}{
+		{"100", 100, false},
+		{"64mb", 64 << 20, false},
+		{"2KB", 2 << 10, false},
+		{"1gb", 1 << 30, false},
+		{"mb", 0, true},
+		{"-1", 0, true},
+		{"1tb", 0, true},
+	}
+	for i, test := range tests {
+		got, err := parseSize(test.input)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: Expected error to be %t, got: %v", i+1, test.shouldErr, err)
+		}
+		if got != test.expected {
+			t.Errorf("Test %d: Expected %d, got %d", i+1, test.expected, got)
+		}
+	}
+}
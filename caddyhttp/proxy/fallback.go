@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// Defaults for fallbacks.
+const (
+	DefaultFallbackMaxAge = 24 * time.Hour
+	maxFallbackSize       = 4 << 20
+)
+
+// fallbackRefreshInterval is how often, at most, the stored
+// copy of a page is written again, to bound disk writes.
+var fallbackRefreshInterval = time.Minute
+
+// servedFromHeader tells that a response is the stored copy.
+const servedFromHeader = "X-Served-From"
+
+// fallback keeps a copy on disk of the last good response for
+// some pages and serves it, as long as it is not too old, when
+// all tries to proxy a request for the page fail. A try that is
+// still waiting for the response headers after the timeout, if
+// there is one, is given up, so that the copy is served quickly.
+type fallback struct {
+	store   string              // directory of the copies
+	paths   map[string]struct{} // of pages that are kept
+	maxAge  time.Duration
+	timeout time.Duration
+
+	mu      sync.Mutex
+	written map[string]time.Time // when each copy was written
+}
+
+// parseFallback parses the fallback_on_error property:
+//
+//	fallback_on_error {
+//	    store   directory
+//	    paths   path...
+//	    max_age duration
+//	    timeout duration
+//	}
+func parseFallback(c *caddyfile.Dispenser) (*fallback, error) {
+	f := &fallback{
+		paths:   make(map[string]struct{}),
+		maxAge:  DefaultFallbackMaxAge,
+		written: make(map[string]time.Time),
+	}
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	c.IncrNest()
+	for c.NextBlock() {
+		property := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 || (property != "paths" && len(args) > 1) {
+			return nil, c.ArgErr()
+		}
+		var err error
+		switch property {
+		case "store":
+			f.store = args[0]
+		case "paths":
+			for _, path := range args {
+				if !strings.HasPrefix(path, "/") {
+					return nil, c.Errf("fallback path '%s' must start with /", path)
+				}
+				f.paths[path] = struct{}{}
+			}
+		case "max_age":
+			f.maxAge, err = time.ParseDuration(args[0])
+			if err != nil || f.maxAge <= 0 {
+				return nil, c.Errf("invalid fallback max_age '%s'", args[0])
+			}
+		case "timeout":
+			f.timeout, err = time.ParseDuration(args[0])
+			if err != nil || f.timeout <= 0 {
+				return nil, c.Errf("invalid fallback timeout '%s'", args[0])
+			}
+		default:
+			return nil, c.Errf("unknown fallback_on_error property '%s'", property)
+		}
+	}
+	if f.store == "" {
+		return nil, c.Err("fallback_on_error requires a store")
+	}
+	if len(f.paths) == 0 {
+		return nil, c.Err("fallback_on_error requires paths")
+	}
+	return f, nil
+}
+
+// applies returns true if r is for a page that is kept. A
+// request to upgrade the connection is not, as the connection
+// cannot be hijacked through a fallbackWriter.
+func (f *fallback) applies(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, ok := f.paths[r.URL.Path]
+	return ok
+}
+
+// file returns the file of the copy of the page of r,
+// which is named after its host and path.
+func (f *fallback) file(r *http.Request) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(r.Host) + r.URL.Path))
+	return filepath.Join(f.store, hex.EncodeToString(sum[:])+".html")
+}
+
+// serve serves r with proxy, keeping a copy of good responses.
+// If proxy fails without writing a response, the copy is served
+// instead, if it is fresh enough.
+func (f *fallback) serve(w http.ResponseWriter, r *http.Request, proxy func(http.ResponseWriter, *http.Request) (int, error)) (int, error) {
+	fw := &fallbackWriter{ResponseWriter: w}
+	if f.timeout > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		fw.timer = time.AfterFunc(f.timeout, cancel)
+		r = r.WithContext(ctx)
+	}
+
+	status, err := proxy(fw, r)
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	if fw.status == 0 && (status == http.StatusBadGateway || status == http.StatusGatewayTimeout) {
+		if f.write(w, r) {
+			log.Printf("[WARNING] Serving stored copy of %s%s: %v", r.Host, r.URL.Path, err)
+			return 0, nil
+		}
+		return status, err
+	}
+	if err == nil && fw.complete() && status < 400 && r.Method == "GET" {
+		f.save(r, fw.Header().Get("Content-Type"), fw.body.Bytes())
+	}
+	return status, err
+}
+
+// write writes the copy of the page of r, if there is one
+// that is fresh enough, and returns true if it did.
+func (f *fallback) write(w http.ResponseWriter, r *http.Request) bool {
+	file := f.file(r)
+	info, err := os.Stat(file)
+	if err != nil || time.Since(info.ModTime()) > f.maxAge {
+		return false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	// the first line of the file is the media type
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return false
+	}
+	w.Header().Set("Content-Type", string(data[:i]))
+	w.Header().Set(servedFromHeader, "stale-cache")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(data[i+1:])
+	}
+	return true
+}
+
+// save stores body as the copy of the page of r, unless
+// the copy was written less than a refresh interval ago.
+func (f *fallback) save(r *http.Request, contentType string, body []byte) {
+	file := f.file(r)
+	now := time.Now()
+	f.mu.Lock()
+	last, ok := f.written[file]
+	if !ok {
+		if info, err := os.Stat(file); err == nil {
+			last = info.ModTime()
+		}
+	}
+	if now.Sub(last) < fallbackRefreshInterval {
+		f.written[file] = last
+		f.mu.Unlock()
+		return
+	}
+	f.written[file] = now
+	f.mu.Unlock()
+
+	data := make([]byte, 0, len(contentType)+1+len(body))
+	data = append(append(append(data, contentType...), '\n'), body...)
+	if err := os.MkdirAll(f.store, 0700); err != nil {
+		log.Printf("[ERROR] Storing copy of %s%s: %v", r.Host, r.URL.Path, err)
+		return
+	}
+	if err := writeFileAtomic(file, data, 0600); err != nil {
+		log.Printf("[ERROR] Storing copy of %s%s: %v", r.Host, r.URL.Path, err)
+	}
+}
+
+// writeFileAtomic writes data to file by writing it to a
+// temporary file next to it and renaming that over file. The
+// temporary file has a name of its own, so that copies of the
+// same page that are saved at once do not write into each other.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fallbackWriter writes the response to ResponseWriter and
+// records the body if the response is an HTML page that can
+// be kept: a 200 response that is not encoded.
+type fallbackWriter struct {
+	http.ResponseWriter
+	timer    *time.Timer // stopped once the response begins
+	status   int
+	keep     bool
+	body     bytes.Buffer
+	tooLarge bool
+	failed   bool // writing to the client failed
+}
+
+// WriteHeader records whether the response can be kept and writes it.
+func (fw *fallbackWriter) WriteHeader(status int) {
+	if fw.status != 0 {
+		return
+	}
+	fw.status = status
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	header := fw.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	fw.keep = status == http.StatusOK && mediaType == "text/html" &&
+		header.Get("Content-Encoding") == "" && header.Get("Content-Range") == ""
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records b, if the response is kept and not too large yet, and writes it.
+func (fw *fallbackWriter) Write(b []byte) (int, error) {
+	fw.WriteHeader(http.StatusOK)
+	if fw.keep && !fw.tooLarge {
+		if fw.body.Len()+len(b) > maxFallbackSize {
+			fw.tooLarge = true
+			fw.body = bytes.Buffer{}
+		} else {
+			fw.body.Write(b)
+		}
+	}
+	n, err := fw.ResponseWriter.Write(b)
+	if err != nil {
+		fw.failed = true
+	}
+	return n, err
+}
+
+// complete returns true if the response can be kept and all of
+// its body was recorded: the proxy copies the body until it ends
+// or until writing it to the client fails, and the body that was
+// recorded has the length that the response said it has, if any.
+func (fw *fallbackWriter) complete() bool {
+	if !fw.keep || fw.tooLarge || fw.failed {
+		return false
+	}
+	if cl := fw.Header().Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		return err == nil && n == fw.body.Len()
+	}
+	return true
+}
+
+// Flush flushes the response, so that it keeps being streamed.
+func (fw *fallbackWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestParseFallback(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		maxAge    time.Duration
+		timeout   time.Duration
+	}{
+		{"{\nstore /tmp/fallback\npaths / /pricing\n}", false, DefaultFallbackMaxAge, 0},
+		{"{\nstore /tmp/fallback\npaths /\nmax_age 1h\ntimeout 2s\n}", false, time.Hour, 2 * time.Second},
+		{"", true, 0, 0},
+		{"{\npaths /\n}", true, 0, 0},
+		{"{\nstore /tmp/fallback\n}", true, 0, 0},
+		{"{\nstore /tmp/fallback\npaths pricing\n}", true, 0, 0},
+		{"{\nstore /tmp/a /tmp/b\npaths /\n}", true, 0, 0},
+		{"{\nstore /tmp/fallback\npaths /\nmax_age never\n}", true, 0, 0},
+		{"{\nstore /tmp/fallback\npaths /\ntimeout -1s\n}", true, 0, 0},
+		{"{\nstore /tmp/fallback\npaths /\nfoo bar\n}", true, 0, 0},
+	} {
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader("fallback_on_error "+test.input))
+		c.Next()
+		f, err := parseFallback(&c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if f.maxAge != test.maxAge || f.timeout != test.timeout {
+			t.Errorf("Test %d: Expected max_age %v and timeout %v, got %v and %v", i, test.maxAge, test.timeout, f.maxAge, f.timeout)
+		}
+	}
+}
+
+// newFallbackTest returns a proxy with the fallback_on_error block
+// fallbackBlock to an upstream that uses handler, the fallback of
+// the proxy and the upstream.
+func newFallbackTest(t *testing.T, fallbackBlock string, handler http.HandlerFunc) (*Proxy, *fallback, *httptest.Server) {
+	backend := httptest.NewServer(handler)
+	config := "proxy / " + backend.URL + " {\nfallback_on_error " + fallbackBlock + "\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+	return p, upstreams[0].(*staticUpstream).Fallback, backend
+}
+
+func fallbackGet(p *Proxy, path string) (*httptest.ResponseRecorder, int) {
+	r, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	w := httptest.NewRecorder()
+	status, _ := p.ServeHTTP(w, r)
+	return w, status
+}
+
+func TestFallbackOnError(t *testing.T) {
+	store, err := ioutil.TempDir("", "caddy_fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	block := "{\nstore " + store + "\npaths / /pricing /broken\nmax_age 1h\n}"
+	p, f, backend := newFallbackTest(t, block, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("broken"))
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("page " + r.URL.Path))
+		}
+	})
+
+	for _, path := range []string{"/", "/pricing", "/broken", "/other", "/data.json"} {
+		if _, status := fallbackGet(p, path); status != 0 {
+			t.Fatalf("Expected %s to be proxied, got status %d", path, status)
+		}
+	}
+	files, _ := ioutil.ReadDir(store)
+	if len(files) != 2 {
+		t.Errorf("Expected copies of 2 pages, got %d files", len(files))
+	}
+	backend.Close()
+
+	for i, test := range []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/", 0, "page /"},
+		{"/pricing", 0, "page /pricing"},
+		{"/broken", http.StatusBadGateway, ""},
+		{"/other", http.StatusBadGateway, ""},
+	} {
+		w, status := fallbackGet(p, test.path)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+			continue
+		}
+		if test.expectedStatus != 0 {
+			continue
+		}
+		if w.Code != http.StatusOK || w.Body.String() != test.expectedBody {
+			t.Errorf("Test %d: Expected stored copy '%s', got %d '%s'", i, test.expectedBody, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Served-From"); got != "stale-cache" {
+			t.Errorf("Test %d: Expected X-Served-From: stale-cache, got '%s'", i, got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Test %d: Expected Cache-Control: no-store, got '%s'", i, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("Test %d: Expected the stored media type, got '%s'", i, got)
+		}
+	}
+
+	// copies older than max_age are not served
+	r, _ := http.NewRequest("GET", "http://example.com/pricing", nil)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(f.file(r), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := fallbackGet(p, "/pricing"); status != http.StatusBadGateway {
+		t.Errorf("Expected status 502 for an old copy, got %d", status)
+	}
+}
+
+func TestFallbackRefreshInterval(t *testing.T) {
+	store, err := ioutil.TempDir("", "caddy_fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	var n int
+	p, f, backend := newFallbackTest(t, "{\nstore "+store+"\npaths /\n}", func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(strings.Repeat("x", n)))
+	})
+	defer backend.Close()
+
+	read := func() string {
+		files, _ := filepath.Glob(filepath.Join(store, "*.html"))
+		if len(files) != 1 {
+			t.Fatalf("Expected 1 copy, got %v", files)
+		}
+		b, _ := ioutil.ReadFile(files[0])
+		return string(b)
+	}
+	fallbackGet(p, "/")
+	fallbackGet(p, "/")
+	if got := read(); got != "text/html\nx" {
+		t.Errorf("Expected the first copy to be kept within the refresh interval, got %q", got)
+	}
+
+	// the copy is written again once the interval passed
+	for file := range f.written {
+		f.written[file] = time.Now().Add(-2 * fallbackRefreshInterval)
+	}
+	fallbackGet(p, "/")
+	if got := read(); got != "text/html\nxxx" {
+		t.Errorf("Expected the copy to be refreshed, got %q", got)
+	}
+}
+
+func TestFallbackTimeout(t *testing.T) {
+	store, err := ioutil.TempDir("", "caddy_fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	release := make(chan struct{})
+	var slow int32
+	p, _, backend := newFallbackTest(t, "{\nstore "+store+"\npaths /\ntimeout 100ms\n}", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			<-release
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("home"))
+	})
+	defer backend.Close()
+	defer close(release)
+
+	fallbackGet(p, "/")
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	w, status := fallbackGet(p, "/")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the stored copy after the timeout, took %v", elapsed)
+	}
+	if status != 0 || w.Body.String() != "home" || w.Header().Get("X-Served-From") != "stale-cache" {
+		t.Errorf("Expected the stored copy, got status %d and body '%s'", status, w.Body.String())
+	}
+}
+
+// failingWriter is a ResponseWriter whose client has gone away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestFallbackIncompleteResponse(t *testing.T) {
+	store, err := ioutil.TempDir("", "caddy_fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	p, f, backend := newFallbackTest(t, "{\nstore "+store+"\npaths /truncated /client\n}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/truncated" {
+			// the upstream goes away in the middle of the body
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("half a page"))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("page"))
+	})
+	defer backend.Close()
+
+	fallbackGet(p, "/truncated")
+	r, _ := http.NewRequest("GET", "http://example.com/client", nil)
+	p.ServeHTTP(failingWriter{httptest.NewRecorder()}, r)
+	if files, _ := ioutil.ReadDir(store); len(files) != 0 {
+		t.Errorf("Expected no copies of incomplete responses, got %d files", len(files))
+	}
+
+	// the connection of a request to upgrade it must be hijackable
+	r, _ = http.NewRequest("GET", "http://example.com/client", nil)
+	r.Header.Set("Upgrade", "websocket")
+	if f.applies(r) {
+		t.Error("Expected a request to upgrade the connection not to be kept")
+	}
+}
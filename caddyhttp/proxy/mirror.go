@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Defaults for mirrors.
+const (
+	DefaultMirrorTimeout = 5 * time.Second
+	DefaultMirrorMaxBody = 1 << 20
+	DefaultMirrorWorkers = 16
+)
+
+// mirrorStats counts, for each mirror by its URL, the requests
+// sent to it and what became of them.
+var mirrorStats = expvar.NewMap("proxy_mirrors")
+
+// mirror sends copies of a sample of the requests that are
+// proxied to a shadow upstream, whose responses are thrown
+// away. Copies are sent by a fixed number of workers after
+// the request was proxied; if they are all busy, the copy
+// is dropped, so that mirroring never holds up a request.
+type mirror struct {
+	target  *url.URL
+	sample  float64       // fraction of requests to mirror
+	timeout time.Duration // for each mirrored request
+	maxBody int64         // requests with larger bodies are not mirrored
+	workers int
+
+	client *http.Client
+	queue  chan *http.Request
+	stop   chan struct{}
+	start  sync.Once
+	stats  *expvar.Map
+}
+
+// newMirror returns a mirror to target with the default settings.
+func newMirror(target *url.URL) *mirror {
+	stats := new(expvar.Map).Init()
+	mirrorStats.Set(target.String(), stats)
+	return &mirror{
+		target:  target,
+		sample:  1,
+		timeout: DefaultMirrorTimeout,
+		maxBody: DefaultMirrorMaxBody,
+		workers: DefaultMirrorWorkers,
+		stop:    make(chan struct{}),
+		stats:   stats,
+	}
+}
+
+// prepare makes the copy of r to send to the mirror, if r is
+// sampled and its body is small enough. The body of r is read
+// for this and replaced with one that reads the same bytes.
+// It returns nil if r is not to be mirrored.
+func (m *mirror) prepare(r *http.Request) *http.Request {
+	if rand.Float64() >= m.sample {
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+		if err != nil || int64(len(body)) > m.maxBody {
+			// the upstream still gets what was read
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			m.stats.Add("too_large", 1)
+			return nil
+		}
+		r.Body = readCloser{bytes.NewReader(body), r.Body}
+	}
+
+	u := *m.target
+	u.Path = singleJoiningSlash(m.target.Path, r.URL.Path)
+	u.RawQuery = r.URL.RawQuery
+	mirrored, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		m.stats.Add("failures", 1)
+		return nil
+	}
+	copyHeader(mirrored.Header, r.Header)
+	for _, h := range hopHeaders {
+		mirrored.Header.Del(h)
+	}
+	return mirrored
+}
+
+// submit queues req to be sent to the mirror, unless
+// all workers are busy, in which case it is dropped.
+func (m *mirror) submit(req *http.Request) {
+	m.start.Do(m.startWorkers)
+	select {
+	case m.queue <- req:
+	default:
+		m.stats.Add("dropped", 1)
+	}
+}
+
+// startWorkers starts the workers that send requests from
+// the queue to the mirror until the mirror is stopped.
+func (m *mirror) startWorkers() {
+	m.client = &http.Client{
+		Timeout: m.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	m.queue = make(chan *http.Request, m.workers)
+	for i := 0; i < m.workers; i++ {
+		go func() {
+			for {
+				select {
+				case req := <-m.queue:
+					m.send(req)
+				case <-m.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// send sends req to the mirror and discards the response.
+func (m *mirror) send(req *http.Request) {
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	m.stats.Add("requests", 1)
+	m.stats.Add("latency_ms", int64(time.Since(start)/time.Millisecond))
+	if err != nil || resp.StatusCode >= 500 {
+		m.stats.Add("failures", 1)
+	}
+}
+
+// Stop stops the workers of m; requests that are
+// still queued are not sent.
+func (m *mirror) Stop() {
+	close(m.stop)
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
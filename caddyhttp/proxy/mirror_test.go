@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// mirrorRequest is a request received by the shadow upstream.
+type mirrorRequest struct {
+	method, path, body string
+	header             http.Header
+}
+
+// newMirrorTest starts a primary upstream, which responds with
+// the body of the request and a fixed text, and a shadow upstream,
+// which reports the requests it receives on the returned channel.
+// It returns a proxy to the primary upstream, configured with the
+// mirror block mirrorBlock unless it is empty.
+func newMirrorTest(t *testing.T, mirrorBlock string) (*Proxy, chan mirrorRequest, func()) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Primary", "yes")
+		w.Write(body)
+		w.Write([]byte(" from primary " + r.URL.String()))
+	}))
+	received := make(chan mirrorRequest, 100)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- mirrorRequest{r.Method, r.URL.RequestURI(), string(body), r.Header}
+		w.Write([]byte("from shadow"))
+	}))
+
+	config := "proxy / " + primary.URL
+	if mirrorBlock != "" {
+		config += " {\nmirror " + shadow.URL + " " + mirrorBlock + "\n}"
+	}
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+	return p, received, func() {
+		for _, u := range upstreams {
+			if m := u.(*staticUpstream).Mirror; m != nil {
+				m.Stop()
+			}
+		}
+		primary.Close()
+		shadow.Close()
+	}
+}
+
+func TestMirrorPrimaryResponse(t *testing.T) {
+	serve := func(p *Proxy) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "/upload?x=1", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Custom", "custom")
+		r.Header.Set("Connection", "close")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	plain, _, cleanup := newMirrorTest(t, "")
+	defer cleanup()
+	mirrored, received, cleanupMirrored := newMirrorTest(t, "{\nsample 1\ntimeout 2s\n}")
+	defer cleanupMirrored()
+
+	want, got := serve(plain), serve(mirrored)
+	if want.Code != got.Code {
+		t.Errorf("Expected status %d with mirroring, got %d", want.Code, got.Code)
+	}
+	if !bytes.Equal(want.Body.Bytes(), got.Body.Bytes()) {
+		t.Errorf("Expected body %q with mirroring, got %q", want.Body.String(), got.Body.String())
+	}
+	if got.Header().Get("X-Primary") != "yes" {
+		t.Errorf("Expected response headers of primary, got %v", got.Header())
+	}
+
+	select {
+	case req := <-received:
+		if req.method != "POST" || req.path != "/upload?x=1" || req.body != "hello" {
+			t.Errorf("Expected mirror to receive POST /upload?x=1 with body hello, got %s %s with body %q",
+				req.method, req.path, req.body)
+		}
+		if req.header.Get("X-Custom") != "custom" {
+			t.Errorf("Expected mirror to receive X-Custom header, got %v", req.header)
+		}
+		if req.header.Get("Connection") != "" {
+			t.Errorf("Expected hop-by-hop headers to be removed, got Connection: %s", req.header.Get("Connection"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected mirror to receive the request")
+	}
+}
+
+func TestMirrorSample(t *testing.T) {
+	u, _ := http.NewRequest("GET", "http://localhost", nil)
+	m := newMirror(u.URL)
+	m.sample = 0.25
+
+	const n = 4000
+	var sampled int
+	for i := 0; i < n; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if m.prepare(r) != nil {
+			sampled++
+		}
+	}
+	// the standard deviation is about 27 requests
+	if sampled < n/4-150 || sampled > n/4+150 {
+		t.Errorf("Expected about %d of %d requests to be mirrored, got %d", n/4, n, sampled)
+	}
+
+	m.sample = 0
+	r, _ := http.NewRequest("GET", "/", nil)
+	if m.prepare(r) != nil {
+		t.Error("Expected no request to be mirrored with sample 0")
+	}
+}
+
+func TestMirrorMaxBody(t *testing.T) {
+	p, received, cleanup := newMirrorTest(t, "{\nmax_body 10\nworkers 1\n}")
+	defer cleanup()
+	m := p.Upstreams[0].(*staticUpstream).Mirror
+
+	large := strings.Repeat("x", 100)
+	for _, body := range []string{large, "small"} {
+		r, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if expected := body + " from primary /"; w.Body.String() != expected {
+			t.Errorf("Expected primary to respond %q, got %q", expected, w.Body.String())
+		}
+	}
+
+	select {
+	case req := <-received:
+		if req.body != "small" {
+			t.Errorf("Expected only the small body to be mirrored, got %q", req.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected mirror to receive the small request")
+	}
+	if tooLarge := m.stats.Get("too_large"); tooLarge == nil || tooLarge.String() != "1" {
+		t.Errorf("Expected too_large to be 1, got %v", tooLarge)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 )
 
@@ -60,13 +61,13 @@ func TestRoundRobinPolicy(t *testing.T) {
 		t.Error("Expected third round robin host to be first host in the pool.")
 	}
 	// mark host as down
-	pool[1].Unhealthy = true
+	atomic.StoreInt32(&pool[1].Unhealthy, 1)
 	h = rrPolicy.Select(pool, request)
 	if h != pool[2] {
 		t.Error("Expected to skip down host.")
 	}
 	// mark host as up
-	pool[1].Unhealthy = false
+	atomic.StoreInt32(&pool[1].Unhealthy, 0)
 
 	h = rrPolicy.Select(pool, request)
 	if h == pool[2] {
@@ -161,7 +162,7 @@ func TestIPHashPolicy(t *testing.T) {
 	// we should get a healthy host if the original host is unhealthy and a
 	// healthy host is available
 	request.RemoteAddr = "172.0.0.1"
-	pool[1].Unhealthy = true
+	atomic.StoreInt32(&pool[1].Unhealthy, 1)
 	h = ipHash.Select(pool, request)
 	if h != pool[0] {
 		t.Error("Expected ip hash policy host to be the first host.")
@@ -172,10 +173,10 @@ func TestIPHashPolicy(t *testing.T) {
 	if h != pool[1] {
 		t.Error("Expected ip hash policy host to be the second host.")
 	}
-	pool[1].Unhealthy = false
+	atomic.StoreInt32(&pool[1].Unhealthy, 0)
 
 	request.RemoteAddr = "172.0.0.3"
-	pool[2].Unhealthy = true
+	atomic.StoreInt32(&pool[2].Unhealthy, 1)
 	h = ipHash.Select(pool, request)
 	if h != pool[0] {
 		t.Error("Expected ip hash policy host to be the first host.")
@@ -219,8 +220,8 @@ func TestIPHashPolicy(t *testing.T) {
 	}
 
 	// We should get nil when there are no healthy hosts
-	pool[0].Unhealthy = true
-	pool[1].Unhealthy = true
+	atomic.StoreInt32(&pool[0].Unhealthy, 1)
+	atomic.StoreInt32(&pool[1].Unhealthy, 1)
 	h = ipHash.Select(pool, request)
 	if h != nil {
 		t.Error("Expected ip hash policy host to be nil.")
@@ -42,12 +42,20 @@ type UpstreamHost struct {
 	ReverseProxy      *ReverseProxy
 	Fails             int32
 	FailTimeout       time.Duration
-	Unhealthy         bool
+	Unhealthy         int32 // 1 if the health check fails; accessed atomically
 	UpstreamHeaders   http.Header
 	DownstreamHeaders http.Header
 	CheckDown         UpstreamHostDownFunc
 	WithoutPathPrefix string
 	MaxConns          int64
+
+	// the traffic of the host, shared by the hosts of the same
+	// name; nil if the host is not registered for a site
+	traffic *httpserver.Traffic
+
+	// whether Name has placeholders; such a host is not proxied
+	// to, but resolved to a host for each request
+	template bool
 }
 
 // Down checks whether the upstream host is down or not.
@@ -56,7 +64,7 @@ type UpstreamHost struct {
 func (uh *UpstreamHost) Down() bool {
 	if uh.CheckDown == nil {
 		// Default settings
-		return uh.Unhealthy || uh.Fails > 0
+		return atomic.LoadInt32(&uh.Unhealthy) != 0 || atomic.LoadInt32(&uh.Fails) > 0
 	}
 	return uh.CheckDown(uh)
 }
@@ -83,6 +91,35 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		return p.Next.ServeHTTP(w, r)
 	}
 
+	// a copy of the request for the mirror is sent once the
+	// request has been proxied; it must be made before the
+	// body is read by the upstream
+	if su, ok := upstream.(*staticUpstream); ok && su.Mirror != nil {
+		if mirrored := su.Mirror.prepare(r); mirrored != nil {
+			defer su.Mirror.submit(mirrored)
+		}
+	}
+
+	// the response recorder is looked up here because the
+	// cache wraps the response writer
+	rr, _ := w.(*httpserver.ResponseRecorder)
+	serve := func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if su, ok := upstream.(*staticUpstream); ok && su.Cache != nil && !su.Cache.bypass(r) {
+			return su.Cache.serve(w, r, func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return p.proxy(w, r, upstream, rr)
+			})
+		}
+		return p.proxy(w, r, upstream, rr)
+	}
+	if su, ok := upstream.(*staticUpstream); ok && su.Fallback != nil && su.Fallback.applies(r) {
+		return su.Fallback.serve(w, r, serve)
+	}
+	return serve(w, r)
+}
+
+// proxy proxies r to one of the hosts of upstream. If rr is
+// not nil, the name of the host is set as a placeholder in it.
+func (p Proxy) proxy(w http.ResponseWriter, r *http.Request, upstream Upstream, rr *httpserver.ResponseRecorder) (int, error) {
 	// this replacer is used to fill in header field values
 	replacer := httpserver.NewReplacer(r, nil, "")
 
@@ -97,9 +134,12 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		if host == nil {
 			return http.StatusBadGateway, errUnreachable
 		}
-		if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
+		if rr != nil && rr.Replacer != nil {
 			rr.Replacer.Set("upstream", host.Name)
 		}
+		if su, ok := upstream.(*staticUpstream); ok && su.Sticky != nil {
+			su.Sticky.pin(w, r, host)
+		}
 
 		proxy := host.ReverseProxy
 
@@ -139,15 +179,32 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			downHeaderUpdateFn = createRespHeaderUpdateFn(host.DownstreamHeaders, replacer)
 		}
 
+		// count the bodies going to and coming from the host
+		if host.traffic != nil {
+			if r.Body != nil && r.ContentLength != 0 {
+				outreq.Body = host.traffic.CountSent(r.Body)
+			}
+			downHeaderUpdateFn = countResponse(host.traffic, downHeaderUpdateFn)
+		}
+
 		// tell the proxy to serve the request
 		atomic.AddInt64(&host.Conns, 1)
 		backendErr := proxy.ServeHTTP(w, outreq, downHeaderUpdateFn)
 		atomic.AddInt64(&host.Conns, -1)
 
-		// if no errors, we're done here; otherwise failover
+		// if no errors, we're done here; otherwise failover,
+		// unless the client has part of the response already
 		if backendErr == nil {
 			return 0, nil
 		}
+		if rerr, ok := backendErr.(responseError); ok {
+			return 0, rerr
+		}
+
+		// a canceled request is not the fault of the host
+		if err := r.Context().Err(); err != nil {
+			return http.StatusGatewayTimeout, err
+		}
 		timeout := host.FailTimeout
 		if timeout == 0 {
 			timeout = 10 * time.Second
@@ -210,6 +267,19 @@ func createUpstreamRequest(r *http.Request) *http.Request {
 		}
 	}
 
+	// Neither are headers whose names are invalid, or
+	// that the backend could take for other headers
+	for name := range r.Header {
+		if !httpserver.ValidHeaderName(name) {
+			if !copiedHeaders {
+				outreq.Header = make(http.Header)
+				copyHeader(outreq.Header, r.Header)
+				copiedHeaders = true
+			}
+			delete(outreq.Header, name)
+		}
+	}
+
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		// If we aren't the first proxy, retain prior
 		// X-Forwarded-For information as a comma+space
@@ -223,6 +293,18 @@ func createUpstreamRequest(r *http.Request) *http.Request {
 	return outreq
 }
 
+// countResponse returns a respUpdateFn that counts the bytes
+// read from the body of the response as received by traffic,
+// after calling next, if it is not nil.
+func countResponse(traffic *httpserver.Traffic, next respUpdateFn) respUpdateFn {
+	return func(resp *http.Response) {
+		if next != nil {
+			next(resp)
+		}
+		resp.Body = traffic.CountReceived(resp.Body)
+	}
+}
+
 func createRespHeaderUpdateFn(rules http.Header, replacer httpserver.Replacer) respUpdateFn {
 	return func(resp *http.Response) {
 		mutateHeadersByRules(resp.Header, rules, replacer)
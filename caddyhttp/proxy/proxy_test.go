@@ -19,6 +19,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/gzip"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 
 	"golang.org/x/net/websocket"
@@ -100,6 +102,41 @@ func TestReverseProxyInsecureSkipVerify(t *testing.T) {
 	}
 }
 
+func TestReverseProxyTrailers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("Hello, client"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer backend.Close()
+
+	p := &Proxy{
+		Next:      httpserver.EmptyNext, // prevents panic in some cases when test fails
+		Upstreams: []Upstream{newFakeUpstream(backend.URL, false)},
+	}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "Hello, client" {
+		t.Errorf("Expected body 'Hello, client', got '%s'", body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Expected trailer Grpc-Status to be 0, got '%s'", got)
+	}
+}
+
 func TestWebSocketReverseProxyServeHTTPHandler(t *testing.T) {
 	// No-op websocket backend simply allows the WS connection to be
 	// accepted then it will be immediately closed. Perfect for testing.
@@ -437,6 +474,43 @@ func TestUpstreamHeadersUpdate(t *testing.T) {
 
 }
 
+func TestUpstreamInvalidHeadersStripped(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var actualHeaders http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualHeaders = r.Header
+	}))
+	defer backend.Close()
+
+	p := &Proxy{
+		Next:      httpserver.EmptyNext, // prevents panic in some cases when test fails
+		Upstreams: []Upstream{newFakeUpstream(backend.URL, false)},
+	}
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	r.Header["X_Forwarded_For"] = []string{"10.0.0.1"}
+	r.Header["X Custom"] = []string{"1"}
+	r.Header.Set("X-Custom", "2")
+
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, name := range []string{"X_Forwarded_For", "X Custom"} {
+		if _, ok := actualHeaders[name]; ok {
+			t.Errorf("Request sent to upstream backend should not contain %q header", name)
+		}
+	}
+	if got := actualHeaders.Get("X-Custom"); got != "2" {
+		t.Errorf("Expected X-Custom header to be passed on, got %q", got)
+	}
+	if _, ok := r.Header["X_Forwarded_For"]; !ok {
+		t.Error("Expected headers of the original request to be left as they were")
+	}
+}
+
 func TestDownstreamHeadersUpdate(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stderr)
@@ -868,3 +942,261 @@ func BenchmarkProxy(b *testing.B) {
 		p.ServeHTTP(w, r)
 	}
 }
+
+// newByteServer returns a backend that serves blob with support
+// for range and conditional requests, like a media server, and
+// records the header of the last request it got.
+func newByteServer(blob []byte, requests *int32, lastHeader *http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if lastHeader != nil {
+			*lastHeader = r.Header
+		}
+		w.Header().Set("ETag", `"blob"`)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Unix(1e9, 0), bytes.NewReader(blob))
+	}))
+}
+
+func makeBlob(n int) []byte {
+	blob := make([]byte, n)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	return blob
+}
+
+func TestProxyRangeRequests(t *testing.T) {
+	blob := makeBlob(1000)
+	var requests int32
+	var backendHeader http.Header
+	backend := newByteServer(blob, &requests, &backendHeader)
+	defer backend.Close()
+
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: []Upstream{newFakeUpstream(backend.URL, false)}}
+	handler := gzip.Gzip{Next: p, Configs: []gzip.Config{{}}}
+
+	for i, test := range []struct {
+		header       http.Header
+		status       int
+		body         []byte
+		contentRange string
+	}{
+		// seeking
+		{http.Header{"Range": {"bytes=100-199"}}, http.StatusPartialContent, blob[100:200], "bytes 100-199/1000"},
+		{http.Header{"Range": {"bytes=900-"}}, http.StatusPartialContent, blob[900:], "bytes 900-999/1000"},
+		{http.Header{"Range": {"bytes=100-199"}, "If-Range": {`"blob"`}}, http.StatusPartialContent, blob[100:200], "bytes 100-199/1000"},
+		{http.Header{"Range": {"bytes=100-199"}, "If-Range": {`"other"`}}, http.StatusOK, blob, ""},
+		// revalidating
+		{http.Header{"If-None-Match": {`"blob"`}}, http.StatusNotModified, nil, ""},
+		{http.Header{"If-Modified-Since": {time.Unix(2e9, 0).UTC().Format(http.TimeFormat)}}, http.StatusNotModified, nil, ""},
+	} {
+		r, err := http.NewRequest("GET", "/video.mp4", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for field, values := range test.header {
+			r.Header[field] = values
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		rr := httpserver.NewResponseRecorder(w)
+		if _, err := handler.ServeHTTP(rr, r); err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+
+		for field, values := range test.header {
+			if got := backendHeader[field]; len(got) != 1 || got[0] != values[0] {
+				t.Errorf("Test %d: Expected backend to get %s: %s, got %v", i, field, values[0], got)
+			}
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if enc := w.Header().Get("Content-Encoding"); test.status != http.StatusOK && enc != "" {
+			t.Errorf("Test %d: Expected no Content-Encoding, got '%s'", i, enc)
+		}
+		if got := w.Header().Get("Content-Range"); got != test.contentRange {
+			t.Errorf("Test %d: Expected Content-Range '%s', got '%s'", i, test.contentRange, got)
+		}
+		if test.status != http.StatusOK && !bytes.Equal(w.Body.Bytes(), test.body) {
+			t.Errorf("Test %d: Expected body of %d bytes, got %d bytes", i, len(test.body), w.Body.Len())
+		}
+		if rr.Size() != w.Body.Len() {
+			t.Errorf("Test %d: Expected size %d, got %d", i, w.Body.Len(), rr.Size())
+		}
+	}
+}
+
+func TestProxyForceIdentityRanges(t *testing.T) {
+	var requests int32
+	var backendHeader http.Header
+	backend := newByteServer(makeBlob(1000), &requests, &backendHeader)
+	defer backend.Close()
+
+	upstreams, err := newStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(
+		"proxy / "+backend.URL+" {\n force_identity_ranges\n}")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	for i, test := range []struct {
+		rangeHeader      string
+		expectedEncoding string
+	}{
+		{"bytes=0-99", "identity"},
+		{"", "gzip"},
+	} {
+		r, err := http.NewRequest("GET", "/video.mp4", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept-Encoding", "gzip")
+		if test.rangeHeader != "" {
+			r.Header.Set("Range", test.rangeHeader)
+		}
+		if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if got := backendHeader.Get("Accept-Encoding"); got != test.expectedEncoding {
+			t.Errorf("Test %d: Expected backend to get Accept-Encoding '%s', got '%s'", i, test.expectedEncoding, got)
+		}
+	}
+}
+
+// sequenceUpstream selects its hosts one after the other.
+type sequenceUpstream struct {
+	hosts []*UpstreamHost
+	next  int
+}
+
+func (u *sequenceUpstream) From() string                 { return "/" }
+func (u *sequenceUpstream) AllowedPath(path string) bool { return true }
+func (u *sequenceUpstream) Select(r *http.Request) *UpstreamHost {
+	host := u.hosts[u.next%len(u.hosts)]
+	u.next++
+	return host
+}
+
+func TestProxyNoRetryAfterPartialResponse(t *testing.T) {
+	blob := makeBlob(1000)
+	var requests int32
+	good := newByteServer(blob, &requests, nil)
+	defer good.Close()
+
+	// broken sends half of the range and hangs up
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Header().Set("Content-Range", "bytes 100-199/1000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(blob[100:150])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer broken.Close()
+
+	// down is not listening at all
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for i, test := range []struct {
+		first          string
+		shouldErr      bool
+		expectedBody   []byte
+		expectedTrials int32
+	}{
+		{down.URL, false, blob[100:200], 1},
+		{broken.URL, true, blob[100:150], 0},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		u := &sequenceUpstream{hosts: []*UpstreamHost{
+			newFakeUpstream(test.first, false).host,
+			newFakeUpstream(good.URL, false).host,
+		}}
+		p := &Proxy{Next: httpserver.EmptyNext, Upstreams: []Upstream{u}}
+
+		r, err := http.NewRequest("GET", "/video.mp4", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Range", "bytes=100-199")
+		w := httptest.NewRecorder()
+		_, err = p.ServeHTTP(w, r)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), test.expectedBody) {
+			t.Errorf("Test %d: Expected body of %d bytes, got %d bytes", i, len(test.expectedBody), w.Body.Len())
+		}
+		if n := atomic.LoadInt32(&requests); n != test.expectedTrials {
+			t.Errorf("Test %d: Expected %d requests to the good host, got %d", i, test.expectedTrials, n)
+		}
+	}
+}
+
+func TestUpstreamTraffic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write(makeBlob(300))
+	}))
+	defer backend.Close()
+
+	newUpstreams := func() []Upstream {
+		upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / "+backend.URL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upstreams
+	}
+	post := func(upstreams []Upstream, n int) {
+		p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+		for i := 0; i < n; i++ {
+			r, err := http.NewRequest("POST", "/", bytes.NewReader(makeBlob(100)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+		}
+	}
+	site := &httpserver.SiteConfig{Addr: httpserver.Address{Original: "a.example.com", Host: "a.example.com"}}
+	registerUpstreams(site, newUpstreams())
+	post(siteUpstreams[site], 2)
+
+	// the counts are kept while the site still has the upstream
+	// after a restart
+	restarted := &httpserver.SiteConfig{Addr: site.Addr}
+	registerUpstreams(restarted, newUpstreams())
+	unregisterUpstreams(site)
+	expected := httpserver.TrafficCounts{Sent: 200, Received: 600}
+	if got := SiteUpstreamTraffic(restarted)[backend.URL]; got != expected {
+		t.Errorf("Expected traffic %+v for the site, got %+v", expected, got)
+	}
+
+	// another site that proxies to the same host is counted apart
+	other := &httpserver.SiteConfig{Addr: httpserver.Address{Original: "b.example.com", Host: "b.example.com"}}
+	registerUpstreams(other, newUpstreams())
+	post(siteUpstreams[other], 1)
+	if got, expected := SiteUpstreamTraffic(other)[backend.URL], (httpserver.TrafficCounts{Sent: 100, Received: 300}); got != expected {
+		t.Errorf("Expected traffic %+v for the other site, got %+v", expected, got)
+	}
+	if got := SiteUpstreamTraffic(restarted)[backend.URL]; got != expected {
+		t.Errorf("Expected traffic %+v for the site, got %+v", expected, got)
+	}
+	if got, expected := UpstreamTraffic()[backend.URL], (httpserver.TrafficCounts{Sent: 300, Received: 900}); got != expected {
+		t.Errorf("Expected traffic %+v of all the sites, got %+v", expected, got)
+	}
+
+	unregisterUpstreams(restarted)
+	unregisterUpstreams(other)
+	if _, ok := UpstreamTraffic()[backend.URL]; ok {
+		t.Error("Expected traffic to be forgotten once no site has the upstream")
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// siteUpstreams keeps the upstreams each site proxies to,
+// so that other directives can report on their health.
+var (
+	siteUpstreams   = make(map[*httpserver.SiteConfig][]Upstream)
+	siteUpstreamsMu sync.RWMutex
+)
+
+// hostTraffic holds the traffic of each upstream host, by the
+// address of the site that proxies to it and its name, so that
+// the sites that proxy to the same host are counted apart. A host
+// keeps its counts across restarts, as long as its site still
+// has it.
+var (
+	hostTraffic   = make(map[hostTrafficKey]*trafficRef)
+	hostTrafficMu sync.Mutex
+)
+
+type hostTrafficKey struct {
+	site, host string
+}
+
+type trafficRef struct {
+	traffic httpserver.Traffic
+	refs    int
+}
+
+func registerUpstreams(site *httpserver.SiteConfig, upstreams []Upstream) {
+	siteUpstreamsMu.Lock()
+	siteUpstreams[site] = append(siteUpstreams[site], upstreams...)
+	siteUpstreamsMu.Unlock()
+
+	hostTrafficMu.Lock()
+	forEachHost(upstreams, func(host *UpstreamHost) {
+		key := hostTrafficKey{site.Addr.String(), host.Name}
+		ref, ok := hostTraffic[key]
+		if !ok {
+			ref = new(trafficRef)
+			hostTraffic[key] = ref
+		}
+		ref.refs++
+		host.traffic = &ref.traffic
+	})
+	hostTrafficMu.Unlock()
+}
+
+func unregisterUpstreams(site *httpserver.SiteConfig) {
+	siteUpstreamsMu.Lock()
+	upstreams := siteUpstreams[site]
+	delete(siteUpstreams, site)
+	siteUpstreamsMu.Unlock()
+
+	hostTrafficMu.Lock()
+	forEachHost(upstreams, func(host *UpstreamHost) {
+		key := hostTrafficKey{site.Addr.String(), host.Name}
+		if ref, ok := hostTraffic[key]; ok {
+			if ref.refs--; ref.refs <= 0 {
+				delete(hostTraffic, key)
+			}
+		}
+	})
+	hostTrafficMu.Unlock()
+}
+
+// forEachHost calls fn for each host of the upstreams
+// that can list their hosts.
+func forEachHost(upstreams []Upstream, fn func(*UpstreamHost)) {
+	for _, upstream := range upstreams {
+		if static, ok := upstream.(*staticUpstream); ok {
+			for _, host := range static.Hosts {
+				fn(host)
+			}
+		}
+	}
+}
+
+// UpstreamTraffic returns the traffic of every upstream host
+// the proxy directive is configured with, by name: the bytes
+// of the bodies of the requests sent to each host and of the
+// responses received from it, by all the sites together.
+func UpstreamTraffic() map[string]httpserver.TrafficCounts {
+	hostTrafficMu.Lock()
+	defer hostTrafficMu.Unlock()
+	counts := make(map[string]httpserver.TrafficCounts, len(hostTraffic))
+	for key, ref := range hostTraffic {
+		c := ref.traffic.Counts()
+		total := counts[key.host]
+		total.Received += c.Received
+		total.Sent += c.Sent
+		counts[key.host] = total
+	}
+	return counts
+}
+
+// SiteUpstreamTraffic is like UpstreamTraffic, but only for
+// the upstream hosts the proxy directive configured for site,
+// and only the traffic of site.
+func SiteUpstreamTraffic(site *httpserver.SiteConfig) map[string]httpserver.TrafficCounts {
+	counts := make(map[string]httpserver.TrafficCounts)
+	siteUpstreamsMu.RLock()
+	defer siteUpstreamsMu.RUnlock()
+	forEachHost(siteUpstreams[site], func(host *UpstreamHost) {
+		if host.traffic != nil {
+			counts[host.Name] = host.traffic.Counts()
+		}
+	})
+	return counts
+}
+
+// HostCounts returns how many of the upstream hosts the proxy
+// directive configured for site are not down, and how many
+// upstream hosts there are in total. Only upstreams that can
+// list their hosts (like the ones made by NewStaticUpstreams)
+// are counted.
+func HostCounts(site *httpserver.SiteConfig) (up, total int) {
+	siteUpstreamsMu.RLock()
+	defer siteUpstreamsMu.RUnlock()
+	forEachHost(siteUpstreams[site], func(host *UpstreamHost) {
+		total++
+		if !host.Down() {
+			up++
+		}
+	})
+	return up, total
+}
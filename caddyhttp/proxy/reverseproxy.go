@@ -12,6 +12,7 @@
 package proxy
 
 import (
+	"bytes"
 	"crypto/tls"
 	"io"
 	"net"
@@ -51,6 +52,13 @@ type ReverseProxy struct {
 	// response body.
 	// If zero, no periodic flushing is done.
 	FlushInterval time.Duration
+
+	// How long a connection upgraded to websocket
+	// may go without bytes either way, and how long
+	// it may stay open at all, before it is closed.
+	// If zero, there is no limit.
+	WebsocketIdleTimeout time.Duration
+	WebsocketMaxDuration time.Duration
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -164,7 +172,8 @@ func (rp *ReverseProxy) UseInsecureTransport() {
 }
 
 // ServeHTTP serves the proxied request to the upstream by performing a roundtrip.
-// It is designed to handle websocket connection upgrades as well.
+// It is designed to handle websocket connection upgrades as well. An error
+// that happens once the response has begun to be written is a responseError.
 func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request, respUpdateFn respUpdateFn) error {
 	transport := rp.Transport
 	if requestIsWebsocket(outreq) {
@@ -196,44 +205,83 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 
 		conn, _, err := hj.Hijack()
 		if err != nil {
-			return err
+			return responseError{err}
 		}
 		defer conn.Close()
+		// the timeouts of the server are not for
+		// connections that stay open for this long
+		conn.SetDeadline(time.Time{})
 
 		var backendConn net.Conn
+		var buffered []byte
 		if hj, ok := transport.(*connHijackerTransport); ok {
 			backendConn = hj.Conn
 			if _, err := conn.Write(hj.Replay); err != nil {
-				return err
+				return responseError{err}
 			}
-			bufferPool.Put(hj.Replay)
+			// frames may have come in right after the response
+			if i := bytes.Index(hj.Replay, []byte("\r\n\r\n")); i >= 0 {
+				buffered = hj.Replay[i+4:]
+			}
+			defer bufferPool.Put(hj.Replay)
 		} else {
 			backendConn, err = net.Dial("tcp", outreq.URL.Host)
 			if err != nil {
-				return err
+				return responseError{err}
 			}
 			outreq.Write(backendConn)
 		}
 		defer backendConn.Close()
 
-		go func() {
-			io.Copy(backendConn, conn) // write tcp stream to backend.
-		}()
-		io.Copy(conn, backendConn) // read tcp stream from backend.
+		rp.tunnelWebsocket(conn, backendConn, buffered, outreq.URL.Host)
 	} else {
 		defer res.Body.Close()
 		for _, h := range hopHeaders {
 			res.Header.Del(h)
 		}
 		copyHeader(rw.Header(), res.Header)
+
+		// announce the trailers we expect from the
+		// upstream so they can be sent after the body
+		if len(res.Trailer) > 0 {
+			trailerKeys := make([]string, 0, len(res.Trailer))
+			for k := range res.Trailer {
+				trailerKeys = append(trailerKeys, k)
+			}
+			rw.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+		}
+
 		rw.WriteHeader(res.StatusCode)
-		rp.copyResponse(rw, res.Body)
+		err := rp.copyResponse(rw, res.Body)
+
+		// trailers are only known after the body has been read
+		if len(res.Trailer) > 0 {
+			copyHeader(rw.Header(), res.Trailer)
+		}
+		if err != nil {
+			return responseError{err}
+		}
 	}
 
 	return nil
 }
 
-func (rp *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
+// responseError is an error of the upstream that happened after
+// the response began to be written to the client. The request
+// must not be tried again with another upstream: the client has
+// part of the response already, like the first bytes of a range.
+type responseError struct {
+	err error
+}
+
+func (e responseError) Error() string {
+	return "reading response from upstream: " + e.err.Error()
+}
+
+// copyResponse copies the body of the response from src to dst,
+// and returns the error reading src, if any. An error writing dst
+// means that the client went away, which is no error of src.
+func (rp *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) error {
 	buf := bufferPool.Get()
 	defer bufferPool.Put(buf)
 
@@ -249,7 +297,26 @@ func (rp *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
 			dst = mlw
 		}
 	}
-	io.CopyBuffer(dst, src, buf.([]byte))
+	return copyBody(dst, src, buf.([]byte))
+}
+
+// copyBody copies src to dst using buf, and returns the error
+// reading src, if any; it stops at the first error writing dst.
+func copyBody(dst io.Writer, src io.Reader, buf []byte) error {
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func copyHeader(dst, src http.Header) {
@@ -9,16 +9,41 @@ func init() {
 	caddy.RegisterPlugin("proxy", caddy.Plugin{
 		ServerType: "http",
 		Action:     setup,
+		Redact:     redact,
 	})
 }
 
+// redact hides the secrets of sticky sessions in a proxy block.
+func redact(d *caddy.DirectiveExport) {
+	for i := range d.Block {
+		if d.Block[i].Name == "sticky" {
+			for j := range d.Block[i].Block {
+				if line := &d.Block[i].Block[j]; line.Name == "secret" && len(line.Args) > 0 {
+					line.Args[0] = caddy.Redacted
+				}
+			}
+		}
+	}
+}
+
 // setup configures a new Proxy middleware instance.
 func setup(c *caddy.Controller) error {
-	upstreams, err := NewStaticUpstreams(c.Dispenser)
+	upstreams, err := newStaticUpstreams(c.Dispenser, !c.Validating())
 	if err != nil {
 		return err
 	}
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+	cfg := httpserver.GetConfig(c)
+	registerUpstreams(cfg, upstreams)
+	c.OnShutdown(func() error {
+		unregisterUpstreams(cfg)
+		for _, u := range upstreams {
+			if su, ok := u.(*staticUpstream); ok && su.Mirror != nil {
+				su.Mirror.Stop()
+			}
+		}
+		return nil
+	})
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
 		return Proxy{Next: next, Upstreams: upstreams}
 	})
 	return nil
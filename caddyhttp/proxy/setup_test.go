@@ -159,3 +159,24 @@ func TestSetup(t *testing.T) {
 		}
 	}
 }
+
+func TestRedact(t *testing.T) {
+	d := caddy.DirectiveExport{
+		Name: "proxy",
+		Args: []string{"/", "localhost:8080"},
+		Block: []caddy.DirectiveExport{
+			{Name: "policy", Args: []string{"round_robin"}},
+			{Name: "sticky", Args: []string{"cookie"}, Block: []caddy.DirectiveExport{
+				{Name: "ttl", Args: []string{"1h"}},
+				{Name: "secret", Args: []string{"s3cret"}},
+			}},
+		},
+	}
+	redact(&d)
+	if secret := d.Block[1].Block[1].Args[0]; secret != caddy.Redacted {
+		t.Errorf("Expected sticky secret to be redacted, got %s", secret)
+	}
+	if ttl := d.Block[1].Block[0].Args[0]; ttl != "1h" {
+		t.Errorf("Expected ttl to be kept, got %s", ttl)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSignatureHeader is the header that carries the
+	// signature of an upstream request if no name is configured.
+	DefaultSignatureHeader = "X-Edge-Signature"
+
+	// DefaultSignatureDateHeader is the header that carries
+	// the date that is signed if no name is configured.
+	DefaultSignatureDateHeader = "X-Edge-Date"
+)
+
+// signatureFields are the fields of a request that can be signed.
+var signatureFields = map[string]bool{
+	"method": true,
+	"host":   true,
+	"path":   true,
+	"query":  true,
+	"date":   true,
+}
+
+// signer signs the requests that go upstream with an HMAC-SHA256
+// of some of their fields, so that the upstream can tell they came
+// through this proxy. The value that is signed is the fields, one
+// per line, which are:
+//
+//	method  the method, in upper case
+//	host    the Host header, in lower case
+//	path    the path, with all but unreserved characters and '/'
+//	        percent-encoded, with upper case hex digits
+//	query   the query string, as it is sent
+//	date    the date header, which is set to the time of the
+//	        request in RFC 1123 format
+//
+// The date is signed even if it is not one of the fields, after
+// them, so that a signature cannot be replayed forever.
+type signer struct {
+	header     string // of the signature
+	dateHeader string
+	fields     []string
+	secret     []byte
+	now        func() time.Time
+}
+
+// sign sets the date and signature headers of req.
+func (s *signer) sign(req *http.Request) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	req.Header.Set(s.dateHeader, now().UTC().Format(http.TimeFormat))
+	req.Header.Set(s.header, s.signature(req))
+}
+
+// signature returns the hex HMAC of the fields of req.
+func (s *signer) signature(req *http.Request) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(s.canonical(req)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonical returns the value of req that is signed.
+func (s *signer) canonical(req *http.Request) string {
+	var lines []string
+	var date bool
+	for _, field := range s.fields {
+		switch field {
+		case "method":
+			lines = append(lines, strings.ToUpper(req.Method))
+		case "host":
+			lines = append(lines, strings.ToLower(req.Host))
+		case "path":
+			lines = append(lines, canonicalPath(req.URL.Path))
+		case "query":
+			lines = append(lines, req.URL.RawQuery)
+		case "date":
+			lines = append(lines, req.Header.Get(s.dateHeader))
+			date = true
+		}
+	}
+	if !date {
+		lines = append(lines, req.Header.Get(s.dateHeader))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalPath percent-encodes all bytes of path except
+// unreserved characters and '/', so that a path has only
+// one encoding no matter how the client encoded it.
+func canonicalPath(path string) string {
+	var b []byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// newSignatureChecker returns a backend that recomputes the
+// signature of each request with secret, for a request to
+// canonicalPath, and responds with 401 if it does not match.
+func newSignatureChecker(t *testing.T, secret, canonicalPath string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date := r.Header.Get("X-Edge-Date")
+		if date == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, err := time.Parse(time.RFC1123, date); err != nil || !strings.HasSuffix(date, " GMT") {
+			t.Errorf("Expected RFC 1123 date, got '%s'", date)
+		}
+		signed := r.Method + "\n" + canonicalPath + "\n" + date
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal([]byte(r.Header.Get("X-Edge-Signature")), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+}
+
+func TestSignUpstream(t *testing.T) {
+	os.Setenv("CADDY_TEST_EDGE_KEY_A", "secret a")
+	os.Setenv("CADDY_TEST_EDGE_KEY_B", "secret b")
+	defer os.Unsetenv("CADDY_TEST_EDGE_KEY_A")
+	defer os.Unsetenv("CADDY_TEST_EDGE_KEY_B")
+
+	// the path as the client sends it, and as it must be signed
+	path := "/a/caf%C3%A9/x%20y+(1)"
+	canonical := "/a/caf%C3%A9/x%20y%2B%281%29"
+
+	a := newSignatureChecker(t, "secret a", canonical)
+	defer a.Close()
+	b := newSignatureChecker(t, "secret b", "/b")
+	defer b.Close()
+	unsigned := newSignatureChecker(t, "secret a", "/c")
+	defer unsigned.Close()
+
+	config := "proxy /a " + a.URL + " {\nsign_upstream {\nheader X-Edge-Signature\nsecret_env CADDY_TEST_EDGE_KEY_A\nfields method path date\n}\n}\n" +
+		"proxy /b " + b.URL + " {\nsign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY_B\n}\n}\n" +
+		"proxy /c " + unsigned.URL
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}
+
+	for i, test := range []struct {
+		path           string
+		expectedStatus int
+	}{
+		{path, http.StatusOK},
+		{"/b", http.StatusOK},
+		{"/c", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("X-Edge-Signature", "forged")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, w.Code)
+		}
+	}
+}
+
+func TestSignerCanonical(t *testing.T) {
+	s := &signer{
+		header:     DefaultSignatureHeader,
+		dateHeader: DefaultSignatureDateHeader,
+		fields:     []string{"host", "method", "query"},
+		secret:     []byte("secret"),
+		now:        func() time.Time { return time.Date(2016, 10, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600)) },
+	}
+	r := httptest.NewRequest("post", "http://Backend.Example.com/p?b=2&a=1", nil)
+	s.sign(r)
+	if got, expected := r.Header.Get("X-Edge-Date"), "Sat, 01 Oct 2016 10:00:00 GMT"; got != expected {
+		t.Errorf("Expected date '%s', got '%s'", expected, got)
+	}
+	if got, expected := s.canonical(r), "backend.example.com\nPOST\nb=2&a=1\nSat, 01 Oct 2016 10:00:00 GMT"; got != expected {
+		t.Errorf("Expected the date to be signed after the fields, got '%s'", got)
+	}
+	if len(r.Header.Get("X-Edge-Signature")) != 64 {
+		t.Errorf("Expected hex HMAC-SHA256 signature, got '%s'", r.Header.Get("X-Edge-Signature"))
+	}
+
+	for i, test := range []struct {
+		path     string
+		expected string
+	}{
+		{"/", "/"},
+		{"/a-b_c.d~e/", "/a-b_c.d~e/"},
+		{"/a b", "/a%20b"},
+		{"/a+b&c=d;e", "/a%2Bb%26c%3Dd%3Be"},
+		{"/caf\xc3\xa9", "/caf%C3%A9"},
+	} {
+		if got := canonicalPath(test.path); got != test.expected {
+			t.Errorf("Test %d: Expected canonical path '%s', got '%s'", i, test.expected, got)
+		}
+	}
+}
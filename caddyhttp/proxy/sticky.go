@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultStickyCookie is the name of the cookie that pins
+// a client to an upstream host if no name is configured.
+const DefaultStickyCookie = "caddy_affinity"
+
+// sticky pins clients to the upstream host that served them
+// first, as long as that host is available. The host is
+// identified by an HMAC of its name, so that the name is not
+// revealed and cannot be forged, which is sent to the client
+// in a cookie or, for API clients, a header, and which the
+// client sends back with its next requests.
+type sticky struct {
+	cookie bool   // whether the id is in a cookie, or else a header
+	name   string // of the cookie or header
+	ttl    time.Duration
+	secret []byte
+}
+
+// newSticky returns a sticky with a random secret.
+func newSticky(cookie bool, name string) (*sticky, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &sticky{cookie: cookie, name: name, secret: secret}, nil
+}
+
+// id returns the identifier of host that is sent to clients.
+func (s *sticky) id(host *UpstreamHost) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(host.Name))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// requested returns the id that r asks for, if any.
+func (s *sticky) requested(r *http.Request) string {
+	if !s.cookie {
+		return r.Header.Get(s.name)
+	}
+	cookie, err := r.Cookie(s.name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// pinned returns the host of pool that r is pinned to,
+// if it is available, or nil.
+func (s *sticky) pinned(pool HostPool, r *http.Request) *UpstreamHost {
+	requested := s.requested(r)
+	if requested == "" {
+		return nil
+	}
+	for _, host := range pool {
+		if hmac.Equal([]byte(s.id(host)), []byte(requested)) {
+			if host.Available() {
+				return host
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// pin tells the client of r, through w, that it is pinned to host,
+// unless r says so already. If the request fails over to another
+// host, it is called again and replaces the cookie it set before.
+func (s *sticky) pin(w http.ResponseWriter, r *http.Request, host *UpstreamHost) {
+	id := s.id(host)
+	if !s.cookie {
+		w.Header().Set(s.name, id)
+		return
+	}
+	var cookies []string
+	for _, c := range w.Header()["Set-Cookie"] {
+		if !strings.HasPrefix(c, s.name+"=") {
+			cookies = append(cookies, c)
+		}
+	}
+	if cookies == nil {
+		w.Header().Del("Set-Cookie")
+	} else {
+		w.Header()["Set-Cookie"] = cookies
+	}
+	if s.requested(r) == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     s.name,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	if s.ttl > 0 {
+		cookie.MaxAge = int(s.ttl / time.Second)
+		cookie.Expires = time.Now().Add(s.ttl)
+	}
+	http.SetCookie(w, cookie)
+}
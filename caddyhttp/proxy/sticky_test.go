@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// newStickyTest returns a proxy with the sticky property sticky
+// to two upstreams, which respond with their names, a and b.
+func newStickyTest(t *testing.T, sticky string) (*Proxy, map[string]*httptest.Server) {
+	backends := make(map[string]*httptest.Server)
+	var names []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backends[name] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		names = append(names, backends[name].URL)
+	}
+	config := "proxy / " + strings.Join(names, " ") + " {\npolicy round_robin\nsticky " + sticky + "\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	return &Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams}, backends
+}
+
+// stickyGet serves a request through p with the given cookie,
+// if it is not nil, and returns the response.
+func stickyGet(p *Proxy, cookie *http.Cookie, secure bool) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	if secure {
+		r.TLS = &tls.ConnectionState{}
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+// responseCookie returns the cookie named name set by w, or nil.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range (&http.Response{Header: w.Header()}).Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestStickyCookie(t *testing.T) {
+	p, backends := newStickyTest(t, "cookie affinity {\nttl 1h\nsecret s3cret\n}")
+	defer backends["a"].Close()
+	defer backends["b"].Close()
+
+	w := stickyGet(p, nil, false)
+	pinnedTo := w.Body.String()
+	cookie := responseCookie(w, "affinity")
+	if cookie == nil {
+		t.Fatal("Expected affinity cookie to be set")
+	}
+	if !cookie.HttpOnly || cookie.Secure || cookie.MaxAge != 3600 {
+		t.Errorf("Expected HttpOnly, not Secure cookie with max age 3600, got %+v", cookie)
+	}
+	for _, backend := range backends {
+		if strings.Contains(cookie.Value, strings.TrimPrefix(backend.URL, "http://")) {
+			t.Errorf("Expected cookie not to reveal the address of the upstream, got %s", cookie.Value)
+		}
+	}
+
+	// round robin would alternate without the cookie
+	for i := 0; i < 4; i++ {
+		w := stickyGet(p, &http.Cookie{Name: "affinity", Value: cookie.Value}, false)
+		if w.Body.String() != pinnedTo {
+			t.Errorf("Request %d: Expected to be served by %s, got %s", i+1, pinnedTo, w.Body.String())
+		}
+		if responseCookie(w, "affinity") != nil {
+			t.Errorf("Request %d: Expected cookie not to be set again", i+1)
+		}
+	}
+
+	if w := stickyGet(p, nil, true); !responseCookie(w, "affinity").Secure {
+		t.Error("Expected cookie to be Secure on HTTPS")
+	}
+}
+
+func TestStickyFailover(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	p, backends := newStickyTest(t, "cookie")
+	defer backends["a"].Close()
+	defer backends["b"].Close()
+
+	w := stickyGet(p, nil, false)
+	pinnedTo := w.Body.String()
+	cookie := responseCookie(w, DefaultStickyCookie)
+	if cookie == nil {
+		t.Fatal("Expected cookie to be set")
+	}
+
+	backends[pinnedTo].Close()
+	w = stickyGet(p, &http.Cookie{Name: DefaultStickyCookie, Value: cookie.Value}, false)
+	if w.Body.String() == pinnedTo || w.Body.String() == "" {
+		t.Fatalf("Expected to fail over from %s, got %q", pinnedTo, w.Body.String())
+	}
+	if cookies := w.Header()["Set-Cookie"]; len(cookies) != 1 {
+		t.Fatalf("Expected one cookie for the new upstream, got %v", cookies)
+	}
+	newCookie := responseCookie(w, DefaultStickyCookie)
+	if newCookie.Value == cookie.Value {
+		t.Error("Expected cookie to change to the new upstream")
+	}
+	failedOver := w.Body.String()
+	if w := stickyGet(p, newCookie, false); w.Body.String() != failedOver || responseCookie(w, DefaultStickyCookie) != nil {
+		t.Error("Expected to stay with the new upstream")
+	}
+}
+
+func TestStickyTampered(t *testing.T) {
+	p, backends := newStickyTest(t, "cookie {\nsecret s3cret\n}")
+	defer backends["a"].Close()
+	defer backends["b"].Close()
+	other, otherBackends := newStickyTest(t, "cookie {\nsecret other\n}")
+	defer otherBackends["a"].Close()
+	defer otherBackends["b"].Close()
+
+	// ids made with another secret are not accepted
+	foreign := responseCookie(stickyGet(other, nil, false), DefaultStickyCookie)
+	for i, value := range []string{"0123456789abcdef0123456789abcdef", "a", foreign.Value} {
+		served := make(map[string]bool)
+		for j := 0; j < 4; j++ {
+			w := stickyGet(p, &http.Cookie{Name: DefaultStickyCookie, Value: value}, false)
+			served[w.Body.String()] = true
+			if cookie := responseCookie(w, DefaultStickyCookie); cookie == nil || cookie.Value == value {
+				t.Errorf("Test %d: Expected cookie to be replaced, got %v", i+1, cookie)
+			}
+		}
+		if len(served) != 2 {
+			t.Errorf("Test %d: Expected forged cookie to be ignored by the policy, got served by %v", i+1, served)
+		}
+	}
+}
+
+func TestStickyHeader(t *testing.T) {
+	p, backends := newStickyTest(t, "header X-Backend")
+	defer backends["a"].Close()
+	defer backends["b"].Close()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	pinnedTo, id := w.Body.String(), w.Header().Get("X-Backend")
+	if id == "" {
+		t.Fatal("Expected X-Backend header in response")
+	}
+	for i := 0; i < 4; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Backend", id)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Body.String() != pinnedTo {
+			t.Errorf("Request %d: Expected to be served by %s, got %s", i+1, pinnedTo, w.Body.String())
+		}
+	}
+}
@@ -6,11 +6,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyfile"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -29,8 +33,18 @@ type staticUpstream struct {
 	KeepAlive          int
 	insecureSkipVerify bool
 
+	// whether to ask for the identity encoding with
+	// range requests, so that the range is of the bytes
+	// of the file rather than of their compressed form
+	forceIdentityRanges bool
+
 	FailTimeout time.Duration
 	MaxFails    int32
+
+	// limits of the connections upgraded to websocket
+	WebsocketIdleTimeout time.Duration
+	WebsocketMaxDuration time.Duration
+
 	MaxConns    int64
 	HealthCheck struct {
 		Client   http.Client
@@ -40,11 +54,31 @@ type staticUpstream struct {
 	}
 	WithoutPathPrefix string
 	IgnoredSubPaths   []string
+	Mirror            *mirror
+	Cache             *cache
+	Sticky            *sticky
+	Signer            *signer
+	Fallback          *fallback
+
+	// the hosts that the names of the hosts with placeholders
+	// resolve to, by name, so that their connections are reused
+	resolved   map[string]*UpstreamHost
+	resolvedMu sync.Mutex
 }
 
+// maxResolvedHosts is how many of the hosts that names with
+// placeholders resolve to an upstream keeps.
+const maxResolvedHosts = 100
+
 // NewStaticUpstreams parses the configuration input and sets up
 // static upstreams for the proxy middleware.
 func NewStaticUpstreams(c caddyfile.Dispenser) ([]Upstream, error) {
+	return newStaticUpstreams(c, true)
+}
+
+// newStaticUpstreams is like NewStaticUpstreams, but only starts
+// the health check workers of the upstreams if healthChecks is true.
+func newStaticUpstreams(c caddyfile.Dispenser, healthChecks bool) ([]Upstream, error) {
 	var upstreams []Upstream
 	for c.Next() {
 		upstream := &staticUpstream{
@@ -105,15 +139,278 @@ func NewStaticUpstreams(c caddyfile.Dispenser) ([]Upstream, error) {
 
 		if upstream.HealthCheck.Path != "" {
 			upstream.HealthCheck.Client = http.Client{
-				Timeout: upstream.HealthCheck.Timeout,
+				Transport: caddy.NewHTTPClient("health check").Transport,
+				Timeout:   upstream.HealthCheck.Timeout,
+			}
+			if healthChecks {
+				go upstream.HealthCheckWorker(nil)
 			}
-			go upstream.HealthCheckWorker(nil)
 		}
 		upstreams = append(upstreams, upstream)
 	}
 	return upstreams, nil
 }
 
+// parseMirror parses the mirror property, with its optional block:
+//
+//	mirror url {
+//	    sample   fraction
+//	    timeout  duration
+//	    max_body bytes
+//	    workers  n
+//	}
+func parseMirror(c *caddyfile.Dispenser) (*mirror, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	if !strings.HasPrefix(c.Val(), "http://") && !strings.HasPrefix(c.Val(), "https://") {
+		return nil, c.Errf("mirror must be an http or https URL, got '%s'", c.Val())
+	}
+	target, err := url.Parse(c.Val())
+	if err != nil {
+		return nil, c.Err(err.Error())
+	}
+	m := newMirror(target)
+
+	if !c.NextArg() {
+		return m, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	c.IncrNest()
+	for c.NextBlock() {
+		property := c.Val()
+		if !c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		switch property {
+		case "sample":
+			m.sample, err = strconv.ParseFloat(c.Val(), 64)
+			if err != nil || m.sample < 0 || m.sample > 1 {
+				return nil, c.Errf("sample must be a number from 0 to 1, got '%s'", c.Val())
+			}
+		case "timeout":
+			m.timeout, err = time.ParseDuration(c.Val())
+			if err != nil || m.timeout <= 0 {
+				return nil, c.Errf("invalid mirror timeout '%s'", c.Val())
+			}
+		case "max_body":
+			m.maxBody, err = strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || m.maxBody < 0 {
+				return nil, c.Errf("invalid mirror max_body '%s'", c.Val())
+			}
+		case "workers":
+			m.workers, err = strconv.Atoi(c.Val())
+			if err != nil || m.workers < 1 {
+				return nil, c.Errf("invalid number of mirror workers '%s'", c.Val())
+			}
+		default:
+			return nil, c.Errf("unknown mirror property '%s'", property)
+		}
+		if c.NextArg() {
+			return nil, c.ArgErr()
+		}
+	}
+	return m, nil
+}
+
+// parseCache parses the cache property, with its optional block:
+//
+//	cache {
+//	    ttl      duration
+//	    stale    duration
+//	    max_size size
+//	    key      format
+//	    allow    set_cookie|authorization...
+//	}
+func parseCache(c *caddyfile.Dispenser) (*cache, error) {
+	cache := newCache()
+	if !c.NextArg() {
+		return cache, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	c.IncrNest()
+	for c.NextBlock() {
+		property := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 || (property != "allow" && len(args) > 1) {
+			return nil, c.ArgErr()
+		}
+		var err error
+		switch property {
+		case "ttl":
+			cache.ttl, err = time.ParseDuration(args[0])
+			if err != nil || cache.ttl <= 0 {
+				return nil, c.Errf("invalid cache ttl '%s'", args[0])
+			}
+		case "stale":
+			cache.stale, err = time.ParseDuration(args[0])
+			if err != nil || cache.stale < 0 {
+				return nil, c.Errf("invalid cache stale period '%s'", args[0])
+			}
+		case "max_size":
+			cache.maxSize, err = parseSize(args[0])
+			if err != nil || cache.maxSize == 0 {
+				return nil, c.Errf("invalid cache max_size '%s'", args[0])
+			}
+		case "key":
+			cache.key = args[0]
+		case "allow":
+			for _, arg := range args {
+				switch arg {
+				case "set_cookie":
+					cache.allowCookies = true
+				case "authorization":
+					cache.allowAuthorization = true
+				default:
+					return nil, c.Errf("cannot allow '%s' in cache; only set_cookie and authorization", arg)
+				}
+			}
+		default:
+			return nil, c.Errf("unknown cache property '%s'", property)
+		}
+	}
+	return cache, nil
+}
+
+// parseSticky parses the sticky property, which is either
+//
+//	sticky cookie [name] {
+//	    ttl    duration
+//	    secret secret
+//	}
+//
+// or
+//
+//	sticky header name {
+//	    secret secret
+//	}
+//
+// where the block is optional.
+func parseSticky(c *caddyfile.Dispenser) (*sticky, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return nil, c.ArgErr()
+	}
+	var name string
+	switch args[0] {
+	case "cookie":
+		name = DefaultStickyCookie
+		if len(args) == 2 {
+			name = args[1]
+		}
+	case "header":
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		name = args[1]
+	default:
+		return nil, c.Errf("sticky must be 'cookie' or 'header', got '%s'", args[0])
+	}
+	sticky, err := newSticky(args[0] == "cookie", name)
+	if err != nil {
+		return nil, err
+	}
+	if !c.NextArg() {
+		return sticky, nil
+	}
+	c.IncrNest()
+	for c.NextBlock() {
+		property := c.Val()
+		if !c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		switch property {
+		case "ttl":
+			if !sticky.cookie {
+				return nil, c.Err("ttl only applies to sticky cookies")
+			}
+			sticky.ttl, err = time.ParseDuration(c.Val())
+			if err != nil || sticky.ttl < 0 {
+				return nil, c.Errf("invalid sticky ttl '%s'", c.Val())
+			}
+		case "secret":
+			sticky.secret = []byte(c.Val())
+		default:
+			return nil, c.Errf("unknown sticky property '%s'", property)
+		}
+		if c.NextArg() {
+			return nil, c.ArgErr()
+		}
+	}
+	return sticky, nil
+}
+
+// parseSigner parses the sign_upstream property:
+//
+//	sign_upstream {
+//	    secret_env  name
+//	    header      name
+//	    date_header name
+//	    fields      field...
+//	}
+//
+// where secret_env, the environment variable that holds the
+// secret, is required. The secret cannot be in the Caddyfile.
+func parseSigner(c *caddyfile.Dispenser) (*signer, error) {
+	s := &signer{
+		header:     DefaultSignatureHeader,
+		dateHeader: DefaultSignatureDateHeader,
+		fields:     []string{"method", "path", "date"},
+	}
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	if c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	c.IncrNest()
+	var secretEnv string
+	for c.NextBlock() {
+		property := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return nil, c.ArgErr()
+		}
+		if property != "fields" && len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		switch property {
+		case "secret_env":
+			secretEnv = args[0]
+		case "secret":
+			return nil, c.Err("the sign_upstream secret must come from the environment; use secret_env")
+		case "header":
+			s.header = args[0]
+		case "date_header":
+			s.dateHeader = args[0]
+		case "fields":
+			for _, field := range args {
+				if !signatureFields[field] {
+					return nil, c.Errf("unknown sign_upstream field '%s'", field)
+				}
+			}
+			s.fields = args
+		default:
+			return nil, c.Errf("unknown sign_upstream property '%s'", property)
+		}
+	}
+	if secretEnv == "" {
+		return nil, c.Err("sign_upstream needs secret_env")
+	}
+	s.secret = []byte(os.Getenv(secretEnv))
+	if len(s.secret) == 0 {
+		return nil, c.Errf("environment variable %s for the sign_upstream secret is not set", secretEnv)
+	}
+	if strings.EqualFold(s.header, s.dateHeader) {
+		return nil, c.Err("sign_upstream header and date_header must differ")
+	}
+	return s, nil
+}
+
 // RegisterPolicy adds a custom policy to the proxy.
 func RegisterPolicy(name string, policy func() Policy) {
 	supportedPolicies[name] = policy
@@ -133,15 +430,14 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 		Conns:             0,
 		Fails:             0,
 		FailTimeout:       u.FailTimeout,
-		Unhealthy:         false,
 		UpstreamHeaders:   u.upstreamHeaders,
 		DownstreamHeaders: u.downstreamHeaders,
 		CheckDown: func(u *staticUpstream) UpstreamHostDownFunc {
 			return func(uh *UpstreamHost) bool {
-				if uh.Unhealthy {
+				if atomic.LoadInt32(&uh.Unhealthy) != 0 {
 					return true
 				}
-				if uh.Fails >= u.MaxFails &&
+				if atomic.LoadInt32(&uh.Fails) >= u.MaxFails &&
 					u.MaxFails != 0 {
 					return true
 				}
@@ -152,15 +448,41 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 		MaxConns:          u.MaxConns,
 	}
 
+	// the name is known for each request
+	if strings.Contains(host, "{") {
+		uh.template = true
+		return uh, nil
+	}
+
 	baseURL, err := url.Parse(uh.Name)
 	if err != nil {
 		return nil, err
 	}
 
 	uh.ReverseProxy = NewSingleHostReverseProxy(baseURL, uh.WithoutPathPrefix, u.KeepAlive)
+	uh.ReverseProxy.WebsocketIdleTimeout = u.WebsocketIdleTimeout
+	uh.ReverseProxy.WebsocketMaxDuration = u.WebsocketMaxDuration
 	if u.insecureSkipVerify {
 		uh.ReverseProxy.UseInsecureTransport()
 	}
+	if u.forceIdentityRanges {
+		director := uh.ReverseProxy.Director
+		uh.ReverseProxy.Director = func(req *http.Request) {
+			director(req)
+			if req.Header.Get("Range") != "" {
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+		}
+	}
+	if u.Signer != nil {
+		// sign the request as it is sent, after the
+		// director has made its final path
+		director := uh.ReverseProxy.Director
+		uh.ReverseProxy.Director = func(req *http.Request) {
+			director(req)
+			u.Signer.sign(req)
+		}
+	}
 
 	return uh, nil
 }
@@ -229,6 +551,23 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream) error {
 			return err
 		}
 		u.FailTimeout = dur
+	case "websocket_idle_timeout", "websocket_max_duration":
+		property := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Errf("%s must be positive", property)
+		}
+		if property == "websocket_idle_timeout" {
+			u.WebsocketIdleTimeout = dur
+		} else {
+			u.WebsocketMaxDuration = dur
+		}
 	case "max_fails":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -319,6 +658,8 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream) error {
 		u.IgnoredSubPaths = ignoredPaths
 	case "insecure_skip_verify":
 		u.insecureSkipVerify = true
+	case "force_identity_ranges":
+		u.forceIdentityRanges = true
 	case "keepalive":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -331,6 +672,51 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream) error {
 			return c.ArgErr()
 		}
 		u.KeepAlive = n
+	case "mirror":
+		if u.Mirror != nil {
+			return c.Err("mirror already specified")
+		}
+		m, err := parseMirror(c)
+		if err != nil {
+			return err
+		}
+		u.Mirror = m
+	case "cache":
+		if u.Cache != nil {
+			return c.Err("cache already specified")
+		}
+		cache, err := parseCache(c)
+		if err != nil {
+			return err
+		}
+		u.Cache = cache
+	case "sticky":
+		if u.Sticky != nil {
+			return c.Err("sticky already specified")
+		}
+		sticky, err := parseSticky(c)
+		if err != nil {
+			return err
+		}
+		u.Sticky = sticky
+	case "fallback_on_error":
+		if u.Fallback != nil {
+			return c.Err("fallback_on_error already specified")
+		}
+		f, err := parseFallback(c)
+		if err != nil {
+			return err
+		}
+		u.Fallback = f
+	case "sign_upstream":
+		if u.Signer != nil {
+			return c.Err("sign_upstream already specified")
+		}
+		signer, err := parseSigner(c)
+		if err != nil {
+			return err
+		}
+		u.Signer = signer
 	default:
 		return c.Errf("unknown property '%s'", c.Val())
 	}
@@ -339,13 +725,20 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream) error {
 
 func (u *staticUpstream) healthCheck() {
 	for _, host := range u.Hosts {
+		if host.template {
+			continue
+		}
 		hostURL := host.Name + u.HealthCheck.Path
 		if r, err := u.HealthCheck.Client.Get(hostURL); err == nil {
 			io.Copy(ioutil.Discard, r.Body)
 			r.Body.Close()
-			host.Unhealthy = r.StatusCode < 200 || r.StatusCode >= 400
+			var unhealthy int32
+			if r.StatusCode < 200 || r.StatusCode >= 400 {
+				unhealthy = 1
+			}
+			atomic.StoreInt32(&host.Unhealthy, unhealthy)
 		} else {
-			host.Unhealthy = true
+			atomic.StoreInt32(&host.Unhealthy, 1)
 		}
 	}
 }
@@ -366,6 +759,53 @@ func (u *staticUpstream) HealthCheckWorker(stop chan struct{}) {
 }
 
 func (u *staticUpstream) Select(r *http.Request) *UpstreamHost {
+	host := u.selectHost(r)
+	if host == nil || !host.template {
+		return host
+	}
+	return u.resolve(host, r)
+}
+
+// resolve returns the host that the name of template, which has
+// placeholders, resolves to for r, or nil if it resolves to no
+// host or to one that is not available.
+func (u *staticUpstream) resolve(template *UpstreamHost, r *http.Request) *UpstreamHost {
+	name := httpserver.NewReplacer(r, nil, "").Replace(template.Name)
+	if strings.Contains(name, "{") {
+		return nil
+	}
+	if nameURL, err := url.Parse(name); err != nil || (nameURL.Host == "" && !strings.HasPrefix(name, "unix:")) {
+		return nil
+	}
+
+	u.resolvedMu.Lock()
+	defer u.resolvedMu.Unlock()
+	host, ok := u.resolved[name]
+	if !ok {
+		var err error
+		host, err = u.NewHost(name)
+		if err != nil {
+			return nil
+		}
+		host.traffic = template.traffic
+		if u.resolved == nil {
+			u.resolved = make(map[string]*UpstreamHost)
+		}
+		if len(u.resolved) >= maxResolvedHosts {
+			for old := range u.resolved {
+				delete(u.resolved, old)
+				break
+			}
+		}
+		u.resolved[name] = host
+	}
+	if !host.Available() {
+		return nil
+	}
+	return host
+}
+
+func (u *staticUpstream) selectHost(r *http.Request) *UpstreamHost {
 	pool := u.Hosts
 	if len(pool) == 1 {
 		if !pool[0].Available() {
@@ -383,6 +823,11 @@ func (u *staticUpstream) Select(r *http.Request) *UpstreamHost {
 	if allUnavailable {
 		return nil
 	}
+	if u.Sticky != nil {
+		if host := u.Sticky.pinned(pool, r); host != nil {
+			return host
+		}
+	}
 	if u.Policy == nil {
 		return (&Random{}).Select(pool, r)
 	}
@@ -3,7 +3,11 @@ package proxy
 import (
 	"github.com/mholt/caddy/caddyfile"
 	"net/http"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,12 +39,12 @@ func TestNewHost(t *testing.T) {
 		t.Error("Expected new host not to be down.")
 	}
 	// mark Unhealthy
-	uh.Unhealthy = true
+	atomic.StoreInt32(&uh.Unhealthy, 1)
 	if !uh.CheckDown(uh) {
 		t.Error("Expected unhealthy host to be down.")
 	}
 	// mark with Fails
-	uh.Unhealthy = false
+	atomic.StoreInt32(&uh.Unhealthy, 0)
 	uh.Fails = 1
 	if !uh.CheckDown(uh) {
 		t.Error("Expected failed host to be down.")
@@ -73,13 +77,13 @@ func TestSelect(t *testing.T) {
 		MaxFails:    1,
 	}
 	r, _ := http.NewRequest("GET", "/", nil)
-	upstream.Hosts[0].Unhealthy = true
-	upstream.Hosts[1].Unhealthy = true
-	upstream.Hosts[2].Unhealthy = true
+	atomic.StoreInt32(&upstream.Hosts[0].Unhealthy, 1)
+	atomic.StoreInt32(&upstream.Hosts[1].Unhealthy, 1)
+	atomic.StoreInt32(&upstream.Hosts[2].Unhealthy, 1)
 	if h := upstream.Select(r); h != nil {
 		t.Error("Expected select to return nil as all host are down")
 	}
-	upstream.Hosts[2].Unhealthy = false
+	atomic.StoreInt32(&upstream.Hosts[2].Unhealthy, 0)
 	if h := upstream.Select(r); h == nil {
 		t.Error("Expected select to not return nil")
 	}
@@ -98,6 +102,50 @@ func TestSelect(t *testing.T) {
 	}
 }
 
+func TestSelectPlaceholderHost(t *testing.T) {
+	upstream := &staticUpstream{FailTimeout: 10 * time.Second, MaxFails: 1}
+	template, err := upstream.NewHost("{>X-Backend}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Hosts = HostPool{template}
+
+	for i, test := range []struct {
+		backend, expected string
+	}{
+		{"10.0.0.5:8080", "http://10.0.0.5:8080"},
+		{"10.0.0.5:8080", "http://10.0.0.5:8080"},
+		{"10.0.0.9:8080", "http://10.0.0.9:8080"},
+		{"", ""},
+		{"{path}", ""},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Backend", test.backend)
+		host := upstream.Select(r)
+		if test.expected == "" {
+			if host != nil {
+				t.Errorf("Test %d: Expected no host, got %s", i, host.Name)
+			}
+			continue
+		}
+		if host == nil || host.Name != test.expected || host.ReverseProxy == nil {
+			t.Errorf("Test %d: Expected host %s with a proxy, got %+v", i, test.expected, host)
+		}
+	}
+	if len(upstream.resolved) != 2 {
+		t.Errorf("Expected the 2 resolved hosts to be kept, got %d", len(upstream.resolved))
+	}
+
+	for i := 0; i < maxResolvedHosts+10; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Backend", "10.1.0.1:"+strconv.Itoa(1000+i))
+		upstream.Select(r)
+	}
+	if len(upstream.resolved) > maxResolvedHosts {
+		t.Errorf("Expected at most %d resolved hosts to be kept, got %d", maxResolvedHosts, len(upstream.resolved))
+	}
+}
+
 func TestRegisterPolicy(t *testing.T) {
 	name := "custom"
 	customPolicy := &customPolicy{}
@@ -225,3 +273,210 @@ func TestParseBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBlockMirror(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+		sample    float64
+		timeout   time.Duration
+		maxBody   int64
+		workers   int
+	}{
+		{"mirror http://shadow:8080", false, 1, DefaultMirrorTimeout, DefaultMirrorMaxBody, DefaultMirrorWorkers},
+		{"mirror http://shadow:8080 {\nsample 0.05\ntimeout 2s\n}", false, 0.05, 2 * time.Second, DefaultMirrorMaxBody, DefaultMirrorWorkers},
+		{"mirror https://shadow {\nmax_body 100\nworkers 2\n}", false, 1, DefaultMirrorTimeout, 100, 2},
+		{"mirror", true, 0, 0, 0, 0},
+		{"mirror shadow:8080", true, 0, 0, 0, 0},
+		{"mirror http://shadow extra", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\nsample 2\n}", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\ntimeout soon\n}", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\nworkers 0\n}", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\nsample\n}", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\nsample 0.5 0.6\n}", true, 0, 0, 0, 0},
+		{"mirror http://shadow {\nunknown 1\n}", true, 0, 0, 0, 0},
+		{"mirror http://a\nmirror http://b", true, 0, 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u)
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i+1, err)
+			continue
+		}
+		m := u.Mirror
+		if m.sample != test.sample || m.timeout != test.timeout || m.maxBody != test.maxBody || m.workers != test.workers {
+			t.Errorf("Test %d: Expected sample %v, timeout %v, max_body %d, workers %d; got %v, %v, %d, %d",
+				i+1, test.sample, test.timeout, test.maxBody, test.workers, m.sample, m.timeout, m.maxBody, m.workers)
+		}
+	}
+}
+
+func TestParseBlockCache(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+		ttl       time.Duration
+		stale     time.Duration
+		maxSize   int64
+		key       string
+	}{
+		{"cache", false, DefaultCacheTTL, 0, DefaultCacheMaxSize, DefaultCacheKey},
+		{"cache {\nttl 10s\nstale 60s\nmax_size 64mb\nkey {host}{uri}\n}", false, 10 * time.Second, time.Minute, 64 << 20, "{host}{uri}"},
+		{"cache {\nallow set_cookie authorization\n}", false, DefaultCacheTTL, 0, DefaultCacheMaxSize, DefaultCacheKey},
+		{"cache {\nttl 0s\n}", true, 0, 0, 0, ""},
+		{"cache {\nttl\n}", true, 0, 0, 0, ""},
+		{"cache {\nstale 1s 2s\n}", true, 0, 0, 0, ""},
+		{"cache {\nmax_size lots\n}", true, 0, 0, 0, ""},
+		{"cache {\nallow everything\n}", true, 0, 0, 0, ""},
+		{"cache {\nunknown 1\n}", true, 0, 0, 0, ""},
+		{"cache 10s", true, 0, 0, 0, ""},
+		{"cache\ncache", true, 0, 0, 0, ""},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u)
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i+1, err)
+			continue
+		}
+		cache := u.Cache
+		if cache.ttl != test.ttl || cache.stale != test.stale || cache.maxSize != test.maxSize || cache.key != test.key {
+			t.Errorf("Test %d: Expected ttl %v, stale %v, max_size %d, key %s; got %v, %v, %d, %s",
+				i+1, test.ttl, test.stale, test.maxSize, test.key, cache.ttl, cache.stale, cache.maxSize, cache.key)
+		}
+	}
+}
+
+func TestParseBlockSticky(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+		cookie    bool
+		name      string
+		ttl       time.Duration
+		secret    string
+	}{
+		{"sticky cookie", false, true, DefaultStickyCookie, 0, ""},
+		{"sticky cookie caddy_affinity {\nttl 1h\nsecret abc\n}", false, true, "caddy_affinity", time.Hour, "abc"},
+		{"sticky header X-Backend", false, false, "X-Backend", 0, ""},
+		{"sticky header X-Backend {\nsecret abc\n}", false, false, "X-Backend", 0, "abc"},
+		{"sticky", true, false, "", 0, ""},
+		{"sticky header", true, false, "", 0, ""},
+		{"sticky ip", true, false, "", 0, ""},
+		{"sticky cookie a b", true, false, "", 0, ""},
+		{"sticky header X-Backend {\nttl 1h\n}", true, false, "", 0, ""},
+		{"sticky cookie {\nttl forever\n}", true, false, "", 0, ""},
+		{"sticky cookie {\nsecret\n}", true, false, "", 0, ""},
+		{"sticky cookie {\nunknown 1\n}", true, false, "", 0, ""},
+		{"sticky cookie\nsticky cookie", true, false, "", 0, ""},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u)
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i+1, err)
+			continue
+		}
+		s := u.Sticky
+		if s.cookie != test.cookie || s.name != test.name || s.ttl != test.ttl {
+			t.Errorf("Test %d: Expected cookie %t, name %s, ttl %v; got %t, %s, %v",
+				i+1, test.cookie, test.name, test.ttl, s.cookie, s.name, s.ttl)
+		}
+		if test.secret != "" && string(s.secret) != test.secret {
+			t.Errorf("Test %d: Expected secret %s, got %s", i+1, test.secret, s.secret)
+		}
+		if test.secret == "" && len(s.secret) != 32 {
+			t.Errorf("Test %d: Expected random secret of 32 bytes, got %d bytes", i+1, len(s.secret))
+		}
+	}
+}
+
+func TestParseBlockSigner(t *testing.T) {
+	os.Setenv("CADDY_TEST_EDGE_KEY", "secret")
+	defer os.Unsetenv("CADDY_TEST_EDGE_KEY")
+
+	tests := []struct {
+		config     string
+		shouldErr  bool
+		header     string
+		dateHeader string
+		fields     []string
+	}{
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\n}", false,
+			DefaultSignatureHeader, DefaultSignatureDateHeader, []string{"method", "path", "date"}},
+		{"sign_upstream {\nheader X-Sig\ndate_header X-Sig-Date\nsecret_env CADDY_TEST_EDGE_KEY\nfields host path query\n}", false,
+			"X-Sig", "X-Sig-Date", []string{"host", "path", "query"}},
+		{"sign_upstream", true, "", "", nil},
+		{"sign_upstream X-Sig", true, "", "", nil},
+		{"sign_upstream {\nheader X-Sig\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret abc\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY_UNSET\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\nfields method body\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\nheader\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env A B\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\ndate_header X-Edge-Signature\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\nunknown 1\n}", true, "", "", nil},
+		{"sign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\n}\nsign_upstream {\nsecret_env CADDY_TEST_EDGE_KEY\n}", true, "", "", nil},
+	}
+
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		var err error
+		for c.Next() && err == nil {
+			err = parseBlock(&c, &u)
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i+1, err)
+			continue
+		}
+		s := u.Signer
+		if s.header != test.header || s.dateHeader != test.dateHeader || !reflect.DeepEqual(s.fields, test.fields) {
+			t.Errorf("Test %d: Expected header %s, date header %s, fields %v; got %s, %s, %v",
+				i+1, test.header, test.dateHeader, test.fields, s.header, s.dateHeader, s.fields)
+		}
+		if string(s.secret) != "secret" {
+			t.Errorf("Test %d: Expected secret from the environment, got '%s'", i+1, s.secret)
+		}
+	}
+}
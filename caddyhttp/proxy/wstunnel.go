@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// websocketCloseGrace is how long a websocket connection stays
+// open once one side has stopped sending, for the other side to
+// finish, before both halves are closed.
+var websocketCloseGrace = 5 * time.Second
+
+// closeGoingAway is the close frame sent to the client when the
+// connection is closed by the proxy: status 1001, going away.
+var closeGoingAway = []byte{0x88, 0x02, 0x03, 0xE9}
+
+// wsTunnel copies the frames of an upgraded websocket connection
+// between the client and the backend, keeping track of when bytes
+// last went either way and of where the frames to the client
+// begin, so that a close frame can be sent between two of them.
+type wsTunnel struct {
+	client, backend net.Conn
+	fromClient      int64 // bytes, accessed atomically
+	toClient        int64 // bytes, accessed atomically
+	lastActive      int64 // unix nanoseconds, accessed atomically
+
+	mu      sync.Mutex // protects writes to client and what follows
+	frames  frameBoundary
+	closing bool
+}
+
+// tunnelWebsocket copies between client and backend until either
+// closes the connection, or until it has been idle or open for too
+// long, if rp limits it. buffered are the bytes already sent to
+// the client from the backend after the response to the upgrade.
+func (rp *ReverseProxy) tunnelWebsocket(client, backend net.Conn, buffered []byte, name string) {
+	t := &wsTunnel{client: client, backend: backend}
+	t.frames.feed(buffered)
+	start := time.Now()
+	t.touch()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		t.copyToBackend()
+		if cw, ok := backend.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		t.copyToClient()
+		if cw, ok := client.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+
+	var idle, maxDuration, grace <-chan time.Time
+	var idleTimer *time.Timer
+	if rp.WebsocketIdleTimeout > 0 {
+		idleTimer = time.NewTimer(rp.WebsocketIdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if rp.WebsocketMaxDuration > 0 {
+		maxTimer := time.NewTimer(rp.WebsocketMaxDuration)
+		defer maxTimer.Stop()
+		maxDuration = maxTimer.C
+	}
+
+	var reason string
+	for finished := 0; finished < 2 && reason == ""; {
+		select {
+		case <-done:
+			finished++
+			if finished == 1 {
+				// one side is done; the other gets a grace period
+				graceTimer := time.NewTimer(websocketCloseGrace)
+				defer graceTimer.Stop()
+				grace = graceTimer.C
+			}
+		case <-idle:
+			if since := time.Since(t.last()); since < rp.WebsocketIdleTimeout {
+				idleTimer.Reset(rp.WebsocketIdleTimeout - since)
+				continue
+			}
+			reason = fmt.Sprintf("idle for %v", rp.WebsocketIdleTimeout)
+		case <-maxDuration:
+			reason = fmt.Sprintf("open for %v", rp.WebsocketMaxDuration)
+		case <-grace:
+			reason = "half-closed"
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	t.close()
+	log.Printf("[INFO] Closed websocket to %s after %v, %s: %d bytes from client, %d bytes to client",
+		name, time.Since(start), reason, atomic.LoadInt64(&t.fromClient), atomic.LoadInt64(&t.toClient))
+}
+
+func (t *wsTunnel) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+func (t *wsTunnel) last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActive))
+}
+
+func (t *wsTunnel) copyToBackend() {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	for {
+		n, err := t.client.Read(buf)
+		if n > 0 {
+			t.touch()
+			atomic.AddInt64(&t.fromClient, int64(n))
+			if _, werr := t.backend.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *wsTunnel) copyToClient() {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	for {
+		n, err := t.backend.Read(buf)
+		if n > 0 {
+			t.touch()
+			t.mu.Lock()
+			if t.closing {
+				t.mu.Unlock()
+				return
+			}
+			written, werr := t.client.Write(buf[:n])
+			t.frames.feed(buf[:written])
+			t.mu.Unlock()
+			atomic.AddInt64(&t.toClient, int64(written))
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close sends the client a close frame, if that can be done
+// between two frames and soon, and closes both connections.
+func (t *wsTunnel) close() {
+	// a write to a client that is not reading is given up
+	t.client.SetWriteDeadline(time.Now().Add(time.Second))
+	t.mu.Lock()
+	t.closing = true
+	if t.frames.atBoundary() {
+		t.client.Write(closeGoingAway)
+	}
+	t.mu.Unlock()
+	t.client.Close()
+	t.backend.Close()
+}
+
+// frameBoundary follows a stream of websocket frames
+// to know whether the next byte begins a frame.
+type frameBoundary struct {
+	header    [14]byte
+	headerLen int    // bytes of the header of the current frame so far
+	remaining uint64 // bytes of the payload of the current frame to come
+}
+
+func (f *frameBoundary) feed(b []byte) {
+	for len(b) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(b))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			b = b[n:]
+			continue
+		}
+		f.header[f.headerLen] = b[0]
+		f.headerLen++
+		b = b[1:]
+		if f.headerLen >= 2 && f.headerLen == frameHeaderSize(f.header[1]) {
+			f.remaining = framePayloadLen(f.header[:f.headerLen])
+			f.headerLen = 0
+		}
+	}
+}
+
+func (f *frameBoundary) atBoundary() bool {
+	return f.headerLen == 0 && f.remaining == 0
+}
+
+// frameHeaderSize returns the size of the header of a frame
+// whose second byte is b: its payload length and mask bits.
+func frameHeaderSize(b byte) int {
+	size := 2
+	switch b & 0x7F {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if b&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func framePayloadLen(header []byte) uint64 {
+	switch n := header[1] & 0x7F; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(n)
+	}
+}
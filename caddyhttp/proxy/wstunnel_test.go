@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"golang.org/x/net/websocket"
+)
+
+// startWebsocketProxy starts a server that proxies to a websocket
+// backend with handler, with the limits of rp, which is not nil.
+func startWebsocketProxy(t *testing.T, handler websocket.Handler, limit func(rp *ReverseProxy)) (addr string, done func()) {
+	backend := httptest.NewServer(handler)
+	upstream := newFakeUpstream(backend.URL, false)
+	limit(upstream.host.ReverseProxy)
+	upstream.host.UpstreamHeaders = http.Header{
+		"Connection": {"{>Connection}"},
+		"Upgrade":    {"{>Upgrade}"},
+	}
+	p := &Proxy{Next: httpserver.EmptyNext, Upstreams: []Upstream{upstream}}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	return strings.TrimPrefix(front.URL, "http://"), func() {
+		front.Close()
+		backend.Close()
+	}
+}
+
+// dialWebsocket opens a websocket connection to addr and
+// returns it past the response to the upgrade.
+func dialWebsocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: http://" + addr + "\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 upgrading, got %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+// clientFrame returns a masked text frame with payload.
+func clientFrame(payload string) []byte {
+	return append([]byte{0x81, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+}
+
+func echo(ws *websocket.Conn) {
+	io.Copy(ws, ws)
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr, done := startWebsocketProxy(t, echo, func(rp *ReverseProxy) {
+		rp.WebsocketIdleTimeout = 200 * time.Millisecond
+	})
+	defer done()
+	conn, br := dialWebsocket(t, addr)
+	defer conn.Close()
+
+	// activity keeps the connection open past the timeout
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		conn.Write(clientFrame("ping"))
+		reply := make([]byte, 6)
+		if _, err := io.ReadFull(br, reply); err != nil {
+			t.Fatalf("Expected echo %d, got error: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Expected the connection to be closed, got error: %v", err)
+	}
+	if !bytes.Equal(rest, closeGoingAway) {
+		t.Errorf("Expected a close frame, got %x", rest)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("Expected the connection to stay open while active, closed after %v", elapsed)
+	}
+}
+
+func TestWebsocketMaxDuration(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr, done := startWebsocketProxy(t, echo, func(rp *ReverseProxy) {
+		rp.WebsocketMaxDuration = 300 * time.Millisecond
+	})
+	defer done()
+	conn, br := dialWebsocket(t, addr)
+	defer conn.Close()
+
+	start := time.Now()
+	go func() {
+		for {
+			if _, err := conn.Write(clientFrame("ping")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	all, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Expected the connection to be closed, got error: %v", err)
+	}
+	if !bytes.HasSuffix(all, closeGoingAway) || len(all) < 2*len(closeGoingAway) {
+		t.Errorf("Expected echoes and then a close frame, got %x", all)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the connection to be closed after 300ms, closed after %v", elapsed)
+	}
+}
+
+func TestWebsocketHalfClose(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(grace time.Duration) { websocketCloseGrace = grace }(websocketCloseGrace)
+	websocketCloseGrace = 200 * time.Millisecond
+
+	// a backend that neither reads nor ever closes the connection
+	hold := make(chan struct{})
+	defer close(hold)
+	addr, done := startWebsocketProxy(t, func(ws *websocket.Conn) { <-hold }, func(rp *ReverseProxy) {})
+	defer done()
+	conn, br := dialWebsocket(t, addr)
+	defer conn.Close()
+
+	start := time.Now()
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Expected the other half to be closed, got error: %v", err)
+	}
+	if !bytes.Equal(rest, closeGoingAway) {
+		t.Errorf("Expected a close frame, got %x", rest)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected a grace period before closing, closed after %v", elapsed)
+	}
+}
+
+func TestFrameBoundary(t *testing.T) {
+	var f frameBoundary
+	long := append([]byte{0x82, 126, 0x01, 0x00}, make([]byte, 256)...)
+	stream := append(append([]byte{0x81, 0x03, 'a', 'b', 'c'}, long...), clientFrame("hi")...)
+	for i, b := range stream {
+		f.feed([]byte{b})
+		expect := i == 4 || i == 4+len(long) || i == len(stream)-1
+		if f.atBoundary() != expect {
+			t.Fatalf("Byte %d: Expected boundary %v, got %v", i, expect, f.atBoundary())
+		}
+	}
+}
+
+func TestParseBlockWebsocketLimits(t *testing.T) {
+	tests := []struct {
+		config    string
+		idle, max time.Duration
+		shouldErr bool
+	}{
+		{"proxy / localhost:8080 {\n websocket_idle_timeout 5m \n websocket_max_duration 12h \n}", 5 * time.Minute, 12 * time.Hour, false},
+		{"proxy / localhost:8080 {\n websocket_idle_timeout 30s \n}", 30 * time.Second, 0, false},
+		{"proxy / localhost:8080 {\n websocket_idle_timeout \n}", 0, 0, true},
+		{"proxy / localhost:8080 {\n websocket_max_duration forever \n}", 0, 0, true},
+		{"proxy / localhost:8080 {\n websocket_max_duration 0s \n}", 0, 0, true},
+	}
+	for i, test := range tests {
+		upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(test.config)))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i+1, err)
+			continue
+		}
+		rp := upstreams[0].(*staticUpstream).Hosts[0].ReverseProxy
+		if rp.WebsocketIdleTimeout != test.idle || rp.WebsocketMaxDuration != test.max {
+			t.Errorf("Test %d: Expected limits %v and %v, got %v and %v", i+1, test.idle, test.max, rp.WebsocketIdleTimeout, rp.WebsocketMaxDuration)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package query provides middleware that adds, deletes, sets and
+// renames the parameters of the query string of requests before
+// they are handled.
+package query
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Query is middleware that changes the query string of the
+// requests matching a certain path.
+type Query struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is the operations to apply, in order, to the
+// query string of requests whose path matches Path.
+type Rule struct {
+	Path string
+	Ops  []Op
+}
+
+// Action is what an Op does to a parameter.
+type Action int
+
+const (
+	// Add appends a parameter, keeping any with the same key.
+	Add Action = iota
+	// Delete removes every parameter with the key.
+	Delete
+	// Set replaces the value of the first parameter with the key
+	// and removes the others, or appends it if there is none.
+	Set
+	// Rename changes the key of every parameter with the key.
+	Rename
+)
+
+// Op is an operation on the parameters with key Key. Value is the
+// value to add or set, which may have placeholders, or the new key
+// for Rename. For Add, an empty Value adds the key on its own.
+type Op struct {
+	Action Action
+	Key    string
+	Value  string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (q Query) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var replacer httpserver.Replacer
+	for _, rule := range q.Rules {
+		if !httpserver.Path(r.URL.Path).Matches(rule.Path) {
+			continue
+		}
+		if replacer == nil {
+			replacer = httpserver.NewReplacer(r, nil, "")
+		}
+		r.URL.RawQuery = apply(r.URL.RawQuery, rule.Ops, replacer)
+	}
+	return q.Next.ServeHTTP(w, r)
+}
+
+// param is a parameter of a query string. rawKey and rawValue
+// are how the parameter was encoded, so that the parameters an
+// operation does not touch are left exactly as they were.
+type param struct {
+	key      string
+	rawKey   string
+	rawValue string
+	hasValue bool
+}
+
+// apply returns rawQuery with ops applied to it.
+func apply(rawQuery string, ops []Op, replacer httpserver.Replacer) string {
+	params := parse(rawQuery)
+	for _, op := range ops {
+		switch op.Action {
+		case Add:
+			params = append(params, newParam(op.Key, replacer.Replace(op.Value), op.Value != ""))
+		case Delete:
+			kept := params[:0]
+			for _, p := range params {
+				if p.key != op.Key {
+					kept = append(kept, p)
+				}
+			}
+			params = kept
+		case Set:
+			value := replacer.Replace(op.Value)
+			kept := params[:0]
+			found := false
+			for _, p := range params {
+				if p.key != op.Key {
+					kept = append(kept, p)
+				} else if !found {
+					kept = append(kept, newParam(op.Key, value, true))
+					found = true
+				}
+			}
+			params = kept
+			if !found {
+				params = append(params, newParam(op.Key, value, true))
+			}
+		case Rename:
+			for i, p := range params {
+				if p.key == op.Key {
+					params[i].key = op.Value
+					params[i].rawKey = url.QueryEscape(op.Value)
+				}
+			}
+		}
+	}
+	return encode(params)
+}
+
+// newParam makes a parameter with key and value.
+func newParam(key, value string, hasValue bool) param {
+	return param{
+		key:      key,
+		rawKey:   url.QueryEscape(key),
+		rawValue: url.QueryEscape(value),
+		hasValue: hasValue,
+	}
+}
+
+// parse splits rawQuery into its parameters, in order.
+func parse(rawQuery string) []param {
+	var params []param
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		p := param{rawKey: part}
+		if i := strings.Index(part, "="); i >= 0 {
+			p.rawKey, p.rawValue, p.hasValue = part[:i], part[i+1:], true
+		}
+		key, err := url.QueryUnescape(p.rawKey)
+		if err != nil {
+			key = p.rawKey
+		}
+		p.key = key
+		params = append(params, p)
+	}
+	return params
+}
+
+// encode joins params into a query string.
+func encode(params []param) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.rawKey
+		if p.hasValue {
+			parts[i] += "=" + p.rawValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestQuery(t *testing.T) {
+	for i, test := range []struct {
+		rawQuery string
+		ops      []Op
+		expected string
+	}{
+		// untouched parameters keep their order and encoding
+		{"b=2&a=1&c=%7E", []Op{{Action: Add, Key: "d", Value: "4"}}, "b=2&a=1&c=%7E&d=4"},
+		{"a=1", []Op{{Action: Add, Key: "flag"}}, "a=1&flag"},
+		{"", []Op{{Action: Add, Key: "api_version", Value: "2"}}, "api_version=2"},
+
+		// repeated keys
+		{"a=1&b=2&a=3", []Op{{Action: Add, Key: "a", Value: "4"}}, "a=1&b=2&a=3&a=4"},
+		{"a=1&b=2&a=3", []Op{{Action: Delete, Key: "a"}}, "b=2"},
+		{"a=1&b=2&a=3", []Op{{Action: Set, Key: "a", Value: "x"}}, "a=x&b=2"},
+		{"a=1&b=2&a=3", []Op{{Action: Rename, Key: "a", Value: "z"}}, "z=1&b=2&z=3"},
+
+		// empty values and keys without values
+		{"a=&b&c=1", []Op{{Action: Delete, Key: "c"}}, "a=&b"},
+		{"a=&b", []Op{{Action: Set, Key: "b", Value: ""}}, "a=&b="},
+		{"a&&b", []Op{{Action: Delete, Key: "x"}}, "a&b"},
+
+		// characters that need encoding
+		{"q=a+b", []Op{{Action: Set, Key: "next", Value: "/a b?c=d&e"}}, "q=a+b&next=%2Fa+b%3Fc%3Dd%26e"},
+		{"utm%5Fsource=x&q=1", []Op{{Action: Delete, Key: "utm_source"}}, "q=1"},
+		{"q=1", []Op{{Action: Rename, Key: "q", Value: "search term"}}, "search+term=1"},
+		{"k%zz=1&a=1", []Op{{Action: Delete, Key: "a"}}, "k%zz=1"},
+
+		// operations apply in order
+		{"utm_source=x&page=1&utm_medium=y", []Op{
+			{Action: Add, Key: "api_version", Value: "2"},
+			{Action: Delete, Key: "utm_source"},
+			{Action: Delete, Key: "utm_medium"},
+			{Action: Set, Key: "page", Value: "{method}"},
+		}, "page=GET&api_version=2"},
+		{"a=1", []Op{
+			{Action: Rename, Key: "a", Value: "b"},
+			{Action: Set, Key: "b", Value: "2"},
+			{Action: Delete, Key: "a"},
+		}, "b=2"},
+	} {
+		r := httptest.NewRequest("GET", "/?"+test.rawQuery, nil)
+		actual := apply(test.rawQuery, test.ops, httpserver.NewReplacer(r, nil, ""))
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected query '%s', got '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestQueryServeHTTP(t *testing.T) {
+	var seen string
+	q := Query{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			seen = r.URL.RawQuery
+			return 0, nil
+		}),
+		Rules: []Rule{
+			{Path: "/", Ops: []Op{{Action: Delete, Key: "utm_source"}}},
+			{Path: "/api", Ops: []Op{{Action: Set, Key: "api_version", Value: "2"}}},
+		},
+	}
+
+	for i, test := range []struct {
+		url      string
+		expected string
+	}{
+		{"/?utm_source=x&a=1", "a=1"},
+		{"/api/users?utm_source=x&api_version=1", "api_version=2"},
+		{"/other?utm_source=y&api_version=1", "api_version=1"},
+	} {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if _, err := q.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if seen != test.expected {
+			t.Errorf("Test %d: Expected next handler to see query '%s', got '%s'", i, test.expected, seen)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("query", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Query middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := queryParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Query{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// queryParse parses query directives, which look like:
+//
+//	query [path] {
+//	    +key [value]
+//	    -key
+//	    add key [value]
+//	    delete key
+//	    set key value
+//	    rename key newkey
+//	}
+func queryParse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+
+	for c.Next() {
+		rule := Rule{Path: "/"}
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Path = args[0]
+		default:
+			return rules, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			var op Op
+			args := append([]string{c.Val()}, c.RemainingArgs()...)
+			switch {
+			case args[0] == "add":
+				op.Action, args = Add, args[1:]
+			case args[0] == "delete":
+				op.Action, args = Delete, args[1:]
+			case args[0] == "set":
+				op.Action, args = Set, args[1:]
+			case args[0] == "rename":
+				op.Action, args = Rename, args[1:]
+			case strings.HasPrefix(args[0], "+"):
+				op.Action, args[0] = Add, args[0][1:]
+			case strings.HasPrefix(args[0], "-"):
+				op.Action, args[0] = Delete, args[0][1:]
+			default:
+				return rules, c.Errf("unknown query operation '%s'", args[0])
+			}
+			if len(args) == 0 || args[0] == "" {
+				return rules, c.ArgErr()
+			}
+			op.Key = args[0]
+
+			switch op.Action {
+			case Add:
+				if len(args) > 2 {
+					return rules, c.ArgErr()
+				}
+			case Delete:
+				if len(args) != 1 {
+					return rules, c.ArgErr()
+				}
+			case Set, Rename:
+				if len(args) != 2 {
+					return rules, c.ArgErr()
+				}
+			}
+			if len(args) > 1 {
+				op.Value = args[1]
+			}
+			if op.Action == Rename && op.Value == "" {
+				return rules, c.Err("query parameter cannot be renamed to an empty key")
+			}
+			rule.Ops = append(rule.Ops, op)
+		}
+		if len(rule.Ops) == 0 {
+			return rules, c.Err("query needs at least one operation")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
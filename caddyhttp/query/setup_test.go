@@ -0,0 +1,118 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `query {
+		-utm_source
+	}`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, but got: %v", err)
+	}
+
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, had 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Query)
+	if !ok {
+		t.Fatalf("Expected handler to be type Query, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestQueryParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`query {
+			+api_version 2
+			-utm_source
+			-utm_medium
+			set page {re.page}
+		}`, false, []Rule{{Path: "/", Ops: []Op{
+			{Action: Add, Key: "api_version", Value: "2"},
+			{Action: Delete, Key: "utm_source"},
+			{Action: Delete, Key: "utm_medium"},
+			{Action: Set, Key: "page", Value: "{re.page}"},
+		}}}},
+		{`query /api {
+			add flag
+			delete set
+			rename q search
+			+set 1
+		}`, false, []Rule{{Path: "/api", Ops: []Op{
+			{Action: Add, Key: "flag"},
+			{Action: Delete, Key: "set"},
+			{Action: Rename, Key: "q", Value: "search"},
+			{Action: Add, Key: "set", Value: "1"},
+		}}}},
+		{`query /a {
+			-a
+		}
+		query /b {
+			-b
+		}`, false, []Rule{
+			{Path: "/a", Ops: []Op{{Action: Delete, Key: "a"}}},
+			{Path: "/b", Ops: []Op{{Action: Delete, Key: "b"}}},
+		}},
+		{`query`, true, nil},
+		{`query / /b {
+			-a
+		}`, true, nil},
+		{`query {
+			~a
+		}`, true, nil},
+		{`query {
+			-
+		}`, true, nil},
+		{`query {
+			-a b
+		}`, true, nil},
+		{`query {
+			+a b c
+		}`, true, nil},
+		{`query {
+			set a
+		}`, true, nil},
+		{`query {
+			rename a
+		}`, true, nil},
+		{`query {
+			rename a ""
+		}`, true, nil},
+		{`query {
+			delete
+		}`, true, nil},
+	}
+
+	for i, test := range tests {
+		actual, err := queryParse(caddy.NewTestController("http", test.input))
+
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected rules %+v, got %+v", i, test.expected, actual)
+		}
+	}
+}
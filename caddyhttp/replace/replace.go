@@ -0,0 +1,136 @@
+// Package replace provides middleware that replaces strings
+// in response bodies, like links to the internal hostname of
+// a proxied application.
+package replace
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Replace is middleware that replaces strings in the bodies
+// of responses.
+type Replace struct {
+	Next    httpserver.Handler
+	Configs []Config
+}
+
+// Config is a set of rules that apply to the responses
+// to requests in Path which have one of ContentTypes.
+type Config struct {
+	Path         string
+	ContentTypes []string
+	Rules        []Rule
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rep Replace) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, config := range rep.Configs {
+		if !httpserver.Path(r.URL.Path).Matches(config.Path) {
+			continue
+		}
+
+		// compressed bodies are left alone, so ask the backend
+		// not to compress them; the gzip middleware, which comes
+		// before this one, compresses what this one writes
+		r.Header.Set("Accept-Encoding", "identity")
+
+		// nor are partial bodies, whose ranges are of a body
+		// with other lengths, so the whole body is asked for
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+
+		rw := &responseWriter{ResponseWriterWrapper: httpserver.ResponseWriterWrapper{ResponseWriter: w}, r: r, config: config}
+		status, err := rep.Next.ServeHTTP(rw, r)
+		if closeErr := rw.close(); err == nil {
+			err = closeErr
+		}
+		return status, err
+	}
+	return rep.Next.ServeHTTP(w, r)
+}
+
+// responseWriter replaces strings in the body written to
+// it if the response header says it can. Flushing it does
+// not flush the end of the body which could still be the
+// start of a match.
+type responseWriter struct {
+	httpserver.ResponseWriterWrapper
+	r           *http.Request
+	config      Config
+	wroteHeader bool
+	body        io.WriteCloser // nil if the body is not changed
+}
+
+// WriteHeader decides whether to replace in the body, and
+// writes the response header.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.replaces(code) {
+		// the length of the body is not known anymore, nor
+		// do validators of the original body apply to it
+		w.Header().Del("Content-Length")
+		w.Header().Del("Accept-Ranges")
+		if etag := w.Header().Get("ETag"); etag != "" && !isWeak(etag) {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+		w.body = newStreamReplacer(w.config.Rules, w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// replaces returns true if the body of the response
+// with status code can have strings replaced in it.
+func (w *responseWriter) replaces(code int) bool {
+	if w.r.Method == http.MethodHead || code == http.StatusNoContent ||
+		code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, ct := range w.config.ContentTypes {
+		if ct == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes b, with strings replaced in it if the
+// response can have them replaced.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.body != nil {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// close writes what is left of the body.
+func (w *responseWriter) close() error {
+	if w.body == nil {
+		return nil
+	}
+	return w.body.Close()
+}
+
+// isWeak returns true if etag is a weak validator.
+func isWeak(etag string) bool {
+	return len(etag) > 1 && etag[0] == 'W' && etag[1] == '/'
+}
@@ -0,0 +1,223 @@
+package replace
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func compile(rules ...Rule) []Rule {
+	for i, rule := range rules {
+		pattern := rule.Find
+		if !rule.Regexp {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		rules[i].re = regexp.MustCompile(pattern)
+	}
+	return rules
+}
+
+func TestStreamReplacer(t *testing.T) {
+	link := Rule{Find: "http://internal.app", Replacement: "https://public.example.com"}
+	for i, test := range []struct {
+		rules  []Rule
+		chunks []string
+		expect string
+	}{
+		{
+			rules:  compile(link),
+			chunks: []string{`<a href="http://internal.app/a">a</a>`},
+			expect: `<a href="https://public.example.com/a">a</a>`,
+		},
+		// the match straddles chunks
+		{
+			rules:  compile(link),
+			chunks: []string{`<a href="http://int`, `ernal.app/a">a</a> <a href="http://internal.`, `app/b">`},
+			expect: `<a href="https://public.example.com/a">a</a> <a href="https://public.example.com/b">`,
+		},
+		// one byte at a time
+		{
+			rules:  compile(link),
+			chunks: strings.Split(`x http://internal.app y http://internal.ap`, ""),
+			expect: `x https://public.example.com y http://internal.ap`,
+		},
+		// the match is at the very end
+		{
+			rules:  compile(link),
+			chunks: []string{"see http://inter", "nal.app"},
+			expect: "see https://public.example.com",
+		},
+		// replacements are not replaced again by the same rule
+		{
+			rules:  compile(Rule{Find: "a", Replacement: "aa"}),
+			chunks: []string{"aba", "a"},
+			expect: "aabaaaa",
+		},
+		// rules are applied in order
+		{
+			rules:  compile(Rule{Find: "a", Replacement: "b"}, Rule{Find: "bb", Replacement: "c"}),
+			chunks: []string{"ab", "ba"},
+			expect: "cc",
+		},
+		// regular expressions with submatches, across chunks
+		{
+			rules: compile(Rule{
+				Find:        `http://([a-z]+)\.internal\.app`,
+				Replacement: "https://$1.example.com",
+				Regexp:      true,
+			}),
+			chunks: []string{"go to http://docs.inter", "nal.app/ or http://", "api.internal.app/v1"},
+			expect: "go to https://docs.example.com/ or https://api.example.com/v1",
+		},
+		{
+			rules: compile(Rule{
+				Find:        `(\d+)-(\d+)`,
+				Replacement: "${2}-${1}",
+				Regexp:      true,
+			}),
+			chunks: []string{"1-2 3", "4-5", "6"},
+			expect: "2-1 56-34",
+		},
+	} {
+		var out bytes.Buffer
+		w := newStreamReplacer(test.rules, &out)
+		for _, chunk := range test.chunks {
+			if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+				t.Fatalf("Test %d: Expected %d bytes written, got %d and error %v", i, len(chunk), n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Test %d: Expected no error closing, got %v", i, err)
+		}
+		if got := out.String(); got != test.expect {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestStreamReplacerBuffersLittle(t *testing.T) {
+	var out bytes.Buffer
+	w := newStreamReplacer(compile(Rule{Find: "abcd", Replacement: "x"}), &out)
+	w.Write([]byte(strings.Repeat("z", 1000)))
+	if got, want := out.Len(), 1000-3; got != want {
+		t.Errorf("Expected %d bytes to be written before the end of the body, got %d", want, got)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	config := Config{
+		Path:         "/",
+		ContentTypes: []string{"text/html", "text/css"},
+		Rules:        compile(Rule{Find: "http://internal.app", Replacement: "https://public.example.com"}),
+	}
+	body := []string{`<a href="http://internal.app/">`, `home</a> <img src="http://internal`, `.app/logo.png">`}
+	replaced := `<a href="https://public.example.com/">home</a> <img src="https://public.example.com/logo.png">`
+	original := strings.Join(body, "")
+
+	for i, test := range []struct {
+		path            string
+		contentType     string
+		contentEncoding string
+		status          int
+		expectBody      string
+	}{
+		{"/", "text/html; charset=utf-8", "", http.StatusOK, replaced},
+		{"/", "text/css", "", http.StatusNotFound, replaced},
+		{"/", "text/plain", "", http.StatusOK, original},
+		{"/", "text/html", "gzip", http.StatusOK, original},
+		{"/", "text/html", "identity", http.StatusOK, replaced},
+		{"/", "text/html", "", http.StatusPartialContent, original},
+		{"/", "", "", http.StatusOK, replaced}, // detected
+	} {
+		var acceptEncoding, rangeHeader string
+		rep := Replace{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				rangeHeader = r.Header.Get("Range") + r.Header.Get("If-Range")
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				if test.contentEncoding != "" {
+					w.Header().Set("Content-Encoding", test.contentEncoding)
+				}
+				w.Header().Set("Content-Length", "1000")
+				if test.contentType != "" {
+					w.WriteHeader(test.status)
+				}
+				for _, chunk := range body {
+					w.Write([]byte(chunk))
+				}
+				return 0, nil
+			}),
+			Configs: []Config{config},
+		}
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", "bytes=10-")
+		req.Header.Set("If-Range", `"etag"`)
+		rec := httptest.NewRecorder()
+		if _, err := rep.ServeHTTP(rec, req); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+
+		if acceptEncoding != "identity" {
+			t.Errorf("Test %d: Expected backend to be asked for identity, got '%s'", i, acceptEncoding)
+		}
+		if rangeHeader != "" {
+			t.Errorf("Test %d: Expected backend to be asked for the whole body, got range '%s'", i, rangeHeader)
+		}
+		if got := rec.Body.String(); got != test.expectBody {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.expectBody, got)
+		}
+		if rec.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, rec.Code)
+		}
+		changed := test.expectBody != original
+		if got := rec.Header().Get("Content-Length"); changed && got != "" {
+			t.Errorf("Test %d: Expected no Content-Length, got %s", i, got)
+		} else if !changed && got != "1000" {
+			t.Errorf("Test %d: Expected Content-Length to be kept, got '%s'", i, got)
+		}
+	}
+}
+
+func TestReplacePath(t *testing.T) {
+	rep := Replace{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("foo"))
+			return 0, nil
+		}),
+		Configs: []Config{{
+			Path:         "/app",
+			ContentTypes: []string{"text/html"},
+			Rules:        compile(Rule{Find: "foo", Replacement: "bar"}),
+		}},
+	}
+	for i, test := range []struct {
+		path   string
+		expect string
+	}{
+		{"/app/page", "bar"},
+		{"/other", "foo"},
+	} {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create HTTP request: %v", i, err)
+		}
+		rec := httptest.NewRecorder()
+		rep.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != test.expect {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package replace
+
+import (
+	"regexp"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("replace", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// DefaultContentTypes are the content types of the responses that
+// strings are replaced in unless others are configured.
+var DefaultContentTypes = []string{"text/html"}
+
+// setup configures a new Replace middleware instance.
+func setup(c *caddy.Controller) error {
+	configs, err := replaceParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Replace{Next: next, Configs: configs}
+	})
+
+	return nil
+}
+
+func replaceParse(c *caddy.Controller) ([]Config, error) {
+	var configs []Config
+
+	for c.Next() {
+		config := Config{Path: "/"}
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			config.Path = args[0]
+		case 2:
+			config.Rules = append(config.Rules, Rule{Find: args[0], Replacement: args[1]})
+		case 3:
+			config.Path = args[0]
+			config.Rules = append(config.Rules, Rule{Find: args[1], Replacement: args[2]})
+		default:
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "content_type":
+				types := c.RemainingArgs()
+				if len(types) == 0 {
+					return nil, c.ArgErr()
+				}
+				config.ContentTypes = append(config.ContentTypes, types...)
+			case "regex":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				config.Rules = append(config.Rules, Rule{Find: args[0], Replacement: args[1], Regexp: true})
+			default:
+				find := c.Val()
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				config.Rules = append(config.Rules, Rule{Find: find, Replacement: args[0]})
+			}
+		}
+
+		if len(config.Rules) == 0 {
+			return nil, c.Err("replace: at least one replacement is required")
+		}
+		for i, rule := range config.Rules {
+			if rule.Find == "" {
+				return nil, c.Err("replace: cannot replace empty string")
+			}
+			pattern := rule.Find
+			if !rule.Regexp {
+				pattern = regexp.QuoteMeta(pattern)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, c.Errf("replace: invalid regular expression '%s': %v", rule.Find, err)
+			}
+			config.Rules[i].re = re
+		}
+		if len(config.ContentTypes) == 0 {
+			config.ContentTypes = DefaultContentTypes
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,113 @@
+package replace
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `replace http://internal.app https://public.example.com`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Replace)
+	if !ok {
+		t.Fatalf("Expected handler to be type Replace, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestReplaceParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Config
+	}{
+		{`replace a b`, false, []Config{{
+			Path:         "/",
+			ContentTypes: DefaultContentTypes,
+			Rules:        []Rule{{Find: "a", Replacement: "b"}},
+		}}},
+		{`replace /app a b`, false, []Config{{
+			Path:         "/app",
+			ContentTypes: DefaultContentTypes,
+			Rules:        []Rule{{Find: "a", Replacement: "b"}},
+		}}},
+		{`replace /app {
+			content_type text/html text/css
+			"http://internal.app" "https://public.example.com"
+			regex "http://([a-z]+)\.internal" "https://$1.public"
+		}
+		replace /other a b`, false, []Config{{
+			Path:         "/app",
+			ContentTypes: []string{"text/html", "text/css"},
+			Rules: []Rule{
+				{Find: "http://internal.app", Replacement: "https://public.example.com"},
+				{Find: `http://([a-z]+)\.internal`, Replacement: "https://$1.public", Regexp: true},
+			},
+		}, {
+			Path:         "/other",
+			ContentTypes: DefaultContentTypes,
+			Rules:        []Rule{{Find: "a", Replacement: "b"}},
+		}}},
+		{`replace a ""`, false, []Config{{
+			Path:         "/",
+			ContentTypes: DefaultContentTypes,
+			Rules:        []Rule{{Find: "a", Replacement: ""}},
+		}}},
+		{`replace`, true, nil},
+		{`replace /app`, true, nil},
+		{`replace "" b`, true, nil},
+		{`replace / a b c`, true, nil},
+		{`replace {
+			content_type
+			a b
+		}`, true, nil},
+		{`replace {
+			regex "(" b
+		}`, true, nil},
+		{`replace {
+			regex a
+		}`, true, nil},
+		{`replace {
+			a
+		}`, true, nil},
+	}
+	for i, test := range tests {
+		configs, err := replaceParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		for j := range configs {
+			for k := range configs[j].Rules {
+				if configs[j].Rules[k].re == nil {
+					t.Errorf("Test %d: Expected rule %d of config %d to be compiled", i, k, j)
+				}
+				configs[j].Rules[k].re = nil
+			}
+		}
+		if !reflect.DeepEqual(configs, test.expected) {
+			t.Errorf("Test %d: Expected %#v, got %#v", i, test.expected, configs)
+		}
+	}
+}
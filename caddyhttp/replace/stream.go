@@ -0,0 +1,124 @@
+package replace
+
+import (
+	"io"
+	"regexp"
+)
+
+// regexpWindow is how far past the start of a match of a
+// regular expression the body is buffered before the match is
+// replaced, so it is also the longest match that is guaranteed
+// to be found whole.
+const regexpWindow = 4096
+
+// Rule replaces what it finds in a response body.
+type Rule struct {
+	// Find is the string or, if Regexp is true, the
+	// regular expression to find
+	Find string
+
+	// Replacement is what Find is replaced with; if Regexp
+	// is true, $1 and the like stand for its submatches
+	Replacement string
+
+	// Regexp is true if Find is a regular expression
+	Regexp bool
+
+	re *regexp.Regexp
+}
+
+// window returns how many bytes after the start of a possible
+// match must be buffered to be certain about the match.
+func (rule Rule) window() int {
+	if rule.Regexp {
+		return regexpWindow
+	}
+	return len(rule.Find) - 1
+}
+
+// streamReplacer is an io.WriteCloser that applies a rule to what
+// is written to it and writes the result to out. It holds back just
+// enough of the end of what was written that a match which is not
+// written whole yet is still found. Close writes what is left.
+type streamReplacer struct {
+	rule Rule
+	out  io.Writer
+	buf  []byte
+}
+
+// newStreamReplacer returns a streamReplacer that
+// applies rules in order and writes the result to out.
+func newStreamReplacer(rules []Rule, out io.Writer) io.WriteCloser {
+	var w io.WriteCloser
+	for i := len(rules) - 1; i >= 0; i-- {
+		w = &streamReplacer{rule: rules[i], out: out}
+		out = w
+	}
+	return w
+}
+
+// Write writes p through the buffer and always reports having
+// written all of p unless writing to out fails.
+func (s *streamReplacer) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	if err := s.replace(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close replaces what is left in the buffer and writes it,
+// then closes out if it is a streamReplacer too.
+func (s *streamReplacer) Close() error {
+	if err := s.replace(true); err != nil {
+		return err
+	}
+	if next, ok := s.out.(*streamReplacer); ok {
+		return next.Close()
+	}
+	return nil
+}
+
+// replace writes the buffer to out with the matches in it replaced,
+// except for the part at its end that could still be the start of
+// a match; unless final is true, in which case all is written.
+func (s *streamReplacer) replace(final bool) error {
+	// matches that start in the last window bytes
+	// may still grow, or may not be matches yet
+	limit := len(s.buf)
+	if !final {
+		limit -= s.rule.window()
+		if limit <= 0 {
+			return nil
+		}
+	}
+
+	var out []byte
+	last := 0
+	for _, match := range s.rule.re.FindAllSubmatchIndex(s.buf, -1) {
+		if match[0] >= limit {
+			break
+		}
+		if match[1] == match[0] {
+			continue // replacing empty matches makes no sense here
+		}
+		out = append(out, s.buf[last:match[0]]...)
+		if s.rule.Regexp {
+			out = s.rule.re.Expand(out, []byte(s.rule.Replacement), s.buf, match)
+		} else {
+			out = append(out, s.rule.Replacement...)
+		}
+		last = match[1]
+	}
+	if limit < last {
+		limit = last
+	}
+	out = append(out, s.buf[last:limit]...)
+	s.buf = append(s.buf[:0], s.buf[limit:]...)
+
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := s.out.Write(out)
+	return err
+}
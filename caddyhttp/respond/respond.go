@@ -0,0 +1,101 @@
+// Package respond serves responses that are defined in
+// the Caddyfile, without files on disk.
+package respond
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// DefaultContentType is the Content-Type of
+// bodies for which no type is configured.
+const DefaultContentType = "text/plain; charset=utf-8"
+
+// Respond is a middleware that serves a fixed response
+// to the requests with a path it has a rule for.
+type Respond struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is a response to serve for requests with a path.
+type Rule struct {
+	// Path is the path the rule applies to; the
+	// longest path that matches a request wins
+	Path string
+
+	// Status is the status code of the response
+	Status int
+
+	// Body is the response body, which may contain
+	// placeholders; if empty, the response has no body,
+	// or the error page for Status if it is an error
+	Body string
+
+	// ContentType is the Content-Type of Body; if empty,
+	// DefaultContentType is used
+	ContentType string
+
+	// Close is whether to close the connection
+	// after the response
+	Close bool
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rs Respond) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := rs.match(r)
+	if rule == nil {
+		return rs.Next.ServeHTTP(w, r)
+	}
+
+	if rule.Close {
+		w.Header().Set("Connection", "close")
+	}
+	return Serve(w, r, rule.Status, rule.Body, rule.ContentType)
+}
+
+// Serve answers r with status and body, whose placeholders are
+// replaced, of contentType, or DefaultContentType if it is empty.
+// If body is empty, the response has none, unless status is an
+// error; then status is returned, for the error page to be written.
+// Other middleware use this to serve fixed responses the same way.
+func Serve(w http.ResponseWriter, r *http.Request, status int, body, contentType string) (int, error) {
+	if body == "" {
+		if status >= 400 {
+			return status, nil
+		}
+		w.WriteHeader(status)
+		return 0, nil
+	}
+
+	body = httpserver.NewReplacer(r, nil, "").Replace(body)
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, body)
+	}
+	return 0, nil
+}
+
+// match returns the rule with the longest path
+// that matches r, or nil if there is none.
+func (rs Respond) match(r *http.Request) *Rule {
+	var match *Rule
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if !httpserver.Path(r.URL.Path).Matches(rule.Path) {
+			continue
+		}
+		if match == nil || len(rule.Path) > len(match.Path) {
+			match = rule
+		}
+	}
+	return match
+}
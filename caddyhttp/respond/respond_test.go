@@ -0,0 +1,106 @@
+package respond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/rewrite"
+)
+
+func TestRespond(t *testing.T) {
+	rs := Respond{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("next"))
+			return 0, nil
+		}),
+		Rules: []Rule{
+			{Path: "/", Status: 404},
+			{Path: "/robots.txt", Status: 200, Body: "User-agent: *\nDisallow: /private"},
+			{Path: "/hello", Status: 200, Body: `{"path": "{path}", "method": "{method}"}`, ContentType: "application/json"},
+			{Path: "/healthz", Status: 204, Close: true},
+			{Path: "/static", Status: 200, Body: "{{not a placeholder}}"},
+			{Path: "/static/files", Status: 418},
+		},
+	}
+
+	for i, test := range []struct {
+		method, path string
+		status       int    // returned status
+		code         int    // status written
+		body         string // body written
+		contentType  string
+		close        bool
+	}{
+		{"GET", "/robots.txt", 0, 200, "User-agent: *\nDisallow: /private", DefaultContentType, false},
+		{"HEAD", "/robots.txt", 0, 200, "", DefaultContentType, false},
+		{"POST", "/hello/there", 0, 200, `{"path": "/hello/there", "method": "POST"}`, "application/json", false},
+		{"GET", "/healthz", 0, 204, "", "", true},
+		{"GET", "/static", 0, 200, "{{not a placeholder}}", DefaultContentType, false},
+		{"GET", "/static/files/x", 418, 200, "", "", false},
+		{"GET", "/missing", 404, 200, "", "", false},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		rec := httptest.NewRecorder()
+		status, err := rs.ServeHTTP(rec, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected returned status %d, got %d", i, test.status, status)
+		}
+		if rec.Code != test.code {
+			t.Errorf("Test %d: Expected status %d to be written, got %d", i, test.code, rec.Code)
+		}
+		if got := rec.Body.String(); got != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, got)
+		}
+		if got := rec.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Test %d: Expected Content-Type %q, got %q", i, test.contentType, got)
+		}
+		if got := rec.Header().Get("Connection") == "close"; got != test.close {
+			t.Errorf("Test %d: Expected connection closing to be %v, got %v", i, test.close, got)
+		}
+		if test.body != "" {
+			if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(len(test.body)); got != want {
+				t.Errorf("Test %d: Expected Content-Length %s, got %s", i, want, got)
+			}
+		}
+	}
+}
+
+func TestRespondAfterRewrite(t *testing.T) {
+	directives := caddy.ValidDirectives("http")
+	var rewriteIdx, respondIdx int
+	for i, dir := range directives {
+		switch dir {
+		case "rewrite":
+			rewriteIdx = i
+		case "respond":
+			respondIdx = i
+		}
+	}
+	if rewriteIdx >= respondIdx {
+		t.Fatalf("Expected respond to come after rewrite, got directives %v", directives)
+	}
+
+	// a request that is rewritten gets the response for its new path
+	handler := rewrite.Rewrite{
+		Rules: []httpserver.HandlerConfig{rewrite.NewSimpleRule("/robots", "/robots.txt")},
+		Next: Respond{
+			Next:  httpserver.EmptyNext,
+			Rules: []Rule{{Path: "/robots.txt", Status: 200, Body: "{path}"}},
+		},
+	}
+	r := httptest.NewRequest("GET", "/robots", nil)
+	rec := httptest.NewRecorder()
+	if _, err := handler.ServeHTTP(rec, r); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Body.String(), "/robots.txt"; got != want {
+		t.Errorf("Expected response for rewritten path %q, got %q", want, got)
+	}
+}
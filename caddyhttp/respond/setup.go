@@ -0,0 +1,102 @@
+package respond
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("respond", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Respond middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := respondParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Respond{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// respondParse parses respond directives, which look like:
+//
+//	respond [path] [status] {
+//	    body         text
+//	    content_type type
+//	    close
+//	}
+//
+// The path defaults to / and the status to 200.
+func respondParse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+
+	for c.Next() {
+		rule := Rule{Path: "/", Status: http.StatusOK}
+
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return nil, c.ArgErr()
+		}
+		if len(args) > 0 && strings.HasPrefix(args[0], "/") {
+			rule.Path = args[0]
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			status, err := strconv.Atoi(args[0])
+			if err != nil || status < 200 || status > 599 {
+				return nil, c.Errf("Invalid status '%s'; must be a code from 200 to 599", args[0])
+			}
+			rule.Status = status
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "body":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.Body = c.Val()
+			case "content_type":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.ContentType = c.Val()
+			case "close":
+				rule.Close = true
+			default:
+				return nil, c.Errf("Unknown respond option '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		}
+
+		if rule.Body != "" && (rule.Status == http.StatusNoContent || rule.Status == http.StatusNotModified) {
+			return nil, c.Errf("A response with status %d cannot have a body", rule.Status)
+		}
+		for _, other := range rules {
+			if other.Path == rule.Path {
+				return nil, c.Errf("Duplicate response for path '%s'", rule.Path)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
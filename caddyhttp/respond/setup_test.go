@@ -0,0 +1,78 @@
+package respond
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `respond /robots.txt 200`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Respond)
+	if !ok {
+		t.Fatalf("Expected handler to be type Respond, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestRespondParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`respond`, false, []Rule{{Path: "/", Status: 200}}},
+		{`respond /gone 410`, false, []Rule{{Path: "/gone", Status: 410}}},
+		{`respond 503`, false, []Rule{{Path: "/", Status: 503}}},
+		{"respond /robots.txt 200 {\nbody \"User-agent: *\nDisallow:\"\ncontent_type text/plain\n}", false, []Rule{{
+			Path: "/robots.txt", Status: 200, Body: "User-agent: *\nDisallow:", ContentType: "text/plain",
+		}}},
+		{"respond /status.json {\n\tbody <<JSON\n\t\t{\n\t\t  \"status\": \"{status}\"\n\t\t}\n\t\tJSON\n\tclose\n}", false, []Rule{{
+			Path: "/status.json", Status: 200, Body: "{\n  \"status\": \"{status}\"\n}", Close: true,
+		}}},
+		{"respond /a {\nbody \"}\"\n}\nrespond /b 204", false, []Rule{
+			{Path: "/a", Status: 200, Body: "}"},
+			{Path: "/b", Status: 204},
+		}},
+		{`respond /a 200 extra`, true, nil},
+		{`respond /a abc`, true, nil},
+		{`respond /a 99`, true, nil},
+		{`respond /a 600`, true, nil},
+		{"respond /a 204 {\nbody text\n}", true, nil},
+		{"respond /a {\nbody\n}", true, nil},
+		{"respond /a {\nbody a b\n}", true, nil},
+		{"respond /a {\nfoo bar\n}", true, nil},
+		{"respond /a\nrespond /a 404", true, nil},
+	}
+	for i, test := range tests {
+		actual, err := respondParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected rules %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
@@ -37,7 +37,11 @@ type Rewrite struct {
 // ServeHTTP implements the httpserver.Handler interface.
 func (rw Rewrite) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	if rule := httpserver.ConfigSelector(rw.Rules).Select(r); rule != nil {
-		switch result := rule.(Rule).Rewrite(rw.FileSys, r); result {
+		if cRule, ok := rule.(*ComplexRule); ok {
+			r = cRule.withNamedMatches(r)
+		}
+		fs := httpserver.RequestFileSystem(r, rw.FileSys)
+		switch result := rule.(Rule).Rewrite(fs, r); result {
 		case RewriteStatus:
 			// only valid for complex rules.
 			if cRule, ok := rule.(*ComplexRule); ok && cRule.Status != 0 {
@@ -240,6 +244,24 @@ func (r *ComplexRule) matchExt(rPath string) bool {
 	return true
 }
 
+// withNamedMatches returns req with a placeholder {re.name} for
+// each named group of the regexp of r that its path matched, so
+// that the handlers after the rewrite can use them too.
+func (r *ComplexRule) withNamedMatches(req *http.Request) *http.Request {
+	matches := r.regexpMatches(req.URL.Path)
+	if matches == nil {
+		return req
+	}
+	for i, name := range r.SubexpNames() {
+		if name == "" || i >= len(matches) {
+			continue
+		}
+		value := matches[i]
+		req = httpserver.WithPlaceholder(req, "re."+name, func() string { return value })
+	}
+	return req
+}
+
 func (r *ComplexRule) regexpMatches(rPath string) []string {
 	if r.Regexp != nil {
 		// include trailing slash in regexp if present
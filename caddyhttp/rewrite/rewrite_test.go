@@ -157,6 +157,30 @@ func TestRewrite(t *testing.T) {
 	}
 }
 
+func TestRewriteNamedMatches(t *testing.T) {
+	rule, err := NewComplexRule("/blog", `/page/(?P<page>[0-9]+)`, "/blog?p={re.page}", 0, nil, httpserver.IfMatcher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := Rewrite{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			fmt.Fprint(w, r.URL.String(), " ", httpserver.NewReplacer(r, nil, "").Replace("{re.page}"))
+			return 0, nil
+		}),
+		Rules: []httpserver.HandlerConfig{rule},
+	}
+
+	req, err := http.NewRequest("GET", "/blog/page/12", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	rw.ServeHTTP(rec, req)
+	if expected := "/blog?p=12 12"; rec.Body.String() != expected {
+		t.Errorf("Expected named match in rewrite and after it, '%s', got '%s'", expected, rec.Body.String())
+	}
+}
+
 func urlPrinter(w http.ResponseWriter, r *http.Request) (int, error) {
 	fmt.Fprint(w, r.URL.String())
 	return 0, nil
@@ -14,6 +14,10 @@ func init() {
 		ServerType: "http",
 		Action:     setup,
 	})
+	caddy.RegisterPlugin("try_files", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupTryFiles,
+	})
 }
 
 // setup configures a new Rewrite middleware instance.
@@ -115,3 +119,54 @@ func rewriteParse(c *caddy.Controller) ([]httpserver.HandlerConfig, error) {
 
 	return rules, nil
 }
+
+// setupTryFiles configures a new TryFiles middleware instance.
+func setupTryFiles(c *caddy.Controller) error {
+	tf, err := tryFilesParse(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		tf.Next = next
+		tf.FileSys = http.Dir(cfg.Root)
+		return tf
+	})
+
+	return nil
+}
+
+// tryFilesParse parses the try_files directive, which is
+// a list of candidates, optionally followed by =status:
+//
+//	try_files {path} {path}/ /index.html
+//	try_files {path} {path}/ =404
+func tryFilesParse(c *caddy.Controller) (TryFiles, error) {
+	var tf TryFiles
+
+	for c.Next() {
+		if tf.Candidates != nil {
+			return tf, c.Err("try_files can only be used once per site")
+		}
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return tf, c.ArgErr()
+		}
+		if last := args[len(args)-1]; strings.HasPrefix(last, "=") {
+			status, err := strconv.Atoi(last[1:])
+			if err != nil || status < 400 || status > 599 {
+				return tf, c.Errf("Invalid status '%s'; must be = and an error code", last)
+			}
+			tf.Status = status
+			args = args[:len(args)-1]
+			if len(args) == 0 {
+				return tf, c.ArgErr()
+			}
+		}
+		tf.Candidates = args
+	}
+
+	return tf, nil
+}
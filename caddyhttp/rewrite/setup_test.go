@@ -2,6 +2,7 @@ package rewrite
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"testing"
 
@@ -233,3 +234,39 @@ func TestRewriteParse(t *testing.T) {
 	}
 
 }
+
+func TestTryFilesParse(t *testing.T) {
+	for i, test := range []struct {
+		input      string
+		shouldErr  bool
+		candidates []string
+		status     int
+	}{
+		{`try_files {path} {path}/ /index.html`, false, []string{"{path}", "{path}/", "/index.html"}, 0},
+		{`try_files {path} =404`, false, []string{"{path}"}, 404},
+		{`try_files /index.html`, false, []string{"/index.html"}, 0},
+		{`try_files`, true, nil, 0},
+		{`try_files =404`, true, nil, 0},
+		{`try_files {path} =200`, true, nil, 0},
+		{`try_files {path} =abc`, true, nil, 0},
+		{"try_files {path}\ntry_files /index.html", true, nil, 0},
+	} {
+		tf, err := tryFilesParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(tf.Candidates, test.candidates) {
+			t.Errorf("Test %d: Expected candidates %v, got %v", i, test.candidates, tf.Candidates)
+		}
+		if tf.Status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, tf.Status)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package rewrite
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+)
+
+// TryFiles is middleware that rewrites requests to the
+// first of a list of files that exists.
+type TryFiles struct {
+	Next    httpserver.Handler
+	FileSys http.FileSystem
+
+	// Candidates are the paths to try, in order; they may
+	// contain placeholders and a query string. A path that
+	// ends in / must be a directory, any other a file.
+	Candidates []string
+
+	// Status is returned if none of the candidates exist;
+	// if it is 0, the last candidate is rewritten to
+	// whether it exists or not.
+	Status int
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (tf TryFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	tf.FileSys = httpserver.RequestFileSystem(r, tf.FileSys)
+	replacer := newReplacer(r)
+	for i, candidate := range tf.Candidates {
+		name, query := tryFilesCandidate(replacer.Replace(candidate))
+		info, ok := tf.stat(name)
+		if !ok {
+			if i < len(tf.Candidates)-1 || tf.Status != 0 {
+				continue
+			}
+		}
+
+		// take note of this rewrite for internal use by fastcgi
+		r.Header.Set(headerFieldName, r.URL.RequestURI())
+		r.URL.Path = name
+		if query != "" {
+			r.URL.RawQuery = query
+		}
+		if info != nil {
+			r = staticfiles.WithFileInfo(r, name, info)
+		}
+		return tf.Next.ServeHTTP(w, r)
+	}
+	return tf.Status, nil
+}
+
+// stat returns the file info of the file or directory at
+// name, and whether it exists as the kind of file that
+// name asks for.
+func (tf TryFiles) stat(name string) (os.FileInfo, bool) {
+	if tf.FileSys == nil {
+		return nil, false
+	}
+	f, err := tf.FileSys.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false
+	}
+	if info.IsDir() != strings.HasSuffix(name, "/") {
+		return nil, false
+	}
+	return info, true
+}
+
+// tryFilesCandidate splits candidate, into which placeholders
+// are replaced, into its cleaned path and its query string.
+// A trailing slash is kept, since it asks for a directory.
+func tryFilesCandidate(candidate string) (name, query string) {
+	parts := strings.SplitN(candidate, "?", 2)
+	if len(parts) > 1 {
+		query = parts[1]
+	}
+	name = path.Clean("/" + parts[0])
+	if strings.HasSuffix(parts[0], "/") && name != "/" {
+		name += "/"
+	}
+	return name, query
+}
@@ -0,0 +1,162 @@
+package rewrite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/staticfiles"
+)
+
+// statCountingFS counts how often the files it opens are stat'ed.
+type statCountingFS struct {
+	http.FileSystem
+	stats *int
+}
+
+func (fs statCountingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return statCountingFile{f, fs.stats}, nil
+}
+
+type statCountingFile struct {
+	http.File
+	stats *int
+}
+
+func (f statCountingFile) Stat() (os.FileInfo, error) {
+	*f.stats++
+	return f.File.Stat()
+}
+
+func TestTryFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "caddy_tryfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{
+		"index.html":         "spa",
+		"assets/app.v2.js":   "app",
+		"docs/index.html":    "docs",
+		"v1.2/notes.txt":     "notes",
+		"docs/guide.v1/x.js": "x",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats int
+	fs := statCountingFS{http.Dir(root), &stats}
+	spa := TryFiles{FileSys: fs, Candidates: []string{"{path}", "{path}/", "/index.html"}}
+	strict := TryFiles{FileSys: fs, Candidates: []string{"{path}", "{path}/"}, Status: http.StatusNotFound}
+
+	for i, test := range []struct {
+		tf     TryFiles
+		path   string
+		status int
+		body   string
+		stats  int // stats of files and directories, by both middleware and file server
+	}{
+		{spa, "/assets/app.v2.js", http.StatusOK, "app", 1},
+		{spa, "/v1.2/notes.txt", http.StatusOK, "notes", 1},
+		{spa, "/assets/missing.v3.js", http.StatusOK, "spa", 1},
+		{spa, "/some/client/route", http.StatusOK, "spa", 1},
+		{spa, "/docs", http.StatusOK, "docs", 3},            // docs as file, docs/, then its index
+		{spa, "/docs/", http.StatusOK, "docs", 2},           // docs/, then its index
+		{spa, "/docs/guide.v1", http.StatusNotFound, "", 2}, // a directory without index
+		{spa, "/../../etc/passwd", http.StatusOK, "spa", 1},
+		{strict, "/assets/app.v2.js", http.StatusOK, "app", 1},
+		{strict, "/assets/missing.v3.js", http.StatusNotFound, "", 0},
+		{strict, "/docs", http.StatusOK, "docs", 3},
+	} {
+		stats = 0
+		test.tf.Next = staticfiles.FileServer{Root: fs}
+		r := httptest.NewRequest("GET", test.path, nil)
+		rec := httptest.NewRecorder()
+		status, err := test.tf.ServeHTTP(rec, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d for %s, got %d", i, test.status, test.path, status)
+		}
+		if got := rec.Body.String(); got != test.body {
+			t.Errorf("Test %d: Expected body %q for %s, got %q", i, test.body, test.path, got)
+		}
+		if stats != test.stats {
+			t.Errorf("Test %d: Expected %d stats for %s, got %d", i, test.stats, test.path, stats)
+		}
+	}
+}
+
+func TestTryFilesRewrite(t *testing.T) {
+	var got *http.Request
+	tf := TryFiles{
+		FileSys:    http.Dir("testdata"),
+		Candidates: []string{"/testdir/", "/index.php?p={path}&{query}"},
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			got = r
+			return 0, nil
+		}),
+	}
+
+	// the first candidate exists
+	tf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a.b/c?x=1", nil))
+	if got == nil || got.URL.Path != "/testdir/" || got.URL.RawQuery != "x=1" {
+		t.Errorf("Expected rewrite to /testdir/?x=1, got %v", got)
+	}
+
+	// the last candidate is the fallback
+	got = nil
+	tf.Candidates = tf.Candidates[1:]
+	tf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a.b/c?x=1", nil))
+	if got == nil {
+		t.Fatal("Expected request to be passed on")
+	}
+	if got.URL.Path != "/index.php" || got.URL.RawQuery != "p=/a.b/c&x=1" {
+		t.Errorf("Expected rewrite to /index.php?p=/a.b/c&x=1, got %s", got.URL.RequestURI())
+	}
+	if got.Header.Get(headerFieldName) != "/a.b/c?x=1" {
+		t.Errorf("Expected original URI to be noted, got %q", got.Header.Get(headerFieldName))
+	}
+}
+
+func TestTryFilesRequestRoot(t *testing.T) {
+	var got *http.Request
+	tf := TryFiles{
+		FileSys:    http.Dir("/nonexistent/{host}"),
+		Candidates: []string{"/testdir/", "/index.php"},
+		Status:     http.StatusNotFound,
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			got = r
+			return 0, nil
+		}),
+	}
+
+	// the candidates are found in the root of the request
+	r := httpserver.WithRoot(httptest.NewRequest("GET", "/a", nil), "testdata")
+	tf.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.URL.Path != "/testdir/" {
+		t.Errorf("Expected rewrite to /testdir/ in the root of the request, got %v", got)
+	}
+
+	// a request without root has no files
+	got = nil
+	r = httpserver.WithRoot(httptest.NewRequest("GET", "/a", nil), "")
+	if status, _ := tf.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusNotFound || got != nil {
+		t.Errorf("Expected status 404 without root, got %d", status)
+	}
+}
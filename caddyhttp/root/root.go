@@ -2,7 +2,9 @@ package root
 
 import (
 	"log"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
@@ -15,27 +17,153 @@ func init() {
 	})
 }
 
+// setupRoot sets the root of the site, which may have placeholders
+// to give each request its own root, and then may have a fallback:
+//
+//	root /srv/sites/{hostonly}/public {
+//	    fallback /srv/sites/default/public
+//	}
 func setupRoot(c *caddy.Controller) error {
 	config := httpserver.GetConfig(c)
+	var fallback string
 
 	for c.Next() {
-		if !c.NextArg() {
+		if !c.NextArg() || c.Val() == "{" {
 			return c.ArgErr()
 		}
 		config.Root = c.Val()
+		for c.NextBlock() {
+			switch c.Val() {
+			case "fallback":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				fallback = c.Val()
+			default:
+				return c.Errf("unknown root property '%s'", c.Val())
+			}
+		}
+	}
+
+	parts := splitRoot(config.Root)
+	check := config.Root
+	if isTemplate(parts) {
+		if fallback == "" {
+			check = ""
+		} else {
+			check = fallback
+		}
+		config.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+			return Root{Next: next, parts: parts, Fallback: fallback}
+		})
+	} else if fallback != "" {
+		return c.Err("a fallback root is only for roots with placeholders")
+	}
+	if check == "" {
+		return nil
 	}
 
 	// Check if root path exists
-	_, err := os.Stat(config.Root)
+	_, err := os.Stat(check)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Allow this, because the folder might appear later.
 			// But make sure the user knows!
-			log.Printf("[WARNING] Root path does not exist: %s", config.Root)
+			log.Printf("[WARNING] Root path does not exist: %s", check)
 		} else {
-			return c.Errf("Unable to access root path '%s': %v", config.Root, err)
+			return c.Errf("Unable to access root path '%s': %v", check, err)
 		}
 	}
 
 	return nil
 }
+
+// Root gives each request the document root that results from
+// replacing the placeholders of the root of the site with the
+// values of the request. The values are lower-cased, and a value
+// that is empty, is a dot segment or has a path separator, which
+// could take the root out of the directory the site meant, does
+// not give a root. If there is no root, or it is not a directory,
+// the request is served from Fallback, or if there is no fallback,
+// it goes on without root, so that the handlers that serve files
+// find none and it is not found the way any missing file is, which
+// errors can handle.
+type Root struct {
+	Next     httpserver.Handler
+	parts    []rootPart
+	Fallback string
+}
+
+// rootPart is a literal part of a root, or a placeholder.
+type rootPart struct {
+	text        string
+	placeholder bool
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rt Root) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	root, ok := rt.resolve(r)
+	if ok {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			ok = false
+		}
+	}
+	if !ok {
+		root = rt.Fallback
+	}
+	return rt.Next.ServeHTTP(w, httpserver.WithRoot(r, root))
+}
+
+// resolve returns the root of r, and false if a value
+// of r is not safe to put in a path.
+func (rt Root) resolve(r *http.Request) (string, bool) {
+	rep := httpserver.NewReplacer(r, nil, "")
+	var root []byte
+	for _, part := range rt.parts {
+		if !part.placeholder {
+			root = append(root, part.text...)
+			continue
+		}
+		value := strings.ToLower(rep.Replace(part.text))
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, "/\\\x00") {
+			return "", false
+		}
+		root = append(root, value...)
+	}
+	return string(root), true
+}
+
+// splitRoot splits root into its literal parts and its placeholders.
+func splitRoot(root string) []rootPart {
+	var parts []rootPart
+	for {
+		start := strings.Index(root, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(root[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		if start > 0 {
+			parts = append(parts, rootPart{text: root[:start]})
+		}
+		parts = append(parts, rootPart{text: root[start:end], placeholder: true})
+		root = root[end:]
+	}
+	if root != "" {
+		parts = append(parts, rootPart{text: root})
+	}
+	return parts
+}
+
+// isTemplate returns whether parts has placeholders.
+func isTemplate(parts []rootPart) bool {
+	for _, part := range parts {
+		if part.placeholder {
+			return true
+		}
+	}
+	return false
+}
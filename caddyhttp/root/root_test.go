@@ -3,6 +3,8 @@ package root
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -101,3 +103,93 @@ func getTempDirPath() (string, error) {
 func getInaccessiblePath(file string) string {
 	return filepath.Join("C:", "file\x00name") // null byte in filename is not allowed on Windows AND unix
 }
+
+func TestRootPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "root_test")
+	if err != nil {
+		t.Fatalf("BeforeTest: Failed to create temp dir for testing! Error was: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"sites/example.com/public", "public", "default"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("BeforeTest: Failed to create %s! Error was: %v", d, err)
+		}
+	}
+
+	sites := filepath.Join(dir, "sites")
+	fallback := filepath.Join(dir, "default")
+
+	// next is found like a file server finds files, so that a
+	// request without root is not found by it but goes through
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		f, err := httpserver.RequestFileSystem(r, http.Dir(dir)).Open("/")
+		if err != nil {
+			return http.StatusNotFound, nil
+		}
+		f.Close()
+		root, _ := httpserver.RequestRoot(r)
+		w.Write([]byte(root))
+		return http.StatusOK, nil
+	})
+
+	for i, test := range []struct {
+		fallback       string
+		host           string
+		expectedStatus int
+		expectedRoot   string
+	}{
+		{"", "example.com", http.StatusOK, filepath.Join(sites, "example.com", "public")},
+		{"", "EXAMPLE.com", http.StatusOK, filepath.Join(sites, "example.com", "public")},
+		{"", "other.com", http.StatusNotFound, ""},
+		{"", "..", http.StatusNotFound, ""},
+		{"", "../../public", http.StatusNotFound, ""},
+		{"", `..\public`, http.StatusNotFound, ""},
+		{fallback, "example.com", http.StatusOK, filepath.Join(sites, "example.com", "public")},
+		{fallback, "other.com", http.StatusOK, fallback},
+		{fallback, "..", http.StatusOK, fallback},
+	} {
+		c := caddy.NewTestController("http", fmt.Sprintf("root %s/sites/{host}/public {\nfallback %s\n}", dir, test.fallback))
+		if test.fallback == "" {
+			c = caddy.NewTestController("http", fmt.Sprintf("root %s/sites/{host}/public", dir))
+		}
+		if err := setupRoot(c); err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		status, _ := mids[0](next).ServeHTTP(w, r)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+		}
+		if got := filepath.Clean(w.Body.String()); test.expectedRoot != "" && got != test.expectedRoot {
+			t.Errorf("Test %d: Expected root %s, got %s", i, test.expectedRoot, got)
+		}
+	}
+}
+
+func TestRootParse(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"root /srv/{host}", false},
+		{"root /srv/{host} {\nfallback /srv/default\n}", false},
+		{"root /srv {\nfallback /srv/default\n}", true},
+		{"root /srv/{host} {\nfallback\n}", true},
+		{"root /srv/{host} {\nlowercase off\n}", true},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setupRoot(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+}
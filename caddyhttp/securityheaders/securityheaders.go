@@ -0,0 +1,104 @@
+// Package securityheaders provides middleware that adds a preset
+// of security headers to the responses of a site.
+package securityheaders
+
+import (
+	"net/http"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// The values of the headers that are sent by default.
+const (
+	DefaultHSTSMaxAge         = 31536000 // a year, in seconds
+	DefaultContentTypeOptions = "nosniff"
+	DefaultFrameOptions       = "SAMEORIGIN"
+	DefaultReferrerPolicy     = "strict-origin-when-cross-origin"
+	DefaultPermissionsPolicy  = "camera=(), geolocation=(), microphone=()"
+)
+
+// SecurityHeaders is middleware that adds security headers to the
+// responses, unless the handlers after it set them already.
+type SecurityHeaders struct {
+	Next httpserver.Handler
+
+	// HSTS is the value of Strict-Transport-Security, which is
+	// only sent over TLS; it is not sent if it is empty
+	HSTS string
+
+	// Headers are the rest of the headers that are sent
+	Headers []Header
+
+	// Force sets the headers even if the handlers after
+	// this one set them
+	Force bool
+}
+
+// Header is a single HTTP header, a name and value.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// ServeHTTP implements the httpserver.Handler interface. The headers
+// are set right before the response header is written, so that the
+// ones the handlers set, such as a proxied backend, are kept.
+func (s SecurityHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	headers := s.Headers
+	if s.HSTS != "" && r.TLS != nil {
+		headers = append([]Header{{Name: "Strict-Transport-Security", Value: s.HSTS}}, headers...)
+	}
+	sw := &securityHeaderWriter{ResponseWriterWrapper: httpserver.ResponseWriterWrapper{ResponseWriter: w}, headers: headers, force: s.Force}
+	rec := httpserver.NewResponseRecorder(sw)
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok {
+		rec.Replacer = rr.Replacer
+	}
+	status, err := s.Next.ServeHTTP(rec, r)
+
+	// a response that is left to be written, like an error
+	// page, is written by the middleware before this one
+	sw.setHeaders()
+	return status, err
+}
+
+// securityHeaderWriter sets its headers the first time
+// the response header is about to be written.
+type securityHeaderWriter struct {
+	httpserver.ResponseWriterWrapper
+	headers []Header
+	force   bool
+	done    bool
+}
+
+func (w *securityHeaderWriter) setHeaders() {
+	if w.done {
+		return
+	}
+	w.done = true
+	h := w.ResponseWriter.Header()
+	for _, header := range w.headers {
+		if w.force || h.Get(header.Name) == "" {
+			h.Set(header.Name, header.Value)
+		}
+	}
+}
+
+// WriteHeader sets the headers and writes the response header.
+func (w *securityHeaderWriter) WriteHeader(status int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write sets the headers if the response header
+// has not been written yet, and writes buf.
+func (w *securityHeaderWriter) Write(buf []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush implements http.Flusher. Flushing writes the
+// response header, so the headers are set first.
+func (w *securityHeaderWriter) Flush() {
+	w.setHeaders()
+	w.ResponseWriterWrapper.Flush()
+}
@@ -0,0 +1,116 @@
+package securityheaders
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	preset := SecurityHeaders{
+		HSTS: "max-age=31536000",
+		Headers: []Header{
+			{Name: "X-Content-Type-Options", Value: "nosniff"},
+			{Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+		},
+	}
+
+	for i, test := range []struct {
+		tls      bool
+		force    bool
+		handler  func(w http.ResponseWriter)
+		status   int // returned by the handler
+		expected map[string]string
+	}{
+		// over TLS, all of them are sent
+		{true, false, func(w http.ResponseWriter) { w.Write([]byte("ok")) }, 0, map[string]string{
+			"Strict-Transport-Security": "max-age=31536000",
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "SAMEORIGIN",
+		}},
+		// HSTS is not sent over plaintext
+		{false, false, func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) }, 0, map[string]string{
+			"Strict-Transport-Security": "",
+			"X-Content-Type-Options":    "nosniff",
+		}},
+		// the headers that the handler sets are kept
+		{true, false, func(w http.ResponseWriter) {
+			w.Header().Set("X-Frame-Options", "DENY")
+			w.Write([]byte("ok"))
+		}, 0, map[string]string{
+			"X-Frame-Options":        "DENY",
+			"X-Content-Type-Options": "nosniff",
+		}},
+		// unless they are forced
+		{true, true, func(w http.ResponseWriter) {
+			w.Header().Set("X-Frame-Options", "DENY")
+			w.Write([]byte("ok"))
+		}, 0, map[string]string{
+			"X-Frame-Options": "SAMEORIGIN",
+		}},
+		// a response that is left to the error handler has them too
+		{true, false, func(w http.ResponseWriter) {}, http.StatusNotFound, map[string]string{
+			"X-Content-Type-Options": "nosniff",
+		}},
+	} {
+		sh := preset
+		sh.Force = test.force
+		sh.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			test.handler(w)
+			return test.status, nil
+		})
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		status, err := sh.ServeHTTP(rec, r)
+		if err != nil || status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d (%v)", i, test.status, status, err)
+		}
+		for name, value := range test.expected {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("Test %d: Expected %s to be '%s', got '%s'", i, name, value, got)
+			}
+		}
+	}
+}
+
+func TestSecurityHeadersKeepProxiedCSP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / "+backend.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := SecurityHeaders{
+		Next: proxy.Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams},
+		Headers: []Header{
+			{Name: "Content-Security-Policy", Value: "frame-ancestors 'self'"},
+			{Name: "Referrer-Policy", Value: DefaultReferrerPolicy},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	if _, err := sh.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "default-src 'self'; frame-ancestors 'none'" {
+		t.Errorf("Expected the CSP of the backend to be kept, got '%s'", csp)
+	}
+	if policy := rec.Header().Get("Referrer-Policy"); policy != DefaultReferrerPolicy {
+		t.Errorf("Expected the Referrer-Policy the backend did not set, got '%s'", policy)
+	}
+	if rec.Body.String() != "backend" {
+		t.Errorf("Expected the body of the backend, got '%s'", rec.Body.String())
+	}
+}
@@ -0,0 +1,204 @@
+package securityheaders
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("security_headers", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new SecurityHeaders middleware instance.
+func setup(c *caddy.Controller) error {
+	preset, err := securityHeadersParse(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		// whether the site has TLS is only known once all of
+		// its directives are set up and its servers are made
+		sh := preset
+		if sh.HSTS != "" && !cfg.TLS.Enabled {
+			log.Printf("[WARNING] %s: security_headers: site has no TLS; not sending Strict-Transport-Security", cfg.Addr)
+			sh.HSTS = ""
+		}
+		sh.Next = next
+		return sh
+	})
+
+	return nil
+}
+
+// securityHeadersParse parses the security_headers directive,
+// which looks like:
+//
+//	security_headers {
+//	    hsts                 max_age [include_subdomains] [preload]
+//	    content_type_options value
+//	    frame_options        value
+//	    frame_ancestors      source...
+//	    referrer_policy      value
+//	    permissions_policy   value
+//	    force
+//	}
+//
+// Each header is sent with its default value unless its option
+// sets another one, or off, which does not send it. The max_age
+// of HSTS is in seconds or a duration. frame_ancestors sends the
+// frame-ancestors directive of Content-Security-Policy in place
+// of X-Frame-Options; its sources may be self and none, which are
+// quoted in the header.
+func securityHeadersParse(c *caddy.Controller) (SecurityHeaders, error) {
+	var sh SecurityHeaders
+	if !c.Next() {
+		return sh, c.ArgErr()
+	}
+	if len(c.RemainingArgs()) > 0 {
+		return sh, c.ArgErr()
+	}
+
+	hsts := strictTransportSecurity(DefaultHSTSMaxAge, false)
+	values := map[string]string{
+		"X-Content-Type-Options": DefaultContentTypeOptions,
+		"X-Frame-Options":        DefaultFrameOptions,
+		"Referrer-Policy":        DefaultReferrerPolicy,
+		"Permissions-Policy":     DefaultPermissionsPolicy,
+	}
+	var frameOptionsSet bool
+	var frameAncestors string
+
+	for c.NextBlock() {
+		option := c.Val()
+		args := c.RemainingArgs()
+		if option == "force" {
+			if len(args) > 0 {
+				return sh, c.ArgErr()
+			}
+			sh.Force = true
+			continue
+		}
+		if len(args) == 0 {
+			return sh, c.ArgErr()
+		}
+		value := strings.Join(args, " ")
+		if value == "off" {
+			value = ""
+		}
+		switch option {
+		case "hsts":
+			if value == "" {
+				hsts = ""
+				break
+			}
+			var err error
+			hsts, err = parseHSTS(args)
+			if err != nil {
+				return sh, c.Err(err.Error())
+			}
+		case "content_type_options":
+			values["X-Content-Type-Options"] = value
+		case "frame_options":
+			values["X-Frame-Options"] = value
+			frameOptionsSet = true
+		case "frame_ancestors":
+			if value == "" {
+				frameAncestors = ""
+				break
+			}
+			sources := make([]string, len(args))
+			for i, source := range args {
+				// the keywords are quoted in the header, but the
+				// quotes are taken off by the Caddyfile lexer
+				if source == "self" || source == "none" {
+					source = "'" + source + "'"
+				}
+				sources[i] = source
+			}
+			frameAncestors = strings.Join(sources, " ")
+		case "referrer_policy":
+			values["Referrer-Policy"] = value
+		case "permissions_policy":
+			values["Permissions-Policy"] = value
+		default:
+			return sh, c.Errf("Unknown security_headers option '%s'", option)
+		}
+	}
+	if frameAncestors != "" {
+		if frameOptionsSet {
+			return sh, c.Err("security_headers: frame_options and frame_ancestors cannot both be set")
+		}
+		values["X-Frame-Options"] = ""
+		values["Content-Security-Policy"] = "frame-ancestors " + frameAncestors
+	}
+	if c.Next() {
+		return sh, c.Err("security_headers can only be used once per site")
+	}
+
+	sh.HSTS = hsts
+	for _, name := range []string{
+		"X-Content-Type-Options",
+		"X-Frame-Options",
+		"Content-Security-Policy",
+		"Referrer-Policy",
+		"Permissions-Policy",
+	} {
+		if values[name] != "" {
+			sh.Headers = append(sh.Headers, Header{Name: name, Value: values[name]})
+		}
+	}
+	return sh, nil
+}
+
+// parseHSTS parses the arguments of the hsts option into the
+// value of Strict-Transport-Security.
+func parseHSTS(args []string) (string, error) {
+	var maxAge int64
+	if n, err := strconv.ParseInt(args[0], 10, 64); err == nil && n >= 0 {
+		maxAge = n
+	} else if d, err := time.ParseDuration(args[0]); err == nil && d >= 0 {
+		maxAge = int64(d / time.Second)
+	} else {
+		return "", fmt.Errorf("invalid hsts max_age '%s'", args[0])
+	}
+
+	var subdomains, preload bool
+	for _, arg := range args[1:] {
+		switch arg {
+		case "include_subdomains":
+			subdomains = true
+		case "preload":
+			preload = true
+		default:
+			return "", fmt.Errorf("unknown hsts flag '%s'; must be include_subdomains or preload", arg)
+		}
+	}
+	value := strictTransportSecurity(maxAge, subdomains)
+	if preload {
+		// the preload list only takes sites that meet its requirements
+		if !subdomains || maxAge < DefaultHSTSMaxAge {
+			return "", fmt.Errorf("hsts preload requires include_subdomains and a max_age of at least a year")
+		}
+		value += "; preload"
+	}
+	return value, nil
+}
+
+func strictTransportSecurity(maxAge int64, subdomains bool) string {
+	value := "max-age=" + strconv.FormatInt(maxAge, 10)
+	if subdomains {
+		value += "; includeSubDomains"
+	}
+	return value
+}
@@ -0,0 +1,132 @@
+package securityheaders
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `security_headers`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(SecurityHeaders)
+	if !ok {
+		t.Fatalf("Expected handler to be type SecurityHeaders, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestSetupHSTSOnlyWithTLS(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for i, enabled := range []bool{false, true} {
+		buf.Reset()
+		c := caddy.NewTestController("http", `security_headers`)
+		if err := setup(c); err != nil {
+			t.Fatalf("Test %d: Expected no errors, got: %v", i, err)
+		}
+		cfg := httpserver.GetConfig(c)
+		cfg.TLS.Enabled = enabled
+		handler := cfg.Middleware()[0](httpserver.EmptyNext).(SecurityHeaders)
+
+		warned := strings.Contains(buf.String(), "[WARNING]")
+		if enabled && (handler.HSTS != "max-age=31536000" || warned) {
+			t.Errorf("Test %d: Expected HSTS on a TLS site without a warning, got '%s' and log %q", i, handler.HSTS, buf.String())
+		}
+		if !enabled && (handler.HSTS != "" || !warned) {
+			t.Errorf("Test %d: Expected no HSTS on a plaintext site and a warning, got '%s' and log %q", i, handler.HSTS, buf.String())
+		}
+	}
+}
+
+func TestSecurityHeadersParse(t *testing.T) {
+	defaults := []Header{
+		{Name: "X-Content-Type-Options", Value: DefaultContentTypeOptions},
+		{Name: "X-Frame-Options", Value: DefaultFrameOptions},
+		{Name: "Referrer-Policy", Value: DefaultReferrerPolicy},
+		{Name: "Permissions-Policy", Value: DefaultPermissionsPolicy},
+	}
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  SecurityHeaders
+	}{
+		{`security_headers`, false, SecurityHeaders{HSTS: "max-age=31536000", Headers: defaults}},
+		{"security_headers {\n}", false, SecurityHeaders{HSTS: "max-age=31536000", Headers: defaults}},
+		{"security_headers {\nhsts 63072000 include_subdomains preload\nforce\n}", false, SecurityHeaders{
+			HSTS: "max-age=63072000; includeSubDomains; preload", Headers: defaults, Force: true,
+		}},
+		{"security_headers {\nhsts 24h\n}", false, SecurityHeaders{HSTS: "max-age=86400", Headers: defaults}},
+		{"security_headers {\nhsts off\ncontent_type_options off\nframe_options DENY\nreferrer_policy no-referrer\npermissions_policy \"camera=(), usb=()\"\n}", false, SecurityHeaders{
+			Headers: []Header{
+				{Name: "X-Frame-Options", Value: "DENY"},
+				{Name: "Referrer-Policy", Value: "no-referrer"},
+				{Name: "Permissions-Policy", Value: "camera=(), usb=()"},
+			},
+		}},
+		{"security_headers {\nframe_ancestors self https://partner.example.com\npermissions_policy off\n}", false, SecurityHeaders{
+			HSTS: "max-age=31536000",
+			Headers: []Header{
+				{Name: "X-Content-Type-Options", Value: DefaultContentTypeOptions},
+				{Name: "Content-Security-Policy", Value: "frame-ancestors 'self' https://partner.example.com"},
+				{Name: "Referrer-Policy", Value: DefaultReferrerPolicy},
+			},
+		}},
+		{`security_headers extra`, true, SecurityHeaders{}},
+		{"security_headers {\nhsts\n}", true, SecurityHeaders{}},
+		{"security_headers {\nhsts forever\n}", true, SecurityHeaders{}},
+		{"security_headers {\nhsts 31536000 sometimes\n}", true, SecurityHeaders{}},
+		{"security_headers {\nhsts 31536000 preload\n}", true, SecurityHeaders{}},
+		{"security_headers {\nhsts 600 include_subdomains preload\n}", true, SecurityHeaders{}},
+		{"security_headers {\nframe_ancestors none\n}", false, SecurityHeaders{
+			HSTS: "max-age=31536000",
+			Headers: []Header{
+				{Name: "X-Content-Type-Options", Value: DefaultContentTypeOptions},
+				{Name: "Content-Security-Policy", Value: "frame-ancestors 'none'"},
+				{Name: "Referrer-Policy", Value: DefaultReferrerPolicy},
+				{Name: "Permissions-Policy", Value: DefaultPermissionsPolicy},
+			},
+		}},
+		{"security_headers {\nframe_options DENY\nframe_ancestors none\n}", true, SecurityHeaders{}},
+		{"security_headers {\nreferrer_policy\n}", true, SecurityHeaders{}},
+		{"security_headers {\nforce yes\n}", true, SecurityHeaders{}},
+		{"security_headers {\nfoo bar\n}", true, SecurityHeaders{}},
+		{"security_headers\nsecurity_headers", true, SecurityHeaders{}},
+	}
+	for i, test := range tests {
+		actual, err := securityHeadersParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package signedurl
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"os"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// algos are the algorithms URLs can be signed with.
+var algos = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+func init() {
+	caddy.RegisterPlugin("signed_url", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new SignedURL middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := parse(c)
+	if err != nil {
+		return err
+	}
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return SignedURL{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+// parse parses the signed_url directives, each of which is
+//
+//	signed_url [path] {
+//	    secret_env   name...
+//	    expiry_param name
+//	    sig_param    name
+//	    algo         hmac-sha1|hmac-sha256|hmac-sha512
+//	}
+//
+// where secret_env, the environment variables that hold the
+// secrets, is required; the secrets cannot be in the Caddyfile.
+// More than one secret lets a new secret be rolled out while the
+// URLs signed with the old one are still valid.
+func parse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+	for c.Next() {
+		rule := Rule{
+			Path:        "/",
+			ExpiryParam: DefaultExpiryParam,
+			SigParam:    DefaultSigParam,
+			Hash:        algos[DefaultAlgo],
+		}
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Path = args[0]
+		default:
+			return nil, c.ArgErr()
+		}
+		for _, existing := range rules {
+			if existing.Path == rule.Path {
+				return nil, c.Errf("duplicate signed_url path '%s'", rule.Path)
+			}
+		}
+
+		var secretEnvs []string
+		for c.NextBlock() {
+			property := c.Val()
+			args := c.RemainingArgs()
+			if len(args) == 0 || (property != "secret_env" && len(args) != 1) {
+				return nil, c.ArgErr()
+			}
+			switch property {
+			case "secret_env":
+				secretEnvs = append(secretEnvs, args...)
+			case "secret":
+				return nil, c.Err("the signed_url secret must come from the environment; use secret_env")
+			case "expiry_param":
+				rule.ExpiryParam = args[0]
+			case "sig_param":
+				rule.SigParam = args[0]
+			case "algo":
+				h, ok := algos[args[0]]
+				if !ok {
+					return nil, c.Errf("unknown signed_url algo '%s'", args[0])
+				}
+				rule.Hash = h
+			default:
+				return nil, c.Errf("unknown signed_url property '%s'", property)
+			}
+		}
+		if len(secretEnvs) == 0 {
+			return nil, c.Err("signed_url needs secret_env")
+		}
+		for _, name := range secretEnvs {
+			secret := os.Getenv(name)
+			if secret == "" {
+				return nil, c.Errf("environment variable %s for the signed_url secret is not set", name)
+			}
+			rule.Secrets = append(rule.Secrets, []byte(secret))
+		}
+		if rule.ExpiryParam == rule.SigParam {
+			return nil, c.Err("signed_url expiry_param and sig_param must differ")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,59 @@
+package signedurl
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	os.Setenv("CADDY_TEST_DL_SECRET", "primary")
+	os.Setenv("CADDY_TEST_DL_SECRET_OLD", "secondary")
+	defer os.Unsetenv("CADDY_TEST_DL_SECRET")
+	defer os.Unsetenv("CADDY_TEST_DL_SECRET_OLD")
+
+	for i, test := range []struct {
+		input           string
+		shouldErr       bool
+		expectedRules   int
+		expectedSecrets int
+	}{
+		{"signed_url /downloads {\nsecret_env CADDY_TEST_DL_SECRET\n}", false, 1, 1},
+		{"signed_url {\nsecret_env CADDY_TEST_DL_SECRET CADDY_TEST_DL_SECRET_OLD\nexpiry_param e\nsig_param s\nalgo hmac-sha512\n}", false, 1, 2},
+		{"signed_url /a {\nsecret_env CADDY_TEST_DL_SECRET\nsecret_env CADDY_TEST_DL_SECRET_OLD\n}\nsigned_url /b {\nsecret_env CADDY_TEST_DL_SECRET\n}", false, 2, 2},
+		{`signed_url /downloads`, true, 0, 0},
+		{"signed_url /downloads {\nsecret abc\n}", true, 0, 0},
+		{"signed_url /downloads {\nsecret_env CADDY_TEST_DL_SECRET_UNSET\n}", true, 0, 0},
+		{"signed_url /a /b {\nsecret_env CADDY_TEST_DL_SECRET\n}", true, 0, 0},
+		{"signed_url {\nsecret_env CADDY_TEST_DL_SECRET\nalgo md5\n}", true, 0, 0},
+		{"signed_url {\nsecret_env CADDY_TEST_DL_SECRET\nsig_param p\nexpiry_param p\n}", true, 0, 0},
+		{"signed_url {\nsecret_env CADDY_TEST_DL_SECRET\nsig_param a b\n}", true, 0, 0},
+		{"signed_url {\nsecret_env CADDY_TEST_DL_SECRET\nfoo bar\n}", true, 0, 0},
+		{"signed_url /a {\nsecret_env CADDY_TEST_DL_SECRET\n}\nsigned_url /a {\nsecret_env CADDY_TEST_DL_SECRET\n}", true, 0, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		handler := mids[0](httpserver.EmptyNext).(SignedURL)
+		if len(handler.Rules) != test.expectedRules {
+			t.Errorf("Test %d: Expected %d rules, got %d", i, test.expectedRules, len(handler.Rules))
+		} else if got := len(handler.Rules[0].Secrets); got != test.expectedSecrets {
+			t.Errorf("Test %d: Expected %d secrets, got %d", i, test.expectedSecrets, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package signedurl is middleware that only lets through requests
+// whose URL is signed with a shared secret and has not expired, so
+// that an application can hand out links to protected files that
+// are checked without asking the application.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Defaults for rules.
+const (
+	DefaultExpiryParam = "exp"
+	DefaultSigParam    = "sig"
+	DefaultAlgo        = "hmac-sha256"
+)
+
+// SignedURL is middleware that checks the signature of the URL of
+// the requests that match one of its rules, and answers 403 if the
+// signature is not valid for any of the secrets of the rule, or if
+// the URL has expired.
+type SignedURL struct {
+	Next  httpserver.Handler
+	Rules []Rule
+	now   func() time.Time
+}
+
+// Rule is the signing of the URLs with a path.
+//
+// The signature is the HMAC, with one of the secrets, of the path
+// as the request has it once percent-decoded, followed by '?' and
+// the parameters of the query except the signature, sorted by name
+// and encoded as by url.Values.Encode. The expiry parameter, which
+// is required, is the time the URL expires, in Unix seconds. The
+// signature is given in hex or in base64, either standard or URL
+// encoding, with or without the padding.
+type Rule struct {
+	Path        string
+	Secrets     [][]byte // tried in order, for rotation
+	ExpiryParam string
+	SigParam    string
+	Hash        func() hash.Hash
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (s SignedURL) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule, ok := s.match(r)
+	if !ok {
+		return s.Next.ServeHTTP(w, r)
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	if !rule.valid(r, now()) {
+		return http.StatusForbidden, nil
+	}
+
+	// the handlers after this one do not need to know
+	r.URL.RawQuery = stripParams(r.URL.RawQuery, rule.ExpiryParam, rule.SigParam)
+	return s.Next.ServeHTTP(w, r)
+}
+
+// match returns the rule with the longest path that matches r.
+func (s SignedURL) match(r *http.Request) (Rule, bool) {
+	var rule Rule
+	var found bool
+	for _, candidate := range s.Rules {
+		if !httpserver.Path(r.URL.Path).Matches(candidate.Path) {
+			continue
+		}
+		if !found || len(candidate.Path) > len(rule.Path) {
+			rule, found = candidate, true
+		}
+	}
+	return rule, found
+}
+
+// valid returns true if the URL of r has not expired at now,
+// and is signed with one of the secrets of rule.
+func (rule Rule) valid(r *http.Request, now time.Time) bool {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return false
+	}
+	sigs, exps := query[rule.SigParam], query[rule.ExpiryParam]
+	if len(sigs) != 1 || len(exps) != 1 {
+		return false
+	}
+	exp, err := strconv.ParseInt(exps[0], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+	sig, ok := decodeSignature(sigs[0], rule.Hash().Size())
+	if !ok {
+		return false
+	}
+
+	delete(query, rule.SigParam)
+	message := []byte(r.URL.Path + "?" + query.Encode())
+	valid := false
+	for _, secret := range rule.Secrets {
+		mac := hmac.New(rule.Hash, secret)
+		mac.Write(message)
+		// every secret is tried, so that the time taken
+		// does not tell which one matched
+		if hmac.Equal(mac.Sum(nil), sig) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// decodeSignature decodes sig, which is of size bytes, from hex
+// or base64. A '+' of base64 that was not percent-encoded in the
+// query has been decoded as a space, so spaces are taken as '+'.
+func decodeSignature(sig string, size int) ([]byte, bool) {
+	if len(sig) == 2*size {
+		b, err := hex.DecodeString(sig)
+		return b, err == nil
+	}
+	sig = strings.TrimRight(strings.Replace(sig, " ", "+", -1), "=")
+	if b, err := base64.RawURLEncoding.DecodeString(sig); err == nil {
+		return b, true
+	}
+	if b, err := base64.RawStdEncoding.DecodeString(sig); err == nil {
+		return b, true
+	}
+	return nil, false
+}
+
+// stripParams removes the parameters named names from rawQuery,
+// leaving the other parameters as they are.
+func stripParams(rawQuery string, names ...string) string {
+	var kept []string
+outer:
+	for _, param := range strings.Split(rawQuery, "&") {
+		key := param
+		if i := strings.IndexByte(key, '='); i >= 0 {
+			key = key[:i]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		for _, name := range names {
+			if key == name {
+				continue outer
+			}
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
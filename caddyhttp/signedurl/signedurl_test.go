@@ -0,0 +1,123 @@
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// sign returns the URL of path with query, signed with secret and
+// with the signature, encoded with encode, appended.
+func sign(secret, path string, query url.Values, encode func([]byte) string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "?" + query.Encode()))
+	u := url.URL{Path: path, RawQuery: query.Encode() + "&sig=" + url.QueryEscape(encode(mac.Sum(nil)))}
+	return u.String()
+}
+
+func TestSignedURL(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	exp := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(now.Add(-time.Second).Unix(), 10)
+
+	var gotQuery string
+	s := SignedURL{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			gotQuery = r.URL.RawQuery
+			return http.StatusOK, nil
+		}),
+		Rules: []Rule{{
+			Path:        "/downloads",
+			Secrets:     [][]byte{[]byte("primary"), []byte("secondary")},
+			ExpiryParam: DefaultExpiryParam,
+			SigParam:    DefaultSigParam,
+			Hash:        sha256.New,
+		}},
+		now: func() time.Time { return now },
+	}
+
+	values := url.Values{"exp": {exp}, "user": {"42"}}
+	valid := sign("primary", "/downloads/report.pdf", values, hex.EncodeToString)
+	for i, test := range []struct {
+		url            string
+		expectedStatus int
+		expectedQuery  string
+	}{
+		{valid, http.StatusOK, "user=42"},
+		{sign("secondary", "/downloads/report.pdf", values, hex.EncodeToString), http.StatusOK, "user=42"},
+		{sign("primary", "/downloads/report.pdf", values, base64.StdEncoding.EncodeToString), http.StatusOK, "user=42"},
+		{sign("primary", "/downloads/report.pdf", values, base64.RawURLEncoding.EncodeToString), http.StatusOK, "user=42"},
+		{sign("primary", "/downloads/a b.pdf", values, hex.EncodeToString), http.StatusOK, "user=42"},
+		{sign("primary", "/downloads/report.pdf", url.Values{"exp": {exp}}, hex.EncodeToString), http.StatusOK, ""},
+
+		// expired, tampered, or signed with another secret
+		{sign("primary", "/downloads/report.pdf", url.Values{"exp": {expired}}, hex.EncodeToString), http.StatusForbidden, ""},
+		{sign("other", "/downloads/report.pdf", values, hex.EncodeToString), http.StatusForbidden, ""},
+		{valid + "&user=43", http.StatusForbidden, ""},
+		{"/downloads/other.pdf" + valid[len("/downloads/report.pdf"):], http.StatusForbidden, ""},
+		{"/downloads/report.pdf?user=42&exp=" + exp, http.StatusForbidden, ""},
+		{"/downloads/report.pdf?user=42&sig=abc", http.StatusForbidden, ""},
+		{valid + "&sig=abc", http.StatusForbidden, ""},
+		{"/downloads/report.pdf?exp=soon&sig=abc", http.StatusForbidden, ""},
+
+		// other paths need no signature
+		{"/public/index.html?a=b", http.StatusOK, "a=b"},
+	} {
+		r := httptest.NewRequest("GET", test.url, nil)
+		gotQuery = ""
+		status, err := s.ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d for %s, got %d", i, test.expectedStatus, test.url, status)
+			continue
+		}
+		if status == http.StatusOK && gotQuery != test.expectedQuery {
+			t.Errorf("Test %d: Expected query '%s' for the next handler, got '%s'", i, test.expectedQuery, gotQuery)
+		}
+	}
+}
+
+func TestSignatureWithUnescapedPlus(t *testing.T) {
+	// find a signature that has a '+'
+	var exp, sig string
+	for t := time.Now().Add(time.Hour).Unix(); !strings.Contains(sig, "+"); t++ {
+		exp = strconv.FormatInt(t, 10)
+		mac := hmac.New(sha256.New, []byte("primary"))
+		mac.Write([]byte("/f?exp=" + exp))
+		sig = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	// a '+' that was not percent-encoded is decoded as a space
+	r := httptest.NewRequest("GET", "/f?exp="+exp+"&sig="+sig, nil)
+	rule := Rule{Secrets: [][]byte{[]byte("primary")}, ExpiryParam: "exp", SigParam: "sig", Hash: sha256.New}
+	if !rule.valid(r, time.Now()) {
+		t.Errorf("Expected signature %s to be valid in query %s", sig, r.URL.RawQuery)
+	}
+}
+
+func TestStripParams(t *testing.T) {
+	for i, test := range []struct {
+		input, expected string
+	}{
+		{"a=1&exp=2&sig=3", "a=1"},
+		{"sig=3&b=%20x&exp=2&c", "b=%20x&c"},
+		{"%73ig=3&a=1", "a=1"},
+		{"exp=2&sig=3", ""},
+	} {
+		if got := stripParams(test.input, "exp", "sig"); got != test.expected {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expected, got)
+		}
+	}
+}
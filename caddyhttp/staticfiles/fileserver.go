@@ -1,6 +1,7 @@
 package staticfiles
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -29,6 +30,10 @@ type FileServer struct {
 
 	// List of files to treat as "Not Found"
 	Hide []string
+
+	// Returns the index pages of the directory at a
+	// path; if nil, IndexPages are used everywhere
+	IndexPages func(urlPath string) []string
 }
 
 // ServeHTTP serves static files for r according to fs's configuration.
@@ -65,15 +70,18 @@ func (fs FileServer) serveFile(w http.ResponseWriter, r *http.Request, name stri
 	}
 	defer f.Close()
 
-	d, err := f.Stat()
-	if err != nil {
-		if os.IsNotExist(err) {
-			return http.StatusNotFound, nil
-		} else if os.IsPermission(err) {
-			return http.StatusForbidden, err
+	d, known := knownFileInfo(r, name)
+	if !known {
+		d, err = f.Stat()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return http.StatusNotFound, nil
+			} else if os.IsPermission(err) {
+				return http.StatusForbidden, err
+			}
+			// Return a different status code than above so as to distinguish these cases
+			return http.StatusInternalServerError, err
 		}
-		// Return a different status code than above so as to distinguish these cases
-		return http.StatusInternalServerError, err
 	}
 
 	// redirect to canonical path
@@ -93,8 +101,12 @@ func (fs FileServer) serveFile(w http.ResponseWriter, r *http.Request, name stri
 	}
 
 	// use contents of an index file, if present, for directory
+	indexPages := IndexPages
+	if fs.IndexPages != nil {
+		indexPages = fs.IndexPages(name)
+	}
 	if d.IsDir() {
-		for _, indexPage := range IndexPages {
+		for _, indexPage := range indexPages {
 			index := strings.TrimSuffix(name, "/") + "/" + indexPage
 			ff, err := fs.Root.Open(index)
 			if err == nil {
@@ -113,8 +125,12 @@ func (fs FileServer) serveFile(w http.ResponseWriter, r *http.Request, name stri
 	}
 
 	// Still a directory? (we didn't find an index file)
-	// Return 404 to hide the fact that the folder exists
+	// Return 404 to hide the fact that the folder exists,
+	// unless the directory is known to have no index
 	if d.IsDir() {
+		if len(indexPages) == 0 {
+			return http.StatusForbidden, nil
+		}
 		return http.StatusNotFound, nil
 	}
 
@@ -133,6 +149,35 @@ func (fs FileServer) serveFile(w http.ResponseWriter, r *http.Request, name stri
 	return http.StatusOK, nil
 }
 
+// knownFileKey is the context key of the knownFile of a request.
+type knownFileKey struct{}
+
+// knownFile is a file that was looked at before the
+// request got to the file server.
+type knownFile struct {
+	name string
+	info os.FileInfo
+}
+
+// WithFileInfo returns a shallow copy of r that carries info
+// as what is known about the file at name, so that the file
+// server does not need to stat the file again when it serves
+// it. Middleware that checks whether a file exists before it
+// passes r on can use this.
+func WithFileInfo(r *http.Request, name string, info os.FileInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), knownFileKey{}, knownFile{name: name, info: info}))
+}
+
+// knownFileInfo returns what is known about the file at
+// name for r, if it was given with WithFileInfo.
+func knownFileInfo(r *http.Request, name string) (os.FileInfo, bool) {
+	known, ok := r.Context().Value(knownFileKey{}).(knownFile)
+	if !ok || known.name != name {
+		return nil, false
+	}
+	return known.info, true
+}
+
 // isHidden checks if file with FileInfo d is on hide list.
 func (fs FileServer) isHidden(d os.FileInfo) bool {
 	// If the file is supposed to be hidden, return a 404
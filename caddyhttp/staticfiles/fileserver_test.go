@@ -30,12 +30,20 @@ var (
 // '---- dir/
 // '------ file2.html
 // '------ hidden.html
+// '---- docs/
+// '------ README.html
+// '------ index.html
+// '------ api/
+// '-------- index.html
 var testFiles = map[string]string{
 	"unreachable.html":                                     "<h1>must not leak</h1>",
 	filepath.Join("webroot", "file1.html"):                 "<h1>file1.html</h1>",
 	filepath.Join("webroot", "dirwithindex", "index.html"): "<h1>dirwithindex/index.html</h1>",
 	filepath.Join("webroot", "dir", "file2.html"):          "<h1>dir/file2.html</h1>",
 	filepath.Join("webroot", "dir", "hidden.html"):         "<h1>dir/hidden.html</h1>",
+	filepath.Join("webroot", "docs", "README.html"):        "<h1>docs/README.html</h1>",
+	filepath.Join("webroot", "docs", "index.html"):         "<h1>docs/index.html</h1>",
+	filepath.Join("webroot", "docs", "api", "index.html"):  "<h1>docs/api/index.html</h1>",
 }
 
 // TestServeHTTP covers positive scenarios when serving files.
@@ -193,6 +201,50 @@ func TestServeHTTP(t *testing.T) {
 
 }
 
+func TestServeHTTPIndexPages(t *testing.T) {
+	beforeServeHTTPTest(t)
+	defer afterServeHTTPTest(t)
+
+	fileserver := FileServer{
+		Root: http.Dir(testWebRoot),
+		IndexPages: func(urlPath string) []string {
+			switch {
+			case strings.HasPrefix(urlPath, "/docs/api"):
+				return nil
+			case strings.HasPrefix(urlPath, "/docs"):
+				return []string{"README.html", "index.html"}
+			}
+			return IndexPages
+		},
+	}
+
+	for i, test := range []struct {
+		url                 string
+		expectedStatus      int
+		expectedBodyContent string
+	}{
+		{"https://foo/docs/", http.StatusOK, testFiles[filepath.Join("webroot", "docs", "README.html")]},
+		{"https://foo/docs/index.html", http.StatusOK, testFiles[filepath.Join("webroot", "docs", "index.html")]},
+		{"https://foo/docs/api/", http.StatusForbidden, ""},
+		{"https://foo/docs/api/index.html", http.StatusOK, testFiles[filepath.Join("webroot", "docs", "api", "index.html")]},
+		{"https://foo/dirwithindex/", http.StatusOK, testFiles[filepath.Join("webroot", "dirwithindex", "index.html")]},
+		{"https://foo/dir/", http.StatusNotFound, ""},
+	} {
+		responseRecorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Error making request: %v", i, err)
+		}
+		status, _ := fileserver.ServeHTTP(responseRecorder, request)
+		if status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, found %d", i, test.expectedStatus, status)
+		}
+		if !strings.Contains(responseRecorder.Body.String(), test.expectedBodyContent) {
+			t.Errorf("Test %d: Expected body to contain %q, found %q", i, test.expectedBodyContent, responseRecorder.Body.String())
+		}
+	}
+}
+
 // beforeServeHTTPTest creates a test directory with the structure, defined in the variable testFiles
 func beforeServeHTTPTest(t *testing.T) {
 	// make the root test dir
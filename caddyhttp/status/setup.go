@@ -0,0 +1,140 @@
+package status
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("status", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Status middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := statusParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Status{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// statusParse parses status directives, which look like:
+//
+//	status code [path] {
+//	    methods      method...
+//	    allow        method...
+//	    if           a cond b
+//	    if_op        and|or
+//	    body         text
+//	    content_type type
+//	    retry_after  seconds|duration
+//	}
+//
+// The path defaults to /. The rules are tried in the order they
+// are declared, and the first one that matches the request wins.
+func statusParse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return nil, c.ArgErr()
+		}
+		status, err := strconv.Atoi(args[0])
+		if err != nil || status < 200 || status > 599 {
+			return nil, c.Errf("Invalid status '%s'; must be a code from 200 to 599", args[0])
+		}
+		rule := Rule{Status: status, Path: "/"}
+		if len(args) > 1 {
+			if !strings.HasPrefix(args[1], "/") {
+				return nil, c.Errf("Invalid path '%s'; must begin with /", args[1])
+			}
+			rule.Path = args[1]
+		}
+
+		matcher, err := httpserver.SetupIfMatcher(c)
+		if err != nil {
+			return nil, err
+		}
+		for c.NextBlock() {
+			if httpserver.IfMatcherKeyword(c) {
+				rule.Matcher = matcher
+				continue
+			}
+			switch c.Val() {
+			case "methods", "allow":
+				option := c.Val()
+				methods := c.RemainingArgs()
+				if len(methods) == 0 {
+					return nil, c.ArgErr()
+				}
+				for i := range methods {
+					methods[i] = strings.ToUpper(methods[i])
+				}
+				if option == "methods" {
+					rule.Methods = methods
+				} else {
+					rule.Allow = methods
+				}
+				continue
+			case "body":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.Body = c.Val()
+			case "content_type":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rule.ContentType = c.Val()
+			case "retry_after":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+					return nil, c.Errf("retry_after is only for status 429 and 503, not %d", status)
+				}
+				seconds, err := strconv.Atoi(c.Val())
+				if err != nil {
+					d, derr := time.ParseDuration(c.Val())
+					if derr != nil {
+						return nil, c.Errf("Invalid retry_after '%s'; must be seconds or a duration", c.Val())
+					}
+					seconds = int(d / time.Second)
+				}
+				if seconds <= 0 {
+					return nil, c.Errf("Invalid retry_after '%s'; must be at least a second", c.Val())
+				}
+				rule.RetryAfter = seconds
+			default:
+				return nil, c.Errf("Unknown status option '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		}
+
+		if len(rule.Methods) > 0 && len(rule.Allow) > 0 {
+			return nil, c.Err("A status rule cannot have both methods and allow")
+		}
+		if rule.Body != "" && (rule.Status == http.StatusNoContent || rule.Status == http.StatusNotModified) {
+			return nil, c.Errf("A response with status %d cannot have a body", rule.Status)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,93 @@
+package status
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `status 410 /gone`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Status)
+	if !ok {
+		t.Fatalf("Expected handler to be type Status, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestStatusParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{`status 410 /gone`, false, []Rule{{Status: 410, Path: "/gone"}}},
+		{`status 503`, false, []Rule{{Status: 503, Path: "/"}}},
+		{"status 405 /static {\nallow get HEAD\n}", false, []Rule{{Status: 405, Path: "/static", Allow: []string{"GET", "HEAD"}}}},
+		{"status 429 /api/* {\nmethods POST\nretry_after 30\nbody \"slow down\"\ncontent_type text/plain\n}", false, []Rule{{
+			Status: 429, Path: "/api/*", Methods: []string{"POST"}, RetryAfter: 30, Body: "slow down", ContentType: "text/plain",
+		}}},
+		{"status 503 {\nretry_after 1h\n}\nstatus 404 /a", false, []Rule{
+			{Status: 503, Path: "/", RetryAfter: 3600},
+			{Status: 404, Path: "/a"},
+		}},
+		{`status`, true, nil},
+		{`status /gone`, true, nil},
+		{`status 410 gone`, true, nil},
+		{`status 410 /a /b`, true, nil},
+		{`status 700 /a`, true, nil},
+		{"status 404 {\nretry_after 30\n}", true, nil},
+		{"status 503 {\nretry_after soon\n}", true, nil},
+		{"status 503 {\nretry_after 0\n}", true, nil},
+		{"status 405 {\nmethods POST\nallow GET\n}", true, nil},
+		{"status 405 {\nallow\n}", true, nil},
+		{"status 204 {\nbody nothing\n}", true, nil},
+		{"status 410 {\nbody a b\n}", true, nil},
+		{"status 410 {\nfoo bar\n}", true, nil},
+		{"status 418 {\nif {path} is\n}", true, nil},
+	}
+	for i, test := range tests {
+		actual, err := statusParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestStatusParseCondition(t *testing.T) {
+	rules, err := statusParse(caddy.NewTestController("http", "status 418 {\nif {method} is BREW\nif {path} is /pot\nif_op or\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Matcher == nil {
+		t.Fatalf("Expected a rule with a condition, got %#v", rules)
+	}
+	if _, ok := rules[0].Matcher.(httpserver.IfMatcher); !ok {
+		t.Errorf("Expected the condition to be an if matcher, got %#v", rules[0].Matcher)
+	}
+}
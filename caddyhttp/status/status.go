@@ -0,0 +1,138 @@
+// Package status serves fixed status codes for requests that
+// match rules of path, method and conditions, before they reach
+// the handlers that would otherwise serve them.
+package status
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/respond"
+)
+
+// Status is a middleware that answers the requests that match
+// one of its rules with the status of that rule.
+type Status struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is a status to answer the requests it matches with.
+type Rule struct {
+	// Status is the status code of the response
+	Status int
+
+	// Path is the path the rule applies to, which
+	// matches the paths it is a prefix of; if it has
+	// a *, it is a pattern instead (see MatchPattern)
+	Path string
+
+	// Methods, if not empty, are the only methods
+	// the rule applies to
+	Methods []string
+
+	// Allow, if not empty, are the methods the rule
+	// does not apply to; they are sent in the Allow
+	// header of the response if its status is 405
+	Allow []string
+
+	// Matcher, if not nil, is the condition the
+	// request must meet as well
+	Matcher httpserver.RequestMatcher
+
+	// Body is the response body, which may contain
+	// placeholders; if empty, the response has no body,
+	// or the error page for Status if it is an error
+	Body string
+
+	// ContentType is the Content-Type of Body; if empty,
+	// respond.DefaultContentType is used
+	ContentType string
+
+	// RetryAfter, if not zero, is the number of
+	// seconds sent in the Retry-After header
+	RetryAfter int
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (s Status) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := s.match(r)
+	if rule == nil {
+		return s.Next.ServeHTTP(w, r)
+	}
+
+	if rule.Status == http.StatusMethodNotAllowed && len(rule.Allow) > 0 {
+		w.Header().Set("Allow", strings.Join(rule.Allow, ", "))
+	}
+	if rule.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(rule.RetryAfter))
+	}
+	return respond.Serve(w, r, rule.Status, rule.Body, rule.ContentType)
+}
+
+// match returns the first rule that matches r,
+// or nil if there is none.
+func (s Status) match(r *http.Request) *Rule {
+	for i := range s.Rules {
+		if s.Rules[i].matches(r) {
+			return &s.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	if !MatchPattern(rule.Path, r.URL.Path) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !hasMethod(rule.Methods, r.Method) {
+		return false
+	}
+	if len(rule.Allow) > 0 && hasMethod(rule.Allow, r.Method) {
+		return false
+	}
+	return rule.Matcher == nil || rule.Matcher.Match(r)
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPattern returns whether the request path p matches pattern.
+// A pattern without a * matches the paths it is a prefix of, like
+// the paths of other directives do. In a pattern with a *, each *
+// matches any part of one path segment, except that a final /*
+// matches anything below the directory before it, so /v1/* matches
+// /v1/users/42 but not /v1 itself.
+func MatchPattern(pattern, p string) bool {
+	if !strings.Contains(pattern, "*") {
+		return httpserver.Path(p).Matches(pattern)
+	}
+	if !httpserver.CaseSensitivePath {
+		pattern, p = strings.ToLower(pattern), strings.ToLower(p)
+	}
+	if dir := strings.TrimSuffix(pattern, "/*"); dir != pattern {
+		// compare the directory with as many segments of p
+		segments := strings.Count(dir, "/")
+		end := 0
+		for i := 0; i < segments; i++ {
+			next := strings.Index(p[end+1:], "/")
+			if next < 0 {
+				return false
+			}
+			end += next + 1
+		}
+		p = p[:end]
+		pattern = dir
+	}
+	ok, err := path.Match(pattern, p)
+	return ok && err == nil
+}
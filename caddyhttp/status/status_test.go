@@ -0,0 +1,135 @@
+package status
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestStatus(t *testing.T) {
+	rules, err := statusParse(caddy.NewTestController("http", `
+		status 405 /static {
+			allow GET HEAD
+		}
+		status 410 /v1/* {
+			body "{\"error\": \"{path} is retired\"}"
+			content_type application/json
+		}
+		status 418 {
+			if {>User-Agent} has teapot
+		}
+		status 503 /admin {
+			methods POST
+			retry_after 2m
+		}
+		status 404 /admin
+		status 204 /v1/health`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Status{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("next"))
+			return 0, nil
+		}),
+		Rules: rules,
+	}
+
+	for i, test := range []struct {
+		method, path, userAgent string
+		status                  int // returned status
+		code                    int // status written
+		body                    string
+		headers                 map[string]string
+	}{
+		// the method filter
+		{"GET", "/static/app.js", "", 0, 200, "next", nil},
+		{"HEAD", "/static/app.js", "", 0, 200, "next", nil},
+		{"POST", "/static/app.js", "", 405, 200, "", map[string]string{"Allow": "GET, HEAD"}},
+		{"DELETE", "/static", "", 405, 200, "", map[string]string{"Allow": "GET, HEAD"}},
+		{"POST", "/admin", "", 503, 200, "", map[string]string{"Retry-After": "120"}},
+
+		// the wildcard with a body
+		{"GET", "/v1/users/42", "", 0, 410, `{"error": "/v1/users/42 is retired"}`, map[string]string{
+			"Content-Type": "application/json",
+		}},
+		{"HEAD", "/v1/users/42", "", 0, 410, "", nil},
+		{"GET", "/v1", "", 0, 200, "next", nil},
+		{"GET", "/v10/users", "", 0, 200, "next", nil},
+
+		// the conditional rule
+		{"GET", "/brew", "the teapot/1.0", 418, 200, "", nil},
+		{"GET", "/brew", "curl/7.50", 0, 200, "next", nil},
+
+		// the first rule that matches wins over the later ones
+		{"GET", "/v1/health", "", 0, 410, `{"error": "/v1/health is retired"}`, nil},
+		{"GET", "/v1/health", "teapot", 0, 410, `{"error": "/v1/health is retired"}`, nil},
+		{"POST", "/admin", "teapot", 418, 200, "", map[string]string{"Retry-After": ""}},
+		{"GET", "/admin", "", 404, 200, "", map[string]string{"Retry-After": ""}},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.userAgent != "" {
+			r.Header.Set("User-Agent", test.userAgent)
+		}
+		rec := httptest.NewRecorder()
+		status, err := s.ServeHTTP(rec, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected returned status %d, got %d", i, test.status, status)
+		}
+		if rec.Code != test.code {
+			t.Errorf("Test %d: Expected status %d to be written, got %d", i, test.code, rec.Code)
+		}
+		if got := rec.Body.String(); got != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, got)
+		}
+		for name, value := range test.headers {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("Test %d: Expected %s to be %q, got %q", i, name, value, got)
+			}
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for i, test := range []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"/static", "/static/app.js", true},
+		{"/static", "/staticfiles", true},
+		{"/static", "/", false},
+		{"/v1/*", "/v1/users", true},
+		{"/v1/*", "/v1/users/42", true},
+		{"/v1/*", "/v1/", true},
+		{"/v1/*", "/v1", false},
+		{"/v1/*", "/v10/users", false},
+		{"/*", "/anything/at/all", true},
+		{"/api/*/v1/*", "/api/billing/v1/invoices", true},
+		{"/api/*/v1/*", "/api/billing/v2/invoices", false},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/wp/index.php", false},
+	} {
+		if got := MatchPattern(test.pattern, test.path); got != test.expected {
+			t.Errorf("Test %d: Expected %s matching %s to be %v, got %v", i, test.pattern, test.path, test.expected, got)
+		}
+	}
+}
+
+func TestStatusBeforeBackends(t *testing.T) {
+	directives := caddy.ValidDirectives("http")
+	indexes := make(map[string]int)
+	for i, dir := range directives {
+		indexes[dir] = i
+	}
+	for _, later := range []string{"proxy", "fastcgi", "browse"} {
+		if indexes["status"] >= indexes[later] {
+			t.Errorf("Expected status to come before %s, got directives %v", later, directives)
+		}
+	}
+}
@@ -15,6 +15,12 @@ import (
 
 // ServeHTTP implements the httpserver.Handler interface.
 func (t Templates) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if root, ok := httpserver.RequestRoot(r); ok {
+		if root == "" {
+			return t.Next.ServeHTTP(w, r)
+		}
+		t.Root, t.FileSys = root, http.Dir(root)
+	}
 	for _, rule := range t.Rules {
 		if !httpserver.Path(r.URL.Path).Matches(rule.Path) {
 			continue
@@ -0,0 +1,82 @@
+// Package trace configures the tracing of the time that
+// each middleware of a site takes to serve a request.
+package trace
+
+import (
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("trace", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+		Redact:     redact,
+	})
+}
+
+// redact hides the token of a trace line.
+func redact(d *caddy.DirectiveExport) {
+	if len(d.Args) >= 2 && d.Args[0] == "token" {
+		d.Args[1] = caddy.Redacted
+	}
+}
+
+// setup configures the tracing of a site, which either traces
+// every request or, with a token, only the requests that have
+// it in the httpserver.TraceHeader:
+//
+//	trace on|off|token TOKEN {
+//	    slow DURATION
+//	}
+//
+// With slow, traced requests that take longer are logged.
+func setup(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		trace := httpserver.TraceConfig{}
+		switch c.Val() {
+		case "on":
+			trace.Always = true
+		case "off":
+		case "token":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			trace.Token = c.Val()
+		default:
+			return c.Errf("Unknown trace value '%s'; must be on, off or token", c.Val())
+		}
+		if len(c.RemainingArgs()) > 0 {
+			return c.ArgErr()
+		}
+		for c.NextBlock() {
+			switch c.Val() {
+			case "slow":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				threshold, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return c.Errf("Invalid slow duration '%s': %v", c.Val(), err)
+				}
+				if threshold <= 0 {
+					return c.Errf("The slow duration must be positive, not %s", c.Val())
+				}
+				trace.Threshold = threshold
+				if c.NextArg() {
+					return c.ArgErr()
+				}
+			default:
+				return c.ArgErr()
+			}
+		}
+		config.Trace = trace
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package trace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  httpserver.TraceConfig
+	}{
+		{`trace on`, false, httpserver.TraceConfig{Always: true}},
+		{`trace off`, false, httpserver.TraceConfig{}},
+		{`trace token s3cret`, false, httpserver.TraceConfig{Token: "s3cret"}},
+		{"trace on {\n\tslow 500ms\n}", false, httpserver.TraceConfig{Always: true, Threshold: 500 * time.Millisecond}},
+		{"trace token s3cret {\n\tslow 2s\n}", false, httpserver.TraceConfig{Token: "s3cret", Threshold: 2 * time.Second}},
+		{`trace`, true, httpserver.TraceConfig{}},
+		{`trace yes`, true, httpserver.TraceConfig{}},
+		{`trace token`, true, httpserver.TraceConfig{}},
+		{`trace on off`, true, httpserver.TraceConfig{}},
+		{"trace on {\n\tslow\n}", true, httpserver.TraceConfig{}},
+		{"trace on {\n\tslow soon\n}", true, httpserver.TraceConfig{}},
+		{"trace on {\n\tslow -1s\n}", true, httpserver.TraceConfig{}},
+		{"trace on {\n\tfast 1s\n}", true, httpserver.TraceConfig{}},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if got := httpserver.GetConfig(c).Trace; got != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package traffic
+
+import (
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("traffic", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+	caddy.RegisterPlugin("traffic_log", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupLog,
+	})
+}
+
+// setup configures the counting of the traffic of the site:
+//
+//	traffic
+func setup(c *caddy.Controller) error {
+	found := false
+	for c.Next() {
+		if found {
+			return c.Err("traffic can only be specified once")
+		}
+		if c.NextArg() || c.NextBlock() {
+			return c.ArgErr()
+		}
+		found = true
+	}
+
+	cfg := httpserver.GetConfig(c)
+	t := register(cfg)
+	c.OnShutdown(func() error {
+		unregister(cfg, t)
+		return nil
+	})
+	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Handler{Next: next, Traffic: &t.traffic}
+	})
+	return nil
+}
+
+// setupLog configures the logging of the traffic of the site,
+// which must have the traffic directive, every interval:
+//
+//	traffic_log interval
+func setupLog(c *caddy.Controller) error {
+	interval, err := parseLog(c)
+	if err != nil {
+		return err
+	}
+
+	cfg := httpserver.GetConfig(c)
+	t := registered(cfg)
+	if t == nil {
+		return c.Err("traffic_log requires the traffic directive")
+	}
+	stop := make(chan struct{})
+	c.OnStartup(func() error {
+		go logTraffic(cfg, t, interval, stop)
+		return nil
+	})
+	c.OnShutdown(func() error {
+		close(stop)
+		return nil
+	})
+	return nil
+}
+
+func parseLog(c *caddy.Controller) (time.Duration, error) {
+	var interval time.Duration
+	for c.Next() {
+		if interval != 0 {
+			return 0, c.Err("traffic_log can only be specified once")
+		}
+		if !c.NextArg() {
+			return 0, c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return 0, c.Errf("invalid traffic_log interval '%s': %v", c.Val(), err)
+		}
+		if dur <= 0 {
+			return 0, c.Errf("traffic_log interval must be positive, got %s", dur)
+		}
+		interval = dur
+		if c.NextArg() || c.NextBlock() {
+			return 0, c.ArgErr()
+		}
+	}
+	return interval, nil
+}
@@ -0,0 +1,72 @@
+package traffic
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`traffic`, false},
+		{`traffic 1h`, true},
+		{"traffic {\nlog 1h\n}", true},
+		{"traffic\ntraffic", true},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		cfg := httpserver.GetConfig(c)
+		mids := cfg.Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		if _, ok := mids[0](httpserver.EmptyNext).(Handler); !ok {
+			t.Errorf("Test %d: Expected handler to be type Handler", i)
+		}
+		unregister(cfg, registered(cfg))
+	}
+}
+
+func TestSetupLog(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{`traffic_log 1h`, false},
+		{`traffic_log`, true},
+		{`traffic_log 1h 2h`, true},
+		{`traffic_log soon`, true},
+		{`traffic_log -1h`, true},
+		{"traffic_log 1h\ntraffic_log 2h", true},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		cfg := httpserver.GetConfig(c)
+		st := register(cfg)
+		err := setupLog(c)
+		unregister(cfg, st)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+	}
+
+	c := caddy.NewTestController("http", `traffic_log 1h`)
+	if err := setupLog(c); err == nil {
+		t.Error("Expected an error without the traffic directive, but got none")
+	}
+}
@@ -0,0 +1,139 @@
+// Package traffic counts the bytes of the request and response
+// bodies of each site, for accounting, and exposes the counts,
+// along with those of the proxy upstreams, as an expvar.
+package traffic
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+)
+
+func init() {
+	expvar.Publish("traffic", expvar.Func(func() interface{} {
+		return map[string]map[string]httpserver.TrafficCounts{
+			"sites":     Sites(),
+			"upstreams": proxy.UpstreamTraffic(),
+		}
+	}))
+}
+
+// siteTraffic is the traffic of a site.
+type siteTraffic struct {
+	traffic httpserver.Traffic
+	label   string
+	refs    int // guarded by registryMu
+}
+
+// registry holds the traffic of every site that has the traffic
+// directive, keyed by site address. Sites keep their counts across
+// restarts, as long as they are still configured, so the counts
+// only start over when the process does.
+var (
+	registry   = make(map[string]*siteTraffic)
+	configs    = make(map[*httpserver.SiteConfig]*siteTraffic)
+	registryMu sync.Mutex
+)
+
+// register returns the traffic of site, creating it if needed.
+// Each call must be balanced by a call to unregister.
+func register(site *httpserver.SiteConfig) *siteTraffic {
+	label := site.Addr.String()
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	t, ok := registry[label]
+	if !ok {
+		t = &siteTraffic{label: label}
+		registry[label] = t
+	}
+	t.refs++
+	configs[site] = t
+	return t
+}
+
+func unregister(site *httpserver.SiteConfig, t *siteTraffic) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if configs[site] == t {
+		delete(configs, site)
+	}
+	if t.refs--; t.refs <= 0 {
+		delete(registry, t.label)
+	}
+}
+
+// registered returns the traffic of site, if it has the traffic directive.
+func registered(site *httpserver.SiteConfig) *siteTraffic {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return configs[site]
+}
+
+// Sites returns the traffic of every site that has the traffic
+// directive, by site address: the bytes of the bodies of the
+// requests received from clients and of the responses sent to
+// them, as written by the site, so after any compression.
+func Sites() map[string]httpserver.TrafficCounts {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	counts := make(map[string]httpserver.TrafficCounts, len(registry))
+	for label, t := range registry {
+		counts[label] = t.traffic.Counts()
+	}
+	return counts
+}
+
+// Handler counts the traffic of the requests it passes to Next.
+type Handler struct {
+	Next    httpserver.Handler
+	Traffic *httpserver.Traffic
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Body != nil && r.ContentLength != 0 {
+		r.Body = h.Traffic.CountReceived(r.Body)
+	}
+	rec := httpserver.NewResponseRecorder(w)
+	status, err := h.Next.ServeHTTP(rec, r)
+	h.Traffic.AddSent(rec.Size())
+	return status, err
+}
+
+// logTraffic logs the traffic of site, and of the upstream hosts
+// it proxies to, every interval until stop is closed.
+func logTraffic(site *httpserver.SiteConfig, t *siteTraffic, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logSnapshot(site, t)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func logSnapshot(site *httpserver.SiteConfig, t *siteTraffic) {
+	counts := t.traffic.Counts()
+	log.Printf("[INFO] Traffic of %s: received %d bytes, sent %d bytes", t.label, counts.Received, counts.Sent)
+
+	upstreams := proxy.SiteUpstreamTraffic(site)
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		counts := upstreams[name]
+		log.Printf("[INFO] Traffic of %s to upstream %s: sent %d bytes, received %d bytes",
+			t.label, name, counts.Sent, counts.Received)
+	}
+}
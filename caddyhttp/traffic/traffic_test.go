@@ -0,0 +1,83 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/gzip"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestHandlerCounts(t *testing.T) {
+	response := bytes.Repeat([]byte("caddy "), 2000)
+	var traffic httpserver.Traffic
+	h := Handler{
+		Traffic: &traffic,
+		Next: gzip.Gzip{Configs: []gzip.Config{{}}, Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				return http.StatusBadRequest, err
+			}
+			w.Write(response)
+			return 0, nil
+		})},
+	}
+
+	var sent int
+	for i, acceptEncoding := range []string{"", "gzip"} {
+		r, err := http.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		if _, err := h.ServeHTTP(w, r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		sent += w.Body.Len()
+		if acceptEncoding == "gzip" && w.Body.Len() >= len(response) {
+			t.Errorf("Test %d: Expected a compressed response, got %d bytes", i, w.Body.Len())
+		}
+
+		expected := httpserver.TrafficCounts{Received: uint64(1000 * (i + 1)), Sent: uint64(sent)}
+		if got := traffic.Counts(); got != expected {
+			t.Errorf("Test %d: Expected traffic %+v, got %+v", i, expected, got)
+		}
+	}
+}
+
+func TestRegistryAcrossRestarts(t *testing.T) {
+	addr := httpserver.Address{Original: "traffic.test", Host: "traffic.test"}
+	old := &httpserver.SiteConfig{Addr: addr}
+	st := register(old)
+	st.traffic.AddSent(42)
+
+	// the new instance starts before the old one shuts down
+	restarted := &httpserver.SiteConfig{Addr: addr}
+	newSt := register(restarted)
+	unregister(old, st)
+	if registered(old) != nil || registered(restarted) != newSt {
+		t.Error("Expected the traffic to be registered for the new config only")
+	}
+	if got := newSt.traffic.Counts().Sent; got != 42 {
+		t.Errorf("Expected the counts kept across the restart, got %d bytes sent", got)
+	}
+
+	var published map[string]map[string]httpserver.TrafficCounts
+	if err := json.Unmarshal([]byte(expvar.Get("traffic").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if got := published["sites"]["http://traffic.test"].Sent; got != 42 {
+		t.Errorf("Expected the counts published, got %d bytes sent", got)
+	}
+
+	unregister(restarted, newSt)
+	if _, ok := Sites()["http://traffic.test"]; ok {
+		t.Error("Expected the traffic to be forgotten once no config has the site")
+	}
+}
@@ -0,0 +1,170 @@
+package upload
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("upload", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Upload middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := uploadParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Upload{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// uploadParse parses upload directives, which look like:
+//
+//	upload path {
+//	    to               directory
+//	    max_size         size
+//	    methods          method...
+//	    overwrite        on|off
+//	    filenames        keep|random_suffix|random
+//	    auth_passthrough
+//	}
+//
+// The directory must exist. The methods default to PUT and
+// POST, overwrite to on and filenames to keep.
+func uploadParse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+
+	for c.Next() {
+		rule := Rule{
+			Methods:   []string{http.MethodPut, http.MethodPost},
+			Overwrite: true,
+			Names:     NamesKeep,
+		}
+
+		if !c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		rule.Path = c.Val()
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, c.Errf("Invalid upload path '%s'; must begin with /", rule.Path)
+		}
+		if len(c.RemainingArgs()) > 0 {
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "to":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				dir, err := filepath.Abs(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.To = dir
+			case "max_size":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				size, err := parseSize(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				rule.MaxSize = size
+			case "methods":
+				methods := c.RemainingArgs()
+				if len(methods) == 0 {
+					return nil, c.ArgErr()
+				}
+				rule.Methods = nil
+				for _, method := range methods {
+					method = strings.ToUpper(method)
+					if method != http.MethodPut && method != http.MethodPost {
+						return nil, c.Errf("Invalid upload method '%s'; must be PUT or POST", method)
+					}
+					rule.Methods = append(rule.Methods, method)
+				}
+				continue
+			case "overwrite":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "on":
+					rule.Overwrite = true
+				case "off":
+					rule.Overwrite = false
+				default:
+					return nil, c.Err("overwrite must be on or off")
+				}
+			case "filenames":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case NamesKeep, NamesRandomSuffix, NamesRandom:
+					rule.Names = c.Val()
+				default:
+					return nil, c.Err("filenames must be keep, random_suffix or random")
+				}
+			case "auth_passthrough":
+				rule.AuthPassthrough = true
+			default:
+				return nil, c.Errf("Unknown upload option '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		}
+
+		if rule.To == "" {
+			return nil, c.Errf("Upload path '%s' needs a directory to store files in", rule.Path)
+		}
+		if info, err := os.Stat(rule.To); err != nil || !info.IsDir() {
+			return nil, c.Errf("Upload directory '%s' must be an existing directory", rule.To)
+		}
+		for _, other := range rules {
+			if other.Path == rule.Path {
+				return nil, c.Errf("Duplicate upload for path '%s'", rule.Path)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseSize parses a size like 500mb into bytes. Sizes
+// are in bytes unless suffixed with kb, mb or gb, which
+// are multiples of 1024.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	lower := strings.ToLower(s)
+	for suffix, m := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(lower, suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,99 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := caddy.NewTestController("http", "upload /incoming {\nto "+dir+"\n}")
+	err = setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Upload)
+	if !ok {
+		t.Fatalf("Expected handler to be type Upload, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestUploadParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  []Rule
+	}{
+		{"upload /incoming {\nto " + dir + "\n}", false, []Rule{{
+			Path: "/incoming", To: dir, Methods: []string{"PUT", "POST"}, Overwrite: true, Names: NamesKeep,
+		}}},
+		{"upload /incoming {\nto " + dir + "\nmax_size 500mb\nmethods put\noverwrite off\nfilenames random_suffix\nauth_passthrough\n}", false, []Rule{{
+			Path: "/incoming", To: dir, MaxSize: 500 << 20, Methods: []string{"PUT"}, Names: NamesRandomSuffix, AuthPassthrough: true,
+		}}},
+		{"upload /a {\nto " + dir + "\n}\nupload /b {\nto " + dir + "\nfilenames random\n}", false, []Rule{
+			{Path: "/a", To: dir, Methods: []string{"PUT", "POST"}, Overwrite: true, Names: NamesKeep},
+			{Path: "/b", To: dir, Methods: []string{"PUT", "POST"}, Overwrite: true, Names: NamesRandom},
+		}},
+		{`upload`, true, nil},
+		{`upload /incoming`, true, nil},
+		{"upload incoming {\nto " + dir + "\n}", true, nil},
+		{"upload /incoming extra {\nto " + dir + "\n}", true, nil},
+		{"upload /incoming {\nto " + file + "\n}", true, nil},
+		{"upload /incoming {\nto " + filepath.Join(dir, "missing") + "\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nmax_size lots\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nmethods GET\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nmethods\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\noverwrite maybe\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nfilenames hashed\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nauth_passthrough yes\n}", true, nil},
+		{"upload /incoming {\nto " + dir + "\nfoo bar\n}", true, nil},
+		{"upload /a {\nto " + dir + "\n}\nupload /a {\nto " + dir + "\n}", true, nil},
+	}
+	for i, test := range tests {
+		actual, err := uploadParse(caddy.NewTestController("http", test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected rules %#v, got %#v", i, test.expected, actual)
+		}
+	}
+}
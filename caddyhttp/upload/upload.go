@@ -0,0 +1,376 @@
+// Package upload stores the files that are uploaded
+// with PUT or POST requests in a directory on disk.
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// The policies for naming the uploaded files.
+const (
+	// NamesKeep stores a file under the name it is uploaded as
+	NamesKeep = "keep"
+
+	// NamesRandomSuffix adds a random suffix to the name,
+	// before its extension
+	NamesRandomSuffix = "random_suffix"
+
+	// NamesRandom replaces the name with a random one,
+	// keeping its extension
+	NamesRandom = "random"
+)
+
+// Upload is a middleware that stores the bodies of the
+// requests to the paths it has a rule for as files.
+type Upload struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is where the files uploaded to a path are stored.
+type Rule struct {
+	// Path is the path that files are uploaded to; the
+	// longest path that matches a request wins
+	Path string
+
+	// To is the directory that the files are stored in
+	To string
+
+	// MaxSize is the most bytes a request body may have;
+	// 0 means there is no limit
+	MaxSize int64
+
+	// Methods are the methods that upload files; the
+	// requests with other methods are passed on
+	Methods []string
+
+	// Overwrite is whether an upload may replace a file
+	// that exists
+	Overwrite bool
+
+	// Names is the policy for naming the files, one of
+	// NamesKeep, NamesRandomSuffix and NamesRandom
+	Names string
+
+	// AuthPassthrough accepts uploads without credentials,
+	// leaving access control to the middleware before this
+	// one, such as a filter by IP address; otherwise, a
+	// request without an Authorization header is refused,
+	// since uploads are meant to be behind basicauth
+	AuthPassthrough bool
+}
+
+// errTooLarge is returned when the body is larger than allowed.
+var errTooLarge = errors.New("request body too large")
+
+// errExists is returned when a file may not be replaced.
+var errExists = errors.New("file exists")
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (u Upload) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	rule := u.match(r)
+	if rule == nil {
+		return u.Next.ServeHTTP(w, r)
+	}
+	if !rule.AuthPassthrough && r.Header.Get("Authorization") == "" {
+		return http.StatusUnauthorized, nil
+	}
+	if rule.MaxSize > 0 && r.ContentLength > rule.MaxSize {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	rel, ok := relativePath(r.URL.Path, rule.Path)
+	if !ok {
+		return http.StatusBadRequest, nil
+	}
+	body := io.Reader(r.Body)
+	var limited *limitedReader
+	if rule.MaxSize > 0 {
+		limited = &limitedReader{r: r.Body, left: rule.MaxSize}
+		body = limited
+	}
+
+	var stored []string
+	var replaced bool
+	var err error
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == http.MethodPost && mediaType == "multipart/form-data" {
+		stored, err = rule.storeParts(multipart.NewReader(body, params["boundary"]), rel)
+	} else {
+		if rel == "" || strings.HasSuffix(r.URL.Path, "/") {
+			return http.StatusBadRequest, nil // a file needs a name
+		}
+		var name string
+		name, replaced, err = rule.store(body, rel)
+		stored = []string{name}
+	}
+	switch {
+	case limited != nil && limited.exceeded:
+		// whatever err wraps errTooLarge, as the multipart reader does
+		return http.StatusRequestEntityTooLarge, nil
+	case err == errExists:
+		return http.StatusConflict, nil
+	case err == errBadName:
+		return http.StatusBadRequest, nil
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+	if len(stored) == 0 {
+		return http.StatusBadRequest, nil // a form without files
+	}
+
+	for _, name := range stored {
+		w.Header().Add("Location", (&url.URL{Path: path.Join(rule.Path, name)}).EscapedPath())
+	}
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+// match returns the rule with the longest path that
+// matches r and its method, or nil if there is none.
+func (u Upload) match(r *http.Request) *Rule {
+	var match *Rule
+	for i := range u.Rules {
+		rule := &u.Rules[i]
+		if !httpserver.Path(r.URL.Path).Matches(rule.Path) || !rule.uploads(r.Method) {
+			continue
+		}
+		if match == nil || len(rule.Path) > len(match.Path) {
+			match = rule
+		}
+	}
+	return match
+}
+
+func (rule *Rule) uploads(method string) bool {
+	for _, m := range rule.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// errBadName is returned for the name of a part
+// that cannot be stored.
+var errBadName = errors.New("invalid file name")
+
+// storeParts stores each file in the multipart form
+// in the directory dir, and returns their paths.
+func (rule *Rule) storeParts(form *multipart.Reader, dir string) ([]string, error) {
+	var stored []string
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return stored, nil
+		}
+		if err != nil {
+			return stored, errBadName
+		}
+		if part.FileName() == "" {
+			continue // a form field, not a file
+		}
+		// only the base name; browsers used to send the whole path
+		name := path.Base(strings.Replace(part.FileName(), `\`, "/", -1))
+		if !validSegment(name) {
+			return stored, errBadName
+		}
+		name, _, err = rule.store(part, path.Join(dir, name))
+		if err != nil {
+			return stored, err
+		}
+		stored = append(stored, name)
+	}
+}
+
+// store writes src to the file at rel, which is relative to the
+// directory of the rule, after naming it by the policy of the
+// rule, and returns its path and whether it replaced a file. The
+// file is written to a temporary file first, which is renamed, so
+// a file is either complete or not there at all.
+func (rule *Rule) store(src io.Reader, rel string) (string, bool, error) {
+	rel = rule.name(rel)
+	target := filepath.Join(rule.To, filepath.FromSlash(rel))
+	dir := filepath.Dir(target)
+	if err := rule.makeDir(dir); err != nil {
+		return "", false, err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return "", false, err
+	}
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+
+	var replaced bool
+	if info, err := os.Lstat(target); err == nil {
+		if !rule.Overwrite || !info.Mode().IsRegular() {
+			os.Remove(tmp.Name())
+			return "", false, errExists
+		}
+		replaced = true
+	}
+	if rule.Overwrite {
+		err = os.Rename(tmp.Name(), target)
+	} else {
+		// a link fails if the file was created in the meantime
+		err = os.Link(tmp.Name(), target)
+		os.Remove(tmp.Name())
+		if os.IsExist(err) {
+			return "", false, errExists
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+	os.Chmod(target, 0644)
+	return rel, replaced, nil
+}
+
+// name returns the path rel with the last element
+// named by the policy of the rule.
+func (rule *Rule) name(rel string) string {
+	if rule.Names == NamesKeep || rule.Names == "" {
+		return rel
+	}
+	dir, file := path.Split(rel)
+	ext := path.Ext(file)
+	if strings.HasPrefix(file, ".") && ext == file {
+		ext = ""
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	if rule.Names == NamesRandom {
+		return dir + hex.EncodeToString(random) + ext
+	}
+	return dir + strings.TrimSuffix(file, ext) + "-" + hex.EncodeToString(random[:4]) + ext
+}
+
+// makeDir makes dir, which is in the directory of the rule, and
+// the directories it is in that are missing. The nearest one that
+// exists must be in the directory of the rule with its links
+// resolved, and the missing ones are made one at a time, so that
+// none is made through a link out of the directory.
+func (rule *Rule) makeDir(dir string) error {
+	var missing []string
+	existing := dir
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if !os.IsNotExist(err) || parent == existing {
+			return err
+		}
+		missing = append(missing, filepath.Base(existing))
+		existing = parent
+	}
+	if !rule.contains(existing) {
+		return errBadName // a link out of the directory
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		existing = filepath.Join(existing, missing[i])
+		if err := os.Mkdir(existing, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		// it may have been made in the meantime, as a link
+		if info, err := os.Lstat(existing); err != nil || !info.IsDir() {
+			return errBadName
+		}
+	}
+	return nil
+}
+
+// contains returns whether dir, with its links resolved,
+// is in the directory of the rule.
+func (rule *Rule) contains(dir string) bool {
+	root, err := filepath.EvalSymlinks(rule.To)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+}
+
+// relativePath returns the path of reqPath under the path
+// of a rule, and false if it is not one that may be written:
+// one with a .. element or an element that is not a valid
+// file name.
+func relativePath(reqPath, rulePath string) (string, bool) {
+	rel := strings.TrimPrefix(reqPath, strings.TrimSuffix(rulePath, "/"))
+	var elements []string
+	for _, element := range strings.Split(rel, "/") {
+		if element == "" {
+			continue
+		}
+		if !validSegment(element) {
+			return "", false
+		}
+		elements = append(elements, element)
+	}
+	return strings.Join(elements, "/"), true
+}
+
+// validSegment returns whether name may be the name of
+// a file or directory that is uploaded to: not . or ..,
+// and without path separators or control characters.
+func validSegment(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedReader reads from r until more than left bytes
+// were read, when it returns errTooLarge and records that
+// the limit was exceeded.
+type limitedReader struct {
+	r        io.Reader
+	left     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		l.exceeded = true
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,287 @@
+package upload
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func newTestUpload(t *testing.T, rule Rule) (Upload, string) {
+	dir, err := ioutil.TempDir("", "caddy_upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule.To = dir
+	if rule.Methods == nil {
+		rule.Methods = []string{"PUT", "POST"}
+	}
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Write([]byte("next"))
+		return 0, nil
+	})
+	return Upload{Next: next, Rules: []Rule{rule}}, dir
+}
+
+func authorized(r *http.Request) *http.Request {
+	r.SetBasicAuth("user", "pass")
+	return r
+}
+
+func TestUpload(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/incoming", Overwrite: true})
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		method, path string
+		body         string
+		status       int // returned status
+		code         int // status written
+		location     string
+		file         string // the file stored, relative to dir
+	}{
+		{"PUT", "/incoming/a.txt", "first", 0, 201, "/incoming/a.txt", "a.txt"},
+		{"PUT", "/incoming/a.txt", "second", 0, 204, "/incoming/a.txt", "a.txt"},
+		{"POST", "/incoming/sub/dir/b.txt", "nested", 0, 201, "/incoming/sub/dir/b.txt", "sub/dir/b.txt"},
+		{"PUT", "/incoming/with%20space.txt", "space", 0, 201, "/incoming/with%20space.txt", "with space.txt"},
+		{"PUT", "/incoming/", "no name", 400, 200, "", ""},
+		{"PUT", "/incoming/../escaped.txt", "up", 400, 200, "", ""},
+		{"PUT", "/incoming/sub/../../escaped.txt", "up", 400, 200, "", ""},
+		{"PUT", "/incoming/..%2fescaped.txt", "up", 400, 200, "", ""},
+		{"PUT", "/incoming/..%5cescaped.txt", "up", 400, 200, "", ""},
+		{"PUT", "/incoming/nul%00.txt", "nul", 400, 200, "", ""},
+		{"GET", "/incoming/a.txt", "", 0, 200, "", ""},
+	} {
+		r := authorized(httptest.NewRequest(test.method, "http://localhost"+test.path, strings.NewReader(test.body)))
+		rec := httptest.NewRecorder()
+		status, err := u.ServeHTTP(rec, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected returned status %d, got %d", i, test.status, status)
+		}
+		if rec.Code != test.code {
+			t.Errorf("Test %d: Expected written status %d, got %d", i, test.code, rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected Location '%s', got '%s'", i, test.location, location)
+		}
+		if test.file != "" {
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(test.file)))
+			if err != nil || string(data) != test.body {
+				t.Errorf("Test %d: Expected file %s to hold '%s', got '%s' (%v)", i, test.file, test.body, data, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.txt")); err == nil {
+		t.Error("Expected no file to be written outside of the directory")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".upload-*")); len(files) != 0 {
+		t.Errorf("Expected no temporary files to be left, got %v", files)
+	}
+}
+
+func TestUploadSymlinkEscape(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/", Overwrite: true})
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "caddy_upload_outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("Cannot create symlink: %v", err)
+	}
+
+	// no directory is made through the link either
+	for _, path := range []string{"/link/escaped.txt", "/link/sub/dir/escaped.txt"} {
+		r := authorized(httptest.NewRequest("PUT", path, strings.NewReader("out")))
+		status, _ := u.ServeHTTP(httptest.NewRecorder(), r)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: Expected status 400 for a path through a link out of the directory, got %d", path, status)
+		}
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("Expected nothing to be written through the link, got %d files", len(files))
+	}
+}
+
+func TestUploadMaxSize(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/", MaxSize: 10, Overwrite: true})
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		body          string
+		contentLength int64 // -1 for a chunked body
+		status        int
+	}{
+		{"0123456789", 10, 0},
+		{"0123456789", -1, 0},
+		{"0123456789a", 11, 413},
+		{"0123456789a", -1, 413},
+		{strings.Repeat("x", 100000), -1, 413},
+	} {
+		r := authorized(httptest.NewRequest("PUT", "/file.txt", strings.NewReader(test.body)))
+		r.ContentLength = test.contentLength
+		if test.contentLength < 0 {
+			r.TransferEncoding = []string{"chunked"}
+		}
+		status, err := u.ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "file.txt"))
+		if err != nil || string(data) != "0123456789" {
+			t.Errorf("Test %d: Expected the file to hold the last body within the limit, got '%s' (%v)", i, data, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".upload-*")); len(files) != 0 {
+		t.Errorf("Expected no temporary files to be left, got %v", files)
+	}
+
+	// the multipart reader wraps the error of the body
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", strings.Repeat("x", 1000))
+	part, _ := mw.CreateFormFile("file", "file.txt")
+	part.Write([]byte("0123456789"))
+	mw.Close()
+	r := authorized(httptest.NewRequest("POST", "/", &body))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	if status, _ := u.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a form that is too large, got %d", status)
+	}
+}
+
+func TestUploadNoOverwrite(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/", Overwrite: false})
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		body   string
+		status int
+		code   int
+	}{
+		{"first", 0, 201},
+		{"second", 409, 200},
+	} {
+		r := authorized(httptest.NewRequest("PUT", "/file.txt", strings.NewReader(test.body)))
+		rec := httptest.NewRecorder()
+		status, _ := u.ServeHTTP(rec, r)
+		if status != test.status || rec.Code != test.code {
+			t.Errorf("Test %d: Expected status %d and %d written, got %d and %d", i, test.status, test.code, status, rec.Code)
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "file.txt")); string(data) != "first" {
+		t.Errorf("Expected the first upload to be kept, got '%s'", data)
+	}
+}
+
+func TestUploadRandomNames(t *testing.T) {
+	for _, names := range []string{NamesRandomSuffix, NamesRandom} {
+		u, dir := newTestUpload(t, Rule{Path: "/up", Names: names})
+		defer os.RemoveAll(dir)
+
+		var locations []string
+		for i := 0; i < 2; i++ {
+			r := authorized(httptest.NewRequest("PUT", "/up/photo.jpg", strings.NewReader("data")))
+			rec := httptest.NewRecorder()
+			if status, _ := u.ServeHTTP(rec, r); status != 0 || rec.Code != 201 {
+				t.Errorf("%s: Expected status 201, got %d and %d", names, status, rec.Code)
+			}
+			locations = append(locations, rec.Header().Get("Location"))
+		}
+		for _, location := range locations {
+			if !strings.HasPrefix(location, "/up/") || !strings.HasSuffix(location, ".jpg") || location == "/up/photo.jpg" {
+				t.Errorf("%s: Expected a new name with the extension, got '%s'", names, location)
+			}
+			if names == NamesRandomSuffix && !strings.HasPrefix(location, "/up/photo-") {
+				t.Errorf("%s: Expected the name to keep its stem, got '%s'", names, location)
+			}
+			if _, err := os.Stat(filepath.Join(dir, strings.TrimPrefix(location, "/up/"))); err != nil {
+				t.Errorf("%s: Expected the file at the Location: %v", names, err)
+			}
+		}
+		if locations[0] == locations[1] {
+			t.Errorf("%s: Expected distinct names, got '%s' twice", names, locations[0])
+		}
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/incoming", Overwrite: true})
+	defer os.RemoveAll(dir)
+
+	form := func(files map[string]string) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("comment", "not a file")
+		for name, content := range files {
+			part, _ := mw.CreateFormFile("file", name)
+			part.Write([]byte(content))
+		}
+		mw.Close()
+		return &body, mw.FormDataContentType()
+	}
+
+	body, contentType := form(map[string]string{"one.txt": "1", `C:\Users\me\two.txt`: "2"})
+	r := authorized(httptest.NewRequest("POST", "/incoming/batch", body))
+	r.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	status, err := u.ServeHTTP(rec, r)
+	if err != nil || status != 0 || rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d and %d (%v)", status, rec.Code, err)
+	}
+	if locations := rec.Header()["Location"]; len(locations) != 2 {
+		t.Errorf("Expected a Location for each file, got %v", locations)
+	}
+	for name, content := range map[string]string{"one.txt": "1", "two.txt": "2"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "batch", name))
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold '%s', got '%s' (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "batch", "comment")); err == nil {
+		t.Error("Expected form fields not to be stored")
+	}
+
+	for i, files := range []map[string]string{{"..": "up"}, {}} {
+		body, contentType := form(files)
+		r := authorized(httptest.NewRequest("POST", "/incoming/", body))
+		r.Header.Set("Content-Type", contentType)
+		if status, _ := u.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusBadRequest {
+			t.Errorf("Test %d: Expected status 400, got %d", i, status)
+		}
+	}
+}
+
+func TestUploadAuth(t *testing.T) {
+	u, dir := newTestUpload(t, Rule{Path: "/", Overwrite: true})
+	defer os.RemoveAll(dir)
+
+	r := httptest.NewRequest("PUT", "/file.txt", strings.NewReader("data"))
+	if status, _ := u.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without credentials, got %d", status)
+	}
+
+	// access is left to a middleware before it, like ipfilter
+	u.Rules[0].AuthPassthrough = true
+	r = httptest.NewRequest("PUT", "/file.txt", strings.NewReader("data"))
+	rec := httptest.NewRecorder()
+	if status, _ := u.ServeHTTP(rec, r); status != 0 || rec.Code != 201 {
+		t.Errorf("Expected status 201 with auth_passthrough, got %d and %d", status, rec.Code)
+	}
+}
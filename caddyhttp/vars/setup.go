@@ -0,0 +1,101 @@
+package vars
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("map", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new Map middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := parse(c)
+	if err != nil {
+		return err
+	}
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Map{Next: next, Rules: rules}
+	})
+	return nil
+}
+
+// parse parses the map directives, each of which is
+//
+//	map input {output}... {
+//	    key     value...
+//	    default value...
+//	}
+//
+// where each row has a value for each output. A key that begins
+// with *. matches the inputs that end with the rest of it, one that
+// begins with ~ is a regular expression, and any other key matches
+// only itself. A key may be given only once.
+func parse(c *caddy.Controller) ([]Rule, error) {
+	var rules []Rule
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return nil, c.ArgErr()
+		}
+		rule := Rule{Input: args[0], exact: make(map[string][]string)}
+		for _, output := range args[1:] {
+			if len(output) < 3 || !strings.HasPrefix(output, "{") || !strings.HasSuffix(output, "}") {
+				return nil, c.Errf("map output must be a placeholder, like {name}, not '%s'", output)
+			}
+			name := output[1 : len(output)-1]
+			for _, existing := range rule.Outputs {
+				if existing == name {
+					return nil, c.Errf("duplicate map output '%s'", output)
+				}
+			}
+			rule.Outputs = append(rule.Outputs, name)
+		}
+
+		keys := make(map[string]bool)
+		for c.NextBlock() {
+			key := c.Val()
+			values := c.RemainingArgs()
+			if len(values) != len(rule.Outputs) {
+				return nil, c.Errf("map row '%s' has %d values for %d outputs", key, len(values), len(rule.Outputs))
+			}
+			if keys[key] {
+				return nil, c.Errf("duplicate map key '%s'", key)
+			}
+			keys[key] = true
+
+			switch {
+			case key == "default":
+				rule.defaults = values
+			case strings.HasPrefix(key, "~"):
+				re, err := regexp.Compile(key[1:])
+				if err != nil {
+					return nil, c.Errf("invalid map regexp '%s': %v", key[1:], err)
+				}
+				rule.regexps = append(rule.regexps, regexpRow{re: re, values: values})
+			case strings.HasPrefix(key, "*."):
+				rule.wildcards = append(rule.wildcards, wildcardRow{suffix: key[1:], values: values})
+			default:
+				rule.exact[key] = values
+			}
+		}
+		sort.Stable(byLongestSuffix(rule.wildcards))
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// byLongestSuffix sorts wildcard rows with the longest suffix first.
+type byLongestSuffix []wildcardRow
+
+func (s byLongestSuffix) Len() int           { return len(s) }
+func (s byLongestSuffix) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLongestSuffix) Less(i, j int) bool { return len(s[i].suffix) > len(s[j].suffix) }
@@ -0,0 +1,54 @@
+package vars
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	for i, test := range []struct {
+		input           string
+		shouldErr       bool
+		expectedRules   int
+		expectedOutputs int
+	}{
+		{"map {host} {backend} {\napi.example.com 10.0.0.5:8080\n*.example.com 10.0.0.9:8080\ndefault 10.0.0.1:8080\n}", false, 1, 1},
+		{"map {path} {a} {b} {\n~^/api/ api v1\n}\nmap {host} {c} {\nx y\n}", false, 2, 2},
+		{"map {host} {backend}", false, 1, 1},
+		{"map {host}", true, 0, 0},
+		{"map {host} backend {\nx y\n}", true, 0, 0},
+		{"map {host} {} {\nx y\n}", true, 0, 0},
+		{"map {host} {a} {a} {\nx y z\n}", true, 0, 0},
+		{"map {host} {a} {b} {\nx y\n}", true, 0, 0},
+		{"map {host} {a} {\nx y z\n}", true, 0, 0},
+		{"map {host} {a} {\nx 1\nx 2\n}", true, 0, 0},
+		{"map {host} {a} {\ndefault 1\ndefault 2\n}", true, 0, 0},
+		{"map {host} {a} {\n*.example.com 1\n*.example.com 2\n}", true, 0, 0},
+		{"map {host} {a} {\n~(unclosed 1\n}", true, 0, 0},
+	} {
+		c := caddy.NewTestController("http", test.input)
+		err := setup(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		mids := httpserver.GetConfig(c).Middleware()
+		if len(mids) != 1 {
+			t.Fatalf("Test %d: Expected 1 middleware, got %d", i, len(mids))
+		}
+		handler := mids[0](httpserver.EmptyNext).(Map)
+		if len(handler.Rules) != test.expectedRules {
+			t.Errorf("Test %d: Expected %d rules, got %d", i, test.expectedRules, len(handler.Rules))
+		} else if got := len(handler.Rules[0].Outputs); got != test.expectedOutputs {
+			t.Errorf("Test %d: Expected %d outputs, got %d", i, test.expectedOutputs, got)
+		}
+	}
+}
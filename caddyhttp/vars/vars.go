@@ -0,0 +1,106 @@
+// Package vars is middleware that sets placeholders whose values
+// are looked up, for each request, in a map from the value of an
+// input, so that the same choice, like which backend a host goes
+// to, is made in one place for the directives that use it.
+package vars
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Map is middleware that sets the output placeholders of its rules.
+type Map struct {
+	Next  httpserver.Handler
+	Rules []Rule
+}
+
+// Rule is a map from the value of Input, with its placeholders
+// replaced, to the values of the placeholders Outputs. A value
+// is looked up in the rows with an exact key first, then in the
+// wildcard rows, the one with the longest suffix first, and then
+// in the regexp rows, in order; the default values are given if
+// none of them matches, or empty values if there is no default.
+type Rule struct {
+	Input   string
+	Outputs []string // the names of the placeholders, without braces
+
+	exact     map[string][]string
+	wildcards []wildcardRow
+	regexps   []regexpRow
+	defaults  []string
+}
+
+// wildcardRow has the values for the inputs with a suffix,
+// as in *.example.com, whose suffix is .example.com.
+type wildcardRow struct {
+	suffix string
+	values []string
+}
+
+// regexpRow has the values for the inputs that match re. The
+// values may refer to the submatches, like $1, as in
+// regexp.Regexp.Expand.
+type regexpRow struct {
+	re     *regexp.Regexp
+	values []string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (m Map) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, rule := range m.Rules {
+		r = rule.withPlaceholders(r)
+	}
+	return m.Next.ServeHTTP(w, r)
+}
+
+// withPlaceholders returns r with the output placeholders of rule.
+// The values are looked up once, the first time one of them is
+// replaced; if none is, they are not looked up at all.
+func (rule Rule) withPlaceholders(r *http.Request) *http.Request {
+	var once sync.Once
+	var values []string
+	input := r
+	lookup := func() {
+		values = rule.lookup(httpserver.NewReplacer(input, nil, "").Replace(rule.Input))
+	}
+	for i, name := range rule.Outputs {
+		i := i
+		r = httpserver.WithPlaceholder(r, name, func() string {
+			once.Do(lookup)
+			return values[i]
+		})
+	}
+	return r
+}
+
+// lookup returns the values of the outputs for input.
+func (rule Rule) lookup(input string) []string {
+	if values, ok := rule.exact[input]; ok {
+		return values
+	}
+	for _, row := range rule.wildcards {
+		if len(input) > len(row.suffix) && strings.HasSuffix(input, row.suffix) {
+			return row.values
+		}
+	}
+	for _, row := range rule.regexps {
+		match := row.re.FindStringSubmatchIndex(input)
+		if match == nil {
+			continue
+		}
+		values := make([]string, len(row.values))
+		for i, template := range row.values {
+			values[i] = string(row.re.ExpandString(nil, template, input, match))
+		}
+		return values
+	}
+	if rule.defaults != nil {
+		return rule.defaults
+	}
+	return make([]string, len(rule.Outputs))
+}
@@ -0,0 +1,136 @@
+package vars
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/mholt/caddy/caddyhttp/header"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/mholt/caddy/caddyhttp/proxy"
+)
+
+func parseRule(t *testing.T, input string) Rule {
+	rules, err := parse(caddy.NewTestController("http", input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules[0]
+}
+
+func TestLookup(t *testing.T) {
+	rule := parseRule(t, `map {host} {backend} {pool} {
+		api.example.com    10.0.0.5:8080 api
+		*.example.com      10.0.0.9:8080 web
+		*.eu.example.com   10.0.1.9:8080 web-eu
+		~^(\w+)\.test$     $1.internal:8080 test
+		default            10.0.0.1:8080 default
+	}`)
+	for i, test := range []struct {
+		input    string
+		expected []string
+	}{
+		{"api.example.com", []string{"10.0.0.5:8080", "api"}},
+		{"www.example.com", []string{"10.0.0.9:8080", "web"}},
+		{"www.eu.example.com", []string{"10.0.1.9:8080", "web-eu"}},
+		{"example.com", []string{"10.0.0.1:8080", "default"}},
+		{"staging.test", []string{"staging.internal:8080", "test"}},
+		{"a.b.test", []string{"10.0.0.1:8080", "default"}},
+		{"other.org", []string{"10.0.0.1:8080", "default"}},
+	} {
+		got := rule.lookup(test.input)
+		if strings.Join(got, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("Test %d: Expected %v for %s, got %v", i, test.expected, test.input, got)
+		}
+	}
+
+	rule = parseRule(t, "map {path} {a} {b} {\n/x 1 2\n}")
+	if got := rule.lookup("/y"); len(got) != 2 || got[0] != "" || got[1] != "" {
+		t.Errorf("Expected empty values without a default, got %v", got)
+	}
+}
+
+func TestLazyLookup(t *testing.T) {
+	var lookups int
+	m := Map{Rules: []Rule{parseRule(t, "map {counted} {a} {b} {\nx 1 2\n}")}}
+	var replaced string
+	m.Next = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		rep := httpserver.NewReplacer(r, nil, "")
+		if r.URL.Path == "/use" {
+			replaced = rep.Replace("{a}{b}") + rep.Replace("{b}")
+		} else {
+			rep.Replace("{path}")
+		}
+		return http.StatusOK, nil
+	})
+
+	for _, path := range []string{"/skip", "/use"} {
+		lookups = 0
+		r := httptest.NewRequest("GET", path, nil)
+		r = httpserver.WithPlaceholder(r, "counted", func() string {
+			lookups++
+			return "x"
+		})
+		m.ServeHTTP(httptest.NewRecorder(), r)
+		if path == "/skip" && lookups != 0 {
+			t.Errorf("Expected no lookup without the outputs used, got %d", lookups)
+		}
+		if path == "/use" && lookups != 1 {
+			t.Errorf("Expected one lookup for the outputs used three times, got %d", lookups)
+		}
+	}
+	if replaced != "122" {
+		t.Errorf("Expected the outputs to be replaced with 122, got %s", replaced)
+	}
+}
+
+func TestMapToProxyAndHeader(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	api, web, fallback := backend("api"), backend("web"), backend("default")
+	defer api.Close()
+	defer web.Close()
+	defer fallback.Close()
+	addr := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	rule := parseRule(t, "map {hostonly} {backend} {\n"+
+		"api.example.com "+addr(api)+"\n"+
+		"*.example.com "+addr(web)+"\n"+
+		"default "+addr(fallback)+"\n}")
+	upstreams, err := proxy.NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader("proxy / {backend}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Map{Rules: []Rule{rule}, Next: header.Headers{
+		Rules: []header.Rule{{Path: "/", Headers: []header.Header{{Name: "X-Backend", Value: "{backend}"}}}},
+		Next:  proxy.Proxy{Next: httpserver.EmptyNext, Upstreams: upstreams},
+	}}
+
+	for i, test := range []struct {
+		host, expectedBody, expectedHeader string
+	}{
+		{"api.example.com", "api", addr(api)},
+		{"www.example.com", "web", addr(web)},
+		{"example.org:8080", "default", addr(fallback)},
+		{"API.example.com", "web", addr(web)},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		body, _ := ioutil.ReadAll(w.Body)
+		if string(body) != test.expectedBody {
+			t.Errorf("Test %d: Expected %s to be proxied to %s, got %q", i, test.host, test.expectedBody, body)
+		}
+		if got := w.Header().Get("X-Backend"); got != test.expectedHeader {
+			t.Errorf("Test %d: Expected X-Backend %s, got %s", i, test.expectedHeader, got)
+		}
+	}
+}
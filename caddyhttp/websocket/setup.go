@@ -1,6 +1,10 @@
 package websocket
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -31,14 +35,43 @@ func setup(c *caddy.Controller) error {
 
 func webSocketParse(c *caddy.Controller) ([]Config, error) {
 	var websocks []Config
-	var respawn bool
 
-	optionalBlock := func() (hadBlock bool, err error) {
+	optionalBlock := func(config *Config) (hadBlock bool, err error) {
 		for c.NextBlock() {
 			hadBlock = true
-			if c.Val() == "respawn" {
-				respawn = true
-			} else {
+			switch c.Val() {
+			case "respawn":
+				config.Respawn = true
+			case "origins":
+				origins := c.RemainingArgs()
+				if len(origins) == 0 {
+					return true, c.ArgErr()
+				}
+				for _, origin := range origins {
+					if strings.Count(origin, "*") > 1 || (strings.Contains(origin, "*") && !strings.Contains(origin, "://*.")) {
+						return true, c.Errf("Invalid origin '%s'; wildcards must be like https://*.example.com", origin)
+					}
+				}
+				config.Origins = append(config.Origins, origins...)
+			case "max_connections":
+				if !c.NextArg() {
+					return true, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return true, c.Errf("max_connections must be a positive integer, got '%s'", c.Val())
+				}
+				config.MaxConnections = n
+			case "idle_timeout":
+				if !c.NextArg() {
+					return true, c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil || timeout <= 0 {
+					return true, c.Errf("idle_timeout must be a positive duration, got '%s'", c.Val())
+				}
+				config.IdleTimeout = timeout
+			default:
 				return true, c.Err("Expected websocket configuration parameter in block")
 			}
 		}
@@ -47,6 +80,7 @@ func webSocketParse(c *caddy.Controller) ([]Config, error) {
 
 	for c.Next() {
 		var val, path, command string
+		var config Config
 
 		// Path or command; not sure which yet
 		if !c.NextArg() {
@@ -55,7 +89,7 @@ func webSocketParse(c *caddy.Controller) ([]Config, error) {
 		val = c.Val()
 
 		// Extra configuration may be in a block
-		hadBlock, err := optionalBlock()
+		hadBlock, err := optionalBlock(&config)
 		if err != nil {
 			return nil, err
 		}
@@ -71,7 +105,7 @@ func webSocketParse(c *caddy.Controller) ([]Config, error) {
 			}
 
 			// Okay, check again for optional block
-			_, err = optionalBlock()
+			_, err = optionalBlock(&config)
 			if err != nil {
 				return nil, err
 			}
@@ -83,12 +117,11 @@ func webSocketParse(c *caddy.Controller) ([]Config, error) {
 			return nil, err
 		}
 
-		websocks = append(websocks, Config{
-			Path:      path,
-			Command:   cmd,
-			Arguments: args,
-			Respawn:   respawn, // TODO: This isn't used currently
-		})
+		config.Path = path
+		config.Command = cmd
+		config.Arguments = args // config.Respawn isn't used currently
+		config.active = new(int32)
+		websocks = append(websocks, config)
 	}
 
 	return websocks, nil
@@ -1,7 +1,9 @@
 package websocket
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
@@ -71,6 +73,34 @@ func TestWebSocketParse(t *testing.T) {
 		{`websocket /api7 cat {
 			invalid
 		}`, true, []Config{}},
+
+		{`websocket /api8 cat {
+			origins https://app.example.com https://*.example.com
+			max_connections 50
+			idle_timeout 5m
+		}`, false, []Config{{
+			Path:           "/api8",
+			Command:        "cat",
+			Origins:        []string{"https://app.example.com", "https://*.example.com"},
+			MaxConnections: 50,
+			IdleTimeout:    5 * time.Minute,
+		}}},
+
+		{`websocket /api9 cat {
+			origins
+		}`, true, []Config{}},
+
+		{`websocket /api10 cat {
+			origins https://app.*.com
+		}`, true, []Config{}},
+
+		{`websocket /api11 cat {
+			max_connections 0
+		}`, true, []Config{}},
+
+		{`websocket /api12 cat {
+			idle_timeout forever
+		}`, true, []Config{}},
 	}
 	for i, test := range tests {
 		c := caddy.NewTestController("http", test.inputWebSocketConfig)
@@ -97,6 +127,21 @@ func TestWebSocketParse(t *testing.T) {
 					i, j, test.expectedWebSocketConfig[j].Command, actualWebSocketConfig.Command)
 			}
 
+			if !reflect.DeepEqual(actualWebSocketConfig.Origins, test.expectedWebSocketConfig[j].Origins) {
+				t.Errorf("Test %d expected %dth WebSocket Config Origins to be %v, but got %v",
+					i, j, test.expectedWebSocketConfig[j].Origins, actualWebSocketConfig.Origins)
+			}
+
+			if actualWebSocketConfig.MaxConnections != test.expectedWebSocketConfig[j].MaxConnections {
+				t.Errorf("Test %d expected %dth WebSocket Config MaxConnections to be %d, but got %d",
+					i, j, test.expectedWebSocketConfig[j].MaxConnections, actualWebSocketConfig.MaxConnections)
+			}
+
+			if actualWebSocketConfig.IdleTimeout != test.expectedWebSocketConfig[j].IdleTimeout {
+				t.Errorf("Test %d expected %dth WebSocket Config IdleTimeout to be %v, but got %v",
+					i, j, test.expectedWebSocketConfig[j].IdleTimeout, actualWebSocketConfig.IdleTimeout)
+			}
+
 		}
 	}
 
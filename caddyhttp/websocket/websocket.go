@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -61,6 +62,21 @@ type (
 		Command   string
 		Arguments []string
 		Respawn   bool // TODO: Not used, but parser supports it until we decide on it
+
+		// Origins are the origins that may connect, like
+		// https://app.example.com or https://*.example.com;
+		// if empty, any origin may connect
+		Origins []string
+
+		// MaxConnections is how many connections, and processes,
+		// there may be at the same time; 0 means no limit
+		MaxConnections int
+
+		// IdleTimeout is how long a connection may go without a
+		// message either way before it is closed; 0 means forever
+		IdleTimeout time.Duration
+
+		active *int32 // number of connections; shared by all copies
 	}
 )
 
@@ -79,10 +95,21 @@ func (ws WebSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, erro
 // serveWS is used for setting and upgrading the HTTP connection to a websocket connection.
 // It also spawns the child process that is associated with matched HTTP path/url.
 func serveWS(w http.ResponseWriter, r *http.Request, config *Config) (int, error) {
+	if !config.allowOrigin(r.Header.Get("Origin")) {
+		return http.StatusForbidden, nil
+	}
+	if config.MaxConnections > 0 && config.active != nil {
+		if atomic.AddInt32(config.active, 1) > int32(config.MaxConnections) {
+			atomic.AddInt32(config.active, -1)
+			return http.StatusServiceUnavailable, nil
+		}
+		defer atomic.AddInt32(config.active, -1)
+	}
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		CheckOrigin:     func(r *http.Request) bool { return true }, // checked above
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -116,8 +143,11 @@ func serveWS(w http.ResponseWriter, r *http.Request, config *Config) (int, error
 	}
 
 	done := make(chan struct{})
-	go pumpStdout(conn, stdout, done)
-	pumpStdin(conn, stdin)
+	idle := newIdleTimer(conn, config.IdleTimeout)
+	defer idle.stop()
+	go pumpStdout(conn, stdout, done, idle)
+	go closeOnShutdown(conn, httpserver.ShutdownNotify(r), done)
+	pumpStdin(conn, stdin, idle)
 
 	stdin.Close() // close stdin to end the process
 
@@ -144,6 +174,63 @@ func serveWS(w http.ResponseWriter, r *http.Request, config *Config) (int, error
 	return 0, nil
 }
 
+// allowOrigin returns true if a connection from origin,
+// the value of the Origin header, may be upgraded.
+func (c *Config) allowOrigin(origin string) bool {
+	if len(c.Origins) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.Origins {
+		allowed = strings.ToLower(allowed)
+		if star := strings.Index(allowed, "*"); star >= 0 {
+			// wildcard subdomain, like https://*.example.com
+			prefix, suffix := allowed[:star], allowed[star+1:]
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+				return true
+			}
+		} else if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// idleTimer closes a connection with a close frame when
+// there has been no message either way for a while.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newIdleTimer returns a started idleTimer for conn.
+// If timeout is 0, the timer never goes off.
+func newIdleTimer(conn *websocket.Conn, timeout time.Duration) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"), time.Now().Add(writeWait))
+			conn.Close()
+		})
+	}
+	return t
+}
+
+// reset restarts the timer because of activity.
+func (t *idleTimer) reset() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
 // buildEnv creates the meta-variables for the child process according
 // to the CGI 1.1 specification: http://tools.ietf.org/html/rfc3875#section-4.1
 // cmdPath should be the path of the command being run.
@@ -201,7 +288,7 @@ func buildEnv(cmdPath string, r *http.Request) (metavars []string, err error) {
 
 // pumpStdin handles reading data from the websocket connection and writing
 // it to stdin of the process.
-func pumpStdin(conn *websocket.Conn, stdin io.WriteCloser) {
+func pumpStdin(conn *websocket.Conn, stdin io.WriteCloser, idle *idleTimer) {
 	// Setup our connection's websocket ping/pong handlers from our const values.
 	defer conn.Close()
 	conn.SetReadLimit(maxMessageSize)
@@ -212,6 +299,7 @@ func pumpStdin(conn *websocket.Conn, stdin io.WriteCloser) {
 		if err != nil {
 			break
 		}
+		idle.reset()
 		message = append(message, '\n')
 		if _, err := stdin.Write(message); err != nil {
 			break
@@ -221,7 +309,7 @@ func pumpStdin(conn *websocket.Conn, stdin io.WriteCloser) {
 
 // pumpStdout handles reading data from stdout of the process and writing
 // it to websocket connection.
-func pumpStdout(conn *websocket.Conn, stdout io.Reader, done chan struct{}) {
+func pumpStdout(conn *websocket.Conn, stdout io.Reader, done chan struct{}, idle *idleTimer) {
 	go pinger(conn, done)
 	defer func() {
 		conn.Close()
@@ -230,6 +318,7 @@ func pumpStdout(conn *websocket.Conn, stdout io.Reader, done chan struct{}) {
 
 	s := bufio.NewScanner(stdout)
 	for s.Scan() {
+		idle.reset()
 		conn.SetWriteDeadline(time.Now().Add(writeWait))
 		if err := conn.WriteMessage(websocket.TextMessage, bytes.TrimSpace(s.Bytes())); err != nil {
 			break
@@ -240,6 +329,17 @@ func pumpStdout(conn *websocket.Conn, stdout io.Reader, done chan struct{}) {
 	}
 }
 
+// closeOnShutdown sends a close frame to the client and closes
+// conn when shutdown is closed, which ends the other pumps.
+func closeOnShutdown(conn *websocket.Conn, shutdown <-chan struct{}, done chan struct{}) {
+	select {
+	case <-shutdown:
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(writeWait))
+		conn.Close()
+	case <-done:
+	}
+}
+
 // pinger simulates the websocket to keep it alive with ping messages.
 func pinger(conn *websocket.Conn, done chan struct{}) {
 	ticker := time.NewTicker(pingPeriod)
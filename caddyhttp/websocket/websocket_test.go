@@ -2,7 +2,14 @@ package websocket
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestBuildEnv(t *testing.T) {
@@ -11,6 +18,7 @@ func TestBuildEnv(t *testing.T) {
 		t.Fatal("Error setting up request:", err)
 	}
 	req.RemoteAddr = "localhost:50302"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
 
 	env, err := buildEnv("/bin/command", req)
 	if err != nil {
@@ -19,4 +27,171 @@ func TestBuildEnv(t *testing.T) {
 	if len(env) == 0 {
 		t.Fatalf("Expected non-empty environment; got %#v", env)
 	}
+	for _, expected := range []string{"REMOTE_ADDR=localhost", "HTTP_X_FORWARDED_FOR=10.0.0.1"} {
+		found := false
+		for _, v := range env {
+			if v == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s in environment; got %#v", expected, env)
+		}
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	config := Config{Origins: []string{"https://app.example.com", "https://*.example.org"}}
+	for i, test := range []struct {
+		origin string
+		allow  bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://.example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"https://evilexample.org", false},
+		{"", false},
+	} {
+		if got := config.allowOrigin(test.origin); got != test.allow {
+			t.Errorf("Test %d: Expected origin '%s' allowed to be %v, got %v", i, test.origin, test.allow, got)
+		}
+	}
+
+	if !(&Config{}).allowOrigin("https://anywhere.com") {
+		t.Error("Expected any origin to be allowed without an allowlist")
+	}
+}
+
+// newTestServer serves config with the websocket
+// middleware, writing the status it returns, if any.
+func newTestServer(t *testing.T, config Config) *httptest.Server {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test command is not available on Windows")
+	}
+	if _, err := exec.LookPath(config.Command); err != nil {
+		t.Skipf("%s is not available: %v", config.Command, err)
+	}
+	config.active = new(int32)
+	ws := WebSocket{Sockets: []Config{config}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := ws.ServeHTTP(w, r)
+		if status >= 400 {
+			w.WriteHeader(status)
+		}
+	}))
+}
+
+func dial(srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	header := make(http.Header)
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+}
+
+func TestOriginRejected(t *testing.T) {
+	srv := newTestServer(t, Config{Path: "/", Command: "cat", Origins: []string{"https://app.example.com"}})
+	defer srv.Close()
+
+	_, resp, err := dial(srv, "https://evil.com")
+	if err == nil {
+		t.Fatal("Expected connection from other origin to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %v", http.StatusForbidden, resp)
+	}
+
+	conn, _, err := dial(srv, "https://app.example.com")
+	if err != nil {
+		t.Fatalf("Expected connection from allowed origin, got: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Errorf("Expected echo 'hello', got '%s'", msg)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv := newTestServer(t, Config{Path: "/", Command: "cat", MaxConnections: 2})
+	defer srv.Close()
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := dial(srv, "")
+		if err != nil {
+			t.Fatalf("Connection %d: Expected no error, got: %v", i, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	_, resp, err := dial(srv, "")
+	if err == nil {
+		t.Fatal("Expected connection beyond the limit to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %v", http.StatusServiceUnavailable, resp)
+	}
+
+	// closing a connection makes room for another one
+	conns[0].Close()
+	var conn *websocket.Conn
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if conn, _, err = dial(srv, ""); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Expected connection after one was closed, got: %v", err)
+	}
+	conn.Close()
+	conns[1].Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestServer(t, Config{Path: "/", Command: "cat", IdleTimeout: 200 * time.Millisecond})
+	defer srv.Close()
+
+	conn, _, err := dial(srv, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer conn.Close()
+
+	// activity keeps the connection open
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+			t.Fatalf("Message %d: %v", i, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("Message %d: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Fatal("Expected the messages to take longer than the idle timeout")
+	}
+
+	// idleness gets it closed with a close frame
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected a normal close frame, got: %v", err)
+	}
 }
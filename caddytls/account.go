@@ -0,0 +1,62 @@
+package caddytls
+
+import (
+	"strings"
+	"sync"
+)
+
+// accountSeparator separates the email address from the
+// hostname in the name of an account that is not shared.
+const accountSeparator = "#"
+
+// accountName returns the name under which the ACME account of
+// the config for hostname that does not share its account with
+// other configs is stored, if its email address is email.
+func accountName(email, hostname string) string {
+	return email + accountSeparator + strings.ToLower(hostname)
+}
+
+// accountName returns the name under which the ACME account that
+// c uses is stored at its CA: its email address, which the configs
+// that use the same address share, or, if c does not share its
+// account, the address and its hostname.
+func (c *Config) accountName() string {
+	if c.NoAccountReuse {
+		return accountName(c.ACMEEmail, c.Hostname)
+	}
+	return c.ACMEEmail
+}
+
+// issuingAccount returns the name of the account that obtained
+// the certificate whose metadata is meta, so that it is renewed
+// with the same account, or the account of c if the metadata is
+// from before the account was recorded.
+func (c *Config) issuingAccount(meta certMetadata) string {
+	if meta.Account != nil {
+		return *meta.Account
+	}
+	return c.accountName()
+}
+
+var (
+	// accountLocks are the locks of the ACME accounts
+	// while they are loaded or registered, by the CA
+	// URL and the name of the account
+	accountLocks   = make(map[string]*sync.Mutex)
+	accountLocksMu sync.Mutex
+)
+
+// lockAccount locks the ACME account stored as name at caURL
+// until the returned function is called.
+func lockAccount(caURL, name string) (unlock func()) {
+	key := strings.ToLower(caURL) + " " + strings.ToLower(name)
+	accountLocksMu.Lock()
+	lock, ok := accountLocks[key]
+	if !ok {
+		lock = new(sync.Mutex)
+		accountLocks[key] = lock
+	}
+	accountLocksMu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
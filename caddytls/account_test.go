@@ -0,0 +1,182 @@
+package caddytls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// stubRegistration replaces registerAccount with a CA that registers
+// each account slowly, and records how often it registered each
+// account, by the name it is stored under, until restore is called.
+func stubRegistration(caURL string) (registrations map[string]int, restore func()) {
+	registrations = make(map[string]int)
+	var mu sync.Mutex
+	original := registerAccount
+	registerAccount = func(client *acme.Client, user *User, allowPrompts bool) error {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		registrations[user.storageName()]++
+		user.Registration = &acme.RegistrationResource{URI: fmt.Sprintf("%s/reg/%d", caURL, len(registrations))}
+		return nil
+	}
+	return registrations, func() { registerAccount = original }
+}
+
+// accountTestCA returns the directory of a CA, and
+// storage that configs created by config share.
+func accountTestCA(t *testing.T) (ca *httptest.Server, storage FileStorage, config func(email, name string) *Config) {
+	ca = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := "http://" + r.Host
+		json.NewEncoder(w).Encode(map[string]string{
+			"new-reg":     base + "/new-reg",
+			"new-authz":   base + "/new-authz",
+			"new-cert":    base + "/new-cert",
+			"revoke-cert": base + "/revoke-cert",
+		})
+	}))
+	dir, err := ioutil.TempDir("", "caddytls_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = FileStorage(dir)
+	creator := func(caURL *url.URL) (Storage, error) { return storage, nil }
+	config = func(email, name string) *Config {
+		return &Config{Managed: true, Hostname: name, ACMEEmail: email, CAUrl: ca.URL + "/directory", StorageCreator: creator}
+	}
+	return ca, storage, config
+}
+
+func TestAccountPerEmail(t *testing.T) {
+	ca, storage, config := accountTestCA(t)
+	defer ca.Close()
+	defer os.RemoveAll(string(storage))
+	registrations, restore := stubRegistration(ca.URL)
+	defer restore()
+
+	a := config("a@example.com", "a.example.com")
+	b := config("b@example.com", "b.example.com")
+	shared := config("a@example.com", "c.example.com")
+	own := config("a@example.com", "d.example.com")
+	own.NoAccountReuse = true
+	configs := []*Config{a, b, shared, own}
+
+	// the first clients of each account are made at the same time
+	accounts := make([][2]string, len(configs))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, cfg := range configs {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i, j int, cfg *Config) {
+				defer wg.Done()
+				client, err := newACMEClient(cfg, cfg.accountName(), false)
+				if err != nil {
+					t.Errorf("Config %d: Expected no error, got: %v", i, err)
+					return
+				}
+				mu.Lock()
+				accounts[i][j] = client.user.Registration.URI
+				mu.Unlock()
+			}(i, j, cfg)
+		}
+	}
+	wg.Wait()
+
+	expected := map[string]int{"a@example.com": 1, "b@example.com": 1, "a@example.com#d.example.com": 1}
+	if len(registrations) != len(expected) {
+		t.Errorf("Expected registrations %v, got %v", expected, registrations)
+	}
+	for name, n := range expected {
+		if registrations[name] != n {
+			t.Errorf("Expected account %s to be registered %d times, got %d", name, n, registrations[name])
+		}
+		if data, err := storage.LoadUser(name); err != nil || len(data.Key) == 0 {
+			t.Errorf("Expected account %s to be stored, got error %v", name, err)
+		}
+	}
+	for i := range configs {
+		if accounts[i][0] == "" || accounts[i][0] != accounts[i][1] {
+			t.Errorf("Config %d: Expected both clients to use one account, got %v", i, accounts[i])
+		}
+	}
+	if accounts[0][0] != accounts[2][0] {
+		t.Errorf("Expected the configs with the same email to share the account, got %s and %s", accounts[0][0], accounts[2][0])
+	}
+	if accounts[0][0] == accounts[1][0] || accounts[0][0] == accounts[3][0] || accounts[1][0] == accounts[3][0] {
+		t.Errorf("Expected distinct accounts for each email and for the config that does not share, got %v", accounts)
+	}
+	if email := storage.MostRecentUserEmail(); email != "a@example.com" && email != "b@example.com" {
+		t.Errorf("Expected the account that is not shared not to be the most recent email, got %s", email)
+	}
+}
+
+func TestRenewWithIssuingAccount(t *testing.T) {
+	ca, storage, config := accountTestCA(t)
+	defer ca.Close()
+	defer os.RemoveAll(string(storage))
+
+	var used []string
+	original := newACMEClient
+	newACMEClient = func(config *Config, account string, allowPrompts bool) (*ACMEClient, error) {
+		used = append(used, account)
+		return nil, errors.New("not contacting the CA")
+	}
+	defer func() { newACMEClient = original }()
+
+	// obtained with the account of b, before the site switched to a
+	issuer := User{Email: "b@example.com", Registration: &acme.RegistrationResource{URI: ca.URL + "/reg/2"}}
+	err := saveCertResource(storage, acme.CertificateResource{
+		Domain:      "site.example.com",
+		PrivateKey:  []byte("key"),
+		Certificate: []byte("cert"),
+	}, "", issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteData, _ := storage.LoadSite("site.example.com")
+	if cert, _ := loadCertResource(siteData); cert.AccountRef != ca.URL+"/reg/2" {
+		t.Errorf("Expected the account URI in the metadata, got '%s'", cert.AccountRef)
+	}
+	// from before the account was recorded
+	err = storage.StoreSite("old.example.com", &SiteData{Cert: []byte("cert"), Key: []byte("key"), Meta: []byte(`{"domain":"old.example.com"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		cfg      *Config
+		renew    bool
+		expected string
+	}{
+		{config("a@example.com", "site.example.com"), true, "b@example.com"},
+		{config("a@example.com", "old.example.com"), true, "a@example.com"},
+		{config("a@example.com", "new.example.com"), false, "a@example.com"},
+	} {
+		used = nil
+		if test.renew {
+			err = test.cfg.renewCertName(test.cfg.Hostname, false)
+		} else {
+			test.cfg.NoAccountReuse = true
+			test.expected = accountName(test.expected, test.cfg.Hostname)
+			err = test.cfg.obtainCertName(test.cfg.Hostname, false)
+		}
+		if err == nil {
+			t.Errorf("Test %d: Expected the error of the stub client, got none", i)
+		}
+		if len(used) != 1 || used[0] != test.expected {
+			t.Errorf("Test %d: Expected a client for account %s, got %v", i, test.expected, used)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package caddytls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// AuditEntry is a line of the audit log, which records every
+// certificate that is obtained, renewed or revoked.
+type AuditEntry struct {
+	// Time is when the operation completed
+	Time time.Time `json:"time"`
+
+	// Operation is "obtain", "renew" or "revoke"
+	Operation string `json:"operation"`
+
+	// Names are the subject alternative names of the certificate
+	Names []string `json:"names"`
+
+	// Serial is the serial number of the certificate, in hex
+	Serial string `json:"serial"`
+
+	// Issuer is the distinguished name of the issuer
+	Issuer string `json:"issuer"`
+
+	// NotBefore and NotAfter bound the validity of the certificate
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// SHA256 is the hex SHA-256 hash of the DER of the certificate
+	SHA256 string `json:"sha256"`
+
+	// OrderURL is the URL of the certificate at the CA
+	OrderURL string `json:"order_url,omitempty"`
+
+	// CAUrl is the directory URL of the CA
+	CAUrl string `json:"ca,omitempty"`
+
+	// Config is the hostname of the TLS config that
+	// caused the operation
+	Config string `json:"config,omitempty"`
+
+	// Prev is the hex SHA-256 hash of the previous line of
+	// the log, if the log is hash-chained
+	Prev string `json:"prev,omitempty"`
+}
+
+// newAuditEntry describes the leaf certificate of the PEM bundle.
+func newAuditEntry(operation string, bundle []byte) (AuditEntry, error) {
+	entry := AuditEntry{Time: time.Now().UTC(), Operation: operation}
+	var block *pem.Block
+	for {
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return entry, errors.New("no certificate in bundle")
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return entry, err
+	}
+	sum := sha256.Sum256(cert.Raw)
+	entry.Names = cert.DNSNames
+	entry.Serial = cert.SerialNumber.Text(16)
+	entry.Issuer = distinguishedName(cert.Issuer)
+	entry.NotBefore = cert.NotBefore.UTC()
+	entry.NotAfter = cert.NotAfter.UTC()
+	entry.SHA256 = hex.EncodeToString(sum[:])
+	return entry, nil
+}
+
+// distinguishedName formats the common parts of name.
+func distinguishedName(name pkix.Name) string {
+	var parts []string
+	if name.CommonName != "" {
+		parts = append(parts, "CN="+name.CommonName)
+	}
+	for _, o := range name.Organization {
+		parts = append(parts, "O="+o)
+	}
+	for _, c := range name.Country {
+		parts = append(parts, "C="+c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// audit records operation on cert in the audit log of the
+// config of c, if it has one. Writing the log never blocks
+// or fails the operation; failures are logged instead.
+func (c *ACMEClient) audit(operation string, cert acme.CertificateResource) {
+	if c.config.AuditLog == "" {
+		return
+	}
+	entry, err := newAuditEntry(operation, cert.Certificate)
+	if err != nil {
+		log.Printf("[ERROR] Audit log %s: %s %v: %v", c.config.AuditLog, operation, cert.Domain, err)
+		return
+	}
+	entry.OrderURL = cert.CertURL
+	entry.CAUrl = c.config.CAUrl
+	entry.Config = c.config.Hostname
+	getAuditLog(c.config.AuditLog).record(entry, c.config.AuditChain)
+}
+
+// auditQueueSize is how many entries may wait to be
+// written to an audit log before new ones are dropped.
+const auditQueueSize = 100
+
+var (
+	// auditLogs are the open audit logs, by file name.
+	auditLogs   = make(map[string]*auditLog)
+	auditLogsMu sync.Mutex
+)
+
+// getAuditLog returns the audit log that writes to file.
+func getAuditLog(file string) *auditLog {
+	auditLogsMu.Lock()
+	defer auditLogsMu.Unlock()
+	l, ok := auditLogs[file]
+	if !ok {
+		l = &auditLog{file: file, queue: make(chan auditRecord, auditQueueSize)}
+		go l.write()
+		auditLogs[file] = l
+	}
+	return l
+}
+
+// FlushAuditLogs waits until the entries that were recorded in
+// the audit logs are written, or failed to be. It should be called
+// before the process exits.
+func FlushAuditLogs() {
+	auditLogsMu.Lock()
+	logs := make([]*auditLog, 0, len(auditLogs))
+	for _, l := range auditLogs {
+		logs = append(logs, l)
+	}
+	auditLogsMu.Unlock()
+	for _, l := range logs {
+		l.pending.Wait()
+	}
+}
+
+// auditLog appends entries to a file in the background,
+// in the order in which they were recorded.
+type auditLog struct {
+	file    string
+	queue   chan auditRecord
+	pending sync.WaitGroup
+
+	// the last line written, for the hash chain
+	last     []byte
+	lastRead bool
+}
+
+// auditRecord is an entry that waits to be written.
+type auditRecord struct {
+	entry AuditEntry
+	chain bool
+}
+
+// record queues entry to be written to l, linked to
+// the line before it if chain is true.
+func (l *auditLog) record(entry AuditEntry, chain bool) {
+	l.pending.Add(1)
+	select {
+	case l.queue <- auditRecord{entry, chain}:
+	default:
+		l.pending.Done()
+		log.Printf("[ERROR] Audit log %s: too many entries waiting to be written; dropping %s of %v",
+			l.file, entry.Operation, entry.Names)
+	}
+}
+
+// write writes the queued entries to the file of l.
+func (l *auditLog) write() {
+	for rec := range l.queue {
+		err := l.append(rec)
+		if err != nil {
+			log.Printf("[ERROR] Audit log %s: writing %s of %v: %v", l.file, rec.entry.Operation, rec.entry.Names, err)
+		}
+		l.pending.Done()
+	}
+}
+
+// append writes one line to the file of l.
+func (l *auditLog) append(rec auditRecord) error {
+	f, err := os.OpenFile(l.file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !l.lastRead {
+		l.last, err = lastLine(f)
+		if err != nil {
+			return err
+		}
+		l.lastRead = true
+	}
+	if rec.chain && l.last != nil {
+		sum := sha256.Sum256(l.last)
+		rec.entry.Prev = hex.EncodeToString(sum[:])
+	}
+	line, err := json.Marshal(rec.entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		l.lastRead = false // we do not know what made it to the file
+		return err
+	}
+	l.last = line
+	return nil
+}
+
+// lastLine returns the last line of f, without its
+// newline, or nil if f is empty.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	tail := int64(64 * 1024)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	_, err = f.ReadAt(buf, size-tail)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	} else if tail < size {
+		return nil, errors.New("last line is too long")
+	}
+	return buf, nil
+}
+
+// VerifyAuditLog checks that the lines of the audit log in file are
+// entries and that, from the first entry that is linked to the line
+// before it on, each entry is linked to the line before it. It returns
+// the number of entries. A log whose first entry is linked to a line
+// was truncated at the start.
+func VerifyAuditLog(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var prev []byte
+	var chained bool
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, fmt.Errorf("line %d: not an audit entry: %v", lineNum, err)
+		}
+		if entry.Prev != "" || chained {
+			if prev == nil {
+				return 0, fmt.Errorf("line %d: linked to a line that is missing; the log was truncated", lineNum)
+			}
+			sum := sha256.Sum256(prev)
+			if entry.Prev != hex.EncodeToString(sum[:]) {
+				return 0, fmt.Errorf("line %d: not linked to line %d; the log was altered", lineNum, lineNum-1)
+			}
+			chained = true
+		}
+		prev = append(prev[:0], line...)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return lineNum, nil
+}
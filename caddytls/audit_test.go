@@ -0,0 +1,167 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "issuance.log")
+	defer func() {
+		auditLogsMu.Lock()
+		delete(auditLogs, file)
+		auditLogsMu.Unlock()
+	}()
+
+	c := &ACMEClient{config: &Config{
+		Hostname:   "example.com",
+		CAUrl:      "https://ca.test/directory",
+		AuditLog:   file,
+		AuditChain: true,
+	}}
+	names := []string{"a.example.com", "b.example.com", "c.example.com"}
+	var certs [][]byte
+	for i, name := range names {
+		certPEM, _ := makeTestCertPEM(t, name)
+		certs = append(certs, certPEM)
+		c.audit([]string{"obtain", "renew", "revoke"}[i], acme.CertificateResource{
+			Domain:      name,
+			CertURL:     "https://ca.test/cert/" + name,
+			Certificate: certPEM,
+		})
+	}
+	c.audit("obtain", acme.CertificateResource{Domain: "bad.example.com", Certificate: []byte("not a cert")})
+	FlushAuditLogs()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, got %d:\n%s", len(lines), contents)
+	}
+	for i, line := range lines {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Entry %d: %v", i, err)
+		}
+		block, _ := pem.Decode(certs[i])
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		sum := sha256.Sum256(block.Bytes)
+		if entry.Operation != []string{"obtain", "renew", "revoke"}[i] {
+			t.Errorf("Entry %d: Expected operation of the call, got '%s'", i, entry.Operation)
+		}
+		if len(entry.Names) != 1 || entry.Names[0] != names[i] {
+			t.Errorf("Entry %d: Expected names [%s], got %v", i, names[i], entry.Names)
+		}
+		if entry.SHA256 != hex.EncodeToString(sum[:]) || entry.Serial != "1" || entry.Issuer != "CN="+names[i] {
+			t.Errorf("Entry %d: Expected hash, serial and issuer of the certificate, got %+v", i, entry)
+		}
+		if !entry.NotAfter.Equal(cert.NotAfter) || !entry.NotBefore.Equal(cert.NotBefore) {
+			t.Errorf("Entry %d: Expected validity of the certificate, got %v to %v", i, entry.NotBefore, entry.NotAfter)
+		}
+		if entry.OrderURL != "https://ca.test/cert/"+names[i] || entry.Config != "example.com" || entry.CAUrl != "https://ca.test/directory" {
+			t.Errorf("Entry %d: Expected URL, config and CA, got %+v", i, entry)
+		}
+		if (i == 0) != (entry.Prev == "") {
+			t.Errorf("Entry %d: Expected only entries after the first to be linked, got prev '%s'", i, entry.Prev)
+		}
+	}
+
+	if n, err := VerifyAuditLog(file); err != nil || n != 3 {
+		t.Errorf("Expected intact log with 3 entries, got %d, %v", n, err)
+	}
+
+	// after a restart, the chain continues where it ended
+	auditLogsMu.Lock()
+	delete(auditLogs, file)
+	auditLogsMu.Unlock()
+	c.audit("renew", acme.CertificateResource{Domain: "a.example.com", Certificate: certs[0]})
+	getAuditLog(file).pending.Wait()
+	if n, err := VerifyAuditLog(file); err != nil || n != 4 {
+		t.Errorf("Expected intact log with 4 entries after restart, got %d, %v", n, err)
+	}
+
+	// tampering is detected
+	contents, err = ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	for i, test := range []struct {
+		lines    []string
+		expected string
+	}{
+		{[]string{lines[0], strings.Replace(lines[1], "b.example.com", "evil.example.com", 1), lines[2], lines[3]}, "line 3: not linked"},
+		{[]string{lines[0], lines[2], lines[3]}, "line 2: not linked"},
+		{lines[1:], "line 1: linked to a line that is missing"},
+		{[]string{lines[0], lines[1], "{garbage", lines[3]}, "line 3: not an audit entry"},
+	} {
+		tampered := filepath.Join(dir, "tampered.log")
+		if err := ioutil.WriteFile(tampered, []byte(strings.Join(test.lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := VerifyAuditLog(tampered)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Test %d: Expected error containing '%s', got: %v", i, test.expected, err)
+		}
+	}
+}
+
+func TestAuditLogUnchained(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "issuance.log")
+	defer func() {
+		auditLogsMu.Lock()
+		delete(auditLogs, file)
+		auditLogsMu.Unlock()
+	}()
+
+	c := &ACMEClient{config: &Config{AuditLog: file}}
+	certPEM, _ := makeTestCertPEM(t, "example.com")
+	c.audit("obtain", acme.CertificateResource{Domain: "example.com", Certificate: certPEM})
+	c.audit("renew", acme.CertificateResource{Domain: "example.com", Certificate: certPEM})
+	getAuditLog(file).pending.Wait()
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte(`"prev"`)) {
+		t.Errorf("Expected no hash chain, got:\n%s", contents)
+	}
+	if n, err := VerifyAuditLog(file); err != nil || n != 2 {
+		t.Errorf("Expected valid log with 2 entries, got %d, %v", n, err)
+	}
+
+	// without an audit log, nothing is written
+	c = &ACMEClient{config: new(Config)}
+	c.audit("obtain", acme.CertificateResource{Domain: "example.com", Certificate: certPEM})
+	auditLogsMu.Lock()
+	n := len(auditLogs)
+	auditLogsMu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected only the configured audit log to be open, got %d", n)
+	}
+}
@@ -0,0 +1,216 @@
+package caddytls
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func init() {
+	caddy.RegisterEventHook("tls_background_obtain", startBackgroundObtain)
+}
+
+// BackgroundObtainConcurrency is how many certificates are
+// obtained in the background at the same time.
+const BackgroundObtainConcurrency = 4
+
+// maxBackgroundRetryDelay is the longest wait before trying
+// again to obtain a certificate in the background.
+const maxBackgroundRetryDelay = time.Hour
+
+// backgroundRetryDelay is how long to wait before trying again to
+// obtain a certificate in the background the first time it fails;
+// the wait doubles with each failure. It is a variable so that
+// tests can make it short.
+var backgroundRetryDelay = time.Minute
+
+// pendingCert is a name whose certificate is being
+// obtained in the background.
+type pendingCert struct {
+	cfg *Config
+
+	// temporary is the self-signed certificate that is
+	// served for the name until then; it is made when
+	// it is first needed
+	temporary *Certificate
+}
+
+var (
+	// queuedCerts are the configs, by name, whose certificates
+	// are to be obtained in the background once the servers of
+	// the instance that is starting are listening
+	queuedCerts = make(map[string]*Config)
+
+	// pendingCerts are the names whose certificates are being
+	// obtained in the background
+	pendingCerts = make(map[string]*pendingCert)
+
+	pendingCertsMu sync.Mutex
+
+	// backgroundSlots limits how many certificates are
+	// obtained in the background at the same time
+	backgroundSlots = make(chan struct{}, BackgroundObtainConcurrency)
+)
+
+// ObtainCertInBackground queues the certificate for c.Hostname to be
+// obtained in the background once the servers are listening, so that
+// the sites whose certificates are in storage are served right away,
+// and returns true; until it is obtained, handshakes for the name are
+// served per c.StrictSNI. It returns false, and queues nothing, if c
+// does not manage a certificate that is missing from storage, or if c
+// blocks startup until its certificate is ready; then ObtainCert must
+// be used. If allowPrompts is true, the user may be prompted for an
+// email address now, since they cannot be once startup is done.
+func (c *Config) ObtainCertInBackground(allowPrompts bool) (bool, error) {
+	if c.BlockUntilReady || !c.Managed || c.SelfSigned || !HostQualifies(c.Hostname) {
+		return false, nil
+	}
+	storage, err := c.StorageFor(c.CAUrl)
+	if err != nil {
+		return false, err
+	}
+	if storage.SiteExists(c.Hostname) {
+		return false, nil
+	}
+	if c.ACMEEmail == "" {
+		c.ACMEEmail = getEmail(storage, allowPrompts)
+	}
+	pendingCertsMu.Lock()
+	queuedCerts[strings.ToLower(c.Hostname)] = c
+	pendingCertsMu.Unlock()
+	return true, nil
+}
+
+// ObtainingInBackground returns true if the certificate for name
+// is queued or being obtained in the background, so that it is
+// not in storage to be loaded yet.
+func ObtainingInBackground(name string) bool {
+	name = strings.ToLower(name)
+	pendingCertsMu.Lock()
+	defer pendingCertsMu.Unlock()
+	_, queued := queuedCerts[name]
+	_, pending := pendingCerts[name]
+	return queued || pending
+}
+
+// startBackgroundObtain starts obtaining the queued certificates
+// in the background when an instance has started its servers. The
+// names that the new instance does not serve any more are dropped;
+// the ones that were already being obtained carry on.
+func startBackgroundObtain(eventName string, payload interface{}) error {
+	if eventName != caddy.InstanceStartupEvent {
+		return nil
+	}
+	pendingCertsMu.Lock()
+	queued := queuedCerts
+	queuedCerts = make(map[string]*Config)
+	for name := range pendingCerts {
+		if _, ok := queued[name]; !ok {
+			delete(pendingCerts, name)
+		}
+	}
+	var started []string
+	for name, cfg := range queued {
+		if p, ok := pendingCerts[name]; ok {
+			p.cfg = cfg
+			continue
+		}
+		p := &pendingCert{cfg: cfg}
+		pendingCerts[name] = p
+		started = append(started, name)
+		go obtainPending(name, p)
+	}
+	pendingCertsMu.Unlock()
+	if len(started) > 0 {
+		log.Printf("[INFO] Obtaining certificates for %v in the background", started)
+	}
+	return nil
+}
+
+// obtainInBackground obtains the certificate for name with cfg
+// and stores it. It is a variable so that tests can stand in for
+// the CA.
+var obtainInBackground = func(cfg *Config, name string) error {
+	return cfg.obtainCertName(name, false)
+}
+
+// obtainPending obtains the certificate for name, which is pending
+// as p, and swaps it into the cache, trying again after a while each
+// time that fails, until it succeeds or name is dropped.
+func obtainPending(name string, p *pendingCert) {
+	delay := backgroundRetryDelay
+	for {
+		pendingCertsMu.Lock()
+		cfg := p.cfg
+		current := pendingCerts[name] == p
+		pendingCertsMu.Unlock()
+		if !current {
+			return
+		}
+
+		backgroundSlots <- struct{}{}
+		err := obtainInBackground(cfg, name)
+		if err == nil {
+			_, err = CacheManagedCertificate(name, cfg)
+		}
+		<-backgroundSlots
+
+		if err == nil {
+			pendingCertsMu.Lock()
+			if pendingCerts[name] == p {
+				delete(pendingCerts, name)
+			}
+			pendingCertsMu.Unlock()
+			log.Printf("[INFO] Certificate for %s is obtained; serving it", name)
+			return
+		}
+		log.Printf("[ERROR] Obtaining certificate for %s in the background; trying again in %v: %v", name, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxBackgroundRetryDelay {
+			delay = maxBackgroundRetryDelay
+		}
+	}
+}
+
+// pendingCertificate returns the certificate to serve for name while
+// its certificate is being obtained in the background, and true, or
+// false if it is not: a temporary self-signed certificate, or, if the
+// config of name is strict, an error.
+func pendingCertificate(name string) (Certificate, bool, error) {
+	name = strings.ToLower(name)
+	pendingCertsMu.Lock()
+	p, ok := pendingCerts[name]
+	var cfg *Config
+	var temporary *Certificate
+	if ok {
+		cfg, temporary = p.cfg, p.temporary
+	}
+	pendingCertsMu.Unlock()
+	if !ok {
+		return Certificate{}, false, nil
+	}
+	if cfg.StrictSNI {
+		return Certificate{}, true, fmt.Errorf("certificate for %s is being obtained; try again later", name)
+	}
+	if temporary != nil {
+		return *temporary, true, nil
+	}
+
+	// the temporary certificate always has a quick key
+	cert, err := newSelfSignedCert(&Config{}, name)
+	if err != nil {
+		return Certificate{}, true, err
+	}
+	cert.Config = cfg
+	pendingCertsMu.Lock()
+	if p.temporary == nil {
+		p.temporary = &cert
+	}
+	cert = *p.temporary
+	pendingCertsMu.Unlock()
+	return cert, true, nil
+}
@@ -0,0 +1,189 @@
+package caddytls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// resetBackground forgets the certificates that are being obtained
+// in the background, and the certificates in the cache.
+func resetBackground() {
+	pendingCertsMu.Lock()
+	queuedCerts = make(map[string]*Config)
+	pendingCerts = make(map[string]*pendingCert)
+	pendingCertsMu.Unlock()
+	certCache = make(map[string]Certificate)
+	certSources = make(map[string]*certSource)
+}
+
+// waitForBackground waits until none of names
+// are being obtained in the background.
+func waitForBackground(t *testing.T, names ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, name := range names {
+		for ObtainingInBackground(name) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the certificate for %s to be obtained in the background", name)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestObtainCertInBackground(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	storage, config, done := checkedStorage(t)
+	defer done()
+	defer resetBackground()
+
+	certPEM, keyPEM := makeTestCertPEM(t, "existing.example.com")
+	if err := storage.StoreSite("existing.example.com", &SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA is slow; it issues once it is released
+	release := make(chan struct{})
+	original := obtainInBackground
+	obtainInBackground = func(cfg *Config, name string) error {
+		<-release
+		certPEM, keyPEM := makeTestCertPEM(t, name)
+		return storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM})
+	}
+	defer func() { obtainInBackground = original }()
+
+	existing, fresh, strict, blocking := config("existing.example.com"), config("new.example.com"),
+		config("strict.example.com"), config("blocking.example.com")
+	strict.StrictSNI = true
+	blocking.BlockUntilReady = true
+	for i, test := range []struct {
+		cfg    *Config
+		queued bool
+	}{
+		{existing, false},
+		{fresh, true},
+		{strict, true},
+		{blocking, false},
+		{&Config{Managed: true, Hostname: "localhost", StorageCreator: existing.StorageCreator}, false},
+	} {
+		queued, err := test.cfg.ObtainCertInBackground(false)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if queued != test.queued {
+			t.Errorf("Test %d: Expected queued to be %v, got %v", i, test.queued, queued)
+		}
+	}
+	if _, err := CacheManagedCertificate("existing.example.com", existing); err != nil {
+		t.Fatal(err)
+	}
+	startBackgroundObtain(caddy.InstanceStartupEvent, caddy.InstanceEventInfo{})
+
+	cg := configGroup{"existing.example.com": existing, "new.example.com": fresh, "strict.example.com": strict}
+	served := func(name string) (*x509.Certificate, error) {
+		cert, err := cg.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(cert.Certificate[0])
+	}
+
+	// while the CA is working, the site in storage is served,
+	// and the new sites get the fallback of their policy
+	if leaf, err := served("existing.example.com"); err != nil || leaf.Subject.CommonName != "existing.example.com" {
+		t.Errorf("Expected the stored certificate to be served right away, got %v (%v)", leaf, err)
+	}
+	temporary, err := served("new.example.com")
+	if err != nil {
+		t.Fatalf("Expected a temporary certificate, got error: %v", err)
+	}
+	if len(temporary.Subject.Organization) == 0 || temporary.Subject.Organization[0] != "Caddy Self-Signed" ||
+		len(temporary.DNSNames) != 1 || temporary.DNSNames[0] != "new.example.com" {
+		t.Errorf("Expected a self-signed certificate for new.example.com, got %v %v", temporary.Subject, temporary.DNSNames)
+	}
+	if again, _ := served("NEW.example.com"); again == nil || again.SerialNumber.Cmp(temporary.SerialNumber) != 0 {
+		t.Error("Expected the same temporary certificate to be served each time")
+	}
+	if _, err := served("strict.example.com"); err == nil {
+		t.Error("Expected the handshake to be refused for a strict config, got a certificate")
+	}
+	if !ObtainingInBackground("new.example.com") || ObtainingInBackground("existing.example.com") {
+		t.Error("Expected only the new sites to be obtained in the background")
+	}
+
+	// once issued, the real certificates are swapped in
+	close(release)
+	waitForBackground(t, "new.example.com", "strict.example.com")
+	for _, name := range []string{"new.example.com", "strict.example.com"} {
+		if leaf, err := served(name); err != nil || leaf.Subject.CommonName != name {
+			t.Errorf("Expected the obtained certificate for %s, got %v (%v)", name, leaf, err)
+		}
+	}
+}
+
+func TestBackgroundObtainRetryAndDrop(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	storage, config, done := checkedStorage(t)
+	defer done()
+	defer resetBackground()
+	originalDelay := backgroundRetryDelay
+	backgroundRetryDelay = time.Millisecond
+	defer func() { backgroundRetryDelay = originalDelay }()
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	original := obtainInBackground
+	obtainInBackground = func(cfg *Config, name string) error {
+		mu.Lock()
+		attempts[name]++
+		n := attempts[name]
+		mu.Unlock()
+		if name == "flaky.example.com" && n >= 3 {
+			certPEM, keyPEM := makeTestCertPEM(t, name)
+			return storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM})
+		}
+		return errors.New("CA is down")
+	}
+	defer func() { obtainInBackground = original }()
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[name]
+	}
+
+	for _, name := range []string{"flaky.example.com", "dropped.example.com"} {
+		if queued, err := config(name).ObtainCertInBackground(false); !queued || err != nil {
+			t.Fatalf("Expected %s to be queued, got %v (%v)", name, queued, err)
+		}
+	}
+	startBackgroundObtain(caddy.InstanceStartupEvent, caddy.InstanceEventInfo{})
+	waitForBackground(t, "flaky.example.com")
+	if n := count("flaky.example.com"); n != 3 {
+		t.Errorf("Expected the certificate to be obtained on the third attempt, got %d attempts", n)
+	}
+	if _, matched, _ := getCertificate("flaky.example.com"); !matched {
+		t.Error("Expected the certificate to be cached once it is obtained")
+	}
+
+	// a reload that no longer serves the site stops trying
+	startBackgroundObtain(caddy.InstanceStartupEvent, caddy.InstanceEventInfo{})
+	if ObtainingInBackground("dropped.example.com") {
+		t.Error("Expected a site that is not served any more to be dropped")
+	}
+	time.Sleep(20 * time.Millisecond)
+	n := count("dropped.example.com")
+	time.Sleep(50 * time.Millisecond)
+	if count("dropped.example.com") != n {
+		t.Error("Expected no more attempts for a site that was dropped")
+	}
+}
@@ -0,0 +1,244 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultGetCertificateTimeout is how long the get_certificate
+// command may run if the config does not say.
+const DefaultGetCertificateTimeout = 30 * time.Second
+
+// execFailureTTL is how long a failure of the get_certificate
+// command for a name is remembered. Until it is forgotten, the
+// handshakes for the name fail (or get the default certificate)
+// without running the command again.
+var execFailureTTL = 30 * time.Second
+
+// execSourcePrefix is the prefix of the source of the certificates
+// that the get_certificate command gave; the name it was run for
+// follows it.
+const execSourcePrefix = "get_certificate:"
+
+// isExecCertificate returns whether cert came from the
+// get_certificate command of its config.
+func isExecCertificate(cert Certificate) bool {
+	return strings.HasPrefix(cert.source, execSourcePrefix) &&
+		cert.Config != nil && len(cert.Config.GetCertificateExec) > 0
+}
+
+// execCertificate runs the get_certificate command of c for name
+// and caches the certificate it writes. The command never runs for
+// the same name more than once at a time; whoever asks for the name
+// while it runs waits for it and gets what it got. If the command
+// failed recently for name, its error is returned without running it.
+// The names the command gets a certificate for, not counting the
+// ones it renews, are limited by max_certs.
+//
+// This method is safe for concurrent use.
+func (c *Config) execCertificate(name string) (Certificate, error) {
+	name = strings.ToLower(name)
+	if err := recentExecFailure(name); err != nil {
+		return Certificate{}, err
+	}
+
+	execCertWaitChansMu.Lock()
+	wait, ok := execCertWaitChans[name]
+	if ok {
+		execCertWaitChansMu.Unlock()
+		<-wait
+		if cert, matched, _ := getCertificate(name); matched {
+			return cert, nil
+		}
+		if err := recentExecFailure(name); err != nil {
+			return Certificate{}, err
+		}
+		return Certificate{}, fmt.Errorf("no certificate available for %s", name)
+	}
+	wait = make(chan struct{})
+	execCertWaitChans[name] = wait
+	execCertWaitChansMu.Unlock()
+
+	defer func() {
+		execCertWaitChansMu.Lock()
+		close(wait)
+		delete(execCertWaitChans, name)
+		execCertWaitChansMu.Unlock()
+	}()
+
+	_, cached, _ := getCertificate(name)
+	if !cached && c.OnDemandState.MaxObtain > 0 &&
+		atomic.LoadInt32(&c.OnDemandState.ObtainedCount) >= c.OnDemandState.MaxObtain {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: maximum certificates issued (%d)", name, c.OnDemandState.MaxObtain)
+	}
+
+	cert, err := c.runGetCertificate(name)
+	if err != nil {
+		recordExecFailure(name, err)
+		return Certificate{}, err
+	}
+	if !cached {
+		atomic.AddInt32(&c.OnDemandState.ObtainedCount, 1)
+	}
+	execFailuresMu.Lock()
+	delete(execFailures, name)
+	execFailuresMu.Unlock()
+	return cert, nil
+}
+
+// runGetCertificate runs the get_certificate command of c for
+// name, and caches the certificate it writes to its standard
+// output: a PEM bundle of the private key and the chain, whose
+// leaf must be valid now and for name.
+func (c *Config) runGetCertificate(name string) (Certificate, error) {
+	args := make([]string, len(c.GetCertificateExec))
+	for i, arg := range c.GetCertificateExec {
+		args[i] = strings.Replace(arg, "{host}", name, -1)
+	}
+	timeout := c.GetCertificateTimeout
+	if timeout <= 0 {
+		timeout = DefaultGetCertificateTimeout
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: %v", name, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return Certificate{}, fmt.Errorf("get_certificate for %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return Certificate{}, fmt.Errorf("get_certificate for %s: timed out after %v", name, timeout)
+	}
+
+	certPEM, keyPEM, err := splitPEMBundle(stdout.Bytes())
+	if err != nil {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: %v", name, err)
+	}
+	block, _ := pem.Decode(certPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: %v", name, err)
+	}
+	if err := leaf.VerifyHostname(name); err != nil {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: %v", name, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: certificate is not valid now (%v to %v)",
+			name, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	cert, err := cacheCertificateFromSource(c, execSourcePrefix+name, certPEM, keyPEM, true)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("get_certificate for %s: %v", name, err)
+	}
+	log.Printf("[INFO] Got certificate for %s from get_certificate, valid until %v", name, cert.NotAfter)
+	return cert, nil
+}
+
+// splitPEMBundle splits bundle into its certificates, leaf first,
+// and its private key.
+func splitPEMBundle(bundle []byte) (certPEM, keyPEM []byte, err error) {
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if keyPEM != nil {
+				return nil, nil, errors.New("more than one private key in output")
+			}
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if certPEM == nil {
+		return nil, nil, errors.New("no PEM certificate in output")
+	}
+	if keyPEM == nil {
+		return nil, nil, errors.New("no PEM private key in output")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// renewExecCertificate gets a new certificate to replace cert, which
+// came from the get_certificate command and expires soon. If that
+// fails, cert is returned while it is still valid.
+func renewExecCertificate(cert Certificate) (Certificate, error) {
+	name := strings.TrimPrefix(cert.source, execSourcePrefix)
+	newCert, err := cert.Config.execCertificate(name)
+	if err != nil {
+		if time.Now().Before(cert.NotAfter) {
+			log.Printf("[ERROR] Renewing certificate for %s: %v; serving the current one until it expires", name, err)
+			return cert, nil
+		}
+		return Certificate{}, err
+	}
+	return newCert, nil
+}
+
+// recentExecFailure returns the error of the last run of the
+// get_certificate command for name, if it failed recently.
+func recentExecFailure(name string) error {
+	execFailuresMu.Lock()
+	defer execFailuresMu.Unlock()
+	failure, ok := execFailures[name]
+	if !ok {
+		return nil
+	}
+	if time.Since(failure.when) >= execFailureTTL {
+		delete(execFailures, name)
+		return nil
+	}
+	return fmt.Errorf("%v (not retrying until %v)", failure.err, failure.when.Add(execFailureTTL).Format(time.RFC3339))
+}
+
+// recordExecFailure remembers that the get_certificate command
+// failed for name with err, and forgets the failures that expired,
+// so that the names that are never asked for again are not kept.
+func recordExecFailure(name string, err error) {
+	now := time.Now()
+	execFailuresMu.Lock()
+	defer execFailuresMu.Unlock()
+	for n, failure := range execFailures {
+		if now.Sub(failure.when) >= execFailureTTL {
+			delete(execFailures, n)
+		}
+	}
+	execFailures[name] = execFailure{err: err, when: now}
+}
+
+// execFailure is a failed run of the get_certificate command.
+type execFailure struct {
+	err  error
+	when time.Time
+}
+
+// execFailures has the recent failures of the
+// get_certificate command, by name.
+var execFailures = make(map[string]execFailure)
+var execFailuresMu sync.Mutex
+
+// execCertWaitChans is used to coordinate the runs of the
+// get_certificate command for each name.
+var execCertWaitChans = make(map[string]chan struct{})
+var execCertWaitChansMu sync.Mutex
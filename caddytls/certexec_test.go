@@ -0,0 +1,226 @@
+package caddytls
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// execFixture writes a get_certificate command that appends the
+// name it is run for to a file and then runs script, and returns
+// the command and a function that tells how many times it ran.
+func execFixture(t *testing.T, dir, script string) ([]string, func() int) {
+	runs := filepath.Join(dir, "runs")
+	path := filepath.Join(dir, "get-cert.sh")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho \"$1\" >> "+runs+"\n"+script+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []string{path, "{host}"}, func() int {
+		b, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(b), "\n")
+	}
+}
+
+func TestGetCertificateExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fixture is a shell script")
+	}
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+		execFailures = make(map[string]execFailure)
+	}()
+
+	dir, err := ioutil.TempDir("", "caddytls-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM := makeTestCertPEM(t, "example.com")
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(bundle, append(keyPEM, certPEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		script    string
+		name      string
+		shouldErr bool
+	}{
+		{"sleep 0.2; cat " + bundle, "example.com", false},
+		{"cat " + bundle, "other.example.com", true}, // not valid for the name
+		{"echo garbage", "example.com", true},
+		{"cat " + bundle + "; exit 3", "example.com", true},
+		{"exec sleep 5", "example.com", true},
+	} {
+		certCache = make(map[string]Certificate)
+		execFailures = make(map[string]execFailure)
+		testDir := filepath.Join(dir, strconv.Itoa(i))
+		os.Mkdir(testDir, 0755)
+		command, runs := execFixture(t, testDir, test.script)
+		cfg := &Config{GetCertificateExec: command, GetCertificateTimeout: 500 * time.Millisecond}
+		cg := configGroup{test.name: cfg}
+		hello := &tls.ClientHelloInfo{ServerName: test.name}
+
+		// concurrent handshakes for one new name run the command once
+		var wg sync.WaitGroup
+		errs := make([]error, 5)
+		for j := range errs {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				_, errs[j] = cg.GetCertificate(hello)
+			}(j)
+		}
+		start := time.Now()
+		wg.Wait()
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Test %d: Expected handshakes to finish by the timeout, took %v", i, elapsed)
+		}
+		for j, err := range errs {
+			if test.shouldErr && err == nil {
+				t.Errorf("Test %d: Expected error for handshake %d, got none", i, j)
+			} else if !test.shouldErr && err != nil {
+				t.Errorf("Test %d: Expected no error for handshake %d, got: %v", i, j, err)
+			}
+		}
+		if n := runs(); n != 1 {
+			t.Errorf("Test %d: Expected the command to run once, ran %d times", i, n)
+		}
+
+		// later handshakes use the cache, or the remembered failure
+		_, err := cg.GetCertificate(hello)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: Expected error %v on a later handshake, got: %v", i, test.shouldErr, err)
+		}
+		if n := runs(); n != 1 {
+			t.Errorf("Test %d: Expected the command not to run again, ran %d times", i, n)
+		}
+		if test.shouldErr {
+			continue
+		}
+		cert, matched, _ := getCertificate(test.name)
+		if !matched || !isExecCertificate(cert) {
+			t.Errorf("Test %d: Expected certificate from the command in the cache, got %v", i, cert.Names)
+		}
+	}
+}
+
+func TestGetCertificateExecFailureExpires(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fixture is a shell script")
+	}
+	defer func(ttl time.Duration) {
+		execFailureTTL = ttl
+		execFailures = make(map[string]execFailure)
+	}(execFailureTTL)
+	execFailureTTL = 100 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "caddytls-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	command, runs := execFixture(t, dir, "exit 1")
+	cfg := &Config{GetCertificateExec: command}
+	if _, err := cfg.execCertificate("example.com"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if _, err := cfg.execCertificate("example.com"); err == nil || runs() != 1 {
+		t.Fatalf("Expected remembered error without running again, got %v after %d runs", err, runs())
+	}
+	time.Sleep(150 * time.Millisecond)
+	cfg.execCertificate("example.com")
+	if n := runs(); n != 2 {
+		t.Errorf("Expected the command to run again after the failure expired, ran %d times", n)
+	}
+
+	// the failures that expired are forgotten when another is recorded
+	time.Sleep(150 * time.Millisecond)
+	cfg.execCertificate("other.example.com")
+	execFailuresMu.Lock()
+	_, kept := execFailures["example.com"]
+	execFailuresMu.Unlock()
+	if kept {
+		t.Error("Expected the expired failure to be pruned")
+	}
+}
+
+func TestGetCertificateExecMaxCerts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fixture is a shell script")
+	}
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+		execFailures = make(map[string]execFailure)
+	}()
+
+	dir, err := ioutil.TempDir("", "caddytls-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM := makeTestCertPEM(t, "example.com")
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(bundle, append(keyPEM, certPEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	command, runs := execFixture(t, dir, "cat "+bundle)
+	cfg := &Config{GetCertificateExec: command, OnDemandState: OnDemandState{MaxObtain: 1}}
+
+	if _, err := cfg.execCertificate("example.com"); err != nil {
+		t.Fatalf("Expected no error for the first name, got: %v", err)
+	}
+	// renewing a name that is in the cache is not limited
+	if _, err := cfg.execCertificate("example.com"); err != nil {
+		t.Errorf("Expected no error renewing the name, got: %v", err)
+	}
+	if _, err := cfg.execCertificate("other.example.com"); err == nil {
+		t.Error("Expected error for a name over max_certs, got none")
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("Expected the command not to run over max_certs, ran %d times", n)
+	}
+}
+
+func TestSplitPEMBundle(t *testing.T) {
+	certPEM, keyPEM := makeTestCertPEM(t, "example.com")
+	for i, test := range []struct {
+		bundle    []byte
+		shouldErr bool
+	}{
+		{append(append([]byte{}, keyPEM...), certPEM...), false},
+		{append(append([]byte("leading text\n"), certPEM...), keyPEM...), false},
+		{certPEM, true},
+		{keyPEM, true},
+		{append(append(append([]byte{}, keyPEM...), keyPEM...), certPEM...), true},
+		{[]byte("garbage"), true},
+	} {
+		gotCert, gotKey, err := splitPEMBundle(test.bundle)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if string(gotCert) != string(certPEM) || string(gotKey) != string(keyPEM) {
+			t.Errorf("Test %d: Expected the certificate and key of the bundle back", i)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package caddytls
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
@@ -18,6 +22,19 @@ import (
 var certCache = make(map[string]Certificate)
 var certCacheMu sync.RWMutex
 
+// certSources maps the source that a cached certificate was
+// loaded from (a storage key or a pair of files) to how it is
+// used, so that reloading the configuration can reuse the
+// certificates that did not change and evict the ones that
+// are no longer used. It is guarded by certCacheMu.
+var certSources = make(map[string]*certSource)
+
+// certSource describes the use of a certificate source.
+type certSource struct {
+	refs int    // number of configs that use the certificate
+	name string // a name that the certificate is cached under
+}
+
 // Certificate is a tls.Certificate with associated metadata tacked on.
 // Even if the metadata can be obtained by parsing the certificate,
 // we can be more efficient by extracting the metadata once so it's
@@ -29,8 +46,10 @@ type Certificate struct {
 	// The first is the CommonName (if any), the rest are SAN.
 	Names []string
 
-	// NotAfter is when the certificate expires.
-	NotAfter time.Time
+	// NotBefore and NotAfter are when the certificate
+	// starts and stops being valid.
+	NotBefore time.Time
+	NotAfter  time.Time
 
 	// OCSP contains the certificate's parsed OCSP response.
 	OCSP *ocsp.Response
@@ -38,6 +57,10 @@ type Certificate struct {
 	// Config is the configuration with which the certificate was
 	// loaded or obtained and with which it should be maintained.
 	Config *Config
+
+	// source is where the certificate was loaded from, and hash
+	// is the hash of the PEM blocks that it was made of
+	source, hash string
 }
 
 // getCertificate gets a certificate that matches name (a server name)
@@ -85,9 +108,76 @@ func getCertificate(name string) (cert Certificate, matched, defaulted bool) {
 	return
 }
 
+// CheckCertificate returns an error if the cache does not have
+// a certificate for name, or if that certificate has expired.
+// The default certificate does not count unless name is empty.
+//
+// This function is safe for concurrent use.
+func CheckCertificate(name string) error {
+	cert, matched, defaulted := getCertificate(name)
+	if !matched && !(defaulted && name == "") {
+		return fmt.Errorf("no certificate loaded for %s", name)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate for %s expired at %s", name, cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CacheStats summarizes the certificates in the cache.
+type CacheStats struct {
+	// The number of distinct managed certificates
+	Managed int
+
+	// When the certificate that expires first
+	// expires; zero if the cache is empty
+	NearestExpiry time.Time
+
+	// When the oldest OCSP staple was produced;
+	// zero if no certificate has a staple
+	OldestOCSP time.Time
+}
+
+// CertificateCacheStats returns statistics about the
+// certificates that are currently in the cache.
+//
+// This function is safe for concurrent use.
+func CertificateCacheStats() CacheStats {
+	var stats CacheStats
+	seen := make(map[string]struct{})
+
+	certCacheMu.RLock()
+	defer certCacheMu.RUnlock()
+
+	for _, cert := range certCache {
+		// the same certificate is cached once for each of its names
+		if len(cert.Certificate.Certificate) == 0 {
+			continue
+		}
+		leaf := string(cert.Certificate.Certificate[0])
+		if _, ok := seen[leaf]; ok {
+			continue
+		}
+		seen[leaf] = struct{}{}
+
+		if cert.Config != nil && cert.Config.Managed {
+			stats.Managed++
+		}
+		if stats.NearestExpiry.IsZero() || cert.NotAfter.Before(stats.NearestExpiry) {
+			stats.NearestExpiry = cert.NotAfter
+		}
+		if cert.OCSP != nil && (stats.OldestOCSP.IsZero() || cert.OCSP.ThisUpdate.Before(stats.OldestOCSP)) {
+			stats.OldestOCSP = cert.OCSP.ThisUpdate
+		}
+	}
+	return stats
+}
+
 // CacheManagedCertificate loads the certificate for domain into the
 // cache, flagging it as Managed and, if onDemand is true, as "OnDemand"
 // (meaning that it was obtained or loaded during a TLS handshake).
+// If the cache already has the same certificate from storage, it
+// is reused instead of being loaded again.
 //
 // This function is safe for concurrent use.
 func CacheManagedCertificate(domain string, cfg *Config) (Certificate, error) {
@@ -99,64 +189,193 @@ func CacheManagedCertificate(domain string, cfg *Config) (Certificate, error) {
 	if err != nil {
 		return Certificate{}, err
 	}
-	cert, err := makeCertificate(siteData.Cert, siteData.Key)
-	if err != nil {
-		return cert, err
-	}
-	cert.Config = cfg
-	cacheCertificate(cert)
-	return cert, nil
+	source := "storage:" + strings.ToLower(cfg.CAUrl) + ":" + domain
+	return cacheCertificateFromSource(cfg, source, siteData.Cert, siteData.Key, true)
 }
 
 // cacheUnmanagedCertificatePEMFile loads a certificate for host using certFile
 // and keyFile, which must be in PEM format. It stores the certificate in
-// memory. The Managed and OnDemand flags of the certificate will be set to
-// false.
+// memory, unless it is already cached and the files did not change. The
+// Managed and OnDemand flags of the certificate will be set to false.
 //
 // This function is safe for concurrent use.
-func cacheUnmanagedCertificatePEMFile(certFile, keyFile string) error {
-	cert, err := makeCertificateFromDisk(certFile, keyFile)
+func cacheUnmanagedCertificatePEMFile(cfg *Config, certFile, keyFile string) error {
+	certPEMBlock, err := ioutil.ReadFile(certFile)
 	if err != nil {
 		return err
 	}
-	cacheCertificate(cert)
-	return nil
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	_, err = cacheCertificateFromSource(cfg, "file:"+certFile+":"+keyFile, certPEMBlock, keyPEMBlock, false)
+	return err
 }
 
 // cacheUnmanagedCertificatePEMBytes makes a certificate out of the PEM bytes
 // of the certificate and key, then caches it in memory.
 //
 // This function is safe for concurrent use.
-func cacheUnmanagedCertificatePEMBytes(certBytes, keyBytes []byte) error {
-	cert, err := makeCertificate(certBytes, keyBytes)
+func cacheUnmanagedCertificatePEMBytes(cfg *Config, certBytes, keyBytes []byte) error {
+	source := "pem:" + pemHash(certBytes, keyBytes)
+	_, err := cacheCertificateFromSource(cfg, source, certBytes, keyBytes, false)
+	return err
+}
+
+// cacheCertificateFromSource caches the certificate made of certPEMBlock
+// and keyPEMBlock, which were read from source, and records that cfg
+// uses it. If a certificate from source with the same contents is
+// already cached, it is reused along with its OCSP staple instead
+// of being made again. If managed is true, cfg becomes the config
+// with which the certificate is maintained.
+//
+// This function is safe for concurrent use.
+func cacheCertificateFromSource(cfg *Config, source string, certPEMBlock, keyPEMBlock []byte, managed bool) (Certificate, error) {
+	hash := pemHash(certPEMBlock, keyPEMBlock) + cfg.chainOptions()
+
+	certCacheMu.Lock()
+	if src, ok := certSources[source]; ok {
+		if cert, ok := certCache[src.name]; ok && cert.source == source {
+			if cert.hash == hash {
+				if managed && cert.Config != cfg {
+					cert.Config = cfg
+					for _, name := range cert.Names {
+						certCache[name] = cert
+					}
+				}
+				cfg.useSource(source, src.name)
+				certCacheMu.Unlock()
+				return cert, nil
+			}
+			// the source changed; its old names may not apply anymore
+			evictSource(source, src.name)
+		}
+	}
+	certCacheMu.Unlock()
+
+	cert, err := makeCertificate(cfg, certPEMBlock, keyPEMBlock)
 	if err != nil {
-		return err
+		return cert, err
+	}
+	cert.source, cert.hash = source, hash
+	if managed {
+		cert.Config = cfg
 	}
 	cacheCertificate(cert)
-	return nil
+
+	var name string
+	if len(cert.Names) > 0 {
+		name = cert.Names[0]
+	}
+	certCacheMu.Lock()
+	cfg.useSource(source, name)
+	certCacheMu.Unlock()
+
+	return cert, nil
 }
 
-// makeCertificateFromDisk makes a Certificate by loading the
-// certificate and key files. It fills out all the fields in
-// the certificate except for the Managed and OnDemand flags.
-// (It is up to the caller to set those.)
-func makeCertificateFromDisk(certFile, keyFile string) (Certificate, error) {
-	certPEMBlock, err := ioutil.ReadFile(certFile)
-	if err != nil {
-		return Certificate{}, err
+// pemHash returns a hash of the PEM blocks of a certificate and key.
+func pemHash(certPEMBlock, keyPEMBlock []byte) string {
+	h := sha256.New()
+	h.Write(certPEMBlock)
+	h.Write([]byte{0})
+	h.Write(keyPEMBlock)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// useSource records that c uses the certificate from source,
+// which is cached under name. On-demand configs do not count
+// as users, so their certificates outlive reloads. The lock
+// certCacheMu must be held.
+func (c *Config) useSource(source, name string) {
+	src, ok := certSources[source]
+	if !ok {
+		src = new(certSource)
+		certSources[source] = src
 	}
-	keyPEMBlock, err := ioutil.ReadFile(keyFile)
-	if err != nil {
-		return Certificate{}, err
+	src.name = name
+	if c == nil || c.OnDemand {
+		return
+	}
+	if _, ok := c.certSources[source]; ok {
+		return
+	}
+	if c.certSources == nil {
+		c.certSources = make(map[string]struct{})
+	}
+	c.certSources[source] = struct{}{}
+	src.refs++
+}
+
+// ReleaseCertificates records that c no longer uses the certificates
+// that were cached for it. Certificates that no other config uses
+// are evicted from the cache. Servers call this when they stop, after
+// the servers of a reloaded configuration have loaded (or reused)
+// their certificates, so only the certificates of removed sites
+// are evicted.
+//
+// This method is safe for concurrent use.
+func (c *Config) ReleaseCertificates() {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	for source := range c.certSources {
+		src, ok := certSources[source]
+		if !ok {
+			continue
+		}
+		if src.refs--; src.refs > 0 {
+			continue
+		}
+		delete(certSources, source)
+		evictSource(source, src.name)
+	}
+	c.certSources = nil
+}
+
+// evictSource deletes the certificate that was loaded from source,
+// which is cached under name, from the cache. If it was the default
+// certificate, the one that expires last becomes the default, or of
+// those, the one cached under the first name. The lock certCacheMu
+// must be held.
+func evictSource(source, name string) {
+	cert, ok := certCache[name]
+	if !ok || cert.source != source {
+		return
+	}
+	var wasDefault bool
+	for _, n := range cert.Names {
+		if other, ok := certCache[n]; ok && other.source == source {
+			delete(certCache, n)
+			wasDefault = wasDefault || n == ""
+		}
+	}
+	if !wasDefault {
+		return
+	}
+	var next string
+	var found bool
+	for n, other := range certCache {
+		best := certCache[next]
+		if !found || other.NotAfter.After(best.NotAfter) ||
+			other.NotAfter.Equal(best.NotAfter) && n < next {
+			next, found = n, true
+		}
+	}
+	if !found {
+		return
+	}
+	other := certCache[next]
+	other.Names = append(append([]string{}, other.Names...), "")
+	for _, n := range other.Names {
+		certCache[n] = other
 	}
-	return makeCertificate(certPEMBlock, keyPEMBlock)
 }
 
 // makeCertificate turns a certificate PEM bundle and a key PEM block into
 // a Certificate, with OCSP and other relevant metadata tagged with it,
 // except for the OnDemand and Managed flags. It is up to the caller to
 // set those properties.
-func makeCertificate(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
+func makeCertificate(cfg *Config, certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
 	var cert Certificate
 
 	// Convert to a tls.Certificate
@@ -167,6 +386,10 @@ func makeCertificate(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
 	if len(tlsCert.Certificate) == 0 {
 		return cert, errors.New("certificate is empty")
 	}
+	tlsCert.Certificate, err = assembleChain(tlsCert.Certificate, cfg)
+	if err != nil {
+		return cert, err
+	}
 
 	// Parse leaf certificate and extract relevant metadata
 	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
@@ -181,10 +404,11 @@ func makeCertificate(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
 			cert.Names = append(cert.Names, strings.ToLower(name))
 		}
 	}
+	cert.NotBefore = leaf.NotBefore
 	cert.NotAfter = leaf.NotAfter
 	cert.Certificate = tlsCert
 
-	err = stapleOCSP(&cert, certPEMBlock)
+	err = stapleOCSP(&cert)
 	if err != nil {
 		log.Printf("[WARNING] Stapling OCSP: %v", err)
 	}
@@ -227,6 +451,13 @@ func cacheCertificate(cert Certificate) {
 	certCacheMu.Unlock()
 }
 
+// sameCertificate returns true if a and b are the same certificate,
+// so that a staple fetched for one can be attached to the other.
+func sameCertificate(a, b Certificate) bool {
+	return len(a.Certificate.Certificate) > 0 && len(b.Certificate.Certificate) > 0 &&
+		bytes.Equal(a.Certificate.Certificate[0], b.Certificate.Certificate[0])
+}
+
 // uncacheCertificate deletes name's certificate from the
 // cache. If name is not a key in the certificate cache,
 // this function does nothing.
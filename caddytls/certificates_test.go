@@ -1,6 +1,23 @@
 package caddytls
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
 
 func TestUnexportedGetCertificate(t *testing.T) {
 	defer func() { certCache = make(map[string]Certificate) }()
@@ -35,6 +52,68 @@ func TestUnexportedGetCertificate(t *testing.T) {
 	}
 }
 
+func TestCheckCertificate(t *testing.T) {
+	defer func() { certCache = make(map[string]Certificate) }()
+
+	if err := CheckCertificate("example.com"); err == nil {
+		t.Error("Expected an error when cache is empty, got none")
+	}
+
+	defaultCert := Certificate{Names: []string{"example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	certCache[""] = defaultCert
+	certCache["example.com"] = defaultCert
+	certCache["expired.com"] = Certificate{Names: []string{"expired.com"}, NotAfter: time.Now().Add(-time.Hour)}
+
+	if err := CheckCertificate("example.com"); err != nil {
+		t.Errorf("Expected no error for loaded certificate, got: %v", err)
+	}
+	if err := CheckCertificate(""); err != nil {
+		t.Errorf("Expected no error for default certificate, got: %v", err)
+	}
+	if err := CheckCertificate("other.com"); err == nil {
+		t.Error("Expected an error when only the default certificate is loaded, got none")
+	}
+	if err := CheckCertificate("expired.com"); err == nil {
+		t.Error("Expected an error for expired certificate, got none")
+	}
+}
+
+func TestCertificateCacheStats(t *testing.T) {
+	defer func() { certCache = make(map[string]Certificate) }()
+
+	if stats := CertificateCacheStats(); stats != (CacheStats{}) {
+		t.Errorf("Expected empty stats for empty cache, got %+v", stats)
+	}
+
+	now := time.Now()
+	managed := Certificate{
+		Certificate: tls.Certificate{Certificate: [][]byte{[]byte("managed")}},
+		Names:       []string{"example.com", "www.example.com"},
+		NotAfter:    now.Add(48 * time.Hour),
+		OCSP:        &ocsp.Response{ThisUpdate: now.Add(-time.Hour)},
+		Config:      &Config{Managed: true},
+	}
+	manual := Certificate{
+		Certificate: tls.Certificate{Certificate: [][]byte{[]byte("manual")}},
+		Names:       []string{"manual.com"},
+		NotAfter:    now.Add(24 * time.Hour),
+		OCSP:        &ocsp.Response{ThisUpdate: now.Add(-2 * time.Hour)},
+	}
+	cacheCertificate(managed)
+	cacheCertificate(manual)
+
+	stats := CertificateCacheStats()
+	if stats.Managed != 1 {
+		t.Errorf("Expected 1 managed certificate, got %d", stats.Managed)
+	}
+	if !stats.NearestExpiry.Equal(manual.NotAfter) {
+		t.Errorf("Expected nearest expiry %v, got %v", manual.NotAfter, stats.NearestExpiry)
+	}
+	if !stats.OldestOCSP.Equal(manual.OCSP.ThisUpdate) {
+		t.Errorf("Expected oldest OCSP staple from %v, got %v", manual.OCSP.ThisUpdate, stats.OldestOCSP)
+	}
+}
+
 func TestCacheCertificate(t *testing.T) {
 	defer func() { certCache = make(map[string]Certificate) }()
 
@@ -57,3 +136,157 @@ func TestCacheCertificate(t *testing.T) {
 		t.Error("Expected second cert to NOT be cached as default, but it was")
 	}
 }
+
+func TestEvictDefaultCertificate(t *testing.T) {
+	defer func() { certCache = make(map[string]Certificate) }()
+
+	now := time.Now()
+	for _, cert := range []Certificate{
+		{Names: []string{"default.com"}, NotAfter: now.Add(48 * time.Hour), source: "default"},
+		{Names: []string{"b.com"}, NotAfter: now.Add(24 * time.Hour), source: "b"},
+		{Names: []string{"c.com", "a.com"}, NotAfter: now.Add(72 * time.Hour), source: "c"},
+		{Names: []string{"d.com"}, NotAfter: now.Add(72 * time.Hour), source: "d"},
+	} {
+		cacheCertificate(cert)
+	}
+
+	// of the certificates that expire last, the one
+	// cached under the first name becomes the default
+	evictSource("default", "default.com")
+	if cert, ok := certCache[""]; !ok || cert.source != "c" {
+		t.Errorf("Expected the certificate of c.com to become the default, got %v", cert.Names)
+	}
+	if _, ok := certCache["default.com"]; ok {
+		t.Error("Expected the evicted certificate to be deleted from the cache")
+	}
+	evictSource("c", "c.com")
+	if cert, ok := certCache[""]; !ok || cert.source != "d" {
+		t.Errorf("Expected the certificate of d.com to become the default, got %v", cert.Names)
+	}
+}
+
+func TestCacheReuseAcrossReload(t *testing.T) {
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+
+	dir, err := ioutil.TempDir("", "caddytls_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := FileStorage(dir)
+	storageCreator := func(caURL *url.URL) (Storage, error) { return storage, nil }
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		certPEM, keyPEM := makeTestCertPEM(t, name)
+		if err := storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certFile, keyFile := filepath.Join(dir, "manual.crt"), filepath.Join(dir, "manual.key")
+	writeManual := func() {
+		certPEM, keyPEM := makeTestCertPEM(t, "manual.example.com")
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeManual()
+
+	// load sets up the configs of one "instance"
+	load := func(names ...string) []*Config {
+		var configs []*Config
+		for _, name := range names {
+			cfg := &Config{Hostname: name, CAUrl: "https://ca.test/directory", StorageCreator: storageCreator}
+			if name == "manual.example.com" {
+				err = cacheUnmanagedCertificatePEMFile(cfg, certFile, keyFile)
+			} else {
+				_, err = CacheManagedCertificate(name, cfg)
+			}
+			if err != nil {
+				t.Fatalf("Loading %s: %v", name, err)
+			}
+			configs = append(configs, cfg)
+		}
+		return configs
+	}
+	release := func(configs []*Config) {
+		for _, cfg := range configs {
+			cfg.ReleaseCertificates()
+		}
+	}
+	leaf := func(name string) *byte {
+		certCacheMu.RLock()
+		defer certCacheMu.RUnlock()
+		cert, ok := certCache[name]
+		if !ok {
+			return nil
+		}
+		return &cert.Certificate.Certificate[0][0]
+	}
+
+	oldConfigs := load("a.example.com", "b.example.com", "manual.example.com")
+	a, manual := leaf("a.example.com"), leaf("manual.example.com")
+
+	// reload with b removed and c added; the new instance loads
+	// its certificates before the old one is shut down
+	writeManual()
+	newConfigs := load("a.example.com", "c.example.com", "manual.example.com")
+	release(oldConfigs)
+
+	if leaf("a.example.com") != a {
+		t.Error("Expected certificate of unchanged site to be reused, but it was loaded again")
+	}
+	if got := certCache["a.example.com"].Config; got != newConfigs[0] {
+		t.Errorf("Expected reused certificate to be maintained with the new config, got %p", got)
+	}
+	if leaf("c.example.com") == nil {
+		t.Error("Expected certificate of added site to be loaded")
+	}
+	if leaf("b.example.com") != nil {
+		t.Error("Expected certificate of removed site to be evicted")
+	}
+	if l := leaf("manual.example.com"); l == nil || l == manual {
+		t.Error("Expected manual certificate whose files changed to be loaded again")
+	}
+	if leaf("") == nil {
+		t.Error("Expected a default certificate after evicting the old default")
+	}
+	if len(certSources) != 3 {
+		t.Errorf("Expected 3 certificate sources, got %d", len(certSources))
+	}
+
+	release(newConfigs)
+	if len(certCache) != 0 {
+		t.Errorf("Expected empty cache after releasing all configs, got %d entries", len(certCache))
+	}
+}
+
+// makeTestCertPEM makes a self-signed certificate for name
+// and returns the PEM blocks of the certificate and its key.
+func makeTestCertPEM(t *testing.T, name string) ([]byte, []byte) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,204 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// How the chain of a certificate is served; see Config.ServeChain.
+const (
+	ChainAsObtained = "as_obtained"
+	ChainLeafToRoot = "leaf_to_root"
+)
+
+// chainOptions returns the options of c that make the chain that is
+// served, so that certificates made with other options are not reused.
+func (c *Config) chainOptions() string {
+	if c == nil || (c.ServeChain != ChainLeafToRoot && !c.IncludeRoot) {
+		return ""
+	}
+	opts := ":" + c.ServeChain
+	if c.IncludeRoot {
+		opts += ":root"
+		for _, root := range c.RootCerts {
+			opts += fmt.Sprintf(":%x", sha256.Sum256(root.Raw))
+		}
+	}
+	return opts
+}
+
+// loadRootCerts returns the certificates in the PEM file.
+func loadRootCerts(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		root, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%s: no certificates", file)
+	}
+	return roots, nil
+}
+
+// assembleChain returns chain, the DER certificates of a leaf and
+// its intermediates, as cfg serves it: the intermediates ordered
+// by which issued which, from the leaf to the root, if it asks for
+// that, and the root at the end, if it asks for that and the root
+// is in the chain or among its root certificates. The chain must
+// not be empty. If cfg changes the chain, it is verified, and a
+// warning is logged if it does not verify.
+func assembleChain(chain [][]byte, cfg *Config) ([][]byte, error) {
+	if cfg.chainOptions() == "" {
+		return chain, nil
+	}
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = cert
+	}
+
+	if cfg.ServeChain == ChainLeafToRoot {
+		certs = orderChain(certs)
+	}
+
+	if cfg.IncludeRoot {
+		top := chainTop(certs)
+		if !selfSigned(top) {
+			candidates := append(append([]*x509.Certificate{}, certs...), cfg.RootCerts...)
+			if root := issuerOf(top, candidates); root != nil && selfSigned(root) {
+				if !containsCert(certs, root) {
+					certs = append(certs, root)
+				}
+			} else {
+				log.Printf("[WARNING] %s: root of the chain not found; serving the chain without it", certs[0].Subject.CommonName)
+			}
+		}
+	}
+
+	verifyChain(certs, cfg.ServeChain == ChainLeafToRoot)
+
+	assembled := make([][]byte, len(certs))
+	for i, cert := range certs {
+		assembled[i] = cert.Raw
+	}
+	return assembled, nil
+}
+
+// orderChain returns certs with the leaf first, each certificate
+// followed by its issuer, as long as the issuer is in certs; the
+// certificates that are not linked to the leaf follow at the end,
+// in the order they were in.
+func orderChain(certs []*x509.Certificate) []*x509.Certificate {
+	ordered := []*x509.Certificate{certs[0]}
+	rest := append([]*x509.Certificate{}, certs[1:]...)
+	for cur := certs[0]; !selfSigned(cur); {
+		issuer := issuerOf(cur, rest)
+		if issuer == nil {
+			break
+		}
+		for i, cert := range rest {
+			if cert == issuer {
+				rest = append(rest[:i], rest[i+1:]...)
+				break
+			}
+		}
+		ordered = append(ordered, issuer)
+		cur = issuer
+	}
+	return append(ordered, rest...)
+}
+
+// chainTop returns the last certificate of the chain that
+// begins with the leaf of certs, in whatever order certs are.
+func chainTop(certs []*x509.Certificate) *x509.Certificate {
+	cur := certs[0]
+	for i := 1; i < len(certs) && !selfSigned(cur); i++ {
+		issuer := issuerOf(cur, certs)
+		if issuer == nil {
+			break
+		}
+		cur = issuer
+	}
+	return cur
+}
+
+// issuerOf returns the certificate among candidates that issued
+// cert, or nil if none did.
+func issuerOf(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if candidate == cert || !bytes.Equal(cert.RawIssuer, candidate.RawSubject) {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyChain logs a warning if the leaf of certs does not
+// verify with the rest of certs as the intermediates and, if
+// certs has roots, those as the only trusted ones; otherwise,
+// the system roots are trusted. If ordered is true,
+// it also warns if a certificate is not issued by the next.
+func verifyChain(certs []*x509.Certificate, ordered bool) {
+	if ordered {
+		for i := 0; i < len(certs)-1; i++ {
+			if certs[i].CheckSignatureFrom(certs[i+1]) != nil {
+				log.Printf("[WARNING] %s: certificate %d of the chain is not issued by the next one",
+					certs[0].Subject.CommonName, i)
+				break
+			}
+		}
+	}
+	opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		if !selfSigned(cert) {
+			opts.Intermediates.AddCert(cert)
+			continue
+		}
+		if opts.Roots == nil {
+			opts.Roots = x509.NewCertPool()
+		}
+		opts.Roots.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		log.Printf("[WARNING] %s: served chain does not verify: %v", certs[0].Subject.CommonName, err)
+	}
+}
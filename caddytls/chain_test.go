@@ -0,0 +1,203 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// testChain is a chain of certificates: a root, which issued
+// the first intermediate, which issued the second, which issued
+// the leaf for example.com.
+type testChain struct {
+	root, inter1, inter2, leaf *x509.Certificate
+	leafKeyPEM                 []byte
+}
+
+func makeTestChain(t *testing.T) testChain {
+	var chain testChain
+	issue := func(name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			BasicConstraintsValid: true,
+			IsCA:                  ca,
+		}
+		if ca {
+			template.KeyUsage = x509.KeyUsageCertSign
+		} else {
+			template.DNSNames = []string{name}
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	root, rootKey := issue("Test Root", true, nil, nil)
+	inter1, inter1Key := issue("Test Intermediate 1", true, root, rootKey)
+	inter2, inter2Key := issue("Test Intermediate 2", true, inter1, inter1Key)
+	leaf, leafKey := issue("example.com", false, inter2, inter2Key)
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.root, chain.inter1, chain.inter2, chain.leaf = root, inter1, inter2, leaf
+	chain.leafKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return chain
+}
+
+// bundle returns the PEM bundle of certs, in their order.
+func bundle(certs ...*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+func TestAssembleChain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	c := makeTestChain(t)
+	for i, test := range []struct {
+		cfg    *Config
+		bundle []byte
+		expect []*x509.Certificate
+	}{
+		// served as it is by default, even out of order
+		{nil, bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter1, c.inter2}},
+		{&Config{ServeChain: ChainAsObtained}, bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter1, c.inter2}},
+		{&Config{ServeChain: ChainLeafToRoot}, bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter2, c.inter1}},
+		{&Config{ServeChain: ChainLeafToRoot}, bundle(c.leaf, c.root, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter2, c.inter1, c.root}},
+		{&Config{ServeChain: ChainLeafToRoot, IncludeRoot: true, RootCerts: []*x509.Certificate{c.root}},
+			bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter2, c.inter1, c.root}},
+		{&Config{IncludeRoot: true, RootCerts: []*x509.Certificate{c.root}},
+			bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter1, c.inter2, c.root}},
+		// the root in the chain is not served twice
+		{&Config{IncludeRoot: true, RootCerts: []*x509.Certificate{c.root}},
+			bundle(c.leaf, c.root, c.inter2, c.inter1), []*x509.Certificate{c.leaf, c.root, c.inter2, c.inter1}},
+		// no root to include
+		{&Config{ServeChain: ChainLeafToRoot, IncludeRoot: true},
+			bundle(c.leaf, c.inter1, c.inter2), []*x509.Certificate{c.leaf, c.inter2, c.inter1}},
+		// an unrelated root is not included
+		{&Config{IncludeRoot: true, RootCerts: []*x509.Certificate{c.inter1}},
+			bundle(c.leaf, c.inter2), []*x509.Certificate{c.leaf, c.inter2}},
+	} {
+		cert, err := makeCertificate(test.cfg, test.bundle, c.leafKeyPEM)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		served := cert.Certificate.Certificate
+		if len(served) != len(test.expect) {
+			t.Errorf("Test %d: Expected %d certificates, got %d", i, len(test.expect), len(served))
+			continue
+		}
+		for j, expect := range test.expect {
+			if !bytes.Equal(served[j], expect.Raw) {
+				parsed, _ := x509.ParseCertificate(served[j])
+				t.Errorf("Test %d: Expected certificate %d to be %s, got %s", i, j, expect.Subject.CommonName, parsed.Subject.CommonName)
+			}
+		}
+	}
+}
+
+func TestChainOptionsNotShared(t *testing.T) {
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	c := makeTestChain(t)
+	certPEM := bundle(c.leaf, c.inter1, c.inter2)
+	if _, err := cacheCertificateFromSource(new(Config), "file:chain", certPEM, c.leafKeyPEM, false); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ServeChain: ChainLeafToRoot}
+	cert, err := cacheCertificateFromSource(cfg, "file:chain", certPEM, c.leafKeyPEM, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate.Certificate[1], c.inter2.Raw) {
+		t.Error("Expected the certificate to be made again with the chain options of the config")
+	}
+}
+
+func TestSetupServeChain(t *testing.T) {
+	c := makeTestChain(t)
+	dir, err := ioutil.TempDir("", "caddytls_chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootFile := filepath.Join(dir, "root.pem")
+	if err := ioutil.WriteFile(rootFile, bundle(c.root), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		input       string
+		shouldErr   bool
+		serveChain  string
+		includeRoot bool
+		roots       int
+	}{
+		{"tls {\n serve_chain leaf_to_root \n}", false, ChainLeafToRoot, false, 0},
+		{"tls {\n serve_chain as_obtained \n include_root \n}", false, ChainAsObtained, true, 0},
+		{"tls {\n include_root " + rootFile + " \n}", false, "", true, 1},
+		{"tls {\n serve_chain \n}", true, "", false, 0},
+		{"tls {\n serve_chain root_to_leaf \n}", true, "", false, 0},
+		{"tls {\n include_root " + filepath.Join(dir, "missing.pem") + " \n}", true, "", false, 0},
+		{"tls {\n include_root a.pem b.pem \n}", true, "", false, 0},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.ServeChain != test.serveChain || cfg.IncludeRoot != test.includeRoot || len(cfg.RootCerts) != test.roots {
+			t.Errorf("Test %d: Expected chain %q, include root %v with %d roots; got %q, %v with %d",
+				i, test.serveChain, test.includeRoot, test.roots, cfg.ServeChain, cfg.IncludeRoot, len(cfg.RootCerts))
+		}
+	}
+}
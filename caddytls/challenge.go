@@ -0,0 +1,219 @@
+package caddytls
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// challengeTTL is how long a challenge kept in storage may be
+// used. The entry is deleted when the challenge is cleaned up,
+// but one that is left behind, because the instance that made
+// it went away, is ignored and deleted once it is this old.
+var challengeTTL = 10 * time.Minute
+
+// challengeKeyPrefix namespaces the challenges kept in storage,
+// in which they are stored as sites, apart from certificates.
+const challengeKeyPrefix = "acme-challenge."
+
+// tlsSNISuffix ends the names of TLS-SNI challenge certificates.
+const tlsSNISuffix = ".acme.invalid"
+
+// challengeKey returns the key in storage and in the local
+// challenges of the HTTP challenge of domain with token, or,
+// if token is empty, of the TLS-SNI challenge for the name
+// domain. Challenges are looked up by the name the CA asks
+// for, so that one instance can answer the challenges made
+// by another that shares its storage.
+func challengeKey(domain, token string) string {
+	key := challengeKeyPrefix
+	if token != "" {
+		key += token + "."
+	}
+	return key + strings.ToLower(domain)
+}
+
+// challengeMeta is the metadata of a challenge in storage.
+type challengeMeta struct {
+	KeyAuth string    `json:"key_auth"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	// localChallenges has the key authorizations of
+	// the challenges presented by this instance.
+	localChallenges   = make(map[string]string)
+	localChallengesMu sync.RWMutex
+)
+
+// presentChallenge keeps keyAuth as the answer to the challenge
+// with key in this instance and in the storage of cfg. Failing
+// to store it is not fatal: this instance can still answer.
+func presentChallenge(cfg *Config, key, keyAuth string) {
+	localChallengesMu.Lock()
+	localChallenges[key] = keyAuth
+	localChallengesMu.Unlock()
+
+	if cfg == nil {
+		return
+	}
+	err := storeChallenge(cfg, key, keyAuth)
+	if err != nil {
+		log.Printf("[ERROR] Sharing ACME challenge through storage: %v", err)
+	}
+}
+
+// cleanUpChallenge forgets the challenge with key.
+func cleanUpChallenge(cfg *Config, key string) {
+	localChallengesMu.Lock()
+	delete(localChallenges, key)
+	localChallengesMu.Unlock()
+
+	if cfg == nil {
+		return
+	}
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err == nil {
+		err = storage.DeleteSite(key)
+	}
+	if err != nil && err != ErrStorageNotFound {
+		log.Printf("[ERROR] Deleting ACME challenge from storage: %v", err)
+	}
+}
+
+func storeChallenge(cfg *Config, key, keyAuth string) error {
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(challengeMeta{KeyAuth: keyAuth, Expires: time.Now().Add(challengeTTL)})
+	if err != nil {
+		return err
+	}
+	return storage.StoreSite(key, &SiteData{Meta: meta})
+}
+
+// lookUpChallenge returns the key authorization of the challenge
+// with key, presented by this instance or, if cfg is not nil,
+// by one that shares the storage of cfg.
+func lookUpChallenge(cfg *Config, key string) (string, bool) {
+	localChallengesMu.RLock()
+	keyAuth, ok := localChallenges[key]
+	localChallengesMu.RUnlock()
+	if ok || cfg == nil {
+		return keyAuth, ok
+	}
+
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil || !storage.SiteExists(key) {
+		return "", false
+	}
+	siteData, err := storage.LoadSite(key)
+	if err != nil {
+		return "", false
+	}
+	var meta challengeMeta
+	if err := json.Unmarshal(siteData.Meta, &meta); err != nil || meta.KeyAuth == "" {
+		return "", false
+	}
+	if time.Now().After(meta.Expires) {
+		// left behind; nobody will clean it up
+		storage.DeleteSite(key)
+		return "", false
+	}
+	return meta.KeyAuth, true
+}
+
+// httpSolver solves HTTP challenges with the listener of the
+// server on the HTTP challenge port, which hands the challenge
+// requests to HTTPChallengeHandler. It keeps the challenges in
+// storage too, so that any instance that shares the storage
+// can answer them, whichever one the CA reaches.
+type httpSolver struct {
+	config *Config
+}
+
+// Present makes the challenge available.
+func (s httpSolver) Present(domain, token, keyAuth string) error {
+	presentChallenge(s.config, challengeKey(domain, token), keyAuth)
+	return nil
+}
+
+// CleanUp removes the challenge.
+func (s httpSolver) CleanUp(domain, token, keyAuth string) error {
+	cleanUpChallenge(s.config, challengeKey(domain, token))
+	return nil
+}
+
+// HTTPChallengeHandler answers r with the key authorization of
+// the HTTP challenge it asks for, if this instance or another
+// that shares the storage of c presented it; otherwise, it
+// proxies r to the ACME client on the alternate port of c, like
+// the package-level HTTPChallengeHandler. It returns true if it
+// handled the request and false if r is not for a challenge.
+func (c *Config) HTTPChallengeHandler(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, challengeBasePath) {
+		return false
+	}
+	if answerHTTPChallenge(c, w, r) {
+		return true
+	}
+	altPort := c.AltHTTPPort
+	if altPort == "" {
+		altPort = DefaultHTTPAlternatePort
+	}
+	return proxyHTTPChallenge(w, r, altPort)
+}
+
+// answerHTTPChallenge writes the key authorization of the
+// challenge r asks for, if it is known, and returns true if
+// it did.
+func answerHTTPChallenge(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.URL.Path, challengeBasePath+"/")
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	// both go into the key in storage, which may be a path
+	if token == "" || host == "" || strings.ContainsAny(token+host, `/\`) {
+		return false
+	}
+	keyAuth, ok := lookUpChallenge(cfg, challengeKey(host, token))
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
+
+// sharedChallengeCertificate returns the certificate of the
+// TLS-SNI challenge for name if an instance that shares the
+// storage of one of the configs in cg presented it. It is not
+// cached: the challenge is soon over.
+func (cg configGroup) sharedChallengeCertificate(name string) (Certificate, bool) {
+	name = strings.ToLower(name)
+	seen := make(map[*Config]struct{})
+	for _, cfg := range cg {
+		if _, ok := seen[cfg]; ok {
+			continue
+		}
+		seen[cfg] = struct{}{}
+		keyAuth, ok := lookUpChallenge(cfg, challengeKey(name, ""))
+		if !ok {
+			continue
+		}
+		cert, acmeDomain, err := acme.TLSSNI01ChallengeCert(keyAuth)
+		if err != nil || acmeDomain != name {
+			continue
+		}
+		return Certificate{Certificate: cert, Names: []string{acmeDomain}}, true
+	}
+	return Certificate{}, false
+}
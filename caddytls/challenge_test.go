@@ -0,0 +1,144 @@
+package caddytls
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// twoInstances returns the configs of two instances that share
+// storage, and a function that makes the challenges presented so
+// far look like they were presented by another process.
+func twoInstances(t *testing.T) (a, b *Config, elsewhere func(), done func()) {
+	dir, err := ioutil.TempDir("", "caddytls_challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := FileStorage(dir)
+	creator := func(caURL *url.URL) (Storage, error) { return storage, nil }
+	a = &Config{CAUrl: "https://ca.test/directory", StorageCreator: creator}
+	b = &Config{CAUrl: "https://ca.test/directory", StorageCreator: creator}
+	elsewhere = func() {
+		localChallengesMu.Lock()
+		localChallenges = make(map[string]string)
+		localChallengesMu.Unlock()
+	}
+	return a, b, elsewhere, func() {
+		elsewhere()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSharedHTTPChallenge(t *testing.T) {
+	a, b, elsewhere, done := twoInstances(t)
+	defer done()
+
+	solver := httpSolver{config: a}
+	if err := solver.Present("Example.com", "tok3n", "tok3n.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere()
+
+	answer := func(cfg *Config, target string) (string, bool) {
+		rw := httptest.NewRecorder()
+		ok := answerHTTPChallenge(cfg, rw, httptest.NewRequest("GET", target, nil))
+		return rw.Body.String(), ok
+	}
+	rw := httptest.NewRecorder()
+	if !b.HTTPChallengeHandler(rw, httptest.NewRequest("GET", "http://example.com:80"+challengeBasePath+"/tok3n", nil)) {
+		t.Fatal("Expected the challenge to be handled")
+	}
+	if rw.Code != http.StatusOK || rw.Body.String() != "tok3n.thumbprint" {
+		t.Errorf("Expected 200 with the key authorization, got %d %q", rw.Code, rw.Body.String())
+	}
+	if got := rw.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Expected Content-Type text/plain, got %q", got)
+	}
+	for _, target := range []string{
+		"http://other.example.com" + challengeBasePath + "/tok3n",
+		"http://example.com" + challengeBasePath + "/other",
+		"http://example.com" + challengeBasePath + "/",
+	} {
+		if _, ok := answer(b, target); ok {
+			t.Errorf("Expected no answer for %s", target)
+		}
+	}
+	if _, ok := answer(nil, "http://example.com"+challengeBasePath+"/tok3n"); ok {
+		t.Error("Expected no answer without storage for a challenge presented elsewhere")
+	}
+
+	if err := solver.CleanUp("example.com", "tok3n", "tok3n.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := answer(b, "http://example.com"+challengeBasePath+"/tok3n"); ok {
+		t.Error("Expected no answer after the challenge was cleaned up")
+	}
+}
+
+func TestSharedChallengeExpires(t *testing.T) {
+	a, b, elsewhere, done := twoInstances(t)
+	defer done()
+	defer func(ttl time.Duration) { challengeTTL = ttl }(challengeTTL)
+	challengeTTL = -time.Second
+
+	// left behind by an instance that never cleaned it up
+	if err := (httpSolver{config: a}).Present("example.com", "tok3n", "tok3n.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere()
+
+	if _, ok := lookUpChallenge(b, challengeKey("example.com", "tok3n")); ok {
+		t.Error("Expected an expired challenge to be ignored")
+	}
+	storage, _ := b.StorageFor(b.CAUrl)
+	if storage.SiteExists(challengeKey("example.com", "tok3n")) {
+		t.Error("Expected an expired challenge to be deleted from storage")
+	}
+}
+
+func TestSharedTLSSNIChallenge(t *testing.T) {
+	a, b, elsewhere, done := twoInstances(t)
+	defer done()
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+
+	keyAuth := "tok3n.thumbprint"
+	_, acmeDomain, err := acme.TLSSNI01ChallengeCert(keyAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := tlsSniSolver{config: a}
+	if err := solver.Present("example.com", "tok3n", keyAuth); err != nil {
+		t.Fatal(err)
+	}
+	// the certificate is in the cache of the other process only
+	uncacheCertificate(acmeDomain)
+	elsewhere()
+
+	cg := configGroup{"example.com": b}
+	cert, err := cg.getCertDuringHandshake(acmeDomain, true, false)
+	if err != nil {
+		t.Fatalf("Expected the challenge certificate, got error: %v", err)
+	}
+	if len(cert.Names) != 1 || cert.Names[0] != acmeDomain || len(cert.Certificate.Certificate) == 0 {
+		t.Errorf("Expected a certificate for %s, got names %v", acmeDomain, cert.Names)
+	}
+	if _, matched, _ := getCertificate(acmeDomain); matched {
+		t.Error("Expected the challenge certificate not to be cached")
+	}
+
+	if err := solver.CleanUp("example.com", "tok3n", keyAuth); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cg.sharedChallengeCertificate(acmeDomain); ok {
+		t.Error("Expected no challenge certificate after the challenge was cleaned up")
+	}
+}
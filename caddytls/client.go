@@ -1,12 +1,14 @@
 package caddytls
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,18 @@ import (
 	"github.com/xenolf/lego/acme"
 )
 
+// acmeHTTPClient is the client for the requests to the
+// CA that are not made by the ACME library.
+var acmeHTTPClient = caddy.NewHTTPClient("ACME")
+
+func init() {
+	// the requests of the ACME library are made as the
+	// other outbound requests are, too, and have the
+	// profile and lifetime of the config added to them
+	acme.HTTPClient = *caddy.NewHTTPClient("ACME")
+	acme.HTTPClient.Transport = orderTransport{acme.HTTPClient.Transport}
+}
+
 // acmeMu ensures that only one ACME challenge occurs at a time.
 var acmeMu sync.Mutex
 
@@ -23,18 +37,25 @@ type ACMEClient struct {
 	*acme.Client
 	AllowPrompts bool
 	config       *Config
+	user         User
 }
 
-// newACMEClient creates a new ACMEClient given an email and whether
-// prompting the user is allowed. It's a variable so we can mock in tests.
-var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error) {
+// newACMEClient creates a new ACMEClient for config that uses the ACME
+// account stored as account, which is registered the first time it is
+// used, and whether prompting the user is allowed. It's a variable so
+// we can mock in tests.
+var newACMEClient = func(config *Config, account string, allowPrompts bool) (*ACMEClient, error) {
 	storage, err := config.StorageFor(config.CAUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	// Look up or create the LE user account
-	leUser, err := getUser(storage, config.ACMEEmail)
+	// Look up or create the LE user account; the account is
+	// locked until it is saved, so that the clients that are
+	// made for it at the same time do not each register it
+	unlock := lockAccount(config.CAUrl, account)
+	defer unlock()
+	leUser, err := getAccount(storage, account, config.ACMEEmail)
 	if err != nil {
 		return nil, err
 	}
@@ -45,19 +66,9 @@ var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error)
 		keyType = config.KeyType
 	}
 
-	// ensure CA URL (directory endpoint) is set
-	caURL := DefaultCAUrl
-	if config.CAUrl != "" {
-		caURL = config.CAUrl
-	}
-
-	// ensure endpoint is secure (assume HTTPS if scheme is missing)
-	if !strings.Contains(caURL, "://") {
-		caURL = "https://" + caURL
-	}
-	u, err := url.Parse(caURL)
-	if u.Scheme != "https" && !caddy.IsLoopback(u.Host) && !strings.HasPrefix(u.Host, "10.") {
-		return nil, fmt.Errorf("%s: insecure CA URL (HTTPS required)", caURL)
+	caURL, err := config.directoryURL()
+	if err != nil {
+		return nil, err
 	}
 
 	// The client facilitates our communication with the CA server.
@@ -69,25 +80,12 @@ var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error)
 	// If not registered, the user must register an account with the CA
 	// and agree to terms
 	if leUser.Registration == nil {
-		reg, err := client.Register()
+		err := registerAccount(client, &leUser, allowPrompts)
 		if err != nil {
-			return nil, errors.New("registration error: " + err.Error())
-		}
-		leUser.Registration = reg
-
-		if allowPrompts { // can't prompt a user who isn't there
-			if !Agreed && reg.TosURL == "" {
-				Agreed = promptUserAgreement(saURL, false) // TODO - latest URL
-			}
-			if !Agreed && reg.TosURL == "" {
-				return nil, errors.New("user must agree to terms")
+			if leUser.Registration != nil {
+				saveUser(storage, leUser) // Might as well try, right?
 			}
-		}
-
-		err = client.AgreeToTOS()
-		if err != nil {
-			saveUser(storage, leUser) // Might as well try, right?
-			return nil, errors.New("error agreeing to terms: " + err.Error())
+			return nil, err
 		}
 
 		// save user to the file system
@@ -97,24 +95,26 @@ var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error)
 		}
 	}
 
-	c := &ACMEClient{Client: client, AllowPrompts: allowPrompts, config: config}
+	c := &ACMEClient{Client: client, AllowPrompts: allowPrompts, config: config, user: leUser}
 
-	if config.DNSProvider == "" {
+	if config.DNSProvider == "" && len(config.DNSRoutes) == 0 {
 		// Use HTTP and TLS-SNI challenges by default
 
-		// See if HTTP challenge needs to be proxied
+		// See if HTTP challenge needs to be handled by our own facilities
 		if caddy.HasListenerWithAddress(net.JoinHostPort(config.ListenHost, HTTPChallengePort)) {
-			altPort := config.AltHTTPPort
-			if altPort == "" {
-				altPort = DefaultHTTPAlternatePort
-			}
-			c.SetHTTPAddress(net.JoinHostPort(config.ListenHost, altPort))
+			c.SetChallengeProvider(acme.HTTP01, httpSolver{config: config})
 		}
 
 		// See if TLS challenge needs to be handled by our own facilities
 		if caddy.HasListenerWithAddress(net.JoinHostPort(config.ListenHost, TLSSNIChallengePort)) {
-			c.SetChallengeProvider(acme.TLSSNI01, tlsSniSolver{})
+			c.SetChallengeProvider(acme.TLSSNI01, tlsSniSolver{config: config})
 		}
+	} else if len(config.DNSRoutes) > 0 {
+		// The DNS challenge, with the provider of the zone
+		// of each domain; they get their credentials when
+		// they are first needed
+		c.ExcludeChallenges([]acme.Challenge{acme.HTTP01, acme.TLSSNI01})
+		c.SetChallengeProvider(acme.DNS01, newDNSRouter(config.dnsRoutes()))
 	} else {
 		// Otherwise, DNS challenge it is
 
@@ -124,9 +124,8 @@ var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error)
 			return nil, errors.New("unknown DNS provider by name '" + config.DNSProvider + "'")
 		}
 
-		// we could pass credentials to create the provider, but for now
-		// we just let the solver package get them from the environment
-		prov, err := provFn()
+		// the provider gets its credentials from the environment
+		prov, err := provFn(os.Getenv, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -139,14 +138,53 @@ var newACMEClient = func(config *Config, allowPrompts bool) (*ACMEClient, error)
 	return c, nil
 }
 
+// registerAccount registers the account of user with the CA of
+// client, and agrees to its terms. It is a variable so that tests
+// can stand in for the CA.
+var registerAccount = func(client *acme.Client, user *User, allowPrompts bool) error {
+	reg, err := client.Register()
+	if err != nil {
+		return errors.New("registration error: " + err.Error())
+	}
+	user.Registration = reg
+
+	if allowPrompts { // can't prompt a user who isn't there
+		if !Agreed && reg.TosURL == "" {
+			Agreed = promptUserAgreement(saURL, false) // TODO - latest URL
+		}
+		if !Agreed && reg.TosURL == "" {
+			return errors.New("user must agree to terms")
+		}
+	}
+
+	err = client.AgreeToTOS()
+	if err != nil {
+		return errors.New("error agreeing to terms: " + err.Error())
+	}
+	return nil
+}
+
 // Obtain obtains a single certificate for names. It stores the certificate
 // on the disk if successful.
 func (c *ACMEClient) Obtain(names []string) error {
+	err := c.obtain(names)
+	c.emitCertEvent(CertObtainedEvent, "obtain", names, err)
+	return err
+}
+
+func (c *ACMEClient) obtain(names []string) error {
+	order, err := c.config.acmeOrder("")
+	if err != nil {
+		return err
+	}
+
 Attempts:
 	for attempts := 0; attempts < 2; attempts++ {
-		acmeMu.Lock()
-		certificate, failures := c.ObtainCertificate(names, true, nil)
-		acmeMu.Unlock()
+		var certificate acme.CertificateResource
+		var failures map[string]error
+		placeOrder(order, c.user, func() {
+			certificate, failures = c.ObtainCertificate(names, true, nil)
+		})
 		if len(failures) > 0 {
 			// Error - try to fix it or report it to the user and abort
 			var errMsg string             // we'll combine all the failures into a single error message
@@ -182,10 +220,13 @@ Attempts:
 		if err != nil {
 			return err
 		}
-		err = saveCertResource(storage, certificate)
+		err = saveCertResource(storage, certificate, order.profileName(), c.user)
 		if err != nil {
 			return fmt.Errorf("error saving assets for %v: %v", names, err)
 		}
+		c.config.checkLifetime(certificate)
+		c.retireOldAccountKey(storage)
+		c.audit("obtain", certificate)
 
 		break
 	}
@@ -201,18 +242,29 @@ Attempts:
 //
 // Anyway, this function is safe for concurrent use.
 func (c *ACMEClient) Renew(name string) error {
+	renewed, err := c.renew(name)
+	if renewed || err != nil {
+		c.emitCertEvent(CertRenewedEvent, "renew", []string{name}, err)
+	}
+	return err
+}
+
+// renew renews the certificate for name and reports
+// whether it did; it does not if another process
+// is renewing the certificate already.
+func (c *ACMEClient) renew(name string) (bool, error) {
 	// Get access to ACME storage
 	storage, err := c.config.StorageFor(c.config.CAUrl)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// We must lock the renewal with the storage engine
 	if lockObtained, err := storage.LockRegister(name); err != nil {
-		return err
+		return false, err
 	} else if !lockObtained {
 		log.Printf("[INFO] Certificate for %v is already being renewed elsewhere", name)
-		return nil
+		return false, nil
 	}
 	defer func() {
 		if err := storage.UnlockRegister(name); err != nil {
@@ -223,20 +275,29 @@ func (c *ACMEClient) Renew(name string) error {
 	// Prepare for renewal (load PEM cert, key, and meta)
 	siteData, err := storage.LoadSite(name)
 	if err != nil {
-		return err
+		return false, err
+	}
+	certMeta, stored := loadCertResource(siteData)
+	order, err := c.config.acmeOrder(stored.Profile)
+	if err != nil {
+		return false, err
+	}
+
+	// renew with the account that obtained the certificate
+	if account := c.config.issuingAccount(stored); account != c.user.storageName() {
+		c, err = newACMEClient(c.config, account, c.AllowPrompts)
+		if err != nil {
+			return false, err
+		}
 	}
-	var certMeta acme.CertificateResource
-	err = json.Unmarshal(siteData.Meta, &certMeta)
-	certMeta.Certificate = siteData.Cert
-	certMeta.PrivateKey = siteData.Key
 
 	// Perform renewal and retry if necessary, but not too many times.
 	var newCertMeta acme.CertificateResource
 	var success bool
 	for attempts := 0; attempts < 2; attempts++ {
-		acmeMu.Lock()
-		newCertMeta, err = c.RenewCertificate(certMeta, true)
-		acmeMu.Unlock()
+		placeOrder(order, c.user, func() {
+			newCertMeta, err = c.RenewCertificate(certMeta, true)
+		})
 		if err == nil {
 			success = true
 			break
@@ -247,7 +308,7 @@ func (c *ACMEClient) Renew(name string) error {
 		if _, ok := err.(acme.TOSError); ok {
 			err := c.AgreeToTOS()
 			if err != nil {
-				return err
+				return false, err
 			}
 			continue
 		}
@@ -259,15 +320,69 @@ func (c *ACMEClient) Renew(name string) error {
 	}
 
 	if !success {
-		return errors.New("too many renewal attempts; last error: " + err.Error())
+		return false, errors.New("too many renewal attempts; last error: " + err.Error())
+	}
+
+	err = saveCertResource(storage, newCertMeta, order.profileName(), c.user)
+	if err == nil {
+		c.config.checkLifetime(newCertMeta)
+		c.retireOldAccountKey(storage)
+		c.audit("renew", newCertMeta)
+	}
+	return true, err
+}
+
+// directoryURL returns the URL of the directory of the ACME
+// CA of c, which must be secure unless the CA is local.
+func (c *Config) directoryURL() (string, error) {
+	// ensure CA URL (directory endpoint) is set
+	caURL := DefaultCAUrl
+	if c.CAUrl != "" {
+		caURL = c.CAUrl
+	}
+
+	// ensure endpoint is secure (assume HTTPS if scheme is missing)
+	if !strings.Contains(caURL, "://") {
+		caURL = "https://" + caURL
+	}
+	u, err := url.Parse(caURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" && !caddy.IsLoopback(u.Host) && !strings.HasPrefix(u.Host, "10.") {
+		return "", fmt.Errorf("%s: insecure CA URL (HTTPS required)", caURL)
 	}
+	return caURL, nil
+}
 
-	return saveCertResource(storage, newCertMeta)
+// retireOldAccountKey deletes the key that the account of c had
+// before its last rollover from storage, now that the CA accepted
+// an order signed with the current key.
+func (c *ACMEClient) retireOldAccountKey(storage Storage) {
+	userData, err := storage.LoadUser(c.user.storageName())
+	if err != nil || len(userData.OldKey) == 0 {
+		return
+	}
+	key, err := savePrivateKey(c.user.key)
+	if err != nil || !bytes.Equal(key, userData.Key) {
+		return // the order was signed with a key that is not current
+	}
+	userData.OldKey = nil
+	err = storage.StoreUser(c.user.storageName(), userData)
+	if err != nil {
+		log.Printf("[ERROR] Removing old key of ACME account %s: %v", c.user.storageName(), err)
+	}
 }
 
 // Revoke revokes the certificate for name and deltes
 // it from storage.
 func (c *ACMEClient) Revoke(name string) error {
+	err := c.revoke(name)
+	c.emitCertEvent(CertRevokedEvent, "revoke", []string{name}, err)
+	return err
+}
+
+func (c *ACMEClient) revoke(name string) error {
 	storage, err := c.config.StorageFor(c.config.CAUrl)
 	if err != nil {
 		return err
@@ -286,6 +401,10 @@ func (c *ACMEClient) Revoke(name string) error {
 	if err != nil {
 		return err
 	}
+	var certMeta acme.CertificateResource
+	json.Unmarshal(siteData.Meta, &certMeta)
+	certMeta.Certificate = siteData.Cert
+	c.audit("revoke", certMeta)
 
 	err = storage.DeleteSite(name)
 	if err != nil {
@@ -294,3 +413,52 @@ func (c *ACMEClient) Revoke(name string) error {
 
 	return nil
 }
+
+// Names of the events emitted by this package. The payload
+// of all of them is a CertEventInfo.
+const (
+	// CertObtainedEvent is emitted when a certificate was
+	// obtained and stored.
+	CertObtainedEvent = "tls.certobtained"
+
+	// CertRenewedEvent is emitted when a certificate was
+	// renewed and stored.
+	CertRenewedEvent = "tls.certrenewed"
+
+	// CertRevokedEvent is emitted when a certificate was
+	// revoked and deleted from storage.
+	CertRevokedEvent = "tls.certrevoked"
+
+	// CertFailureEvent is emitted when obtaining, renewing
+	// or revoking a certificate failed.
+	CertFailureEvent = "tls.certfailure"
+)
+
+// CertEventInfo is the payload of the certificate events.
+type CertEventInfo struct {
+	// Names are the names on the certificate
+	Names []string
+
+	// CAUrl is the directory URL of the CA
+	CAUrl string
+
+	// Operation is "obtain", "renew" or "revoke"
+	Operation string
+
+	// Err is why the operation failed, for CertFailureEvent
+	Err error
+}
+
+// emitCertEvent emits event for the certificate for names,
+// or CertFailureEvent if err is not nil.
+func (c *ACMEClient) emitCertEvent(event, operation string, names []string, err error) {
+	if err != nil {
+		event = CertFailureEvent
+	}
+	caddy.EmitEvent(event, CertEventInfo{
+		Names:     names,
+		CAUrl:     c.config.CAUrl,
+		Operation: operation,
+		Err:       err,
+	})
+}
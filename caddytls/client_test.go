@@ -1,3 +1,50 @@
 package caddytls
 
-// TODO
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+var (
+	certEvents   []string
+	certEventsMu sync.Mutex
+)
+
+func init() {
+	caddy.RegisterEventHook("caddytls-test", func(eventName string, payload interface{}) error {
+		if info, ok := payload.(CertEventInfo); ok {
+			certEventsMu.Lock()
+			certEvents = append(certEvents, eventName+" "+info.Operation+" "+info.Names[0]+" "+info.CAUrl)
+			certEventsMu.Unlock()
+		}
+		return nil
+	})
+}
+
+func TestEmitCertEvent(t *testing.T) {
+	certEventsMu.Lock()
+	certEvents = nil
+	certEventsMu.Unlock()
+
+	c := &ACMEClient{config: &Config{CAUrl: "https://ca.example"}}
+	c.emitCertEvent(CertObtainedEvent, "obtain", []string{"example.com"}, nil)
+	c.emitCertEvent(CertRenewedEvent, "renew", []string{"example.org"}, errors.New("failed"))
+
+	certEventsMu.Lock()
+	defer certEventsMu.Unlock()
+	expected := []string{
+		CertObtainedEvent + " obtain example.com https://ca.example",
+		CertFailureEvent + " renew example.org https://ca.example",
+	}
+	if len(certEvents) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, certEvents)
+	}
+	for i := range expected {
+		if certEvents[i] != expected[i] {
+			t.Errorf("Event %d: Expected '%s', got '%s'", i, expected[i], certEvents[i])
+		}
+	}
+}
@@ -3,7 +3,6 @@ package caddytls
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -49,6 +48,13 @@ type Config struct {
 	// Manual means user provides own certs and keys
 	Manual bool
 
+	// The command, with its arguments, that is run to get
+	// the certificate of a name that is not in the cache,
+	// and how long it may take; the placeholder {host} in
+	// the arguments is replaced with the name
+	GetCertificateExec    []string
+	GetCertificateTimeout time.Duration
+
 	// Managed means config qualifies for implicit,
 	// automatic, managed TLS; as opposed to the user
 	// providing and managing the certificate manually
@@ -89,6 +95,11 @@ type Config struct {
 	// to use when solving the ACME DNS challenge
 	DNSProvider string
 
+	// The DNS providers that solve the ACME DNS
+	// challenge for the domains of their zones; the
+	// DNSProvider, if any, is the one for the rest
+	DNSRoutes []DNSRoute
+
 	// The email address to use when creating or
 	// using an ACME account (fun fact: if this
 	// is set to "off" then this config will not
@@ -99,6 +110,53 @@ type Config struct {
 	// certificates
 	KeyType acme.KeyType
 
+	// The certificate profile to order certificates
+	// with, if the CA offers profiles, and how long
+	// they should be valid; 0 leaves that to the CA
+	ACMEProfile  string
+	CertLifetime time.Duration
+
+	// How old the key of the ACME account may get
+	// before it is rolled over; 0 means it is kept
+	AccountKeyRotate time.Duration
+
+	// Whether this config uses an ACME account of its
+	// own, instead of sharing the account of its email
+	// address with the other configs that use it
+	NoAccountReuse bool
+
+	// Whether startup waits for the certificate of this
+	// config to be obtained, if it is not in storage,
+	// instead of obtaining it in the background once
+	// the servers are listening
+	BlockUntilReady bool
+
+	// Whether handshakes for a name whose certificate is
+	// being obtained in the background are refused, instead
+	// of served a temporary self-signed certificate
+	StrictSNI bool
+
+	// How often the certificate and key in storage
+	// are checked for damage after startup, where they
+	// are always checked unless NoStorageCheck is set;
+	// 0 means they are only checked at startup
+	StorageCheckInterval time.Duration
+	NoStorageCheck       bool
+
+	// The file to which every certificate that is
+	// obtained, renewed or revoked is appended, and
+	// whether its entries are hash-chained
+	AuditLog   string
+	AuditChain bool
+
+	// How the chain of each certificate is served,
+	// ChainAsObtained or ChainLeafToRoot, and whether
+	// its root is served too; the root is looked for
+	// in the chain and among RootCerts
+	ServeChain  string
+	IncludeRoot bool
+	RootCerts   []*x509.Certificate
+
 	// The explicitly set storage creator or nil; use
 	// StorageFor() to get a guaranteed non-nil Storage
 	// instance. Note, Caddy may call this frequently so
@@ -108,6 +166,11 @@ type Config struct {
 
 	// The state needed to operate on-demand TLS
 	OnDemandState OnDemandState
+
+	// certSources is the set of sources of cached
+	// certificates that this config uses; it is
+	// guarded by certCacheMu
+	certSources map[string]struct{}
 }
 
 // OnDemandState contains some state relevant for providing
@@ -121,6 +184,19 @@ type OnDemandState struct {
 	// Based on max_certs in tls config, it specifies the
 	// maximum number of certificates that can be issued.
 	MaxObtain int32
+
+	// WarmFrom is the file with the hostnames whose
+	// certificates are put in the cache at startup,
+	// one per line; no hostnames are warmed if empty
+	WarmFrom string
+
+	// WarmConcurrency is how many of those hostnames
+	// are loaded or obtained at the same time
+	WarmConcurrency int
+
+	// WarmIssue is whether certificates that are not
+	// in storage are obtained when warming the cache
+	WarmIssue bool
 }
 
 // ObtainCert obtains a certificate for c.Hostname, as long as a certificate
@@ -159,7 +235,7 @@ func (c *Config) obtainCertName(name string, allowPrompts bool) error {
 		c.ACMEEmail = getEmail(storage, allowPrompts)
 	}
 
-	client, err := newACMEClient(c, allowPrompts)
+	client, err := newACMEClient(c, c.accountName(), allowPrompts)
 	if err != nil {
 		return err
 	}
@@ -196,16 +272,18 @@ func (c *Config) renewCertName(name string, allowPrompts bool) error {
 	}()
 
 	// Prepare for renewal (load PEM cert, key, and meta)
-	siteData, err := storage.LoadSite(c.Hostname)
+	siteData, err := storage.LoadSite(name)
+	if err != nil {
+		return err
+	}
+	certMeta, stored := loadCertResource(siteData)
+	order, err := c.acmeOrder(stored.Profile)
 	if err != nil {
 		return err
 	}
-	var certMeta acme.CertificateResource
-	err = json.Unmarshal(siteData.Meta, &certMeta)
-	certMeta.Certificate = siteData.Cert
-	certMeta.PrivateKey = siteData.Key
 
-	client, err := newACMEClient(c, allowPrompts)
+	// renew with the account that obtained the certificate
+	client, err := newACMEClient(c, c.issuingAccount(stored), allowPrompts)
 	if err != nil {
 		return err
 	}
@@ -214,9 +292,9 @@ func (c *Config) renewCertName(name string, allowPrompts bool) error {
 	var newCertMeta acme.CertificateResource
 	var success bool
 	for attempts := 0; attempts < 2; attempts++ {
-		acmeMu.Lock()
-		newCertMeta, err = client.RenewCertificate(certMeta, true)
-		acmeMu.Unlock()
+		placeOrder(order, client.user, func() {
+			newCertMeta, err = client.RenewCertificate(certMeta, true)
+		})
 		if err == nil {
 			success = true
 			break
@@ -240,7 +318,14 @@ func (c *Config) renewCertName(name string, allowPrompts bool) error {
 		return errors.New("too many renewal attempts; last error: " + err.Error())
 	}
 
-	return saveCertResource(storage, newCertMeta)
+	err = saveCertResource(storage, newCertMeta, order.profileName(), client.user)
+	if err != nil {
+		return err
+	}
+	c.checkLifetime(newCertMeta)
+	client.retireOldAccountKey(storage)
+	client.audit("renew", newCertMeta)
+	return nil
 }
 
 // StorageFor obtains a TLS Storage instance for the given CA URL which should
@@ -438,6 +523,94 @@ func SetDefaultTLSParams(config *Config) {
 	config.PreferServerCipherSuites = true
 }
 
+// Summary describes the effective settings of a Config,
+// as they are exported. It never contains secrets.
+type Summary struct {
+	Enabled     bool     `json:"enabled"`
+	Manual      bool     `json:"manual,omitempty"`
+	OnDemand    bool     `json:"on_demand,omitempty"`
+	SelfSigned  bool     `json:"self_signed,omitempty"`
+	CA          string   `json:"ca,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	KeyType     string   `json:"key_type,omitempty"`
+	DNSProvider string   `json:"dns_provider,omitempty"`
+	ProtocolMin string   `json:"protocol_min,omitempty"`
+	ProtocolMax string   `json:"protocol_max,omitempty"`
+	Ciphers     []string `json:"ciphers,omitempty"`
+}
+
+// Summary describes the effective settings of c. The names of
+// key types, protocols and ciphers are the ones used in the
+// Caddyfile. The CA and key type are only given if certificates
+// for c are obtained from a CA.
+func (c *Config) Summary() Summary {
+	if !c.Enabled {
+		return Summary{}
+	}
+	summary := Summary{
+		Enabled:     true,
+		Manual:      c.Manual,
+		OnDemand:    c.OnDemand,
+		SelfSigned:  c.SelfSigned,
+		DNSProvider: c.DNSProvider,
+	}
+	if len(c.DNSRoutes) > 0 {
+		var names []string
+		for _, route := range c.dnsRoutes() {
+			names = append(names, route.Name)
+		}
+		summary.DNSProvider = strings.Join(names, ", ")
+	}
+	if !c.SelfSigned && (!c.Manual || c.OnDemand) {
+		summary.CA = c.CAUrl
+		if summary.CA == "" {
+			summary.CA = DefaultCAUrl
+		}
+		summary.Email = c.ACMEEmail
+		keyType := c.KeyType
+		if keyType == "" {
+			keyType = DefaultKeyType
+		}
+		for name, kt := range supportedKeyTypes {
+			if kt == keyType {
+				summary.KeyType = name
+			}
+		}
+	}
+	summary.ProtocolMin = ProtocolName(c.ProtocolMinVersion)
+	summary.ProtocolMax = ProtocolName(c.ProtocolMaxVersion)
+	for _, cipher := range c.Ciphers {
+		if name := CipherName(cipher); name != "" {
+			summary.Ciphers = append(summary.Ciphers, name)
+		}
+	}
+	return summary
+}
+
+// ProtocolName returns the name of the TLS protocol version
+// as it is written in the Caddyfile, like "tls1.2", or an
+// empty string if the version is not supported.
+func ProtocolName(version uint16) string {
+	for name, v := range supportedProtocols {
+		if v == version {
+			return name
+		}
+	}
+	return ""
+}
+
+// CipherName returns the name of the cipher suite as it is
+// written in the Caddyfile, like "ECDHE-RSA-AES128-GCM-SHA256",
+// or an empty string if the suite is not supported.
+func CipherName(suite uint16) string {
+	for name, s := range supportedCiphersMap {
+		if s == suite {
+			return name
+		}
+	}
+	return ""
+}
+
 // Map of supported key types
 var supportedKeyTypes = map[string]acme.KeyType{
 	"P384":    acme.EC384,
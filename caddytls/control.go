@@ -0,0 +1,186 @@
+package caddytls
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// CertificateInfo describes a certificate in the cache.
+type CertificateInfo struct {
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Managed   bool      `json:"managed"`
+	OnDemand  bool      `json:"on_demand"`
+	Default   bool      `json:"default"`
+
+	// The status in the OCSP staple, if the certificate has
+	// one: "good", "revoked" or "unknown"
+	OCSPStatus string `json:"ocsp_status,omitempty"`
+}
+
+// CachedCertificates describes the certificates in the
+// cache, once each, in the order of their first names.
+//
+// This function is safe for concurrent use.
+func CachedCertificates() []CertificateInfo {
+	var infos []CertificateInfo
+	seen := make(map[string]struct{})
+
+	certCacheMu.RLock()
+	for _, cert := range certCache {
+		if len(cert.Certificate.Certificate) == 0 {
+			continue
+		}
+		leaf := string(cert.Certificate.Certificate[0])
+		if _, ok := seen[leaf]; ok {
+			continue
+		}
+		seen[leaf] = struct{}{}
+
+		info := CertificateInfo{NotBefore: cert.NotBefore, NotAfter: cert.NotAfter}
+		for _, name := range cert.Names {
+			if name == "" {
+				info.Default = true
+				continue
+			}
+			info.Names = append(info.Names, name)
+		}
+		if cert.Config != nil {
+			info.Managed, info.OnDemand = cert.Config.Managed, cert.Config.OnDemand
+		}
+		if parsed, err := x509.ParseCertificate(cert.Certificate.Certificate[0]); err == nil {
+			info.Issuer = parsed.Issuer.CommonName
+		}
+		if cert.OCSP != nil {
+			switch cert.OCSP.Status {
+			case ocsp.Good:
+				info.OCSPStatus = "good"
+			case ocsp.Revoked:
+				info.OCSPStatus = "revoked"
+			default:
+				info.OCSPStatus = "unknown"
+			}
+		}
+		infos = append(infos, info)
+	}
+	certCacheMu.RUnlock()
+
+	sort.Sort(certInfosByName(infos))
+	return infos
+}
+
+type certInfosByName []CertificateInfo
+
+func (c certInfosByName) Len() int      { return len(c) }
+func (c certInfosByName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c certInfosByName) Less(i, j int) bool {
+	if len(c[i].Names) == 0 || len(c[j].Names) == 0 {
+		return len(c[i].Names) < len(c[j].Names)
+	}
+	return c[i].Names[0] < c[j].Names[0]
+}
+
+// cachedCertificate returns the certificate in the
+// cache for host, which must match one of its names.
+func cachedCertificate(host string) (Certificate, error) {
+	cert, matched, _ := getCertificate(strings.ToLower(host))
+	if !matched {
+		return Certificate{}, ErrNoCertificate
+	}
+	return cert, nil
+}
+
+// RenewCertificate renews the certificate in the cache for host
+// now, however long it has left, and puts the renewed certificate
+// in the cache. Like the renewals of the maintenance routine, it
+// does nothing but reload the certificate from storage if the
+// lock on the renewal is held elsewhere. A certificate from the
+// get_certificate command is renewed by running it again.
+//
+// This function is safe for concurrent use.
+func RenewCertificate(host string) error {
+	cert, err := cachedCertificate(host)
+	if err != nil {
+		return err
+	}
+	if isExecCertificate(cert) {
+		_, err := cert.Config.execCertificate(strings.TrimPrefix(cert.source, execSourcePrefix))
+		return err
+	}
+	if cert.Config == nil || !cert.Config.Managed || cert.Config.SelfSigned {
+		return fmt.Errorf("certificate for %s is not managed", host)
+	}
+	if err := cert.Config.renewCertName(cert.Names[0], false); err != nil {
+		return err
+	}
+	return recacheCertificate(cert)
+}
+
+// EvictCertificate removes the certificate for host from the
+// cache. If fromStorage is true, the certificate, which must be
+// managed, and its key are also deleted from storage, under the
+// same lock as its renewals; otherwise, the next handshake that
+// needs the certificate loads it again if the config of its site
+// has on-demand TLS. Another certificate becomes the default
+// if this one was.
+//
+// This function is safe for concurrent use.
+func EvictCertificate(host string, fromStorage bool) error {
+	cert, err := cachedCertificate(host)
+	if err != nil {
+		return err
+	}
+	if fromStorage {
+		if cert.Config == nil || !cert.Config.Managed {
+			return fmt.Errorf("certificate for %s is not managed, so it is not in storage", host)
+		}
+		name := cert.Names[0]
+		storage, err := cert.Config.StorageFor(cert.Config.CAUrl)
+		if err != nil {
+			return err
+		}
+		if lockObtained, err := storage.LockRegister(name); err != nil {
+			return err
+		} else if !lockObtained {
+			return fmt.Errorf("certificate for %s is being renewed elsewhere", name)
+		}
+		err = storage.DeleteSite(name)
+		if unlockErr := storage.UnlockRegister(name); err == nil {
+			err = unlockErr
+		}
+		if err != nil && err != ErrStorageNotFound {
+			return err
+		}
+	}
+
+	certCacheMu.Lock()
+	evictSource(cert.source, cert.Names[0])
+	certCacheMu.Unlock()
+	return nil
+}
+
+// ResetOnDemandFailures forgets the recent failures to obtain
+// certificates on demand and to run the get_certificate command,
+// so that the next handshakes for those names try again right
+// away. It returns how many names were forgotten.
+//
+// This function is safe for concurrent use.
+func ResetOnDemandFailures() int {
+	failedIssuanceMu.Lock()
+	n := len(failedIssuance)
+	failedIssuance = make(map[string]time.Time)
+	failedIssuanceMu.Unlock()
+
+	execFailuresMu.Lock()
+	n += len(execFailures)
+	execFailures = make(map[string]execFailure)
+	execFailuresMu.Unlock()
+	return n
+}
@@ -0,0 +1,149 @@
+package caddytls
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// lockedStorage is storage whose certificates are being
+// renewed elsewhere, so its register lock is never obtained.
+type lockedStorage struct {
+	Storage
+}
+
+func (s lockedStorage) LockRegister(domain string) (bool, error) {
+	return false, nil
+}
+
+func TestCertificateControl(t *testing.T) {
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+
+	dir, err := ioutil.TempDir("", "caddytls_control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := FileStorage(dir)
+	var locked bool
+	cfg := &Config{
+		Managed: true,
+		CAUrl:   "https://ca.test/directory",
+		StorageCreator: func(caURL *url.URL) (Storage, error) {
+			if locked {
+				return lockedStorage{storage}, nil
+			}
+			return storage, nil
+		},
+	}
+	store := func(name string) {
+		certPEM, keyPEM := makeTestCertPEM(t, name)
+		if err := storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		store(name)
+		if _, err := CacheManagedCertificate(name, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certPEM, keyPEM := makeTestCertPEM(t, "manual.example.com")
+	if err := cacheUnmanagedCertificatePEMBytes(new(Config), certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := CachedCertificates()
+	if len(infos) != 3 {
+		t.Fatalf("Expected 3 certificates, got %d: %+v", len(infos), infos)
+	}
+	for i, expected := range []struct {
+		name           string
+		managed, deflt bool
+	}{
+		{"a.example.com", true, true},
+		{"b.example.com", true, false},
+		{"manual.example.com", false, false},
+	} {
+		info := infos[i]
+		if len(info.Names) != 1 || info.Names[0] != expected.name {
+			t.Errorf("Certificate %d: Expected names [%s], got %v", i, expected.name, info.Names)
+		}
+		if info.Managed != expected.managed || info.Default != expected.deflt {
+			t.Errorf("Certificate %d: Expected managed=%v default=%v, got %+v", i, expected.managed, expected.deflt, info)
+		}
+		if info.Issuer != expected.name || time.Now().After(info.NotAfter) {
+			t.Errorf("Certificate %d: Unexpected issuer or validity: %+v", i, info)
+		}
+	}
+
+	// the lock is held elsewhere, where b.example.com was renewed;
+	// renewing it here only loads the renewed one from storage
+	locked = true
+	before, _ := cachedCertificate("b.example.com")
+	store("b.example.com")
+	if err := RenewCertificate("b.example.com"); err != nil {
+		t.Fatalf("Expected no error renewing, got: %v", err)
+	}
+	after, _ := cachedCertificate("b.example.com")
+	if string(after.Certificate.Certificate[0]) == string(before.Certificate.Certificate[0]) {
+		t.Error("Expected the renewed certificate in the cache")
+	}
+	if err := RenewCertificate("manual.example.com"); err == nil {
+		t.Error("Expected error renewing an unmanaged certificate, got none")
+	}
+	if err := RenewCertificate("nosuch.example.com"); err != ErrNoCertificate {
+		t.Errorf("Expected ErrNoCertificate, got: %v", err)
+	}
+
+	// evicting from storage takes the lock too
+	if err := EvictCertificate("a.example.com", true); err == nil {
+		t.Error("Expected error evicting from storage while the lock is held elsewhere, got none")
+	}
+	locked = false
+	if err := EvictCertificate("a.example.com", true); err != nil {
+		t.Fatalf("Expected no error evicting, got: %v", err)
+	}
+	if storage.SiteExists("a.example.com") {
+		t.Error("Expected certificate to be deleted from storage")
+	}
+	if _, err := cachedCertificate("a.example.com"); err != ErrNoCertificate {
+		t.Errorf("Expected certificate to be evicted from the cache, got: %v", err)
+	}
+	if _, _, defaulted := getCertificate("nosuch.example.com"); !defaulted {
+		t.Error("Expected another certificate to become the default")
+	}
+	if err := EvictCertificate("manual.example.com", false); err != nil {
+		t.Errorf("Expected no error evicting from the cache only, got: %v", err)
+	}
+	if err := EvictCertificate("manual.example.com", true); err != ErrNoCertificate {
+		t.Errorf("Expected ErrNoCertificate evicting twice, got: %v", err)
+	}
+}
+
+func TestResetOnDemandFailures(t *testing.T) {
+	failedIssuanceMu.Lock()
+	failedIssuance["a.example.com"] = time.Now()
+	failedIssuanceMu.Unlock()
+	execFailuresMu.Lock()
+	execFailures["b.example.com"] = execFailure{err: ErrNoCertificate, when: time.Now()}
+	execFailuresMu.Unlock()
+
+	if n := ResetOnDemandFailures(); n != 2 {
+		t.Errorf("Expected 2 names forgotten, got %d", n)
+	}
+	if err := (configGroup{}).checkLimitsForObtainingNewCerts("a.example.com", new(Config)); err != nil {
+		t.Errorf("Expected no throttling after reset, got: %v", err)
+	}
+	if err := recentExecFailure("b.example.com"); err != nil {
+		t.Errorf("Expected no remembered failure after reset, got: %v", err)
+	}
+	if n := ResetOnDemandFailures(); n != 0 {
+		t.Errorf("Expected nothing to forget, got %d", n)
+	}
+}
@@ -7,20 +7,23 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ocsp"
@@ -32,6 +35,9 @@ import (
 // loadPrivateKey loads a PEM-encoded ECC/RSA private key from an array of bytes.
 func loadPrivateKey(keyBytes []byte) (crypto.PrivateKey, error) {
 	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return nil, errors.New("no PEM data in private key")
+	}
 
 	switch keyBlock.Type {
 	case "RSA PRIVATE KEY":
@@ -64,23 +70,38 @@ func savePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 	return pem.EncodeToMemory(&pemKey), nil
 }
 
-// stapleOCSP staples OCSP information to cert for hostname name.
-// If you have it handy, you should pass in the PEM-encoded certificate
-// bundle; otherwise the DER-encoded cert will have to be PEM-encoded.
-// If you don't have the PEM blocks already, just pass in nil.
+// stapleOCSP staples OCSP information to cert, whether it is managed
+// or loaded from files. The staple is cached on disk under the hash of
+// the leaf certificate, so it is used again after a restart as long as
+// it is fresh, and a certificate that replaces another one gets its own.
 //
-// Errors here are not necessarily fatal, it could just be that the
-// certificate doesn't have an issuer URL.
-func stapleOCSP(cert *Certificate, pemBundle []byte) error {
-	if pemBundle == nil {
-		// The function in the acme package that gets OCSP requires a PEM-encoded cert
-		bundle := new(bytes.Buffer)
-		for _, derBytes := range cert.Certificate.Certificate {
-			pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+// Certificates that do not name an OCSP responder are skipped without
+// an error. Other errors here are not fatal; the certificate is just
+// served without a staple.
+func stapleOCSP(cert *Certificate) error {
+	if len(cert.Certificate.Certificate) == 0 {
+		return nil
+	}
+	leaf := cert.Certificate.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("no OCSP stapling for %v: %v", cert.Names, err)
 		}
-		pemBundle = bundle.Bytes()
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil
 	}
 
+	// The function that gets OCSP requires a PEM-encoded bundle,
+	// which has the intermediates that were added to the chain
+	bundle := new(bytes.Buffer)
+	for _, derBytes := range cert.Certificate.Certificate {
+		pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	}
+	pemBundle := bundle.Bytes()
+
 	var ocspBytes []byte
 	var ocspResp *ocsp.Response
 	var ocspErr error
@@ -89,8 +110,7 @@ func stapleOCSP(cert *Certificate, pemBundle []byte) error {
 	// First try to load OCSP staple from storage and see if
 	// we can still use it.
 	// TODO: Use Storage interface instead of disk directly
-	ocspFileName := cert.Names[0] + "-" + fastHash(pemBundle)
-	ocspCachePath := filepath.Join(ocspFolder, ocspFileName)
+	ocspCachePath := filepath.Join(ocspFolder, stapleFileName(cert))
 	cachedOCSP, err := ioutil.ReadFile(ocspCachePath)
 	if err == nil {
 		resp, err := ocsp.ParseResponse(cachedOCSP, nil)
@@ -112,10 +132,8 @@ func stapleOCSP(cert *Certificate, pemBundle []byte) error {
 	// If we couldn't get a fresh staple by reading the cache,
 	// then we need to request it from the OCSP responder
 	if ocspResp == nil || len(ocspBytes) == 0 {
-		ocspBytes, ocspResp, ocspErr = acme.GetOCSPForCert(pemBundle)
+		ocspBytes, ocspResp, ocspErr = getOCSPForCert(pemBundle)
 		if ocspErr != nil {
-			// An error here is not a problem because a certificate may simply
-			// not contain a link to an OCSP server. But we should log it anyway.
 			// There's nothing else we can do to get OCSP for this certificate,
 			// so we can return here with the error.
 			return fmt.Errorf("no OCSP stapling for %v: %v", cert.Names, ocspErr)
@@ -125,12 +143,18 @@ func stapleOCSP(cert *Certificate, pemBundle []byte) error {
 
 	// By now, we should have a response. If good, staple it to
 	// the certificate. If the OCSP response was not loaded from
-	// storage, we persist it for next time.
+	// storage, we persist it for next time. A revoked status is
+	// never stapled, but kept so that the certificate is replaced.
+	if ocspResp.Status == ocsp.Revoked {
+		cert.Certificate.OCSPStaple = nil
+		cert.OCSP = ocspResp
+		return nil
+	}
 	if ocspResp.Status == ocsp.Good {
 		cert.Certificate.OCSPStaple = ocspBytes
 		cert.OCSP = ocspResp
 		if gotNewOCSP {
-			err := os.MkdirAll(filepath.Join(caddy.AssetsPath(), "ocsp"), 0700)
+			err := os.MkdirAll(ocspFolder, 0700)
 			if err != nil {
 				return fmt.Errorf("unable to make OCSP staple path for %v: %v", cert.Names, err)
 			}
@@ -144,10 +168,117 @@ func stapleOCSP(cert *Certificate, pemBundle []byte) error {
 	return nil
 }
 
+// stapleFileName returns the name of the file that the OCSP staple
+// of cert is cached in, which is keyed by the hash of its leaf.
+func stapleFileName(cert *Certificate) string {
+	sum := sha256.Sum256(cert.Certificate.Certificate[0])
+	name := hex.EncodeToString(sum[:])
+	if len(cert.Names) > 0 && cert.Names[0] != "" {
+		name = cert.Names[0] + "-" + name
+	}
+	return name
+}
+
+// ocspHTTPClient is the client for the requests
+// to OCSP responders and for issuer certificates.
+var ocspHTTPClient = caddy.NewHTTPClient("OCSP")
+
+// getOCSPForCert gets the OCSP response for the leaf of the PEM
+// bundle from the responder that the leaf names. The issuer of
+// the leaf is the next certificate in the bundle or, if there is
+// none, the certificate at the issuer URL of the leaf.
+func getOCSPForCert(bundle []byte) ([]byte, *ocsp.Response, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificates in bundle")
+	}
+	leaf := certs[0]
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("no OCSP server specified in certificate")
+	}
+
+	var issuer *x509.Certificate
+	if len(certs) > 1 {
+		issuer = certs[1]
+	} else {
+		if len(leaf.IssuingCertificateURL) == 0 {
+			return nil, nil, errors.New("no issuing certificate URL in certificate")
+		}
+		der, err := ocspGet(leaf.IssuingCertificateURL[0], "", nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting issuer certificate: %v", err)
+		}
+		issuer, err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("issuer certificate: %v", err)
+		}
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := ocspGet(leaf.OCSPServer[0], "application/ocsp-request", req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponse(raw, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+// ocspGet returns the body of the response to a GET request
+// to url, or, if body is not nil, to a POST request of body.
+func ocspGet(url, contentType string, body []byte) ([]byte, error) {
+	var resp *http.Response
+	var err error
+	if body == nil {
+		resp, err = ocspHTTPClient.Get(url)
+	} else {
+		resp, err = ocspHTTPClient.Post(url, contentType, bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
 // makeSelfSignedCert makes a self-signed certificate according
 // to the parameters in config. It then caches the certificate
 // in our cache.
 func makeSelfSignedCert(config *Config) error {
+	cert, err := newSelfSignedCert(config, config.Hostname)
+	if err != nil {
+		return err
+	}
+	cacheCertificate(cert)
+	return nil
+}
+
+// newSelfSignedCert makes a self-signed certificate for hostname
+// according to the parameters in config, without caching it.
+func newSelfSignedCert(config *Config, hostname string) (Certificate, error) {
 	// start by generating private key
 	var privKey interface{}
 	var err error
@@ -163,10 +294,10 @@ func makeSelfSignedCert(config *Config) error {
 	case acme.RSA8192:
 		privKey, err = rsa.GenerateKey(rand.Reader, 8192)
 	default:
-		return fmt.Errorf("cannot generate private key; unknown key type %v", config.KeyType)
+		return Certificate{}, fmt.Errorf("cannot generate private key; unknown key type %v", config.KeyType)
 	}
 	if err != nil {
-		return fmt.Errorf("failed to generate private key: %v", err)
+		return Certificate{}, fmt.Errorf("failed to generate private key: %v", err)
 	}
 
 	// create certificate structure with proper values
@@ -175,7 +306,7 @@ func makeSelfSignedCert(config *Config) error {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %v", err)
+		return Certificate{}, fmt.Errorf("failed to generate serial number: %v", err)
 	}
 	cert := &x509.Certificate{
 		SerialNumber: serialNumber,
@@ -185,10 +316,10 @@ func makeSelfSignedCert(config *Config) error {
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
-	if ip := net.ParseIP(config.Hostname); ip != nil {
+	if ip := net.ParseIP(hostname); ip != nil {
 		cert.IPAddresses = append(cert.IPAddresses, ip)
 	} else {
-		cert.DNSNames = append(cert.DNSNames, config.Hostname)
+		cert.DNSNames = append(cert.DNSNames, hostname)
 	}
 
 	publicKey := func(privKey interface{}) interface{} {
@@ -203,10 +334,10 @@ func makeSelfSignedCert(config *Config) error {
 	}
 	derBytes, err := x509.CreateCertificate(rand.Reader, cert, cert, publicKey(privKey), privKey)
 	if err != nil {
-		return fmt.Errorf("could not create certificate: %v", err)
+		return Certificate{}, fmt.Errorf("could not create certificate: %v", err)
 	}
 
-	cacheCertificate(Certificate{
+	return Certificate{
 		Certificate: tls.Certificate{
 			Certificate: [][]byte{derBytes},
 			PrivateKey:  privKey,
@@ -215,9 +346,7 @@ func makeSelfSignedCert(config *Config) error {
 		Names:    cert.DNSNames,
 		NotAfter: cert.NotAfter,
 		Config:   config,
-	})
-
-	return nil
+	}, nil
 }
 
 // RotateSessionTicketKeys rotates the TLS session ticket keys
@@ -252,18 +381,22 @@ func standaloneTLSTicketKeyRotation(c *tls.Config, ticker *time.Ticker, exitChan
 
 	// The entire page should be marked as sticky, but Go cannot do that
 	// without resorting to syscall#Mlock. And, we don't have madvise (for NODUMP), too. ☹
-	keys := make([][32]byte, 1, NumTickets)
+	keys := inheritedTicketKeys()
+	if len(keys) == 0 {
+		keys = make([][32]byte, 1, NumTickets)
 
-	rng := c.Rand
-	if rng == nil {
-		rng = rand.Reader
-	}
-	if _, err := io.ReadFull(rng, keys[0][:]); err != nil {
-		c.SessionTicketsDisabled = true // bail if we don't have the entropy for the first one
-		return
+		rng := c.Rand
+		if rng == nil {
+			rng = rand.Reader
+		}
+		if _, err := io.ReadFull(rng, keys[0][:]); err != nil {
+			c.SessionTicketsDisabled = true // bail if we don't have the entropy for the first one
+			return
+		}
 	}
 	c.SessionTicketKey = keys[0] // SetSessionTicketKeys doesn't set a 'tls.keysAlreadySet'
 	c.SetSessionTicketKeys(setSessionTicketKeysTestHook(keys))
+	recordTicketKeys(keys)
 
 	for {
 		select {
@@ -272,7 +405,7 @@ func standaloneTLSTicketKeyRotation(c *tls.Config, ticker *time.Ticker, exitChan
 				return
 			}
 		case <-ticker.C:
-			rng = c.Rand // could've changed since the start
+			rng := c.Rand // could've changed since the start
 			if rng == nil {
 				rng = rand.Reader
 			}
@@ -291,17 +424,66 @@ func standaloneTLSTicketKeyRotation(c *tls.Config, ticker *time.Ticker, exitChan
 			}
 			// pushes the last key out, doesn't matter that we don't have a new one
 			c.SetSessionTicketKeys(setSessionTicketKeysTestHook(keys))
+			recordTicketKeys(keys)
 		}
 	}
 }
 
-// fastHash hashes input using a hashing algorithm that
-// is fast, and returns the hash as a hex-encoded string.
-// Do not use this for cryptographic purposes.
-func fastHash(input []byte) string {
-	h := fnv.New32a()
-	h.Write([]byte(input))
-	return fmt.Sprintf("%x", h.Sum32())
+// The session ticket keys most recently put in use, which are
+// handed to the new process during an upgrade, and the ones
+// inherited from the old process, with which new key rotations
+// start so that clients can resume their sessions.
+var (
+	currentTicketKeys [][32]byte
+	inheritedKeys     [][32]byte
+	ticketKeysMu      sync.Mutex
+)
+
+// recordTicketKeys records keys as the keys most recently put in use.
+func recordTicketKeys(keys [][32]byte) {
+	ticketKeysMu.Lock()
+	currentTicketKeys = append(currentTicketKeys[:0], keys...)
+	ticketKeysMu.Unlock()
+}
+
+// inheritedTicketKeys returns a copy of the ticket keys
+// inherited from the old process, if any.
+func inheritedTicketKeys() [][32]byte {
+	ticketKeysMu.Lock()
+	defer ticketKeysMu.Unlock()
+	if len(inheritedKeys) == 0 {
+		return nil
+	}
+	keys := make([][32]byte, len(inheritedKeys), NumTickets)
+	copy(keys, inheritedKeys)
+	return keys
+}
+
+// saveTicketKeys encodes the current ticket keys for an upgrade.
+func saveTicketKeys() ([]byte, error) {
+	ticketKeysMu.Lock()
+	defer ticketKeysMu.Unlock()
+	var data []byte
+	for _, key := range currentTicketKeys {
+		data = append(data, key[:]...)
+	}
+	return data, nil
+}
+
+// restoreTicketKeys decodes the ticket keys of the old process.
+func restoreTicketKeys(data []byte) error {
+	if len(data)%32 != 0 || len(data)/32 > NumTickets {
+		return fmt.Errorf("invalid session ticket keys (%d bytes)", len(data))
+	}
+	ticketKeysMu.Lock()
+	defer ticketKeysMu.Unlock()
+	inheritedKeys = nil
+	for i := 0; i < len(data); i += 32 {
+		var key [32]byte
+		copy(key[:], data[i:])
+		inheritedKeys = append(inheritedKeys, key)
+	}
+	return nil
 }
 
 const (
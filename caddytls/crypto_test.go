@@ -9,8 +9,16 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestSaveAndLoadRSAPrivateKey(t *testing.T) {
@@ -133,3 +141,203 @@ func TestStandaloneTLSTicketKeyRotation(t *testing.T) {
 		}
 	}
 }
+
+func TestInheritedTLSTicketKeys(t *testing.T) {
+	defer func() {
+		ticketKeysMu.Lock()
+		inheritedKeys = nil
+		currentTicketKeys = nil
+		ticketKeysMu.Unlock()
+	}()
+
+	oldKeys := [][32]byte{{1}, {2}}
+	recordTicketKeys(oldKeys)
+	data, err := saveTicketKeys()
+	if err != nil {
+		t.Fatalf("Expected no error saving keys, got: %v", err)
+	}
+	if err := restoreTicketKeys(data[:40]); err == nil {
+		t.Error("Expected an error restoring truncated keys, got none")
+	}
+	if err := restoreTicketKeys(data); err != nil {
+		t.Fatalf("Expected no error restoring keys, got: %v", err)
+	}
+
+	gotKeys := make(chan [][32]byte, 1)
+	oldHook := setSessionTicketKeysTestHook
+	defer func() {
+		setSessionTicketKeysTestHook = oldHook
+	}()
+	setSessionTicketKeysTestHook = func(keys [][32]byte) [][32]byte {
+		gotKeys <- append([][32]byte(nil), keys...)
+		return keys
+	}
+
+	// the rotation must be over before the keys are reset
+	exitChan, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(exitChan)
+		<-stopped
+	}()
+	go func() {
+		standaloneTLSTicketKeyRotation(new(tls.Config), time.NewTicker(time.Hour), exitChan)
+		close(stopped)
+	}()
+
+	select {
+	case keys := <-gotKeys:
+		if len(keys) != len(oldKeys) || keys[0] != oldKeys[0] || keys[1] != oldKeys[1] {
+			t.Errorf("Expected rotation to start with inherited keys %v, got %v", oldKeys, keys)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for ticket keys to be set")
+	}
+}
+
+// handshakeStaple makes a TLS handshake with cg for serverName,
+// and returns the leaf that is served and the staple that comes
+// with it, parsed.
+func handshakeStaple(t *testing.T, cg configGroup, serverName string) (*x509.Certificate, *ocsp.Response) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Server(server, &tls.Config{GetCertificate: cg.GetCertificate}).Handshake()
+	conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake for '%s': %v", serverName, err)
+	}
+	state := conn.ConnectionState()
+	leaf := state.PeerCertificates[0]
+	if len(state.OCSPResponse) == 0 {
+		return leaf, nil
+	}
+	resp, err := ocsp.ParseResponse(state.OCSPResponse, nil)
+	if err != nil {
+		t.Fatalf("Staple for '%s': %v", serverName, err)
+	}
+	return leaf, resp
+}
+
+// ocspTestFolder points the OCSP staple cache at a temporary
+// folder, and returns the function that puts it back.
+func ocspTestFolder(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "caddytls_ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalFolder := ocspFolder
+	ocspFolder = dir
+	return func() {
+		ocspFolder = originalFolder
+		os.RemoveAll(dir)
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}
+}
+
+func TestStapleManualCertificate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer ocspTestFolder(t)()
+	ca := newOCSPTestCA(t)
+	defer ca.server.Close()
+
+	dir, err := ioutil.TempDir("", "caddytls_manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	load := func(serial int64) {
+		data := ca.issue(t, "example.com", serial)
+		if err := ioutil.WriteFile(certFile, data.Cert, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, data.Key, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := cacheUnmanagedCertificatePEMFile(&Config{}, certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cg := configGroup{"example.com": &Config{}}
+
+	// the staple comes with the handshakes, with or without SNI
+	load(200)
+	var first *ocsp.Response
+	for _, serverName := range []string{"example.com", ""} {
+		leaf, staple := handshakeStaple(t, cg, serverName)
+		if staple == nil || staple.SerialNumber.Cmp(leaf.SerialNumber) != 0 || leaf.SerialNumber.Int64() != 200 {
+			t.Fatalf("Expected certificate 200 to be served with its staple for '%s', got %v", serverName, staple)
+		}
+		first = staple
+	}
+
+	// a new response from the responder is stapled in its place
+	requests := ca.requestCount()
+	ca.rotate()
+	UpdateOCSPStaples()
+	if ca.requestCount() != requests+1 {
+		t.Errorf("Expected the staple to be refreshed once, got %d requests", ca.requestCount()-requests)
+	}
+	if _, staple := handshakeStaple(t, cg, "example.com"); staple == nil || !staple.NextUpdate.After(first.NextUpdate) {
+		t.Errorf("Expected the refreshed staple to be served, got %v", staple)
+	}
+
+	// a reloaded certificate file gets a staple of its own
+	load(201)
+	for _, serverName := range []string{"example.com", ""} {
+		leaf, staple := handshakeStaple(t, cg, serverName)
+		if staple == nil || staple.SerialNumber.Cmp(leaf.SerialNumber) != 0 || leaf.SerialNumber.Int64() != 201 {
+			t.Errorf("Expected reloaded certificate 201 to be served with its staple for '%s', got %v", serverName, staple)
+		}
+	}
+}
+
+func TestStapleCachedByCertificateHash(t *testing.T) {
+	defer ocspTestFolder(t)()
+	ca := newOCSPTestCA(t)
+	defer ca.server.Close()
+	ca.fresh = true
+
+	// a certificate without names is stapled too; its staple
+	// is used again when it is loaded after a restart
+	data := ca.issue(t, "127.0.0.1", 300)
+	for i := 0; i < 2; i++ {
+		cert, err := makeCertificate(&Config{}, data.Cert, data.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.Certificate.OCSPStaple) == 0 {
+			t.Errorf("Load %d: Expected the certificate to be stapled", i)
+		}
+	}
+	if n := ca.requestCount(); n != 1 {
+		t.Errorf("Expected the staple to be fetched once and then read from disk, got %d requests", n)
+	}
+
+	// the same leaf in a bundle written differently has the same staple
+	reformatted := append([]byte("# comment\n"), data.Cert...)
+	if _, err := makeCertificate(&Config{}, reformatted, data.Key); err != nil {
+		t.Fatal(err)
+	}
+	if n := ca.requestCount(); n != 1 {
+		t.Errorf("Expected the staple to be keyed by the certificate, got %d requests", n)
+	}
+}
+
+func TestStapleSkipsCertificateWithoutResponder(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer ocspTestFolder(t)()
+
+	certPEM, keyPEM := makeTestCertPEM(t, "internal.example.com")
+	if err := cacheUnmanagedCertificatePEMBytes(&Config{}, certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	UpdateOCSPStaples()
+	if strings.Contains(buf.String(), "OCSP") {
+		t.Errorf("Expected a certificate without an OCSP responder to be skipped silently, got log %q", buf.String())
+	}
+}
@@ -0,0 +1,213 @@
+package caddytls
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// DNSRoute is an instance of a DNS provider that solves the ACME
+// DNS challenge for the domains in its zones.
+type DNSRoute struct {
+	// The name the provider was registered with
+	Provider string
+
+	// The name of this instance; it defaults to Provider
+	Name string
+
+	// The prefix of the environment variables this instance
+	// gets its credentials from, if it was given a name: the
+	// provider sees CORP_AWS_ACCESS_KEY_ID as AWS_ACCESS_KEY_ID
+	// for the instance named corp; empty means the provider
+	// reads the environment as it is
+	EnvPrefix string
+
+	// The options of the provider given to this instance,
+	// which are up to the provider, such as the server to
+	// send updates to
+	Options map[string]string
+
+	// The zones of the domains this instance solves the
+	// challenges of; none means any domain
+	Zones []string
+
+	// The name of the instance that solves the challenges
+	// that this one fails to; empty means none
+	Fallback string
+}
+
+// dnsRoutes returns the DNS routes of c; the DNS provider of
+// c, if there is one, solves the challenges of any domain.
+func (c *Config) dnsRoutes() []DNSRoute {
+	routes := c.DNSRoutes
+	if c.DNSProvider != "" {
+		routes = append(routes[:len(routes):len(routes)], DNSRoute{Provider: c.DNSProvider, Name: c.DNSProvider})
+	}
+	return routes
+}
+
+// envPrefix returns the prefix of the environment
+// variables of the DNS provider instance name.
+func envPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name)) + "_"
+}
+
+// matchZone returns how long the zone of route is that
+// domain is in, or -1 if domain is in none of its zones.
+func (route DNSRoute) matchZone(domain string) int {
+	if len(route.Zones) == 0 {
+		return 0
+	}
+	best := -1
+	for _, zone := range route.Zones {
+		if (domain == zone || strings.HasSuffix(domain, "."+zone)) && len(zone) > best {
+			best = len(zone)
+		}
+	}
+	return best
+}
+
+// dnsRouter is an acme.ChallengeProvider that solves the DNS
+// challenge of each domain with the route whose zone is the
+// longest suffix of the domain, or with its fallbacks if that
+// fails. The providers of the routes are made when they are
+// first needed.
+type dnsRouter struct {
+	routes []DNSRoute
+
+	mu        sync.Mutex // protects providers
+	providers map[string]acme.ChallengeProvider
+}
+
+func newDNSRouter(routes []DNSRoute) *dnsRouter {
+	return &dnsRouter{routes: routes, providers: make(map[string]acme.ChallengeProvider)}
+}
+
+// chain returns the routes to try for domain, in order.
+func (r *dnsRouter) chain(domain string) []DNSRoute {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	best, bestLen := -1, -1
+	for i, route := range r.routes {
+		if n := route.matchZone(domain); n > bestLen {
+			best, bestLen = i, n
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	chain := []DNSRoute{r.routes[best]}
+	visited := map[string]bool{r.routes[best].Name: true}
+	for next := r.routes[best].Fallback; next != "" && !visited[next]; {
+		visited[next] = true
+		var found bool
+		for _, route := range r.routes {
+			if route.Name == next {
+				chain = append(chain, route)
+				next, found = route.Fallback, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return chain
+}
+
+// provider returns the provider of route, making it if needed.
+func (r *dnsRouter) provider(route DNSRoute) (acme.ChallengeProvider, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prov, ok := r.providers[route.Name]; ok {
+		return prov, nil
+	}
+	provFn, ok := dnsProviders[route.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider '%s'", route.Provider)
+	}
+	// the environment of the process is left as it is,
+	// since more than the provider may be reading it
+	getenv := os.Getenv
+	if route.EnvPrefix != "" {
+		getenv = prefixedGetenv(route.EnvPrefix)
+	}
+	prov, err := provFn(getenv, route.Options)
+	if err != nil {
+		return nil, err
+	}
+	r.providers[route.Name] = prov
+	return prov, nil
+}
+
+// Present presents the challenge of domain with the first route
+// in its chain that succeeds, which then also cleans it up.
+func (r *dnsRouter) Present(domain, token, keyAuth string) error {
+	chain := r.chain(domain)
+	if len(chain) == 0 {
+		return fmt.Errorf("no DNS provider for the zone of %s", domain)
+	}
+	var errs []string
+	for _, route := range chain {
+		prov, err := r.provider(route)
+		if err == nil {
+			err = prov.Present(domain, token, keyAuth)
+		}
+		if err == nil {
+			presentedChallenges.put(domain, token, prov)
+			return nil
+		}
+		log.Printf("[WARNING] DNS provider %s could not present the challenge for %s: %v", route.Name, domain, err)
+		errs = append(errs, route.Name+": "+err.Error())
+	}
+	return fmt.Errorf("presenting DNS challenge for %s: %s", domain, strings.Join(errs, "; "))
+}
+
+// CleanUp cleans up the challenge of domain with the provider
+// that presented it, whatever the routes are now.
+func (r *dnsRouter) CleanUp(domain, token, keyAuth string) error {
+	prov, ok := presentedChallenges.take(domain, token)
+	if !ok {
+		return fmt.Errorf("no DNS provider presented the challenge for %s", domain)
+	}
+	return prov.CleanUp(domain, token, keyAuth)
+}
+
+// presentedChallenges has the provider that presented each DNS
+// challenge, by domain and token, until it is cleaned up.
+var presentedChallenges = &challengeProviders{m: make(map[string]acme.ChallengeProvider)}
+
+type challengeProviders struct {
+	sync.Mutex
+	m map[string]acme.ChallengeProvider
+}
+
+func (p *challengeProviders) put(domain, token string, prov acme.ChallengeProvider) {
+	p.Lock()
+	p.m[domain+" "+token] = prov
+	p.Unlock()
+}
+
+func (p *challengeProviders) take(domain, token string) (acme.ChallengeProvider, bool) {
+	p.Lock()
+	defer p.Unlock()
+	prov, ok := p.m[domain+" "+token]
+	delete(p.m, domain+" "+token)
+	return prov, ok
+}
+
+// prefixedGetenv returns a function that looks up the
+// environment variable of a name with prefix prepended.
+func prefixedGetenv(prefix string) func(string) string {
+	return func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+}
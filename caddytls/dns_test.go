@@ -0,0 +1,278 @@
+package caddytls
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/xenolf/lego/acme"
+)
+
+// mockDNS is a DNS provider that records what it is asked to do.
+type mockDNS struct {
+	name   string
+	token  string // the MOCK_DNS_TOKEN it was made with
+	server string // the server option it was made with
+	fail   bool
+	log    *mockDNSLog
+}
+
+type mockDNSLog struct {
+	sync.Mutex
+	calls []string
+}
+
+func (l *mockDNSLog) add(call string) {
+	l.Lock()
+	l.calls = append(l.calls, call)
+	l.Unlock()
+}
+
+func (p *mockDNS) Present(domain, token, keyAuth string) error {
+	p.log.add(p.name + " present " + domain)
+	if p.fail {
+		return errors.New("zone not found")
+	}
+	return nil
+}
+
+func (p *mockDNS) CleanUp(domain, token, keyAuth string) error {
+	p.log.add(p.name + " cleanup " + domain)
+	return nil
+}
+
+var mockDNSCalls = new(mockDNSLog)
+
+func init() {
+	for _, name := range []string{"mockdns", "mockdnsfail"} {
+		name := name
+		RegisterDNSProvider(name, func(getenv func(string) string, options map[string]string) (acme.ChallengeProvider, error) {
+			prov := &mockDNS{name: name, token: getenv("MOCK_DNS_TOKEN"), server: options["server"],
+				fail: name == "mockdnsfail", log: mockDNSCalls}
+			if n := getenv("MOCK_DNS_NAME"); n != "" {
+				prov.name = n
+			}
+			return prov, nil
+		})
+	}
+}
+
+// setMockDNSNames sets the MOCK_DNS_NAME of the instances named
+// names to their name, and returns a function that unsets them.
+func setMockDNSNames(names ...string) func() {
+	for _, name := range names {
+		os.Setenv(envPrefix(name)+"MOCK_DNS_NAME", name)
+	}
+	return func() {
+		for _, name := range names {
+			os.Unsetenv(envPrefix(name) + "MOCK_DNS_NAME")
+		}
+	}
+}
+
+func TestSetupParseDNS(t *testing.T) {
+	for i, test := range []struct {
+		input            string
+		shouldErr        bool
+		expectedProvider string
+		expectedRoutes   []DNSRoute
+	}{
+		{`tls {
+			dns mockdns
+		}`, false, "mockdns", nil},
+		{`tls {
+			dns mockdns {
+				zones example.com .Example.NET.
+			}
+			dns mockdnsfail internal {
+				zones internal.example.org
+				fallback mockdns
+			}
+		}`, false, "", []DNSRoute{
+			{Provider: "mockdns", Name: "mockdns", Zones: []string{"example.com", "example.net"}},
+			{Provider: "mockdnsfail", Name: "internal", EnvPrefix: "INTERNAL_", Zones: []string{"internal.example.org"},
+				Fallback: "mockdns"},
+		}},
+		{`tls {
+			dns mockdnsfail internal {
+				zones internal.example.org
+				server 10.0.0.53
+			}
+		}`, false, "", []DNSRoute{
+			{Provider: "mockdnsfail", Name: "internal", EnvPrefix: "INTERNAL_", Zones: []string{"internal.example.org"},
+				Options: map[string]string{"server": "10.0.0.53"}},
+		}},
+		{`tls {
+			dns mockdns corp-dns
+		}`, false, "", []DNSRoute{
+			{Provider: "mockdns", Name: "corp-dns", EnvPrefix: "CORP_DNS_"},
+		}},
+		{`tls {
+			dns nosuchdns
+		}`, true, "", nil},
+		{`tls {
+			dns
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns {
+				zones
+			}
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns {
+				server
+			}
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns {
+				server 10.0.0.53
+				server 10.0.0.54
+			}
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns a {
+				zones example.com
+			}
+			dns mockdns a {
+				zones example.org
+			}
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns a {
+				fallback b
+			}
+		}`, true, "", nil},
+		{`tls {
+			dns mockdns a {
+				fallback a
+			}
+		}`, true, "", nil},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.DNSProvider != test.expectedProvider {
+			t.Errorf("Test %d: Expected DNS provider '%s', got '%s'", i, test.expectedProvider, cfg.DNSProvider)
+		}
+		if !reflect.DeepEqual(cfg.DNSRoutes, test.expectedRoutes) {
+			t.Errorf("Test %d: Expected DNS routes %+v, got %+v", i, test.expectedRoutes, cfg.DNSRoutes)
+		}
+	}
+}
+
+func TestDNSRouter(t *testing.T) {
+	defer setMockDNSNames("example", "org", "internal")()
+	cfg := &Config{
+		DNSProvider: "mockdns",
+		DNSRoutes: []DNSRoute{
+			{Provider: "mockdns", Name: "example", EnvPrefix: "EXAMPLE_", Zones: []string{"example.com"}},
+			{Provider: "mockdns", Name: "org", EnvPrefix: "ORG_", Zones: []string{"example.org"}},
+			{Provider: "mockdnsfail", Name: "internal", EnvPrefix: "INTERNAL_", Zones: []string{"internal.example.org"},
+				Fallback: "org"},
+		},
+	}
+	router := newDNSRouter(cfg.dnsRoutes())
+
+	for i, test := range []struct {
+		domain   string
+		expected []string
+	}{
+		{"example.com", []string{"example present example.com", "example cleanup example.com"}},
+		{"www.Example.com.", []string{"example present www.Example.com.", "example cleanup www.Example.com."}},
+		{"a.example.org", []string{"org present a.example.org", "org cleanup a.example.org"}},
+		{"notexample.com", []string{"mockdns present notexample.com", "mockdns cleanup notexample.com"}},
+		// the longest zone fails, and its fallback takes over
+		{"db.internal.example.org", []string{"internal present db.internal.example.org",
+			"org present db.internal.example.org", "org cleanup db.internal.example.org"}},
+	} {
+		mockDNSCalls.calls = nil
+		if err := router.Present(test.domain, "token", "keyAuth"); err != nil {
+			t.Errorf("Test %d: Expected no error presenting, got: %v", i, err)
+		}
+		if err := router.CleanUp(test.domain, "token", "keyAuth"); err != nil {
+			t.Errorf("Test %d: Expected no error cleaning up, got: %v", i, err)
+		}
+		if !reflect.DeepEqual(mockDNSCalls.calls, test.expected) {
+			t.Errorf("Test %d: Expected calls %v, got %v", i, test.expected, mockDNSCalls.calls)
+		}
+	}
+
+	// without a fallback, the failure is reported
+	router = newDNSRouter([]DNSRoute{{Provider: "mockdnsfail", Name: "internal", Zones: []string{"internal.example.org"}}})
+	if err := router.Present("db.internal.example.org", "token", "keyAuth"); err == nil {
+		t.Error("Expected error when the provider fails and has no fallback, got none")
+	}
+	if err := router.Present("example.com", "token", "keyAuth"); err == nil {
+		t.Error("Expected error for a domain in no zone, got none")
+	}
+}
+
+func TestDNSRouterCleanUpAffinity(t *testing.T) {
+	defer setMockDNSNames("a", "b")()
+	mockDNSCalls.calls = nil
+	before := newDNSRouter([]DNSRoute{{Provider: "mockdns", Name: "a", EnvPrefix: "A_"}})
+	if err := before.Present("example.com", "token", "keyAuth"); err != nil {
+		t.Fatalf("Expected no error presenting, got: %v", err)
+	}
+
+	// the config changes before the challenge is cleaned up
+	after := newDNSRouter([]DNSRoute{{Provider: "mockdns", Name: "b", EnvPrefix: "B_"}})
+	if err := after.CleanUp("example.com", "token", "keyAuth"); err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+	if expected := []string{"a present example.com", "a cleanup example.com"}; !reflect.DeepEqual(mockDNSCalls.calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, mockDNSCalls.calls)
+	}
+	if err := after.CleanUp("example.com", "token", "keyAuth"); err == nil {
+		t.Error("Expected error cleaning up a challenge twice, got none")
+	}
+}
+
+func TestDNSRouterEnvPrefix(t *testing.T) {
+	os.Setenv("MOCK_DNS_TOKEN", "global")
+	os.Setenv("CORP_MOCK_DNS_TOKEN", "corp")
+	defer os.Unsetenv("MOCK_DNS_TOKEN")
+	defer os.Unsetenv("CORP_MOCK_DNS_TOKEN")
+
+	router := newDNSRouter([]DNSRoute{
+		{Provider: "mockdns", Name: "corp", EnvPrefix: "CORP_", Zones: []string{"corp.example.com"},
+			Options: map[string]string{"server": "10.0.0.53"}},
+		{Provider: "mockdns", Name: "mockdns"},
+	})
+	for i, test := range []struct {
+		route          DNSRoute
+		expected       string
+		expectedServer string
+	}{
+		{router.routes[0], "corp", "10.0.0.53"},
+		{router.routes[1], "global", ""},
+	} {
+		prov, err := router.provider(test.route)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if got := prov.(*mockDNS).token; got != test.expected {
+			t.Errorf("Test %d: Expected token '%s', got '%s'", i, test.expected, got)
+		}
+		if got := prov.(*mockDNS).server; got != test.expectedServer {
+			t.Errorf("Test %d: Expected server '%s', got '%s'", i, test.expectedServer, got)
+		}
+	}
+	if got := os.Getenv("MOCK_DNS_TOKEN"); got != "global" {
+		t.Errorf("Expected the environment to be left alone, got MOCK_DNS_TOKEN '%s'", got)
+	}
+}
@@ -0,0 +1,131 @@
+package caddytls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/mholt/caddy"
+)
+
+// recordingProxy returns a proxy that answers the requests for
+// each host with its handler, and the hosts they were for.
+func recordingProxy(handlers map[string]http.HandlerFunc) (*httptest.Server, *[]string) {
+	var hosts []string
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.URL.Host)
+		if handler, ok := handlers[r.URL.Host]; ok {
+			handler(w, r)
+			return
+		}
+		http.Error(w, "not proxied", http.StatusBadGateway)
+	})), &hosts
+}
+
+func TestEgressThroughProxy(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		OCSPServer:            []string{"http://ocsp.test"},
+		IssuingCertificateURL: []string{"http://issuer.test/ca.der"},
+	}, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, hosts := recordingProxy(map[string]http.HandlerFunc{
+		"acme.test": func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"meta": map[string]interface{}{"profiles": map[string]string{"classic": "The same as always"}},
+			})
+		},
+		"issuer.test": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(caDER)
+		},
+		"ocsp.test": func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			req, err := ocsp.ParseRequest(body)
+			if err != nil || r.Header.Get("Content-Type") != "application/ocsp-request" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			resp, _ := ocsp.CreateResponse(ca, ca, ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: req.SerialNumber,
+				ThisUpdate:   time.Now(),
+				NextUpdate:   time.Now().Add(time.Hour),
+			}, caKey)
+			w.Write(resp)
+		},
+	})
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	if err := caddy.SetEgress(caddy.Egress{Proxy: proxyURL}); err != nil {
+		t.Fatal(err)
+	}
+	defer caddy.SetEgress(caddy.Egress{})
+
+	dir, err := readACMEDirectory("http://acme.test/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dir.Meta.Profiles["classic"]; !ok {
+		t.Errorf("Expected the profiles of the directory from the proxy, got %v", dir.Meta.Profiles)
+	}
+
+	_, resp, err := getOCSPForCert(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != ocsp.Good || resp.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected a good OCSP response for serial 2, got status %d for %v", resp.Status, resp.SerialNumber)
+	}
+
+	expected := []string{"acme.test", "issuer.test", "ocsp.test"}
+	if len(*hosts) != len(expected) {
+		t.Fatalf("Expected requests to %v through the proxy, got %v", expected, *hosts)
+	}
+	for i, host := range expected {
+		if (*hosts)[i] != host {
+			t.Errorf("Request %d: Expected it to be for %s, got %s", i, host, (*hosts)[i])
+		}
+	}
+}
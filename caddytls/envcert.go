@@ -0,0 +1,146 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envBlock is a PEM block and the environment
+// variable that it was read from.
+type envBlock struct {
+	*pem.Block
+	variable string
+}
+
+// cacheEnvCertificates loads the certificates whose PEM content
+// is in the environment variables certVar and keyVar, which hold
+// the certificates and the private keys, or in bundleVar, which
+// holds both; the variables that are empty are not used. Every
+// leaf certificate found is loaded, with the certificates that
+// follow it up to the next leaf as its chain, and the private key
+// that matches it. The certificates are cached only in memory. It
+// returns how many were loaded. Errors name the variables that
+// are missing or malformed, but never contain their contents.
+func cacheEnvCertificates(cfg *Config, certVar, keyVar, bundleVar string) (int, error) {
+	var certs, keys []envBlock
+	for _, v := range []struct {
+		name       string
+		certs, key bool // what the variable must have
+	}{
+		{certVar, true, false},
+		{keyVar, false, true},
+		{bundleVar, true, true},
+	} {
+		if v.name == "" {
+			continue
+		}
+		blocks, err := envPEMBlocks(v.name)
+		if err != nil {
+			return 0, err
+		}
+		var hasCert, hasKey bool
+		for _, block := range blocks {
+			switch {
+			case block.Type == "CERTIFICATE":
+				certs = append(certs, envBlock{block, v.name})
+				hasCert = true
+			case block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY"):
+				keys = append(keys, envBlock{block, v.name})
+				hasKey = true
+			case block.Type == "EC PARAMETERS":
+				// openssl puts them before EC keys; they are not needed
+			default:
+				return 0, fmt.Errorf("environment variable %s: unrecognized PEM block type: %s", v.name, block.Type)
+			}
+		}
+		if v.certs && !hasCert {
+			return 0, fmt.Errorf("environment variable %s has no PEM certificate", v.name)
+		}
+		if v.key && !hasKey {
+			return 0, fmt.Errorf("environment variable %s has no PEM private key", v.name)
+		}
+	}
+
+	// a chain begins at each leaf
+	var chains [][]envBlock
+	for i, block := range certs {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return 0, fmt.Errorf("environment variable %s: certificate %d does not parse: %v", block.variable, i, err)
+		}
+		if len(chains) == 0 || !cert.IsCA {
+			chains = append(chains, nil)
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], block)
+	}
+
+	for _, chain := range chains {
+		var certPEM []byte
+		for _, block := range chain {
+			certPEM = append(certPEM, pem.EncodeToMemory(block.Block)...)
+		}
+		var keyPEM []byte
+		for _, key := range keys {
+			if _, err := loadPrivateKey(pem.EncodeToMemory(key.Block)); err != nil {
+				return 0, fmt.Errorf("environment variable %s: private key does not parse: %v", key.variable, err)
+			}
+			if _, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(key.Block)); err == nil {
+				keyPEM = pem.EncodeToMemory(key.Block)
+				break
+			}
+		}
+		if keyPEM == nil {
+			leaf, _ := x509.ParseCertificate(chain[0].Bytes)
+			return 0, fmt.Errorf("environment variable %s: no private key matches the certificate for %s",
+				chain[0].variable, certName(leaf))
+		}
+		if err := cacheUnmanagedCertificatePEMBytes(cfg, certPEM, keyPEM); err != nil {
+			return 0, fmt.Errorf("environment variable %s: %v", chain[0].variable, err)
+		}
+	}
+	return len(chains), nil
+}
+
+// envPEMBlocks returns the PEM blocks in the
+// environment variable named name.
+func envPEMBlocks(name string) ([]*pem.Block, error) {
+	value := os.Getenv(name)
+	if strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	// some platforms only allow variables on one line
+	if !strings.Contains(value, "\n") {
+		value = strings.Replace(value, `\n`, "\n", -1)
+	}
+	var blocks []*pem.Block
+	rest := []byte(value)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 || len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("environment variable %s is not valid PEM", name)
+	}
+	return blocks, nil
+}
+
+// certName returns the name that cert is for,
+// to tell it apart in messages.
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.SerialNumber.String()
+}
@@ -1,6 +1,7 @@
 package caddytls
 
 import (
+	"fmt"
 	"github.com/mholt/caddy"
 	"io/ioutil"
 	"net/url"
@@ -109,6 +110,18 @@ func (s FileStorage) userKeyFile(email string) string {
 	return filepath.Join(s.user(email), fileName+".key")
 }
 
+// userOldKeyFile returns the path to the key that email's
+// account had before its last key rollover.
+func (s FileStorage) userOldKeyFile(email string) string {
+	return s.userKeyFile(email) + ".old"
+}
+
+// userNextKeyFile returns the path to the key that email's
+// account is being rolled over to.
+func (s FileStorage) userNextKeyFile(email string) string {
+	return s.userKeyFile(email) + ".next"
+}
+
 // readFile abstracts a simple ioutil.ReadFile, making sure to return an
 // ErrStorageNotFound instance when the file is not found.
 func (s FileStorage) readFile(file string) ([]byte, error) {
@@ -176,6 +189,24 @@ func (s FileStorage) DeleteSite(domain string) error {
 	return err
 }
 
+// QuarantineSite implements SiteQuarantiner by renaming the folder of
+// domain to have the .corrupt suffix, or, if there is already such a
+// folder, a number and the suffix.
+func (s FileStorage) QuarantineSite(domain string) (string, error) {
+	site := s.site(domain)
+	if _, err := os.Stat(site); os.IsNotExist(err) {
+		return "", ErrStorageNotFound
+	}
+	target := site + ".corrupt"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		}
+		target = fmt.Sprintf("%s.%d.corrupt", site, i)
+	}
+	return target, os.Rename(site, target)
+}
+
 // LockRegister implements Storage.LockRegister by just returning true because
 // it is not a multi-server storage implementation.
 func (s FileStorage) LockRegister(domain string) (bool, error) {
@@ -197,19 +228,63 @@ func (s FileStorage) LoadUser(email string) (*UserData, error) {
 	if err == nil {
 		userData.Key, err = s.readFile(s.userKeyFile(email))
 	}
+	if err == nil {
+		userData.OldKey, err = s.readFile(s.userOldKeyFile(email))
+		if err == ErrStorageNotFound {
+			err = nil
+		}
+	}
+	if err == nil {
+		userData.NextKey, err = s.readFile(s.userNextKeyFile(email))
+		if err == ErrStorageNotFound {
+			err = nil
+		}
+	}
 	return userData, err
 }
 
 // StoreUser implements Storage.StoreUser by writing it to disk. The base
 // directories needed for the file are automatically created as needed.
+// The old and next keys are written first and the key is replaced
+// last, in one step, so a failure along the way leaves the previous
+// key in place.
 func (s FileStorage) StoreUser(email string, data *UserData) error {
 	err := os.MkdirAll(s.user(email), 0700)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(s.userRegFile(email), data.Reg, 0600)
+	if len(data.OldKey) > 0 {
+		err = ioutil.WriteFile(s.userOldKeyFile(email), data.OldKey, 0600)
+	} else if err = os.Remove(s.userOldKeyFile(email)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		if len(data.NextKey) > 0 {
+			err = writeFileAtomic(s.userNextKeyFile(email), data.NextKey, 0600)
+		} else if err = os.Remove(s.userNextKeyFile(email)); os.IsNotExist(err) {
+			err = nil
+		}
+	}
 	if err == nil {
-		err = ioutil.WriteFile(s.userKeyFile(email), data.Key, 0600)
+		err = ioutil.WriteFile(s.userRegFile(email), data.Reg, 0600)
+	}
+	if err == nil {
+		err = writeFileAtomic(s.userKeyFile(email), data.Key, 0600)
+	}
+	return err
+}
+
+// writeFileAtomic writes data to file by writing it to a
+// temporary file next to it and renaming that over file.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	err := ioutil.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		os.Remove(tmp)
 	}
 	return err
 }
@@ -225,7 +300,9 @@ func (s FileStorage) MostRecentUserEmail() string {
 	}
 	var mostRecent os.FileInfo
 	for _, dir := range userDirs {
-		if !dir.IsDir() {
+		if !dir.IsDir() || strings.Contains(dir.Name(), accountSeparator) {
+			// the accounts that are not shared are not the
+			// account of any other site
 			continue
 		}
 		if mostRecent == nil || dir.ModTime().After(mostRecent.ModTime()) {
@@ -59,7 +59,10 @@ func (cg configGroup) getConfig(name string) *Config {
 //
 // This method is safe for use as a tls.Config.GetCertificate callback.
 func (cg configGroup) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	cert, err := cg.getCertDuringHandshake(clientHello.ServerName, true, true)
+	// the server name should not have a trailing dot, but the
+	// host of the requests is looked up without one anyway
+	name := strings.TrimSuffix(clientHello.ServerName, ".")
+	cert, err := cg.getCertDuringHandshake(name, true, true)
 	return &cert.Certificate, err
 }
 
@@ -78,16 +81,47 @@ func (cg configGroup) getCertDuringHandshake(name string, loadIfNecessary, obtai
 	// First check our in-memory cache to see if we've already loaded it
 	cert, matched, defaulted := getCertificate(name)
 	if matched {
+		touchCertificate(cert)
+		if loadIfNecessary && isExecCertificate(cert) &&
+			cert.NotAfter.Sub(time.Now().UTC()) < cert.renewDurationBefore() {
+			return renewExecCertificate(cert)
+		}
 		return cert, nil
 	}
 
-	// Get the relevant TLS config for this name. If OnDemand is enabled,
-	// then we might be able to load or obtain a needed certificate.
+	// The challenge may have been presented by another instance
+	// that shares the storage
+	if loadIfNecessary && strings.HasSuffix(strings.ToLower(name), tlsSNISuffix) {
+		if challengeCert, ok := cg.sharedChallengeCertificate(name); ok {
+			return challengeCert, nil
+		}
+	}
+
+	// The certificate may be being obtained in the background
+	if tempCert, pending, err := pendingCertificate(name); pending {
+		return tempCert, err
+	}
+
+	// Get the relevant TLS config for this name. If it has a command
+	// that gets certificates, run it; if OnDemand is enabled, then we
+	// might be able to load or obtain a needed certificate.
 	cfg := cg.getConfig(name)
+	if cfg != nil && len(cfg.GetCertificateExec) > 0 && name != "" && loadIfNecessary {
+		execCert, err := cfg.execCertificate(name)
+		if err == nil {
+			return execCert, nil
+		}
+		log.Printf("[ERROR] %v", err)
+		if defaulted {
+			return cert, nil
+		}
+		return Certificate{}, err
+	}
 	if cfg != nil && cfg.OnDemand && loadIfNecessary {
 		// Then check to see if we have one on disk
 		loadedCert, err := CacheManagedCertificate(name, cfg)
 		if err == nil {
+			touchCertificate(loadedCert)
 			loadedCert, err = cg.handshakeMaintenance(name, loadedCert)
 			if err != nil {
 				log.Printf("[ERROR] Maintaining newly-loaded certificate for %s: %v", name, err)
@@ -161,6 +195,10 @@ func (cg configGroup) checkLimitsForObtainingNewCerts(name string, cfg *Config)
 //
 // This function is safe for use by multiple concurrent goroutines.
 func (cg configGroup) obtainOnDemandCertificate(name string, cfg *Config) (Certificate, error) {
+	if atomic.LoadInt32(&onDemandPaused) == 1 {
+		return Certificate{}, fmt.Errorf("%s: %v", name, errOnDemandPaused)
+	}
+
 	// We must protect this process from happening concurrently, so synchronize.
 	obtainCertWaitChansMu.Lock()
 	wait, ok := obtainCertWaitChans[name]
@@ -219,7 +257,7 @@ func (cg configGroup) obtainOnDemandCertificate(name string, cfg *Config) (Certi
 func (cg configGroup) handshakeMaintenance(name string, cert Certificate) (Certificate, error) {
 	// Check cert expiration
 	timeLeft := cert.NotAfter.Sub(time.Now().UTC())
-	if timeLeft < RenewDurationBefore {
+	if timeLeft < cert.renewDurationBefore() {
 		log.Printf("[INFO] Certificate for %v expires in %v; attempting renewal", cert.Names, timeLeft)
 		return cg.renewDynamicCertificate(name, cert.Config)
 	}
@@ -228,14 +266,17 @@ func (cg configGroup) handshakeMaintenance(name string, cert Certificate) (Certi
 	if cert.OCSP != nil {
 		refreshTime := cert.OCSP.ThisUpdate.Add(cert.OCSP.NextUpdate.Sub(cert.OCSP.ThisUpdate) / 2)
 		if time.Now().After(refreshTime) {
-			err := stapleOCSP(&cert, nil)
+			err := stapleOCSP(&cert)
 			if err != nil {
-				// An error with OCSP stapling is not the end of the world, and in fact, is
-				// quite common considering not all certs have issuer URLs that support it.
+				// An error with OCSP stapling is not the end of the world;
+				// the certificate is served without a fresh staple.
 				log.Printf("[ERROR] Getting OCSP for %s: %v", name, err)
 			}
 			certCacheMu.Lock()
-			certCache[name] = cert
+			// the certificate may have been replaced in the meantime
+			if cached, ok := certCache[name]; ok && sameCertificate(cached, cert) {
+				certCache[name] = cert
+			}
 			certCacheMu.Unlock()
 		}
 	}
@@ -298,4 +339,6 @@ var failedIssuanceMu sync.RWMutex
 var lastIssueTime time.Time
 var lastIssueTimeMu sync.Mutex
 
-var errNoCert = errors.New("no certificate available")
+// ErrNoCertificate is returned if the cache has no
+// certificate for the name that is asked about.
+var ErrNoCertificate = errors.New("no certificate available")
@@ -12,14 +12,24 @@ import (
 const challengeBasePath = "/.well-known/acme-challenge"
 
 // HTTPChallengeHandler proxies challenge requests to ACME client if the
-// request path starts with challengeBasePath. It returns true if it
-// handled the request and no more needs to be done; it returns false
-// if this call was a no-op and the request still needs handling.
+// request path starts with challengeBasePath, unless the challenge was
+// presented by this instance, in which case it is answered here. It
+// returns true if it handled the request and no more needs to be done;
+// it returns false if this call was a no-op and the request still needs
+// handling. Use the HTTPChallengeHandler method of the Config of the
+// site, if there is one, to answer challenges kept in its storage too.
 func HTTPChallengeHandler(w http.ResponseWriter, r *http.Request, altPort string) bool {
 	if !strings.HasPrefix(r.URL.Path, challengeBasePath) {
 		return false
 	}
+	if answerHTTPChallenge(nil, w, r) {
+		return true
+	}
+	return proxyHTTPChallenge(w, r, altPort)
+}
 
+// proxyHTTPChallenge proxies r to the ACME client on altPort.
+func proxyHTTPChallenge(w http.ResponseWriter, r *http.Request, altPort string) bool {
 	scheme := "http"
 	if r.TLS != nil {
 		scheme = "https"
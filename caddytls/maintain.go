@@ -22,7 +22,8 @@ const (
 	// RenewInterval is how often to check certificates for renewal.
 	RenewInterval = 12 * time.Hour
 
-	// RenewDurationBefore is how long before expiration to renew certificates.
+	// RenewDurationBefore is how long before expiration to renew certificates;
+	// certificates that live less than three times as long renew sooner.
 	RenewDurationBefore = (24 * time.Hour) * 30
 
 	// OCSPInterval is how often to check if OCSP stapling needs updating.
@@ -42,21 +43,26 @@ const (
 func maintainAssets(stopChan chan struct{}) {
 	renewalTicker := time.NewTicker(RenewInterval)
 	ocspTicker := time.NewTicker(OCSPInterval)
+	storageCheckTicker := time.NewTicker(StorageCheckTick)
 
 	for {
 		select {
 		case <-renewalTicker.C:
 			log.Println("[INFO] Scanning for expiring certificates")
 			RenewManagedCertificates(false)
+			rotateAccountKeys()
 			log.Println("[INFO] Done checking certificates")
 		case <-ocspTicker.C:
 			log.Println("[INFO] Scanning for stale OCSP staples")
 			UpdateOCSPStaples()
 			DeleteOldStapleFiles()
 			log.Println("[INFO] Done checking OCSP staples")
+		case <-storageCheckTicker.C:
+			checkDueStorage()
 		case <-stopChan:
 			renewalTicker.Stop()
 			ocspTicker.Stop()
+			storageCheckTicker.Stop()
 			log.Println("[INFO] Stopped background maintenance routine")
 			return
 		}
@@ -65,11 +71,26 @@ func maintainAssets(stopChan chan struct{}) {
 
 // RenewManagedCertificates renews managed certificates.
 func RenewManagedCertificates(allowPrompts bool) (err error) {
-	var renewed, deleted []Certificate
+	var renewed, deleted, execRenew []Certificate
 	visitedNames := make(map[string]struct{})
 
 	certCacheMu.RLock()
 	for name, cert := range certCache {
+		// certificates from the get_certificate command are
+		// renewed by running it again, after the scan
+		if isExecCertificate(cert) {
+			if _, ok := visitedNames[name]; ok {
+				continue
+			}
+			for _, name := range cert.Names {
+				visitedNames[name] = struct{}{}
+			}
+			if cert.NotAfter.Sub(time.Now().UTC()) < cert.renewDurationBefore() {
+				execRenew = append(execRenew, cert)
+			}
+			continue
+		}
+
 		if !cert.Config.Managed || cert.Config.SelfSigned {
 			continue
 		}
@@ -91,7 +112,7 @@ func RenewManagedCertificates(allowPrompts bool) (err error) {
 
 		// if its time is up or ending soon, we need to try to renew it
 		timeLeft := cert.NotAfter.Sub(time.Now().UTC())
-		if timeLeft < RenewDurationBefore {
+		if timeLeft < cert.renewDurationBefore() {
 			log.Printf("[INFO] Certificate for %v expires in %v; attempting renewal", cert.Names, timeLeft)
 
 			if cert.Config == nil {
@@ -129,17 +150,7 @@ func RenewManagedCertificates(allowPrompts bool) (err error) {
 
 	// Apply changes to the cache
 	for _, cert := range renewed {
-		if cert.Names[len(cert.Names)-1] == "" {
-			// Special case: This is the default certificate. We must
-			// flush it out of the cache so that we no longer point to
-			// the old, un-renewed certificate. Otherwise it will be
-			// renewed on every scan, which is too often. When we cache
-			// this certificate in a moment, it will be the default again.
-			certCacheMu.Lock()
-			delete(certCache, "")
-			certCacheMu.Unlock()
-		}
-		_, err := CacheManagedCertificate(cert.Names[0], cert.Config)
+		err := recacheCertificate(cert)
 		if err != nil {
 			if allowPrompts {
 				return err // operator is present, so report error immediately
@@ -154,10 +165,31 @@ func RenewManagedCertificates(allowPrompts bool) (err error) {
 		}
 		certCacheMu.Unlock()
 	}
+	for _, cert := range execRenew {
+		log.Printf("[INFO] Certificate for %v expires in %v; running get_certificate", cert.Names, cert.NotAfter.Sub(time.Now().UTC()))
+		renewExecCertificate(cert)
+	}
 
 	return nil
 }
 
+// recacheCertificate loads the renewed certificate of cert
+// from storage into the cache in place of cert.
+func recacheCertificate(cert Certificate) error {
+	if cert.Names[len(cert.Names)-1] == "" {
+		// Special case: This is the default certificate. We must
+		// flush it out of the cache so that we no longer point to
+		// the old, un-renewed certificate. Otherwise it will be
+		// renewed on every scan, which is too often. When we cache
+		// this certificate in a moment, it will be the default again.
+		certCacheMu.Lock()
+		delete(certCache, "")
+		certCacheMu.Unlock()
+	}
+	_, err := CacheManagedCertificate(cert.Names[0], cert.Config)
+	return err
+}
+
 // UpdateOCSPStaples updates the OCSP stapling in all
 // eligible, cached certificates.
 //
@@ -171,6 +203,7 @@ func UpdateOCSPStaples() {
 	type ocspUpdate struct {
 		rawBytes []byte
 		parsed   *ocsp.Response
+		cert     Certificate // the certificate the staple is for
 	}
 	updated := make(map[string]ocspUpdate)
 
@@ -179,6 +212,9 @@ func UpdateOCSPStaples() {
 	// certificate multiple times.
 	visited := make(map[string]struct{})
 
+	// The certificates that are revoked, to be replaced
+	var revoked []Certificate
+
 	certCacheMu.RLock()
 	for name, cert := range certCache {
 		// skip this certificate if we've already visited it,
@@ -195,6 +231,13 @@ func UpdateOCSPStaples() {
 			continue
 		}
 
+		// a certificate known to be revoked is not checked
+		// again, but replaced until that succeeds
+		if cert.OCSP != nil && cert.OCSP.Status == ocsp.Revoked {
+			revoked = append(revoked, cert)
+			continue
+		}
+
 		var lastNextUpdate time.Time
 		if cert.OCSP != nil {
 			lastNextUpdate = cert.OCSP.NextUpdate
@@ -204,12 +247,25 @@ func UpdateOCSPStaples() {
 			}
 		}
 
-		err := stapleOCSP(&cert, nil)
+		err := stapleOCSP(&cert)
 		if err != nil {
-			if cert.OCSP != nil {
-				// if there was no staple before, that's fine; otherwise we should log the error
-				log.Printf("[ERROR] Checking OCSP: %v", err)
+			log.Printf("[ERROR] Checking OCSP: %v", err)
+			continue
+		}
+		if cert.OCSP == nil {
+			// the certificate has no OCSP responder
+			continue
+		}
+
+		// A revoked certificate must no longer be stapled with
+		// its last good response, and is replaced right away
+		if cert.OCSP != nil && cert.OCSP.Status == ocsp.Revoked {
+			log.Printf("[ERROR] OCSP responder says the certificate for %v (serial %x) is revoked",
+				cert.Names, cert.OCSP.SerialNumber)
+			for _, n := range cert.Names {
+				updated[n] = ocspUpdate{parsed: cert.OCSP, cert: cert}
 			}
+			revoked = append(revoked, cert)
 			continue
 		}
 
@@ -220,7 +276,7 @@ func UpdateOCSPStaples() {
 			log.Printf("[INFO] Advancing OCSP staple for %v from %s to %s",
 				cert.Names, lastNextUpdate, cert.OCSP.NextUpdate)
 			for _, n := range cert.Names {
-				updated[n] = ocspUpdate{rawBytes: cert.Certificate.OCSPStaple, parsed: cert.OCSP}
+				updated[n] = ocspUpdate{rawBytes: cert.Certificate.OCSPStaple, parsed: cert.OCSP, cert: cert}
 			}
 		}
 	}
@@ -229,12 +285,21 @@ func UpdateOCSPStaples() {
 	// This write lock should be brief since we have all the info we need now.
 	certCacheMu.Lock()
 	for name, update := range updated {
-		cert := certCache[name]
+		cert, ok := certCache[name]
+		if !ok || !sameCertificate(cert, update.cert) {
+			// the certificate was replaced, as when its files
+			// are reloaded, while the staple was fetched
+			continue
+		}
 		cert.OCSP = update.parsed
 		cert.Certificate.OCSPStaple = update.rawBytes
 		certCache[name] = cert
 	}
 	certCacheMu.Unlock()
+
+	for _, cert := range revoked {
+		replaceRevokedCertificate(cert)
+	}
 }
 
 // DeleteOldStapleFiles deletes cached OCSP staples that have expired.
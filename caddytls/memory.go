@@ -0,0 +1,106 @@
+package caddytls
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func init() {
+	caddy.RegisterMemoryAction("certificate_cache", caddy.MemoryAction{Shed: shedOnDemandCertificates})
+	caddy.RegisterMemoryAction("on_demand", caddy.MemoryAction{Shed: pauseOnDemand, Resume: resumeOnDemand})
+}
+
+// errOnDemandPaused is returned instead of obtaining a certificate
+// on demand while memory is short.
+var errOnDemandPaused = errors.New("not obtaining certificates on demand while memory in use is above the soft limit")
+
+var (
+	// onDemandPaused is 1 while certificates
+	// are not to be obtained on demand
+	onDemandPaused int32
+
+	// onDemandCacheTarget is how many on-demand certificates
+	// are kept in the cache while memory is short
+	onDemandCacheTarget int32
+
+	// certLastUsed is when each on-demand certificate in
+	// the cache was last used in a handshake, by source
+	certLastUsed   = make(map[string]time.Time)
+	certLastUsedMu sync.Mutex
+)
+
+// SetOnDemandCacheTarget sets how many of the certificates
+// that were loaded or obtained on demand are kept in the cache
+// while memory in use is above the soft limit; the ones that
+// were used least recently are evicted, to be loaded from
+// storage again when they are needed.
+func SetOnDemandCacheTarget(n int) {
+	atomic.StoreInt32(&onDemandCacheTarget, int32(n))
+}
+
+// pauseOnDemand keeps certificates from being obtained on
+// demand until resumeOnDemand is called; those in storage
+// are still loaded.
+func pauseOnDemand() {
+	atomic.StoreInt32(&onDemandPaused, 1)
+}
+
+func resumeOnDemand() {
+	atomic.StoreInt32(&onDemandPaused, 0)
+}
+
+// touchCertificate records that cert was used, if it was
+// loaded or obtained on demand.
+func touchCertificate(cert Certificate) {
+	if cert.Config == nil || !cert.Config.OnDemand || cert.source == "" {
+		return
+	}
+	certLastUsedMu.Lock()
+	certLastUsed[cert.source] = time.Now()
+	certLastUsedMu.Unlock()
+}
+
+// shedOnDemandCertificates evicts the on-demand certificates
+// that were used least recently from the cache until there are
+// no more of them than the target.
+func shedOnDemandCertificates() {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+	certLastUsedMu.Lock()
+	defer certLastUsedMu.Unlock()
+
+	var certs byLastUse
+	seen := make(map[string]struct{})
+	for name, cert := range certCache {
+		if _, ok := seen[cert.source]; ok || cert.source == "" || cert.Config == nil || !cert.Config.OnDemand {
+			continue
+		}
+		seen[cert.source] = struct{}{}
+		certs = append(certs, usedCertificate{cert.source, name, certLastUsed[cert.source]})
+	}
+	sort.Sort(certs)
+	for i := 0; i < len(certs)-int(atomic.LoadInt32(&onDemandCacheTarget)); i++ {
+		evictSource(certs[i].source, certs[i].name)
+		delete(certSources, certs[i].source)
+		delete(certLastUsed, certs[i].source)
+	}
+}
+
+// usedCertificate is a cached certificate, by its
+// source and a name, with when it was last used.
+type usedCertificate struct {
+	source, name string
+	lastUsed     time.Time
+}
+
+// byLastUse sorts certificates from the least recently used.
+type byLastUse []usedCertificate
+
+func (s byLastUse) Len() int           { return len(s) }
+func (s byLastUse) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastUse) Less(i, j int) bool { return s[i].lastUsed.Before(s[j].lastUsed) }
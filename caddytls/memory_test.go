@@ -0,0 +1,65 @@
+package caddytls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShedOnDemandCertificates(t *testing.T) {
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+		certLastUsed = make(map[string]time.Time)
+		SetOnDemandCacheTarget(0)
+	}()
+	onDemand := &Config{OnDemand: true}
+	manual := &Config{}
+	cacheCertificate(Certificate{Names: []string{"manual.com"}, Config: manual, source: "file:manual"})
+	for _, name := range []string{"a.com", "b.com", "c.com"} {
+		cacheCertificate(Certificate{Names: []string{name, "www." + name}, Config: onDemand, source: "storage:" + name})
+	}
+	for _, name := range []string{"c.com", "a.com", "www.c.com"} {
+		cert, _, _ := getCertificate(name)
+		touchCertificate(cert)
+		time.Sleep(time.Millisecond)
+	}
+
+	SetOnDemandCacheTarget(1)
+	shedOnDemandCertificates()
+	for _, name := range []string{"manual.com", "c.com", "www.c.com"} {
+		if _, matched, _ := getCertificate(name); !matched {
+			t.Errorf("Expected %s to stay in the cache", name)
+		}
+	}
+	for _, name := range []string{"a.com", "www.a.com", "b.com", "www.b.com"} {
+		if _, matched, _ := getCertificate(name); matched {
+			t.Errorf("Expected %s to be evicted", name)
+		}
+	}
+
+	SetOnDemandCacheTarget(0)
+	shedOnDemandCertificates()
+	if _, matched, _ := getCertificate("c.com"); matched {
+		t.Error("Expected all on-demand certificates to be evicted")
+	}
+	if _, matched, _ := getCertificate("manual.com"); !matched {
+		t.Error("Expected the certificate that was not loaded on demand to stay")
+	}
+	if _, _, defaulted := getCertificate("other.com"); !defaulted {
+		t.Error("Expected a default certificate to stay")
+	}
+}
+
+func TestPauseOnDemand(t *testing.T) {
+	cfg := &Config{OnDemand: true}
+	pauseOnDemand()
+	_, err := configGroup{"": cfg}.obtainOnDemandCertificate("example.com", cfg)
+	resumeOnDemand()
+	if err == nil || !strings.Contains(err.Error(), errOnDemandPaused.Error()) {
+		t.Errorf("Expected obtaining to be paused, got: %v", err)
+	}
+	if onDemandPaused != 0 {
+		t.Error("Expected obtaining not to be paused anymore")
+	}
+}
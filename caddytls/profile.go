@@ -0,0 +1,325 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// certMetadata is the metadata that is stored next to a
+// certificate: its certificate resource, whose AccountRef is
+// the URI of the ACME account that ordered it, the profile it
+// was ordered with, which its renewals are ordered with too
+// unless the config names another, and the name under which
+// that account is stored, which its renewals are ordered with.
+type certMetadata struct {
+	acme.CertificateResource
+	Profile string  `json:"profile,omitempty"`
+	Account *string `json:"account,omitempty"`
+}
+
+// loadCertResource returns the certificate resource stored
+// in siteData, and the rest of its metadata.
+func loadCertResource(siteData *SiteData) (acme.CertificateResource, certMetadata) {
+	var meta certMetadata
+	json.Unmarshal(siteData.Meta, &meta)
+	meta.Certificate = siteData.Cert
+	meta.PrivateKey = siteData.Key
+	return meta.CertificateResource, meta
+}
+
+// acmeOrder is what is added to a certificate order: the
+// profile to order the certificate with and how long it is
+// to be valid, which asks the CA for its notAfter. The ACME
+// library places the orders itself, so orderTransport adds
+// these to them on their way to the CA, and signs them again
+// with the key of the account that places them.
+type acmeOrder struct {
+	profile  string
+	lifetime time.Duration
+	urls     []string // where the CA takes orders
+	key      crypto.PrivateKey
+}
+
+// acmeDirectory is the part of the directory of a CA that
+// tells where it takes orders and what profiles it offers.
+type acmeDirectory struct {
+	NewCert  string `json:"new-cert"` // before RFC 8555
+	NewOrder string `json:"newOrder"`
+	Meta     struct {
+		Profiles map[string]string `json:"profiles"`
+	} `json:"meta"`
+}
+
+// readACMEDirectory reads the directory at dirURL.
+func readACMEDirectory(dirURL string) (acmeDirectory, error) {
+	var dir acmeDirectory
+	resp, err := acmeHTTPClient.Get(dirURL)
+	if err != nil {
+		return dir, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dir, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&dir)
+	if err != nil {
+		return dir, fmt.Errorf("reading directory: %v", err)
+	}
+	return dir, nil
+}
+
+// acmeOrder returns what to add to the orders of c, or nil if
+// nothing is: the profile of c, or else stored, which is the
+// profile of the certificate being renewed, and the lifetime
+// of c. The CA must offer the profile; if its directory lists
+// profiles but not this one, it would reject the order, so that
+// is an error. A CA whose directory lists no profiles does not
+// know of them, and then the certificate has no profile.
+func (c *Config) acmeOrder(stored string) (*acmeOrder, error) {
+	profile := c.ACMEProfile
+	if profile == "" {
+		profile = stored
+	}
+	if profile == "" && c.CertLifetime <= 0 {
+		return nil, nil
+	}
+	dirURL, err := c.directoryURL()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := readACMEDirectory(dirURL)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate profiles of CA: %v", err)
+	}
+	order := &acmeOrder{lifetime: c.CertLifetime}
+	for _, u := range []string{dir.NewCert, dir.NewOrder} {
+		if u != "" {
+			order.urls = append(order.urls, u)
+		}
+	}
+	if profile != "" {
+		offered := dir.Meta.Profiles
+		if len(offered) == 0 {
+			log.Printf("[WARNING] CA at %s does not offer certificate profiles; ordering without profile '%s'", dirURL, profile)
+		} else if _, ok := offered[profile]; !ok {
+			var names []string
+			for name := range offered {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("CA at %s does not offer certificate profile '%s'; it offers: %s",
+				dirURL, profile, strings.Join(names, ", "))
+		} else {
+			order.profile = profile
+		}
+	}
+	if order.profile == "" && order.lifetime <= 0 {
+		return nil, nil
+	}
+	return order, nil
+}
+
+// profileName returns the profile of o, which may be nil.
+func (o *acmeOrder) profileName() string {
+	if o == nil {
+		return ""
+	}
+	return o.profile
+}
+
+// pendingOrder is what is added to the order that is being
+// placed, if any; orders are placed with acmeMu held, so
+// there is only one at a time.
+var (
+	pendingOrder   *acmeOrder
+	pendingOrderMu sync.Mutex
+)
+
+// placeOrder calls place, which places a certificate order
+// with the ACME library, with acmeMu held and order, if it is
+// not nil, added to the order that user places.
+func placeOrder(order *acmeOrder, user User, place func()) {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+	if order != nil {
+		o := *order
+		o.key = user.key
+		pendingOrderMu.Lock()
+		pendingOrder = &o
+		pendingOrderMu.Unlock()
+		defer func() {
+			pendingOrderMu.Lock()
+			pendingOrder = nil
+			pendingOrderMu.Unlock()
+		}()
+	}
+	place()
+}
+
+// orderTransport adds the pending order to the certificate
+// orders that are sent through it.
+type orderTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t orderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pendingOrderMu.Lock()
+	order := pendingOrder
+	pendingOrderMu.Unlock()
+	if order == nil || req.Method != "POST" || req.Body == nil || !order.takes(req.URL.String()) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, err = order.addTo(body)
+	if err != nil {
+		return nil, fmt.Errorf("adding profile and lifetime to certificate order: %v", err)
+	}
+	orderReq := new(http.Request)
+	*orderReq = *req
+	orderReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	orderReq.ContentLength = int64(len(body))
+
+	resp, err := t.RoundTripper.RoundTrip(orderReq)
+	if err != nil || resp.StatusCode < 400 || order.profile == "" {
+		return resp, err
+	}
+	return order.checkRejected(resp)
+}
+
+// takes returns true if the CA takes orders at u.
+func (o *acmeOrder) takes(u string) bool {
+	for _, orderURL := range o.urls {
+		if u == orderURL {
+			return true
+		}
+	}
+	return false
+}
+
+// addTo adds the profile and the notAfter of o to the payload
+// of the order in body, a JWS in flattened JSON serialization,
+// and signs it again.
+func (o *acmeOrder) addTo(body []byte) ([]byte, error) {
+	var jws map[string]json.RawMessage
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return nil, err
+	}
+	var protected, payload string
+	json.Unmarshal(jws["protected"], &protected)
+	json.Unmarshal(jws["payload"], &payload)
+	if protected == "" || payload == "" {
+		return nil, errors.New("order is not a signed JWS")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payloadJSON, &fields); err != nil {
+		return nil, err
+	}
+
+	if o.profile != "" {
+		fields["profile"], _ = json.Marshal(o.profile)
+	}
+	if o.lifetime > 0 {
+		fields["notAfter"], _ = json.Marshal(time.Now().Add(o.lifetime).UTC().Format(time.RFC3339))
+	}
+	payloadJSON, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	payload = base64URL(payloadJSON)
+	if alg, _, err := jwsAlgorithm(o.key); err != nil || alg != header.Alg {
+		return nil, fmt.Errorf("order is not signed with the account key (%s)", header.Alg)
+	}
+	signature, err := jwsSign(o.key, protected+"."+payload)
+	if err != nil {
+		return nil, err
+	}
+	jws["payload"], _ = json.Marshal(payload)
+	jws["signature"], _ = json.Marshal(base64URL(signature))
+	return json.Marshal(jws)
+}
+
+// checkRejected returns an error if resp, the failed response
+// to an order with the profile of o, means that the CA rejects
+// that profile, and otherwise resp as it is.
+func (o *acmeOrder) checkRejected(resp *http.Response) (*http.Response, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var problem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+	}
+	json.Unmarshal(body, &problem)
+	if strings.HasSuffix(problem.Type, ":invalidProfile") ||
+		strings.Contains(strings.ToLower(problem.Detail), "profile") {
+		return nil, fmt.Errorf("CA rejected certificate profile '%s': %s", o.profile, problem.Detail)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// checkLifetime logs a warning if cert lives longer than the
+// lifetime that c asks for, which the CA may not go by.
+func (c *Config) checkLifetime(cert acme.CertificateResource) {
+	if c.CertLifetime <= 0 {
+		return
+	}
+	entry, err := newAuditEntry("", cert.Certificate)
+	if err != nil {
+		return
+	}
+	if lifetime := entry.NotAfter.Sub(entry.NotBefore); lifetime > c.CertLifetime {
+		log.Printf("[WARNING] Certificate for %s is valid for %v, longer than the %v asked for",
+			cert.Domain, lifetime, c.CertLifetime)
+	}
+}
+
+// renewDurationBefore returns how long before it expires cert
+// is renewed: RenewDurationBefore, or a third of its lifetime
+// for a certificate that lives less than three times that, so
+// that short-lived certificates are not renewed all the time.
+func (cert Certificate) renewDurationBefore() time.Duration {
+	if cert.NotBefore.IsZero() {
+		return RenewDurationBefore
+	}
+	if third := cert.NotAfter.Sub(cert.NotBefore) / 3; third < RenewDurationBefore {
+		return third
+	}
+	return RenewDurationBefore
+}
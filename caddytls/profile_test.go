@@ -0,0 +1,240 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// newStubDirectory returns a CA whose directory lists profiles.
+func newStubDirectory(profiles map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dir := map[string]interface{}{
+			"new-reg":  "http://" + r.Host + "/new-reg",
+			"new-cert": "http://" + r.Host + "/new-cert",
+		}
+		if profiles != nil {
+			dir["meta"] = map[string]interface{}{"profiles": profiles}
+		}
+		json.NewEncoder(w).Encode(dir)
+	}))
+}
+
+func TestACMEProfile(t *testing.T) {
+	accepting := newStubDirectory(map[string]string{
+		"classic":    "The same as always",
+		"shortlived": "Valid for a week",
+	})
+	defer accepting.Close()
+	rejecting := newStubDirectory(map[string]string{"classic": "The same as always"})
+	defer rejecting.Close()
+	unaware := newStubDirectory(nil)
+	defer unaware.Close()
+
+	for i, test := range []struct {
+		caURL           string
+		profile         string
+		stored          string
+		shouldErr       bool
+		expectedProfile string
+	}{
+		{accepting.URL, "shortlived", "", false, "shortlived"},
+		{accepting.URL, "", "shortlived", false, "shortlived"},
+		{accepting.URL, "classic", "shortlived", false, "classic"},
+		{accepting.URL, "", "", false, ""},
+		{rejecting.URL, "shortlived", "", true, ""},
+		{rejecting.URL, "", "shortlived", true, ""},
+		{unaware.URL, "shortlived", "", false, ""},
+	} {
+		cfg := &Config{CAUrl: test.caURL, ACMEProfile: test.profile}
+		order, err := cfg.acmeOrder(test.stored)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			} else if !strings.Contains(err.Error(), "it offers: classic") {
+				t.Errorf("Test %d: Expected error to name the offered profiles, got: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if profile := order.profileName(); profile != test.expectedProfile {
+			t.Errorf("Test %d: Expected profile '%s', got '%s'", i, test.expectedProfile, profile)
+		}
+		if order != nil && (len(order.urls) != 1 || order.urls[0] != test.caURL+"/new-cert") {
+			t.Errorf("Test %d: Expected the order URL of the directory, got %v", i, order.urls)
+		}
+	}
+}
+
+// signedOrder returns an order for csr as the ACME library
+// sends it, signed with key.
+func signedOrder(t *testing.T, key crypto.PrivateKey, csr string) []byte {
+	body, err := signJWS(key, map[string]interface{}{"nonce": "n0nce"},
+		[]byte(`{"resource":"new-cert","csr":"`+csr+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// verifyOrder returns the fields of the payload of the order
+// in body if its signature is valid for key.
+func verifyOrder(body []byte, key crypto.PrivateKey) (map[string]string, bool) {
+	var jws map[string]string
+	json.Unmarshal(body, &jws)
+	signature, _ := base64.RawURLEncoding.DecodeString(jws["signature"])
+	digest := sha256.Sum256([]byte(jws["protected"] + "." + jws["payload"]))
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if len(signature) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			return nil, false
+		}
+	case *rsa.PrivateKey:
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, false
+		}
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws["payload"])
+	var fields map[string]string
+	json.Unmarshal(payload, &fields)
+	return fields, true
+}
+
+func TestOrderTransport(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []byte
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		received = buf.Bytes()
+		var jws map[string]string
+		json.Unmarshal(received, &jws)
+		if payload, _ := base64.RawURLEncoding.DecodeString(jws["payload"]); strings.Contains(string(payload), `"profile":"bogus"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:invalidProfile","detail":"unknown profile"}`))
+		}
+	}))
+	defer ca.Close()
+	client := &http.Client{Transport: orderTransport{http.DefaultTransport}}
+	order := &acmeOrder{profile: "shortlived", lifetime: 168 * time.Hour, urls: []string{ca.URL + "/new-cert"}}
+
+	for i, key := range []crypto.PrivateKey{ecKey, rsaKey} {
+		var resp *http.Response
+		placeOrder(order, User{key: key}, func() {
+			resp, err = client.Post(ca.URL+"/new-cert", "application/jose+json",
+				bytes.NewReader(signedOrder(t, key, "Y3Ny")))
+		})
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got: %v", i, err)
+		}
+		resp.Body.Close()
+		fields, ok := verifyOrder(received, key)
+		if !ok {
+			t.Errorf("Test %d: Expected the order to be signed again with the account key", i)
+			continue
+		}
+		if fields["csr"] != "Y3Ny" || fields["resource"] != "new-cert" || fields["profile"] != "shortlived" {
+			t.Errorf("Test %d: Expected the order with the profile, got %v", i, fields)
+		}
+		notAfter, err := time.Parse(time.RFC3339, fields["notAfter"])
+		if err != nil || notAfter.Before(time.Now().Add(167*time.Hour)) || notAfter.After(time.Now().Add(169*time.Hour)) {
+			t.Errorf("Test %d: Expected a notAfter a week from now, got '%s'", i, fields["notAfter"])
+		}
+	}
+
+	// other requests, and orders when none is pending, are sent as they are
+	original := signedOrder(t, ecKey, "Y3Ny")
+	placeOrder(order, User{key: ecKey}, func() {
+		_, err = client.Post(ca.URL+"/new-reg", "application/jose+json", bytes.NewReader(original))
+	})
+	if err != nil || !bytes.Equal(received, original) {
+		t.Errorf("Expected other requests to be sent unchanged, got %s (error: %v)", received, err)
+	}
+	_, err = client.Post(ca.URL+"/new-cert", "application/jose+json", bytes.NewReader(original))
+	if err != nil || !bytes.Equal(received, original) {
+		t.Errorf("Expected the order to be sent unchanged when none is pending, got %s (error: %v)", received, err)
+	}
+
+	// a profile that the CA rejects
+	bogus := &acmeOrder{profile: "bogus", urls: order.urls}
+	placeOrder(bogus, User{key: ecKey}, func() {
+		_, err = client.Post(ca.URL+"/new-cert", "application/jose+json", bytes.NewReader(original))
+	})
+	if err == nil || !strings.Contains(err.Error(), "CA rejected certificate profile 'bogus': unknown profile") {
+		t.Errorf("Expected an error that the CA rejected the profile, got: %v", err)
+	}
+}
+
+func TestCertResourceProfile(t *testing.T) {
+	storage := FileStorage("./le_test_profile")
+	defer os.RemoveAll(string(storage))
+
+	err := saveCertResource(storage, acme.CertificateResource{
+		Domain:      "example.com",
+		CertURL:     "https://example.com/cert",
+		PrivateKey:  []byte("key"),
+		Certificate: []byte("cert"),
+	}, "shortlived", User{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	siteData, err := storage.LoadSite("example.com")
+	if err != nil {
+		t.Fatalf("Expected no error loading site, got: %v", err)
+	}
+	cert, meta := loadCertResource(siteData)
+	if meta.Profile != "shortlived" {
+		t.Errorf("Expected stored profile 'shortlived', got '%s'", meta.Profile)
+	}
+	if cert.CertURL != "https://example.com/cert" || string(cert.Certificate) != "cert" || string(cert.PrivateKey) != "key" {
+		t.Errorf("Expected the stored certificate resource, got %+v", cert)
+	}
+}
+
+func TestRenewDurationBefore(t *testing.T) {
+	now := time.Now()
+	for i, test := range []struct {
+		lifetime time.Duration
+		expected time.Duration
+	}{
+		{90 * 24 * time.Hour, RenewDurationBefore},
+		{365 * 24 * time.Hour, RenewDurationBefore},
+		{168 * time.Hour, 56 * time.Hour},
+		{6 * 24 * time.Hour, 48 * time.Hour},
+	} {
+		cert := Certificate{NotBefore: now, NotAfter: now.Add(test.lifetime)}
+		if got := cert.renewDurationBefore(); got != test.expected {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+	if got := (Certificate{NotAfter: now}).renewDurationBefore(); got != RenewDurationBefore {
+		t.Errorf("Expected %v for a certificate of unknown lifetime, got %v", RenewDurationBefore, got)
+	}
+}
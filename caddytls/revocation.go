@@ -0,0 +1,93 @@
+package caddytls
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mholt/caddy"
+)
+
+// RevokedCertServedEvent is emitted on each OCSP check while a
+// certificate that its OCSP responder says is revoked is still
+// served, because it could not be replaced; its payload is a
+// CertEventInfo with the Operation "replace".
+const RevokedCertServedEvent = "tls.revokedcertserved"
+
+// replaceRevokedCertificate obtains a new certificate, with a new
+// key, in place of cert, which is revoked, and swaps it into the
+// cache; the revoked certificate is kept in storage under another
+// name. Until that succeeds, cert is still served, unstapled, and
+// every OCSP check tries again and emits RevokedCertServedEvent.
+func replaceRevokedCertificate(cert Certificate) {
+	err := replaceRevoked(cert)
+	if err == nil {
+		return
+	}
+	log.Printf("[ERROR] Certificate for %v is revoked, but it could not be replaced; still serving it: %v", cert.Names, err)
+	var caURL string
+	if cert.Config != nil {
+		caURL = cert.Config.CAUrl
+	}
+	caddy.EmitEvent(RevokedCertServedEvent, CertEventInfo{
+		Names:     cert.Names,
+		CAUrl:     caURL,
+		Operation: "replace",
+		Err:       err,
+	})
+}
+
+func replaceRevoked(cert Certificate) error {
+	cfg := cert.Config
+	if cfg == nil || !cfg.Managed || cfg.SelfSigned || isExecCertificate(cert) || len(cert.Names) == 0 {
+		return fmt.Errorf("certificate is not managed; it must be replaced by hand")
+	}
+	name := cert.Names[0]
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil {
+		return err
+	}
+	if locked, err := storage.LockRegister(name); err != nil {
+		return err
+	} else if !locked {
+		return fmt.Errorf("certificate is being obtained elsewhere")
+	}
+	defer func() {
+		if err := storage.UnlockRegister(name); err != nil {
+			log.Printf("[ERROR] Unable to unlock obtain lock for %v: %v", name, err)
+		}
+	}()
+
+	revokedData, err := storage.LoadSite(name)
+	if err != nil && err != ErrStorageNotFound {
+		return err
+	}
+	log.Printf("[INFO] Certificate for %v is revoked; obtaining a new one", cert.Names)
+	if err := obtainReplacementCert(cfg, name); err != nil {
+		return err
+	}
+	if err := recacheCertificate(cert); err != nil {
+		return err
+	}
+
+	if revokedData != nil {
+		archive := fmt.Sprintf("%s.revoked-%x", name, cert.OCSP.SerialNumber)
+		if err := storage.StoreSite(archive, revokedData); err != nil {
+			log.Printf("[ERROR] Certificate for %v is replaced, but the revoked one could not be kept as %s: %v", cert.Names, archive, err)
+		} else {
+			log.Printf("[INFO] Certificate for %v is replaced; kept the revoked one as %s", cert.Names, archive)
+		}
+	}
+	return nil
+}
+
+// obtainReplacementCert obtains a certificate for name, whose
+// stored certificate is revoked, with the normal obtain path and
+// a new private key; the caller holds the lock of name. It is a
+// variable so that tests can stand in for the CA.
+var obtainReplacementCert = func(cfg *Config, name string) error {
+	client, err := newACMEClient(cfg, cfg.accountName(), false)
+	if err != nil {
+		return err
+	}
+	return client.Obtain([]string{name})
+}
@@ -0,0 +1,272 @@
+package caddytls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspTestCA issues certificates whose OCSP responder is its
+// server, which says the serials in revoked are revoked. Its
+// responses are due for a refresh unless fresh is set, and each
+// rotation makes them valid for a minute longer.
+type ocspTestCA struct {
+	cert      *x509.Certificate
+	key       *ecdsa.PrivateKey
+	server    *httptest.Server
+	revoked   map[int64]bool
+	fresh     bool
+	rotations int
+	requests  int
+	mu        sync.Mutex
+}
+
+func newOCSPTestCA(t *testing.T) *ocspTestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &ocspTestCA{key: key, revoked: make(map[int64]bool)}
+	ca.cert, _ = x509.ParseCertificate(der)
+	ca.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		ca.mu.Lock()
+		ca.requests++
+		status := ocsp.Good
+		if ca.revoked[req.SerialNumber.Int64()] {
+			status = ocsp.Revoked
+		}
+		// past the middle of its validity, so that it is checked again
+		thisUpdate := time.Now().Add(-2 * time.Hour)
+		if ca.fresh {
+			thisUpdate = time.Now().Add(-time.Minute)
+		}
+		nextUpdate := time.Now().Add(time.Hour + time.Duration(ca.rotations)*time.Minute)
+		ca.mu.Unlock()
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:           status,
+			SerialNumber:     req.SerialNumber,
+			ThisUpdate:       thisUpdate,
+			NextUpdate:       nextUpdate,
+			RevokedAt:        time.Now().Add(-time.Minute),
+			RevocationReason: ocsp.KeyCompromise,
+		}, ca.key)
+		w.Write(resp)
+	}))
+	return ca
+}
+
+// requestCount returns how many OCSP requests the responder answered.
+func (ca *ocspTestCA) requestCount() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.requests
+}
+
+// rotate makes the responder answer with a new response.
+func (ca *ocspTestCA) rotate() {
+	ca.mu.Lock()
+	ca.rotations++
+	ca.mu.Unlock()
+}
+
+func (ca *ocspTestCA) revoke(serial int64) {
+	ca.mu.Lock()
+	ca.revoked[serial] = true
+	ca.mu.Unlock()
+}
+
+// issue returns the site data of a certificate for name with serial.
+// If name is an IP address, the certificate has no DNS names.
+func (ca *ocspTestCA) issue(t *testing.T, name string, serial int64) *SiteData {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		OCSPServer:   []string{ca.server.URL},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.Subject = pkix.Name{CommonName: name}
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &SiteData{
+		Cert: append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), bundle(ca.cert)...),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Meta: []byte(`{"domain":"` + name + `"}`),
+	}
+}
+
+// cachedSerial returns the serial of the certificate cached for
+// name, and whether it has a staple.
+func cachedSerial(name string) (int64, bool) {
+	certCacheMu.RLock()
+	defer certCacheMu.RUnlock()
+	cert := certCache[name]
+	leaf, _ := x509.ParseCertificate(cert.Certificate.Certificate[0])
+	return leaf.SerialNumber.Int64(), len(cert.Certificate.OCSPStaple) > 0
+}
+
+func TestReplaceRevokedCertificate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	storage, config, done := checkedStorage(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "caddytls_ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	originalFolder := ocspFolder
+	ocspFolder = dir
+	defer func() { ocspFolder = originalFolder }()
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+	certEventsMu.Lock()
+	certEvents = nil
+	certEventsMu.Unlock()
+
+	ca := newOCSPTestCA(t)
+	defer ca.server.Close()
+	cfg := config("example.com")
+	if err := storage.StoreSite("example.com", ca.issue(t, "example.com", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CacheManagedCertificate("example.com", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if serial, stapled := cachedSerial("example.com"); serial != 100 || !stapled {
+		t.Fatalf("Expected certificate 100 to be stapled while it is good, got %d stapled %v", serial, stapled)
+	}
+
+	var obtained []string
+	obtainErr := errors.New("CA is down")
+	original := obtainReplacementCert
+	obtainReplacementCert = func(cfg *Config, name string) error {
+		obtained = append(obtained, name)
+		if obtainErr != nil {
+			return obtainErr
+		}
+		return storage.StoreSite(name, ca.issue(t, name, 101))
+	}
+	defer func() { obtainReplacementCert = original }()
+
+	// while it cannot be replaced, the revoked certificate is
+	// served without a staple, and every check raises the event
+	ca.revoke(100)
+	UpdateOCSPStaples()
+	UpdateOCSPStaples()
+	if len(obtained) != 2 {
+		t.Errorf("Expected a replacement to be obtained on each check, got %v", obtained)
+	}
+	if serial, stapled := cachedSerial("example.com"); serial != 100 || stapled {
+		t.Errorf("Expected the revoked certificate to be served without a staple, got %d stapled %v", serial, stapled)
+	}
+	certEventsMu.Lock()
+	events := strings.Join(certEvents, "\n")
+	certEventsMu.Unlock()
+	expected := RevokedCertServedEvent + " replace example.com " + cfg.CAUrl
+	if strings.Count(events, expected) != 2 {
+		t.Errorf("Expected the event '%s' on each check, got %v", expected, events)
+	}
+	if storage.SiteExists(fmt.Sprintf("example.com.revoked-%x", 100)) {
+		t.Error("Expected the revoked certificate not to be set aside before it is replaced")
+	}
+
+	// once the replacement is obtained, it is swapped in
+	// and the revoked certificate is kept in storage
+	obtainErr = nil
+	UpdateOCSPStaples()
+	if serial, stapled := cachedSerial("example.com"); serial != 101 || !stapled {
+		t.Errorf("Expected the replacement to be served with a staple, got %d stapled %v", serial, stapled)
+	}
+	archived, err := storage.LoadSite(fmt.Sprintf("example.com.revoked-%x", 100))
+	if err != nil {
+		t.Fatalf("Expected the revoked certificate to be kept in storage: %v", err)
+	}
+	block, _ := pem.Decode(archived.Cert)
+	if leaf, _ := x509.ParseCertificate(block.Bytes); leaf == nil || leaf.SerialNumber.Int64() != 100 {
+		t.Errorf("Expected the revoked certificate in the archive")
+	}
+	UpdateOCSPStaples()
+	if len(obtained) != 3 {
+		t.Errorf("Expected no more replacements once the certificate is good, got %v", obtained)
+	}
+}
+
+func TestRevokedStatusNotStapled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	originalFolder := ocspFolder
+	ocspFolder = dir
+	defer func() { ocspFolder = originalFolder }()
+
+	ca := newOCSPTestCA(t)
+	defer ca.server.Close()
+	ca.revoke(100)
+	data := ca.issue(t, "example.com", 100)
+	cert, err := makeCertificate(&Config{}, data.Cert, data.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.OCSP == nil || cert.OCSP.Status != ocsp.Revoked {
+		t.Errorf("Expected the revoked status to be known, got %v", cert.OCSP)
+	}
+	if len(cert.Certificate.OCSPStaple) != 0 {
+		t.Error("Expected the revoked status not to be stapled")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the revoked status not to be kept as a staple, got %d files", len(files))
+	}
+}
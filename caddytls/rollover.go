@@ -0,0 +1,375 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// rolloverAccountKey replaces the key of the ACME account that cfg
+// uses with a new one. The new key is stored as the next key before
+// the CA is asked to accept it, so it is not lost if the CA accepts
+// it but storing it as the key fails; a rollover that finds a next
+// key resumes with it. Once the new key is the key, the old key is
+// kept next to it until an order signed with the new key succeeds.
+// If maxAge is positive, the key is only replaced if it is older
+// than that. The rollover is done under the
+// storage lock of the account, so of the instances that share the
+// storage only one rolls the key over; rolloverAccountKey reports
+// whether it was this one.
+func rolloverAccountKey(cfg *Config, maxAge time.Duration) (bool, error) {
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil {
+		return false, err
+	}
+	email := cfg.ACMEEmail
+	if email == "" {
+		email = getEmail(storage, false)
+	}
+	account := email
+	if cfg.NoAccountReuse {
+		account = accountName(email, cfg.Hostname)
+	}
+
+	lockName := "account:" + account
+	if lockObtained, err := storage.LockRegister(lockName); err != nil {
+		return false, err
+	} else if !lockObtained {
+		log.Printf("[INFO] Key of ACME account %s is already being rolled over elsewhere", account)
+		return false, nil
+	}
+	defer func() {
+		if err := storage.UnlockRegister(lockName); err != nil {
+			log.Printf("[ERROR] Unable to unlock rollover lock for ACME account %s: %v", account, err)
+		}
+	}()
+
+	// load the account only now, so we see the key
+	// that another instance may have just rolled over
+	userData, err := storage.LoadUser(account)
+	if err == ErrStorageNotFound {
+		return false, fmt.Errorf("no ACME account for '%s' to roll over", account)
+	}
+	if err != nil {
+		return false, err
+	}
+	user, err := getAccount(storage, account, email)
+	if err != nil {
+		return false, err
+	}
+	if user.Registration == nil || user.Registration.URI == "" {
+		return false, fmt.Errorf("ACME account for '%s' is not registered", account)
+	}
+
+	if maxAge > 0 && len(userData.NextKey) == 0 {
+		if user.KeyCreated.IsZero() {
+			// the age of accounts from before keys were dated
+			// is not known; start counting from now
+			user.KeyCreated = time.Now().UTC()
+			return false, storeUser(storage, user, userData.OldKey)
+		}
+		if time.Since(user.KeyCreated) < maxAge {
+			return false, nil
+		}
+	}
+
+	pending := *userData
+	var newKey crypto.PrivateKey
+	if len(pending.NextKey) > 0 {
+		log.Printf("[INFO] Resuming rollover of key of ACME account %s", account)
+		newKey, err = loadPrivateKey(pending.NextKey)
+	} else {
+		newKey, err = generateKeyLike(user.key)
+		if err == nil {
+			pending.NextKey, err = savePrivateKey(newKey)
+		}
+		if err == nil {
+			err = storage.StoreUser(user.storageName(), &pending)
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("preparing new key of ACME account %s: %v", account, err)
+	}
+	dirURL, err := cfg.directoryURL()
+	if err != nil {
+		return false, err
+	}
+	err = acmeKeyChange(dirURL, user, newKey)
+	if err != nil {
+		if _, ok := err.(keyChangeRejected); ok {
+			// the CA did not take the key, so it is of no use
+			pending.NextKey = nil
+			if serr := storage.StoreUser(user.storageName(), &pending); serr != nil {
+				log.Printf("[ERROR] Removing rejected key of ACME account %s: %v", account, serr)
+			}
+		}
+		return false, fmt.Errorf("rolling over key of ACME account %s: %v", account, err)
+	}
+
+	user.key = newKey
+	user.KeyCreated = time.Now().UTC()
+	err = storeUser(storage, user, userData.Key)
+	if err != nil {
+		return false, fmt.Errorf("CA accepted the new key of ACME account %s, but storing it failed; it is kept as the next key: %v", account, err)
+	}
+	log.Printf("[INFO] Rolled over key of ACME account %s", account)
+	return true, nil
+}
+
+// rotateAccountKeys rolls over the keys of the ACME accounts of the
+// managed certificates that are older than their config allows.
+func rotateAccountKeys() {
+	type account struct{ caURL, name string }
+	visited := make(map[account]struct{})
+	var configs []*Config
+
+	certCacheMu.RLock()
+	for _, cert := range certCache {
+		cfg := cert.Config
+		if cfg == nil || !cfg.Managed || cfg.SelfSigned || cfg.AccountKeyRotate <= 0 {
+			continue
+		}
+		acct := account{strings.ToLower(cfg.CAUrl), cfg.accountName()}
+		if _, ok := visited[acct]; ok {
+			continue
+		}
+		visited[acct] = struct{}{}
+		configs = append(configs, cfg)
+	}
+	certCacheMu.RUnlock()
+
+	for _, cfg := range configs {
+		_, err := rolloverAccountKey(cfg, cfg.AccountKeyRotate)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+	}
+}
+
+// generateKeyLike generates a new private key
+// of the same type and size as key.
+func generateKeyLike(key crypto.PrivateKey) (crypto.PrivateKey, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(key.Curve, rand.Reader)
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(rand.Reader, key.N.BitLen())
+	}
+	return nil, errors.New("unknown private key type")
+}
+
+// acmeKeyChange asks the CA whose directory is at dirURL to
+// replace the key of the account of user with newKey. It
+// returns nil only if the CA confirmed the change.
+func acmeKeyChange(dirURL string, user User, newKey crypto.PrivateKey) error {
+	resp, err := acmeHTTPClient.Get(dirURL)
+	if err != nil {
+		return err
+	}
+	var dir struct {
+		KeyChange string `json:"key-change"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&dir)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading directory: %v", err)
+	}
+	if dir.KeyChange == "" {
+		return errors.New("CA does not support account key rollover")
+	}
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return errors.New("CA sent no nonce")
+	}
+
+	// the new key signs the change, and the old key signs that
+	newJWK, err := jsonWebKey(newKey)
+	if err != nil {
+		return err
+	}
+	change, err := json.Marshal(map[string]interface{}{
+		"account": user.Registration.URI,
+		"newKey":  newJWK,
+	})
+	if err != nil {
+		return err
+	}
+	inner, err := signJWS(newKey, map[string]interface{}{"jwk": newJWK}, change)
+	if err != nil {
+		return err
+	}
+	oldJWK, err := jsonWebKey(user.key)
+	if err != nil {
+		return err
+	}
+	outer, err := signJWS(user.key, map[string]interface{}{
+		"jwk":   oldJWK,
+		"nonce": nonce,
+		"url":   dir.KeyChange,
+	}, inner)
+	if err != nil {
+		return err
+	}
+
+	resp, err = acmeHTTPClient.Post(dir.KeyChange, "application/jose+json", bytes.NewReader(outer))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var problem struct {
+			Type   string `json:"type"`
+			Detail string `json:"detail"`
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		msg := fmt.Sprintf("CA rejected new key: HTTP %d", resp.StatusCode)
+		if json.Unmarshal(body, &problem) == nil && problem.Detail != "" {
+			msg = fmt.Sprintf("CA rejected new key: %s (%s)", problem.Detail, problem.Type)
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return keyChangeRejected(msg)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// keyChangeRejected is the error of a key change that the CA
+// refused as a client error, which means it kept the old key.
+type keyChangeRejected string
+
+func (e keyChangeRejected) Error() string { return string(e) }
+
+// jsonWebKey returns the public JSON Web Key of key.
+func jsonWebKey(key crypto.PrivateKey) (map[string]string, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": key.Curve.Params().Name,
+			"x":   base64URL(padBytes(key.X.Bytes(), size)),
+			"y":   base64URL(padBytes(key.Y.Bytes(), size)),
+		}, nil
+	case *rsa.PrivateKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64URL(key.N.Bytes()),
+			"e":   base64URL(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	}
+	return nil, errors.New("unknown private key type")
+}
+
+// signJWS signs payload with key and returns the JWS in flattened
+// JSON serialization. The algorithm is added to the protected header.
+func signJWS(key crypto.PrivateKey, protected map[string]interface{}, payload []byte) ([]byte, error) {
+	alg, _, err := jwsAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := map[string]interface{}{"alg": alg}
+	for k, v := range protected {
+		header[k] = v
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := base64URL(headerJSON) + "." + base64URL(payload)
+	sig, err := jwsSign(key, signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": base64URL(headerJSON),
+		"payload":   base64URL(payload),
+		"signature": base64URL(sig),
+	})
+}
+
+// jwsAlgorithm returns the JWS algorithm that key signs
+// with, and its hash.
+func jwsAlgorithm(key crypto.PrivateKey) (string, crypto.Hash, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return "ES256", crypto.SHA256, nil
+		case 384:
+			return "ES384", crypto.SHA384, nil
+		case 521:
+			return "ES512", crypto.SHA512, nil
+		default:
+			return "", 0, errors.New("unsupported elliptic curve")
+		}
+	case *rsa.PrivateKey:
+		return "RS256", crypto.SHA256, nil
+	}
+	return "", 0, errors.New("unknown private key type")
+}
+
+// jwsSign returns the JWS signature of signingInput with key.
+func jwsSign(key crypto.PrivateKey, signingInput string) ([]byte, error) {
+	_, hash, err := jwsAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	digest := hashOf(hash, []byte(signingInput))
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return append(padBytes(r.Bytes(), size), padBytes(s.Bytes(), size)...), nil
+	default:
+		return rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), hash, digest)
+	}
+}
+
+// hashOf returns the digest of data using hash.
+func hashOf(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// padBytes left-pads b with zeros to size bytes.
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// base64URL encodes b in unpadded base64url, as JOSE requires.
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
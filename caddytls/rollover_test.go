@@ -0,0 +1,395 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// testKeyChangeCA is a stub ACME CA that verifies key changes
+// like a real one would and accepts them unless told to reject.
+type testKeyChangeCA struct {
+	*httptest.Server
+	reject bool
+
+	mu      sync.Mutex
+	changes int
+	account string
+	newKey  map[string]string
+}
+
+func newTestKeyChangeCA(t *testing.T, accountKey *ecdsa.PrivateKey) *testKeyChangeCA {
+	ca := new(testKeyChangeCA)
+	ca.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce-1")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]string{"key-change": ca.URL + "/key-change"})
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		outerHeader, innerJWS, ok := verifyTestJWS(body)
+		if !ok || outerHeader["nonce"] != "nonce-1" || outerHeader["url"] != ca.URL+"/key-change" {
+			t.Errorf("Expected valid outer JWS, got %s", body)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !sameTestKey(outerHeader["jwk"], accountKey) {
+			t.Error("Expected key change to be signed with the current account key")
+		}
+		innerHeader, changeJSON, ok := verifyTestJWS(innerJWS)
+		if !ok {
+			t.Errorf("Expected valid inner JWS, got %s", innerJWS)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var change struct {
+			Account string            `json:"account"`
+			NewKey  map[string]string `json:"newKey"`
+		}
+		json.Unmarshal(changeJSON, &change)
+		innerKey, _ := json.Marshal(innerHeader["jwk"])
+		newKey, _ := json.Marshal(change.NewKey)
+		if !bytes.Equal(innerKey, newKey) {
+			t.Error("Expected key change to be signed with the new key")
+		}
+
+		if ca.reject {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"urn:acme:error:unauthorized","detail":"no key changes today"}`))
+			return
+		}
+		ca.mu.Lock()
+		ca.changes++
+		ca.account, ca.newKey = change.Account, change.NewKey
+		ca.mu.Unlock()
+	}))
+	return ca
+}
+
+// verifyTestJWS checks the signature of the flattened JWS data
+// with the key in its header and returns the header and payload.
+func verifyTestJWS(data []byte) (map[string]interface{}, []byte, bool) {
+	var jws struct{ Protected, Payload, Signature string }
+	if json.Unmarshal(data, &jws) != nil {
+		return nil, nil, false
+	}
+	headerJSON, err1 := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, err2 := base64.RawURLEncoding.DecodeString(jws.Payload)
+	sig, err3 := base64.RawURLEncoding.DecodeString(jws.Signature)
+	var header map[string]interface{}
+	if err1 != nil || err2 != nil || err3 != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, nil, false
+	}
+	jwk, _ := header["jwk"].(map[string]interface{})
+	if header["alg"] != "ES384" || jwk == nil || len(sig) != 96 {
+		return nil, nil, false
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"].(string))
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"].(string))
+	pub := &ecdsa.PublicKey{Curve: elliptic.P384(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	digest := sha512.Sum384([]byte(jws.Protected + "." + jws.Payload))
+	r, s := new(big.Int).SetBytes(sig[:48]), new(big.Int).SetBytes(sig[48:])
+	return header, payload, ecdsa.Verify(pub, digest[:], r, s)
+}
+
+// sameTestKey returns true if jwk is the public key of key.
+func sameTestKey(jwk interface{}, key *ecdsa.PrivateKey) bool {
+	expected, _ := jsonWebKey(key)
+	a, _ := json.Marshal(jwk)
+	b, _ := json.Marshal(expected)
+	return bytes.Equal(a, b)
+}
+
+// testLockStorage is a FileStorage with a lock shared between
+// its users, like a storage for a cluster of instances.
+type testLockStorage struct {
+	FileStorage
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (s *testLockStorage) LockRegister(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[name] {
+		return false, nil
+	}
+	s.locked[name] = true
+	return true, nil
+}
+
+func (s *testLockStorage) UnlockRegister(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locked, name)
+	return nil
+}
+
+// setupTestAccount makes a storage with a registered account at
+// a stub CA and returns a config for the account.
+func setupTestAccount(t *testing.T, keyAge time.Duration) (*Config, *testLockStorage, *testKeyChangeCA, func()) {
+	dir, err := ioutil.TempDir("", "caddytls_rollover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &testLockStorage{FileStorage: FileStorage(dir), locked: make(map[string]bool)}
+	user, err := newUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestKeyChangeCA(t, user.key.(*ecdsa.PrivateKey))
+	user.Registration = &acme.RegistrationResource{URI: ca.URL + "/acme/reg/1"}
+	user.KeyCreated = time.Now().Add(-keyAge)
+	if err := saveUser(storage, user); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		CAUrl:          ca.URL,
+		ACMEEmail:      "me@example.com",
+		StorageCreator: func(caURL *url.URL) (Storage, error) { return storage, nil },
+	}
+	return cfg, storage, ca, func() {
+		ca.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRolloverAccountKey(t *testing.T) {
+	cfg, storage, ca, cleanup := setupTestAccount(t, time.Hour)
+	defer cleanup()
+	before, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := rolloverAccountKey(cfg, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !rolled {
+		t.Fatal("Expected key to be rolled over")
+	}
+	if ca.changes != 1 || ca.account != ca.URL+"/acme/reg/1" {
+		t.Errorf("Expected 1 key change of the account, got %d for '%s'", ca.changes, ca.account)
+	}
+
+	after, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(after.Key, before.Key) {
+		t.Fatal("Expected stored key to change")
+	}
+	if !bytes.Equal(after.OldKey, before.Key) {
+		t.Error("Expected previous key to be kept as old key")
+	}
+	if _, err := os.Stat(storage.userKeyFile("me@example.com") + ".old"); err != nil {
+		t.Errorf("Expected old key file: %v", err)
+	}
+	user, err := getUser(storage, "me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameTestKey(ca.newKey, user.key.(*ecdsa.PrivateKey)) {
+		t.Error("Expected stored key to be the one the CA accepted")
+	}
+	if time.Since(user.KeyCreated) > time.Minute {
+		t.Errorf("Expected key creation time to be updated, got %v", user.KeyCreated)
+	}
+
+	// an order signed with the old key proves nothing...
+	oldUser := user
+	oldUser.key, _ = loadPrivateKey(before.Key)
+	(&ACMEClient{config: cfg, user: oldUser}).retireOldAccountKey(storage)
+	if data, _ := storage.LoadUser("me@example.com"); len(data.OldKey) == 0 {
+		t.Error("Expected old key to be kept after an order with the old key")
+	}
+
+	// ...but one signed with the new key retires the old key
+	(&ACMEClient{config: cfg, user: user}).retireOldAccountKey(storage)
+	if data, _ := storage.LoadUser("me@example.com"); len(data.OldKey) != 0 {
+		t.Error("Expected old key to be removed after an order with the new key")
+	}
+	if _, err := os.Stat(storage.userKeyFile("me@example.com") + ".old"); !os.IsNotExist(err) {
+		t.Errorf("Expected old key file to be removed, got: %v", err)
+	}
+}
+
+func TestRolloverAccountKeyRejected(t *testing.T) {
+	cfg, storage, ca, cleanup := setupTestAccount(t, time.Hour)
+	defer cleanup()
+	ca.reject = true
+	before, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := rolloverAccountKey(cfg, 0)
+	if err == nil {
+		t.Fatal("Expected an error when the CA rejects the key")
+	}
+	if rolled {
+		t.Error("Expected key not to be rolled over")
+	}
+	after, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.Key, before.Key) || !bytes.Equal(after.Reg, before.Reg) || len(after.OldKey) != 0 || len(after.NextKey) != 0 {
+		t.Error("Expected stored account to be unchanged")
+	}
+	if len(storage.locked) != 0 {
+		t.Errorf("Expected lock to be released, got %v", storage.locked)
+	}
+}
+
+// promotionFailingStorage fails to store the new key of a
+// rollover as the key, after the CA accepted it.
+type promotionFailingStorage struct {
+	*testLockStorage
+	fail bool
+}
+
+func (s *promotionFailingStorage) StoreUser(email string, data *UserData) error {
+	if s.fail && len(data.NextKey) == 0 && len(data.OldKey) > 0 {
+		return errors.New("disk full")
+	}
+	return s.testLockStorage.StoreUser(email, data)
+}
+
+func TestRolloverAccountKeyStoreFails(t *testing.T) {
+	cfg, lockStorage, ca, cleanup := setupTestAccount(t, time.Hour)
+	defer cleanup()
+	storage := &promotionFailingStorage{testLockStorage: lockStorage, fail: true}
+	cfg.StorageCreator = func(caURL *url.URL) (Storage, error) { return storage, nil }
+	before, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key the CA accepted is still in storage
+	if rolled, err := rolloverAccountKey(cfg, 0); err == nil || rolled {
+		t.Fatalf("Expected an error storing the new key, got %v, %v", rolled, err)
+	}
+	pending, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pending.Key, before.Key) || len(pending.NextKey) == 0 {
+		t.Fatal("Expected the new key to be stored as the next key")
+	}
+	nextKey, _ := loadPrivateKey(pending.NextKey)
+	if !sameTestKey(ca.newKey, nextKey.(*ecdsa.PrivateKey)) {
+		t.Error("Expected the next key to be the one the CA accepted")
+	}
+
+	// the next rollover resumes with it, even if the key is not due
+	storage.fail = false
+	if rolled, err := rolloverAccountKey(cfg, 24*time.Hour); err != nil || !rolled {
+		t.Fatalf("Expected the rollover to resume, got %v, %v", rolled, err)
+	}
+	after, err := storage.LoadUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.Key, pending.NextKey) || !bytes.Equal(after.OldKey, before.Key) || len(after.NextKey) != 0 {
+		t.Error("Expected the next key to become the key, with the previous key kept as old key")
+	}
+	if _, err := os.Stat(lockStorage.userKeyFile("me@example.com") + ".next"); !os.IsNotExist(err) {
+		t.Errorf("Expected next key file to be removed, got: %v", err)
+	}
+}
+
+func TestRolloverAccountKeyLocking(t *testing.T) {
+	cfg, storage, ca, cleanup := setupTestAccount(t, 48*time.Hour)
+	defer cleanup()
+
+	// another instance holds the lock
+	storage.LockRegister("account:me@example.com")
+	rolled, err := rolloverAccountKey(cfg, 0)
+	if err != nil || rolled {
+		t.Errorf("Expected nothing to happen while locked elsewhere, got %v, %v", rolled, err)
+	}
+	if ca.changes != 0 {
+		t.Errorf("Expected no key change while locked elsewhere, got %d", ca.changes)
+	}
+	storage.UnlockRegister("account:me@example.com")
+
+	// instances sharing the storage rotate the key when it is due;
+	// only one of them does it
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rolls int
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rolled, err := rolloverAccountKey(cfg, 24*time.Hour)
+			if err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			}
+			if rolled {
+				mu.Lock()
+				rolls++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if rolls != 1 || ca.changes != 1 {
+		t.Errorf("Expected exactly 1 rollover, got %d (%d key changes)", rolls, ca.changes)
+	}
+}
+
+func TestRolloverAccountKeyUndated(t *testing.T) {
+	cfg, storage, ca, cleanup := setupTestAccount(t, 0)
+	defer cleanup()
+	user, _ := getUser(storage, "me@example.com")
+	user.KeyCreated = time.Time{}
+	saveUser(storage, user)
+
+	rolled, err := rolloverAccountKey(cfg, time.Hour)
+	if err != nil || rolled {
+		t.Errorf("Expected key of unknown age not to be rolled over, got %v, %v", rolled, err)
+	}
+	if ca.changes != 0 {
+		t.Errorf("Expected no key change, got %d", ca.changes)
+	}
+	user, _ = getUser(storage, "me@example.com")
+	if user.KeyCreated.IsZero() {
+		t.Error("Expected key to be dated from now on")
+	}
+}
+
+func TestRolloverAccountKeyNoAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_rollover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{
+		CAUrl:          "http://127.0.0.1:1/directory",
+		ACMEEmail:      "nobody@example.com",
+		StorageCreator: func(caURL *url.URL) (Storage, error) { return FileStorage(filepath.Join(dir, "x")), nil },
+	}
+	if _, err := rolloverAccountKey(cfg, 0); err == nil {
+		t.Error("Expected an error for an account that does not exist")
+	}
+}
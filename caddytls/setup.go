@@ -11,12 +11,17 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mholt/caddy"
 )
 
 func init() {
 	caddy.RegisterPlugin("tls", caddy.Plugin{Action: setupTLS})
+	caddy.RegisterUpgradeState("tls_session_ticket_keys", caddy.UpgradeState{
+		Save:    saveTicketKeys,
+		Restore: restoreTicketKeys,
+	})
 }
 
 // setupTLS sets up the TLS configuration and installs certificates that
@@ -36,6 +41,7 @@ func setupTLS(c *caddy.Controller) error {
 
 	for c.Next() {
 		var certificateFile, keyFile, loadDir, maxCerts string
+		var certEnv, keyEnv, bundleEnv string
 
 		args := c.RemainingArgs()
 		switch len(args) {
@@ -133,19 +139,136 @@ func setupTLS(c *caddy.Controller) error {
 			case "load":
 				c.Args(&loadDir)
 				config.Manual = true
+			case "cert_env", "key_env", "bundle_env":
+				dir, name := c.Val(), ""
+				if !c.Args(&name) {
+					return c.ArgErr()
+				}
+				switch dir {
+				case "cert_env":
+					certEnv = name
+				case "key_env":
+					keyEnv = name
+				case "bundle_env":
+					bundleEnv = name
+				}
+				config.Manual = true
+			case "get_certificate":
+				args := c.RemainingArgs()
+				if len(args) < 2 || args[0] != "exec" {
+					return c.ArgErr()
+				}
+				config.GetCertificateExec = args[1:]
+				config.Manual = true
+			case "get_certificate_timeout":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil || timeout <= 0 {
+					return c.Err("get_certificate_timeout must be a positive duration")
+				}
+				config.GetCertificateTimeout = timeout
 			case "max_certs":
 				c.Args(&maxCerts)
 				config.OnDemand = true
-			case "dns":
+			case "account_key_rotate":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				rotate, err := time.ParseDuration(c.Val())
+				if err != nil || rotate <= 0 {
+					return c.Err("account_key_rotate must be a positive duration")
+				}
+				config.AccountKeyRotate = rotate
+			case "reuse_account":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				switch c.Val() {
+				case "on":
+					config.NoAccountReuse = false
+				case "off":
+					config.NoAccountReuse = true
+				default:
+					return c.Err("reuse_account must be on or off")
+				}
+			case "block_until_ready":
+				if c.NextArg() {
+					return c.ArgErr()
+				}
+				config.BlockUntilReady = true
+			case "strict_sni":
+				if c.NextArg() {
+					return c.ArgErr()
+				}
+				config.StrictSNI = true
+			case "storage_check":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				if c.Val() == "off" {
+					config.NoStorageCheck = true
+					break
+				}
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil || interval <= 0 {
+					return c.Err("storage_check must be a positive duration or off")
+				}
+				config.StorageCheckInterval = interval
+			case "profile":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				config.ACMEProfile = c.Val()
+			case "cert_lifetime":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				lifetime, err := time.ParseDuration(c.Val())
+				if err != nil || lifetime <= 0 {
+					return c.Err("cert_lifetime must be a positive duration")
+				}
+				config.CertLifetime = lifetime
+			case "audit_log":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "chain") {
+					return c.ArgErr()
+				}
+				config.AuditLog = args[0]
+				config.AuditChain = len(args) == 2
+			case "serve_chain":
 				args := c.RemainingArgs()
 				if len(args) != 1 {
 					return c.ArgErr()
 				}
-				dnsProvName := args[0]
-				if _, ok := dnsProviders[dnsProvName]; !ok {
-					return c.Errf("Unsupported DNS provider '%s'", args[0])
+				if args[0] != ChainAsObtained && args[0] != ChainLeafToRoot {
+					return c.Errf("Unknown chain order '%s'; must be %s or %s", args[0], ChainLeafToRoot, ChainAsObtained)
+				}
+				config.ServeChain = args[0]
+			case "include_root":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return c.ArgErr()
+				}
+				config.IncludeRoot = true
+				if len(args) == 1 {
+					roots, err := loadRootCerts(args[0])
+					if err != nil {
+						return c.Errf("Unable to load root certificate: %v", err)
+					}
+					config.RootCerts = roots
+				}
+			case "on_demand":
+				err := parseOnDemand(c, config)
+				if err != nil {
+					return err
+				}
+			case "dns":
+				err := parseDNS(c, config)
+				if err != nil {
+					return err
 				}
-				config.DNSProvider = args[0]
 			default:
 				return c.Errf("Unknown keyword '%s'", c.Val())
 			}
@@ -155,6 +278,15 @@ func setupTLS(c *caddy.Controller) error {
 		if len(args) == 0 && !hadBlock {
 			return c.ArgErr()
 		}
+		if (certEnv == "") != (keyEnv == "") {
+			return c.Err("cert_env and key_env must be used together")
+		}
+
+		for _, route := range config.DNSRoutes {
+			if route.Fallback != "" && route.Fallback != config.DNSProvider && !hasDNSRoute(config, route.Fallback) {
+				return c.Errf("DNS provider %s falls back to unknown provider '%s'", route.Name, route.Fallback)
+			}
+		}
 
 		// set certificate limit if on-demand TLS is enabled
 		if maxCerts != "" {
@@ -172,7 +304,7 @@ func setupTLS(c *caddy.Controller) error {
 
 		// load a single certificate and key, if specified
 		if certificateFile != "" && keyFile != "" {
-			err := cacheUnmanagedCertificatePEMFile(certificateFile, keyFile)
+			err := cacheUnmanagedCertificatePEMFile(config, certificateFile, keyFile)
 			if err != nil {
 				return c.Errf("Unable to load certificate and key files for '%s': %v", c.Key, err)
 			}
@@ -181,15 +313,55 @@ func setupTLS(c *caddy.Controller) error {
 
 		// load a directory of certificates, if specified
 		if loadDir != "" {
-			err := loadCertsInDir(c, loadDir)
+			err := loadCertsInDir(config, c, loadDir)
 			if err != nil {
 				return err
 			}
 		}
+
+		// load the certificates in environment variables, if specified;
+		// a reload reads them again
+		if certEnv != "" || bundleEnv != "" {
+			n, err := cacheEnvCertificates(config, certEnv, keyEnv, bundleEnv)
+			if err != nil {
+				return c.Errf("Unable to load certificates from the environment for '%s': %v", c.Key, err)
+			}
+			log.Printf("[INFO] Successfully loaded %d TLS certificates from the environment for %s", n, c.Key)
+		}
 	}
 
 	SetDefaultTLSParams(config)
 
+	// servers release the certificates of config when they stop;
+	// if a reload fails, they never start, so it is done here
+	c.OnStartupFailed(func() error {
+		config.ReleaseCertificates()
+		return nil
+	})
+
+	// warm the cache once the servers are listening; a restart,
+	// like the one on SIGUSR1, reads the file again
+	if config.OnDemandState.WarmFrom != "" && !c.Validating() {
+		warmer := newCacheWarmer(config)
+		c.OnStartup(func() error {
+			queueCacheWarmer(warmer)
+			return nil
+		})
+		c.OnShutdown(func() error {
+			warmer.Stop()
+			return nil
+		})
+	}
+
+	// the entries that are still queued when the
+	// process exits must make it to the audit log
+	if config.AuditLog != "" && !c.Validating() {
+		c.OnFinalStop(func() error {
+			FlushAuditLogs()
+			return nil
+		})
+	}
+
 	// generate self-signed cert if needed
 	if config.SelfSigned {
 		err := makeSelfSignedCert(config)
@@ -201,6 +373,145 @@ func setupTLS(c *caddy.Controller) error {
 	return nil
 }
 
+// parseDNS parses a DNS provider of the tls directive, which is
+// either the provider for every domain, or a named instance of a
+// provider for the domains of some zones:
+//
+//	dns provider [name] {
+//	    zones    zones...
+//	    fallback name
+//	    option   value
+//	}
+//
+// The challenge of a domain is solved by the instance whose zone
+// is the longest suffix of the domain, or by the ones it falls
+// back to if that fails. An instance that is named gets its
+// credentials from the environment variables that start with its
+// name in upper case and "_". Any other option is the provider's,
+// such as the server of rfc2136, and is given to it as it is.
+func parseDNS(c *caddy.Controller, cfg *Config) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	if _, ok := dnsProviders[args[0]]; !ok {
+		return c.Errf("Unsupported DNS provider '%s'", args[0])
+	}
+	hasBlock := c.NextArg()
+	if len(args) == 1 && !hasBlock {
+		cfg.DNSProvider = args[0]
+		return nil
+	}
+
+	route := DNSRoute{Provider: args[0], Name: args[0]}
+	if len(args) == 2 {
+		route.Name = args[1]
+		route.EnvPrefix = envPrefix(args[1])
+	}
+	if hasDNSRoute(cfg, route.Name) {
+		return c.Errf("DNS provider %s is defined twice; give each instance a name", route.Name)
+	}
+	if hasBlock {
+		if c.Val() != "{" {
+			return c.ArgErr()
+		}
+		c.IncrNest()
+		for c.NextBlock() {
+			what := c.Val()
+			values := c.RemainingArgs()
+			switch what {
+			case "zones":
+				if len(values) == 0 {
+					return c.ArgErr()
+				}
+				for _, zone := range values {
+					route.Zones = append(route.Zones, strings.ToLower(strings.Trim(zone, ".")))
+				}
+			case "fallback":
+				if len(values) != 1 {
+					return c.ArgErr()
+				}
+				if values[0] == route.Name {
+					return c.Errf("DNS provider %s cannot fall back to itself", route.Name)
+				}
+				route.Fallback = values[0]
+			default:
+				if len(values) != 1 {
+					return c.ArgErr()
+				}
+				if _, ok := route.Options[what]; ok {
+					return c.Errf("DNS provider option '%s' is given twice", what)
+				}
+				if route.Options == nil {
+					route.Options = make(map[string]string)
+				}
+				route.Options[what] = values[0]
+			}
+		}
+	}
+	cfg.DNSRoutes = append(cfg.DNSRoutes, route)
+	return nil
+}
+
+// hasDNSRoute returns whether cfg has a DNS route named name.
+func hasDNSRoute(cfg *Config, name string) bool {
+	for _, route := range cfg.DNSRoutes {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOnDemand parses the on_demand block of the tls directive
+// into cfg, which it enables on-demand TLS for:
+//
+//	on_demand {
+//	    warm_from        file
+//	    warm_concurrency n
+//	    warm_issue
+//	}
+func parseOnDemand(c *caddy.Controller, cfg *Config) error {
+	cfg.OnDemand = true
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.ArgErr()
+	}
+	c.IncrNest()
+	for c.NextBlock() {
+		switch c.Val() {
+		case "warm_from":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			cfg.OnDemandState.WarmFrom = c.Val()
+		case "warm_concurrency":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 1 {
+				return c.Err("warm_concurrency must be a positive integer")
+			}
+			cfg.OnDemandState.WarmConcurrency = n
+		case "warm_issue":
+			cfg.OnDemandState.WarmIssue = true
+		default:
+			return c.Errf("Unknown on_demand option '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	}
+	if cfg.OnDemandState.WarmFrom == "" &&
+		(cfg.OnDemandState.WarmConcurrency != 0 || cfg.OnDemandState.WarmIssue) {
+		return c.Err("on_demand: warm_concurrency and warm_issue require warm_from")
+	}
+	return nil
+}
+
 // loadCertsInDir loads all the certificates/keys in dir, as long as
 // the file ends with .pem. This method of loading certificates is
 // modeled after haproxy, which expects the certificate and key to
@@ -208,7 +519,7 @@ func setupTLS(c *caddy.Controller) error {
 // https://cbonte.github.io/haproxy-dconv/configuration-1.5.html#5.1-crt
 //
 // This function may write to the log as it walks the directory tree.
-func loadCertsInDir(c *caddy.Controller, dir string) error {
+func loadCertsInDir(cfg *Config, c *caddy.Controller, dir string) error {
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("[WARNING] Unable to traverse into %s; skipping", path)
@@ -271,7 +582,7 @@ func loadCertsInDir(c *caddy.Controller, dir string) error {
 				return c.Errf("%s: no private key block found", path)
 			}
 
-			err = cacheUnmanagedCertificatePEMBytes(certPEMBytes, keyPEMBytes)
+			err = cacheUnmanagedCertificatePEMBytes(cfg, certPEMBytes, keyPEMBytes)
 			if err != nil {
 				return c.Errf("%s: failed to load cert and key for '%s': %v", path, c.Key, err)
 			}
@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mholt/caddy"
 	"github.com/xenolf/lego/acme"
@@ -318,3 +320,362 @@ AwEHoUQDQgAEs22MtnG79K1mvIyjEO9GLx7BFD0tBbGnwQ0VPsuCxC6IeVuXbQDL
 SiVQvFZ6lUszTlczNxVkpEfqrM6xAupB7g==
 -----END EC PRIVATE KEY-----
 `)
+
+func TestSetupParseOnDemand(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  OnDemandState
+	}{
+		{`tls {
+			on_demand
+		}`, false, OnDemandState{}},
+		{`tls {
+			on_demand {
+				warm_from /etc/caddy/domains.txt
+			}
+		}`, false, OnDemandState{WarmFrom: "/etc/caddy/domains.txt"}},
+		{`tls {
+			max_certs 100
+			on_demand {
+				warm_from domains.txt
+				warm_concurrency 20
+				warm_issue
+			}
+		}`, false, OnDemandState{MaxObtain: 100, WarmFrom: "domains.txt", WarmConcurrency: 20, WarmIssue: true}},
+		{`tls {
+			on_demand {
+				warm_from
+			}
+		}`, true, OnDemandState{}},
+		{`tls {
+			on_demand {
+				warm_from domains.txt
+				warm_concurrency 0
+			}
+		}`, true, OnDemandState{}},
+		{`tls {
+			on_demand {
+				warm_from domains.txt
+				warm_issue yes
+			}
+		}`, true, OnDemandState{}},
+		{`tls {
+			on_demand {
+				warm_issue
+			}
+		}`, true, OnDemandState{}},
+		{`tls {
+			on_demand {
+				warm_up domains.txt
+			}
+		}`, true, OnDemandState{}},
+		{`tls {
+			on_demand domains.txt
+		}`, true, OnDemandState{}},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !cfg.OnDemand {
+			t.Errorf("Test %d: Expected on-demand TLS to be enabled", i)
+		}
+		if cfg.OnDemandState != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, cfg.OnDemandState)
+		}
+	}
+}
+
+func TestSetupParseAccountKeyRotate(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  time.Duration
+	}{
+		{`tls {
+			account_key_rotate 8760h
+		}`, false, 8760 * time.Hour},
+		{`tls {
+			account_key_rotate
+		}`, true, 0},
+		{`tls {
+			account_key_rotate yearly
+		}`, true, 0},
+		{`tls {
+			account_key_rotate -1h
+		}`, true, 0},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.AccountKeyRotate != test.expected {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, cfg.AccountKeyRotate)
+		}
+	}
+}
+
+func TestSetupParseStorageCheck(t *testing.T) {
+	for i, test := range []struct {
+		input       string
+		shouldErr   bool
+		expected    time.Duration
+		expectedOff bool
+	}{
+		{"tls {\n storage_check 6h \n}", false, 6 * time.Hour, false},
+		{"tls {\n storage_check off \n}", false, 0, true},
+		{"tls {\n storage_check \n}", true, 0, false},
+		{"tls {\n storage_check daily \n}", true, 0, false},
+		{"tls {\n storage_check 0s \n}", true, 0, false},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.StorageCheckInterval != test.expected || cfg.NoStorageCheck != test.expectedOff {
+			t.Errorf("Test %d: Expected interval %v and off %v, got %v and %v",
+				i, test.expected, test.expectedOff, cfg.StorageCheckInterval, cfg.NoStorageCheck)
+		}
+	}
+}
+
+func TestSetupParseReuseAccount(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+		expected  bool
+	}{
+		{"tls {\n reuse_account off \n}", false, true},
+		{"tls {\n reuse_account on \n}", false, false},
+		{"tls {\n reuse_account \n}", true, false},
+		{"tls {\n reuse_account never \n}", true, false},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.NoAccountReuse != test.expected {
+			t.Errorf("Test %d: Expected NoAccountReuse %v, got %v", i, test.expected, cfg.NoAccountReuse)
+		}
+	}
+}
+
+func TestSetupParseBackgroundPolicy(t *testing.T) {
+	for i, test := range []struct {
+		input             string
+		shouldErr         bool
+		expectedBlock     bool
+		expectedStrictSNI bool
+	}{
+		{"tls {\n block_until_ready \n}", false, true, false},
+		{"tls {\n strict_sni \n}", false, false, true},
+		{"tls {\n block_until_ready \n strict_sni \n}", false, true, true},
+		{"tls {\n block_until_ready yes \n}", true, false, false},
+		{"tls {\n strict_sni on \n}", true, false, false},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.BlockUntilReady != test.expectedBlock {
+			t.Errorf("Test %d: Expected BlockUntilReady %v, got %v", i, test.expectedBlock, cfg.BlockUntilReady)
+		}
+		if cfg.StrictSNI != test.expectedStrictSNI {
+			t.Errorf("Test %d: Expected StrictSNI %v, got %v", i, test.expectedStrictSNI, cfg.StrictSNI)
+		}
+	}
+}
+
+func TestSetupParseProfile(t *testing.T) {
+	for i, test := range []struct {
+		input            string
+		shouldErr        bool
+		expectedProfile  string
+		expectedLifetime time.Duration
+	}{
+		{`tls {
+			profile shortlived
+			cert_lifetime 168h
+		}`, false, "shortlived", 168 * time.Hour},
+		{`tls {
+			profile classic
+		}`, false, "classic", 0},
+		{`tls {
+			profile
+		}`, true, "", 0},
+		{`tls {
+			cert_lifetime weekly
+		}`, true, "", 0},
+		{`tls {
+			cert_lifetime 0s
+		}`, true, "", 0},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.ACMEProfile != test.expectedProfile {
+			t.Errorf("Test %d: Expected profile '%s', got '%s'", i, test.expectedProfile, cfg.ACMEProfile)
+		}
+		if cfg.CertLifetime != test.expectedLifetime {
+			t.Errorf("Test %d: Expected lifetime %v, got %v", i, test.expectedLifetime, cfg.CertLifetime)
+		}
+	}
+}
+
+func TestSetupParseAuditLog(t *testing.T) {
+	for i, test := range []struct {
+		input         string
+		shouldErr     bool
+		expectedFile  string
+		expectedChain bool
+	}{
+		{`tls {
+			audit_log /var/log/caddy/issuance.log
+		}`, false, "/var/log/caddy/issuance.log", false},
+		{`tls {
+			audit_log issuance.log chain
+		}`, false, "issuance.log", true},
+		{`tls {
+			audit_log
+		}`, true, "", false},
+		{`tls {
+			audit_log issuance.log link
+		}`, true, "", false},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cfg.AuditLog != test.expectedFile || cfg.AuditChain != test.expectedChain {
+			t.Errorf("Test %d: Expected audit log '%s' (chain %v), got '%s' (chain %v)",
+				i, test.expectedFile, test.expectedChain, cfg.AuditLog, cfg.AuditChain)
+		}
+	}
+}
+
+func TestSetupParseGetCertificate(t *testing.T) {
+	for i, test := range []struct {
+		input           string
+		shouldErr       bool
+		expectedCommand []string
+		expectedTimeout time.Duration
+	}{
+		{`tls {
+			get_certificate exec /usr/local/bin/fetch-cert {host}
+		}`, false, []string{"/usr/local/bin/fetch-cert", "{host}"}, 0},
+		{`tls {
+			get_certificate exec /usr/local/bin/fetch-cert
+			get_certificate_timeout 5s
+		}`, false, []string{"/usr/local/bin/fetch-cert"}, 5 * time.Second},
+		{`tls {
+			get_certificate exec /usr/local/bin/fetch-cert
+			get_certificate_timeout 0s
+		}`, true, nil, 0},
+		{`tls {
+			get_certificate exec /usr/local/bin/fetch-cert
+			get_certificate_timeout
+		}`, true, nil, 0},
+		{`tls {
+			get_certificate exec
+		}`, true, nil, 0},
+		{`tls {
+			get_certificate http://ca.internal/{host}
+		}`, true, nil, 0},
+	} {
+		cfg := new(Config)
+		RegisterConfigGetter("", func(c *caddy.Controller) *Config { return cfg })
+		c := caddy.NewTestController("", test.input)
+		err := setupTLS(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.GetCertificateExec, test.expectedCommand) {
+			t.Errorf("Test %d: Expected command %v, got %v", i, test.expectedCommand, cfg.GetCertificateExec)
+		}
+		if cfg.GetCertificateTimeout != test.expectedTimeout {
+			t.Errorf("Test %d: Expected timeout %v, got %v", i, test.expectedTimeout, cfg.GetCertificateTimeout)
+		}
+		if !cfg.Manual {
+			t.Errorf("Test %d: Expected config to be manual", i)
+		}
+	}
+}
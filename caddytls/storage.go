@@ -30,6 +30,15 @@ type UserData struct {
 	Reg []byte
 	// Key is the user key byte array.
 	Key []byte
+	// OldKey is the user key byte array from before the last key
+	// rollover, kept until the new key is known to work; it is
+	// empty if there is no such key.
+	OldKey []byte
+	// NextKey is the user key byte array that a key rollover is
+	// replacing Key with, stored before the CA is asked to accept
+	// it and kept until it replaces Key; it is empty if there is
+	// no rollover under way.
+	NextKey []byte
 }
 
 // Storage is an interface abstracting all storage used by Caddy's TLS
@@ -73,7 +82,9 @@ type Storage interface {
 	// for multi-server storage, all internal implementations should put a
 	// reasonable expiration on this lock in case UnlockRegister is unable to
 	// be called due to system crash. Errors should only be returned in
-	// exceptional cases. Any error will prevent renewal.
+	// exceptional cases. Any error will prevent renewal. It is also called
+	// before the key of a user account is rolled over, with "account:"
+	// and the email of the user in place of the domain.
 	LockRegister(domain string) (bool, error)
 
 	// UnlockRegister is called after Caddy has attempted to obtain or renew
@@ -94,7 +105,8 @@ type Storage interface {
 
 	// StoreUser persists the given user data for the given email in
 	// storage. Multi-server implementations should take care to make this
-	// operation atomic for all stored data items.
+	// operation atomic for all stored data items. An empty OldKey or
+	// NextKey removes the old or the next key from storage.
 	StoreUser(email string, data *UserData) error
 
 	// MostRecentUserEmail provides the most recently used email parameter
@@ -0,0 +1,286 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// StorageCheckEvent is emitted after the certificates in storage were
+// checked for damage; its payload is a StorageCheckInfo.
+const StorageCheckEvent = "tls.storagecheck"
+
+// StorageCheckInfo is the payload of StorageCheckEvent.
+type StorageCheckInfo struct {
+	// Checked is how many sites were checked
+	Checked int
+
+	// Quarantined are the problems of the sites whose
+	// data was set aside to be obtained again, by name
+	Quarantined map[string]string
+
+	// Renewed are the names of the sites whose certificate
+	// chain was broken, which are renewed to replace it
+	Renewed []string
+}
+
+// SiteQuarantiner is implemented by the Storage that can set aside
+// the data of a site that is damaged, so that it is kept to be looked
+// at but is no longer found. The data of other storage is deleted.
+type SiteQuarantiner interface {
+	// QuarantineSite sets aside the data of domain and
+	// returns where it is now.
+	QuarantineSite(domain string) (string, error)
+}
+
+// StorageCheckTick is how often the background maintenance
+// looks for sites whose storage check interval has passed.
+var StorageCheckTick = 10 * time.Minute
+
+var (
+	// lastStorageCheck is when each site was last checked, by
+	// the CA URL and the name
+	lastStorageCheck   = make(map[string]time.Time)
+	lastStorageCheckMu sync.Mutex
+)
+
+// storedSite is the name of a site whose data is in the storage of cfg.
+type storedSite struct {
+	cfg  *Config
+	name string
+}
+
+// CheckStorage checks the data of the managed sites of configs in
+// storage, at startup: a site whose certificate or key is missing
+// or does not parse, whose key does not match its certificate, or
+// whose metadata is not readable, is quarantined, so that ObtainCert,
+// which must be called next, obtains it again. A certificate whose
+// chain is not well-formed is renewed.
+func CheckStorage(configs []*Config) StorageCheckInfo {
+	var sites []storedSite
+	for _, cfg := range configs {
+		if cfg.Managed && !cfg.SelfSigned && !cfg.NoStorageCheck && HostQualifies(cfg.Hostname) {
+			sites = append(sites, storedSite{cfg, cfg.Hostname})
+		}
+	}
+	return checkSites(sites, false)
+}
+
+// checkDueStorage checks the sites of the managed certificates
+// in the cache whose storage check interval has passed, and
+// obtains again the ones that are quarantined.
+func checkDueStorage() {
+	var sites []storedSite
+	certCacheMu.RLock()
+	for _, cert := range certCache {
+		cfg := cert.Config
+		if cfg == nil || !cfg.Managed || cfg.SelfSigned || cfg.NoStorageCheck || isExecCertificate(cert) ||
+			cfg.StorageCheckInterval <= 0 || len(cert.Names) == 0 {
+			continue
+		}
+		lastStorageCheckMu.Lock()
+		last, ok := lastStorageCheck[storageCheckKey(cfg, cert.Names[0])]
+		lastStorageCheckMu.Unlock()
+		if ok && time.Since(last) < cfg.StorageCheckInterval {
+			continue
+		}
+		sites = append(sites, storedSite{cfg, cert.Names[0]})
+	}
+	certCacheMu.RUnlock()
+	if len(sites) > 0 {
+		checkSites(sites, true)
+	}
+}
+
+// checkSites checks the data of sites in storage, and emits and
+// logs a summary. If reobtain is true, the sites that are
+// quarantined are obtained again right away.
+func checkSites(sites []storedSite, reobtain bool) StorageCheckInfo {
+	info := StorageCheckInfo{Quarantined: make(map[string]string)}
+	visited := make(map[string]struct{})
+	for _, site := range sites {
+		key := storageCheckKey(site.cfg, site.name)
+		if _, ok := visited[key]; ok {
+			continue
+		}
+		visited[key] = struct{}{}
+		lastStorageCheckMu.Lock()
+		lastStorageCheck[key] = time.Now()
+		lastStorageCheckMu.Unlock()
+
+		problem, chainProblem, err := checkSite(site.cfg, site.name)
+		if err != nil {
+			log.Printf("[ERROR] Checking stored certificate of %s: %v", site.name, err)
+			continue
+		}
+		info.Checked++
+		switch {
+		case problem != "":
+			info.Quarantined[site.name] = problem
+			if reobtain {
+				if err := reobtainCert(site.cfg, site.name, true); err != nil {
+					log.Printf("[ERROR] Obtaining certificate of %s again: %v", site.name, err)
+				}
+			}
+		case chainProblem != "":
+			log.Printf("[WARNING] %s: stored certificate chain is broken (%s); renewing the certificate", site.name, chainProblem)
+			info.Renewed = append(info.Renewed, site.name)
+			if err := reobtainCert(site.cfg, site.name, false); err != nil {
+				log.Printf("[ERROR] Renewing certificate of %s: %v", site.name, err)
+			}
+		}
+	}
+
+	if len(info.Quarantined) > 0 || len(info.Renewed) > 0 {
+		log.Printf("[INFO] Checked stored certificates of %d sites: %d quarantined, %d renewed",
+			info.Checked, len(info.Quarantined), len(info.Renewed))
+	}
+	caddy.EmitEvent(StorageCheckEvent, info)
+	return info
+}
+
+// reobtainCert obtains the certificate of name again if it was
+// quarantined, or else renews it, and loads it into the cache.
+// It is a variable so that tests can tell it was called.
+var reobtainCert = func(cfg *Config, name string, quarantined bool) error {
+	var err error
+	if quarantined {
+		err = cfg.obtainCertName(name, false)
+	} else {
+		err = cfg.renewCertName(name, false)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = CacheManagedCertificate(name, cfg)
+	return err
+}
+
+func storageCheckKey(cfg *Config, name string) string {
+	return strings.ToLower(cfg.CAUrl) + " " + strings.ToLower(name)
+}
+
+// checkSite checks the data of name in the storage of cfg while
+// holding its lock, and quarantines it if it is damaged. It returns
+// what was damaged, or, if only the chain of the certificate is
+// broken, which does not keep it from being served, that.
+func checkSite(cfg *Config, name string) (problem, chainProblem string, err error) {
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil {
+		return "", "", err
+	}
+	if locked, err := storage.LockRegister(name); err != nil {
+		return "", "", err
+	} else if !locked {
+		return "", "", fmt.Errorf("certificate is being obtained elsewhere")
+	}
+	defer func() {
+		if err := storage.UnlockRegister(name); err != nil {
+			log.Printf("[ERROR] Unable to unlock obtain lock for %v: %v", name, err)
+		}
+	}()
+
+	data, err := storage.LoadSite(name)
+	if err == ErrStorageNotFound {
+		if !storage.SiteExists(name) {
+			return "", "", nil // not obtained yet
+		}
+		problem = "certificate, key or metadata is missing"
+	} else if err != nil {
+		return "", "", err
+	} else {
+		problem, chainProblem = siteDataProblem(data)
+	}
+	if problem == "" {
+		return "", chainProblem, nil
+	}
+
+	if q, ok := storage.(SiteQuarantiner); ok {
+		var where string
+		where, err = q.QuarantineSite(name)
+		if err == nil {
+			log.Printf("[ERROR] %s: stored certificate is damaged (%s); set it aside as %s to obtain it again", name, problem, where)
+		}
+	} else {
+		err = storage.DeleteSite(name)
+		if err == nil {
+			log.Printf("[ERROR] %s: stored certificate is damaged (%s); deleted it to obtain it again", name, problem)
+		}
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("stored certificate is damaged (%s), but it could not be set aside: %v", problem, err)
+	}
+	return problem, "", nil
+}
+
+// siteDataProblem returns what is wrong with data: the problem that
+// keeps the certificate from being used, or else the problem with
+// its chain, such as a later certificate that is cut short. A chain
+// that does not verify against the system roots is not a problem as
+// long as each of its certificates is issued by the next; it may be
+// from a CA that is not trusted here.
+func siteDataProblem(data *SiteData) (problem, chainProblem string) {
+	if len(data.Key) == 0 {
+		return "private key is empty", ""
+	}
+	if _, err := loadPrivateKey(data.Key); err != nil {
+		return fmt.Sprintf("private key does not parse: %v", err), ""
+	}
+
+	var certs []*x509.Certificate
+	var truncated bool
+	for rest := data.Cert; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			// a block that begins but does not end was cut short
+			truncated = bytes.Contains(rest, []byte("-----BEGIN"))
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Sprintf("certificate %d does not parse: %v", len(certs), err), ""
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return "certificate is empty", ""
+	}
+	if _, err := tls.X509KeyPair(data.Cert, data.Key); err != nil {
+		return fmt.Sprintf("private key does not match the certificate: %v", err), ""
+	}
+
+	var meta certMetadata
+	if err := json.Unmarshal(data.Meta, &meta); err != nil {
+		return fmt.Sprintf("metadata is not readable: %v", err), ""
+	}
+
+	if truncated {
+		return "", "certificate chain is truncated"
+	}
+	opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err == nil {
+		return "", ""
+	}
+	for i := 0; i < len(certs)-1; i++ {
+		if certs[i].CheckSignatureFrom(certs[i+1]) != nil {
+			return "", fmt.Sprintf("certificate %d is not issued by the next one", i)
+		}
+	}
+	return "", ""
+}
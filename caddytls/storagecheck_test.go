@@ -0,0 +1,197 @@
+package caddytls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// checkedStorage returns storage in a temporary directory and
+// a function that makes the config of a managed site in it.
+func checkedStorage(t *testing.T) (storage FileStorage, config func(name string) *Config, done func()) {
+	dir, err := ioutil.TempDir("", "caddytls_storagecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = FileStorage(dir)
+	creator := func(caURL *url.URL) (Storage, error) { return storage, nil }
+	config = func(name string) *Config {
+		return &Config{Managed: true, Hostname: name, CAUrl: "https://ca.test/directory", StorageCreator: creator}
+	}
+	return storage, config, func() {
+		lastStorageCheckMu.Lock()
+		lastStorageCheck = make(map[string]time.Time)
+		lastStorageCheckMu.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+// stubReobtain replaces reobtainCert with a function that records
+// the sites it is called for, by name, with whether they were
+// quarantined, until restore is called.
+func stubReobtain() (calls map[string]bool, restore func()) {
+	calls = make(map[string]bool)
+	original := reobtainCert
+	reobtainCert = func(cfg *Config, name string, quarantined bool) error {
+		calls[name] = quarantined
+		return nil
+	}
+	return calls, func() { reobtainCert = original }
+}
+
+func TestCheckStorage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	storage, config, done := checkedStorage(t)
+	defer done()
+	calls, restore := stubReobtain()
+	defer restore()
+
+	c := makeTestChain(t)
+	goodCert := bundle(c.leaf, c.inter2, c.inter1)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyDER, _ := x509.MarshalECPrivateKey(otherKey)
+	otherKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherKeyDER})
+	meta := []byte(`{"domain":"example.com"}`)
+
+	sites := []struct {
+		name        string
+		data        *SiteData
+		quarantined bool
+		renewed     bool
+	}{
+		// served from a CA the system does not trust, but well-formed
+		{"good.example.com", &SiteData{Cert: goodCert, Key: c.leafKeyPEM, Meta: meta}, false, false},
+		{"emptykey.example.com", &SiteData{Cert: goodCert, Key: []byte{}, Meta: meta}, true, false},
+		{"truncatedkey.example.com", &SiteData{Cert: goodCert, Key: c.leafKeyPEM[:len(c.leafKeyPEM)/2], Meta: meta}, true, false},
+		{"truncatedleaf.example.com", &SiteData{Cert: goodCert[:100], Key: c.leafKeyPEM, Meta: meta}, true, false},
+		// the leaf is whole, and still served until it is renewed
+		{"truncatedchain.example.com", &SiteData{Cert: goodCert[:len(goodCert)-100], Key: c.leafKeyPEM, Meta: meta}, false, true},
+		{"mismatch.example.com", &SiteData{Cert: goodCert, Key: otherKeyPEM, Meta: meta}, true, false},
+		{"badjson.example.com", &SiteData{Cert: goodCert, Key: c.leafKeyPEM, Meta: []byte(`{"domain":`)}, true, false},
+		{"misordered.example.com", &SiteData{Cert: bundle(c.leaf, c.inter1, c.inter2), Key: c.leafKeyPEM, Meta: meta}, false, true},
+	}
+	var configs []*Config
+	for _, site := range sites {
+		if err := storage.StoreSite(site.name, site.data); err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config(site.name))
+	}
+	// not obtained yet, which is not a problem
+	configs = append(configs, config("new.example.com"))
+	// not managed
+	unmanaged := config("emptykey.example.com")
+	unmanaged.Managed = false
+	configs = append(configs, unmanaged)
+
+	info := CheckStorage(configs)
+	if info.Checked != len(sites)+1 {
+		t.Errorf("Expected %d sites to be checked, got %d", len(sites)+1, info.Checked)
+	}
+	for _, site := range sites {
+		_, quarantined := info.Quarantined[site.name]
+		if quarantined != site.quarantined {
+			t.Errorf("%s: Expected quarantined %v, got %v (%s)", site.name, site.quarantined, quarantined, info.Quarantined[site.name])
+		}
+		if _, err := os.Stat(storage.site(site.name) + ".corrupt"); (err == nil) != site.quarantined {
+			t.Errorf("%s: Expected set-aside folder %v, got error %v", site.name, site.quarantined, err)
+		}
+		// a quarantined site is obtained again by ObtainCert
+		if storage.SiteExists(site.name) == site.quarantined {
+			t.Errorf("%s: Expected site to exist %v", site.name, !site.quarantined)
+		}
+		if quarantined, called := calls[site.name]; called != site.renewed || (called && quarantined) {
+			t.Errorf("%s: Expected renewal %v, got call %v with quarantined %v", site.name, site.renewed, called, quarantined)
+		}
+	}
+
+	// the good certificate is left as it is
+	data, err := storage.LoadSite("good.example.com")
+	if err != nil || !bytes.Equal(data.Cert, goodCert) {
+		t.Errorf("Expected the good certificate to stay, got error %v", err)
+	}
+}
+
+func TestCheckStorageQuarantinedAgain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	storage, config, done := checkedStorage(t)
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		storage.StoreSite("example.com", &SiteData{Cert: []byte("broken"), Key: []byte("broken"), Meta: []byte("{}")})
+		CheckStorage([]*Config{config("example.com")})
+	}
+	for _, folder := range []string{".corrupt", ".1.corrupt"} {
+		if _, err := os.Stat(storage.site("example.com") + folder); err != nil {
+			t.Errorf("Expected the site to be set aside as %s: %v", folder, err)
+		}
+	}
+}
+
+func TestCheckDueStorage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+	storage, config, done := checkedStorage(t)
+	defer done()
+	calls, restore := stubReobtain()
+	defer restore()
+
+	c := makeTestChain(t)
+	meta := []byte(`{"domain":"example.com"}`)
+	periodic, once := config("example.com"), config("example.net")
+	periodic.StorageCheckInterval = time.Hour
+	for _, cfg := range []*Config{periodic, once} {
+		storage.StoreSite(cfg.Hostname, &SiteData{Cert: bundle(c.leaf, c.inter2, c.inter1), Key: c.leafKeyPEM, Meta: meta})
+		cacheCertificate(Certificate{Names: []string{cfg.Hostname}, Config: cfg})
+	}
+
+	// damaged on disk after it was loaded
+	storage.StoreSite("example.com", &SiteData{Cert: bundle(c.leaf), Key: []byte{}, Meta: meta})
+	storage.StoreSite("example.net", &SiteData{Cert: bundle(c.leaf), Key: []byte{}, Meta: meta})
+	checkDueStorage()
+	if quarantined, called := calls["example.com"]; !called || !quarantined {
+		t.Errorf("Expected the quarantined certificate to be obtained again, got call %v with quarantined %v", called, quarantined)
+	}
+	if _, called := calls["example.net"]; called {
+		t.Error("Expected the certificate without a storage check interval not to be checked")
+	}
+
+	// not due again until the interval has passed
+	storage.StoreSite("example.com", &SiteData{Cert: bundle(c.leaf), Key: []byte{}, Meta: meta})
+	delete(calls, "example.com")
+	checkDueStorage()
+	if len(calls) != 0 {
+		t.Errorf("Expected no check before the interval has passed, got %v", calls)
+	}
+	lastStorageCheckMu.Lock()
+	lastStorageCheck[storageCheckKey(periodic, "example.com")] = time.Now().Add(-2 * time.Hour)
+	lastStorageCheckMu.Unlock()
+	checkDueStorage()
+	var names []string
+	for name := range calls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("Expected example.com to be checked again, got %v", names)
+	}
+}
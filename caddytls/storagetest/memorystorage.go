@@ -121,6 +121,12 @@ func (s *InMemoryStorage) StoreUser(email string, data *caddytls.UserData) error
 	copiedData := new(caddytls.UserData)
 	copiedData.Reg = copyBytes(data.Reg)
 	copiedData.Key = copyBytes(data.Key)
+	if len(data.OldKey) > 0 {
+		copiedData.OldKey = copyBytes(data.OldKey)
+	}
+	if len(data.NextKey) > 0 {
+		copiedData.NextKey = copyBytes(data.NextKey)
+	}
 	s.Users[email] = copiedData
 	s.LastUserEmail = email
 	return nil
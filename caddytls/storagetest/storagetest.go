@@ -192,8 +192,9 @@ var simpleUserData = &caddytls.UserData{
 	Key: []byte("bar"),
 }
 var simpleUserDataAlt = &caddytls.UserData{
-	Reg: []byte("baz"),
-	Key: []byte("qux"),
+	Reg:    []byte("baz"),
+	Key:    []byte("qux"),
+	OldKey: []byte("bar"),
 }
 
 // TestUser tests Storage.LoadUser and Storage.StoreUser.
@@ -228,6 +229,18 @@ func (s *StorageTest) TestUser() error {
 		return err
 	} else if !bytes.Equal(userData.Reg, simpleUserDataAlt.Reg) {
 		return errors.New("Unexpected reg returned after overwrite")
+	} else if !bytes.Equal(userData.OldKey, simpleUserDataAlt.OldKey) {
+		return errors.New("Unexpected old key returned after overwrite")
+	}
+
+	// Storing without an old key should remove it
+	if err := s.StoreUser("foo@example.com", simpleUserData); err != nil {
+		return err
+	}
+	if userData, err := s.LoadUser("foo@example.com"); err != nil {
+		return err
+	} else if len(userData.OldKey) != 0 {
+		return errors.New("Expected no old key after storing without one")
 	}
 
 	return nil
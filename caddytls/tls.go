@@ -48,15 +48,24 @@ func HostQualifies(hostname string) bool {
 
 // saveCertResource saves the certificate resource to disk. This
 // includes the certificate file itself, the private key, and the
-// metadata file.
-func saveCertResource(storage Storage, cert acme.CertificateResource) error {
+// metadata file, which records the profile the certificate was
+// ordered with and the ACME account of user, which ordered it.
+func saveCertResource(storage Storage, cert acme.CertificateResource, profile string, user User) error {
 	// Save cert, private key, and metadata
 	siteData := &SiteData{
 		Cert: cert.Certificate,
 		Key:  cert.PrivateKey,
 	}
+	if cert.AccountRef == "" && user.Registration != nil {
+		cert.AccountRef = user.Registration.URI
+	}
+	account := user.storageName()
 	var err error
-	siteData.Meta, err = json.MarshalIndent(&cert, "", "\t")
+	siteData.Meta, err = json.MarshalIndent(&certMetadata{
+		CertificateResource: cert,
+		Profile:             profile,
+		Account:             &account,
+	}, "", "\t")
 	if err == nil {
 		err = storage.StoreSite(cert.Domain, siteData)
 	}
@@ -66,17 +75,41 @@ func saveCertResource(storage Storage, cert acme.CertificateResource) error {
 // Revoke revokes the certificate for host via ACME protocol.
 // It assumes the certificate was obtained from the
 // CA at DefaultCAUrl.
-func Revoke(host string) error {
-	client, err := newACMEClient(new(Config), true)
+//
+// The revocation is recorded in the audit log in the file
+// auditLog, if it is not empty, hash-chained if auditChain is
+// true; it is written before Revoke returns.
+func Revoke(host, auditLog string, auditChain bool) error {
+	cfg := &Config{CAUrl: DefaultCAUrl, Hostname: host, AuditLog: auditLog, AuditChain: auditChain}
+	defer FlushAuditLogs()
+	client, err := newACMEClient(cfg, cfg.accountName(), true)
 	if err != nil {
 		return err
 	}
 	return client.Revoke(host)
 }
 
+// RolloverAccountKey replaces the key of the ACME account of the
+// default email address at the default CA with a new one; see
+// -email and -ca. It may prompt the user for the email address.
+func RolloverAccountKey() error {
+	cfg := &Config{CAUrl: DefaultCAUrl}
+	storage, err := cfg.StorageFor(cfg.CAUrl)
+	if err != nil {
+		return err
+	}
+	cfg.ACMEEmail = getEmail(storage, true)
+	_, err = rolloverAccountKey(cfg, 0)
+	return err
+}
+
 // tlsSniSolver is a type that can solve tls-sni challenges using
 // an existing listener and our custom, in-memory certificate cache.
-type tlsSniSolver struct{}
+// The challenges are kept in the storage of config too, so that
+// any instance that shares the storage can answer them.
+type tlsSniSolver struct {
+	config *Config
+}
 
 // Present adds the challenge certificate to the cache.
 func (s tlsSniSolver) Present(domain, token, keyAuth string) error {
@@ -88,6 +121,7 @@ func (s tlsSniSolver) Present(domain, token, keyAuth string) error {
 		Certificate: cert,
 		Names:       []string{acmeDomain},
 	})
+	presentChallenge(s.config, challengeKey(acmeDomain, ""), keyAuth)
 	return nil
 }
 
@@ -98,6 +132,7 @@ func (s tlsSniSolver) CleanUp(domain, token, keyAuth string) error {
 		return err
 	}
 	uncacheCertificate(acmeDomain)
+	cleanUpChallenge(s.config, challengeKey(acmeDomain, ""))
 	return nil
 }
 
@@ -140,9 +175,11 @@ func QualifiesForManagedTLS(c ConfigHolder) bool {
 		(HostQualifies(c.Host()) || tlsConfig.OnDemand)
 }
 
-// DNSProviderConstructor is a function that takes credentials and
-// returns a type that can solve the ACME DNS challenges.
-type DNSProviderConstructor func(credentials ...string) (acme.ChallengeProvider, error)
+// DNSProviderConstructor is a function that returns a type that
+// can solve the ACME DNS challenges, with the credentials it gets by
+// calling getenv with the names of its environment variables, and
+// the options it was given in the Caddyfile, which may be nil.
+type DNSProviderConstructor func(getenv func(name string) string, options map[string]string) (acme.ChallengeProvider, error)
 
 // dnsProviders is the list of DNS providers that have been plugged in.
 var dnsProviders = make(map[string]DNSProviderConstructor)
@@ -93,7 +93,9 @@ func TestSaveCertResource(t *testing.T) {
 	metaContents := `{
 	"domain": "example.com",
 	"certUrl": "https://example.com/cert",
-	"certStableUrl": "https://example.com/cert/stable"
+	"certStableUrl": "https://example.com/cert/stable",
+	"accountRef": "https://example.com/acme/reg/1",
+	"account": "me@example.com"
 }`
 
 	cert := acme.CertificateResource{
@@ -104,7 +106,8 @@ func TestSaveCertResource(t *testing.T) {
 		Certificate:   []byte(certContents),
 	}
 
-	err := saveCertResource(storage, cert)
+	user := User{Email: "me@example.com", Registration: &acme.RegistrationResource{URI: "https://example.com/acme/reg/1"}}
+	err := saveCertResource(storage, cert, "", user)
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
@@ -143,7 +146,7 @@ func TestExistingCertAndKey(t *testing.T) {
 		Domain:      domain,
 		PrivateKey:  []byte("key"),
 		Certificate: []byte("cert"),
-	})
+	}, "", User{})
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/xenolf/lego/acme"
 )
@@ -20,7 +21,9 @@ import (
 type User struct {
 	Email        string
 	Registration *acme.RegistrationResource
+	KeyCreated   time.Time // zero if not known
 	key          crypto.PrivateKey
+	account      string // the name it is stored under, if not Email
 }
 
 // GetEmail gets u's email.
@@ -44,7 +47,7 @@ func (u User) GetPrivateKey() crypto.PrivateKey {
 // a user account that might already exist, call getUser
 // instead. It does NOT prompt the user.
 func newUser(email string) (User, error) {
-	user := User{Email: email}
+	user := User{Email: email, KeyCreated: time.Now().UTC()}
 	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	if err != nil {
 		return user, errors.New("error generating private key: " + err.Error())
@@ -92,20 +95,39 @@ func getEmail(storage Storage, userPresent bool) string {
 	return strings.ToLower(leEmail)
 }
 
+// storageName returns the name that u is stored under.
+func (u User) storageName() string {
+	if u.account != "" {
+		return u.account
+	}
+	return u.Email
+}
+
 // getUser loads the user with the given email from disk
 // using the provided storage. If the user does not exist,
 // it will create a new one, but it does NOT save new
 // users to the disk or register them via ACME. It does
 // NOT prompt the user.
 func getUser(storage Storage, email string) (User, error) {
+	return getAccount(storage, email, email)
+}
+
+// getAccount is like getUser, but it loads the user
+// stored as account, which is created with email if
+// it does not exist.
+func getAccount(storage Storage, account, email string) (User, error) {
 	var user User
 
 	// open user reg
-	userData, err := storage.LoadUser(email)
+	userData, err := storage.LoadUser(account)
 	if err != nil {
 		if err == ErrStorageNotFound {
 			// create a new user
-			return newUser(email)
+			user, err = newUser(email)
+			if account != email {
+				user.account = account
+			}
+			return user, err
 		}
 		return user, err
 	}
@@ -121,6 +143,9 @@ func getUser(storage Storage, email string) (User, error) {
 	if err != nil {
 		return user, err
 	}
+	if account != user.Email {
+		user.account = account
+	}
 
 	return user, nil
 }
@@ -131,15 +156,21 @@ func getUser(storage Storage, email string) (User, error) {
 // wherein the user should be saved. It should be the storage
 // for the CA with which user has an account.
 func saveUser(storage Storage, user User) error {
+	return storeUser(storage, user, nil)
+}
+
+// storeUser is like saveUser, but it also stores
+// oldKey as the key user had before its current one.
+func storeUser(storage Storage, user User, oldKey []byte) error {
 	// Save the private key and registration
-	userData := new(UserData)
+	userData := &UserData{OldKey: oldKey}
 	var err error
 	userData.Key, err = savePrivateKey(user.key)
 	if err == nil {
 		userData.Reg, err = json.MarshalIndent(&user, "", "\t")
 	}
 	if err == nil {
-		err = storage.StoreUser(user.Email, userData)
+		err = storage.StoreUser(user.storageName(), userData)
 	}
 	return err
 }
@@ -0,0 +1,245 @@
+package caddytls
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mholt/caddy"
+)
+
+func init() {
+	caddy.RegisterEventHook("tls_cache_warmers", startCacheWarmers)
+}
+
+// DefaultWarmConcurrency is how many hostnames are warmed
+// at the same time if warm_concurrency is not set.
+const DefaultWarmConcurrency = 10
+
+var (
+	// pendingWarmers are the warmers of the instance that
+	// is starting; they run once its servers are listening.
+	pendingWarmers   []*cacheWarmer
+	pendingWarmersMu sync.Mutex
+)
+
+// queueCacheWarmer makes w run once the servers are started.
+func queueCacheWarmer(w *cacheWarmer) {
+	pendingWarmersMu.Lock()
+	pendingWarmers = append(pendingWarmers, w)
+	pendingWarmersMu.Unlock()
+}
+
+// startCacheWarmers runs the pending warmers in the background
+// when an instance has started its servers.
+func startCacheWarmers(eventName string, payload interface{}) error {
+	if eventName != caddy.InstanceStartupEvent {
+		return nil
+	}
+	pendingWarmersMu.Lock()
+	warmers := pendingWarmers
+	pendingWarmers = nil
+	pendingWarmersMu.Unlock()
+	for _, w := range warmers {
+		go w.run()
+	}
+	return nil
+}
+
+// warmResult counts what warming the cache did with each hostname.
+type warmResult struct {
+	cached  int // already in the cache
+	loaded  int // loaded from storage
+	issued  int // obtained from the CA
+	missing int // not in storage, and not to be obtained
+	failed  int // could not be loaded or obtained
+}
+
+// cacheWarmer puts the certificates for the hostnames in a file
+// into the cache, so that the first handshakes for those names do
+// not have to wait for storage or for the CA.
+type cacheWarmer struct {
+	cfg         *Config
+	file        string
+	concurrency int
+	issue       bool
+
+	// obtain obtains a certificate for name and caches it
+	obtain func(name string) error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newCacheWarmer makes a warmer from the on-demand settings of cfg.
+func newCacheWarmer(cfg *Config) *cacheWarmer {
+	w := &cacheWarmer{
+		cfg:         cfg,
+		file:        cfg.OnDemandState.WarmFrom,
+		concurrency: cfg.OnDemandState.WarmConcurrency,
+		issue:       cfg.OnDemandState.WarmIssue,
+		stop:        make(chan struct{}),
+	}
+	if w.concurrency < 1 {
+		w.concurrency = DefaultWarmConcurrency
+	}
+	w.obtain = func(name string) error {
+		_, err := configGroup{"": cfg}.obtainOnDemandCertificate(name, cfg)
+		return err
+	}
+	return w
+}
+
+// Stop makes w stop warming; hostnames that are being
+// loaded or obtained already are finished.
+func (w *cacheWarmer) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// stopped returns true if w was stopped.
+func (w *cacheWarmer) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run warms the cache and logs the result.
+func (w *cacheWarmer) run() {
+	if w.stopped() {
+		return
+	}
+	res, err := w.warm()
+	if err != nil {
+		log.Printf("[ERROR] Warming certificate cache: %v", err)
+		return
+	}
+	log.Printf("[INFO] Warmed certificate cache from %s: %d cached, %d loaded, %d issued, %d missing, %d failed",
+		w.file, res.cached, res.loaded, res.issued, res.missing, res.failed)
+}
+
+// warm reads the hostnames from the file of w and loads or
+// obtains their certificates, at most w.concurrency at a time.
+func (w *cacheWarmer) warm() (warmResult, error) {
+	var res warmResult
+	names, err := readWarmNames(w.file)
+	if err != nil {
+		return res, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				outcome := w.warmName(name)
+				mu.Lock()
+				res.add(outcome)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		if w.stopped() {
+			break
+		}
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+	return res, nil
+}
+
+// warmOutcome is what warming the cache did with a hostname.
+type warmOutcome int
+
+const (
+	warmCached warmOutcome = iota
+	warmLoaded
+	warmIssued
+	warmMissing
+	warmFailed
+)
+
+// add counts outcome in r.
+func (r *warmResult) add(outcome warmOutcome) {
+	switch outcome {
+	case warmCached:
+		r.cached++
+	case warmLoaded:
+		r.loaded++
+	case warmIssued:
+		r.issued++
+	case warmMissing:
+		r.missing++
+	case warmFailed:
+		r.failed++
+	}
+}
+
+// warmName loads or obtains the certificate for name. Obtaining
+// is subject to the same limits as during handshakes.
+func (w *cacheWarmer) warmName(name string) warmOutcome {
+	if _, matched, _ := getCertificate(name); matched {
+		return warmCached
+	}
+	if _, err := CacheManagedCertificate(name, w.cfg); err == nil {
+		return warmLoaded
+	}
+	if !w.issue {
+		return warmMissing
+	}
+	err := configGroup{"": w.cfg}.checkLimitsForObtainingNewCerts(name, w.cfg)
+	if err == nil {
+		err = w.obtain(name)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Warming certificate cache: %v", err)
+		return warmFailed
+	}
+	return warmIssued
+}
+
+// readWarmNames reads the hostnames in file, one per line. Empty
+// lines and lines starting with # are ignored; lines that are not
+// a hostname which qualifies for a certificate are skipped with a
+// warning. Hostnames that are repeated are only returned once.
+func readWarmNames(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.ToLower(line)
+		if strings.ContainsAny(name, " \t/:") || !HostQualifies(name) {
+			log.Printf("[WARNING] %s:%d: '%s' is not a hostname that qualifies for a certificate; skipping", file, lineNum, line)
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", file, err)
+	}
+	return names, nil
+}
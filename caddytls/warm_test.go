@@ -0,0 +1,195 @@
+package caddytls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadWarmNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "domains.txt")
+	err = ioutil.WriteFile(file, []byte(`# customers
+a.example.com
+  B.Example.com
+
+localhost
+1.2.3.4
+*.example.com
+not a hostname
+https://c.example.com/
+a.example.com
+d.example.com
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := readWarmNames(file)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []string{"a.example.com", "b.example.com", "d.example.com"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected names %v, got %v", expected, names)
+	}
+
+	if _, err := readWarmNames(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("Expected an error for a missing file, got none")
+	}
+}
+
+func TestCacheWarmer(t *testing.T) {
+	defer func() {
+		certCache = make(map[string]Certificate)
+		certSources = make(map[string]*certSource)
+	}()
+
+	dir, err := ioutil.TempDir("", "caddytls_warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := FileStorage(filepath.Join(dir, "storage"))
+	cfg := &Config{
+		OnDemand:       true,
+		CAUrl:          "https://ca.test/directory",
+		StorageCreator: func(caURL *url.URL) (Storage, error) { return storage, nil },
+	}
+
+	// storage has certificates for half of the names
+	var list []byte
+	stored := make(map[string]bool)
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("site%d.example.com", i)
+		list = append(list, name+"\n"...)
+		if i%2 == 0 {
+			certPEM, keyPEM := makeTestCertPEM(t, name)
+			if err := storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+				t.Fatal(err)
+			}
+			stored[name] = true
+		}
+	}
+	cfg.OnDemandState.WarmFrom = filepath.Join(dir, "domains.txt")
+	if err := ioutil.WriteFile(cfg.OnDemandState.WarmFrom, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// without warm_issue, the other names are left alone
+	w := newCacheWarmer(cfg)
+	w.obtain = func(name string) error {
+		t.Errorf("Expected no certificate to be obtained, but %s was", name)
+		return nil
+	}
+	res, err := w.warm()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := (warmResult{loaded: 6, missing: 6}); res != expected {
+		t.Errorf("Expected %+v, got %+v", expected, res)
+	}
+
+	// with warm_issue, they are obtained, at most 3 at a time
+	cfg.OnDemandState.WarmIssue = true
+	cfg.OnDemandState.WarmConcurrency = 3
+	w = newCacheWarmer(cfg)
+	var mu sync.Mutex
+	var running, peak int
+	var obtained []string
+	w.obtain = func(name string) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		obtained = append(obtained, name)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		certPEM, keyPEM := makeTestCertPEM(t, name)
+		if err := storage.StoreSite(name, &SiteData{Cert: certPEM, Key: keyPEM}); err != nil {
+			return err
+		}
+		_, err := CacheManagedCertificate(name, cfg)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return err
+	}
+	res, err = w.warm()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := (warmResult{cached: 6, issued: 6}); res != expected {
+		t.Errorf("Expected %+v, got %+v", expected, res)
+	}
+	for _, name := range obtained {
+		if stored[name] {
+			t.Errorf("Expected %s to be loaded from storage, but it was obtained", name)
+		}
+	}
+	if peak != 3 {
+		t.Errorf("Expected at most and at peak 3 names to be obtained at once, got %d", peak)
+	}
+	if _, matched, _ := getCertificate("site1.example.com"); !matched {
+		t.Error("Expected obtained certificate to be cached")
+	}
+
+	// a stopped warmer does nothing more
+	w = newCacheWarmer(cfg)
+	w.Stop()
+	res, err = w.warm()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if res != (warmResult{}) {
+		t.Errorf("Expected stopped warmer to warm nothing, got %+v", res)
+	}
+}
+
+func TestCacheWarmerRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddytls_warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := FileStorage(filepath.Join(dir, "storage"))
+	cfg := &Config{
+		OnDemand:       true,
+		CAUrl:          "https://ca.test/directory",
+		StorageCreator: func(caURL *url.URL) (Storage, error) { return storage, nil },
+	}
+	cfg.OnDemandState.WarmFrom = filepath.Join(dir, "domains.txt")
+	cfg.OnDemandState.WarmIssue = true
+	cfg.OnDemandState.MaxObtain = 2
+	cfg.OnDemandState.ObtainedCount = 2
+	err = ioutil.WriteFile(cfg.OnDemandState.WarmFrom, []byte("a.example.com\nb.example.com\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCacheWarmer(cfg)
+	w.obtain = func(name string) error {
+		t.Errorf("Expected limit to keep %s from being obtained", name)
+		return nil
+	}
+	res, err := w.warm()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := (warmResult{failed: 2}); res != expected {
+		t.Errorf("Expected %+v, got %+v", expected, res)
+	}
+}
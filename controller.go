@@ -21,6 +21,9 @@ type Controller struct {
 	// an address, hostname, or identifier of some sort.
 	Key string
 
+	// Directive is the name of the directive being set up.
+	Directive string
+
 	// OncePerServerBlock is a function that executes f
 	// exactly once per server block, no matter how many
 	// hosts are associated with it. If it is the first
@@ -84,6 +87,30 @@ func (c *Controller) OnFinalShutdown(fn func() error) {
 	c.instance.onFinalShutdown = append(c.instance.onFinalShutdown, fn)
 }
 
+// OnFinalStop adds fn to the list of callback functions to execute
+// after the servers were stopped when the process is shutting down,
+// which is NOT as part of a restart.
+func (c *Controller) OnFinalStop(fn func() error) {
+	c.instance.onFinalStop = append(c.instance.onFinalStop, fn)
+}
+
+// OnStartupFailed adds fn to the list of callback functions to execute
+// when the instance fails to start (including as part of a restart),
+// after which it is discarded; fn should undo what the setup did that
+// would outlive the instance.
+func (c *Controller) OnStartupFailed(fn func() error) {
+	c.instance.onStartupFailed = append(c.instance.onStartupFailed, fn)
+}
+
+// Validating returns true if the Caddyfile is only being
+// validated. Setup functions should still check and apply
+// the configuration as usual, but must skip side effects
+// that reach outside of the process, like network requests
+// or writing files.
+func (c *Controller) Validating() bool {
+	return c.instance.validating
+}
+
 // Context gets the context associated with the instance associated with c.
 func (c *Controller) Context() Context {
 	return c.instance.context
@@ -103,9 +130,13 @@ func NewTestController(serverType, input string) *Controller {
 	if stype, err := getServerType(serverType); err == nil {
 		ctx = stype.NewContext()
 	}
+	dispenser := caddyfile.NewDispenser("Testfile", strings.NewReader(input))
+	first := dispenser
+	first.Next()
 	return &Controller{
 		instance:           &Instance{serverType: serverType, context: ctx},
-		Dispenser:          caddyfile.NewDispenser("Testfile", strings.NewReader(input)),
+		Directive:          first.Val(),
+		Dispenser:          dispenser,
 		OncePerServerBlock: func(f func() error) error { return f() },
 	}
 }
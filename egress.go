@@ -0,0 +1,257 @@
+package caddy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Egress is how Caddy makes the HTTP requests of its own, such as
+// those to an ACME CA, to OCSP responders and the health checks of
+// upstreams. It does not apply to the requests that Caddy proxies.
+type Egress struct {
+	// Proxy is the proxy that requests go through; if it is
+	// nil, they go through the proxy of the environment, if any
+	Proxy *url.URL
+
+	// BindInterface is the name of the network interface
+	// whose addresses connections are made from
+	BindInterface string
+
+	// Resolvers are the DNS servers, as host:port, that
+	// names are looked up with instead of those of the system
+	Resolvers []string
+
+	// Timeout is how long a request may take, including
+	// reading its response; 0 means DefaultEgressTimeout
+	Timeout time.Duration
+}
+
+// DefaultEgressTimeout is how long an outbound request
+// may take if the timeout is not configured.
+const DefaultEgressTimeout = 30 * time.Second
+
+var (
+	egress          Egress
+	egressTransport = newEgressTransport(Egress{}, nil)
+	egressMu        sync.RWMutex
+)
+
+// NewHTTPClient returns a client for the outbound requests of
+// subsystem, which is named in the errors of its requests. Each
+// request is made as the last Egress given to SetEgress says,
+// so the client can be made before the configuration is loaded.
+func NewHTTPClient(subsystem string) *http.Client {
+	return &http.Client{Transport: egressRoundTripper{subsystem: subsystem}}
+}
+
+// SetEgress makes the clients of NewHTTPClient make their
+// requests as e says, from the next request on. It returns
+// an error, and changes nothing, if e is not valid.
+func SetEgress(e Egress) error {
+	if err := e.Check(); err != nil {
+		return err
+	}
+	locals, err := interfaceAddrs(e.BindInterface)
+	if err != nil {
+		return err
+	}
+	egressMu.Lock()
+	egressTransport.CloseIdleConnections()
+	egress, egressTransport = e, newEgressTransport(e, locals)
+	egressMu.Unlock()
+	return nil
+}
+
+// Check returns an error if e is not valid: if its proxy is not
+// an http, https or socks5 URL with a host, its interface does not
+// exist or has no addresses, or its timeout is negative.
+func (e Egress) Check() error {
+	if e.Proxy != nil {
+		switch e.Proxy.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("egress proxy %s: scheme must be http, https or socks5", proxyName(e.Proxy))
+		}
+		if e.Proxy.Host == "" {
+			return fmt.Errorf("egress proxy %s: no host", proxyName(e.Proxy))
+		}
+	}
+	for _, resolver := range e.Resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("egress resolver %s: %v", resolver, err)
+		}
+	}
+	if e.Timeout < 0 {
+		return fmt.Errorf("egress timeout must not be negative")
+	}
+	_, err := interfaceAddrs(e.BindInterface)
+	return err
+}
+
+// interfaceAddrs returns the addresses of the interface
+// named name that connections can be made from, or
+// nil if name is empty.
+func interfaceAddrs(name string) ([]net.IP, error) {
+	if name == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("egress interface %s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("egress interface %s: %v", name, err)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		// link-local addresses would need a zone
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("egress interface %s has no addresses", name)
+	}
+	return ips, nil
+}
+
+// newEgressTransport returns the transport of the requests
+// made as e says, from locals, the addresses of its interface.
+func newEgressTransport(e Egress, locals []net.IP) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if len(e.Resolvers) > 0 {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var conn net.Conn
+				var err error
+				for _, resolver := range e.Resolvers {
+					conn, err = dialFrom(ctx, dialer, locals, network, resolver)
+					if err == nil {
+						break
+					}
+				}
+				return conn, err
+			},
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if e.Proxy != nil {
+		proxy = http.ProxyURL(e.Proxy)
+	}
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if len(locals) == 0 {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			resolver := dialer.Resolver
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			ips, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			err = fmt.Errorf("no addresses of %s to connect from to %s", e.BindInterface, host)
+			for _, ip := range ips {
+				var conn net.Conn
+				conn, err = dialFrom(ctx, dialer, locals, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// dialFrom connects to addr, an IP address and port, from the
+// first of locals with the same IP version, or from any address
+// if locals is empty.
+func dialFrom(ctx context.Context, dialer *net.Dialer, locals []net.IP, network, addr string) (net.Conn, error) {
+	if len(locals) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	for _, local := range locals {
+		if ip == nil || (ip.To4() == nil) != (local.To4() == nil) {
+			continue
+		}
+		d := *dialer
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: local}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return nil, fmt.Errorf("no address to connect from to %s", addr)
+}
+
+// egressRoundTripper makes the requests of a subsystem with
+// the current egress transport.
+type egressRoundTripper struct {
+	subsystem string
+}
+
+// RoundTrip makes req within the egress timeout, which
+// lasts until the body of the response is closed.
+func (rt egressRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	egressMu.RLock()
+	e, transport := egress, egressTransport
+	egressMu.RUnlock()
+
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = DefaultEgressTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if e.Proxy != nil {
+			return nil, fmt.Errorf("%s request through proxy %s failed: %v", rt.subsystem, proxyName(e.Proxy), err)
+		}
+		return nil, fmt.Errorf("%s request failed: %v", rt.subsystem, err)
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody is a response body that cancels the
+// context of its request when it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// proxyName returns u without its credentials.
+func proxyName(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
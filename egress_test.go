@@ -0,0 +1,158 @@
+package caddy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("from proxy"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	if err := SetEgress(Egress{Proxy: proxyURL}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEgress(Egress{})
+
+	resp, err := NewHTTPClient("test").Get("http://example.test/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "from proxy" || len(proxied) != 1 || proxied[0] != "http://example.test/path" {
+		t.Errorf("Expected the request to go through the proxy, got body %q and proxied %v", body, proxied)
+	}
+}
+
+func TestEgressMisconfiguredProxy(t *testing.T) {
+	// a proxy that is not listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: ln.Addr().String()}
+	ln.Close()
+	if err := SetEgress(Egress{Proxy: proxyURL}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEgress(Egress{})
+
+	start := time.Now()
+	_, err = NewHTTPClient("ACME").Get("https://acme.test/directory")
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the request to fail fast, took %v", time.Since(start))
+	}
+	expected := "ACME request through proxy http://" + ln.Addr().String() + " failed"
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected the error to contain %q, got: %v", expected, err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected the error not to contain the password of the proxy, got: %v", err)
+	}
+}
+
+func TestEgressTimeout(t *testing.T) {
+	released := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-released
+	}))
+	defer slow.Close()
+	defer close(released)
+	if err := SetEgress(Egress{Timeout: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEgress(Egress{})
+
+	_, err := NewHTTPClient("OCSP").Get(slow.URL)
+	if err == nil || !strings.Contains(err.Error(), "OCSP request failed") {
+		t.Errorf("Expected the request to time out, got: %v", err)
+	}
+}
+
+func TestEgressBindInterface(t *testing.T) {
+	loopback := loopbackInterface(t)
+	var remote string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	}))
+	defer server.Close()
+	if err := SetEgress(Egress{BindInterface: loopback}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEgress(Egress{})
+
+	resp, err := NewHTTPClient("test").Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.1" {
+		t.Errorf("Expected the connection to come from 127.0.0.1, got %s", remote)
+	}
+}
+
+func TestEgressCheck(t *testing.T) {
+	loopback := loopbackInterface(t)
+	for i, test := range []struct {
+		egress    Egress
+		shouldErr bool
+	}{
+		{Egress{}, false},
+		{Egress{Proxy: &url.URL{Scheme: "http", Host: "proxy:3128"}}, false},
+		{Egress{Proxy: &url.URL{Scheme: "socks5", Host: "proxy:1080"}}, false},
+		{Egress{Proxy: &url.URL{Scheme: "ftp", Host: "proxy:21"}}, true},
+		{Egress{Proxy: &url.URL{Path: "proxy:3128"}}, true},
+		{Egress{Proxy: &url.URL{Scheme: "http"}}, true},
+		{Egress{BindInterface: loopback}, false},
+		{Egress{BindInterface: "nonexistent0"}, true},
+		{Egress{Resolvers: []string{"10.0.0.53:53"}}, false},
+		{Egress{Resolvers: []string{"10.0.0.53"}}, true},
+		{Egress{Timeout: -time.Second}, true},
+	} {
+		err := test.egress.Check()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+
+	// an egress that is not valid changes nothing
+	if err := SetEgress(Egress{BindInterface: "nonexistent0"}); err == nil {
+		t.Error("Expected an error, got none")
+	}
+	if egress.BindInterface != "" {
+		t.Errorf("Expected the egress not to change, got interface %s", egress.BindInterface)
+	}
+}
+
+// loopbackInterface returns the name of the interface
+// that has 127.0.0.1, or skips the test if there is none.
+func loopbackInterface(t *testing.T) string {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+				return iface.Name
+			}
+		}
+	}
+	t.Skip("No interface with 127.0.0.1")
+	return ""
+}
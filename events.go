@@ -0,0 +1,139 @@
+package caddy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Names of the events emitted by this package. Server types
+// and plugins may emit their own events; those names should
+// be prefixed with the name of the plugin to avoid collisions.
+const (
+	// InstanceStartupEvent is emitted when an instance has
+	// started its servers, including the new instance of a
+	// restart. Its payload is an InstanceEventInfo.
+	InstanceStartupEvent = "instancestartup"
+
+	// InstanceShutdownEvent is emitted when an instance is
+	// about to stop its servers, including the old instance
+	// of a restart. Its payload is an InstanceEventInfo.
+	InstanceShutdownEvent = "instanceshutdown"
+
+	// InstanceRestartEvent is emitted when an instance was
+	// restarted with a reloaded Caddyfile, or failed to be.
+	// Its payload is an InstanceRestartEventInfo.
+	InstanceRestartEvent = "instancerestart"
+)
+
+// InstanceEventInfo is the payload of InstanceStartupEvent
+// and InstanceShutdownEvent.
+type InstanceEventInfo struct {
+	// Instance is the instance that started or is stopping
+	Instance *Instance
+
+	// ServerType is the name of the instance's server type
+	ServerType string
+}
+
+// InstanceRestartEventInfo is the payload of InstanceRestartEvent.
+type InstanceRestartEventInfo struct {
+	// Old is the instance that was restarted
+	Old *Instance
+
+	// New is the instance that replaces Old; it is
+	// nil if the restart failed
+	New *Instance
+
+	// Caddyfile is the input the restart loaded
+	Caddyfile Input
+
+	// Err is the reason the restart failed, if it did
+	Err error
+}
+
+// EventHook is a function that is called when an event is
+// emitted. It is passed the name of the event, which allows
+// a hook to handle many kinds of events, and its payload,
+// whose type is documented with the name of the event. A hook
+// must not modify the payload. An error returned from a hook
+// is logged; it does not stop the other hooks from running.
+type EventHook func(eventName string, payload interface{}) error
+
+// EventHookTimeout is how long EmitEvent waits for a hook to
+// return before it gives up on it and calls the next one.
+var EventHookTimeout = 5 * time.Second
+
+// eventHook is a registered EventHook.
+type eventHook struct {
+	name string
+	hook EventHook
+}
+
+var (
+	// eventHooks are the registered hooks, in the order
+	// in which they were registered.
+	eventHooks   []eventHook
+	eventHooksMu sync.RWMutex
+)
+
+// RegisterEventHook plugs in hook, which is called for every
+// event that is emitted. Hooks are called in the order in which
+// they were registered. All hooks should register themselves in
+// an init() function. The name of the hook must be unique; it is
+// used to identify the hook in log messages.
+func RegisterEventHook(name string, hook EventHook) {
+	if name == "" {
+		panic("event hook must have a name")
+	}
+	eventHooksMu.Lock()
+	defer eventHooksMu.Unlock()
+	for _, h := range eventHooks {
+		if h.name == name {
+			panic("event hook named " + name + " already registered")
+		}
+	}
+	eventHooks = append(eventHooks, eventHook{name: name, hook: hook})
+}
+
+// EmitEvent calls all the registered event hooks, one after the
+// other, with the event named name and its payload. A hook that
+// panics, returns an error or takes longer than EventHookTimeout
+// is logged and then ignored, so that it cannot keep the other
+// hooks, or the process, from doing their job. EmitEvent blocks
+// until all hooks have returned or timed out.
+func EmitEvent(name string, payload interface{}) {
+	eventHooksMu.RLock()
+	hooks := make([]eventHook, len(eventHooks))
+	copy(hooks, eventHooks)
+	eventHooksMu.RUnlock()
+
+	for _, h := range hooks {
+		err := runEventHook(h.hook, name, payload)
+		if err != nil {
+			log.Printf("[ERROR] Event hook %s, event %s: %v", h.name, name, err)
+		}
+	}
+}
+
+// runEventHook calls hook with the event and returns its error. A
+// panic in hook is recovered and turned into an error, as is hook
+// not returning within EventHookTimeout.
+func runEventHook(hook EventHook, name string, payload interface{}) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- fmt.Errorf("panic: %v", rec)
+			}
+		}()
+		done <- hook(name, payload)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(EventHookTimeout):
+		return fmt.Errorf("timed out after %v", EventHookTimeout)
+	}
+}
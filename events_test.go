@@ -0,0 +1,127 @@
+package caddy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// withEventHooks runs f with no event hooks registered
+// other than the ones f registers.
+func withEventHooks(f func()) {
+	eventHooksMu.Lock()
+	oldHooks := eventHooks
+	eventHooks = nil
+	eventHooksMu.Unlock()
+	defer func() {
+		eventHooksMu.Lock()
+		eventHooks = oldHooks
+		eventHooksMu.Unlock()
+	}()
+	f()
+}
+
+func TestEmitEvent(t *testing.T) {
+	withEventHooks(func() {
+		var mu sync.Mutex
+		var calls []string
+		record := func(hookName string) EventHook {
+			return func(eventName string, payload interface{}) error {
+				mu.Lock()
+				calls = append(calls, hookName+":"+eventName+":"+payload.(string))
+				mu.Unlock()
+				return nil
+			}
+		}
+		RegisterEventHook("first", record("first"))
+		RegisterEventHook("panics", func(string, interface{}) error { panic("oops") })
+		RegisterEventHook("second", record("second"))
+
+		EmitEvent("test", "one")
+		EmitEvent("other", "two")
+
+		expected := []string{"first:test:one", "second:test:one", "first:other:two", "second:other:two"}
+		if len(calls) != len(expected) {
+			t.Fatalf("Expected calls %v, got %v", expected, calls)
+		}
+		for i := range expected {
+			if calls[i] != expected[i] {
+				t.Errorf("Call %d: Expected %s, got %s", i, expected[i], calls[i])
+			}
+		}
+	})
+}
+
+func TestEmitEventTimeout(t *testing.T) {
+	oldTimeout := EventHookTimeout
+	defer func() { EventHookTimeout = oldTimeout }()
+	EventHookTimeout = 50 * time.Millisecond
+
+	withEventHooks(func() {
+		block := make(chan struct{})
+		defer close(block)
+		var called bool
+		RegisterEventHook("blocks", func(string, interface{}) error {
+			<-block
+			return nil
+		})
+		RegisterEventHook("after", func(string, interface{}) error {
+			called = true
+			return nil
+		})
+
+		start := time.Now()
+		EmitEvent("test", nil)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected EmitEvent to give up on a blocking hook, took %v", elapsed)
+		}
+		if !called {
+			t.Error("Expected hook after the blocking one to be called")
+		}
+	})
+}
+
+func TestRegisterEventHookDuplicate(t *testing.T) {
+	withEventHooks(func() {
+		RegisterEventHook("dup", func(string, interface{}) error { return nil })
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic registering the same hook name twice")
+			}
+		}()
+		RegisterEventHook("dup", func(string, interface{}) error { return nil })
+	})
+}
+
+func TestInstanceEvents(t *testing.T) {
+	withEventHooks(func() {
+		var events []string
+		var instances []*Instance
+		RegisterEventHook("instance", func(eventName string, payload interface{}) error {
+			info, ok := payload.(InstanceEventInfo)
+			if !ok {
+				t.Errorf("Expected payload of %s to be InstanceEventInfo, got %T", eventName, payload)
+				return nil
+			}
+			events = append(events, eventName)
+			instances = append(instances, info.Instance)
+			return nil
+		})
+
+		inst, err := Start(CaddyfileInput{ServerTypeName: "upgradetest"})
+		if err != nil {
+			t.Fatalf("Expected no error starting, got: %v", err)
+		}
+		inst.Stop()
+
+		expected := []string{InstanceStartupEvent, InstanceShutdownEvent}
+		if len(events) != len(expected) || events[0] != expected[0] || events[1] != expected[1] {
+			t.Fatalf("Expected events %v, got %v", expected, events)
+		}
+		for i, got := range instances {
+			if got != inst {
+				t.Errorf("Event %d: Expected instance %p, got %p", i, inst, got)
+			}
+		}
+	})
+}
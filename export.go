@@ -0,0 +1,144 @@
+package caddy
+
+import (
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// ExportVersion is the version of the format of ConfigExport.
+// It changes whenever the format changes in a way that could
+// break its consumers.
+const ExportVersion = 1
+
+// Redacted is what secrets are replaced with in an export.
+const Redacted = "[REDACTED]"
+
+// ConfigExport describes the configuration loaded from a
+// Caddyfile in a form that is meant to be encoded as JSON.
+type ConfigExport struct {
+	// Version is the version of this format; see ExportVersion
+	Version int `json:"version"`
+
+	// ServerType is the name of the server type
+	ServerType string `json:"server_type"`
+
+	// Caddyfile is the path of the Caddyfile
+	Caddyfile string `json:"caddyfile"`
+
+	// ServerBlocks are the server blocks of the Caddyfile
+	ServerBlocks []ServerBlockExport `json:"server_blocks"`
+
+	// Servers describes the servers made from the server
+	// blocks, if the server type can describe them (see
+	// ExportingContext); its format is up to the server type
+	Servers interface{} `json:"servers,omitempty"`
+}
+
+// ServerBlockExport describes a server block.
+type ServerBlockExport struct {
+	// Addresses are the keys of the server block
+	Addresses []string `json:"addresses"`
+
+	// Directives are the lines of directives in the server
+	// block, in the order that the directives are executed
+	Directives []DirectiveExport `json:"directives"`
+}
+
+// DirectiveExport describes one line of a directive or
+// of the block that belongs to one.
+type DirectiveExport struct {
+	// Name is the first token of the line
+	Name string `json:"name"`
+
+	// Args are the other tokens of the line
+	Args []string `json:"args,omitempty"`
+
+	// Block holds the lines of the block that was
+	// opened at the end of the line, if any
+	Block []DirectiveExport `json:"block,omitempty"`
+}
+
+// Export loads cdyfile and sets it up like Validate, then
+// describes the resulting configuration, with secrets redacted.
+// It returns the errors found, if any, instead of an export.
+func Export(cdyfile Input) (*ConfigExport, []error) {
+	inst, sblocks, errs := validate(cdyfile)
+	if inst != nil {
+		defer inst.ShutdownCallbacks()
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	export := &ConfigExport{
+		Version:      ExportVersion,
+		ServerType:   inst.serverType,
+		Caddyfile:    inst.caddyfileInput.Path(),
+		ServerBlocks: []ServerBlockExport{},
+	}
+	directives := ValidDirectives(inst.serverType)
+	for _, sb := range sblocks {
+		export.ServerBlocks = append(export.ServerBlocks, exportServerBlock(inst.serverType, directives, sb))
+	}
+	if ectx, ok := inst.context.(ExportingContext); ok {
+		export.Servers = ectx.ExportServers()
+	}
+	return export, nil
+}
+
+// exportServerBlock describes sb, whose directives are executed
+// in the order of directives, and redacts the secrets in it.
+func exportServerBlock(serverType string, directives []string, sb caddyfile.ServerBlock) ServerBlockExport {
+	export := ServerBlockExport{Addresses: sb.Keys, Directives: []DirectiveExport{}}
+	for _, dir := range directives {
+		tokens, ok := sb.Tokens[dir]
+		if !ok {
+			continue
+		}
+		lines := exportTokens(tokens)
+		if plugin, ok := directivePlugin(serverType, dir); ok && plugin.Redact != nil {
+			for i := range lines {
+				plugin.Redact(&lines[i])
+			}
+		}
+		export.Directives = append(export.Directives, lines...)
+	}
+	return export
+}
+
+// exportTokens describes tokens, which belong to one directive,
+// line by line. The tokens of a block become the Block of the
+// line that opened it.
+func exportTokens(tokens []caddyfile.Token) []DirectiveExport {
+	var lines []DirectiveExport
+	for i := 0; i < len(tokens); {
+		line := DirectiveExport{Name: tokens[i].Text}
+		i++
+		for i < len(tokens) && sameLine(tokens[i-1], tokens[i]) {
+			line.Args = append(line.Args, tokens[i].Text)
+			i++
+		}
+		if n := len(line.Args); n > 0 && tokens[i-1].IsBrace("{") {
+			line.Args = line.Args[:n-1]
+			start, nesting := i, 1
+			for ; i < len(tokens); i++ {
+				if tokens[i].IsBrace("{") {
+					nesting++
+				} else if tokens[i].IsBrace("}") {
+					nesting--
+					if nesting == 0 {
+						break
+					}
+				}
+			}
+			line.Block = exportTokens(tokens[start:i])
+			i++ // skip the closing brace
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// sameLine returns true if b is on the same line as a.
+func sameLine(a, b caddyfile.Token) bool {
+	return a.File == b.File && a.Line == b.Line
+}
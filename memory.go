@@ -0,0 +1,283 @@
+package caddy
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryPressureEvent is emitted when the memory in use goes above
+// the soft limit, and again when it is back below it. Its payload
+// is a MemoryPressureInfo.
+const MemoryPressureEvent = "memorypressure"
+
+// MemoryPressureInfo is the payload of MemoryPressureEvent.
+type MemoryPressureInfo struct {
+	// Pressured is true if the memory in use went above
+	// the soft limit, and false if it is back below it
+	Pressured bool
+
+	// InUse is the memory in use, in bytes
+	InUse uint64
+
+	// SoftLimit is the soft limit, in bytes
+	SoftLimit uint64
+
+	// Actions are the names of the actions that were
+	// taken, or that were reversed, in order
+	Actions []string
+}
+
+// MemoryAction is what a plugin does to use less memory
+// while the memory in use is above the soft limit.
+type MemoryAction struct {
+	// Shed is called on each check while the memory in
+	// use is above the soft limit, so it may be called
+	// several times before Resume
+	Shed func()
+
+	// Resume is called once the memory in use is back
+	// below the soft limit, to undo what Shed did; it
+	// may be nil
+	Resume func()
+}
+
+// MemoryLimit configures the resource governor, which checks
+// the memory in use against a soft limit and takes the memory
+// actions while the soft limit is exceeded.
+type MemoryLimit struct {
+	// SoftLimit is the memory in use, in bytes, above which
+	// the actions are taken; 0 means there is no limit
+	SoftLimit uint64
+
+	// Interval is how often the memory in use is checked;
+	// 0 means DefaultMemoryCheckInterval
+	Interval time.Duration
+
+	// Disabled are the names of the actions not to take
+	Disabled []string
+}
+
+// DefaultMemoryCheckInterval is how often the memory
+// in use is checked if the interval is not configured.
+const DefaultMemoryCheckInterval = 10 * time.Second
+
+// memoryResumeRatio is how far below the soft limit the
+// memory in use must be for the actions to be reversed, so
+// that they are not taken and reversed again on every check.
+const memoryResumeRatio = 0.9
+
+// memoryActionState is the state of a registered action.
+type memoryActionState struct {
+	MemoryAction
+	disabled bool
+	active   bool
+	shed     int // how often it was taken
+	resumed  int // how often it was reversed
+}
+
+var (
+	memoryActions   = make(map[string]*memoryActionState)
+	memoryLimit     MemoryLimit
+	memoryInUse     uint64 // as of the last check
+	memoryPressured bool
+	memoryStop      chan struct{}
+	memoryMu        sync.Mutex
+)
+
+// readMemStats reads the memory statistics of the
+// runtime; it is a variable so tests can replace it.
+var readMemStats = runtime.ReadMemStats
+
+func init() {
+	expvar.Publish("memory", expvar.Func(memoryVar))
+}
+
+// RegisterMemoryAction plugs in action, which is taken while
+// the memory in use is above the soft limit unless it is
+// disabled by name. Actions should register in an init()
+// function; they are taken in the order of their names.
+func RegisterMemoryAction(name string, action MemoryAction) {
+	if name == "" || action.Shed == nil {
+		panic("memory action must have a name and a Shed function")
+	}
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	if _, ok := memoryActions[name]; ok {
+		panic("memory action named " + name + " already registered")
+	}
+	memoryActions[name] = &memoryActionState{MemoryAction: action}
+}
+
+// CheckMemoryLimit returns an error if l disables
+// an action that is not registered.
+func CheckMemoryLimit(l MemoryLimit) error {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	for _, name := range l.Disabled {
+		if _, ok := memoryActions[name]; !ok {
+			return fmt.Errorf("unknown memory action '%s'", name)
+		}
+	}
+	return nil
+}
+
+// SetMemoryLimit replaces the configuration of the resource
+// governor with l. The actions that were taken are reversed
+// first, and the governor is stopped if l has no soft limit.
+func SetMemoryLimit(l MemoryLimit) error {
+	if err := CheckMemoryLimit(l); err != nil {
+		return err
+	}
+	memoryMu.Lock()
+	if memoryStop != nil {
+		close(memoryStop)
+		memoryStop = nil
+	}
+	resumed := resumeMemoryActions()
+	wasPressured := memoryPressured
+	memoryPressured = false
+	memoryLimit = l
+	for name, state := range memoryActions {
+		state.disabled = false
+		for _, disabled := range l.Disabled {
+			state.disabled = state.disabled || disabled == name
+		}
+	}
+	if l.SoftLimit > 0 {
+		interval := l.Interval
+		if interval <= 0 {
+			interval = DefaultMemoryCheckInterval
+		}
+		memoryStop = make(chan struct{})
+		go governMemory(interval, memoryStop)
+	}
+	inUse := memoryInUse
+	memoryMu.Unlock()
+
+	if wasPressured {
+		EmitEvent(MemoryPressureEvent, MemoryPressureInfo{InUse: inUse, SoftLimit: l.SoftLimit, Actions: resumed})
+	}
+	return nil
+}
+
+// governMemory checks the memory in use every interval
+// until stop is closed.
+func governMemory(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			checkMemory()
+		}
+	}
+}
+
+// checkMemory reads the memory in use and, if it is above the
+// soft limit, takes the actions that are enabled; if it is back
+// below, it reverses them. The event is emitted when the memory
+// in use crosses the limit, either way.
+func checkMemory() {
+	var stats runtime.MemStats
+	readMemStats(&stats)
+	// what the process holds from the system, as
+	// the system sees it, not what is allocated
+	inUse := stats.Sys - stats.HeapReleased
+
+	memoryMu.Lock()
+	memoryInUse = inUse
+	limit := memoryLimit.SoftLimit
+	if limit == 0 {
+		memoryMu.Unlock()
+		return
+	}
+	var info *MemoryPressureInfo
+	switch {
+	case inUse > limit:
+		var taken []string
+		for _, name := range memoryActionNames() {
+			state := memoryActions[name]
+			if state.disabled {
+				continue
+			}
+			state.Shed()
+			state.shed++
+			state.active = true
+			taken = append(taken, name)
+		}
+		if !memoryPressured {
+			memoryPressured = true
+			info = &MemoryPressureInfo{Pressured: true, InUse: inUse, SoftLimit: limit, Actions: taken}
+			log.Printf("[WARNING] Memory in use (%d bytes) is above the soft limit (%d bytes); taking actions: %v",
+				inUse, limit, taken)
+		}
+	case memoryPressured && float64(inUse) < float64(limit)*memoryResumeRatio:
+		memoryPressured = false
+		info = &MemoryPressureInfo{InUse: inUse, SoftLimit: limit, Actions: resumeMemoryActions()}
+		log.Printf("[INFO] Memory in use (%d bytes) is below the soft limit (%d bytes) again; reversed actions: %v",
+			inUse, limit, info.Actions)
+	}
+	memoryMu.Unlock()
+
+	if info != nil {
+		EmitEvent(MemoryPressureEvent, *info)
+	}
+}
+
+// resumeMemoryActions reverses the actions that were taken
+// and returns their names. The lock memoryMu must be held.
+func resumeMemoryActions() []string {
+	var resumed []string
+	for _, name := range memoryActionNames() {
+		state := memoryActions[name]
+		if !state.active {
+			continue
+		}
+		if state.Resume != nil {
+			state.Resume()
+		}
+		state.active = false
+		state.resumed++
+		resumed = append(resumed, name)
+	}
+	return resumed
+}
+
+// memoryActionNames returns the names of the registered
+// actions, sorted. The lock memoryMu must be held.
+func memoryActionNames() []string {
+	names := make([]string, 0, len(memoryActions))
+	for name := range memoryActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memoryVar is the expvar of the resource governor.
+func memoryVar() interface{} {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	actions := make(map[string]interface{})
+	for name, state := range memoryActions {
+		actions[name] = map[string]interface{}{
+			"enabled": !state.disabled,
+			"active":  state.active,
+			"shed":    state.shed,
+			"resumed": state.resumed,
+		}
+	}
+	return map[string]interface{}{
+		"soft_limit": memoryLimit.SoftLimit,
+		"in_use":     memoryInUse,
+		"pressured":  memoryPressured,
+		"actions":    actions,
+	}
+}
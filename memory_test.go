@@ -0,0 +1,126 @@
+package caddy
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemory makes the memory in use appear to be what
+// *inUse is, until restore is called.
+func fakeMemory(inUse *uint64) (restore func()) {
+	original := readMemStats
+	readMemStats = func(stats *runtime.MemStats) {
+		*stats = runtime.MemStats{Sys: *inUse + 100, HeapReleased: 100}
+	}
+	return func() { readMemStats = original }
+}
+
+var (
+	// how often each test memory action was taken and reversed
+	shed, resumed             map[string]int
+	registerTestMemoryActions sync.Once
+)
+
+func TestMemoryGovernor(t *testing.T) {
+	shed, resumed = make(map[string]int), make(map[string]int)
+	registerTestMemoryActions.Do(func() {
+		for _, name := range []string{"test_cache", "test_issuance"} {
+			name := name
+			RegisterMemoryAction(name, MemoryAction{
+				Shed:   func() { shed[name]++ },
+				Resume: func() { resumed[name]++ },
+			})
+		}
+	})
+	for _, state := range memoryActions {
+		state.shed, state.resumed = 0, 0
+	}
+	var events []MemoryPressureInfo
+	RegisterEventHook("test_memory_governor", func(eventName string, payload interface{}) error {
+		if eventName == MemoryPressureEvent {
+			events = append(events, payload.(MemoryPressureInfo))
+		}
+		return nil
+	})
+	defer func() {
+		eventHooksMu.Lock()
+		eventHooks = eventHooks[:len(eventHooks)-1]
+		eventHooksMu.Unlock()
+	}()
+
+	var inUse uint64 = 500
+	defer fakeMemory(&inUse)()
+	if err := SetMemoryLimit(MemoryLimit{SoftLimit: 1000, Interval: time.Hour, Disabled: []string{"test_issuance"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMemoryLimit(MemoryLimit{})
+
+	checkMemory()
+	if len(shed) != 0 || len(events) != 0 {
+		t.Fatalf("Expected no actions below the soft limit, got %v and events %v", shed, events)
+	}
+
+	// above the soft limit, the enabled actions are
+	// taken on each check, and the event is emitted once
+	inUse = 1500
+	checkMemory()
+	checkMemory()
+	if shed["test_cache"] != 2 || shed["test_issuance"] != 0 {
+		t.Errorf("Expected only the enabled action to be taken on each check, got %v", shed)
+	}
+	if len(events) != 1 || !events[0].Pressured || events[0].InUse != 1500 || events[0].SoftLimit != 1000 ||
+		strings.Join(events[0].Actions, ",") != "test_cache" {
+		t.Errorf("Expected an event for the pressure, got %+v", events)
+	}
+	vars := memoryVar().(map[string]interface{})
+	action := vars["actions"].(map[string]interface{})["test_cache"].(map[string]interface{})
+	if vars["pressured"] != true || vars["in_use"] != uint64(1500) || action["active"] != true || action["shed"] != 2 {
+		t.Errorf("Expected the expvar to show the pressure and the action, got %v", vars)
+	}
+	disabled := vars["actions"].(map[string]interface{})["test_issuance"].(map[string]interface{})
+	if disabled["enabled"] != false || disabled["active"] != false {
+		t.Errorf("Expected the expvar to show the disabled action, got %v", disabled)
+	}
+
+	// just below the soft limit is not enough to reverse them
+	inUse = 950
+	checkMemory()
+	if len(resumed) != 0 || len(events) != 1 {
+		t.Errorf("Expected no action to be reversed just below the soft limit, got %v", resumed)
+	}
+
+	inUse = 500
+	checkMemory()
+	if resumed["test_cache"] != 1 || resumed["test_issuance"] != 0 {
+		t.Errorf("Expected the action that was taken to be reversed, got %v", resumed)
+	}
+	if len(events) != 2 || events[1].Pressured || strings.Join(events[1].Actions, ",") != "test_cache" {
+		t.Errorf("Expected an event for the pressure clearing, got %+v", events)
+	}
+	vars = memoryVar().(map[string]interface{})
+	action = vars["actions"].(map[string]interface{})["test_cache"].(map[string]interface{})
+	if vars["pressured"] != false || action["active"] != false || action["resumed"] != 1 {
+		t.Errorf("Expected the expvar to show the pressure cleared, got %v", vars)
+	}
+
+	// a new configuration reverses the actions that were taken
+	inUse = 1500
+	checkMemory()
+	if err := SetMemoryLimit(MemoryLimit{}); err != nil {
+		t.Fatal(err)
+	}
+	if resumed["test_cache"] != 2 {
+		t.Errorf("Expected the action to be reversed by the new configuration, got %v", resumed)
+	}
+	checkMemory()
+	if shed["test_cache"] != 3 {
+		t.Errorf("Expected no actions without a soft limit, got %v", shed)
+	}
+
+	if err := SetMemoryLimit(MemoryLimit{SoftLimit: 1000, Disabled: []string{"nonexistent"}}); err == nil {
+		t.Error("Expected an error for an unknown action, got none")
+	}
+}
@@ -79,7 +79,7 @@ func ValidDirectives(serverType string) []string {
 	if err != nil {
 		return nil
 	}
-	return stype.Directives
+	return stype.directives()
 }
 
 // serverListener pairs a server to its listener and/or packetconn.
@@ -116,6 +116,49 @@ type Context interface {
 	MakeServers() ([]Server, error)
 }
 
+// ValidatingContext is a Context that needs to know when
+// it is only being used to validate a Caddyfile, so that
+// it can skip side effects of its own (in parsing callbacks,
+// for example), like obtaining certificates.
+type ValidatingContext interface {
+	Context
+
+	// SetValidating is called right after the Context is
+	// created if none of the servers will be started.
+	SetValidating()
+}
+
+// ExportingContext is a Context that can describe the servers
+// it made, for Export.
+type ExportingContext interface {
+	Context
+
+	// ExportServers returns a description of the servers,
+	// after MakeServers, that can be encoded as JSON.
+	ExportServers() interface{}
+}
+
+// DirectiveContext is a Context that needs to know which
+// directive is being set up, so that it can attribute what the
+// setup function does, like the middleware it adds, to it.
+type DirectiveContext interface {
+	Context
+
+	// SetDirective is called with the key of a server block
+	// and a directive right before the setup function of the
+	// directive runs for the key, and with the key and an
+	// empty directive right after.
+	SetDirective(key, directive string)
+}
+
+// directives returns the directives of the server type.
+func (stype ServerType) directives() []string {
+	if stype.OrderedDirectives != nil {
+		return stype.OrderedDirectives()
+	}
+	return stype.Directives
+}
+
 // RegisterServerType registers a server type srv by its
 // name, typeName.
 func RegisterServerType(typeName string, srv ServerType) {
@@ -132,6 +175,12 @@ type ServerType struct {
 	// one word if possible and lower-cased.
 	Directives []string
 
+	// OrderedDirectives returns the list of directives in
+	// place of Directives, if it is set, for a server type
+	// whose plugins can put their directives in the list
+	// after it is registered. This is optional.
+	OrderedDirectives func() []string
+
 	// DefaultInput returns a default config input if none
 	// is otherwise loaded. This is optional, but highly
 	// recommended, otherwise a blank Caddyfile will be
@@ -157,6 +206,10 @@ type Plugin struct {
 	// Action is the plugin's setup function, if associated
 	// with a directive in the Caddyfile.
 	Action SetupFunc
+
+	// Redact, if set, replaces the secrets in an exported
+	// occurrence of the plugin's directive with Redacted.
+	Redact func(d *DirectiveExport)
 }
 
 // RegisterPlugin plugs in plugin. All plugins should register
@@ -203,18 +256,27 @@ type SetupFunc func(c *Controller) error
 // DirectiveAction gets the action for directive dir of
 // server type serverType.
 func DirectiveAction(serverType, dir string) (SetupFunc, error) {
+	if plugin, ok := directivePlugin(serverType, dir); ok {
+		return plugin.Action, nil
+	}
+	return nil, fmt.Errorf("no action found for directive '%s' with server type '%s' (missing a plugin?)",
+		dir, serverType)
+}
+
+// directivePlugin gets the plugin for directive dir of
+// server type serverType.
+func directivePlugin(serverType, dir string) (Plugin, bool) {
 	if stypePlugins, ok := plugins[serverType]; ok {
 		if plugin, ok := stypePlugins[dir]; ok {
-			return plugin.Action, nil
+			return plugin, true
 		}
 	}
 	if genericPlugins, ok := plugins[""]; ok {
 		if plugin, ok := genericPlugins[dir]; ok {
-			return plugin.Action, nil
+			return plugin, true
 		}
 	}
-	return nil, fmt.Errorf("no action found for directive '%s' with server type '%s' (missing a plugin?)",
-		dir, serverType)
+	return Plugin{}, false
 }
 
 // Loader is a type that can load a Caddyfile.
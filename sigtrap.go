@@ -17,7 +17,7 @@ func TrapSignals() {
 	trapSignalsPosix()
 }
 
-// trapSignalsCrossPlatform captures SIGINT, which triggers forceful
+// trapSignalsCrossPlatform captures SIGINT, which triggers graceful
 // shutdown that executes shutdown callbacks first. A second interrupt
 // signal will exit the process immediately.
 func trapSignalsCrossPlatform() {
@@ -38,15 +38,62 @@ func trapSignalsCrossPlatform() {
 
 			log.Println("[INFO] SIGINT: Shutting down")
 
-			if PidFile != "" {
-				os.Remove(PidFile)
-			}
-
-			go os.Exit(executeShutdownCallbacks("SIGINT"))
+			go func() { os.Exit(gracefulShutdown("SIGINT")) }()
 		}
 	}()
 }
 
+// exitCodeConnsCut is the exit status of a graceful shutdown
+// that had to close connections forcibly because they were
+// still open at the end of the grace period.
+const exitCodeConnsCut = 3
+
+// gracefulShutdown executes the shutdown callbacks as initiated
+// by signame, then stops all servers, waiting up to their grace
+// period for connections to finish, executes the callbacks for
+// after the servers stopped, and removes the pidfile. It
+// returns the exit status for the process: 0 if everything went
+// well, 1 if there were errors and exitCodeConnsCut if servers
+// had to close connections forcibly.
+func gracefulShutdown(signame string) int {
+	gracefulShutdownMu.Lock()
+	defer gracefulShutdownMu.Unlock()
+
+	exitCode := executeShutdownCallbacks(signame)
+
+	// Stop forgets the instances, so get their callbacks first
+	var stopped []func() error
+	instancesMu.Lock()
+	for _, inst := range instances {
+		stopped = append(stopped, inst.onFinalStop...)
+	}
+	instancesMu.Unlock()
+
+	err := Stop()
+	if err == ErrConnsCut {
+		if exitCode == 0 {
+			exitCode = exitCodeConnsCut
+		}
+	} else if err != nil {
+		log.Printf("[ERROR] %s stop: %v", signame, err)
+		exitCode = 1
+	}
+	for _, fn := range stopped {
+		if err := fn(); err != nil {
+			log.Printf("[ERROR] %s after stop: %v", signame, err)
+			exitCode = 1
+		}
+	}
+	if PidFile != "" {
+		os.Remove(PidFile)
+	}
+	return exitCode
+}
+
+// gracefulShutdownMu keeps servers from being stopped
+// by more than one signal at the same time.
+var gracefulShutdownMu sync.Mutex
+
 // executeShutdownCallbacks executes the shutdown callbacks as initiated
 // by signame. It logs any errors and returns the recommended exit status.
 // This function is idempotent; subsequent invocations always return 0.
@@ -13,29 +13,17 @@ import (
 func trapSignalsPosix() {
 	go func() {
 		sigchan := make(chan os.Signal, 1)
-		signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1)
+		signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
 
 		for sig := range sigchan {
 			switch sig {
 			case syscall.SIGTERM:
 				log.Println("[INFO] SIGTERM: Terminating process")
-				if PidFile != "" {
-					os.Remove(PidFile)
-				}
-				os.Exit(0)
+				os.Exit(gracefulShutdown("SIGTERM"))
 
 			case syscall.SIGQUIT:
 				log.Println("[INFO] SIGQUIT: Shutting down")
-				exitCode := executeShutdownCallbacks("SIGQUIT")
-				err := Stop()
-				if err != nil {
-					log.Printf("[ERROR] SIGQUIT stop: %v", err)
-					exitCode = 1
-				}
-				if PidFile != "" {
-					os.Remove(PidFile)
-				}
-				os.Exit(exitCode)
+				os.Exit(gracefulShutdown("SIGQUIT"))
 
 			case syscall.SIGHUP:
 				log.Println("[INFO] SIGHUP: Hanging up")
@@ -78,6 +66,15 @@ func trapSignalsPosix() {
 				if err != nil {
 					log.Printf("[ERROR] SIGUSR1: %v", err)
 				}
+
+			case syscall.SIGUSR2:
+				log.Println("[INFO] SIGUSR2: Upgrading")
+				err := Upgrade()
+				if err != nil {
+					log.Printf("[ERROR] SIGUSR2: upgrade failed: %v", err)
+					continue
+				}
+				os.Exit(0)
 			}
 		}
 	}()
@@ -0,0 +1,19 @@
+// +build !windows
+
+package startupshutdown
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start a process group of its
+// own, so that it can be killed with what it started.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group of cmd.
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
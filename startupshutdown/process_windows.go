@@ -0,0 +1,12 @@
+package startupshutdown
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process of cmd; on Windows, the
+// processes it started are left running.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -1,9 +1,14 @@
 package startupshutdown
 
 import (
+	"bytes"
+	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mholt/caddy"
 )
@@ -19,52 +24,250 @@ func Startup(c *caddy.Controller) error {
 }
 
 // Shutdown registers a shutdown callback to execute during server stop.
+// Shutdown hooks run before the servers stop, or after them if they
+// say "when after".
 func Shutdown(c *caddy.Controller) error {
-	return registerCallback(c, c.OnFinalShutdown)
+	return registerHooks(c, c.OnFinalShutdown, c.OnFinalStop)
 }
 
 // registerCallback registers a callback function to execute by
 // using c to parse the directive. It registers the callback
 // to be executed using registerFunc.
 func registerCallback(c *caddy.Controller, registerFunc func(func() error)) error {
-	var funcs []func() error
+	return registerHooks(c, registerFunc, nil)
+}
+
+// registerHooks parses the hooks of the directive with c and
+// registers them using registerFunc, in the order in which they
+// appear, or using afterFunc if they say "when after". If
+// afterFunc is nil, hooks cannot say when to run.
+func registerHooks(c *caddy.Controller, registerFunc, afterFunc func(func() error)) error {
+	var funcs, afterFuncs []func() error
 
 	for c.Next() {
-		args := c.RemainingArgs()
-		if len(args) == 0 {
-			return c.ArgErr()
+		h, err := parseHook(c, afterFunc != nil)
+		if err != nil {
+			return err
 		}
+		if h.after {
+			afterFuncs = append(afterFuncs, h.run)
+		} else {
+			funcs = append(funcs, h.run)
+		}
+	}
+
+	return c.OncePerServerBlock(func() error {
+		for _, fn := range funcs {
+			registerFunc(fn)
+		}
+		for _, fn := range afterFuncs {
+			afterFunc(fn)
+		}
+		return nil
+	})
+}
 
-		nonblock := false
+// hook is a command that runs when the server starts or stops.
+type hook struct {
+	directive string
+	command   string
+	args      []string
+
+	// nonblock runs the command in the background
+	nonblock bool
+
+	// block hooks capture the output of the command into
+	// the log, and only fail the startup or shutdown if
+	// mustSucceed is true
+	block       bool
+	dir         string
+	env         []string
+	timeout     time.Duration
+	mustSucceed bool
+	after       bool
+}
+
+// parseHook parses one hook, which is either a command on the
+// line of the directive, optionally followed by & to run it in
+// the background, or a block:
+//
+//	startup {
+//	    command command [args...]
+//	    dir     directory
+//	    env     NAME=value...
+//	    timeout duration
+//	    must_succeed
+//	    when    before|after
+//	}
+//
+// where when, which is only allowed if canBeAfter is true, says
+// whether a shutdown hook runs before or after the servers stop.
+func parseHook(c *caddy.Controller, canBeAfter bool) (*hook, error) {
+	h := &hook{directive: c.Val()}
+	args := c.RemainingArgs()
+
+	if len(args) > 0 {
 		if len(args) > 1 && args[len(args)-1] == "&" {
 			// Run command in background; non-blocking
-			nonblock = true
+			h.nonblock = true
 			args = args[:len(args)-1]
 		}
-
-		command, args, err := caddy.SplitCommandAndArgs(strings.Join(args, " "))
+		var err error
+		h.command, h.args, err = caddy.SplitCommandAndArgs(strings.Join(args, " "))
 		if err != nil {
-			return c.Err(err.Error())
+			return nil, c.Err(err.Error())
 		}
+		return h, nil
+	}
 
-		fn := func() error {
-			cmd := exec.Command(command, args...)
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if nonblock {
-				return cmd.Start()
+	h.block = true
+	for c.NextBlock() {
+		what := c.Val()
+		args := c.RemainingArgs()
+		switch what {
+		case "command":
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			var err error
+			h.command, h.args, err = caddy.SplitCommandAndArgs(strings.Join(args, " "))
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+		case "dir":
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			h.dir = args[0]
+		case "env":
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, env := range args {
+				if strings.Index(env, "=") < 1 {
+					return nil, c.Errf("environment variable must be NAME=value, got '%s'", env)
+				}
+			}
+			h.env = append(h.env, args...)
+		case "timeout":
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			var err error
+			h.timeout, err = time.ParseDuration(args[0])
+			if err != nil || h.timeout <= 0 {
+				return nil, c.Errf("invalid timeout '%s'", args[0])
 			}
-			return cmd.Run()
+		case "must_succeed":
+			if len(args) != 0 {
+				return nil, c.ArgErr()
+			}
+			h.mustSucceed = true
+		case "when":
+			if !canBeAfter {
+				return nil, c.Errf("%s hooks cannot say when to run", h.directive)
+			}
+			if len(args) != 1 || (args[0] != "before" && args[0] != "after") {
+				return nil, c.Err("when must be 'before' or 'after'")
+			}
+			h.after = args[0] == "after"
+		default:
+			return nil, c.Errf("unknown %s property '%s'", h.directive, what)
 		}
+	}
+	if h.command == "" {
+		return nil, c.Errf("%s needs a command", h.directive)
+	}
+	return h, nil
+}
 
-		funcs = append(funcs, fn)
+// run runs the command of h. The commands of block hooks that
+// fail are logged rather than returned, unless h must succeed.
+func (h *hook) run() error {
+	cmd := exec.Command(h.command, h.args...)
+	if !h.block {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if h.nonblock {
+			return cmd.Start()
+		}
+		return cmd.Run()
 	}
 
-	return c.OncePerServerBlock(func() error {
-		for _, fn := range funcs {
-			registerFunc(fn)
+	out := &logWriter{prefix: fmt.Sprintf("[INFO] %s %s: ", h.directive, h.command)}
+	defer out.flush()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Dir = h.dir
+	if len(h.env) > 0 {
+		cmd.Env = append(os.Environ(), h.env...)
+	}
+	setProcessGroup(cmd)
+
+	err := h.wait(cmd)
+	if err != nil {
+		err = fmt.Errorf("%s command %s: %v", h.directive, h.command, err)
+		if !h.mustSucceed {
+			log.Printf("[ERROR] %v", err)
+			return nil
 		}
-		return nil
-	})
+	}
+	return err
+}
+
+// wait starts cmd and waits for it to finish, killing it
+// and the processes it started once h.timeout has passed.
+func (h *hook) wait(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	if h.timeout == 0 {
+		return <-done
+	}
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Errorf("killed after timeout of %v", h.timeout)
+	}
+}
+
+// logWriter writes each line written to it to the log,
+// with prefix in front.
+type logWriter struct {
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Print(w.prefix + string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs what is left of an unfinished line.
+func (w *logWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		log.Print(w.prefix + string(w.buf))
+		w.buf = nil
+	}
 }
@@ -1,9 +1,14 @@
 package startupshutdown
 
 import (
+	"bytes"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -64,3 +69,136 @@ func TestStartup(t *testing.T) {
 		}
 	}
 }
+
+// writeScript writes a shell script with body to dir and
+// returns its path.
+func writeScript(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parseTestHooks parses input and returns the hooks that
+// run before and after, in the order they were registered.
+func parseTestHooks(t *testing.T, input string) (before, after []func() error) {
+	c := caddy.NewTestController("", input)
+	err := registerHooks(c, func(fn func() error) { before = append(before, fn) },
+		func(fn func() error) { after = append(after, fn) })
+	if err != nil {
+		t.Fatalf("Expected no error parsing %s, got: %v", input, err)
+	}
+	return before, after
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper scripts need a POSIX shell")
+	}
+	dir, err := ioutil.TempDir("", "caddy_startupshutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	env := writeScript(t, dir, "env.sh", `echo "$FOO $BAR $(pwd)" >> `+out+`; echo "hello from $1"`)
+	fail := writeScript(t, dir, "fail.sh", `echo "going down" >&2; exit 3`)
+	hang := writeScript(t, dir, "hang.sh", `sleep 30 & sleep 30`)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// environment, working directory and captured output;
+	// hooks run in the order they are declared
+	before, after := parseTestHooks(t, `shutdown {
+		command `+env+` first
+		dir `+dir+`
+		env FOO=foo BAR=bar
+	}
+	shutdown {
+		command `+env+` second
+		env FOO=again
+		when after
+	}
+	shutdown {
+		command `+env+` third
+		when before
+	}`)
+	if len(before) != 2 || len(after) != 1 {
+		t.Fatalf("Expected 2 hooks before and 1 after, got %d and %d", len(before), len(after))
+	}
+	for _, fn := range append(before, after...) {
+		if err := fn(); err != nil {
+			t.Errorf("Expected no error, got: %v", err)
+		}
+	}
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	resolved, _ := filepath.EvalSymlinks(dir)
+	if expected := "foo bar " + resolved + "\n  " + cwd + "\nagain  " + cwd + "\n"; string(contents) != expected &&
+		string(contents) != strings.Replace(expected, resolved, dir, 1) {
+		t.Errorf("Expected the hooks to run in order with their environment:\n%s\ngot:\n%s", expected, contents)
+	}
+	if !strings.Contains(logged.String(), "[INFO] shutdown "+env+": hello from first\n") {
+		t.Errorf("Expected output in the log with a prefix, got:\n%s", logged.String())
+	}
+
+	// a failing hook is logged, unless it must succeed
+	before, _ = parseTestHooks(t, "startup {\ncommand "+fail+"\n}\nstartup {\ncommand "+fail+"\nmust_succeed\n}")
+	if err := before[0](); err != nil {
+		t.Errorf("Expected failure of hook that need not succeed to be logged, got: %v", err)
+	}
+	if !strings.Contains(logged.String(), "going down") || !strings.Contains(logged.String(), "exit status 3") {
+		t.Errorf("Expected output and failure in the log, got:\n%s", logged.String())
+	}
+	if err := before[1](); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected failure of hook that must succeed, got: %v", err)
+	}
+
+	// a hook that hangs is killed, with what it started
+	before, _ = parseTestHooks(t, "startup {\ncommand "+hang+"\ntimeout 200ms\nmust_succeed\n}")
+	start := time.Now()
+	err = before[0]()
+	if err == nil || !strings.Contains(err.Error(), "killed after timeout of 200ms") {
+		t.Errorf("Expected hook to be killed, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected hook and its children to be killed after the timeout, took %v", elapsed)
+	}
+}
+
+func TestParseHook(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"shutdown {\ncommand echo hi\ndir /tmp\nenv A=1 B=\ntimeout 1s\nmust_succeed\nwhen after\n}", false},
+		{"startup echo hi &", false},
+		{"startup", true},
+		{"startup {\ndir /tmp\n}", true},
+		{"startup {\ncommand\n}", true},
+		{"startup {\ncommand echo\ndir\n}", true},
+		{"startup {\ncommand echo\nenv A\n}", true},
+		{"startup {\ncommand echo\nenv =1\n}", true},
+		{"startup {\ncommand echo\ntimeout soon\n}", true},
+		{"startup {\ncommand echo\ntimeout -1s\n}", true},
+		{"startup {\ncommand echo\nmust_succeed yes\n}", true},
+		{"startup {\ncommand echo\nwhen after\n}", true},
+		{"shutdown {\ncommand echo\nwhen later\n}", true},
+		{"startup {\ncommand echo\nunknown 1\n}", true},
+	} {
+		c := caddy.NewTestController("", test.input)
+		c.Next()
+		_, err := parseHook(c, c.Val() == "shutdown")
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, got none", i)
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package caddy
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+func init() {
+	isUpgrade = os.Getenv(upgradeEnvVar) != ""
+	// children of this process decide for themselves
+	os.Unsetenv(upgradeEnvVar)
+}
+
+// upgradeEnvVar is set in the environment of the process
+// started by Upgrade, which makes IsUpgrade return true.
+const upgradeEnvVar = "CADDY__UPGRADE"
+
+// The file descriptors that the process started by Upgrade
+// inherits. Listeners and packet conns follow, starting at
+// firstInheritedFd, in the order given by the handoff.
+const (
+	upgradeReadyFd   = 3 // write "success" here once serving
+	upgradeHandoffFd = 4 // read the gob-encoded handoff here
+	firstInheritedFd = 5
+)
+
+// upgradeSuccess is what the new process writes to
+// its parent once its servers are running.
+const upgradeSuccess = "success"
+
+// upgradeReadyTimeout is how long the new process has to
+// start its servers before it is killed and the upgrade fails.
+var upgradeReadyTimeout = 2 * time.Minute
+
+// upgradeHandoff is the state of the process that is handed
+// to the new process during an upgrade.
+type upgradeHandoff struct {
+	// Caddyfile is the configuration being served
+	Caddyfile CaddyfileInput
+
+	// Listeners and Packets map the address of each
+	// server to its inherited file descriptor
+	Listeners map[string]uintptr
+	Packets   map[string]uintptr
+
+	// Extras maps the address of each listener made by
+	// ListenExtra to its inherited file descriptor
+	Extras map[string]uintptr
+
+	// PidFile is the pidfile that the new process takes over
+	PidFile string
+
+	// State holds the data saved by the UpgradeState
+	// functions, keyed by name
+	State map[string][]byte
+}
+
+// UpgradeState saves and restores a part of the process state
+// that should survive an upgrade, like TLS session ticket keys.
+type UpgradeState struct {
+	// Save is called in the old process; its result is
+	// passed to Restore in the new process.
+	Save func() ([]byte, error)
+
+	// Restore is called in the new process before any
+	// servers are started.
+	Restore func([]byte) error
+}
+
+// upgradeStates are the registered upgrade states, by name.
+var upgradeStates = make(map[string]UpgradeState)
+
+// RegisterUpgradeState registers state to be handed over to
+// the new process during an upgrade under the name name.
+func RegisterUpgradeState(name string, state UpgradeState) {
+	if _, ok := upgradeStates[name]; ok {
+		panic("upgrade state " + name + " already registered")
+	}
+	upgradeStates[name] = state
+}
+
+// Upgrade re-launches the process, preserving the listeners
+// for a zero-downtime upgrade. It does NOT load new configuration;
+// it only starts the process anew with a fresh binary, which is
+// given the listeners, the current Caddyfile and any registered
+// UpgradeState. Once the new process reports that it is serving,
+// this process stops accepting connections, waits for in-flight
+// requests to finish (up to the graceful timeout of the servers)
+// and returns. The caller should then exit. If the new process
+// fails to start, or does not start in time, it is killed, an
+// error is returned and this process keeps serving as if nothing
+// happened.
+func Upgrade() error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("upgrading is not supported on Windows")
+	}
+
+	instancesMu.Lock()
+	if len(instances) == 0 {
+		instancesMu.Unlock()
+		return fmt.Errorf("no running instance to upgrade")
+	}
+	inst := instances[0] // we only support one instance at this time
+	instancesMu.Unlock()
+
+	handoff := upgradeHandoff{
+		Listeners: make(map[string]uintptr),
+		Packets:   make(map[string]uintptr),
+		Extras:    make(map[string]uintptr),
+		PidFile:   PidFile,
+		State:     make(map[string][]byte),
+	}
+	if cdyfile := inst.caddyfileInput; cdyfile != nil {
+		handoff.Caddyfile = CaddyfileInput{
+			Contents:       cdyfile.Body(),
+			Filepath:       cdyfile.Path(),
+			ServerTypeName: cdyfile.ServerType(),
+		}
+	}
+	for name, state := range upgradeStates {
+		data, err := state.Save()
+		if err != nil {
+			return fmt.Errorf("saving %s: %v", name, err)
+		}
+		handoff.State[name] = data
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+	handoffRead, handoffWrite, err := os.Pipe()
+	if err != nil {
+		readyWrite.Close()
+		return err
+	}
+	defer handoffWrite.Close()
+
+	// our copies of the files are closed once the new process has them
+	extraFiles := []*os.File{readyWrite, handoffRead}
+	defer func() {
+		for _, f := range extraFiles {
+			f.Close()
+		}
+	}()
+	for _, s := range inst.servers {
+		gs, ok := s.server.(GracefulServer)
+		if !ok {
+			continue
+		}
+		if ln, ok := s.listener.(Listener); ok {
+			file, err := ln.File()
+			if err != nil {
+				return err
+			}
+			handoff.Listeners[gs.Address()] = uintptr(firstInheritedFd + len(extraFiles) - 2)
+			extraFiles = append(extraFiles, file)
+		}
+		if pc, ok := s.packet.(PacketConn); ok {
+			file, err := pc.File()
+			if err != nil {
+				return err
+			}
+			handoff.Packets[gs.Address()] = uintptr(firstInheritedFd + len(extraFiles) - 2)
+			extraFiles = append(extraFiles, file)
+		}
+	}
+	extraListenersMu.Lock()
+	for addr, ln := range extraListeners {
+		file, err := ln.File()
+		if err != nil {
+			extraListenersMu.Unlock()
+			return err
+		}
+		handoff.Extras[addr] = uintptr(firstInheritedFd + len(extraFiles) - 2)
+		extraFiles = append(extraFiles, file)
+	}
+	extraListenersMu.Unlock()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnvVar+"=1")
+	cmd.ExtraFiles = extraFiles
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("starting new process: %v", err)
+	}
+	go cmd.Wait() // reap the process if it exits while we are still around
+
+	// starting the process put the shared sockets in blocking
+	// mode, which our servers cannot be stopped in
+	for _, f := range extraFiles[2:] {
+		restoreNonblock(f)
+	}
+
+	// the write end must only be open in the new process,
+	// so that we see EOF as soon as it exits
+	readyWrite.Close()
+
+	err = gob.NewEncoder(handoffWrite).Encode(handoff)
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("handing off to new process: %v", err)
+	}
+	handoffWrite.Close()
+
+	// a new process that hangs must not keep the
+	// old one from serving as if nothing happened
+	var answer []byte
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		answer, err = ioutil.ReadAll(readyRead)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("waiting for new process: %v", err)
+		}
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not start within %v", upgradeReadyTimeout)
+	}
+	if string(answer) != upgradeSuccess {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process failed to start")
+	}
+
+	// the new process is serving; stop this one without
+	// running final shutdown callbacks or removing the
+	// pidfile, which belongs to the new process now
+	for _, shutdownFunc := range inst.onShutdown {
+		err := shutdownFunc()
+		if err != nil {
+			log.Printf("[ERROR] Shutdown callback: %v", err)
+		}
+	}
+	inst.Stop()
+
+	log.Println("[INFO] Upgrade complete")
+	return nil
+}
+
+var (
+	upgradeHandoffOnce sync.Once
+	upgradeHandoffData *upgradeHandoff
+	upgradeHandoffErr  error
+)
+
+// loadUpgradeHandoff reads the handoff from the parent process.
+// It must only be called if IsUpgrade returns true.
+func loadUpgradeHandoff() (*upgradeHandoff, error) {
+	upgradeHandoffOnce.Do(func() {
+		file := os.NewFile(upgradeHandoffFd, "handoff")
+		defer file.Close()
+		handoff := new(upgradeHandoff)
+		err := gob.NewDecoder(file).Decode(handoff)
+		if err != nil {
+			upgradeHandoffErr = fmt.Errorf("reading handoff from parent process: %v", err)
+			return
+		}
+		upgradeHandoffData = handoff
+	})
+	return upgradeHandoffData, upgradeHandoffErr
+}
+
+// inheritUpgradeState restores the state handed off by the
+// parent process and returns its listeners, keyed by address,
+// for the servers to use.
+func inheritUpgradeState() (map[string]restartTriple, error) {
+	handoff, err := loadUpgradeHandoff()
+	if err != nil {
+		return nil, err
+	}
+
+	if PidFile == "" {
+		PidFile = handoff.PidFile
+	}
+	for name, data := range handoff.State {
+		state, ok := upgradeStates[name]
+		if !ok {
+			log.Printf("[WARNING] Upgrade: no way to restore %s; ignoring", name)
+			continue
+		}
+		err := state.Restore(data)
+		if err != nil {
+			return nil, fmt.Errorf("restoring %s: %v", name, err)
+		}
+	}
+
+	fds := make(map[string]restartTriple)
+	for addr, fd := range handoff.Listeners {
+		file := os.NewFile(fd, addr)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener for %s: %v", addr, err)
+		}
+		triple := fds[addr]
+		triple.listener = ln.(Listener)
+		fds[addr] = triple
+	}
+	for addr, fd := range handoff.Packets {
+		file := os.NewFile(fd, addr)
+		pc, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting packet conn for %s: %v", addr, err)
+		}
+		triple := fds[addr]
+		triple.packet = pc.(PacketConn)
+		fds[addr] = triple
+	}
+	extraListenersMu.Lock()
+	defer extraListenersMu.Unlock()
+	for addr, fd := range handoff.Extras {
+		file := os.NewFile(fd, addr)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener for %s: %v", addr, err)
+		}
+		inheritedExtras[addr] = ln.(Listener)
+	}
+	return fds, nil
+}
+
+var (
+	// extraListeners are the listeners made by ListenExtra
+	// that are open, and inheritedExtras the ones handed off
+	// by the parent process that are not taken yet, both
+	// keyed by address
+	extraListeners   = make(map[string]*extraListener)
+	inheritedExtras  = make(map[string]Listener)
+	extraListenersMu sync.Mutex
+)
+
+// ListenExtra listens on the TCP address addr for a listener
+// that is not the listener of a server, such as one that serves
+// a debugging endpoint. Like the listeners of the servers, it is
+// handed to the new process during an upgrade, in which the call
+// to ListenExtra for addr returns it, so that the new process
+// does not have to wait for the port to be free.
+func ListenExtra(addr string) (net.Listener, error) {
+	extraListenersMu.Lock()
+	defer extraListenersMu.Unlock()
+
+	ln, ok := inheritedExtras[addr]
+	if ok {
+		delete(inheritedExtras, addr)
+	} else {
+		tcpLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln = tcpLn.(*net.TCPListener)
+	}
+	extra := &extraListener{Listener: ln, addr: addr}
+	extraListeners[addr] = extra
+	return extra, nil
+}
+
+// closeInheritedExtras closes the listeners handed off by
+// the parent process that no ListenExtra call has taken.
+func closeInheritedExtras() {
+	extraListenersMu.Lock()
+	defer extraListenersMu.Unlock()
+	for addr, ln := range inheritedExtras {
+		ln.Close()
+		delete(inheritedExtras, addr)
+	}
+}
+
+// extraListener is a listener made by ListenExtra, which
+// is no longer handed off once it is closed.
+type extraListener struct {
+	Listener
+	addr string
+}
+
+// Close closes the listener.
+func (ln *extraListener) Close() error {
+	extraListenersMu.Lock()
+	if extraListeners[ln.addr] == ln {
+		delete(extraListeners, ln.addr)
+	}
+	extraListenersMu.Unlock()
+	return ln.Listener.Close()
+}
+
+var signalUpgradeParentOnce sync.Once
+
+// signalUpgradeParent tells the parent process whether this
+// process started successfully (err is nil) or not. Only the
+// first call has any effect.
+func signalUpgradeParent(err error) {
+	signalUpgradeParentOnce.Do(func() {
+		file := os.NewFile(upgradeReadyFd, "ready")
+		if err == nil {
+			file.Write([]byte(upgradeSuccess))
+		}
+		file.Close()
+	})
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package caddy
+
+import (
+	"os"
+	"syscall"
+)
+
+// restoreNonblock puts the file descriptor of f, which
+// is shared with a listener, back in non-blocking mode.
+func restoreNonblock(f *os.File) {
+	syscall.SetNonblock(int(f.Fd()), true)
+}
@@ -0,0 +1,212 @@
+package caddy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/caddyfile"
+)
+
+func init() {
+	RegisterServerType("upgradetest", ServerType{
+		NewContext: func() Context { return new(upgradeTestContext) },
+	})
+}
+
+// TestMain runs the process started by Upgrade in TestUpgrade,
+// which is this test binary, as the "new binary".
+func TestMain(m *testing.M) {
+	if IsUpgrade() {
+		runUpgradeChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runUpgradeChild serves the handed-off Caddyfile until a
+// request for /quit arrives (or a while has passed).
+func runUpgradeChild() {
+	if os.Getenv("CADDY_TEST_UPGRADE_FAIL") != "" {
+		os.Exit(1)
+	}
+	if os.Getenv("CADDY_TEST_UPGRADE_HANG") != "" {
+		time.Sleep(10 * time.Second)
+		os.Exit(1)
+	}
+	cdyfile, err := LoadCaddyfile("upgradetest")
+	if err != nil {
+		os.Exit(1)
+	}
+	if _, err := Start(cdyfile); err != nil {
+		os.Exit(1)
+	}
+	select {
+	case <-upgradeTestQuit:
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+var (
+	upgradeTestQuit        = make(chan struct{})
+	upgradeTestSlowStarted = make(chan struct{}, 1)
+)
+
+type upgradeTestContext struct {
+	keys []string
+}
+
+func (ctx *upgradeTestContext) InspectServerBlocks(_ string, sblocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, error) {
+	for _, sb := range sblocks {
+		ctx.keys = append(ctx.keys, sb.Keys...)
+	}
+	return sblocks, nil
+}
+
+func (ctx *upgradeTestContext) MakeServers() ([]Server, error) {
+	var servers []Server
+	for _, key := range ctx.keys {
+		servers = append(servers, &upgradeTestServer{addr: key})
+	}
+	return servers, nil
+}
+
+// upgradeTestServer responds with the pid of its process.
+type upgradeTestServer struct {
+	addr     string
+	ln       net.Listener
+	inFlight sync.WaitGroup
+}
+
+func (s *upgradeTestServer) Listen() (net.Listener, error) { return net.Listen("tcp", s.addr) }
+
+func (s *upgradeTestServer) ListenPacket() (net.PacketConn, error) { return nil, nil }
+
+func (s *upgradeTestServer) Serve(ln net.Listener) error {
+	s.ln = ln
+	return http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		switch r.URL.Path {
+		case "/slow":
+			upgradeTestSlowStarted <- struct{}{}
+			time.Sleep(200 * time.Millisecond)
+		case "/quit":
+			defer close(upgradeTestQuit)
+		}
+		w.Write([]byte(strconv.Itoa(os.Getpid())))
+	}))
+}
+
+func (s *upgradeTestServer) ServePacket(pc net.PacketConn) error { return nil }
+
+func (s *upgradeTestServer) Stop() error {
+	err := s.ln.Close()
+	s.inFlight.Wait()
+	return err
+}
+
+func (s *upgradeTestServer) Address() string { return s.addr }
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrading is not supported on Windows")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = Start(CaddyfileInput{Contents: []byte(addr), ServerTypeName: "upgradetest"})
+	if err != nil {
+		t.Fatalf("Expected no error starting, got: %v", err)
+	}
+	defer Stop()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	get := func(path string) (int, error) {
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(string(body))
+	}
+	pidAt := func(path string) int {
+		pid, err := get(path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return pid
+	}
+
+	// a new process that fails to start leaves this one serving
+	os.Setenv("CADDY_TEST_UPGRADE_FAIL", "1")
+	err = Upgrade()
+	os.Unsetenv("CADDY_TEST_UPGRADE_FAIL")
+	if err == nil {
+		t.Fatal("Expected an error when the new process fails, got none")
+	}
+	if pid := pidAt("/"); pid != os.Getpid() {
+		t.Fatalf("Expected old process (%d) to keep serving, got response from %d", os.Getpid(), pid)
+	}
+
+	// so does a new process that does not start in time
+	defer func(timeout time.Duration) { upgradeReadyTimeout = timeout }(upgradeReadyTimeout)
+	upgradeReadyTimeout = 200 * time.Millisecond
+	os.Setenv("CADDY_TEST_UPGRADE_HANG", "1")
+	start := time.Now()
+	err = Upgrade()
+	os.Unsetenv("CADDY_TEST_UPGRADE_HANG")
+	if err == nil {
+		t.Fatal("Expected an error when the new process hangs, got none")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the upgrade to give up after the timeout, took %v", elapsed)
+	}
+	if pid := pidAt("/"); pid != os.Getpid() {
+		t.Fatalf("Expected old process (%d) to keep serving, got response from %d", os.Getpid(), pid)
+	}
+	upgradeReadyTimeout = 2 * time.Minute
+
+	// a request in flight during the upgrade is drained
+	slow := make(chan int, 1)
+	go func() {
+		pid, _ := get("/slow")
+		slow <- pid
+	}()
+	<-upgradeTestSlowStarted
+
+	err = Upgrade()
+	if err != nil {
+		t.Fatalf("Expected no error upgrading, got: %v", err)
+	}
+	select {
+	case pid := <-slow:
+		if pid != os.Getpid() {
+			t.Errorf("Expected in-flight request to be finished by old process (%d), got %d", os.Getpid(), pid)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected in-flight request to be finished")
+	}
+
+	// the new process serves on the inherited listener
+	if pid := pidAt("/"); pid == os.Getpid() || pid == 0 {
+		t.Errorf("Expected response from new process, got %d (old process is %d)", pid, os.Getpid())
+	}
+	pidAt("/quit")
+}
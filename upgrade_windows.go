@@ -0,0 +1,7 @@
+package caddy
+
+import "os"
+
+// restoreNonblock does nothing, since Upgrade is
+// not supported on Windows.
+func restoreNonblock(f *os.File) {}